@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/base"
 )
 
 // Task represents a task to be performed.
@@ -31,6 +32,49 @@ func NewTask(typename string, payload map[string]interface{}) *Task {
 	}
 }
 
+// MessageCodec specifies the encoding of the task messages written to redis.
+//
+// Clients and backgrounds sharing the queues have to use the same codec;
+// a message encoded with another codec cannot be decoded, and is moved to
+// the malformed queue instead of being processed.
+type MessageCodec struct {
+	codec base.Codec
+}
+
+// Codecs of the task messages.
+var (
+	// JSONCodec encodes the task messages as JSON objects, which is
+	// the default and the format to enqueue tasks from other languages
+	// (see "Task Message Format" in README).
+	JSONCodec = MessageCodec{base.JSONCodec}
+
+	// GobCodec encodes the task messages with encoding/gob, except for
+	// the fields inspected by the redis scripts and the payloads, which
+	// stay encoded as JSON.
+	GobCodec = MessageCodec{base.GobCodec}
+)
+
+// Errors passed to OnMalformedTask for the messages which cannot be decoded
+// by the background.
+var (
+	// ErrCodecMismatch indicates that the message was encoded with another
+	// codec than the one of the background.
+	ErrCodecMismatch = base.ErrCodecMismatch
+
+	// ErrUnsupportedVersion indicates that the message was written with
+	// a newer version of the message schema than the one of the background,
+	// e.g. by a client upgraded before the backgrounds.
+	ErrUnsupportedVersion = base.ErrUnsupportedVersion
+)
+
+// baseCodec returns the codec of c, which is base.JSONCodec if c is zero.
+func (c MessageCodec) baseCodec() base.Codec {
+	if c.codec == nil {
+		return base.JSONCodec
+	}
+	return c.codec
+}
+
 // RedisConnOpt is a discriminated union of redis-client-option types.
 //
 // RedisConnOpt represents a sum of following types:
@@ -0,0 +1,127 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package asynqtest provides utilities for testing task handlers without redis.
+
+Broker is an in-memory stand-in for the redis-backed queues. Enqueued tasks
+are processed synchronously by the given handler when Run is called, with the
+same task state as in the background, so that Ack, Nack, RequestRetry,
+SetResult and the routing by queue of ServeMux work in the handler.
+
+Example:
+
+	func TestEmailHandler(t *testing.T) {
+		b := asynqtest.NewBroker(asynq.HandlerFunc(emailHandler))
+		b.Enqueue("send_welcome_email", map[string]interface{}{"user_id": 42})
+
+		for _, res := range b.Run() {
+			if res.Err != nil {
+				t.Errorf("processing %q failed: %v", res.Task.Type, res.Err)
+			}
+		}
+	}
+*/
+package asynqtest
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/hook"
+)
+
+// Broker is an in-memory task broker which runs tasks through a handler.
+//
+// Broker is safe for concurrent use by multiple goroutines, so a handler
+// may enqueue follow-up tasks to the broker while it's running.
+//
+// Tasks are in the default queue.
+type Broker struct {
+	// RequireAck makes tasks fail unless acknowledged by the handler,
+	// as with Config.RequireAck of the background.
+	RequireAck bool
+
+	handler asynq.Handler
+
+	mu      sync.Mutex
+	pending []*asynq.Task
+}
+
+// Result is the outcome of processing a task.
+type Result struct {
+	// Task is the task given to the handler.
+	Task *asynq.Task
+
+	// Err is the error the background would handle the task with, i.e.
+	// the error returned by the handler, or e.g. asynq.ErrNacked or
+	// asynq.ErrRetryRequested if the handler returned nil after calling
+	// Nack or RequestRetry.
+	// If the handler panicked, Err holds the recovered value.
+	//
+	// Nil if the task was processed successfully.
+	Err error
+}
+
+// NewBroker returns a new Broker which processes tasks with the given handler.
+func NewBroker(h asynq.Handler) *Broker {
+	return &Broker{handler: h}
+}
+
+// Enqueue adds a task to the broker.
+//
+// The payload is encoded to and decoded from JSON in the same way as it would
+// be when the task goes through redis (e.g. numbers are decoded as float64),
+// so that the handler sees the payload exactly as it would in production.
+// Enqueue returns an error if the payload cannot be serialized to JSON.
+func (b *Broker) Enqueue(typename string, payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, asynq.NewTask(typename, decoded))
+	return nil
+}
+
+// Len returns the number of tasks waiting to be processed.
+func (b *Broker) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Run processes the enqueued tasks in FIFO order until no task is left,
+// and returns the results in the order tasks were processed.
+//
+// Tasks enqueued by the handler during Run are processed in the same run.
+// Failed tasks are not retried.
+func (b *Broker) Run() []Result {
+	var results []Result
+	for {
+		task, ok := b.pop()
+		if !ok {
+			return results
+		}
+		results = append(results, Result{Task: task, Err: hook.Perform(b.handler, task, base.DefaultQueueName, b.RequireAck)})
+	}
+}
+
+func (b *Broker) pop() (*asynq.Task, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		return nil, false
+	}
+	task := b.pending[0]
+	b.pending = b.pending[1:]
+	return task, true
+}
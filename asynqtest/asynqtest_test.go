@@ -0,0 +1,153 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynqtest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestBroker(t *testing.T) {
+	var b *Broker
+	handler := func(task *asynq.Task) error {
+		switch task.Type {
+		case "signup":
+			id, err := task.Payload.GetInt("user_id")
+			if err != nil {
+				return err
+			}
+			return b.Enqueue("send_email", map[string]interface{}{"user_id": id})
+		case "send_email":
+			return nil
+		case "panic":
+			panic("something went terribly wrong")
+		default:
+			return fmt.Errorf("unknown task type %q", task.Type)
+		}
+	}
+	b = NewBroker(asynq.HandlerFunc(handler))
+
+	if err := b.Enqueue("signup", map[string]interface{}{"user_id": 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Enqueue("panic", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Enqueue("unknown", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Len(); got != 3 {
+		t.Fatalf("(*Broker).Len() = %d, want 3", got)
+	}
+
+	results := b.Run()
+
+	tests := []struct {
+		wantType string
+		wantErr  string // empty if no error is expected
+	}{
+		{"signup", ""},
+		{"panic", "panic: something went terribly wrong"},
+		{"unknown", `unknown task type "unknown"`},
+		{"send_email", ""},
+	}
+	if len(results) != len(tests) {
+		t.Fatalf("(*Broker).Run() returned %d results, want %d", len(results), len(tests))
+	}
+	for i, tc := range tests {
+		res := results[i]
+		if res.Task.Type != tc.wantType {
+			t.Errorf("results[%d].Task.Type = %q, want %q", i, res.Task.Type, tc.wantType)
+		}
+		gotErr := ""
+		if res.Err != nil {
+			gotErr = res.Err.Error()
+		}
+		if gotErr != tc.wantErr {
+			t.Errorf("results[%d].Err = %q, want %q", i, gotErr, tc.wantErr)
+		}
+	}
+	if got := b.Len(); got != 0 {
+		t.Errorf("(*Broker).Len() = %d after Run, want 0", got)
+	}
+}
+
+func TestBrokerEnqueueInvalidPayload(t *testing.T) {
+	b := NewBroker(asynq.HandlerFunc(func(task *asynq.Task) error { return nil }))
+	err := b.Enqueue("bad", map[string]interface{}{"ch": make(chan int)})
+	if err == nil {
+		t.Errorf("(*Broker).Enqueue with non-serializable payload returned nil, want error")
+	}
+	if got := b.Len(); got != 0 {
+		t.Errorf("(*Broker).Len() = %d, want 0", got)
+	}
+}
+
+func TestBrokerTaskState(t *testing.T) {
+	errReason := errors.New("payment declined")
+	mux := asynq.NewServeMux()
+	mux.HandleFunc("nack", func(task *asynq.Task) error {
+		asynq.Nack(task, nil)
+		return nil
+	})
+	mux.HandleFunc("nack_with_reason", func(task *asynq.Task) error {
+		asynq.Nack(task, errReason)
+		return nil
+	})
+	mux.HandleFunc("retry", func(task *asynq.Task) error {
+		asynq.RequestRetry(task)
+		return nil
+	})
+	mux.HandleFunc("ack", func(task *asynq.Task) error {
+		asynq.Ack(task)
+		return nil
+	})
+	mux.HandleFunc("no_ack", func(task *asynq.Task) error {
+		return nil
+	})
+	mux.HandleQueueDefault("default", asynq.HandlerFunc(func(task *asynq.Task) error {
+		return fmt.Errorf("routed to the default queue handler")
+	}))
+
+	tests := []struct {
+		typename   string
+		requireAck bool
+		want       error
+	}{
+		{"nack", false, asynq.ErrNacked},
+		{"nack_with_reason", false, errReason},
+		{"retry", false, asynq.ErrRetryRequested},
+		{"no_ack", false, nil},
+		{"no_ack", true, asynq.ErrNotAcked},
+		{"ack", true, nil},
+	}
+
+	for _, tc := range tests {
+		b := NewBroker(mux)
+		b.RequireAck = tc.requireAck
+		if err := b.Enqueue(tc.typename, nil); err != nil {
+			t.Fatal(err)
+		}
+		results := b.Run()
+		if len(results) != 1 {
+			t.Fatalf("(*Broker).Run() returned %d results, want 1", len(results))
+		}
+		if got := results[0].Err; got != tc.want {
+			t.Errorf("%q (RequireAck=%t): Err = %v, want %v", tc.typename, tc.requireAck, got, tc.want)
+		}
+	}
+
+	b := NewBroker(mux)
+	if err := b.Enqueue("unknown", nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "routed to the default queue handler"
+	if results := b.Run(); len(results) != 1 || results[0].Err == nil || results[0].Err.Error() != want {
+		t.Errorf("(*Broker).Run() = %v for a task of unknown type, want the error %q", results, want)
+	}
+}
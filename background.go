@@ -5,18 +5,22 @@
 package asynq
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
 )
 
 // Background is responsible for managing the background-task processing.
@@ -34,18 +38,98 @@ type Background struct {
 	mu      sync.Mutex
 	running bool
 
+	// shutdownHooks are the functions registered with OnShutdown.
+	shutdownHooks []func()
+
+	// id uniquely identifies the background instance.
+	id string
+
+	// signals to trigger the graceful shutdown.
+	signals []os.Signal
+
+	// signals to trigger the immediate shutdown.
+	immediateSignals []os.Signal
+
+	// coverage specifies how to check the handler coverage of the queues
+	// on start.
+	coverage HandlerCoverage
+
+	// concurrency is the concurrency set by Config.Concurrency or
+	// SetConcurrency, restored once the burst ends.
+	// burst is the timer to end the burst of BurstConcurrency, nil if
+	// there's no burst. Guarded by burstMu.
+	burstMu     sync.Mutex
+	concurrency int
+	burst       *time.Timer
+
+	// warmup is the duration to raise the concurrency from one to
+	// concurrency on start (see Config.ConcurrencyWarmup).
+	// warmupStop stops the raise in progress, nil if there's none.
+	// Guarded by burstMu.
+	warmup     time.Duration
+	warmupStop chan struct{}
+
 	rdb       *rdb.RDB
 	scheduler *scheduler
 	processor *processor
+
+	// leaser is nil unless InProgressLease is set.
+	leaser *leaser
+
+	// subscriber cancels the tasks of the types published by CancelByType.
+	subscriber *subscriber
+
+	logger *logger
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // Config specifies the background-task processing behavior.
 type Config struct {
 	// Maximum number of concurrent processing of tasks.
 	//
+	// More precisely, it's the max total weight of the tasks processed
+	// concurrently, where each task weighs one unless it's enqueued with
+	// Weight option.
+	//
 	// If set to zero or negative value, NewBackground will overwrite the value to one.
 	Concurrency int
 
+	// ConcurrencyWarmup specifies the duration to raise the concurrency
+	// gradually from one to Concurrency when the background starts, so that
+	// the dependencies of the handlers (e.g., a database) are not hit by
+	// a burst of tasks at once.
+	//
+	// SetConcurrency and BurstConcurrency end the warmup, since the
+	// concurrency they set takes precedence.
+	//
+	// If set to zero or negative value, the background starts with
+	// the full concurrency.
+	ConcurrencyWarmup time.Duration
+
+	// Maximum number of concurrent processing of tasks per task type.
+	// Keys are the task type names and values are the limits.
+	//
+	// Use it to keep tasks of a slow type from occupying all the workers.
+	// When the limit of a type is reached, a dequeued task of the type is
+	// put back to the tail of its queue so that tasks of other types proceed.
+	//
+	// Types not in the map (or with zero or negative value) are only
+	// limited by Concurrency.
+	TypeConcurrency map[string]int
+
+	// Maximum number of concurrent processing of tasks per category
+	// (see Category option), regardless of their types and queues.
+	//
+	// Keys are the category names and values are the limits.
+	// When the limit of a category is reached, a dequeued task of the category
+	// is put back to the tail of its queue as with TypeConcurrency.
+	//
+	// Categories not in the map (or with zero or negative value) are only
+	// limited by Concurrency.
+	CategoryConcurrency map[string]int
+
 	// Function to calculate retry delay for a failed task.
 	//
 	// By default, it uses exponential backoff algorithm to calculate the delay.
@@ -53,12 +137,202 @@ type Config struct {
 	// n is the number of times the task has been retried.
 	// e is the error returned by the task handler.
 	// t is the task in question.
+	//
+	// If the error returned by the task handler suggests a delay (see RetryAfter),
+	// the suggested delay is used instead of the one returned by this function.
+	// The function is not called for tasks enqueued with RetrySchedule option.
 	RetryDelayFunc func(n int, e error, t *Task) time.Duration
 
+	// Functions to calculate retry delay of the tasks in the given queues,
+	// e.g. to retry tasks in a latency sensitive queue sooner. Keys are the
+	// names of the queues and values are functions called in the same way
+	// as RetryDelayFunc.
+	//
+	// Tasks in a queue with no function in QueueRetryDelayFuncs are retried
+	// with the delay calculated by RetryDelayFunc.
+	//
+	// Example:
+	// QueueRetryDelayFuncs: map[string]func(int, error, *asynq.Task) time.Duration{
+	//     "critical": func(n int, e error, t *asynq.Task) time.Duration { return time.Second },
+	// }
+	QueueRetryDelayFuncs map[string]func(n int, e error, t *Task) time.Duration
+
+	// Function to decide what to do with a task for which the handler returned an error.
+	//
+	// retried is the number of times the task has been retried.
+	// maxRetry is the max retry count of the task specified by MaxRetry option.
+	//
+	// By default, the task is killed if retried >= maxRetry, otherwise retried.
+	//
+	// If set, the decision returned by the function takes precedence over
+	// the max retry count (e.g., returning Retry for a task which has
+	// exhausted its retry count will retry the task once more).
+	// Compare retried with maxRetry to honor the MaxRetry option.
+	//
+	// It's not called for the errors classified as Permanent
+	// (see ErrorClassifiers).
+	RetryDecider func(task *Task, err error, retried, maxRetry int) Decision
+
+	// ErrorClassifiers classify the errors returned by handlers centrally,
+	// e.g. to tell validation errors from network errors. The classifiers are
+	// called in order, and the first class other than Unclassified is used.
+	//
+	// Errors left unclassified by them are Permanent if they wrap ErrPermanent,
+	// and Retryable if they or any error they wrap have a method
+	// Temporary() bool returning true, as temporary network errors do.
+	//
+	// A task failed with a Permanent error is sent to the dead queue right
+	// away, regardless of the retries left by the MaxRetry option. Other
+	// errors are handled by RetryDecider, so tasks failed with Retryable
+	// errors are still retried only up to the max retry count.
+	ErrorClassifiers []func(err error) ErrorClass
+
+	// RetryPriorityBoost specifies how much to raise the priority of a task
+	// within its queue (see asynq.Priority) each time the task is retried,
+	// so that retried tasks, which have been waiting already, are processed
+	// ahead of fresh tasks of a lower priority. The priority is capped at
+	// the max priority level.
+	//
+	// To retry a task on a higher priority queue instead, see RetryOnQueue.
+	//
+	// If set to zero or negative value, the priority is kept on retry.
+	RetryPriorityBoost int
+
+	// Max number of due retry tasks moved back to each queue per
+	// RetryPromotionInterval.
+	//
+	// Use it to smooth the recovery after an outage, when a flood of retry
+	// tasks become due at once and would overwhelm the workers and the
+	// recovering dependency again. The tasks left over are moved in the
+	// following intervals, oldest first.
+	//
+	// If set to zero or negative value, all due retry tasks are moved at once.
+	RetryPromotionLimit int
+
+	// Interval at which RetryPromotionLimit applies.
+	//
+	// If set to zero or negative value, it defaults to one second.
+	// It's ignored if RetryPromotionLimit is not set.
+	RetryPromotionInterval time.Duration
+
+	// Function called after a task is processed successfully.
+	//
+	// latency is the time the task spent in the system, from when it was
+	// first registered by the client until its completion. It counts from the
+	// first enqueue for retried tasks, and includes the delay for scheduled tasks.
+	// latency is zero if unknown (e.g., the task was enqueued by an older version).
+	//
+	// The function is called from the worker goroutine, so it should not block
+	// for long (e.g., recording latency to a metrics histogram is fine).
+	OnSuccess func(task *Task, latency time.Duration)
+
+	// Collector to receive the metrics of the processed tasks, e.g. to
+	// export them to StatsD with the statsd package.
+	//
+	// The durations are not recorded for the tasks processed in batches
+	// or timed out.
+	//
+	// If unset, metrics are not collected.
+	Metrics MetricsCollector
+
+	// Exporter to archive the tasks sent to the dead queue, e.g. to a file
+	// with NewJSONExporter or to an object store, before they're deleted
+	// from redis by the limits of the dead queue (see MaxDeadTasks).
+	//
+	// The tasks are exported right after they're killed. The failure of
+	// the export is logged, and the task stays in the dead queue regardless.
+	// Tasks killed with asynqmon or killed along with the tasks they depend
+	// on (see KillDependents) are not exported.
+	//
+	// If unset, dead tasks are not exported.
+	DeadTaskExporter DeadTaskExporter
+
+	// ExportDeadTasksAsync indicates whether the dead tasks should be
+	// exported in separate goroutines, so that a slow exporter doesn't hold
+	// the worker. The background waits for the exports to finish on shutdown.
+	//
+	// If set to false, the worker waits for the export before it picks up
+	// the next task.
+	ExportDeadTasksAsync bool
+
+	// Function called after a failed task is sent to the retry queue.
+	//
+	// delay is the retry delay computed by RetryDelayFunc, i.e. the duration
+	// the task waits in the retry queue. Record it to a metrics histogram to
+	// see whether the backoff is too aggressive or too lax.
+	//
+	// The function is called from the worker goroutine, so it should not block
+	// for long.
+	OnRetry func(task *Task, delay time.Duration)
+
+	// Function called after a task pulled out of the queue during shutdown,
+	// before it was handed to a worker, is moved back to the queue.
+	//
+	// Use it to count the tasks deferred by the shutdown. It's not called for
+	// the tasks moved to the abandoned queue (see AbandonUnfinished), nor for
+	// the unfinished tasks of terminated workers, which are restored in bulk.
+	// A panic in the function is recovered and logged.
+	OnRequeue func(task *Task)
+
+	// Function called after a message pulled out of the queue, which cannot
+	// be decoded into a task (e.g., it was pushed to the queue by a buggy
+	// producer), is moved to the malformed queue.
+	//
+	// data is the raw data of the message as stored in redis, and err is the
+	// decoding error, which matches ErrCodecMismatch or ErrUnsupportedVersion
+	// with errors.Is if the message was written with another codec or with
+	// a newer version of the message schema. The message is not processed
+	// nor retried; it stays in the malformed queue until removed.
+	// A panic in the function is recovered and logged.
+	OnMalformedTask func(data []byte, err error)
+
+	// Maximum number of tasks to pull out of a queue in one round trip to
+	// redis. The tasks pulled out together are handed to workers one by one,
+	// which amortizes the latency of redis under high throughput.
+	//
+	// Prefetched tasks are tracked as in-progress tasks. On shutdown, the
+	// ones not handed to workers yet are moved back to the queue.
+	// Note that prefetching favors the queue the tasks are pulled out of,
+	// so keep it small (e.g., 10) relative to the number of tasks processed
+	// per second.
+	//
+	// If set to zero or one, tasks are pulled out one at a time.
+	Prefetch int
+
+	// If set, workers run on a pool of long running goroutines instead of
+	// goroutines started for each task, which reduces the overhead of
+	// starting goroutines when processing a high throughput of short tasks.
+	//
+	// The pool has two goroutines per Concurrency, for each worker and the
+	// handler it runs. Goroutines are started beyond the pool only if all of
+	// them are busy, e.g. when handlers of terminated tasks are left running.
+	WorkerPool bool
+
+	// Interval to report the number of workers still processing tasks while
+	// waiting for them to finish on shutdown, e.g. "Waiting for 5 workers
+	// to finish...".
+	//
+	// If unset or zero, the interval is set to 1 second.
+	DrainReportInterval time.Duration
+
+	// Function called on each report while waiting for workers to finish
+	// on shutdown, with the number of workers still processing tasks.
+	// See DrainReportInterval.
+	// A panic in the function is recovered and logged.
+	OnDrainProgress func(remaining int)
+
 	// List of queues to process with given priority level. Keys are the names of the
 	// queues and values are associated priority level.
 	//
 	// If set to nil or not specified, the background will process only the "default" queue.
+	// The same applies if no queue has a positive priority level.
+	//
+	// Otherwise, every queue has to have a positive priority level, and
+	// NewBackground panics if a queue has zero priority, since the queue
+	// would never be processed. To leave a queue unprocessed, remove it from
+	// Queues or use ProcessQueues. NewBackground logs a warning if the highest
+	// priority is more than 1000 times the lowest one, since the lowest
+	// priority queues would hardly be processed while the others are busy.
 	//
 	// Priority is treated as follows to avoid starving low priority queues.
 	//
@@ -73,12 +347,550 @@ type Config struct {
 	// the time respectively.
 	Queues map[string]uint
 
+	// PollInterval specifies how long a processor waits for a task when
+	// the queues are empty, before checking the queues again.
+	//
+	// Waiting on an empty queue has a resolution of a second, so the
+	// interval is rounded up to whole seconds and the minimum interval is
+	// 1 second. Each wait is followed by a random sleep of up to a half of
+	// the interval, so that idle backgrounds don't query redis in lockstep.
+	// Each wait is split into blocks of at most a second, so that the
+	// processor stops promptly on shutdown.
+	//
+	// If set to zero or negative value, the interval defaults to 1 second.
+	PollInterval time.Duration
+
+	// MaxPolledQueues specifies the max number of queues to check for a task
+	// at a time, to bound the cost of pulling a task out of many queues.
+	//
+	// If more queues are to be processed, the background checks the first
+	// half of the queues in the priority order (strict or random, see
+	// StrictPriority) and rotates through the rest with the other half,
+	// so that every queue is checked over time.
+	//
+	// If set to zero or negative value, all queues are checked at a time.
+	MaxPolledQueues int
+
+	// ForwardInterval specifies how often to move the scheduled and retry tasks
+	// which are due into the queues to be processed.
+	//
+	// The tasks are moved by a goroutine of their own, so the interval
+	// holds regardless of whether the workers are idle or busy.
+	//
+	// If set to zero or negative value, the interval defaults to 5 seconds.
+	ForwardInterval time.Duration
+
+	// Handlers to process tasks of the given queues. Keys are the names of the
+	// queues and values are the handlers for the tasks in the queue.
+	//
+	// Tasks in a queue with no handler in QueueHandlers are processed by
+	// the handler passed to Run.
+	//
+	// Example:
+	// QueueHandlers: map[string]asynq.Handler{
+	//     "emails": emailHandler,
+	//     "images": imageHandler,
+	// }
+	QueueHandlers map[string]Handler
+
+	// Queues to process in batches. Keys are the names of the queues and
+	// values specify the handler and the max size of the batches.
+	//
+	// Tasks in these queues are passed to the batch handler, up to Batch.Size
+	// tasks at a time, instead of the handler passed to Run or QueueHandlers.
+	// A batch takes a single worker, and TypeConcurrency, CategoryConcurrency
+	// and task timeouts do not apply to the tasks in a batch.
+	//
+	// Example:
+	// Batches: map[string]asynq.Batch{
+	//     "events": {Handler: eventsHandler, Size: 100},
+	// }
+	Batches map[string]Batch
+
+	// HandlerCoverage specifies whether to check on start that each of the
+	// queues to process has a handler for the tasks of any type, to catch
+	// a queue whose tasks would all fail for lack of a handler.
+	//
+	// A queue is covered if it's processed in batches, or if its handler,
+	// from QueueHandlers or else the one passed to Run, is a ServeMux with
+	// a default handler (see HandleDefault) or a default handler of the
+	// queue (see HandleQueueDefault). Handlers other than ServeMux are
+	// assumed to handle any task. Queues discovered at run time (see
+	// DiscoverQueues) are not checked.
+	//
+	// By default, the coverage is not checked.
+	HandlerCoverage HandlerCoverage
+
+	// Circuit breakers of the queues. Keys are the names of the queues and
+	// values specify when to stop processing the queue.
+	//
+	// A circuit breaker stops this background from pulling tasks out of
+	// the queue for a cool-down period when most of the recently processed
+	// tasks of the queue failed, to avoid retrying tasks which are bound to fail.
+	// See CircuitBreaker for details.
+	//
+	// Example:
+	// CircuitBreakers: map[string]asynq.CircuitBreaker{
+	//     "payments": {FailureRate: 0.8, CoolDown: time.Minute},
+	// }
+	CircuitBreakers map[string]CircuitBreaker
+
+	// List of queue names to restrict the processing of this background to.
+	// Each name must be a key of Queues, and the priority levels from Queues apply.
+	//
+	// It allows instances running the same config to process different subsets
+	// of the queues (e.g., set from an environment variable to partition the fleet).
+	//
+	// If set to nil or empty, all queues in Queues are processed.
+	// NewBackground panics if a name is not in Queues.
+	ProcessQueues []string
+
+	// DiscoverQueues indicates whether to process the queues created at runtime
+	// in addition to the ones in Queues.
+	//
+	// If set to true, the background periodically checks for the queues which
+	// have been enqueued to and processes the ones missing from Queues with the
+	// priority level of 1 (after normalizing the priority levels in Queues).
+	//
+	// Note: Every queue name ever enqueued to is processed, so the number of
+	// queues can grow without bound (e.g., if queue names are derived from
+	// user input), which slows down dequeuing since each empty queue is polled.
+	// Remove unused queues with asynqmon's "rmq" command.
+	//
+	// It's ignored if ProcessQueues is set.
+	DiscoverQueues bool
+
 	// StrictPriority indicates whether the queue priority should be treated strictly.
 	//
 	// If set to true, tasks in the queue with the highest priority is processed first.
 	// The tasks in lower priority queues are processed only when those queues with
 	// higher priorities are empty.
 	StrictPriority bool
+
+	// QueueSelector determines the order to check the queues for a task,
+	// for fairness needs not met by the priority levels (e.g., deficit round
+	// robin among tenants). See QueueSelector.
+	//
+	// If set, StrictPriority, StarvationGuard and DepthAwarePriority are
+	// ignored. If nil, WeightedSelector is used, or StrictSelector if
+	// StrictPriority is set.
+	QueueSelector QueueSelector
+
+	// Starvation guard for strict priority mode.
+	//
+	// If set to a positive number n, after n tasks in a row are processed from
+	// queues other than the lowest priority one, the queues are checked in
+	// reverse order of their priority for the next task, so that the lower
+	// priority queues are not starved by the higher priority queues which
+	// never get empty.
+	//
+	// If set to zero or negative value, or StrictPriority is false, it's ignored.
+	StarvationGuard int
+
+	// DepthAwarePriority indicates whether the queues should be weighted by
+	// both their priority and the number of their pending tasks.
+	//
+	// If set to true, a queue with a large backlog gets more attention than
+	// its priority alone suggests, in proportion to its share of the pending
+	// tasks, while a queue with few tasks keeps at least its priority weight.
+	// The pending tasks are counted once per second.
+	//
+	// It's ignored if StrictPriority is true.
+	DepthAwarePriority bool
+
+	// Priority aging period of the queues processed by the background.
+	//
+	// Tasks with a higher priority are processed ahead of other tasks in the
+	// same queue (see Priority option), so a low priority task can be overtaken
+	// by higher priority tasks forever. If set to a positive duration d, a task
+	// gains one priority level over the tasks enqueued after it for each d it
+	// waits in the queue (e.g., with d of one minute, a task of priority 1
+	// which has waited for three minutes is processed ahead of a fresh task
+	// of priority 3).
+	//
+	// The period is stored in redis on start, so that the clients enqueueing
+	// to the queues follow it; it applies to the tasks enqueued afterwards.
+	// Backgrounds processing the same queues should use the same period,
+	// otherwise the last one started wins.
+	//
+	// If set to zero or negative value, priority aging is disabled.
+	PriorityAging time.Duration
+
+	// Namespace of the redis keys used by the background.
+	//
+	// Keys are prefixed with the namespace and a colon (e.g., "myapp:asynq:queues:default"),
+	// so that multiple applications can share a redis instance without
+	// seeing each other's tasks. Clients enqueueing tasks to be processed by the
+	// background have to use the same namespace (see Namespace client option).
+	//
+	// If set to empty string, the keys are not prefixed.
+	Namespace string
+
+	// Codec of the task messages written to redis. Clients enqueueing tasks
+	// to be processed by the background have to use the same codec
+	// (see Codec client option).
+	//
+	// If unset, the messages are encoded with JSONCodec.
+	Codec MessageCodec
+
+	// Format of the logs of the background.
+	//
+	// By default, lines prefixed with the level are logged with the standard
+	// log package. Use JSONLog to log structured lines for log pipelines.
+	LogFormat LogFormat
+
+	// Least severe level of the logs of the background.
+	//
+	// By default, INFO, WARN and ERROR lines are logged. Use DebugLevel to
+	// log the DEBUG lines with the details of each task as well.
+	LogLevel LogLevel
+
+	// KeepCompleted specifies how long to keep a record of each completed task.
+	//
+	// A record holds the task ID, type, queue, completion time and the time
+	// it took to process the task, and can be listed for auditing purposes.
+	// At most 10,000 records are kept; the oldest ones are evicted first.
+	//
+	// If set to zero or negative value, no records are kept.
+	KeepCompleted time.Duration
+
+	// Maximum number of dead tasks to keep per queue.
+	//
+	// Once a queue reaches the limit, the oldest dead task of the queue is
+	// evicted to make room for the new one.
+	//
+	// If set to zero or negative value, only the default retention policy applies
+	// (i.e. dead tasks are kept for 90 days, up to 10,000 tasks across all queues).
+	MaxDeadTasks int
+
+	// RetryQueueTTL and DeadQueueTTL, if positive, set the expiration of the
+	// retry and dead queues, refreshed each time a task is written to them.
+	//
+	// A queue which gets no new tasks for the duration expires, and its
+	// tasks are deleted along with it, so that an idle queue eventually
+	// frees its memory even if its tasks are never cleaned up.
+	//
+	// If set to zero or negative value, the queue never expires.
+	RetryQueueTTL time.Duration
+	DeadQueueTTL  time.Duration
+
+	// KillDependents specifies whether to kill the tasks waiting for a task
+	// (see DependsOn) when the task is killed.
+	//
+	// If true, the waiting tasks are sent to the dead queue, along with the
+	// tasks waiting for them. Otherwise they keep waiting, so that they're
+	// processed if the dead task is enqueued again and completes.
+	// The tasks waiting for a dropped task are always killed, since the task
+	// cannot be enqueued again.
+	//
+	// By default, the waiting tasks keep waiting.
+	KillDependents bool
+
+	// Maximum length in bytes of the error message stored with a task
+	// which is sent to retry or dead queue.
+	//
+	// Longer error messages (e.g., the ones with a stack dump) are truncated
+	// to the limit and marked with "...(truncated)" to avoid bloating redis.
+	//
+	// If set to zero or negative value, it defaults to 4096 bytes.
+	MaxErrorLength int
+
+	// Maximum number of times to process a task over its lifetime.
+	//
+	// Unlike the retry count of a task, it counts all attempts including
+	// the snoozed ones (see Snooze), so that a task which keeps getting
+	// snoozed cannot stay in the queues forever. A task which has been
+	// processed MaxAttempts times is sent to the dead queue instead of being
+	// processed again.
+	//
+	// If set to zero or negative value, there's no limit.
+	MaxAttempts int
+
+	// AbandonUnfinished indicates whether tasks interrupted by a shutdown
+	// should be moved to the "abandoned" queue instead of being requeued.
+	//
+	// By default, tasks which were pulled out of a queue but did not finish
+	// before the shutdown are put back to the queue, either during the shutdown
+	// or on the next start. This gives at-least-once delivery: a task whose
+	// handler was interrupted midway will be processed again, so handlers
+	// should be idempotent.
+	//
+	// If set to true, those tasks are moved to the "abandoned" queue for
+	// manual review and are never processed again automatically. This gives
+	// at-most-once delivery, at the cost of tasks left unprocessed.
+	AbandonUnfinished bool
+
+	// HandoffOnShutdown indicates whether tasks interrupted by a shutdown
+	// should be handed off to the other running backgrounds instead of being
+	// requeued, e.g. in a rolling deploy.
+	//
+	// If set to true, the tasks whose handlers are still running when the
+	// shutdown times out are moved to the handoff lists of their queues,
+	// from which the backgrounds processing the queues dequeue them ahead of
+	// the other tasks. Handed off tasks are marked until they're finished,
+	// so that a background restoring the unfinished tasks on start, e.g.
+	// the one restarted, doesn't requeue them while another background
+	// processes them. Backgrounds processing the same queues should all
+	// set it.
+	//
+	// The in-progress list is not restored on shutdown then; tasks left in it
+	// are restored on the next start. It takes precedence over
+	// AbandonUnfinished on shutdown.
+	HandoffOnShutdown bool
+
+	// HandoffTTL specifies how long the tasks handed off on shutdown are
+	// marked as taken over by another background.
+	//
+	// Once the mark expires, e.g. the background which took over a task
+	// crashed before finishing it, the task is restored on start as any
+	// other unfinished task. It should be longer than the time to dequeue
+	// and process a handed off task.
+	//
+	// If set to zero or negative value, the TTL defaults to 1 hour.
+	HandoffTTL time.Duration
+
+	// RecentEventsSize specifies the number of the latest processing events,
+	// i.e. tasks started, succeeded and failed, to keep in memory for
+	// RecentEvents, e.g. to show what just happened on a debug page.
+	// The oldest events are discarded once the number is reached.
+	//
+	// If set to zero or negative value, events are not kept.
+	RecentEventsSize int
+
+	// TypeLatencySamples specifies the number of the latest durations of
+	// the handler to keep per task type, from which TypeLatencies computes
+	// the percentiles, e.g. 1000, so that the memory used is bounded by the
+	// number of durations times the number of task types.
+	//
+	// The durations are the wall-clock time until the handler returns, and
+	// are not kept for the tasks processed in batches or timed out.
+	//
+	// If set to zero or negative value, durations are not kept.
+	TypeLatencySamples int
+
+	// StateUpdateTimeout specifies how long to keep retrying, with backoff,
+	// to record the result of a processed task in redis, i.e. to mark it as
+	// done or to send it to the retry or dead queue, if redis fails e.g.
+	// on a transient network error.
+	//
+	// If the result can't be recorded in time, the error is logged and the
+	// task is left in the in-progress list, to be restored and processed
+	// again, so handlers should be idempotent (see AbandonUnfinished).
+	//
+	// If set to zero, the timeout defaults to 3 seconds.
+	// If set to negative value, the result is not retried.
+	StateUpdateTimeout time.Duration
+
+	// RestoreLockTTL, if positive, coordinates the restore of the unfinished
+	// tasks on start, so that backgrounds restarted together (e.g. in a
+	// rolling deploy) don't all move the shared in-progress list at once.
+	//
+	// The first background to start takes a lock in redis which expires
+	// after RestoreLockTTL, and the others starting while the lock is held
+	// skip the restore. Tasks left unfinished by those are restored on
+	// the next start after the lock expires.
+	//
+	// It has no effect with InProgressLease, since each background restores
+	// only its own in-progress list then.
+	//
+	// By default, each background restores the unfinished tasks on start.
+	RestoreLockTTL time.Duration
+
+	// MaxDequeueRate specifies the max number of redis commands per second
+	// the background sends to pull tasks out of the queues, to protect redis
+	// in large deployments. Each command pulls one task, or up to Prefetch
+	// tasks or a batch (see Batches) at once.
+	//
+	// If set to zero or negative value, there's no limit.
+	MaxDequeueRate float64
+
+	// DeadRetryInterval and DeadRetryAttempts specify a slow retry policy
+	// for the tasks which would be sent to the dead queue, e.g. once their
+	// retries are exhausted.
+	//
+	// Such a task is kept in the deferred dead queue instead, and processed
+	// again after DeadRetryInterval, up to DeadRetryAttempts times, before
+	// it's sent to the dead queue for good. Each of these attempts makes
+	// a single try, and counts as a failure if it fails.
+	//
+	// Canceled tasks, the tasks failed with a Permanent error (see
+	// ErrorClassifiers) and the tasks whose deadline would pass before the
+	// next attempt are killed right away.
+	//
+	// By default, or if either is zero or negative, tasks are killed right away.
+	DeadRetryInterval time.Duration
+	DeadRetryAttempts int
+
+	// VisibilityTimeout enables the visibility timeout model, in which a task
+	// being processed is invisible for the timeout. The task is acknowledged
+	// once it's finished, e.g. done or sent to the retry queue, and a task
+	// still invisible after the timeout, e.g. since the background processing
+	// it crashed, is moved back to its queue by any of the backgrounds
+	// without waiting for a restart.
+	//
+	// A handler processing a task longer than the timeout has to extend it
+	// with ExtendVisibility. Otherwise, the task may be processed again
+	// while it's still processed.
+	//
+	// With InProgressLease, each background moves only the tasks of its own
+	// in-progress list back to the queues.
+	//
+	// If set to zero or negative value, tasks are not hidden.
+	VisibilityTimeout time.Duration
+
+	// DropExpiredUnfinished indicates whether unfinished tasks past their
+	// deadline (see asynq.Deadline) should be dropped instead of being sent
+	// to the dead queue when they're restored.
+	//
+	// Unfinished tasks past their deadline are not put back to the queue,
+	// since processing them is pointless. By default, they're sent to the
+	// dead queue to be reviewed; if set to true, they're deleted.
+	DropExpiredUnfinished bool
+
+	// Duration of the lease on the in-progress list of the background.
+	//
+	// By default, all backgrounds share one list of the tasks being processed,
+	// and the unfinished tasks are restored on start, which also moves the
+	// tasks being processed by other running backgrounds back to the queues.
+	//
+	// If set to a positive duration, the background keeps the tasks it's
+	// processing in its own list under a lease, which it extends periodically.
+	// On shutdown, only the tasks of the list are restored. If a background
+	// dies without restoring them, the tasks are moved back to their queues by
+	// another background once the lease expires, even if AbandonUnfinished
+	// is set. Backgrounds processing the same queues should all set it.
+	//
+	// If set to zero or negative value, the shared list is used.
+	InProgressLease time.Duration
+
+	// AffinityTTL enables the routing of the tasks with an affinity key
+	// (see asynq.Affinity) between the backgrounds, if InProgressLease
+	// is also set.
+	//
+	// A task is routed to the background which processed a task of the same
+	// queue with the key within AffinityTTL, as long as the background holds
+	// its lease, so that the tasks of a key tend to be processed by the same
+	// background. Otherwise, the task is processed by the background pulling
+	// it out of the queue, which takes over the key. The tasks routed to a
+	// background are moved back to their queues once its lease is released
+	// or expires.
+	//
+	// If set to zero or negative value, tasks are not routed.
+	AffinityTTL time.Duration
+
+	// DedupWindow, if positive, makes the background remember the IDs of the
+	// completed tasks for the duration, and skip a task whose ID is remembered
+	// without calling the handler, e.g. a task restored after the background
+	// processing it died before removing it from the in-progress queue.
+	// Backgrounds share the IDs, so that a completed task is not processed
+	// again by any of them within the window.
+	//
+	// It costs an extra round trip to redis per task, and has no effect on
+	// the tasks processed in batches.
+	//
+	// If set to zero or negative value, the IDs are not remembered.
+	DedupWindow time.Duration
+
+	// RetryUnhandled indicates whether tasks with no matching handler
+	// should be retried like any other failed task.
+	//
+	// A handler reports that it has no handler for a task by returning an error
+	// wrapping ErrHandlerNotFound (as ServeMux does for unregistered task types).
+	//
+	// By default, such tasks are moved to the dead queue immediately, so that
+	// they don't go through retries which would fail all the same.
+	// Set to true to retry them instead, e.g. during a rolling deploy where
+	// another background instance may have the handler.
+	RetryUnhandled bool
+
+	// RequireAck enables the strict mode, in which a handler has to call Ack
+	// with the task for the task to count as done.
+	//
+	// A task whose handler returns nil without calling Ack is logged as
+	// suspicious and treated as failed with ErrNotAcked, so that a handler
+	// which silently does nothing due to a bug doesn't lose the task.
+	// A batch handler has to call Ack with each of the tasks it processed.
+	RequireAck bool
+
+	// FinishClaimedOnShutdown enables the soft abort on shutdown: a task
+	// pulled out of the queue right before the shutdown starts, while all
+	// workers are busy, waits for a worker to finish and is processed within
+	// the shutdown timeout, instead of being sent back to the queue.
+	//
+	// The task is sent back to the queue if no worker finishes in time.
+	FinishClaimedOnShutdown bool
+
+	// TrackStartTimes indicates whether to record in redis the time at which
+	// each task starts to be processed, so that the tasks in progress for
+	// abnormally long (e.g., due to a hung handler) can be listed with
+	// "asynqmon ls stuck".
+	//
+	// It takes two more round trips to redis per task.
+	TrackStartTimes bool
+
+	// List of os signals to trigger the graceful shutdown of the background.
+	//
+	// If set to nil or not specified, SIGTERM and SIGINT are used.
+	//
+	// Note: SIGTSTP is always handled to stop processing new tasks,
+	// and should not be included in this list.
+	ShutdownSignals []os.Signal
+
+	// List of os signals to trigger the immediate shutdown of the background.
+	//
+	// On an immediate shutdown, the in-flight tasks are not waited for: the
+	// workers stop right away, and their tasks are put back to the queue.
+	// A signal in this list also cuts a graceful shutdown in progress short,
+	// e.g. with ShutdownSignals of SIGTERM and ImmediateShutdownSignals of
+	// SIGQUIT, SIGTERM starts draining the workers and a later SIGQUIT
+	// terminates them.
+	//
+	// If set to nil or not specified, no signal triggers the immediate shutdown.
+	ImmediateShutdownSignals []os.Signal
+}
+
+// Decision specifies how to handle a task for which the handler returned an error.
+type Decision int
+
+const (
+	// Retry schedules the task to be retried after a delay computed by
+	// RetryDelayFunc. The attempt counts toward the max retry count.
+	Retry Decision = iota
+
+	// Kill moves the task to the dead queue.
+	Kill
+
+	// Snooze schedules the task to be processed again after a delay computed by
+	// RetryDelayFunc. Unlike Retry, the attempt does not count toward the max
+	// retry count nor as a failure.
+	Snooze
+
+	// Drop discards the task without retrying it.
+	Drop
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Retry:
+		return "Retry"
+	case Kill:
+		return "Kill"
+	case Snooze:
+		return "Snooze"
+	case Drop:
+		return "Drop"
+	default:
+		return fmt.Sprintf("Decision(%d)", int(d))
+	}
+}
+
+// defaultRetryDecider kills the task if it has exhausted its retry count,
+// otherwise retries the task.
+func defaultRetryDecider(task *Task, err error, retried, maxRetry int) Decision {
+	if retried >= maxRetry {
+		return Kill
+	}
+	return Retry
 }
 
 // Formula taken from https://github.com/mperham/sidekiq.
@@ -92,6 +904,12 @@ var defaultQueueConfig = map[string]uint{
 	base.DefaultQueueName: 1,
 }
 
+// defaultForwardInterval is the interval to move due scheduled and retry
+// tasks into the queues if none is specified.
+const defaultForwardInterval = 5 * time.Second
+
+var defaultShutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+
 // NewBackground returns a new Background given a redis connection option
 // and background processing configuration.
 func NewBackground(r RedisConnOpt, cfg *Config) *Background {
@@ -103,20 +921,148 @@ func NewBackground(r RedisConnOpt, cfg *Config) *Background {
 	if delayFunc == nil {
 		delayFunc = defaultDelayFunc
 	}
-	queues := cfg.Queues
-	if queues == nil || len(queues) == 0 {
-		queues = defaultQueueConfig
+	qcfg, pcfg, err := queueConfigs(cfg)
+	if err != nil {
+		panic("asynq: " + err.Error())
+	}
+	signals := cfg.ShutdownSignals
+	if len(signals) == 0 {
+		signals = defaultShutdownSignals
 	}
-	qcfg := normalizeQueueCfg(queues)
 
-	rdb := rdb.NewRDB(createRedisClient(r))
-	scheduler := newScheduler(rdb, 5*time.Second, qcfg)
-	processor := newProcessor(rdb, n, qcfg, cfg.StrictPriority, delayFunc)
+	id := newServerID()
+	rdb := rdb.NewRDBWithNamespace(createRedisClient(r), cfg.Namespace)
+	rdb.SetCodec(cfg.Codec.baseCodec())
+	rdb.SetQueueTTL(cfg.RetryQueueTTL, cfg.DeadQueueTTL)
+	// Note: scheduler is given all the queues, so that scheduled tasks
+	// are forwarded to their own queues even if this background processes
+	// only some of them.
+	discover := cfg.DiscoverQueues && len(cfg.ProcessQueues) == 0
+	if discover {
+		// scheduled tasks have to be sent to their own queues, which may not be
+		// in the config.
+		qcfg = nil
+	}
+	lg := newLogger(cfg.LogFormat, nil)
+	lg.level = cfg.LogLevel
+	if lo, hi, ok := skewedQueueCfg(pcfg); ok {
+		lg.printf("[WARN] Priority of queue %q is more than %d times the priority of queue %q, tasks in %q may hardly be processed\n",
+			hi, maxQueuePriorityRatio, lo, lo)
+	}
+	forwardInterval := cfg.ForwardInterval
+	if forwardInterval <= 0 {
+		forwardInterval = defaultForwardInterval
+	}
+	scheduler := newScheduler(rdb, forwardInterval, qcfg)
+	scheduler.logger = lg
+	if cfg.RetryPromotionLimit > 0 {
+		scheduler.retryLimit = cfg.RetryPromotionLimit
+		scheduler.retryInterval = cfg.RetryPromotionInterval
+		if scheduler.retryInterval <= 0 {
+			scheduler.retryInterval = defaultRetryPromotionInterval
+		}
+	}
+	scheduler.forwardDeferred = cfg.DeadRetryInterval > 0 && cfg.DeadRetryAttempts > 0
+	scheduler.requeueInvisible = cfg.VisibilityTimeout > 0
+	var leaser *leaser
+	if cfg.InProgressLease > 0 {
+		rdb.ScopeInProgress(id)
+		rdb.SetAffinity(id, cfg.AffinityTTL)
+		leaser = newLeaser(rdb, id, cfg.InProgressLease)
+		leaser.logger = lg
+	}
+	processor := newProcessor(processorParams{
+		rdb:                 rdb,
+		serverID:            id,
+		concurrency:         n,
+		typeLimits:          cfg.TypeConcurrency,
+		categoryLimits:      cfg.CategoryConcurrency,
+		queues:              pcfg,
+		strictPriority:      cfg.StrictPriority,
+		starvationGuard:     cfg.StarvationGuard,
+		depthAware:          cfg.DepthAwarePriority,
+		priorityAging:       cfg.PriorityAging,
+		retryDelayFunc:      delayFunc,
+		retryDecider:        cfg.RetryDecider,
+		errorClassifiers:    cfg.ErrorClassifiers,
+		retryPriorityBoost:  cfg.RetryPriorityBoost,
+		maxDeadTasks:        cfg.MaxDeadTasks,
+		keepCompleted:       cfg.KeepCompleted,
+		killDependents:      cfg.KillDependents,
+		maxErrorLength:      cfg.MaxErrorLength,
+		maxAttempts:         cfg.MaxAttempts,
+		queueHandlers:       normalizeQueueHandlers(cfg.QueueHandlers),
+		queueRetryDelays:    normalizeQueueRetryDelayFuncs(cfg.QueueRetryDelayFuncs),
+		batches:             normalizeBatches(cfg.Batches),
+		circuitBreakers:     cfg.CircuitBreakers,
+		queueDiscovery:      discover,
+		pollInterval:        cfg.PollInterval,
+		maxPolledQueues:     cfg.MaxPolledQueues,
+		abandon:             cfg.AbandonUnfinished,
+		handoff:             cfg.HandoffOnShutdown,
+		handoffTTL:          cfg.HandoffTTL,
+		recentEvents:        cfg.RecentEventsSize,
+		latencySamples:      cfg.TypeLatencySamples,
+		dedupWindow:         cfg.DedupWindow,
+		retryUnhandled:      cfg.RetryUnhandled,
+		requireAck:          cfg.RequireAck,
+		finishClaimed:       cfg.FinishClaimedOnShutdown,
+		trackStarted:        cfg.TrackStartTimes,
+		stateUpdateTimeout:  cfg.StateUpdateTimeout,
+		restoreLockTTL:      cfg.RestoreLockTTL,
+		maxDequeueRate:      cfg.MaxDequeueRate,
+		deadRetryInterval:   cfg.DeadRetryInterval,
+		deadRetryAttempts:   cfg.DeadRetryAttempts,
+		visibilityTimeout:   cfg.VisibilityTimeout,
+		dropExpired:         cfg.DropExpiredUnfinished,
+		onSuccess:           cfg.OnSuccess,
+		metrics:             cfg.Metrics,
+		exporter:            cfg.DeadTaskExporter,
+		exportAsync:         cfg.ExportDeadTasksAsync,
+		onRequeue:           cfg.OnRequeue,
+		onRetry:             cfg.OnRetry,
+		onMalformedTask:     cfg.OnMalformedTask,
+		workerPool:          cfg.WorkerPool,
+		prefetch:            cfg.Prefetch,
+		selector:            cfg.QueueSelector,
+		drainReportInterval: cfg.DrainReportInterval,
+		onDrainProgress:     cfg.OnDrainProgress,
+		logger:              lg,
+	})
+	subscriber := newSubscriber(rdb, func(taskType string) {
+		if n := processor.cancelType(taskType); n > 0 {
+			lg.printf("[INFO] Canceled %d tasks of type %q\n", n, taskType)
+		}
+	})
+	subscriber.logger = lg
 	return &Background{
-		rdb:       rdb,
-		scheduler: scheduler,
-		processor: processor,
+		id:               id,
+		signals:          signals,
+		immediateSignals: cfg.ImmediateShutdownSignals,
+		coverage:         cfg.HandlerCoverage,
+		concurrency:      n,
+		warmup:           cfg.ConcurrencyWarmup,
+		rdb:              rdb,
+		scheduler:        scheduler,
+		processor:        processor,
+		leaser:           leaser,
+		subscriber:       subscriber,
+		logger:           lg,
+	}
+}
+
+// defaultRetryPromotionInterval is the interval at which RetryPromotionLimit
+// applies if RetryPromotionInterval is not set.
+const defaultRetryPromotionInterval = time.Second
+
+// newServerID returns an ID which uniquely identifies a background instance.
+// The ID has the format of "<hostname>:<pid>:<random id>".
+func newServerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
 	}
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), xid.New())
 }
 
 // A Handler processes a task.
@@ -141,58 +1087,1149 @@ func (fn HandlerFunc) ProcessTask(task *Task) error {
 	return fn(task)
 }
 
-// Run starts the background-task processing and blocks until
-// an os signal to exit the program is received. Once it receives
-// a signal, it gracefully shuts down all pending workers and other
-// goroutines to process the tasks.
-func (bg *Background) Run(handler Handler) {
-	bg.start(handler)
-	defer bg.stop()
-
-	// Wait for a signal to terminate.
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGTSTP)
-	for {
-		sig := <-sigs
-		if sig == syscall.SIGTSTP {
-			bg.processor.stop()
-			continue
-		}
-		break
-	}
-	fmt.Println()
-	log.Println("[INFO] Starting graceful shutdown...")
+// A BatchHandler processes multiple tasks at once.
+//
+// ProcessTasks should return a slice of errors of the same length as tasks,
+// where the i-th error is the result of processing the i-th task.
+// A nil error means the task was processed successfully, and
+// a non-nil error is handled as if it's returned by a Handler for the task.
+//
+// If ProcessTasks panics or returns a slice of a different length,
+// all tasks in the batch are considered failed.
+type BatchHandler interface {
+	ProcessTasks([]*Task) []error
 }
 
-// starts the background-task processing.
-func (bg *Background) start(handler Handler) {
-	bg.mu.Lock()
-	defer bg.mu.Unlock()
-	if bg.running {
-		return
-	}
+// The BatchHandlerFunc type is an adapter to allow the use of
+// ordinary functions as a BatchHandler.
+type BatchHandlerFunc func([]*Task) []error
 
-	bg.running = true
-	bg.processor.handler = handler
+// ProcessTasks calls fn(tasks)
+func (fn BatchHandlerFunc) ProcessTasks(tasks []*Task) []error {
+	return fn(tasks)
+}
 
-	bg.scheduler.start()
-	bg.processor.start()
+// Batch specifies how to process the tasks of a queue in batches.
+type Batch struct {
+	// Handler to process the batches of tasks.
+	Handler BatchHandler
+
+	// Max number of tasks in a batch.
+	//
+	// A batch is processed as soon as at least one task is available,
+	// so batches may have fewer tasks.
+	//
+	// If set to zero or negative value, it defaults to 10.
+	Size int
+}
+
+// RetryAfter returns the retry delay suggested by err, if err or any error
+// it wraps has a method RetryAfter() time.Duration.
+// The boolean value is false if err does not suggest a delay.
+//
+// Handler can return such an error to honor a delay imposed by an external
+// service (e.g., Retry-After header in HTTP 429 response).
+//
+// Example:
+//
+//	type rateLimitError struct {
+//	    retryAfter time.Duration
+//	}
+//
+//	func (e *rateLimitError) Error() string             { return "rate limited" }
+//	func (e *rateLimitError) RetryAfter() time.Duration { return e.retryAfter }
+func RetryAfter(err error) (time.Duration, bool) {
+	var e interface {
+		error
+		RetryAfter() time.Duration
+	}
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	d := e.RetryAfter()
+	if d < 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// RetryQueue returns the queue to retry the task on suggested by err, if err
+// or any error it wraps has a method RetryQueue() string.
+// The boolean value is false if err does not suggest a queue.
+//
+// Handler can return such an error (see RetryOnQueue) to move the retried
+// task off the queue it was processed from, e.g. to a lower priority queue
+// so that a task waiting for a dependency doesn't block the hot path.
+// The queue has to be one of the queues processed by the background;
+// otherwise, the task is retried on its own queue.
+func RetryQueue(err error) (string, bool) {
+	var e interface {
+		error
+		RetryQueue() string
+	}
+	if !errors.As(err, &e) {
+		return "", false
+	}
+	qname := strings.ToLower(e.RetryQueue())
+	if qname == "" {
+		return "", false
+	}
+	return qname, true
+}
+
+// RetryOnQueue returns an error which wraps err and suggests to retry
+// the task on the queue with the given name (see RetryQueue).
+func RetryOnQueue(qname string, err error) error {
+	return &retryQueueError{qname: qname, err: err}
+}
+
+type retryQueueError struct {
+	qname string
+	err   error
+}
+
+func (e *retryQueueError) Error() string      { return e.err.Error() }
+func (e *retryQueueError) Unwrap() error      { return e.err }
+func (e *retryQueueError) RetryQueue() string { return e.qname }
+
+// ErrPermanent indicates that retrying the task won't help, e.g. since the
+// task is invalid. A task whose handler returns an error wrapping it is sent
+// to the dead queue without being retried.
+//
+// Example:
+//
+//	return fmt.Errorf("invalid email address %q: %w", addr, asynq.ErrPermanent)
+var ErrPermanent = errors.New("permanent error")
+
+// ErrorClass tells whether a task failed with an error is worth retrying
+// (see ErrorClassifiers in Config).
+type ErrorClass int
+
+const (
+	// Unclassified leaves the error to the next classifier, and to
+	// RetryDecider by default.
+	Unclassified ErrorClass = iota
+
+	// Retryable indicates that the task may succeed if it's retried, e.g.
+	// after a network error. The task is retried up to its max retry count.
+	Retryable
+
+	// Permanent indicates that the task would fail all the same if it's
+	// retried. The task is sent to the dead queue right away.
+	Permanent
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Unclassified:
+		return "Unclassified"
+	case Retryable:
+		return "Retryable"
+	case Permanent:
+		return "Permanent"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+// classifyError returns the class of err given by the first of classifiers
+// classifying it, or by ErrPermanent and the Temporary method otherwise.
+func classifyError(err error, classifiers []func(error) ErrorClass) ErrorClass {
+	for _, classify := range classifiers {
+		if c := classify(err); c != Unclassified {
+			return c
+		}
+	}
+	if errors.Is(err, ErrPermanent) {
+		return Permanent
+	}
+	var e interface {
+		error
+		Temporary() bool
+	}
+	if errors.As(err, &e) && e.Temporary() {
+		return Retryable
+	}
+	return Unclassified
+}
+
+// PanicError is the error reported for a task whose handler panicked.
+//
+// Use errors.As to tell panics, which usually indicate bugs, from errors
+// returned by handlers (e.g., in a RetryDecider).
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the handler goroutine at the time of panic.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// ErrRetryRequested is the error recorded for a task whose handler
+// called RequestRetry and returned nil.
+var ErrRetryRequested = errors.New("handler requested retry")
+
+// ErrNotAcked is the error recorded for a task whose handler returned nil
+// without calling Ack while RequireAck is set in Config.
+var ErrNotAcked = errors.New("handler returned nil without acknowledging the task")
+
+// taskStates holds the tasks currently passed to handlers.
+// Each value is a *taskState of the task.
+var taskStates sync.Map
+
+// taskState is the state of a task kept while the task is processed.
+type taskState struct {
+	// retryRequested is set to 1 by RequestRetry.
+	// Must be accessed atomically.
+	retryRequested int32
+
+	// ack is the acknowledgment of the task by the last call to Ack
+	// (ackAcked) or Nack (ackNacked), or ackNone if neither is called.
+	// Must be accessed atomically.
+	ack int32
+
+	// nackReason holds the reason passed to the last call to Nack.
+	nackReason atomic.Value
+
+	// queue is the name of the queue of the task.
+	queue string
+
+	// correlationID is the correlation ID of the task, if any.
+	correlationID string
+
+	// parentID is the ID of the task which the task follows up, if any.
+	parentID string
+
+	// result holds the ProcessResult set by SetResult, if any.
+	result atomic.Value
+
+	// extend extends the visibility of the task, or nil if VisibilityTimeout
+	// is not set in Config.
+	extend func(d time.Duration) error
+}
+
+// Acknowledgments of a task by Ack and Nack.
+const (
+	ackNone int32 = iota
+	ackAcked
+	ackNacked
+)
+
+// nackReason is the value of taskState.nackReason, which wraps the error
+// since atomic.Value cannot hold nil.
+type nackReason struct{ err error }
+
+// taskQueue returns the name of the queue of the task passed to a handler.
+// It returns false if the task is not currently processed.
+func taskQueue(task *Task) (string, bool) {
+	v, ok := taskStates.Load(task)
+	if !ok {
+		return "", false
+	}
+	return v.(*taskState).queue, true
+}
+
+// GetCorrelationID returns the correlation ID attached to the task with
+// the CorrelationID option. It returns false if the task has no correlation
+// ID, or if the task is not the one passed to a handler being processed.
+func GetCorrelationID(task *Task) (string, bool) {
+	v, ok := taskStates.Load(task)
+	if !ok {
+		return "", false
+	}
+	id := v.(*taskState).correlationID
+	return id, id != ""
+}
+
+// GetParentID returns the ID of the task which enqueued the task as its
+// follow-up task with the OnComplete or OnFailure option. It returns false
+// if the task is not a follow-up task, or if the task is not the one passed
+// to a handler being processed.
+func GetParentID(task *Task) (string, bool) {
+	v, ok := taskStates.Load(task)
+	if !ok {
+		return "", false
+	}
+	id := v.(*taskState).parentID
+	return id, id != ""
+}
+
+// RequestRetry marks the task so that it gets retried even if the handler
+// returns nil, in which case the task is treated as failed with ErrRetryRequested.
+// It's an escape hatch for handlers which cannot report a failure by returning
+// an error (e.g., a handler wrapping a third-party function which reports
+// a failure in its result).
+//
+// RequestRetry has to be called with the task passed to the handler before
+// the handler returns. Otherwise, it has no effect.
+func RequestRetry(task *Task) {
+	if v, ok := taskStates.Load(task); ok {
+		atomic.StoreInt32(&v.(*taskState).retryRequested, 1)
+	}
+}
+
+// Ack acknowledges that the handler has done the work of the task.
+// It's required for the task to count as done if RequireAck is set in Config.
+// It also undoes the previous call to Nack, if any.
+//
+// Ack has to be called with the task passed to the handler before
+// the handler returns. Otherwise, it has no effect.
+func Ack(task *Task) {
+	if v, ok := taskStates.Load(task); ok {
+		atomic.StoreInt32(&v.(*taskState).ack, ackAcked)
+	}
+}
+
+// ErrNacked is the error recorded for a task whose handler called Nack with
+// a nil reason and returned nil.
+var ErrNacked = errors.New("handler nacked the task")
+
+// Nack rejects the task with the given reason, so that the task is treated
+// as failed with the reason (or ErrNacked if it's nil) and retried even if
+// the handler returns nil. It's for handlers which do partial work and decide
+// the outcome explicitly rather than by the returned error.
+//
+// The last call to Ack or Nack decides the acknowledgment of the task.
+// A non-nil error returned by the handler takes precedence over Nack,
+// and Nack takes precedence over RequestRetry and SetResult.
+//
+// Nack has to be called with the task passed to the handler before
+// the handler returns. Otherwise, it has no effect.
+func Nack(task *Task, reason error) {
+	if v, ok := taskStates.Load(task); ok {
+		state := v.(*taskState)
+		state.nackReason.Store(nackReason{reason})
+		atomic.StoreInt32(&state.ack, ackNacked)
+	}
+}
+
+// ErrVisibilityExpired is returned by ExtendVisibility if the visibility
+// timeout of the task has elapsed, in which case the task has been moved
+// back to its queue and may be processed again.
+var ErrVisibilityExpired = errors.New("visibility timeout of the task has elapsed")
+
+// ExtendVisibility keeps the task invisible for d from now, if
+// VisibilityTimeout is set in Config. It's for a handler which takes longer
+// than the visibility timeout to process the task, and can be called
+// repeatedly while processing it.
+//
+// ExtendVisibility has to be called with the task passed to the handler
+// before the handler returns. Otherwise, it returns an error.
+func ExtendVisibility(task *Task, d time.Duration) error {
+	v, ok := taskStates.Load(task)
+	if !ok {
+		return errors.New("task is not being processed")
+	}
+	extend := v.(*taskState).extend
+	if extend == nil {
+		return errors.New("VisibilityTimeout is not set in Config")
+	}
+	return extend(d)
+}
+
+// Status is the outcome of a task reported by its handler with SetResult.
+type Status int
+
+const (
+	// StatusSuccess indicates that the task completed successfully.
+	StatusSuccess Status = iota
+
+	// StatusWarning indicates that the task completed with a warning.
+	// The task is done and the warning is logged.
+	StatusWarning
+
+	// StatusPartial indicates that the task completed only partially.
+	// The task is treated as failed with ErrPartiallyCompleted and retried.
+	StatusPartial
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSuccess:
+		return "success"
+	case StatusWarning:
+		return "warning"
+	case StatusPartial:
+		return "partial"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// ProcessResult is the structured outcome of a task reported by its handler
+// with SetResult.
+type ProcessResult struct {
+	Status Status
+
+	// Message describes the outcome, e.g. the warning.
+	Message string
+
+	// Data is the result payload, which is kept with the record of the
+	// completion if KeepCompleted is set in Config.
+	Data []byte
+}
+
+// ErrPartiallyCompleted is the error recorded for a task whose handler
+// reported StatusPartial with SetResult and returned nil.
+var ErrPartiallyCompleted = errors.New("task partially completed")
+
+// SetResult reports the outcome of the task, which decides what happens to
+// the task in addition to the error returned by the handler. A non-nil error
+// returned by the handler takes precedence over the result. If called more
+// than once, the last result is used.
+//
+// A task with a result counts as acknowledged if RequireAck is set in Config.
+//
+// SetResult has to be called with the task passed to the handler before
+// the handler returns. Otherwise, it has no effect.
+func SetResult(task *Task, res ProcessResult) {
+	if v, ok := taskStates.Load(task); ok {
+		v.(*taskState).result.Store(res)
+	}
+}
+
+// taskResult returns the result of the task set by SetResult.
+// It returns false if no result is set or the task is not currently processed.
+func taskResult(task *Task) (ProcessResult, bool) {
+	v, ok := taskStates.Load(task)
+	if !ok {
+		return ProcessResult{}, false
+	}
+	res, ok := v.(*taskState).result.Load().(ProcessResult)
+	return res, ok
+}
+
+// Run starts the background-task processing and blocks until
+// an os signal to exit the program is received. Once it receives
+// a signal, it gracefully shuts down all pending workers and other
+// goroutines to process the tasks.
+//
+// Run returns after all workers have finished.
+//
+// Run returns an error immediately if the background fails to start,
+// i.e. if handler is nil, redis is unreachable, the unfinished tasks of the last run
+// cannot be restored, or a queue has no handler coverage while
+// Config.HandlerCoverage is RejectUncovered, so that the failure is not hidden behind a running
+// background which processes nothing. A nil handler is rejected before
+// pulling any task out of the queues.
+func (bg *Background) Run(handler Handler) error {
+	sigs := make(chan os.Signal, 1)
+	notified := append([]os.Signal{syscall.SIGTSTP}, bg.signals...)
+	signal.Notify(sigs, append(notified, bg.immediateSignals...)...)
+	defer signal.Stop(sigs)
+
+	if err := bg.start(handler); err != nil {
+		return err
+	}
+
+	immediate := bg.waitForSignals(sigs)
+	fmt.Println()
+	stopped := make(chan struct{})
+	if immediate {
+		bg.logger.printf("[INFO] Starting immediate shutdown...")
+		bg.processor.quitWorkers()
+	} else {
+		bg.logger.printf("[INFO] Starting graceful shutdown...")
+		go bg.waitForImmediateSignals(sigs, stopped)
+	}
+	bg.stop()
+	close(stopped)
+	return nil
+}
+
+// waitForSignals blocks until a shutdown signal is received, and reports
+// whether the signal is one of the immediate shutdown signals.
+// Upon receiving SIGTSTP, it stops processing new tasks and continues to wait.
+func (bg *Background) waitForSignals(sigs <-chan os.Signal) (immediate bool) {
+	for sig := range sigs {
+		if sig == syscall.SIGTSTP {
+			bg.processor.stop()
+			continue
+		}
+		if containsSignal(bg.immediateSignals, sig) {
+			return true
+		}
+		if containsSignal(bg.signals, sig) {
+			return false
+		}
+	}
+	return false
+}
+
+// waitForImmediateSignals tells the workers to stop right away if an
+// immediate shutdown signal is received before stopped is closed.
+func (bg *Background) waitForImmediateSignals(sigs <-chan os.Signal, stopped <-chan struct{}) {
+	for {
+		select {
+		case <-stopped:
+			return
+		case sig := <-sigs:
+			if containsSignal(bg.immediateSignals, sig) {
+				bg.logger.printf("[INFO] Starting immediate shutdown...")
+				bg.processor.quitWorkers()
+				return
+			}
+		}
+	}
+}
+
+func containsSignal(sigs []os.Signal, sig os.Signal) bool {
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause stops the background from processing new tasks until Resume is called.
+//
+// Unlike the shutdown, tasks which are being processed keep running, and
+// unfinished tasks are not sent back to the queues.
+// Pause affects only this background; to pause all background instances,
+// use asynqmon's "pause --all" command.
+func (bg *Background) Pause() {
+	bg.processor.pause()
+}
+
+// Resume resumes the processing of new tasks paused by Pause.
+func (bg *Background) Resume() {
+	bg.processor.resume()
+}
+
+// QueueConfig returns a snapshot of the queues the background processes,
+// with their effective priority levels.
+//
+// Priority levels are normalized (e.g., 6, 3, 3 becomes 2, 1, 1), and
+// the config includes the queues found with DiscoverQueues.
+func (bg *Background) QueueConfig() map[string]uint {
+	cfg, _ := bg.processor.queueSnapshot()
+	return cfg
+}
+
+// OrderedQueues returns a snapshot of the queue names in the order they're
+// checked for tasks in strict priority mode, highest priority first.
+//
+// It returns nil if StrictPriority is not set.
+func (bg *Background) OrderedQueues() []string {
+	_, ordered := bg.processor.queueSnapshot()
+	return ordered
+}
+
+// Reconfigure replaces the queues the background processes and their
+// priority levels with the ones in cfg.Queues and cfg.ProcessQueues while
+// the background is running. Other fields of cfg are ignored.
+//
+// The new queues take effect from the next time the background pulls a task
+// out of the queues. Tasks being processed keep running, and the tasks left
+// in the queues removed from the config stay there until a background
+// processes the queues.
+//
+// It returns an error, leaving the queues unchanged, if the new config
+// is invalid.
+func (bg *Background) Reconfigure(cfg *Config) error {
+	qcfg, pcfg, err := queueConfigs(cfg)
+	if err != nil {
+		return err
+	}
+	if lo, hi, ok := skewedQueueCfg(pcfg); ok {
+		bg.logger.printf("[WARN] Priority of queue %q is more than %d times the priority of queue %q, tasks in %q may hardly be processed\n",
+			hi, maxQueuePriorityRatio, lo, lo)
+	}
+	if !bg.processor.queueDiscovery {
+		// with DiscoverQueues, the scheduler moves the tasks into all queues.
+		bg.scheduler.setQueues(qcfg)
+	}
+	bg.processor.reconfigure(pcfg)
+	return nil
+}
+
+// ActiveWorkers returns the number of workers currently processing tasks.
+//
+// Together with MaxWorkers, it can be exported as a metric.
+// For example, to export the utilization of workers with expvar:
+//
+//	expvar.Publish("asynq_workers", expvar.Func(func() interface{} {
+//	    return map[string]int{"active": bg.ActiveWorkers(), "max": bg.MaxWorkers()}
+//	}))
+func (bg *Background) ActiveWorkers() int {
+	return bg.processor.active()
+}
+
+// QueueLatency returns the time the oldest pending task of the queue has
+// been waiting since it was first enqueued, or zero if the queue is empty.
+// Note that the time of a retried task counts from its first enqueue.
+//
+// It queries redis, so export it as a metric at a moderate interval.
+// For example, with expvar:
+//
+//	expvar.Publish("asynq_latency", expvar.Func(func() interface{} {
+//	    d, _ := bg.QueueLatency("default")
+//	    return d.Seconds()
+//	}))
+func (bg *Background) QueueLatency(qname string) (time.Duration, error) {
+	return bg.rdb.QueueLatency(qname)
+}
+
+// ActiveTask describes a task currently processed by a worker.
+type ActiveTask struct {
+	// ID is the ID of the task.
+	ID string
+
+	// Type is the type name of the task.
+	Type string
+
+	// Queue is the name of the queue the task was pulled out of.
+	Queue string
+
+	// Category is the category of the task, if any (see Category option).
+	Category string
+
+	// Started is the time the worker started processing the task.
+	Started time.Time
+
+	// ServerID is the ID of the background instance processing the task.
+	ServerID string
+}
+
+// ActiveTasks returns a snapshot of the tasks currently processed by
+// workers, sorted by the time they started.
+func (bg *Background) ActiveTasks() []ActiveTask {
+	return bg.processor.activeSnapshot()
+}
+
+// RecentEvents returns up to n latest processing events kept by the
+// background, oldest first. It returns nil unless Config.RecentEventsSize
+// is set.
+func (bg *Background) RecentEvents(n int) []Event {
+	if bg.processor.events == nil {
+		return nil
+	}
+	return bg.processor.events.last(n)
+}
+
+// TypeLatencies returns the percentiles of the time the handler took to
+// process the tasks of each type, over the latest durations kept by the
+// background. It returns nil unless Config.TypeLatencySamples is set.
+func (bg *Background) TypeLatencies() map[string]LatencyPercentiles {
+	if bg.processor.latencies == nil {
+		return nil
+	}
+	return bg.processor.latencies.percentiles()
+}
+
+// Stats holds the counters of the tasks processed by the background since
+// it was created. The counters are maintained in-process and are not shared
+// between background instances.
+type Stats struct {
+	// Processed is the number of tasks for which the handler returned,
+	// i.e. the sum of Succeeded and Failed.
+	Processed int64
+
+	// Succeeded is the number of tasks processed successfully.
+	Succeeded int64
+
+	// Failed is the number of tasks for which the handler returned an error
+	// (or timed out).
+	Failed int64
+
+	// Retried is the number of failed tasks sent to the retry queue.
+	Retried int64
+
+	// Killed is the number of tasks sent to the dead queue, including the
+	// ones killed without being processed (e.g., whose payload was corrupted).
+	Killed int64
+
+	// ActiveWorkers is the number of workers currently processing tasks.
+	ActiveWorkers int
+
+	// Categories holds the counters of the tasks with a category (see
+	// Category option) by category name. Nil if there's no such task.
+	Categories map[string]CategoryStats
+}
+
+// CategoryStats holds the counters of the tasks of a category.
+type CategoryStats struct {
+	// Processed is the sum of Succeeded and Failed.
+	Processed int64
+
+	// Succeeded is the number of tasks processed successfully.
+	Succeeded int64
+
+	// Failed is the number of tasks for which the handler returned an error
+	// (or timed out).
+	Failed int64
+
+	// ActiveWorkers is the number of workers currently processing tasks
+	// of the category.
+	ActiveWorkers int
+}
+
+// Stats returns a snapshot of the counters of the tasks processed by the
+// background. It's cheap enough to be polled for simple monitoring.
+func (bg *Background) Stats() Stats {
+	return bg.processor.stats()
+}
+
+// MaxWorkers returns the max number of workers which can process tasks
+// concurrently, which is the max total weight of the tasks (see Weight).
+func (bg *Background) MaxWorkers() int {
+	return int(bg.processor.sema.capacity())
+}
+
+// SetConcurrency changes the max number of concurrent processing of tasks
+// (see Config.Concurrency) while the background is running.
+//
+// Growing the concurrency lets more tasks start right away. Shrinking it
+// doesn't interrupt the tasks being processed; it takes effect as they
+// finish. Zero or negative value is replaced with one.
+//
+// It also ends the burst started by BurstConcurrency, if any.
+func (bg *Background) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	bg.burstMu.Lock()
+	defer bg.burstMu.Unlock()
+	bg.endBurst()
+	bg.endWarmup()
+	bg.concurrency = n
+	bg.processor.sema.resize(int64(n))
+}
+
+// BurstConcurrency raises the max number of concurrent processing of tasks
+// to n until the given time, e.g. to catch up with the backlog accumulated
+// during a downtime, and then restores the concurrency set by
+// Config.Concurrency or SetConcurrency.
+//
+// A call replaces the burst started by the previous one, if any, and
+// SetConcurrency ends it. The concurrency is restored right away if n is
+// not greater than the concurrency or the time has passed.
+func (bg *Background) BurstConcurrency(n int, until time.Time) {
+	bg.burstMu.Lock()
+	defer bg.burstMu.Unlock()
+	bg.endBurst()
+	bg.endWarmup()
+	d := time.Until(until)
+	if n <= bg.concurrency || d <= 0 {
+		bg.processor.sema.resize(int64(bg.concurrency))
+		return
+	}
+	bg.processor.sema.resize(int64(n))
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		bg.burstMu.Lock()
+		defer bg.burstMu.Unlock()
+		if bg.burst != timer {
+			// the burst was replaced or ended in the meantime.
+			return
+		}
+		bg.burst = nil
+		bg.processor.sema.resize(int64(bg.concurrency))
+	})
+	bg.burst = timer
+}
+
+// endBurst stops the timer of the burst, if any.
+// It must be called with bg.burstMu held.
+func (bg *Background) endBurst() {
+	if bg.burst != nil {
+		bg.burst.Stop()
+		bg.burst = nil
+	}
+}
+
+// minWarmupStep is the min interval to raise the concurrency during
+// the warmup.
+const minWarmupStep = 10 * time.Millisecond
+
+// startWarmup sets the concurrency to one and raises it linearly to
+// bg.concurrency over bg.warmup, if the warmup is set.
+func (bg *Background) startWarmup() {
+	bg.burstMu.Lock()
+	defer bg.burstMu.Unlock()
+	bg.endWarmup()
+	n, warmup := bg.concurrency, bg.warmup
+	if warmup <= 0 || n <= 1 {
+		return
+	}
+	bg.processor.sema.resize(1)
+	stop := make(chan struct{})
+	bg.warmupStop = stop
+	step := warmup / time.Duration(n-1)
+	if step < minWarmupStep {
+		step = minWarmupStep
+	}
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(step)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			bg.burstMu.Lock()
+			if bg.warmupStop != stop {
+				// the warmup was ended in the meantime.
+				bg.burstMu.Unlock()
+				return
+			}
+			c := 1 + int(int64(n-1)*int64(time.Since(start))/int64(warmup))
+			if c >= n {
+				c = n
+				bg.warmupStop = nil
+			}
+			bg.processor.sema.resize(int64(c))
+			bg.burstMu.Unlock()
+			if c == n {
+				return
+			}
+		}
+	}()
+}
+
+// endWarmup stops raising the concurrency, if the warmup is in progress.
+// It must be called with bg.burstMu held.
+func (bg *Background) endWarmup() {
+	if bg.warmupStop != nil {
+		close(bg.warmupStop)
+		bg.warmupStop = nil
+	}
+}
+
+// Restored returns the number of unfinished tasks restored back to the queue
+// when the background started, along with the error if the restoration failed.
+//
+// Tasks are left unfinished if a previous run of the background crashed,
+// so an unusually high number indicates an unclean shutdown.
+// If Config.AbandonUnfinished is set, it returns the number of tasks
+// moved to abandoned queue instead.
+//
+// Restored returns zero if the background has not started.
+func (bg *Background) Restored() (int, error) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	return int(bg.processor.restored), bg.processor.restoreErr
+}
+
+// Expired returns the number of unfinished tasks which were past their
+// deadline and thus killed or dropped instead of restored back to the queue,
+// since the background started (see DropExpiredUnfinished in Config).
+func (bg *Background) Expired() int {
+	return int(atomic.LoadInt64(&bg.processor.expired))
+}
+
+// errNilHandler is returned by Run if the handler is nil.
+var errNilHandler = errors.New("asynq: nil handler")
+
+// start starts the background-task processing.
+// It returns an error if the handler is nil, if redis is unreachable or the unfinished tasks
+// cannot be restored, in which case the background is not started.
+func (bg *Background) start(handler Handler) error {
+	if handler == nil {
+		// Note: Fail fast, otherwise every task fails and ends up
+		// in the dead queue.
+		return errNilHandler
+	}
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	if bg.running {
+		return nil
+	}
+
+	if err := bg.checkCoverage(handler); err != nil {
+		return err
+	}
+	if err := bg.rdb.Ping(); err != nil {
+		return fmt.Errorf("asynq: could not connect to redis: %v", err)
+	}
+	bg.processor.handler = handler
+	if bg.leaser != nil {
+		bg.leaser.start()
+	}
+	// Note: Start the warmup before the processor, so that the processor
+	// doesn't pick up tasks with the full concurrency in the meantime.
+	bg.startWarmup()
+	if err := bg.processor.start(); err != nil {
+		if bg.leaser != nil {
+			bg.leaser.terminate()
+		}
+		bg.burstMu.Lock()
+		bg.endWarmup()
+		bg.processor.sema.resize(int64(bg.concurrency))
+		bg.burstMu.Unlock()
+		bg.processor.handler = nil
+		return fmt.Errorf("asynq: could not restore unfinished tasks: %v", err)
+	}
+	bg.scheduler.start()
+	bg.subscriber.start()
+	bg.running = true
+	return nil
+}
+
+// HandlerCoverage specifies how the background checks the handler coverage
+// of the queues on start (see Config.HandlerCoverage).
+type HandlerCoverage int
+
+const (
+	// IgnoreUncovered does not check the coverage.
+	IgnoreUncovered HandlerCoverage = iota
+
+	// WarnUncovered logs a warning listing the queues not covered.
+	WarnUncovered
+
+	// RejectUncovered makes Run return an error listing the queues not
+	// covered, without starting the background.
+	RejectUncovered
+)
+
+// checkCoverage checks that each of the queues to process has a handler
+// for the tasks of any type, as specified by coverage.
+func (bg *Background) checkCoverage(handler Handler) error {
+	if bg.coverage == IgnoreUncovered {
+		return nil
+	}
+	cfg, _ := bg.processor.queueSnapshot()
+	qnames := make([]string, 0, len(cfg))
+	for qname := range cfg {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	var uncovered []string
+	for _, qname := range qnames {
+		if _, ok := bg.processor.batches[qname]; ok {
+			continue
+		}
+		h := handler
+		if qh, ok := bg.processor.queueHandlers[qname]; ok {
+			h = qh
+		}
+		if mux, ok := h.(*ServeMux); ok && !mux.coversQueue(qname) {
+			uncovered = append(uncovered, qname)
+		}
+	}
+	if len(uncovered) == 0 {
+		return nil
+	}
+	if bg.coverage == RejectUncovered {
+		return fmt.Errorf("asynq: no default handler for queues %v", uncovered)
+	}
+	bg.logger.printf("[WARN] No default handler for queues %v, tasks of types with no registered handler will fail\n", uncovered)
+	return nil
+}
+
+// OnShutdown registers fn to be called on shutdown after all workers have
+// finished and the unfinished tasks have been restored, e.g. to close the
+// resources used by the handlers.
+//
+// Registered functions are called in the order of registration. A panic in
+// a function is logged and recovered, so that the rest of them are called.
+func (bg *Background) OnShutdown(fn func()) {
+	bg.mu.Lock()
+	defer bg.mu.Unlock()
+	bg.shutdownHooks = append(bg.shutdownHooks, fn)
+}
+
+// runShutdownHooks calls the given functions registered with OnShutdown.
+func (bg *Background) runShutdownHooks(hooks []func()) {
+	for _, fn := range hooks {
+		func() {
+			defer func() {
+				if x := recover(); x != nil {
+					bg.logger.printf("[ERROR] Shutdown hook panicked: %v\n", x)
+				}
+			}()
+			fn()
+		}()
+	}
 }
 
 // stops the background-task processing.
 func (bg *Background) stop() {
 	bg.mu.Lock()
-	defer bg.mu.Unlock()
 	if !bg.running {
+		bg.mu.Unlock()
 		return
 	}
 
+	bg.burstMu.Lock()
+	bg.endWarmup()
+	bg.burstMu.Unlock()
+	bg.subscriber.terminate()
 	bg.scheduler.terminate()
 	bg.processor.terminate()
+	if bg.leaser != nil {
+		// Note: Release the lease after the processor has restored
+		// its unfinished tasks.
+		bg.leaser.terminate()
+	}
 
-	bg.rdb.Close()
+	bg.closeRDB()
 	bg.processor.handler = nil
 	bg.running = false
+	hooks := append([]func(){}, bg.shutdownHooks...)
+	bg.mu.Unlock()
+
+	// Note: The hooks are called without holding the lock, so that they
+	// can call the methods of the background.
+	bg.runShutdownHooks(hooks)
+}
+
+// Close gracefully shuts down the background-task processing if it's running,
+// and closes the connection with redis.
+//
+// The background cannot be used once closed.
+// It's safe to call Close multiple times.
+func (bg *Background) Close() error {
+	bg.stop()
+	return bg.closeRDB()
+}
+
+// closeRDB closes the connection with redis only once.
+func (bg *Background) closeRDB() error {
+	bg.closeOnce.Do(func() {
+		bg.closeErr = bg.rdb.Close()
+	})
+	return bg.closeErr
+}
+
+// queueConfigs returns the normalized config of all the queues in cfg and
+// of the queues to process, which are only some of them if ProcessQueues is set.
+func queueConfigs(cfg *Config) (all, process map[string]uint, err error) {
+	queues := cfg.Queues
+	if !hasQueues(queues) {
+		queues = defaultQueueConfig
+	}
+	if err := validateQueueCfg(queues); err != nil {
+		return nil, nil, err
+	}
+	all = normalizeQueueCfg(queues)
+	if len(cfg.ProcessQueues) == 0 {
+		return all, all, nil
+	}
+	process, err = filterQueueCfg(queues, cfg.ProcessQueues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return all, process, nil
+}
+
+// filterQueueCfg returns the normalized config of the queues in qnames.
+// It returns an error if a queue in qnames is not in queueCfg.
+func filterQueueCfg(queueCfg map[string]uint, qnames []string) (map[string]uint, error) {
+	res := make(map[string]uint)
+	for _, qname := range qnames {
+		priority, ok := queueCfg[qname]
+		if !ok {
+			return nil, fmt.Errorf("queue %q in ProcessQueues is not configured in Queues", qname)
+		}
+		res[qname] = priority
+	}
+	return normalizeQueueCfg(res), nil
+}
+
+// normalizeQueueHandlers returns a copy of the given handlers keyed by
+// lowercased queue names, to match the queue names in task messages.
+func normalizeQueueHandlers(handlers map[string]Handler) map[string]Handler {
+	if len(handlers) == 0 {
+		return nil
+	}
+	res := make(map[string]Handler)
+	for qname, h := range handlers {
+		res[strings.ToLower(qname)] = h
+	}
+	return res
+}
+
+// normalizeQueueRetryDelayFuncs returns a copy of the given functions keyed
+// by lowercased queue names, to match the queue names in task messages.
+func normalizeQueueRetryDelayFuncs(fns map[string]func(n int, e error, t *Task) time.Duration) map[string]retryDelayFunc {
+	if len(fns) == 0 {
+		return nil
+	}
+	res := make(map[string]retryDelayFunc)
+	for qname, fn := range fns {
+		res[strings.ToLower(qname)] = fn
+	}
+	return res
+}
+
+// defaultBatchSize is the max size of batches used if Batch.Size is not set.
+const defaultBatchSize = 10
+
+// normalizeBatches returns a copy of the given batches keyed by lowercased
+// queue names, with the default batch size applied.
+func normalizeBatches(batches map[string]Batch) map[string]Batch {
+	if len(batches) == 0 {
+		return nil
+	}
+	res := make(map[string]Batch)
+	for qname, b := range batches {
+		if b.Size <= 0 {
+			b.Size = defaultBatchSize
+		}
+		res[strings.ToLower(qname)] = b
+	}
+	return res
+}
+
+// hasQueues reports whether the queue config has at least one queue
+// with a positive priority level to process.
+func hasQueues(queueCfg map[string]uint) bool {
+	for _, priority := range queueCfg {
+		if priority > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQueueCfg returns an error if a queue in the config has zero
+// priority, since the queue would never be dequeued.
+func validateQueueCfg(queueCfg map[string]uint) error {
+	var qnames []string
+	for qname, priority := range queueCfg {
+		if priority == 0 {
+			qnames = append(qnames, qname)
+		}
+	}
+	if len(qnames) == 0 {
+		return nil
+	}
+	sort.Strings(qnames)
+	return fmt.Errorf("queue %q has zero priority and would never be processed; give it a positive priority or remove it from Queues", qnames[0])
+}
+
+// maxQueuePriorityRatio is the ratio of the highest to the lowest queue
+// priority above which NewBackground logs a warning.
+const maxQueuePriorityRatio = 1000
+
+// skewedQueueCfg reports whether the highest priority in the config is more
+// than maxQueuePriorityRatio times the lowest one, along with the queues
+// of the lowest and the highest priority.
+func skewedQueueCfg(queueCfg map[string]uint) (lo, hi string, ok bool) {
+	var qnames []string
+	for qname := range queueCfg {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	for _, qname := range qnames {
+		if lo == "" || queueCfg[qname] < queueCfg[lo] {
+			lo = qname
+		}
+		if hi == "" || queueCfg[qname] > queueCfg[hi] {
+			hi = qname
+		}
+	}
+	if lo == "" || queueCfg[lo] == 0 {
+		return "", "", false
+	}
+	return lo, hi, queueCfg[hi] > queueCfg[lo]*maxQueuePriorityRatio
 }
 
 // normalizeQueueCfg divides priority numbers by their
@@ -5,10 +5,21 @@
 package asynq
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
 	"go.uber.org/goleak"
 )
 
@@ -40,6 +51,655 @@ func TestBackground(t *testing.T) {
 	bg.stop()
 }
 
+func TestBackgroundWorkerPool(t *testing.T) {
+	ignoreOpt := goleak.IgnoreTopFunction("github.com/go-redis/redis/v7/internal/pool.(*ConnPool).reaper")
+	defer goleak.VerifyNoLeaks(t, ignoreOpt)
+
+	r := &RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   15,
+	}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{
+		Concurrency: 10,
+		WorkerPool:  true,
+	})
+
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	bg.start(HandlerFunc(func(task *Task) error {
+		wg.Done()
+		return nil
+	}))
+	for i := 0; i < n; i++ {
+		if err := client.Schedule(NewTask("send_email", map[string]interface{}{"recipient_id": i}), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("tasks were not processed on the worker pool")
+	}
+
+	// Goroutines of the pool exit on shutdown.
+	bg.stop()
+}
+
+func TestBackgroundEmptyQueueConfig(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+
+	tests := []struct {
+		desc   string
+		queues map[string]uint
+	}{
+		{"empty", map[string]uint{}},
+		{"zero priority", map[string]uint{"default": 0, "low": 0}},
+	}
+
+	for _, tc := range tests {
+		bg := NewBackground(r, &Config{
+			Concurrency: 1,
+			Queues:      tc.queues,
+		})
+		if got, want := bg.processor.queues(), []string{base.DefaultQueueName}; !cmp.Equal(want, got) {
+			t.Errorf("%s: queues() = %v, want %v", tc.desc, got, want)
+		}
+
+		processed := make(chan *Task, 1)
+		bg.start(HandlerFunc(func(task *Task) error {
+			processed <- task
+			return nil
+		}))
+		if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case task := <-processed:
+			if task.Type != "send_email" {
+				t.Errorf("%s: processed task of type %q, want %q", tc.desc, task.Type, "send_email")
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: task in the default queue was not processed", tc.desc)
+		}
+		bg.stop()
+	}
+}
+
+func TestBackgroundCorrelationID(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 1})
+
+	type result struct {
+		id string
+		ok bool
+	}
+	results := make(chan result, 2)
+	bg.start(HandlerFunc(func(task *Task) error {
+		id, ok := GetCorrelationID(task)
+		results <- result{id, ok}
+		return nil
+	}))
+	defer bg.stop()
+
+	if err := client.Schedule(NewTask("send_email", nil), time.Now(), CorrelationID("req-123")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	want := []result{{"req-123", true}, {"", false}}
+	for _, w := range want {
+		select {
+		case got := <-results:
+			if got != w {
+				t.Errorf("GetCorrelationID(task) = %q, %t; want %q, %t", got.id, got.ok, w.id, w.ok)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("task was not processed")
+		}
+	}
+
+	// Not available outside of handlers.
+	if id, ok := GetCorrelationID(NewTask("send_email", nil)); ok {
+		t.Errorf("GetCorrelationID(task) = %q, true for a task not processed; want false", id)
+	}
+}
+
+func TestBackgroundForwardInterval(t *testing.T) {
+	r := setup(t)
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency:     1,
+		ForwardInterval: 200 * time.Millisecond,
+	})
+	blocking := h.NewTaskMessage("sync", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{blocking})
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}))
+	defer bg.stop()
+	defer close(release)
+	<-started
+
+	// The only worker is busy, yet the due task is moved into the queue.
+	// Note: The processor may pull it out of the queue to wait for the worker.
+	scheduled := h.NewTaskMessage("send_email", nil)
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: scheduled, Score: float64(time.Now().Add(-time.Second).Unix())}})
+	time.Sleep(time.Second)
+
+	if n := len(h.GetScheduledMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledQueue, n)
+	}
+	pending := append(h.GetEnqueuedMessages(t, r), h.GetInProgressMessages(t, r)...)
+	if diff := cmp.Diff([]*base.TaskMessage{blocking, scheduled}, pending, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in the queue and in-progress list; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestBackgroundRunShutdownOnSignal(t *testing.T) {
+	ignoreOpt := goleak.IgnoreTopFunction("github.com/go-redis/redis/v7/internal/pool.(*ConnPool).reaper")
+	defer goleak.VerifyNoLeaks(t, ignoreOpt)
+
+	// Register the signal in the test as well, so that the signal sent
+	// before Run starts listening does not terminate the test process.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	r := &RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   15,
+	}
+	bg := NewBackground(r, &Config{
+		Concurrency:     10,
+		ShutdownSignals: []os.Signal{syscall.SIGUSR1},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		bg.Run(HandlerFunc(func(task *Task) error { return nil }))
+		close(done)
+	}()
+
+	timeout := time.After(15 * time.Second)
+	for {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+			bg.mu.Lock()
+			running := bg.running
+			bg.mu.Unlock()
+			if running {
+				t.Error("background is still running after Run returned")
+			}
+			return
+		case <-timeout:
+			t.Fatal("Run did not return after receiving a shutdown signal")
+		case <-time.After(100 * time.Millisecond):
+			// signal may have been sent before Run started listening; retry.
+		}
+	}
+}
+
+func TestBackgroundRunShutdownSignals(t *testing.T) {
+	tests := []struct {
+		desc         string
+		sig          os.Signal
+		taskDuration time.Duration
+		wantEnqueued int // number of tasks put back to the queue
+	}{
+		{
+			desc:         "graceful shutdown waits for in-flight task",
+			sig:          syscall.SIGUSR1,
+			taskDuration: time.Second,
+			wantEnqueued: 0,
+		},
+		{
+			desc:         "immediate shutdown requeues in-flight task",
+			sig:          syscall.SIGUSR2,
+			taskDuration: time.Minute,
+			wantEnqueued: 1,
+		},
+	}
+
+	// Register the signals in the test as well, so that a signal delivered
+	// after Run stops listening does not terminate the test process.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	for _, tc := range tests {
+		r := setup(t)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("send_email", nil)})
+
+		bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+			Concurrency:              1,
+			ShutdownSignals:          []os.Signal{syscall.SIGUSR1},
+			ImmediateShutdownSignals: []os.Signal{syscall.SIGUSR2},
+		})
+		started := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			bg.Run(HandlerFunc(func(task *Task) error {
+				close(started)
+				select {
+				case <-time.After(tc.taskDuration):
+				case <-release:
+				}
+				return nil
+			}))
+			close(done)
+		}()
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: task was not processed", tc.desc)
+		}
+
+		if err := syscall.Kill(os.Getpid(), tc.sig.(syscall.Signal)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Run did not return after receiving %v", tc.desc, tc.sig)
+		}
+		close(release)
+
+		if got := h.GetEnqueuedMessages(t, r); len(got) != tc.wantEnqueued {
+			t.Errorf("%s: %d tasks in the queue after shutdown, want %d", tc.desc, len(got), tc.wantEnqueued)
+		}
+	}
+}
+
+func TestBackgroundActiveWorkers(t *testing.T) {
+	r := setup(t)
+	const concurrency = 3
+	for i := 0; i < 5; i++ {
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("task", nil)})
+	}
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: concurrency,
+	})
+	if got := bg.MaxWorkers(); got != concurrency {
+		t.Errorf("(*Background).MaxWorkers() = %d, want %d", got, concurrency)
+	}
+	if got := bg.ActiveWorkers(); got != 0 {
+		t.Errorf("(*Background).ActiveWorkers() = %d before start, want 0", got)
+	}
+
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		<-release
+		return nil
+	}))
+
+	// wait for all workers to be busy.
+	deadline := time.Now().Add(5 * time.Second)
+	for bg.ActiveWorkers() < concurrency && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := bg.ActiveWorkers(); got != concurrency {
+		t.Errorf("(*Background).ActiveWorkers() = %d with saturated workers, want %d", got, concurrency)
+	}
+
+	close(release)
+	bg.stop()
+	if got := bg.ActiveWorkers(); got != 0 {
+		t.Errorf("(*Background).ActiveWorkers() = %d after stop, want 0", got)
+	}
+}
+
+func TestBackgroundStats(t *testing.T) {
+	r := setup(t)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, h.NewTaskMessage("succeed", nil))
+	}
+	for i := 0; i < 2; i++ {
+		msgs = append(msgs, h.NewTaskMessage("fail", nil))
+	}
+	dead := h.NewTaskMessage("fail", nil)
+	dead.Retry = 0 // killed on the first failure
+	msgs = append(msgs, dead)
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 4,
+	})
+	bg.start(HandlerFunc(func(task *Task) error {
+		if task.Type == "fail" {
+			return fmt.Errorf("something went wrong")
+		}
+		return nil
+	}))
+	deadline := time.Now().Add(5 * time.Second)
+	for bg.Stats().Processed < int64(len(msgs)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	bg.stop()
+
+	want := Stats{
+		Processed:     6,
+		Succeeded:     3,
+		Failed:        3,
+		Retried:       2,
+		Killed:        1,
+		ActiveWorkers: 0,
+	}
+	if diff := cmp.Diff(want, bg.Stats()); diff != "" {
+		t.Errorf("(*Background).Stats() mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestBackgroundCancelByType(t *testing.T) {
+	r := setup(t)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{
+		h.NewTaskMessage("export_csv", nil),
+		h.NewTaskMessage("export_csv", nil),
+		h.NewTaskMessage("send_email", nil),
+	})
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 5,
+	})
+	release := make(chan struct{})
+	releaseExports := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		if task.Type == "export_csv" {
+			<-releaseExports
+			return nil
+		}
+		<-release
+		return nil
+	}))
+	defer bg.stop()
+	defer close(release)
+
+	waitFor := func(desc string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", desc)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("tasks to be processed", func() bool { return bg.ActiveWorkers() == 3 })
+	waitFor("subscription", func() bool {
+		return r.PubSubNumSub(base.CancelChannel).Val()[base.CancelChannel] == 1
+	})
+
+	n, err := bg.rdb.CancelByType("export_csv")
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).CancelByType(%q) = %d, %v, want 2, nil", "export_csv", n, err)
+	}
+	waitFor("tasks to be canceled", func() bool { return len(h.GetDeadMessages(t, r)) == 2 })
+	// The workers are busy until the handlers of the canceled tasks return.
+	if n := bg.ActiveWorkers(); n != 3 {
+		t.Errorf("(*Background).ActiveWorkers() = %d before the canceled handlers returned, want 3", n)
+	}
+	close(releaseExports)
+	waitFor("canceled handlers to return", func() bool { return bg.ActiveWorkers() == 1 })
+
+	if got := bg.ActiveTasks(); len(got) != 1 || got[0].Type != "send_email" {
+		t.Errorf("(*Background).ActiveTasks() = %v after cancelation, want only the send_email task", got)
+	}
+	dead := h.GetDeadMessages(t, r)
+	if len(dead) != 2 {
+		t.Fatalf("%q has %d tasks, want the 2 canceled tasks", base.DeadQueue, len(dead))
+	}
+	for _, msg := range dead {
+		if msg.Type != "export_csv" || msg.ErrorMsg != errTaskCanceled.Error() {
+			t.Errorf("dead task (Type: %q, ErrorMsg: %q), want (Type: %q, ErrorMsg: %q)",
+				msg.Type, msg.ErrorMsg, "export_csv", errTaskCanceled.Error())
+		}
+	}
+}
+
+func TestBackgroundActiveTasks(t *testing.T) {
+	r := setup(t)
+	msg := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": 42})
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{msg})
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 2,
+	})
+	if got := bg.ActiveTasks(); len(got) != 0 {
+		t.Errorf("(*Background).ActiveTasks() = %v before start, want empty", got)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		close(started)
+		<-release
+		return nil
+	}))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not processed")
+	}
+
+	got := bg.ActiveTasks()
+	if len(got) != 1 {
+		t.Fatalf("(*Background).ActiveTasks() = %v with an in-flight task, want 1 task", got)
+	}
+	want := ActiveTask{
+		ID:       msg.ID.String(),
+		Type:     msg.Type,
+		Queue:    msg.Queue,
+		Started:  got[0].Started,
+		ServerID: bg.processor.serverID,
+	}
+	if diff := cmp.Diff(want, got[0]); diff != "" {
+		t.Errorf("(*Background).ActiveTasks()[0] = %+v, want %+v; (-want,+got):\n%s", got[0], want, diff)
+	}
+	if got[0].Started.IsZero() || time.Since(got[0].Started) > 5*time.Second {
+		t.Errorf("(*Background).ActiveTasks()[0].Started = %v, want the time the task started", got[0].Started)
+	}
+	if got[0].ServerID == "" {
+		t.Errorf("(*Background).ActiveTasks()[0].ServerID is empty")
+	}
+
+	close(release)
+	bg.stop()
+	if got := bg.ActiveTasks(); len(got) != 0 {
+		t.Errorf("(*Background).ActiveTasks() = %v after stop, want empty", got)
+	}
+}
+
+func TestBackgroundInProgressLease(t *testing.T) {
+	r := setup(t)
+	// Tasks left by a background which died without restoring them.
+	orphan := h.NewTaskMessage("send_email", nil)
+	h.SeedServerInProgressQueue(t, r, []*base.TaskMessage{orphan}, "dead-server")
+	r.ZAdd(base.Servers, &redis.Z{Member: "dead-server", Score: float64(time.Now().Add(-time.Minute).Unix())})
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		InProgressLease: 30 * time.Second,
+	})
+	started := make(chan string, 1)
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		started <- task.Type
+		<-release
+		return nil
+	}))
+
+	select {
+	case typename := <-started:
+		if typename != orphan.Type {
+			t.Errorf("processed a task of type %q, want the reclaimed %q", typename, orphan.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the task of the dead background was not reclaimed")
+	}
+	// The task being processed is in the list of the background under a lease.
+	if got := h.GetServerInProgressMessages(t, r, bg.id); len(got) != 1 || got[0].ID != orphan.ID {
+		t.Errorf("%q = %v, want the task being processed", base.InProgressKey(bg.id), got)
+	}
+	if n := r.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, n)
+	}
+	if got := r.ZRange(base.Servers, 0, -1).Val(); !cmp.Equal([]string{bg.id}, got) {
+		t.Errorf("%q = %v, want only the lease of the background %q", base.Servers, got, bg.id)
+	}
+
+	close(release)
+	bg.stop()
+	if n := r.ZCard(base.Servers).Val(); n != 0 {
+		t.Errorf("%q has %d leases after stop, want 0", base.Servers, n)
+	}
+}
+
+func TestBackgroundRestored(t *testing.T) {
+	r := setup(t)
+	unfinished := []*base.TaskMessage{
+		h.NewTaskMessage("send_email", nil),
+		h.NewTaskMessage("gen_thumbnail", nil),
+		h.NewTaskMessage("reindex", nil),
+	}
+	h.SeedInProgressQueue(t, r, unfinished)
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 10,
+	})
+	if n, err := bg.Restored(); n != 0 || err != nil {
+		t.Errorf("(*Background).Restored() = %d, %v before start, want 0, nil", n, err)
+	}
+
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+	defer bg.stop()
+
+	if n, err := bg.Restored(); n != len(unfinished) || err != nil {
+		t.Errorf("(*Background).Restored() = %d, %v, want %d, nil", n, err, len(unfinished))
+	}
+}
+
+func TestBackgroundRestoreExpired(t *testing.T) {
+	tests := []struct {
+		dropExpired bool
+		wantDead    int64
+	}{
+		{dropExpired: false, wantDead: 2},
+		{dropExpired: true, wantDead: 0},
+	}
+
+	for _, tc := range tests {
+		r := setup(t)
+		valid := h.NewTaskMessage("send_reminder", nil)
+		valid.Deadline = time.Now().Add(time.Hour).Unix()
+		expired1 := h.NewTaskMessage("send_reminder", nil)
+		expired1.Deadline = time.Now().Add(-time.Minute).Unix()
+		expired2 := h.NewTaskMessage("send_reminder", nil)
+		expired2.Deadline = time.Now().Add(-time.Hour).Unix()
+		h.SeedInProgressQueue(t, r, []*base.TaskMessage{valid, expired1, h.NewTaskMessage("reindex", nil), expired2})
+
+		var mu sync.Mutex
+		var processed []string
+		bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+			Concurrency:           10,
+			DropExpiredUnfinished: tc.dropExpired,
+		})
+		bg.start(HandlerFunc(func(task *Task) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, task.Type)
+			return nil
+		}))
+		time.Sleep(time.Second)
+		bg.stop()
+
+		if n, err := bg.Restored(); n != 2 || err != nil {
+			t.Errorf("dropExpired=%t: (*Background).Restored() = %d, %v, want 2, nil", tc.dropExpired, n, err)
+		}
+		if n := bg.Expired(); n != 2 {
+			t.Errorf("dropExpired=%t: (*Background).Expired() = %d, want 2", tc.dropExpired, n)
+		}
+		mu.Lock()
+		if len(processed) != 2 {
+			t.Errorf("dropExpired=%t: processed %v, want the 2 tasks not past the deadline", tc.dropExpired, processed)
+		}
+		mu.Unlock()
+		if n := r.ZCard(base.DeadQueue).Val(); n != tc.wantDead {
+			t.Errorf("dropExpired=%t: %q has %d tasks, want %d", tc.dropExpired, base.DeadQueue, n, tc.wantDead)
+		}
+		if n := r.LLen(base.InProgressQueue).Val(); n != 0 {
+			t.Errorf("dropExpired=%t: %q has %d tasks, want 0", tc.dropExpired, base.InProgressQueue, n)
+		}
+	}
+}
+
+func TestBackgroundStartWithUnreachableRedis(t *testing.T) {
+	ignoreOpt := goleak.IgnoreTopFunction("github.com/go-redis/redis/v7/internal/pool.(*ConnPool).reaper")
+	defer goleak.VerifyNoLeaks(t, ignoreOpt)
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6390"}, &Config{})
+	handler := HandlerFunc(func(task *Task) error { return nil })
+
+	if err := bg.start(handler); err == nil {
+		t.Error("(*Background).start() = nil with unreachable redis, want error")
+	}
+	if bg.running {
+		t.Error("background is running after it failed to start")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- bg.Run(handler) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("(*Background).Run() = nil with unreachable redis, want error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("(*Background).Run() did not return with unreachable redis")
+	}
+	bg.Close()
+}
+
+func TestBackgroundClose(t *testing.T) {
+	ignoreOpt := goleak.IgnoreTopFunction("github.com/go-redis/redis/v7/internal/pool.(*ConnPool).reaper")
+	defer goleak.VerifyNoLeaks(t, ignoreOpt)
+
+	setup(t)
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 10,
+	})
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+
+	// Close should shut down the running background first.
+	if err := bg.Close(); err != nil {
+		t.Errorf("(*Background).Close() = %v, want nil", err)
+	}
+	if err := bg.Close(); err != nil {
+		t.Errorf("(*Background).Close() = %v when called twice, want nil", err)
+	}
+	if _, err := bg.rdb.CurrentStats(); err == nil {
+		t.Errorf("redis connection is usable after Close, want it closed")
+	}
+}
+
 func TestGCD(t *testing.T) {
 	tests := []struct {
 		input []uint
@@ -119,3 +779,902 @@ func TestNormalizeQueueCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestBackgroundZeroPriorityQueue(t *testing.T) {
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatalf("NewBackground did not panic with a zero priority queue")
+		}
+		if msg := fmt.Sprint(v); !strings.Contains(msg, `"low"`) {
+			t.Errorf("NewBackground panicked with %q, want the zero priority queue named", msg)
+		}
+	}()
+	NewBackground(r, &Config{
+		Queues: map[string]uint{"critical": 6, "default": 3, "low": 0},
+	})
+}
+
+func TestSkewedQueueCfg(t *testing.T) {
+	tests := []struct {
+		queues map[string]uint
+		lo, hi string
+		ok     bool
+	}{
+		{map[string]uint{"critical": 6, "default": 3, "low": 1}, "low", "critical", false},
+		{map[string]uint{"critical": 1000, "low": 1}, "low", "critical", false},
+		{map[string]uint{"critical": 1001, "default": 10, "low": 1}, "low", "critical", true},
+		{map[string]uint{"default": 1}, "default", "default", false},
+	}
+	for _, tc := range tests {
+		lo, hi, ok := skewedQueueCfg(tc.queues)
+		if ok != tc.ok || (ok && (lo != tc.lo || hi != tc.hi)) {
+			t.Errorf("skewedQueueCfg(%v) = %q, %q, %t; want %q, %q, %t", tc.queues, lo, hi, ok, tc.lo, tc.hi, tc.ok)
+		}
+	}
+}
+
+func TestFilterQueueCfg(t *testing.T) {
+	queues := map[string]uint{
+		"critical": 6,
+		"default":  3,
+		"low":      1,
+	}
+	tests := []struct {
+		qnames  []string
+		want    map[string]uint
+		wantErr bool
+	}{
+		{
+			qnames: []string{"critical"},
+			want:   map[string]uint{"critical": 1},
+		},
+		{
+			qnames: []string{"default", "low"},
+			want:   map[string]uint{"default": 3, "low": 1},
+		},
+		{
+			qnames:  []string{"critical", "unknown"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := filterQueueCfg(queues, tc.qnames)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("filterQueueCfg(%v) returned error %v, want error %t", tc.qnames, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("filterQueueCfg(%v) = %v, want %v; (-want,+got):\n%s", tc.qnames, got, tc.want, diff)
+		}
+	}
+}
+
+func TestBackgroundProcessQueues(t *testing.T) {
+	r := setup(t)
+	critical := h.NewTaskMessageWithQueue("important_task", nil, "critical")
+	def := h.NewTaskMessage("minor_task", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{critical}, "critical")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{def})
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency:   10,
+		Queues:        map[string]uint{"critical": 6, "default": 3},
+		ProcessQueues: []string{"critical"},
+	})
+
+	var mu sync.Mutex
+	var processed []string
+	bg.start(HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task.Type)
+		return nil
+	}))
+	time.Sleep(time.Second)
+	bg.stop()
+
+	if diff := cmp.Diff([]string{"important_task"}, processed); diff != "" {
+		t.Errorf("processed tasks mismatch; (-want,+got):\n%s", diff)
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r)
+	if diff := cmp.Diff([]*base.TaskMessage{def}, gotEnqueued); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got):\n%s", base.DefaultQueue, diff)
+	}
+}
+
+func TestNewBackgroundPanicsWithUnknownProcessQueue(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expected NewBackground to panic")
+		}
+	}()
+
+	NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Queues:        map[string]uint{"critical": 6, "default": 3},
+		ProcessQueues: []string{"low"},
+	})
+}
+
+func TestBackgroundRunWithNilHandler(t *testing.T) {
+	// Note: Nothing listens on the address, so Run would fail with
+	// another error if it accessed redis before checking the handler.
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:1", DB: 14}, &Config{})
+
+	if err := bg.Run(nil); err != errNilHandler {
+		t.Errorf("(*Background).Run(nil) = %v, want %v", err, errNilHandler)
+	}
+	if bg.running {
+		t.Error("background is running after Run failed")
+	}
+}
+
+func TestBackgroundPriorityAging(t *testing.T) {
+	r := setup(t)
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Queues:        map[string]uint{"critical": 2, "default": 1},
+		PriorityAging: time.Minute,
+	})
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+	bg.stop()
+
+	got := r.HGetAll(base.PriorityAging).Val()
+	want := map[string]string{"critical": "60000", "default": "60000"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("%q = %v, want %v; (-want,+got):\n%s", base.PriorityAging, got, want, diff)
+	}
+
+	// Starting without priority aging disables it.
+	bg = NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Queues: map[string]uint{"critical": 2, "default": 1},
+	})
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+	bg.stop()
+	if got := r.HLen(base.PriorityAging).Val(); got != 0 {
+		t.Errorf("%q has %d fields, want 0", base.PriorityAging, got)
+	}
+}
+
+func TestBackgroundQueueConfig(t *testing.T) {
+	tests := []struct {
+		cfg         *Config
+		want        map[string]uint
+		wantOrdered []string
+	}{
+		{
+			cfg:         &Config{},
+			want:        map[string]uint{"default": 1},
+			wantOrdered: nil,
+		},
+		{
+			cfg: &Config{
+				Queues: map[string]uint{"critical": 6, "default": 3, "low": 3},
+			},
+			want:        map[string]uint{"critical": 2, "default": 1, "low": 1},
+			wantOrdered: nil,
+		},
+		{
+			cfg: &Config{
+				Queues:         map[string]uint{"critical": 6, "default": 3, "low": 1},
+				StrictPriority: true,
+			},
+			want:        map[string]uint{"critical": 6, "default": 3, "low": 1},
+			wantOrdered: []string{"critical", "default", "low"},
+		},
+	}
+
+	for _, tc := range tests {
+		bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, tc.cfg)
+
+		got := bg.QueueConfig()
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("QueueConfig() = %v, want %v; (-want,+got):\n%s", got, tc.want, diff)
+		}
+		// The snapshot should not be affected by the changes to the returned map.
+		got["default"] = 100
+		if diff := cmp.Diff(tc.want, bg.QueueConfig()); diff != "" {
+			t.Errorf("QueueConfig() changed after modifying the returned map; (-want,+got):\n%s", diff)
+		}
+		gotOrdered := bg.OrderedQueues()
+		if diff := cmp.Diff(tc.wantOrdered, gotOrdered); diff != "" {
+			t.Errorf("OrderedQueues() = %v, want %v; (-want,+got):\n%s", gotOrdered, tc.wantOrdered, diff)
+		}
+		bg.Close()
+	}
+}
+
+func TestBackgroundQueueConfigWithDiscoveredQueues(t *testing.T) {
+	r := setup(t)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessageWithQueue("sync", nil, "tenant_a")}, "tenant_a")
+
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Queues:         map[string]uint{"critical": 2, "default": 1},
+		StrictPriority: true,
+		DiscoverQueues: true,
+	})
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+	// Note: Read the config while the processor discovers queues,
+	// to find data races with go test -race.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		bg.QueueConfig()
+		bg.OrderedQueues()
+		time.Sleep(10 * time.Millisecond)
+	}
+	got, gotOrdered := bg.QueueConfig(), bg.OrderedQueues()
+	bg.stop()
+
+	want := map[string]uint{"critical": 2, "default": 1, "tenant_a": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("QueueConfig() = %v, want %v; (-want,+got):\n%s", got, want, diff)
+	}
+	if len(gotOrdered) != 3 || gotOrdered[0] != "critical" {
+		t.Errorf("OrderedQueues() = %v, want 3 queues with %q first", gotOrdered, "critical")
+	}
+}
+
+func TestBackgroundOnShutdown(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 1})
+
+	var finished int32
+	started := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}))
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if atomic.LoadInt32(&finished) == 0 {
+				t.Errorf("shutdown hook %q called before the workers finished", name)
+			}
+			calls = append(calls, name)
+		}
+	}
+	bg.OnShutdown(record("first"))
+	bg.OnShutdown(func() { panic("something went wrong") })
+	bg.OnShutdown(record("second"))
+	bg.OnShutdown(func() { bg.Restored() }) // can call the methods of the background
+
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task was not processed")
+	}
+	bg.stop()
+	bg.stop() // no-op
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{"first", "second"}, calls); diff != "" {
+		t.Errorf("mismatch found in shutdown hook calls; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestBackgroundSetConcurrency(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 2})
+
+	var running int32
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		atomic.AddInt32(&running, 1)
+		<-release
+		atomic.AddInt32(&running, -1)
+		return nil
+	}))
+	defer bg.stop()
+	defer close(release)
+
+	for i := 0; i < 10; i++ {
+		if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRunning := func(want int32) {
+		t.Helper()
+		time.Sleep(500 * time.Millisecond)
+		if got := atomic.LoadInt32(&running); got != want {
+			t.Fatalf("%d tasks are running with concurrency of %d, want %d", got, bg.MaxWorkers(), want)
+		}
+	}
+
+	waitRunning(2)
+	bg.SetConcurrency(4)
+	if got := bg.MaxWorkers(); got != 4 {
+		t.Errorf("MaxWorkers() = %d after SetConcurrency(4), want 4", got)
+	}
+	waitRunning(4)
+
+	// Shrinking doesn't interrupt the running tasks.
+	bg.SetConcurrency(1)
+	waitRunning(4)
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+	waitRunning(1)
+	release <- struct{}{}
+	waitRunning(1)
+}
+
+func TestBackgroundBurstConcurrency(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 2})
+
+	var running int32
+	release := make(chan struct{})
+	bg.start(HandlerFunc(func(task *Task) error {
+		atomic.AddInt32(&running, 1)
+		<-release
+		atomic.AddInt32(&running, -1)
+		return nil
+	}))
+	defer bg.stop()
+	defer close(release)
+
+	for i := 0; i < 10; i++ {
+		if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	bg.BurstConcurrency(5, time.Now().Add(time.Second))
+	if got := bg.MaxWorkers(); got != 5 {
+		t.Errorf("MaxWorkers() = %d during the burst, want 5", got)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if got := atomic.LoadInt32(&running); got != 5 {
+		t.Errorf("%d tasks are running during the burst, want 5", got)
+	}
+	time.Sleep(time.Second)
+	if got := bg.MaxWorkers(); got != 2 {
+		t.Errorf("MaxWorkers() = %d after the burst, want 2", got)
+	}
+	// The tasks running are not interrupted when the burst ends.
+	if got := atomic.LoadInt32(&running); got != 5 {
+		t.Errorf("%d tasks are running right after the burst, want 5", got)
+	}
+
+	// SetConcurrency ends the burst, and its concurrency is kept after
+	// the burst would have ended.
+	bg.BurstConcurrency(8, time.Now().Add(500*time.Millisecond))
+	bg.SetConcurrency(3)
+	time.Sleep(time.Second)
+	if got := bg.MaxWorkers(); got != 3 {
+		t.Errorf("MaxWorkers() = %d after SetConcurrency(3) during the burst, want 3", got)
+	}
+
+	// A burst below the concurrency has no effect.
+	bg.BurstConcurrency(1, time.Now().Add(time.Second))
+	if got := bg.MaxWorkers(); got != 3 {
+		t.Errorf("MaxWorkers() = %d during the burst of 1, want 3", got)
+	}
+}
+
+func TestBackgroundConcurrencyWarmup(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	bg := NewBackground(r, &Config{Concurrency: 10, ConcurrencyWarmup: time.Second})
+	bg.start(HandlerFunc(func(task *Task) error { return nil }))
+	defer bg.stop()
+
+	if got := bg.MaxWorkers(); got != 1 {
+		t.Errorf("MaxWorkers() = %d right after start, want 1", got)
+	}
+	seen := make(map[int]bool)
+	last := 1
+	for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		got := bg.MaxWorkers()
+		if got < last {
+			t.Fatalf("MaxWorkers() went down from %d to %d during warmup", last, got)
+		}
+		seen[got] = true
+		last = got
+	}
+	if last != 10 {
+		t.Errorf("MaxWorkers() = %d after warmup, want 10", last)
+	}
+	if len(seen) < 5 {
+		t.Errorf("MaxWorkers() took %d distinct values during warmup, want it to grow gradually", len(seen))
+	}
+
+	// SetConcurrency ends the warmup.
+	bg2 := NewBackground(r, &Config{Concurrency: 10, ConcurrencyWarmup: 10 * time.Second})
+	bg2.start(HandlerFunc(func(task *Task) error { return nil }))
+	defer bg2.stop()
+	bg2.SetConcurrency(3)
+	time.Sleep(200 * time.Millisecond)
+	if got := bg2.MaxWorkers(); got != 3 {
+		t.Errorf("MaxWorkers() = %d after SetConcurrency(3) during warmup, want 3", got)
+	}
+}
+
+func TestBackgroundDeadRetry(t *testing.T) {
+	r := setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(opt)
+	bg := NewBackground(opt, &Config{
+		Concurrency:       1,
+		ForwardInterval:   100 * time.Millisecond,
+		DeadRetryInterval: 2 * time.Second,
+		DeadRetryAttempts: 1,
+	})
+
+	var calls int32
+	bg.start(HandlerFunc(func(task *Task) error {
+		atomic.AddInt32(&calls, 1)
+		return fmt.Errorf("something went wrong")
+	}))
+	defer bg.stop()
+
+	if err := client.Schedule(NewTask("send_email", nil), time.Now(), MaxRetry(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The task is deferred instead of killed.
+	time.Sleep(time.Second)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("handler called %d times before the dead retry interval, want 1", got)
+	}
+	deferred := h.GetDeferredEntries(t, r)
+	if len(deferred) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.DeferredQueue, len(deferred))
+	}
+	if got := deferred[0].Msg.DeadRetried; got != 1 {
+		t.Errorf("DeadRetried = %d, want 1", got)
+	}
+	if dead := h.GetDeadMessages(t, r); len(dead) != 0 {
+		t.Errorf("%q has %d tasks before the dead retry, want 0", base.DeadQueue, len(dead))
+	}
+
+	// The task is attempted again after the interval, and killed for good
+	// with no dead retries left.
+	time.Sleep(3 * time.Second)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("handler called %d times after the dead retry interval, want 2", got)
+	}
+	if deferred := h.GetDeferredEntries(t, r); len(deferred) != 0 {
+		t.Errorf("%q has %d tasks after the dead retry, want 0", base.DeferredQueue, len(deferred))
+	}
+	dead := h.GetDeadMessages(t, r)
+	if len(dead) != 1 {
+		t.Fatalf("%q has %d tasks after the dead retry, want 1", base.DeadQueue, len(dead))
+	}
+	if got := dead[0].DeadRetried; got != 1 {
+		t.Errorf("DeadRetried of the dead task = %d, want 1", got)
+	}
+}
+
+func TestBackgroundVisibilityTimeout(t *testing.T) {
+	r := setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(opt)
+	bg := NewBackground(opt, &Config{
+		Concurrency:       2,
+		ForwardInterval:   100 * time.Millisecond,
+		VisibilityTimeout: 2 * time.Second,
+	})
+
+	var extendCalls, stallCalls int32
+	var extendErr, stallErr error
+	mux := NewServeMux()
+	mux.HandleFunc("extend", func(task *Task) error {
+		atomic.AddInt32(&extendCalls, 1)
+		for i := 0; i < 6; i++ {
+			time.Sleep(500 * time.Millisecond)
+			if err := ExtendVisibility(task, 2*time.Second); err != nil {
+				extendErr = err
+				return err
+			}
+		}
+		return nil
+	})
+	mux.HandleFunc("stall", func(task *Task) error {
+		if atomic.AddInt32(&stallCalls, 1) == 1 {
+			time.Sleep(3500 * time.Millisecond)
+			stallErr = ExtendVisibility(task, 2*time.Second)
+		}
+		return nil
+	})
+	bg.start(mux)
+
+	for _, typename := range []string{"extend", "stall"} {
+		if err := client.Schedule(NewTask(typename, nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Second)
+	bg.stop()
+
+	// The task whose visibility is extended is processed once.
+	if got := atomic.LoadInt32(&extendCalls); got != 1 {
+		t.Errorf("handler of the extended task called %d times, want 1", got)
+	}
+	if extendErr != nil {
+		t.Errorf("ExtendVisibility returned error: %v", extendErr)
+	}
+	// The stalled task is moved back to the queue after the timeout.
+	if got := atomic.LoadInt32(&stallCalls); got != 2 {
+		t.Errorf("handler of the stalled task called %d times, want 2", got)
+	}
+	if stallErr != ErrVisibilityExpired {
+		t.Errorf("ExtendVisibility after the timeout returned %v, want %v", stallErr, ErrVisibilityExpired)
+	}
+	// Finished tasks are acknowledged.
+	if got := h.GetInvisibleEntries(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the tasks finished, want 0", base.InvisibleTasks, len(got))
+	}
+	if got := h.GetInProgressMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the tasks finished, want 0", base.InProgressQueue, len(got))
+	}
+	if err := ExtendVisibility(NewTask("extend", nil), time.Second); err == nil {
+		t.Errorf("ExtendVisibility with a task not being processed returned nil, want error")
+	}
+}
+
+func TestBackgroundHandoffOnShutdown(t *testing.T) {
+	r := setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(opt)
+	// Note: The restore lock taken by the first background keeps the second
+	// one from restoring the tasks of the shared in-progress list on start.
+	cfg := &Config{Concurrency: 3, HandoffOnShutdown: true, RestoreLockTTL: time.Minute}
+
+	// The first background is shut down while processing the tasks.
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	defer close(release)
+	bg1 := NewBackground(opt, cfg)
+	bg1.start(HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}))
+	for i := 0; i < 3; i++ {
+		if err := client.Schedule(NewTask("sync", map[string]interface{}{"n": i}), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("first background started %d tasks, want 3", i)
+		}
+	}
+
+	var mu sync.Mutex
+	processed := make(map[int]int)
+	live := HandlerFunc(func(task *Task) error {
+		n, err := task.Payload.GetInt("n")
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		processed[n]++
+		mu.Unlock()
+		time.Sleep(3 * time.Second)
+		return nil
+	})
+	bg2 := NewBackground(opt, cfg)
+	bg2.start(live)
+	bg1.stop()
+
+	// The first background restarting while the handed off tasks are
+	// processed doesn't requeue them.
+	time.Sleep(2 * time.Second)
+	r.Del(base.RestoreLock) // as if the lock expired
+	bg3 := NewBackground(opt, cfg)
+	bg3.start(live)
+	time.Sleep(4 * time.Second)
+	bg3.stop()
+	bg2.stop()
+
+	want := map[int]int{0: 1, 1: 1, 2: 1}
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("number of times each task was processed after the handoff mismatch: (-want, +got)\n%s", diff)
+	}
+	if got := h.GetHandoffMessages(t, r, "default"); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the tasks finished, want 0", base.HandoffKey("default"), len(got))
+	}
+	if got := h.GetInProgressMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the tasks finished, want 0", base.InProgressQueue, len(got))
+	}
+	if n := r.ZCard(base.HandedOff).Val(); n != 0 {
+		t.Errorf("%q has %d tasks after the tasks finished, want 0", base.HandedOff, n)
+	}
+}
+
+func TestBackgroundHandlerCoverage(t *testing.T) {
+	setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	queues := map[string]uint{"default": 1, "emails": 1, "sink": 1, "events": 1}
+	noop := HandlerFunc(func(task *Task) error { return nil })
+
+	// "default" and "emails" have no handler for the tasks of types
+	// not registered, "sink" has a default handler of its own and
+	// "events" is processed in batches.
+	newMux := func() *ServeMux {
+		mux := NewServeMux()
+		mux.Handle("email:welcome", noop)
+		mux.HandleQueueDefault("sink", noop)
+		return mux
+	}
+	newConfig := func(coverage HandlerCoverage) *Config {
+		return &Config{
+			Queues:          queues,
+			HandlerCoverage: coverage,
+			QueueHandlers:   map[string]Handler{"emails": newMux()},
+			Batches: map[string]Batch{
+				"events": {Handler: BatchHandlerFunc(func(tasks []*Task) []error { return nil }), Size: 10},
+			},
+		}
+	}
+
+	bg := NewBackground(opt, newConfig(RejectUncovered))
+	err := bg.start(newMux())
+	if err == nil {
+		bg.stop()
+		t.Fatalf("start with uncovered queues returned nil, want error")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "default") || !strings.Contains(msg, "emails") ||
+		strings.Contains(msg, "sink") || strings.Contains(msg, "events") {
+		t.Errorf("start returned error %q, want error listing only %q and %q", msg, "default", "emails")
+	}
+	bg.Close()
+
+	var buf bytes.Buffer
+	bg = NewBackground(opt, newConfig(WarnUncovered))
+	bg.logger = newLogger(JSONLog, &buf)
+	if err := bg.start(newMux()); err != nil {
+		t.Fatalf("start with WarnUncovered returned error: %v", err)
+	}
+	bg.stop()
+	if !strings.Contains(buf.String(), "No default handler for queues [default emails]") {
+		t.Errorf("start with uncovered queues logged %q, want warning", buf.String())
+	}
+
+	// A default handler covers all queues.
+	mux := newMux()
+	mux.HandleDefault(noop)
+	cfg := newConfig(RejectUncovered)
+	cfg.QueueHandlers = nil
+	bg = NewBackground(opt, cfg)
+	if err := bg.start(mux); err != nil {
+		t.Errorf("start with a default handler returned error: %v", err)
+	}
+	bg.stop()
+}
+
+func TestBackgroundRecentEvents(t *testing.T) {
+	setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(opt)
+	bg := NewBackground(opt, &Config{Concurrency: 1, RecentEventsSize: 4})
+	if got := NewBackground(opt, &Config{}).RecentEvents(10); got != nil {
+		t.Errorf("RecentEvents(10) without RecentEventsSize = %v, want nil", got)
+	}
+
+	bg.start(HandlerFunc(func(task *Task) error {
+		if task.Type == "fail" {
+			return fmt.Errorf("something went wrong")
+		}
+		return nil
+	}))
+	for _, typename := range []string{"first", "fail", "last"} {
+		if err := client.Schedule(NewTask(typename, nil), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Second)
+	bg.stop()
+
+	// Only the latest events are kept.
+	type event struct {
+		Kind  EventKind
+		Type  string
+		Error string
+	}
+	want := []event{
+		{TaskStarted, "fail", ""},
+		{TaskFailed, "fail", "something went wrong"},
+		{TaskStarted, "last", ""},
+		{TaskSucceeded, "last", ""},
+	}
+	var got []event
+	for _, e := range bg.RecentEvents(10) {
+		if e.Time.IsZero() || e.TaskID == "" || e.Queue != "default" {
+			t.Errorf("event %+v is missing the time or the task", e)
+		}
+		got = append(got, event{e.Kind, e.Type, e.Error})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RecentEvents(10) mismatch: (-want, +got)\n%s", diff)
+	}
+	if got := bg.RecentEvents(1); len(got) != 1 || got[0].Kind != TaskSucceeded {
+		t.Errorf("RecentEvents(1) = %+v, want the last event", got)
+	}
+}
+
+func TestBackgroundFollowUpTasks(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 2})
+
+	type followUp struct {
+		typename, parentID string
+		payload            map[string]interface{}
+	}
+	followUps := make(chan followUp, 4)
+	bg.start(HandlerFunc(func(task *Task) error {
+		switch task.Type {
+		case "succeed":
+			return nil
+		case "fail":
+			return fmt.Errorf("something went wrong")
+		}
+		id, _ := GetParentID(task)
+		followUps <- followUp{task.Type, id, task.Payload.data}
+		return nil
+	}))
+	defer bg.stop()
+
+	succeeded, err := client.EnqueueWithID(NewTask("succeed", nil),
+		OnComplete(NewTask("notify", map[string]interface{}{"result": "ok"})),
+		OnFailure(NewTask("alert", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := client.EnqueueWithID(NewTask("fail", nil), MaxRetry(0),
+		OnComplete(NewTask("notify", nil)),
+		OnFailure(NewTask("alert", map[string]interface{}{"result": "dead"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]followUp{
+		succeeded: {"notify", succeeded, map[string]interface{}{"result": "ok"}},
+		failed:    {"alert", failed, map[string]interface{}{"result": "dead"}},
+	}
+	got := make(map[string]followUp)
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case f := <-followUps:
+			got[f.parentID] = f
+		case <-timeout:
+			t.Fatalf("got follow-up tasks %v, want %v", got, want)
+		}
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(followUp{})); diff != "" {
+		t.Errorf("mismatch found in follow-up tasks; (-want,+got)\n%s", diff)
+	}
+	select {
+	case f := <-followUps:
+		t.Errorf("unexpected follow-up task %v", f)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestBackgroundCodec(t *testing.T) {
+	r := setup(t)
+	opt := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(opt, Codec(GobCodec))
+	bg := NewBackground(opt, &Config{Concurrency: 2, Codec: GobCodec})
+
+	processed := make(chan *Task, 4)
+	var attempts int32
+	bg.start(HandlerFunc(func(task *Task) error {
+		processed <- task
+		if task.Type == "flaky" && atomic.AddInt32(&attempts, 1) == 1 {
+			return fmt.Errorf("something went wrong")
+		}
+		return nil
+	}))
+	defer bg.stop()
+
+	if err := client.Schedule(NewTask("flaky", map[string]interface{}{"user_id": 42}), time.Now(),
+		OnComplete(NewTask("notify", nil)), RetrySchedule([]time.Duration{time.Second})); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"flaky", "flaky", "notify"}
+	for _, typename := range want {
+		select {
+		case task := <-processed:
+			if task.Type != typename {
+				t.Errorf("processed %q, want %q", task.Type, typename)
+			}
+			if task.Type == "flaky" {
+				if id, err := task.Payload.GetInt("user_id"); id != 42 || err != nil {
+					t.Errorf("Payload.GetInt(%q) = %d, %v; want 42, nil", "user_id", id, err)
+				}
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%q was not processed", typename)
+		}
+	}
+
+	// A task encoded with another codec is quarantined, not processed.
+	if err := NewClient(opt).Schedule(NewTask("json_task", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case task := <-processed:
+		t.Errorf("processed %q encoded with another codec", task.Type)
+	case <-time.After(2 * time.Second):
+	}
+	if n := r.ZCard(base.MalformedQueue).Val(); n != 1 {
+		t.Errorf("%q has %d tasks, want the task encoded with another codec", base.MalformedQueue, n)
+	}
+}
+
+func TestBackgroundReconfigure(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{
+		Concurrency:  2,
+		Queues:       map[string]uint{"default": 1},
+		PollInterval: 100 * time.Millisecond,
+	})
+
+	processed := make(chan string, 2)
+	bg.start(HandlerFunc(func(task *Task) error {
+		processed <- task.Type
+		return nil
+	}))
+	defer bg.stop()
+
+	if err := bg.Reconfigure(&Config{Queues: map[string]uint{"default": 1, "critical": 0}}); err == nil {
+		t.Errorf("Reconfigure with a zero priority queue returned nil, want error")
+	}
+	if err := bg.Reconfigure(&Config{ProcessQueues: []string{"unknown"}}); err == nil {
+		t.Errorf("Reconfigure with an unknown queue in ProcessQueues returned nil, want error")
+	}
+
+	if err := client.Schedule(NewTask("critical_task", nil), time.Now(), Queue("critical")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case typename := <-processed:
+		t.Fatalf("processed %q before the queue was added", typename)
+	case <-time.After(time.Second):
+	}
+
+	if err := bg.Reconfigure(&Config{Queues: map[string]uint{"default": 1, "critical": 2}}); err != nil {
+		t.Fatalf("Reconfigure returned error: %v", err)
+	}
+	select {
+	case typename := <-processed:
+		if typename != "critical_task" {
+			t.Errorf("processed %q, want %q", typename, "critical_task")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task in the added queue was not processed")
+	}
+	want := map[string]uint{"default": 1, "critical": 2}
+	if diff := cmp.Diff(want, bg.QueueConfig()); diff != "" {
+		t.Errorf("mismatch found in QueueConfig(); (-want,+got)\n%s", diff)
+	}
+}
@@ -15,13 +15,25 @@ import (
 // Simple E2E Benchmark testing with no scheduled tasks and
 // no retries.
 func BenchmarkEndToEndSimple(b *testing.B) {
+	benchmarkEndToEndSimple(b, 0)
+}
+
+// Same as BenchmarkEndToEndSimple, but tasks are prefetched
+// in batches of 10.
+func BenchmarkEndToEndSimplePrefetch(b *testing.B) {
+	benchmarkEndToEndSimple(b, 10)
+}
+
+func benchmarkEndToEndSimple(b *testing.B, prefetch int) {
 	const count = 100000
 	for n := 0; n < b.N; n++ {
 		b.StopTimer() // begin setup
-		r := setup(b)
+		setup(b)
+		r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
 		client := NewClient(r)
 		bg := NewBackground(r, &Config{
 			Concurrency: 10,
+			Prefetch:    prefetch,
 			RetryDelayFunc: func(n int, err error, t *Task) time.Duration {
 				return time.Second
 			},
@@ -55,7 +67,8 @@ func BenchmarkEndToEnd(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		b.StopTimer() // begin setup
 		rand.Seed(time.Now().UnixNano())
-		r := setup(b)
+		setup(b)
+		r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
 		client := NewClient(r)
 		bg := NewBackground(r, &Config{
 			Concurrency: 10,
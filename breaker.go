@@ -0,0 +1,159 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// CircuitBreaker specifies when to stop processing a queue whose tasks
+// keep failing, e.g. because a downstream service is down.
+//
+// The breaker trips (opens) when the rate of failed tasks among the tasks
+// processed in the recent window exceeds FailureRate. While the breaker is
+// open, no tasks are pulled out of the queue. After CoolDown, tasks are
+// pulled again to probe the queue: the breaker closes on the first success,
+// and opens again on the first failure.
+type CircuitBreaker struct {
+	// Rate of failed tasks, between 0 and 1, above which the breaker trips.
+	//
+	// If set to zero or negative value, it defaults to 0.5.
+	FailureRate float64
+
+	// Min number of processed tasks in the window before the breaker can trip.
+	//
+	// If set to zero or negative value, it defaults to 10.
+	MinTasks int
+
+	// Duration of the window in which processed tasks are counted.
+	// Counts are reset at the end of each window.
+	//
+	// If set to zero or negative value, it defaults to 1 minute.
+	Window time.Duration
+
+	// Duration to stop processing the queue once the breaker trips.
+	//
+	// If set to zero or negative value, it defaults to 30 seconds.
+	CoolDown time.Duration
+}
+
+const (
+	defaultBreakerFailureRate = 0.5
+	defaultBreakerMinTasks    = 10
+	defaultBreakerWindow      = time.Minute
+	defaultBreakerCoolDown    = 30 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is the circuit breaker of a queue.
+//
+// allow is called by the "processor" goroutine, and record is called by
+// worker goroutines, so the fields are guarded by mu.
+type breaker struct {
+	qname  string
+	cfg    CircuitBreaker
+	clock  base.Clock
+	logger *logger
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	succeeded   int
+	failed      int
+	openedAt    time.Time
+}
+
+func newBreaker(qname string, cfg CircuitBreaker, clock base.Clock) *breaker {
+	if cfg.FailureRate <= 0 {
+		cfg.FailureRate = defaultBreakerFailureRate
+	}
+	if cfg.MinTasks <= 0 {
+		cfg.MinTasks = defaultBreakerMinTasks
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = defaultBreakerCoolDown
+	}
+	return &breaker{
+		qname:       qname,
+		cfg:         cfg,
+		clock:       clock,
+		logger:      defaultLogger,
+		windowStart: clock.Now(),
+	}
+}
+
+// allow reports whether tasks can be pulled out of the queue.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if b.clock.Now().Sub(b.openedAt) < b.cfg.CoolDown {
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+	return true
+}
+
+// record records the result of a task processed from the queue.
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	switch b.state {
+	case breakerOpen:
+		// result of a task pulled out before the breaker tripped.
+		return
+	case breakerHalfOpen:
+		if success {
+			b.logger.printf("[INFO] Circuit breaker for queue %q closed\n", b.qname)
+			b.state = breakerClosed
+			b.reset(now)
+		} else {
+			b.logger.printf("[WARN] Circuit breaker for queue %q opened again after a failed probe\n", b.qname)
+			b.trip(now)
+		}
+		return
+	}
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.reset(now)
+	}
+	if success {
+		b.succeeded++
+	} else {
+		b.failed++
+	}
+	total := b.succeeded + b.failed
+	if total >= b.cfg.MinTasks && float64(b.failed)/float64(total) > b.cfg.FailureRate {
+		b.logger.printf("[WARN] Circuit breaker for queue %q opened: %d of %d tasks failed, pausing the queue for %v\n",
+			b.qname, b.failed, total, b.cfg.CoolDown)
+		b.trip(now)
+	}
+}
+
+func (b *breaker) trip(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.reset(now)
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.windowStart = now
+	b.succeeded = 0
+	b.failed = 0
+}
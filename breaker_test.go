@@ -0,0 +1,73 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+func TestBreaker(t *testing.T) {
+	clock := base.NewSimulatedClock(time.Now())
+	b := newBreaker("default", CircuitBreaker{
+		FailureRate: 0.5,
+		MinTasks:    4,
+		Window:      time.Minute,
+		CoolDown:    30 * time.Second,
+	}, clock)
+
+	// The breaker does not trip until MinTasks tasks are processed.
+	b.record(false)
+	b.record(false)
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("breaker tripped after 3 tasks, want it to wait for 4 tasks")
+	}
+
+	// Counts are reset at the end of the window.
+	clock.AdvanceTime(time.Minute)
+	b.record(false)
+	b.record(true)
+	b.record(true)
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("breaker tripped with failure rate of 0.5, want it to trip above 0.5")
+	}
+
+	// Sustained failures trip the breaker.
+	b.record(false)
+	if b.allow() {
+		t.Fatalf("breaker did not trip with failure rate of 0.6")
+	}
+	clock.AdvanceTime(29 * time.Second)
+	if b.allow() {
+		t.Fatalf("breaker allowed tasks before the cool-down ended")
+	}
+
+	// A failed probe opens the breaker again.
+	clock.AdvanceTime(time.Second)
+	if !b.allow() {
+		t.Fatalf("breaker did not allow a probe after the cool-down")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatalf("breaker allowed tasks after a failed probe")
+	}
+
+	// A successful probe closes the breaker.
+	clock.AdvanceTime(30 * time.Second)
+	if !b.allow() {
+		t.Fatalf("breaker did not allow a probe after the cool-down")
+	}
+	b.record(true)
+	b.record(false)
+	b.record(false)
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("breaker is open after a successful probe, want it closed with the counts reset")
+	}
+}
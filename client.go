@@ -5,9 +5,16 @@
 package asynq
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
 	"github.com/hibiken/asynq/internal/rdb"
 	"github.com/rs/xid"
@@ -21,12 +28,236 @@ import (
 // Clients are safe for concurrent use by multiple goroutines.
 type Client struct {
 	rdb *rdb.RDB
+
+	// compress indicates whether to compress payloads larger than
+	// compressThreshold bytes.
+	compress          bool
+	compressThreshold int
+
+	// memory rejects tasks while redis memory usage is high, if set.
+	memory *memoryGuard
+
+	// defaultOpts holds the options applied to all tasks, which are
+	// overridden by the options passed to each call.
+	defaultOpts []Option
+
+	// uniqueKeyFunc computes the unique key of the tasks enqueued with
+	// UniquePending, if set (see UniqueKeyFunc).
+	uniqueKeyFunc func(*Task) string
+
+	// validators holds the validators registered for each task type.
+	mu         sync.RWMutex
+	validators map[string]func(*Task) error
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // NewClient and returns a new Client given a redis connection option.
-func NewClient(r RedisConnOpt) *Client {
-	rdb := rdb.NewRDB(createRedisClient(r))
-	return &Client{rdb}
+//
+// opts specifies the behavior of the client. If there are conflicting
+// ClientOption values the last one overrides others.
+func NewClient(r RedisConnOpt, opts ...ClientOption) *Client {
+	c := &Client{}
+	var namespace string
+	codec := JSONCodec
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case compressionOption:
+			c.compress = true
+			c.compressThreshold = int(opt)
+		case namespaceOption:
+			namespace = string(opt)
+		case codecOption:
+			codec = MessageCodec(opt)
+		case memoryLimitOption:
+			c.memory = &memoryGuard{fraction: opt.fraction, interval: opt.interval}
+		case defaultOptionsOption:
+			c.defaultOpts = []Option(opt)
+		case uniqueKeyFuncOption:
+			c.uniqueKeyFunc = opt
+		default:
+			// ignore unexpected option
+		}
+	}
+	c.rdb = rdb.NewRDBWithNamespace(createRedisClient(r), namespace)
+	c.rdb.SetCodec(codec.baseCodec())
+	if c.memory != nil {
+		c.memory.usage = c.rdb.ServerMemory
+	}
+	return c
+}
+
+// ClientOption specifies the behavior of a client.
+type ClientOption interface{}
+
+// Internal client option representations.
+type (
+	compressionOption int
+	namespaceOption   string
+	codecOption       MessageCodec
+	memoryLimitOption struct {
+		fraction float64
+		interval time.Duration
+	}
+	defaultOptionsOption []Option
+	uniqueKeyFuncOption  func(*Task) string
+)
+
+// CompressPayload returns a client option to compress payloads of tasks
+// with gzip if their JSON encoding is larger than threshold bytes.
+//
+// Compressed payloads are decompressed before they are passed to the handler,
+// so handlers don't need to be aware of the compression.
+// Note: Backgrounds processing the tasks need to run a version of the package
+// which supports payload compression.
+func CompressPayload(threshold int) ClientOption {
+	if threshold < 0 {
+		threshold = 0
+	}
+	return compressionOption(threshold)
+}
+
+// Namespace returns a client option to specify the namespace of the redis keys
+// used by the client. It has to match the Namespace in the Config of
+// the backgrounds processing the tasks.
+func Namespace(ns string) ClientOption {
+	return namespaceOption(ns)
+}
+
+// Codec returns a client option to specify the codec of the task messages
+// written by the client. It has to match the Codec in the Config of
+// the backgrounds processing the tasks.
+func Codec(c MessageCodec) ClientOption {
+	return codecOption(c)
+}
+
+// DefaultOptions returns a client option to specify the options applied to
+// all tasks enqueued by the client, e.g. MaxRetry, Queue and Timeout.
+//
+// Options passed to each call take precedence over the default options,
+// i.e. they're applied after the default ones.
+//
+// Example:
+//
+//	client := asynq.NewClient(r, asynq.DefaultOptions(asynq.Queue("emails"), asynq.MaxRetry(5)))
+//	client.Schedule(task, time.Now())                      // in "emails" queue with 5 retries
+//	client.Schedule(task, time.Now(), asynq.MaxRetry(10)) // in "emails" queue with 10 retries
+func DefaultOptions(opts ...Option) ClientOption {
+	return defaultOptionsOption(append([]Option(nil), opts...))
+}
+
+// UniqueKeyFunc returns a client option to compute the unique key of the
+// tasks enqueued with UniquePending with fn, instead of the type and payload
+// of the task, e.g. to ignore a timestamp in the payload. Tasks pending in
+// the same queue with the same key are duplicates.
+//
+// fn must return a non-empty key, otherwise the task is not enqueued and
+// an error is returned. UniqueKey passed to each call takes precedence.
+func UniqueKeyFunc(fn func(task *Task) string) ClientOption {
+	return uniqueKeyFuncOption(fn)
+}
+
+// defaultMemoryCheckInterval is the interval to check redis memory usage
+// if the interval given to MemoryLimit is zero or negative.
+const defaultMemoryCheckInterval = 10 * time.Second
+
+// MemoryLimit returns a client option to reject tasks with ErrRedisMemoryHigh
+// while redis uses more than the given fraction, between 0 and 1, of its
+// memory limit (maxmemory), so that a runaway producer cannot make redis
+// run out of memory.
+//
+// Memory usage is checked with INFO command at most once per checkInterval
+// (10 seconds if zero or negative), so it may exceed the limit until the next
+// check. Tasks are not rejected if redis has no memory limit or if the usage
+// cannot be checked.
+func MemoryLimit(fraction float64, checkInterval time.Duration) ClientOption {
+	if checkInterval <= 0 {
+		checkInterval = defaultMemoryCheckInterval
+	}
+	return memoryLimitOption{fraction: fraction, interval: checkInterval}
+}
+
+// ErrRedisMemoryHigh indicates that the task was not enqueued because
+// redis memory usage is above the limit given to MemoryLimit.
+var ErrRedisMemoryHigh = errors.New("redis memory usage is too high")
+
+// memoryGuard caches the memory usage of redis checked with usage.
+type memoryGuard struct {
+	fraction float64
+	interval time.Duration
+	usage    func() (used, limit int64, err error)
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	used      int64
+	limit     int64
+}
+
+// check returns ErrRedisMemoryHigh if the memory usage of redis, checked
+// at most once per interval, is above the limit.
+func (g *memoryGuard) check() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now := time.Now(); now.Sub(g.checkedAt) >= g.interval {
+		g.checkedAt = now
+		used, limit, err := g.usage()
+		if err != nil {
+			// Note: Don't reject tasks if the usage is unknown.
+			used, limit = 0, 0
+		}
+		g.used, g.limit = used, limit
+	}
+	if g.limit > 0 && float64(g.used) > g.fraction*float64(g.limit) {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrRedisMemoryHigh, g.used, g.limit)
+	}
+	return nil
+}
+
+// Close closes the connection with redis.
+//
+// The client cannot be used once closed.
+// It's safe to call Close multiple times.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.rdb.Close()
+	})
+	return c.closeErr
+}
+
+// RegisterValidator registers the validator for the given task type.
+//
+// The validator is called with the task before the task is enqueued,
+// and if it returns a non-nil error, the task is not enqueued and the
+// error is returned, wrapped with the task type.
+// Tasks of types with no registered validator are not validated.
+// If a validator already exists for the type, it's replaced.
+//
+// It's safe to call RegisterValidator concurrently with Schedule.
+func (c *Client) RegisterValidator(taskType string, fn func(*Task) error) {
+	if fn == nil {
+		panic("asynq: nil validator")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.validators == nil {
+		c.validators = make(map[string]func(*Task) error)
+	}
+	c.validators[taskType] = fn
+}
+
+// validate calls the validator registered for the type of the task if any.
+func (c *Client) validate(task *Task) error {
+	c.mu.RLock()
+	fn := c.validators[task.Type]
+	c.mu.RUnlock()
+	if fn == nil {
+		return nil
+	}
+	if err := fn(task); err != nil {
+		return fmt.Errorf("invalid task of type %q: %w", task.Type, err)
+	}
+	return nil
 }
 
 // Option specifies the task processing behavior.
@@ -34,8 +265,34 @@ type Option interface{}
 
 // Internal option representations.
 type (
-	retryOption int
-	queueOption string
+	retryOption      int
+	queueOption      string
+	priorityOption   int
+	timeoutOption    time.Duration
+	deadlineOption   time.Time
+	dependsOnOption  string
+	onCompleteOption *Task
+	onFailureOption  *Task
+	weightOption     int64
+	resultTTLOption  time.Duration
+
+	retryScheduleOption []time.Duration
+
+	uniquePendingOption time.Duration
+	uniqueKeyOption     string
+	correlationIDOption string
+	serialKeyOption     string
+	categoryOption      string
+	affinityOption      string
+	pendingTTLOption    time.Duration
+	idempotencyOption   struct {
+		key string
+		ttl time.Duration
+	}
+	windowOption struct {
+		start  time.Time
+		window time.Duration
+	}
 )
 
 // MaxRetry returns an option to specify the max number of times
@@ -56,9 +313,346 @@ func Queue(name string) Option {
 	return queueOption(strings.ToLower(name))
 }
 
+// Priority returns an option to specify the priority level of the task
+// within its queue. Tasks with a higher priority are processed before
+// tasks with a lower priority in the same queue.
+//
+// Priority ranges from 0 (no priority) to 255. Value out of the range
+// is clamped to the nearest bound.
+//
+// If the queue has a priority aging period (see PriorityAging in Config),
+// the task gains priority while it waits in the queue.
+//
+// Note: Prioritized tasks are stored in a redis sorted set rather than a list,
+// so that enqueue and dequeue of those tasks take O(log(N)) instead of O(1)
+// and they cannot be waited on with blocking pop.
+// Use it only for tasks which need to jump ahead of others.
+func Priority(level int) Option {
+	if level < 0 {
+		level = 0
+	}
+	if level > base.MaxPriority {
+		level = base.MaxPriority
+	}
+	return priorityOption(level)
+}
+
+// Timeout returns an option to specify how long a task may run.
+// If the timeout elapses before the handler returns, the task is
+// treated as a failure and gets retried (or killed if it exhausted
+// its retry count).
+//
+// Note: Handler has no way to be interrupted, so the worker stays busy
+// until the handler returns and its result is ignored. The task counts
+// toward Config.Concurrency in the meantime.
+//
+// Zero or negative value means no timeout.
+func Timeout(d time.Duration) Option {
+	return timeoutOption(d)
+}
+
+// RetrySchedule returns an option to specify the delays before each retry
+// of the task, e.g. []time.Duration{time.Minute, 5 * time.Minute, time.Hour}.
+// The Nth retry uses the Nth delay, and the retries beyond the schedule use
+// the last delay.
+//
+// The schedule takes precedence over RetryDelayFunc in Config, but not over
+// the delay reported by the error returned from the handler (see RetryAfter).
+// Negative delay is treated as zero. Empty schedule has no effect.
+func RetrySchedule(delays []time.Duration) Option {
+	res := make([]time.Duration, len(delays))
+	for i, d := range delays {
+		if d < 0 {
+			d = 0
+		}
+		res[i] = d
+	}
+	return retryScheduleOption(res)
+}
+
+// Weight returns an option to specify the weight of the task, i.e. how much
+// of the concurrency of the background (see Concurrency in Config) the task
+// takes while it's processed, so that heavy tasks consume more of the budget
+// than light ones. Tasks weigh one by default.
+//
+// Weight less than one is treated as one, and weight greater than the
+// concurrency of the background is treated as the concurrency, i.e. the task
+// is processed alone. A batch (see Batches in Config) weighs one regardless
+// of the weight of its tasks.
+func Weight(n int64) Option {
+	if n < 1 {
+		n = 1
+	}
+	return weightOption(n)
+}
+
+// Deadline returns an option to specify the time after which the task is
+// not worth processing, e.g. a reminder of an event which has started.
+//
+// If the task fails and its retry would be processed after the deadline,
+// the task is sent to the dead queue immediately instead of being retried.
+// The deadline doesn't affect the attempt already processed by a worker.
+func Deadline(t time.Time) Option {
+	return deadlineOption(t)
+}
+
+// IdempotencyKey returns an option to specify an idempotency key of the task.
+//
+// Once a task is enqueued with the key, attempts to enqueue a task with the
+// same key within ttl don't enqueue the task and return an
+// *IdempotentReplayError, which matches ErrIdempotentReplay with errors.Is.
+// Unlike uniqueness of a task, the key is kept for ttl even after the task
+// has been processed, so that retried requests are not processed twice.
+//
+// Zero or negative ttl is replaced with the default of 24 hours.
+func IdempotencyKey(key string, ttl time.Duration) Option {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return idempotencyOption{key, ttl}
+}
+
+// UniquePending returns an option to coalesce the task with the same type
+// and payload pending in the same queue.
+//
+// While the task is waiting to be processed, attempts to enqueue the same
+// task don't enqueue it and return ErrDuplicateTask. Once the task is
+// pulled out of the queue to be processed, the same task can be enqueued
+// again, so that a change made while the task is running is not missed.
+// The lock expires after ttl even if the task is still pending.
+//
+// Tasks are identified by their type and payload unless the key is given
+// with UniqueKey or computed by UniqueKeyFunc of the client.
+//
+// Zero or negative ttl is replaced with the default of 24 hours.
+func UniquePending(ttl time.Duration) Option {
+	if ttl <= 0 {
+		ttl = defaultUniqueTTL
+	}
+	return uniquePendingOption(ttl)
+}
+
+// UniqueKey returns an option to identify the task enqueued with
+// UniquePending by the given key, instead of its type and payload, among
+// the tasks pending in the same queue.
+//
+// The key must not be empty, otherwise the task is not enqueued and
+// an error is returned. It has no effect without UniquePending.
+func UniqueKey(key string) Option {
+	return uniqueKeyOption(key)
+}
+
+// PendingTTL returns an option to remove the task without processing it
+// if no worker picks it up within the given duration after the time to
+// process the task, e.g. for an ephemeral notification.
+//
+// The duration starts at the time given to Schedule (or after the delay
+// given to EnqueueIn), or when the task is enqueued if it has a dependency.
+// Expired tasks are removed by the running backgrounds periodically, so they
+// may be processed a few seconds after their expiration. The TTL doesn't
+// apply once the task is pulled out of the queue, including its retries.
+//
+// Zero or negative duration is ignored.
+func PendingTTL(d time.Duration) Option {
+	return pendingTTLOption(d)
+}
+
+// CorrelationID returns an option to attach the given correlation ID to the
+// task, e.g. the ID of the request which enqueued the task, to trace it
+// through to processing.
+//
+// Handlers get the ID with GetCorrelationID, and the background includes
+// it in the log lines about the task.
+func CorrelationID(id string) Option {
+	return correlationIDOption(id)
+}
+
+// Category returns an option to put the task in the given category, e.g.
+// "io-bound" or "cpu-bound", which groups tasks more coarsely than their
+// types. Backgrounds limit the number of tasks processed concurrently per
+// category with CategoryConcurrency in Config, and report the counters per
+// category in Stats.
+func Category(name string) Option {
+	return categoryOption(name)
+}
+
+// SerialKey returns an option to process the task one at a time with the
+// other tasks of the same key, e.g. the ID of the entity which the tasks
+// update. Tasks of different keys are processed concurrently as usual.
+//
+// A task pulled out of the queue while another task with the same key is
+// processed is put back to the queue, behind the other tasks.
+// SerialKey has no effect on the tasks of queues processed in batches.
+func SerialKey(key string) Option {
+	return serialKeyOption(key)
+}
+
+// Affinity returns an option to process the task preferably by the
+// background which last processed a task of the same queue with the given
+// key, e.g. the ID of the entity whose data the background caches.
+//
+// The tasks are routed by key only if the backgrounds enable it with
+// AffinityTTL in Config. Otherwise, or if the background is not available,
+// the task is processed by any background as usual.
+func Affinity(key string) Option {
+	return affinityOption(key)
+}
+
+// ProcessInWindow returns an option to process the task at a random time
+// between start and start+window, so that tasks scheduled for the same time
+// (e.g., midnight) spread their load across the window.
+//
+// The option takes precedence over the time to process the task passed to
+// Schedule or EnqueueIn. Negative window is treated as zero.
+func ProcessInWindow(start time.Time, window time.Duration) Option {
+	if window < 0 {
+		window = 0
+	}
+	return windowOption{start, window}
+}
+
+// DependsOn returns an option to hold the task until the task with the given
+// ID completes. Use EnqueueWithID to get the ID of a task.
+//
+// The task waits in redis, and is enqueued to be processed immediately once
+// the dependency completes. If the dependency is killed, the task is killed
+// or keeps waiting as specified by KillDependents in Config. If the dependency
+// is dropped, the task is killed.
+//
+// The task waits for a day, or until it expires if PendingTTL is given, after
+// which it's killed. The option takes precedence over the time to process the
+// task passed to Schedule or EnqueueIn.
+// Note: A task enqueued more than an hour after its dependency has completed
+// is not resolved and is killed once the wait expires.
+func DependsOn(taskID string) Option {
+	return dependsOnOption(taskID)
+}
+
+// OnComplete returns an option to enqueue the given task once the task
+// completes, as a follow-up task in the same queue with the default options.
+//
+// The follow-up task is enqueued by the background which processed the task
+// on a best-effort basis: a failure to enqueue it is logged and not retried.
+// Handlers get the ID of the completed task with GetParentID.
+func OnComplete(task *Task) Option {
+	return onCompleteOption(task)
+}
+
+// OnFailure returns an option to enqueue the given task once the task is
+// sent to the dead queue, e.g. since it has exhausted its retries. The task
+// is enqueued in the same way as the task given to OnComplete.
+func OnFailure(task *Task) Option {
+	return onFailureOption(task)
+}
+
+// StoreResult returns an option to keep the result of the task for ttl once
+// the task is done or sent to the dead queue, to be retrieved with GetResult.
+//
+// The result slot of the task is created along with the task, so the
+// result can be waited for right away (see EnqueueAndWait). The result holds
+// the data set by the handler with SetResult, or the error of the task if
+// it's sent to the dead queue. The slot of a task which is not processed
+// within a day expires until the task is processed.
+//
+// Zero or negative ttl is replaced with the default of 1 hour.
+func StoreResult(ttl time.Duration) Option {
+	if ttl <= 0 {
+		ttl = defaultResultTTL
+	}
+	return resultTTLOption(ttl)
+}
+
+// ErrIdempotentReplay indicates that a task with the same idempotency key
+// has already been enqueued. The error message contains the ID of the task.
+var ErrIdempotentReplay = errors.New("task with the idempotency key has already been enqueued")
+
+// IdempotentReplayError is the error returned for a task not enqueued since
+// a task with the same idempotency key has already been enqueued.
+//
+// It matches ErrIdempotentReplay with errors.Is; use errors.As to get the ID
+// of the task already enqueued.
+type IdempotentReplayError struct {
+	// ID is the ID of the task enqueued with the idempotency key.
+	ID string
+}
+
+func (e *IdempotentReplayError) Error() string {
+	return fmt.Sprintf("%v (task id: %v)", ErrIdempotentReplay, e.ID)
+}
+
+// Is reports whether target is ErrIdempotentReplay.
+func (e *IdempotentReplayError) Is(target error) bool {
+	return target == ErrIdempotentReplay
+}
+
+// ErrDuplicateTask indicates that the same task is already pending in the
+// queue. See UniquePending.
+var ErrDuplicateTask = errors.New("task already exists")
+
 type option struct {
-	retry int
-	queue string
+	retry    int
+	queue    string
+	priority int
+	timeout  time.Duration
+
+	// deadline is zero if not specified.
+	deadline time.Time
+
+	// idempotencyKey is empty if not specified.
+	idempotencyKey string
+	idempotencyTTL time.Duration
+
+	// pendingTTL is zero if the task doesn't expire.
+	pendingTTL time.Duration
+
+	// correlationID is empty if not specified.
+	correlationID string
+
+	// serialKey is empty if the task is not serialized.
+	serialKey string
+
+	// category is empty if the task has no category.
+	category string
+
+	// affinity is empty if the task has no affinity.
+	affinity string
+
+	// uniqueTTL is zero if the task is not unique.
+	uniqueTTL time.Duration
+
+	// uniqueKey is nil unless the unique key is given with UniqueKey.
+	uniqueKey *string
+
+	// windowStart is zero if the processing window is not specified.
+	windowStart time.Time
+	window      time.Duration
+
+	// dependsOn is empty if the task has no dependency.
+	dependsOn string
+
+	// onComplete and onFailure are nil if the task has no follow-up task.
+	onComplete *Task
+	onFailure  *Task
+
+	// retrySchedule is empty if not specified.
+	retrySchedule []time.Duration
+
+	// weight is zero if not specified.
+	weight int64
+
+	// resultTTL is zero if the result of the task is not stored.
+	resultTTL time.Duration
+}
+
+// composeOptions composes the default options of the client and the given
+// options, which take precedence over the default ones.
+func (c *Client) composeOptions(opts ...Option) option {
+	if len(c.defaultOpts) == 0 {
+		return composeOptions(opts...)
+	}
+	all := make([]Option, 0, len(c.defaultOpts)+len(opts))
+	all = append(all, c.defaultOpts...)
+	return composeOptions(append(all, opts...)...)
 }
 
 func composeOptions(opts ...Option) option {
@@ -72,6 +666,45 @@ func composeOptions(opts ...Option) option {
 			res.retry = int(opt)
 		case queueOption:
 			res.queue = string(opt)
+		case priorityOption:
+			res.priority = int(opt)
+		case timeoutOption:
+			res.timeout = time.Duration(opt)
+		case deadlineOption:
+			res.deadline = time.Time(opt)
+		case pendingTTLOption:
+			res.pendingTTL = time.Duration(opt)
+		case correlationIDOption:
+			res.correlationID = string(opt)
+		case serialKeyOption:
+			res.serialKey = string(opt)
+		case categoryOption:
+			res.category = string(opt)
+		case affinityOption:
+			res.affinity = string(opt)
+		case uniquePendingOption:
+			res.uniqueTTL = time.Duration(opt)
+		case uniqueKeyOption:
+			key := string(opt)
+			res.uniqueKey = &key
+		case idempotencyOption:
+			res.idempotencyKey = opt.key
+			res.idempotencyTTL = opt.ttl
+		case windowOption:
+			res.windowStart = opt.start
+			res.window = opt.window
+		case dependsOnOption:
+			res.dependsOn = string(opt)
+		case onCompleteOption:
+			res.onComplete = opt
+		case onFailureOption:
+			res.onFailure = opt
+		case retryScheduleOption:
+			res.retrySchedule = []time.Duration(opt)
+		case weightOption:
+			res.weight = int64(opt)
+		case resultTTLOption:
+			res.resultTTL = time.Duration(opt)
 		default:
 			// ignore unexpected option
 		}
@@ -82,8 +715,64 @@ func composeOptions(opts ...Option) option {
 const (
 	// Max retry count by default
 	defaultMaxRetry = 25
+
+	// Duration to keep an idempotency key by default
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	// Duration to hold the lock of a unique task by default
+	defaultUniqueTTL = 24 * time.Hour
+
+	// Duration to keep the result of a task by default
+	defaultResultTTL = time.Hour
+)
+
+// EnqueueState is the state of a task right after it's registered by
+// the client.
+type EnqueueState int
+
+const (
+	// StatePending means the task is in its queue to be processed
+	// as soon as possible.
+	StatePending EnqueueState = iota
+
+	// StateScheduled means the task is to be moved to its queue
+	// at the process time.
+	StateScheduled
+
+	// StateWaiting means the task waits for the task it depends on
+	// (see DependsOn), unless the outcome of the dependency is already known.
+	StateWaiting
 )
 
+func (s EnqueueState) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateScheduled:
+		return "scheduled"
+	case StateWaiting:
+		return "waiting"
+	default:
+		return fmt.Sprintf("EnqueueState(%d)", int(s))
+	}
+}
+
+// EnqueueInfo describes a task registered by the client.
+type EnqueueInfo struct {
+	// ID is the ID of the task.
+	ID string
+
+	// Queue is the name of the queue the task is processed from.
+	Queue string
+
+	// State is the state of the task right after it's registered.
+	State EnqueueState
+
+	// ProcessAt is the time the task is to be processed, which is the time
+	// it's registered if State is StatePending. Zero if State is StateWaiting.
+	ProcessAt time.Time
+}
+
 // Schedule registers a task to be processed at the specified time.
 //
 // Schedule returns nil if the task is registered successfully,
@@ -92,20 +781,604 @@ const (
 // opts specifies the behavior of task processing. If there are conflicting
 // Option values the last one overrides others.
 func (c *Client) Schedule(task *Task, processAt time.Time, opts ...Option) error {
-	opt := composeOptions(opts...)
-	msg := &base.TaskMessage{
+	_, err := c.ScheduleWithInfo(task, processAt, opts...)
+	return err
+}
+
+// ScheduleWithInfo registers a task to be processed at the specified time
+// in the same way as Schedule, and returns the info of the task.
+//
+// If a task with the same idempotency key has already been enqueued, it
+// returns the info holding the ID of that task along with an
+// *IdempotentReplayError.
+func (c *Client) ScheduleWithInfo(task *Task, processAt time.Time, opts ...Option) (*EnqueueInfo, error) {
+	opt := c.composeOptions(opts...)
+	msg, err := c.newTaskMessage(task, opt)
+	if err != nil {
+		return nil, err
+	}
+	if !opt.windowStart.IsZero() {
+		processAt = processTimeInWindow(opt.windowStart, opt.window)
+	}
+	setExpiration(msg, opt, processAt)
+	var info *EnqueueInfo
+	err = c.withIdempotency(msg, opt, func() (err error) {
+		info, err = c.enqueue(msg, processAt)
+		return err
+	})
+	if err != nil {
+		return replayInfo(err), err
+	}
+	return info, nil
+}
+
+// replayInfo returns the info of the task already enqueued if err is an
+// *IdempotentReplayError, or nil otherwise. Only the ID of the task is known.
+func replayInfo(err error) *EnqueueInfo {
+	var replay *IdempotentReplayError
+	if !errors.As(err, &replay) {
+		return nil
+	}
+	return &EnqueueInfo{ID: replay.ID}
+}
+
+// ScheduleTx registers a task to be processed at the specified time as part
+// of the given pipeline, typically a MULTI/EXEC transaction created with
+// TxPipeline on the same redis database, so that the task is enqueued
+// atomically with the other writes of the transaction. The task is enqueued
+// only when the pipeline is executed; if it's discarded, the task is not.
+//
+// ScheduleTx returns a non-nil error if the task can't be added to the
+// pipeline. Errors writing the task are returned by the pipeline's Exec.
+// IdempotencyKey, UniquePending, PendingTTL and DependsOn options need their
+// own round trips to redis and are not supported.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) ScheduleTx(pipe redis.Pipeliner, task *Task, processAt time.Time, opts ...Option) error {
+	opt := c.composeOptions(opts...)
+	if opt.idempotencyKey != "" || opt.uniqueTTL > 0 || opt.pendingTTL > 0 || opt.dependsOn != "" {
+		return errors.New("IdempotencyKey, UniquePending, PendingTTL and DependsOn options are not supported in a transaction")
+	}
+	msg, err := c.newTaskMessage(task, opt)
+	if err != nil {
+		return err
+	}
+	if !opt.windowStart.IsZero() {
+		processAt = processTimeInWindow(opt.windowStart, opt.window)
+	}
+	if time.Now().After(processAt) {
+		return c.rdb.EnqueueTx(pipe, msg)
+	}
+	return c.rdb.ScheduleTx(pipe, msg, processAt)
+}
+
+// EnqueueBroadcast enqueues an independent copy of the task to each of the
+// given queues to be processed immediately, and returns the IDs of the copies
+// keyed by the queue name.
+//
+// The copies are enqueued in a single transaction, so either all or none of
+// them are enqueued. Queue names are case-insensitive and must be non-empty
+// and distinct. Queue option is ignored, and IdempotencyKey, UniquePending,
+// PendingTTL, DependsOn and ProcessInWindow options are not supported.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) EnqueueBroadcast(task *Task, queues []string, opts ...Option) (map[string]string, error) {
+	infos, err := c.EnqueueBroadcastWithInfo(task, queues, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string, len(infos))
+	for qname, info := range infos {
+		ids[qname] = info.ID
+	}
+	return ids, nil
+}
+
+// EnqueueBroadcastWithInfo enqueues a copy of the task to each of the given
+// queues in the same way as EnqueueBroadcast, and returns the info of the
+// copies keyed by the queue name.
+func (c *Client) EnqueueBroadcastWithInfo(task *Task, queues []string, opts ...Option) (map[string]*EnqueueInfo, error) {
+	if len(queues) == 0 {
+		return nil, errors.New("no queue is specified")
+	}
+	opt := c.composeOptions(opts...)
+	if opt.idempotencyKey != "" || opt.uniqueTTL > 0 || opt.pendingTTL > 0 || opt.dependsOn != "" || !opt.windowStart.IsZero() {
+		return nil, errors.New("IdempotencyKey, UniquePending, PendingTTL, DependsOn and ProcessInWindow options are not supported in a broadcast")
+	}
+	infos := make(map[string]*EnqueueInfo, len(queues))
+	msgs := make([]*base.TaskMessage, 0, len(queues))
+	for _, qname := range queues {
+		qname = strings.ToLower(qname)
+		if qname == "" {
+			return nil, errors.New("queue name must not be empty")
+		}
+		if _, ok := infos[qname]; ok {
+			return nil, fmt.Errorf("queue %q is specified more than once", qname)
+		}
+		opt.queue = qname
+		msg, err := c.newTaskMessage(task, opt)
+		if err != nil {
+			return nil, err
+		}
+		infos[qname] = &EnqueueInfo{ID: msg.ID.String(), Queue: msg.Queue, State: StatePending}
+		msgs = append(msgs, msg)
+	}
+	if err := c.rdb.EnqueueAll(msgs...); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, info := range infos {
+		info.ProcessAt = now
+	}
+	return infos, nil
+}
+
+// EnqueueIn registers a task to be processed after the specified duration.
+//
+// Unlike Schedule, the time to process the task is computed against the
+// clock of the redis server instead of the local clock, so that tasks
+// enqueued from multiple hosts with skewed clocks are processed consistently.
+// Zero or negative duration enqueues the task to be processed immediately.
+//
+// EnqueueIn returns nil if the task is registered successfully,
+// otherwise returns a non-nil error.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) EnqueueIn(task *Task, d time.Duration, opts ...Option) error {
+	_, err := c.EnqueueInWithInfo(task, d, opts...)
+	return err
+}
+
+// EnqueueInWithInfo registers a task to be processed after the specified
+// duration in the same way as EnqueueIn, and returns the info of the task.
+// The process time is computed against the clock of the redis server.
+// The info of an idempotent replay is returned as in ScheduleWithInfo.
+func (c *Client) EnqueueInWithInfo(task *Task, d time.Duration, opts ...Option) (*EnqueueInfo, error) {
+	opt := c.composeOptions(opts...)
+	msg, err := c.newTaskMessage(task, opt)
+	if err != nil {
+		return nil, err
+	}
+	var info *EnqueueInfo
+	if !opt.windowStart.IsZero() {
+		processAt := processTimeInWindow(opt.windowStart, opt.window)
+		setExpiration(msg, opt, processAt)
+		err = c.withIdempotency(msg, opt, func() (err error) {
+			info, err = c.enqueue(msg, processAt)
+			return err
+		})
+		if err != nil {
+			return replayInfo(err), err
+		}
+		return info, nil
+	}
+	setExpiration(msg, opt, time.Now().Add(d))
+	err = c.withIdempotency(msg, opt, func() error {
+		info = &EnqueueInfo{ID: msg.ID.String(), Queue: msg.Queue}
+		if msg.DependsOn != "" {
+			info.State = StateWaiting
+			return c.rdb.EnqueueDependent(msg)
+		}
+		if d <= 0 {
+			info.State = StatePending
+			info.ProcessAt = time.Now()
+			return c.rdb.Enqueue(msg)
+		}
+		processAt, err := c.rdb.ScheduleIn(msg, d)
+		info.State = StateScheduled
+		info.ProcessAt = processAt
+		return err
+	})
+	if err != nil {
+		return replayInfo(err), err
+	}
+	return info, nil
+}
+
+// EnqueueAtNextCron registers a task to be processed once at the next time
+// matching the given cron spec, in the local time zone.
+//
+// The spec has the standard five fields (minute, hour, day of month, month
+// and day of week), e.g. "0 * * * *" for the next top of the hour, or one of
+// the descriptors "@yearly", "@monthly", "@weekly", "@daily" and "@hourly".
+// The task is not rescheduled after it's processed.
+//
+// EnqueueAtNextCron returns a non-nil error if the spec is invalid or never
+// matches within the next few years, or if the task cannot be registered.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) EnqueueAtNextCron(cronspec string, task *Task, opts ...Option) error {
+	sched, err := parseCron(cronspec)
+	if err != nil {
+		return fmt.Errorf("invalid cron spec %q: %v", cronspec, err)
+	}
+	processAt := sched.next(time.Now())
+	if processAt.IsZero() {
+		return fmt.Errorf("cron spec %q never matches", cronspec)
+	}
+	return c.Schedule(task, processAt, opts...)
+}
+
+// EnqueueWithID registers a task to be processed immediately and returns
+// the ID of the task, which can be passed to DependsOn to make other tasks
+// wait for the task.
+// If a task with the same idempotency key has already been enqueued, it
+// returns the ID of that task along with an *IdempotentReplayError.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) EnqueueWithID(task *Task, opts ...Option) (string, error) {
+	info, err := c.ScheduleWithInfo(task, time.Now(), opts...)
+	if info == nil {
+		return "", err
+	}
+	return info.ID, err
+}
+
+// Result is the result of a task stored with StoreResult.
+type Result struct {
+	// ID is the ID of the task.
+	ID string
+
+	// Succeeded reports whether the task is done. The task was sent to
+	// the dead queue with Error otherwise.
+	Succeeded bool
+
+	// Status, Message and Data are the outcome set by the handler with
+	// SetResult, if any.
+	Status  string
+	Message string
+	Data    []byte
+
+	// Error is the error message of the task sent to the dead queue.
+	Error string
+}
+
+// ErrResultNotFound indicates that the task has no result slot, e.g. since
+// it was enqueued without StoreResult or the result has expired.
+var ErrResultNotFound = errors.New("could not find the result of the task")
+
+// ErrResultNotReady indicates that the task with a result slot has not been
+// done or sent to the dead queue yet.
+var ErrResultNotReady = errors.New("result of the task is not ready")
+
+// GetResult returns the result of the task with the given ID stored with
+// StoreResult.
+//
+// It returns ErrResultNotReady if the task is yet to be done, and
+// ErrResultNotFound if the task has no result slot.
+func (c *Client) GetResult(id string) (*Result, error) {
+	taskID, err := xid.FromString(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task id %q: %v", id, err)
+	}
+	rec, err := c.rdb.GetResult(taskID)
+	if err != nil {
+		return nil, resultError(err)
+	}
+	if rec.State == rdb.ResultPending {
+		return nil, ErrResultNotReady
+	}
+	return newResult(id, rec), nil
+}
+
+// EnqueueAndWait registers a task to be processed immediately with its
+// result stored, and blocks until the task is done or sent to the dead
+// queue, or ctx is done.
+//
+// The result slot of the task is created along with the task, so
+// the result is not missed even if the task is processed right away.
+// The result is kept for an hour unless opts includes StoreResult.
+// If ctx is done first, it returns the error of ctx along with the ID of
+// the task in the result, and the task is still processed.
+//
+// Since the wait is done in steps of a second, it may return up to a second
+// after ctx is done.
+func (c *Client) EnqueueAndWait(ctx context.Context, task *Task, opts ...Option) (*Result, error) {
+	if opt := c.composeOptions(opts...); opt.resultTTL <= 0 {
+		opts = append(opts, StoreResult(defaultResultTTL))
+	}
+	taskID, err := c.EnqueueWithID(task, opts...)
+	if err != nil {
+		return nil, err
+	}
+	id, err := xid.FromString(taskID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		rec, err := c.rdb.WaitResult(id, resultWaitInterval)
+		if err != nil {
+			return nil, resultError(err)
+		}
+		if rec.State != rdb.ResultPending {
+			return newResult(taskID, rec), nil
+		}
+		select {
+		case <-ctx.Done():
+			return &Result{ID: taskID}, ctx.Err()
+		default:
+		}
+	}
+}
+
+// resultWaitInterval is the longest time EnqueueAndWait blocks in redis
+// before it checks its context.
+const resultWaitInterval = time.Second
+
+// resultError maps the errors of the result slots of rdb to the errors of
+// the package.
+func resultError(err error) error {
+	if err == rdb.ErrResultNotFound {
+		return ErrResultNotFound
+	}
+	return err
+}
+
+func newResult(id string, rec *rdb.ResultRecord) *Result {
+	res := &Result{
+		ID:        id,
+		Succeeded: rec.State == rdb.ResultCompleted,
+		Error:     rec.Error,
+	}
+	if rec.Result != nil {
+		res.Status = rec.Result.Status
+		res.Message = rec.Result.Message
+		res.Data = rec.Result.Data
+	}
+	return res
+}
+
+// EnqueueWithDepth registers a task to be processed immediately and returns
+// the number of pending tasks in the queue right after the task is enqueued,
+// including the task itself.
+//
+// The depth is a snapshot computed atomically with the enqueue; it can change
+// as soon as it's returned (e.g., it may be used to show an ETA to users).
+// ProcessInWindow and DependsOn options are ignored.
+//
+// opts specifies the behavior of task processing. If there are conflicting
+// Option values the last one overrides others.
+func (c *Client) EnqueueWithDepth(task *Task, opts ...Option) (int, error) {
+	opt := c.composeOptions(opts...)
+	msg, err := c.newTaskMessage(task, opt)
+	if err != nil {
+		return 0, err
+	}
+	msg.DependsOn = ""
+	setExpiration(msg, opt, time.Now())
+	var depth int64
+	err = c.withIdempotency(msg, opt, func() error {
+		var err error
+		depth, err = c.rdb.EnqueueWithDepth(msg)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(depth), nil
+}
+
+// withIdempotency calls enqueue if the idempotency key in opt, if any,
+// is not associated with another task, and the unique key of the task,
+// if any, is not held by another pending task.
+// The keys are released if enqueue fails so that the caller can try again.
+func (c *Client) withIdempotency(msg *base.TaskMessage, opt option, enqueue func() error) error {
+	enqueue = c.withUniqueness(msg, opt, c.withExpiration(msg, enqueue))
+	if opt.idempotencyKey == "" {
+		return enqueue()
+	}
+	id, err := c.rdb.SetIdempotencyKey(opt.idempotencyKey, msg.ID, opt.idempotencyTTL)
+	if err == rdb.ErrIdempotencyKeyExists {
+		return &IdempotentReplayError{ID: id.String()}
+	}
+	if err != nil {
+		return err
+	}
+	if err := enqueue(); err != nil {
+		c.rdb.DeleteIdempotencyKey(opt.idempotencyKey, msg.ID)
+		return err
+	}
+	return nil
+}
+
+// withUniqueness returns enqueue wrapped to take the lock of the unique key
+// of the task first, if the task is unique.
+func (c *Client) withUniqueness(msg *base.TaskMessage, opt option, enqueue func() error) func() error {
+	if msg.UniqueKey == "" {
+		return enqueue
+	}
+	return func() error {
+		err := c.rdb.SetUniqueKey(msg.UniqueKey, msg.ID, opt.uniqueTTL)
+		if err == rdb.ErrDuplicateTask {
+			return ErrDuplicateTask
+		}
+		if err != nil {
+			return err
+		}
+		if err := enqueue(); err != nil {
+			c.rdb.DeleteUniqueKey(msg.UniqueKey, msg.ID)
+			return err
+		}
+		return nil
+	}
+}
+
+// withExpiration returns enqueue wrapped to register the task to expire
+// first, if the task has a pending TTL.
+func (c *Client) withExpiration(msg *base.TaskMessage, enqueue func() error) func() error {
+	if msg.ExpiresAt == 0 {
+		return enqueue
+	}
+	return func() error {
+		if err := c.rdb.ExpirePending(msg); err != nil {
+			return err
+		}
+		if err := enqueue(); err != nil {
+			c.rdb.CancelExpiration(msg)
+			return err
+		}
+		return nil
+	}
+}
+
+// setExpiration sets the expiration time of the task with a pending TTL,
+// given the time the task becomes pending.
+func setExpiration(msg *base.TaskMessage, opt option, pendingAt time.Time) {
+	if opt.pendingTTL <= 0 {
+		return
+	}
+	if msg.DependsOn != "" {
+		pendingAt = time.Now()
+	}
+	msg.ExpiresAt = pendingAt.Add(opt.pendingTTL).Unix()
+}
+
+// newFollowUpMessage returns the message of the follow-up task to enqueue
+// to the given queue (see OnComplete and OnFailure).
+func (c *Client) newFollowUpMessage(task *Task, qname string) (*base.TaskMessage, error) {
+	if err := c.validate(task); err != nil {
+		return nil, fmt.Errorf("follow-up task: %w", err)
+	}
+	return &base.TaskMessage{
+		Version: base.MessageVersion,
 		ID:      xid.New(),
 		Type:    task.Type,
 		Payload: task.Payload.data,
-		Queue:   opt.queue,
-		Retry:   opt.retry,
+		Queue:   qname,
+		Retry:   defaultMaxRetry,
+	}, nil
+}
+
+// uniqueKey returns the key identifying the task among the pending tasks
+// of its queue, given with UniqueKey or computed by the unique key function
+// of the client, or by the type and payload of the task by default.
+func (c *Client) uniqueKey(task *Task, msg *base.TaskMessage, opt option) (string, error) {
+	var key string
+	switch {
+	case opt.uniqueKey != nil:
+		key = *opt.uniqueKey
+	case c.uniqueKeyFunc != nil:
+		key = c.uniqueKeyFunc(task)
+	default:
+		return uniqueKey(msg.Queue, msg.Type, msg.Payload)
+	}
+	if key == "" {
+		return "", fmt.Errorf("empty unique key for task of type %q", task.Type)
 	}
-	return c.enqueue(msg, processAt)
+	// Note: The empty field in place of the type keeps custom keys apart
+	// from the keys computed from the type and payload.
+	return msg.Queue + "::" + key, nil
 }
 
-func (c *Client) enqueue(msg *base.TaskMessage, processAt time.Time) error {
-	if time.Now().After(processAt) {
-		return c.rdb.Enqueue(msg)
+// uniqueKey returns the key identifying the task with the payload among
+// the pending tasks of the queue.
+func uniqueKey(qname, tasktype string, payload map[string]interface{}) (string, error) {
+	// Note: JSON encoding sorts the map keys, so equal payloads give
+	// the same key.
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return qname + ":" + tasktype + ":" + string(b), nil
+}
+
+// processTimeInWindow returns a random time between start and start+window.
+func processTimeInWindow(start time.Time, window time.Duration) time.Time {
+	if window == 0 {
+		return start
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return start.Add(time.Duration(r.Int63n(int64(window) + 1)))
+}
+
+func (c *Client) newTaskMessage(task *Task, opt option) (*base.TaskMessage, error) {
+	if err := c.validate(task); err != nil {
+		return nil, err
+	}
+	if c.memory != nil {
+		if err := c.memory.check(); err != nil {
+			return nil, err
+		}
+	}
+	msg := &base.TaskMessage{
+		Version:       base.MessageVersion,
+		ID:            xid.New(),
+		Type:          task.Type,
+		Payload:       task.Payload.data,
+		Queue:         opt.queue,
+		Retry:         opt.retry,
+		Priority:      opt.priority,
+		Weight:        opt.weight,
+		EnqueuedAt:    time.Now().UnixNano(),
+		CorrelationID: opt.correlationID,
+		SerialKey:     opt.serialKey,
+		Category:      opt.category,
+		Affinity:      opt.affinity,
+	}
+	if opt.timeout > 0 {
+		msg.Timeout = opt.timeout.String()
+	}
+	if !opt.deadline.IsZero() {
+		msg.Deadline = opt.deadline.Unix()
+	}
+	if opt.resultTTL > 0 {
+		msg.ResultTTL = int64((opt.resultTTL + time.Second - 1) / time.Second)
+	}
+	for _, d := range opt.retrySchedule {
+		msg.RetrySchedule = append(msg.RetrySchedule, d.String())
+	}
+	if opt.uniqueTTL > 0 {
+		key, err := c.uniqueKey(task, msg, opt)
+		if err != nil {
+			return nil, err
+		}
+		msg.UniqueKey = key
+	}
+	if opt.dependsOn != "" {
+		if _, err := xid.FromString(opt.dependsOn); err != nil {
+			return nil, fmt.Errorf("invalid task id %q for DependsOn: %v", opt.dependsOn, err)
+		}
+		msg.DependsOn = opt.dependsOn
+	}
+	if opt.onComplete != nil {
+		followUp, err := c.newFollowUpMessage(opt.onComplete, msg.Queue)
+		if err != nil {
+			return nil, err
+		}
+		msg.OnComplete = followUp
+	}
+	if opt.onFailure != nil {
+		followUp, err := c.newFollowUpMessage(opt.onFailure, msg.Queue)
+		if err != nil {
+			return nil, err
+		}
+		msg.OnFailure = followUp
+	}
+	if c.compress {
+		if err := base.CompressPayload(msg, c.compressThreshold); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (c *Client) enqueue(msg *base.TaskMessage, processAt time.Time) (*EnqueueInfo, error) {
+	info := &EnqueueInfo{ID: msg.ID.String(), Queue: msg.Queue}
+	if msg.DependsOn != "" {
+		info.State = StateWaiting
+		return info, c.rdb.EnqueueDependent(msg)
+	}
+	if now := time.Now(); now.After(processAt) {
+		info.State = StatePending
+		info.ProcessAt = now
+		return info, c.rdb.Enqueue(msg)
 	}
-	return c.rdb.Schedule(msg, processAt)
+	info.State = StateScheduled
+	info.ProcessAt = processAt
+	return info, c.rdb.Schedule(msg, processAt)
 }
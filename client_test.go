@@ -5,14 +5,24 @@
 package asynq
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
 )
 
+// ignoreEnqueuedAtOpt ignores EnqueuedAt field set by the client.
+var ignoreEnqueuedAtOpt = cmpopts.IgnoreFields(base.TaskMessage{}, "EnqueuedAt")
+
 func TestClient(t *testing.T) {
 	r := setup(t)
 	client := NewClient(&RedisClientOpt{
@@ -28,6 +38,7 @@ func TestClient(t *testing.T) {
 		processAt     time.Time
 		opts          []Option
 		wantEnqueued  map[string][]*base.TaskMessage
+		wantPriority  map[string][]*base.TaskMessage
 		wantScheduled []h.ZSetEntry
 	}{
 		{
@@ -38,6 +49,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"default": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   defaultMaxRetry,
@@ -56,6 +68,7 @@ func TestClient(t *testing.T) {
 			wantScheduled: []h.ZSetEntry{
 				{
 					Msg: &base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   defaultMaxRetry,
@@ -75,6 +88,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"default": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   3,
@@ -94,6 +108,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"default": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   0, // Retry count should be set to zero
@@ -114,6 +129,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"default": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   10, // Last option takes precedence
@@ -133,6 +149,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"custom": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   defaultMaxRetry,
@@ -152,6 +169,7 @@ func TestClient(t *testing.T) {
 			wantEnqueued: map[string][]*base.TaskMessage{
 				"high": []*base.TaskMessage{
 					&base.TaskMessage{
+						Version: base.MessageVersion,
 						Type:    task.Type,
 						Payload: task.Payload.data,
 						Retry:   defaultMaxRetry,
@@ -161,6 +179,135 @@ func TestClient(t *testing.T) {
 			},
 			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
 		},
+		{
+			desc:      "With priority option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Priority(3),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": nil, // prioritized task should not be pushed to the list
+			},
+			wantPriority: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version:  base.MessageVersion,
+						Type:     task.Type,
+						Payload:  task.Payload.data,
+						Retry:    defaultMaxRetry,
+						Queue:    "default",
+						Priority: 3,
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
+		{
+			desc:      "Priority out of range is clamped",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Priority(1000),
+			},
+			wantPriority: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version:  base.MessageVersion,
+						Type:     task.Type,
+						Payload:  task.Payload.data,
+						Retry:    defaultMaxRetry,
+						Queue:    "default",
+						Priority: base.MaxPriority,
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
+		{
+			desc:      "With timeout option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Timeout(30 * time.Second),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version: base.MessageVersion,
+						Type:    task.Type,
+						Payload: task.Payload.data,
+						Retry:   defaultMaxRetry,
+						Queue:   "default",
+						Timeout: "30s",
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
+		{
+			desc:      "With deadline option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Deadline(time.Unix(1600000000, 0)),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version:  base.MessageVersion,
+						Type:     task.Type,
+						Payload:  task.Payload.data,
+						Retry:    defaultMaxRetry,
+						Queue:    "default",
+						Deadline: 1600000000,
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
+		{
+			desc:      "With retry schedule option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				RetrySchedule([]time.Duration{time.Minute, 5 * time.Minute, -time.Second}),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version:       base.MessageVersion,
+						Type:          task.Type,
+						Payload:       task.Payload.data,
+						Retry:         defaultMaxRetry,
+						Queue:         "default",
+						RetrySchedule: []string{"1m0s", "5m0s", "0s"},
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
+		{
+			desc:      "With weight option",
+			task:      task,
+			processAt: time.Now(),
+			opts: []Option{
+				Weight(4),
+			},
+			wantEnqueued: map[string][]*base.TaskMessage{
+				"default": []*base.TaskMessage{
+					&base.TaskMessage{
+						Version: base.MessageVersion,
+						Type:    task.Type,
+						Payload: task.Payload.data,
+						Retry:   defaultMaxRetry,
+						Queue:   "default",
+						Weight:  4,
+					},
+				},
+			},
+			wantScheduled: nil, // db is flushed in setup so zset does not exist hence nil
+		},
 	}
 
 	for _, tc := range tests {
@@ -174,14 +321,1050 @@ func TestClient(t *testing.T) {
 
 		for qname, want := range tc.wantEnqueued {
 			gotEnqueued := h.GetEnqueuedMessages(t, r, qname)
-			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt); diff != "" {
+			if diff := cmp.Diff(want, gotEnqueued, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
 				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(qname), diff)
 			}
 		}
 
+		for qname, want := range tc.wantPriority {
+			gotPriority := h.GetPriorityMessages(t, r, qname)
+			if diff := cmp.Diff(want, gotPriority, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
+				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.PriorityQueueKey(qname), diff)
+			}
+		}
+
 		gotScheduled := h.GetScheduledEntries(t, r)
-		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt); diff != "" {
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
 			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledQueue, diff)
 		}
 	}
 }
+
+func TestClientDefaultOptions(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, DefaultOptions(Queue("emails"), MaxRetry(5), Timeout(30*time.Second)))
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+
+	tests := []struct {
+		desc  string
+		opts  []Option
+		qname string
+		want  *base.TaskMessage
+	}{
+		{
+			desc:  "With default options",
+			opts:  nil,
+			qname: "emails",
+			want: &base.TaskMessage{
+				Version: base.MessageVersion,
+				Type:    task.Type,
+				Payload: task.Payload.data,
+				Retry:   5,
+				Queue:   "emails",
+				Timeout: "30s",
+			},
+		},
+		{
+			desc:  "With options overriding default options",
+			opts:  []Option{MaxRetry(10), Queue("critical")},
+			qname: "critical",
+			want: &base.TaskMessage{
+				Version: base.MessageVersion,
+				Type:    task.Type,
+				Payload: task.Payload.data,
+				Retry:   10,
+				Queue:   "critical",
+				Timeout: "30s",
+			},
+		},
+		{
+			desc:  "With options in addition to default options",
+			opts:  []Option{Priority(2)},
+			qname: "emails",
+			want: &base.TaskMessage{
+				Version:  base.MessageVersion,
+				Type:     task.Type,
+				Payload:  task.Payload.data,
+				Retry:    5,
+				Queue:    "emails",
+				Timeout:  "30s",
+				Priority: 2,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+
+		if err := client.Schedule(task, time.Now(), tc.opts...); err != nil {
+			t.Errorf("%s: Schedule returned error: %v", tc.desc, err)
+			continue
+		}
+		got := append(h.GetEnqueuedMessages(t, r, tc.qname), h.GetPriorityMessages(t, r, tc.qname)...)
+		want := []*base.TaskMessage{tc.want}
+		if diff := cmp.Diff(want, got, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
+			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.QueueKey(tc.qname), diff)
+		}
+	}
+}
+
+func TestClientEnqueueIn(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+	wantMsg := &base.TaskMessage{
+		Version: base.MessageVersion,
+		Type:    task.Type,
+		Payload: task.Payload.data,
+		Retry:   defaultMaxRetry,
+		Queue:   "default",
+	}
+
+	tests := []struct {
+		desc          string
+		delay         time.Duration
+		wantEnqueued  []*base.TaskMessage
+		wantScheduled int // number of scheduled tasks
+	}{
+		{
+			desc:          "Process task after delay",
+			delay:         time.Hour,
+			wantEnqueued:  nil,
+			wantScheduled: 1,
+		},
+		{
+			desc:          "Zero delay enqueues task immediately",
+			delay:         0,
+			wantEnqueued:  []*base.TaskMessage{wantMsg},
+			wantScheduled: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+
+		serverNow := r.Time().Val()
+		if err := client.EnqueueIn(task, tc.delay); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		gotEnqueued := h.GetEnqueuedMessages(t, r)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
+			t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.DefaultQueue, diff)
+		}
+
+		gotScheduled := h.GetScheduledEntries(t, r)
+		if len(gotScheduled) != tc.wantScheduled {
+			t.Errorf("%s; %q has %d tasks, want %d", tc.desc, base.ScheduledQueue, len(gotScheduled), tc.wantScheduled)
+			continue
+		}
+		for _, entry := range gotScheduled {
+			if diff := cmp.Diff(wantMsg, entry.Msg, h.IgnoreIDOpt, ignoreEnqueuedAtOpt); diff != "" {
+				t.Errorf("%s;\nmismatch found in %q; (-want,+got)\n%s", tc.desc, base.ScheduledQueue, diff)
+			}
+			// processing time is relative to the redis server clock.
+			want := serverNow.Add(tc.delay).Unix()
+			if got := int64(entry.Score); got < want || got > want+1 {
+				t.Errorf("%s; scheduled task has score %d, want %d", tc.desc, got, want)
+			}
+		}
+	}
+}
+
+func TestClientEnqueueInWithSkewedClock(t *testing.T) {
+	r := setup(t)
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+	scheduler := rdb.NewRDB(r)
+
+	for _, skew := range []time.Duration{time.Hour, -time.Hour} {
+		h.FlushDB(t, r)
+		client := NewClient(&RedisClientOpt{
+			Addr: "localhost:6379",
+			DB:   14,
+		})
+		client.rdb.SetClock(base.NewSimulatedClock(time.Now().Add(skew)))
+
+		serverNow := r.Time().Val()
+		if err := client.EnqueueIn(task, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		gotScheduled := h.GetScheduledEntries(t, r)
+		if len(gotScheduled) != 1 {
+			t.Fatalf("clock skew %v; %q has %d tasks, want 1", skew, base.ScheduledQueue, len(gotScheduled))
+		}
+		if got, want := int64(gotScheduled[0].Score), serverNow.Add(time.Second).Unix(); got < want || got > want+1 {
+			t.Errorf("clock skew %v; scheduled task has score %d, want %d", skew, got, want)
+		}
+
+		// The task is promoted a second later by the redis server clock,
+		// neither early nor late by the skew of the client.
+		if err := scheduler.CheckAndEnqueue(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(h.GetEnqueuedMessages(t, r)); n != 0 {
+			t.Errorf("clock skew %v; %d tasks promoted right away, want 0", skew, n)
+		}
+		time.Sleep(2 * time.Second)
+		if err := scheduler.CheckAndEnqueue(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(h.GetEnqueuedMessages(t, r)); n != 1 {
+			t.Errorf("clock skew %v; %d tasks promoted after the delay, want 1", skew, n)
+		}
+	}
+}
+
+func TestClientEnqueueInWithInfo(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+
+	tests := []struct {
+		desc      string
+		delay     time.Duration
+		wantState EnqueueState
+	}{
+		{desc: "Process task after delay", delay: time.Hour, wantState: StateScheduled},
+		{desc: "Zero delay enqueues task immediately", delay: 0, wantState: StatePending},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r) // clean up db before each test case.
+
+		serverNow := r.Time().Val()
+		now := time.Now()
+		info, err := client.EnqueueInWithInfo(task, tc.delay, Queue("Critical"))
+		if err != nil {
+			t.Errorf("%s; EnqueueInWithInfo returned error: %v", tc.desc, err)
+			continue
+		}
+		if info.State != tc.wantState {
+			t.Errorf("%s; State = %v, want %v", tc.desc, info.State, tc.wantState)
+		}
+		if info.Queue != "critical" {
+			t.Errorf("%s; Queue = %q, want %q", tc.desc, info.Queue, "critical")
+		}
+
+		var msg *base.TaskMessage
+		if tc.wantState == StateScheduled {
+			gotScheduled := h.GetScheduledEntries(t, r)
+			if len(gotScheduled) != 1 {
+				t.Errorf("%s; %q has %d tasks, want 1", tc.desc, base.ScheduledQueue, len(gotScheduled))
+				continue
+			}
+			msg = gotScheduled[0].Msg
+			// processing time is relative to the redis server clock.
+			if got, want := info.ProcessAt.Unix(), int64(gotScheduled[0].Score); got != want {
+				t.Errorf("%s; ProcessAt = %d, want the score %d", tc.desc, got, want)
+			}
+			if want := serverNow.Add(tc.delay).Unix(); info.ProcessAt.Unix() < want || info.ProcessAt.Unix() > want+1 {
+				t.Errorf("%s; ProcessAt = %v, want %v", tc.desc, info.ProcessAt, time.Unix(want, 0))
+			}
+		} else {
+			gotEnqueued := h.GetEnqueuedMessages(t, r, "critical")
+			if len(gotEnqueued) != 1 {
+				t.Errorf("%s; %q has %d tasks, want 1", tc.desc, base.QueueKey("critical"), len(gotEnqueued))
+				continue
+			}
+			msg = gotEnqueued[0]
+			if info.ProcessAt.Before(now) || info.ProcessAt.After(time.Now()) {
+				t.Errorf("%s; ProcessAt = %v, want the time of the enqueue", tc.desc, info.ProcessAt)
+			}
+		}
+		if info.ID != msg.ID.String() {
+			t.Errorf("%s; ID = %q, want %q", tc.desc, info.ID, msg.ID)
+		}
+	}
+
+	// A task depending on another task waits for it.
+	info, err := client.EnqueueInWithInfo(task, time.Hour, DependsOn(xid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != StateWaiting || !info.ProcessAt.IsZero() {
+		t.Errorf("with DependsOn; State, ProcessAt = %v, %v; want %v, zero time", info.State, info.ProcessAt, StateWaiting)
+	}
+
+	// An idempotent replay returns the ID of the task already enqueued.
+	opt := IdempotencyKey("request-123", time.Hour)
+	first, err := client.EnqueueInWithInfo(task, time.Hour, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replays := []struct {
+		desc    string
+		enqueue func() (*EnqueueInfo, error)
+	}{
+		{"EnqueueInWithInfo", func() (*EnqueueInfo, error) { return client.EnqueueInWithInfo(task, 0, opt) }},
+		{"ScheduleWithInfo", func() (*EnqueueInfo, error) { return client.ScheduleWithInfo(task, time.Now(), opt) }},
+	}
+	for _, replay := range replays {
+		info, err := replay.enqueue()
+		if !errors.Is(err, ErrIdempotentReplay) {
+			t.Errorf("replayed %s returned error %v, want %v", replay.desc, err, ErrIdempotentReplay)
+			continue
+		}
+		if info == nil || info.ID != first.ID {
+			t.Errorf("replayed %s returned info %+v, want ID %q", replay.desc, info, first.ID)
+		}
+	}
+	if id, err := client.EnqueueWithID(task, opt); !errors.Is(err, ErrIdempotentReplay) || id != first.ID {
+		t.Errorf("replayed EnqueueWithID = %q, %v; want %q, %v", id, err, first.ID, ErrIdempotentReplay)
+	}
+}
+
+func TestClientEnqueueAndWait(t *testing.T) {
+	setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 10,
+	})
+	// The handler returns right away, so that tasks are likely done
+	// before the waiter starts waiting for their results.
+	bg.start(HandlerFunc(func(task *Task) error {
+		n, err := task.Payload.GetInt("n")
+		if err != nil {
+			return err
+		}
+		SetResult(task, ProcessResult{Data: []byte(strconv.Itoa(n * 2))})
+		return nil
+	}))
+	defer bg.stop()
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		res, err := client.EnqueueAndWait(ctx, NewTask("double", map[string]interface{}{"n": i}))
+		cancel()
+		if err != nil {
+			t.Fatalf("EnqueueAndWait returned error: %v", err)
+		}
+		if want := strconv.Itoa(i * 2); !res.Succeeded || string(res.Data) != want {
+			t.Errorf("EnqueueAndWait returned %+v, want succeeded with data %q", res, want)
+		}
+		if got, err := client.GetResult(res.ID); err != nil || string(got.Data) != string(res.Data) {
+			t.Errorf("GetResult(%q) = %+v, %v; want the same result", res.ID, got, err)
+		}
+	}
+
+	// A task sent to the dead queue has the error in its result.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := client.EnqueueAndWait(ctx, NewTask("double", nil), MaxRetry(0))
+	if err != nil {
+		t.Fatalf("EnqueueAndWait returned error: %v", err)
+	}
+	if res.Succeeded || !strings.Contains(res.Error, "does not exist") {
+		t.Errorf("EnqueueAndWait returned %+v, want failed with the error of the handler", res)
+	}
+}
+
+func TestClientStoreResult(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+
+	// The result slot exists as soon as the task is enqueued.
+	id, err := client.EnqueueWithID(task, StoreResult(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetResult(id); err != ErrResultNotReady {
+		t.Errorf("GetResult(%q) returned error %v, want %v", id, err, ErrResultNotReady)
+	}
+	msgs := h.GetEnqueuedMessages(t, r, base.DefaultQueueName)
+	if len(msgs) != 1 || msgs[0].ResultTTL != 60 {
+		t.Fatalf("enqueued %+v, want the task with ResultTTL 60", msgs)
+	}
+	if ttl := r.PTTL(base.ResultKey(id)).Val(); ttl <= rdb.PendingResultTTL {
+		t.Errorf("TTL of the result slot = %v, want more than %v", ttl, rdb.PendingResultTTL)
+	}
+
+	// No slot is left if the task is not enqueued.
+	h.FlushDB(t, r)
+	if err := client.Schedule(task, time.Now(), UniquePending(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Schedule(task, time.Now(), UniquePending(time.Hour), StoreResult(time.Minute)); err != ErrDuplicateTask {
+		t.Fatalf("Schedule returned error %v, want %v", err, ErrDuplicateTask)
+	}
+	if keys := r.Keys(base.ResultKey("*")).Val(); len(keys) != 0 {
+		t.Errorf("result slots = %v, want none", keys)
+	}
+
+	id, err = client.EnqueueWithID(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetResult(id); err != ErrResultNotFound {
+		t.Errorf("GetResult(%q) without StoreResult returned error %v, want %v", id, err, ErrResultNotFound)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("(*Client).Close() = %v, want nil", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("(*Client).Close() = %v when called twice, want nil", err)
+	}
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err == nil {
+		t.Errorf("(*Client).Schedule() returned nil after Close, want error")
+	}
+}
+
+func TestClientCompressPayload(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, CompressPayload(64))
+
+	small := NewTask("send_email", map[string]interface{}{"user_id": 42})
+	large := NewTask("send_email", map[string]interface{}{"body": strings.Repeat("a", 1000)})
+	for _, task := range []*Task{small, large} {
+		if err := client.Schedule(task, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gotEnqueued := h.GetEnqueuedMessages(t, r)
+	if len(gotEnqueued) != 2 {
+		t.Fatalf("%q has %d tasks, want 2", base.DefaultQueue, len(gotEnqueued))
+	}
+	// Note: enqueued list is in reverse order of insertion.
+	if msg := gotEnqueued[1]; msg.Compressed {
+		t.Errorf("small payload %v was compressed, want uncompressed", msg.Payload)
+	}
+	msg := gotEnqueued[0]
+	if !msg.Compressed || msg.Payload != nil {
+		t.Errorf("large payload was not compressed: Compressed=%t", msg.Compressed)
+	}
+	payload, err := base.DecodePayload(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(large.Payload.data, payload); diff != "" {
+		t.Errorf("decoded payload mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestClientSetsEnqueuedAt(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	before := time.Now()
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	gotEnqueued := h.GetEnqueuedMessages(t, r)
+	if len(gotEnqueued) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.DefaultQueue, len(gotEnqueued))
+	}
+	got := time.Unix(0, gotEnqueued[0].EnqueuedAt)
+	if got.Before(before) || got.After(after) {
+		t.Errorf("EnqueuedAt = %v, want between %v and %v", got, before, after)
+	}
+}
+
+func TestClientUniquePending(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("sync_account", map[string]interface{}{"account_id": "a1"})
+	opt := UniquePending(time.Hour)
+
+	if err := client.Schedule(task, time.Now(), opt); err != nil {
+		t.Fatalf("first (*Client).Schedule() = %v, want nil", err)
+	}
+
+	// Duplicate while the task is pending should be rejected.
+	if err := client.Schedule(task, time.Now(), opt); err != ErrDuplicateTask {
+		t.Fatalf("(*Client).Schedule() while pending = %v, want %v", err, ErrDuplicateTask)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 1 {
+		t.Errorf("%q has %d tasks after duplicate, want 1", base.DefaultQueue, n)
+	}
+
+	// Task with another payload or in another queue is not a duplicate.
+	other := NewTask("sync_account", map[string]interface{}{"account_id": "a2"})
+	if err := client.Schedule(other, time.Now(), opt); err != nil {
+		t.Errorf("(*Client).Schedule() with another payload = %v, want nil", err)
+	}
+	if err := client.Schedule(task, time.Now(), opt, Queue("low")); err != nil {
+		t.Errorf("(*Client).Schedule() to another queue = %v, want nil", err)
+	}
+
+	// Duplicate after the task has started should be accepted.
+	msg, err := rdb.NewRDB(r).Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload["account_id"] != "a1" {
+		t.Fatalf("dequeued task with payload %v, want the first task", msg.Payload)
+	}
+	if err := client.Schedule(task, time.Now(), opt); err != nil {
+		t.Errorf("(*Client).Schedule() after the task started = %v, want nil", err)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 2 {
+		t.Errorf("%q has %d tasks, want 2", base.DefaultQueue, n)
+	}
+
+	// Not supported in a transaction.
+	if err := client.ScheduleTx(r.TxPipeline(), task, time.Now(), opt); err == nil {
+		t.Errorf("(*Client).ScheduleTx() with UniquePending = nil, want non-nil error")
+	}
+}
+
+func TestClientUniqueKey(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, UniqueKeyFunc(func(task *Task) string {
+		id, _ := task.Payload.GetString("account_id")
+		return id
+	}))
+	opt := UniquePending(time.Hour)
+
+	// Tasks with different payloads but the same key are duplicates.
+	t1 := NewTask("sync_account", map[string]interface{}{"account_id": "a1", "requested_at": 1})
+	t2 := NewTask("sync_account", map[string]interface{}{"account_id": "a1", "requested_at": 2})
+	if err := client.Schedule(t1, time.Now(), opt); err != nil {
+		t.Fatalf("first (*Client).Schedule() = %v, want nil", err)
+	}
+	if err := client.Schedule(t2, time.Now(), opt); err != ErrDuplicateTask {
+		t.Errorf("(*Client).Schedule() with the same key = %v, want %v", err, ErrDuplicateTask)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 1 {
+		t.Errorf("%q has %d tasks after duplicate, want 1", base.DefaultQueue, n)
+	}
+
+	// UniqueKey takes precedence over the key function.
+	if err := client.Schedule(t2, time.Now(), opt, UniqueKey("other")); err != nil {
+		t.Errorf("(*Client).Schedule() with UniqueKey(%q) = %v, want nil", "other", err)
+	}
+	if err := client.Schedule(t1, time.Now(), opt, UniqueKey("other")); err != ErrDuplicateTask {
+		t.Errorf("(*Client).Schedule() with the same UniqueKey = %v, want %v", err, ErrDuplicateTask)
+	}
+
+	// Empty key is rejected.
+	t3 := NewTask("sync_account", map[string]interface{}{"requested_at": 3})
+	if err := client.Schedule(t3, time.Now(), opt); err == nil {
+		t.Errorf("(*Client).Schedule() with an empty key = nil, want non-nil error")
+	}
+	if err := client.Schedule(t1, time.Now(), opt, UniqueKey("")); err == nil {
+		t.Errorf("(*Client).Schedule() with UniqueKey(\"\") = nil, want non-nil error")
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 2 {
+		t.Errorf("%q has %d tasks, want 2", base.DefaultQueue, n)
+	}
+}
+
+func TestClientPendingTTL(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	ephemeral := NewTask("notify", map[string]interface{}{"user_id": "u1"})
+	task := NewTask("send_email", nil)
+
+	if err := client.Schedule(ephemeral, time.Now(), PendingTTL(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	rdbClient := rdb.NewRDB(r)
+	if n, err := rdbClient.DeleteExpired(); n != 0 || err != nil {
+		t.Errorf("DeleteExpired() before ttl = %d, %v; want 0, nil", n, err)
+	}
+	time.Sleep(2 * time.Second)
+	if n, err := rdbClient.DeleteExpired(); n != 1 || err != nil {
+		t.Errorf("DeleteExpired() after ttl = %d, %v; want 1, nil", n, err)
+	}
+	enqueued := h.GetEnqueuedMessages(t, r)
+	if len(enqueued) != 1 || enqueued[0].Type != task.Type {
+		t.Errorf("%q has %v, want only the task without ttl", base.DefaultQueue, enqueued)
+	}
+}
+
+func TestClientIdempotencyKey(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("send_email", map[string]interface{}{"to": "customer@gmail.com"})
+	opt := IdempotencyKey("request-123", time.Hour)
+
+	if err := client.Schedule(task, time.Now(), opt); err != nil {
+		t.Fatalf("first (*Client).Schedule() = %v, want nil", err)
+	}
+	enqueued := h.GetEnqueuedMessages(t, r)
+	if len(enqueued) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.DefaultQueue, len(enqueued))
+	}
+	origID := enqueued[0].ID
+
+	// Replay within ttl should not enqueue the task again.
+	err := client.EnqueueIn(task, time.Minute, opt)
+	if !errors.Is(err, ErrIdempotentReplay) {
+		t.Fatalf("second (*Client).EnqueueIn() = %v, want %v", err, ErrIdempotentReplay)
+	}
+	if !strings.Contains(err.Error(), origID.String()) {
+		t.Errorf("error message %q does not contain the original task id %v", err.Error(), origID)
+	}
+	var replay *IdempotentReplayError
+	if !errors.As(err, &replay) {
+		t.Fatalf("second (*Client).EnqueueIn() = %v, want an *IdempotentReplayError", err)
+	}
+	if replay.ID != origID.String() {
+		t.Errorf("IdempotentReplayError.ID = %q, want the original task id %v", replay.ID, origID)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 1 {
+		t.Errorf("%q has %d tasks after replay, want 1", base.DefaultQueue, n)
+	}
+	if n := len(h.GetScheduledMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks after replay, want 0", base.ScheduledQueue, n)
+	}
+
+	// Key is kept even after the task has been processed.
+	if err := r.Del(base.DefaultQueue).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Schedule(task, time.Now(), opt); !errors.Is(err, ErrIdempotentReplay) {
+		t.Errorf("(*Client).Schedule() after processing = %v, want %v", err, ErrIdempotentReplay)
+	}
+
+	// Different key should enqueue the task.
+	if err := client.Schedule(task, time.Now(), IdempotencyKey("request-456", time.Hour)); err != nil {
+		t.Errorf("(*Client).Schedule() with another key = %v, want nil", err)
+	}
+
+	// Replay after ttl should enqueue the task.
+	key := base.IdempotencyKey("request-123")
+	if ttl := r.TTL(key).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL of %q = %v, want (0, %v]", key, ttl, time.Hour)
+	}
+	r.Del(key) // simulate expiration of the key
+	if err := client.Schedule(task, time.Now(), opt); err != nil {
+		t.Errorf("(*Client).Schedule() after ttl = %v, want nil", err)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 2 {
+		t.Errorf("%q has %d tasks, want 2", base.DefaultQueue, n)
+	}
+}
+
+func TestClientProcessInWindow(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("send_email", nil)
+	start := time.Now().Add(time.Hour)
+	window := 3 * time.Hour
+
+	// ProcessInWindow takes precedence over the time passed to Schedule and EnqueueIn.
+	for i := 0; i < 10; i++ {
+		if err := client.Schedule(task, time.Now(), ProcessInWindow(start, window)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.EnqueueIn(task, 0, ProcessInWindow(start, window)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, n)
+	}
+	gotScheduled := h.GetScheduledEntries(t, r)
+	if len(gotScheduled) != 20 {
+		t.Fatalf("%q has %d tasks, want 20", base.ScheduledQueue, len(gotScheduled))
+	}
+	min, max := start.Unix(), start.Add(window).Unix()
+	scores := make(map[int64]bool)
+	for _, entry := range gotScheduled {
+		got := int64(entry.Score)
+		if got < min || got > max {
+			t.Errorf("task is scheduled at %d, want between %d and %d", got, min, max)
+		}
+		scores[got] = true
+	}
+	if len(scores) == 1 {
+		t.Errorf("all tasks are scheduled at the same time, want them spread across the window")
+	}
+}
+
+func TestProcessTimeInWindow(t *testing.T) {
+	start := time.Now()
+	if got := processTimeInWindow(start, 0); !got.Equal(start) {
+		t.Errorf("processTimeInWindow(%v, 0) = %v, want %v", start, got, start)
+	}
+	window := time.Minute
+	for i := 0; i < 100; i++ {
+		got := processTimeInWindow(start, window)
+		if got.Before(start) || got.After(start.Add(window)) {
+			t.Errorf("processTimeInWindow(%v, %v) = %v, want between %v and %v", start, window, got, start, start.Add(window))
+		}
+	}
+}
+
+func TestClientNamespace(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, Namespace("myapp"))
+	task := NewTask("send_email", nil)
+
+	if err := client.Schedule(task, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Schedule(task, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, n)
+	}
+	if n := len(h.GetScheduledMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledQueue, n)
+	}
+	keys := base.NewKeys("myapp")
+	if n := r.LLen(keys.DefaultQueue).Val(); n != 1 {
+		t.Errorf("%q has %d tasks, want 1", keys.DefaultQueue, n)
+	}
+	if n := r.ZCard(keys.ScheduledQueue).Val(); n != 1 {
+		t.Errorf("%q has %d tasks, want 1", keys.ScheduledQueue, n)
+	}
+}
+
+func TestClientEnqueueWithDepth(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	task := NewTask("send_email", nil)
+
+	for want := 1; want <= 3; want++ {
+		got, err := client.EnqueueWithDepth(task)
+		if err != nil {
+			t.Fatalf("(*Client).EnqueueWithDepth() returned error: %v", err)
+		}
+		if got != want {
+			t.Errorf("(*Client).EnqueueWithDepth() = %d, want %d", got, want)
+		}
+	}
+	if got, err := client.EnqueueWithDepth(task, Queue("critical")); err != nil || got != 1 {
+		t.Errorf("(*Client).EnqueueWithDepth(task, Queue(%q)) = %d, %v; want 1, nil", "critical", got, err)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != 3 {
+		t.Errorf("%q has %d tasks, want 3", base.DefaultQueue, n)
+	}
+}
+
+func TestClientRegisterValidator(t *testing.T) {
+	errMissingRecipient := errors.New("missing recipient")
+	tests := []struct {
+		desc    string
+		task    *Task
+		wantErr error
+	}{
+		{
+			desc:    "valid task",
+			task:    NewTask("send_email", map[string]interface{}{"to": "user@example.com"}),
+			wantErr: nil,
+		},
+		{
+			desc:    "invalid task",
+			task:    NewTask("send_email", map[string]interface{}{"subject": "hello"}),
+			wantErr: errMissingRecipient,
+		},
+		{
+			desc:    "task type with no validator",
+			task:    NewTask("gen_thumbnail", nil),
+			wantErr: nil,
+		},
+	}
+
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+	client.RegisterValidator("send_email", func(task *Task) error {
+		if !task.Payload.Has("to") {
+			return errMissingRecipient
+		}
+		return nil
+	})
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+
+		err := client.Schedule(tc.task, time.Now())
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s; Schedule returned %v, want %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		wantEnqueued := 1
+		if tc.wantErr != nil {
+			if !strings.Contains(err.Error(), tc.task.Type) {
+				t.Errorf("%s; error %q does not contain the task type %q", tc.desc, err, tc.task.Type)
+			}
+			wantEnqueued = 0
+		}
+		if n := len(h.GetEnqueuedMessages(t, r)); n != wantEnqueued {
+			t.Errorf("%s; %q has %d tasks, want %d", tc.desc, base.DefaultQueue, n, wantEnqueued)
+		}
+	}
+}
+
+func TestClientDependsOn(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	parentID, err := client.EnqueueWithID(NewTask("export_csv", nil))
+	if err != nil {
+		t.Fatalf("(*Client).EnqueueWithID() = _, %v, want nil", err)
+	}
+	// DependsOn takes precedence over the time to process the task.
+	err = client.Schedule(NewTask("email_csv", nil), time.Now().Add(time.Hour), DependsOn(parentID))
+	if err != nil {
+		t.Fatalf("(*Client).Schedule() with DependsOn = %v, want nil", err)
+	}
+
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 1 || got[0].ID.String() != parentID {
+		t.Errorf("%q has %v, want only the parent task %s", base.DefaultQueue, got, parentID)
+	}
+	if got := h.GetScheduledMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledQueue, len(got))
+	}
+	waiting := h.GetDependentMessages(t, r, parentID)
+	if len(waiting) != 1 || waiting[0].Type != "email_csv" || waiting[0].DependsOn != parentID {
+		t.Errorf("tasks waiting for %s = %v, want the email_csv task", parentID, waiting)
+	}
+
+	err = client.Schedule(NewTask("email_csv", nil), time.Now(), DependsOn("not-a-task-id"))
+	if err == nil {
+		t.Errorf("(*Client).Schedule() with invalid DependsOn = nil, want error")
+	}
+}
+
+func TestClientScheduleTx(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	// Discarded transaction enqueues neither the user's write nor the task.
+	pipe := r.TxPipeline()
+	pipe.Set("order:1", "created", 0)
+	if err := client.ScheduleTx(pipe, NewTask("send_receipt", nil), time.Now()); err != nil {
+		t.Fatalf("(*Client).ScheduleTx() = %v, want nil", err)
+	}
+	if err := pipe.Discard(); err != nil {
+		t.Fatalf("Discard() = %v, want nil", err)
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks after discarding the transaction, want 0", base.DefaultQueue, len(got))
+	}
+	if n := r.Exists("order:1").Val(); n != 0 {
+		t.Errorf("order:1 exists after discarding the transaction")
+	}
+
+	pipe = r.TxPipeline()
+	pipe.Set("order:1", "created", 0)
+	if err := client.ScheduleTx(pipe, NewTask("send_receipt", nil), time.Now()); err != nil {
+		t.Fatalf("(*Client).ScheduleTx() = %v, want nil", err)
+	}
+	if err := client.ScheduleTx(pipe, NewTask("send_reminder", nil), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("(*Client).ScheduleTx() = %v, want nil", err)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		t.Fatalf("Exec() = %v, want nil", err)
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 1 || got[0].Type != "send_receipt" {
+		t.Errorf("%q has %v, want the send_receipt task", base.DefaultQueue, got)
+	}
+	if got := h.GetScheduledMessages(t, r); len(got) != 1 || got[0].Type != "send_reminder" {
+		t.Errorf("%q has %v, want the send_reminder task", base.ScheduledQueue, got)
+	}
+	if got := r.Get("order:1").Val(); got != "created" {
+		t.Errorf("order:1 = %q, want %q", got, "created")
+	}
+
+	err := client.ScheduleTx(r.TxPipeline(), NewTask("send_receipt", nil), time.Now(), IdempotencyKey("order:1", time.Hour))
+	if err == nil {
+		t.Errorf("(*Client).ScheduleTx() with IdempotencyKey = nil, want error")
+	}
+}
+
+func TestClientMemoryLimit(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	}, MemoryLimit(0.9, time.Hour))
+
+	var calls int
+	used := int64(95)
+	client.memory.usage = func() (int64, int64, error) {
+		calls++
+		return used, 100, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		err := client.Schedule(NewTask("send_email", nil), time.Now())
+		if !errors.Is(err, ErrRedisMemoryHigh) {
+			t.Errorf("(*Client).Schedule() with high memory usage = %v, want %v", err, ErrRedisMemoryHigh)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("memory usage checked %d times, want once within the interval", calls)
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, len(got))
+	}
+
+	// Usage drops below the limit, which is seen on the next check.
+	used = 50
+	client.memory.checkedAt = time.Time{}
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Errorf("(*Client).Schedule() with low memory usage = %v, want nil", err)
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != 1 {
+		t.Errorf("%q has %d tasks, want 1", base.DefaultQueue, len(got))
+	}
+}
+
+func TestClientEnqueueAtNextCron(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	now := time.Now()
+	if err := client.EnqueueAtNextCron("0 * * * *", NewTask("send_report", nil)); err != nil {
+		t.Fatalf("(*Client).EnqueueAtNextCron() = %v, want nil", err)
+	}
+	// next top of the hour
+	want := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+	entries := h.GetScheduledEntries(t, r)
+	if len(entries) != 1 || entries[0].Msg.Type != "send_report" {
+		t.Fatalf("%q has %v, want the send_report task", base.ScheduledQueue, entries)
+	}
+	if got := int64(entries[0].Score); got != want.Unix() {
+		t.Errorf("task is scheduled to be processed at %v, want %v", time.Unix(got, 0), want)
+	}
+
+	if err := client.EnqueueAtNextCron("0 * * *", NewTask("send_report", nil)); err == nil {
+		t.Errorf("(*Client).EnqueueAtNextCron() with invalid spec = nil, want error")
+	}
+}
+
+func TestClientEnqueueBroadcast(t *testing.T) {
+	r := setup(t)
+	client := NewClient(&RedisClientOpt{
+		Addr: "localhost:6379",
+		DB:   14,
+	})
+
+	task := NewTask("refresh_cache", map[string]interface{}{"key": "users"})
+	ids, err := client.EnqueueBroadcast(task, []string{"Region-A", "region-b"}, MaxRetry(3))
+	if err != nil {
+		t.Fatalf("(*Client).EnqueueBroadcast() = %v, want nil", err)
+	}
+	if len(ids) != 2 || ids["region-a"] == "" || ids["region-b"] == "" || ids["region-a"] == ids["region-b"] {
+		t.Fatalf("(*Client).EnqueueBroadcast() returned IDs %v, want distinct IDs for region-a and region-b", ids)
+	}
+	for qname, id := range ids {
+		got := h.GetEnqueuedMessages(t, r, qname)
+		if len(got) != 1 {
+			t.Errorf("%q has %d tasks, want 1", qname, len(got))
+			continue
+		}
+		if got[0].ID.String() != id || got[0].Type != task.Type || got[0].Queue != qname || got[0].Retry != 3 {
+			t.Errorf("%q has %+v, want the copy with ID %s", qname, got[0], id)
+		}
+	}
+
+	// Each copy is processed independently.
+	bg := NewBackground(&RedisClientOpt{Addr: "localhost:6379", DB: 14}, &Config{
+		Concurrency: 2,
+		Queues:      map[string]uint{"region-a": 1, "region-b": 1},
+	})
+	processed := make(chan string, 2)
+	bg.start(HandlerFunc(func(task *Task) error {
+		key, err := task.Payload.GetString("key")
+		processed <- key
+		return err
+	}))
+	defer bg.stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-processed:
+			if key != "users" {
+				t.Errorf("processed task with key %q, want %q", key, "users")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %d of the copies, want 2", i)
+		}
+	}
+
+	invalid := [][]string{
+		nil,
+		{"region-a", ""},
+		{"region-a", "REGION-A"},
+	}
+	for _, queues := range invalid {
+		if _, err := client.EnqueueBroadcast(task, queues); err == nil {
+			t.Errorf("(*Client).EnqueueBroadcast(task, %q) = nil, want error", queues)
+		}
+	}
+	if _, err := client.EnqueueBroadcast(task, []string{"region-a"}, UniquePending(time.Hour)); err == nil {
+		t.Errorf("(*Client).EnqueueBroadcast() with UniquePending = nil, want error")
+	}
+}
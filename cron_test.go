@@ -0,0 +1,70 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2020, 1, 15, 10, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2020, 1, 16, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2020, 1, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2020, 1, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,20 * *", time.Date(2020, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either of day of month and day of week matches if both are set.
+		{"0 0 1 * fri", time.Date(2020, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tc := range tests {
+		s, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q) returned error: %v", tc.spec, err)
+			continue
+		}
+		if got := s.next(now); !got.Equal(tc.want) {
+			t.Errorf("next time of %q after %v = %v, want %v", tc.spec, now, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronError(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every 1h",
+	}
+	for _, spec := range specs {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) returned nil error, want non-nil", spec)
+		}
+	}
+}
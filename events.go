@@ -0,0 +1,105 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventKind is the kind of a processing event.
+type EventKind int
+
+const (
+	// TaskStarted is recorded when a worker starts processing a task.
+	TaskStarted EventKind = iota
+
+	// TaskSucceeded is recorded when a task is processed successfully.
+	TaskSucceeded
+
+	// TaskFailed is recorded when the processing of a task fails,
+	// before the task is retried or killed.
+	TaskFailed
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case TaskStarted:
+		return "TaskStarted"
+	case TaskSucceeded:
+		return "TaskSucceeded"
+	case TaskFailed:
+		return "TaskFailed"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a processing event recorded by the background
+// (see Config.RecentEventsSize).
+type Event struct {
+	// Kind is the kind of the event.
+	Kind EventKind
+
+	// Time is the time the event happened.
+	Time time.Time
+
+	// TaskID is the ID of the task.
+	TaskID string
+
+	// Type is the type name of the task.
+	Type string
+
+	// Queue is the name of the queue the task was pulled out of.
+	Queue string
+
+	// Error is the error the task failed with, empty unless Kind is TaskFailed.
+	Error string
+}
+
+// eventRing holds the latest events up to its size, overwriting
+// the oldest event once it's full.
+type eventRing struct {
+	mu     sync.Mutex
+	events []Event
+	next   int // index to write the next event at
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]Event, size)}
+}
+
+func (r *eventRing) add(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to n latest events, oldest first.
+func (r *eventRing) last(n int) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := r.next
+	if r.full {
+		size = len(r.events)
+	}
+	if n > size {
+		n = size
+	}
+	if n <= 0 {
+		return nil
+	}
+	res := make([]Event, 0, n)
+	for i := n; i > 0; i-- {
+		res = append(res, r.events[(r.next-i+len(r.events))%len(r.events)])
+	}
+	return res
+}
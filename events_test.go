@@ -0,0 +1,41 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEventRing(t *testing.T) {
+	r := newEventRing(3)
+	if got := r.last(5); len(got) != 0 {
+		t.Errorf("last(5) of empty ring = %v, want empty", got)
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		r.add(Event{TaskID: id})
+	}
+
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{n: 2, want: []string{"d", "e"}},
+		{n: 3, want: []string{"c", "d", "e"}},
+		// Older events are discarded.
+		{n: 10, want: []string{"c", "d", "e"}},
+		{n: 0, want: nil},
+	}
+	for _, tc := range tests {
+		var got []string
+		for _, e := range r.last(tc.n) {
+			got = append(got, e.TaskID)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("last(%d) mismatch: (-want, +got)\n%s", tc.n, diff)
+		}
+	}
+}
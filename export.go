@@ -0,0 +1,109 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// DeadTask is the record of a task sent to the dead queue, given to
+// the DeadTaskExporter.
+type DeadTask struct {
+	// ID is the ID of the task.
+	ID string
+
+	// Type is the type name of the task.
+	Type string
+
+	// Payload is the payload of the task, nil if it cannot be decoded.
+	Payload map[string]interface{}
+
+	// Queue is the name of the queue the task was processed from.
+	Queue string
+
+	// Retried is the number of times the task has been retried.
+	Retried int
+
+	// ErrorMsg is the error message the task was killed with.
+	ErrorMsg string
+
+	// ErrorHistory holds the previous error messages of the task, oldest first.
+	ErrorHistory []string
+
+	// EnqueuedAt is the time the task was first enqueued, zero if unknown.
+	EnqueuedAt time.Time
+
+	// DiedAt is the time the task was killed.
+	DiedAt time.Time
+
+	// Message is the task as stored in the dead queue, encoded in JSON.
+	// It holds all the fields of the task, including the ones not above.
+	Message json.RawMessage
+}
+
+func newDeadTask(msg *base.TaskMessage) (*DeadTask, error) {
+	data, err := base.EncodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	// Note: The payload is nil if it cannot be decoded.
+	payload, _ := base.DecodePayload(msg)
+	t := &DeadTask{
+		ID:           msg.ID.String(),
+		Type:         msg.Type,
+		Payload:      payload,
+		Queue:        msg.Queue,
+		Retried:      msg.Retried,
+		ErrorMsg:     msg.ErrorMsg,
+		ErrorHistory: msg.ErrorHistory,
+		DiedAt:       time.Unix(msg.DiedAt, 0),
+		Message:      data,
+	}
+	if msg.EnqueuedAt != 0 {
+		t.EnqueuedAt = time.Unix(0, msg.EnqueuedAt)
+	}
+	return t, nil
+}
+
+// A DeadTaskExporter archives the tasks sent to the dead queue
+// (see Config.DeadTaskExporter), e.g. to a file or an object store,
+// so that they're kept after they're deleted from redis.
+//
+// Export is called from multiple goroutines, so it must be safe for
+// concurrent use.
+type DeadTaskExporter interface {
+	Export(t *DeadTask) error
+}
+
+// The DeadTaskExporterFunc type is an adapter to allow the use of
+// ordinary functions as a DeadTaskExporter.
+type DeadTaskExporterFunc func(t *DeadTask) error
+
+// Export calls fn(t)
+func (fn DeadTaskExporterFunc) Export(t *DeadTask) error {
+	return fn(t)
+}
+
+// NewJSONExporter returns a DeadTaskExporter which writes each dead task
+// to w as a line of JSON, e.g. to append the tasks to a file.
+func NewJSONExporter(w io.Writer) DeadTaskExporter {
+	return &jsonExporter{enc: json.NewEncoder(w)}
+}
+
+type jsonExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *jsonExporter) Export(t *DeadTask) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(t)
+}
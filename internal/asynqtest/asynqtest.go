@@ -133,18 +133,39 @@ func SeedEnqueuedQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage,
 	seedRedisList(tb, r, queue, msgs)
 }
 
+// SeedPriorityQueue initializes the priority queue of the specified queue
+// with the given messages.
+func SeedPriorityQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry, qname string) {
+	tb.Helper()
+	r.SAdd(base.AllQueues, base.QueueKey(qname))
+	seedRedisZSet(tb, r, base.PriorityQueueKey(qname), entries)
+}
+
 // SeedInProgressQueue initializes the in-progress queue with the given messages.
 func SeedInProgressQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage) {
 	tb.Helper()
 	seedRedisList(tb, r, base.InProgressQueue, msgs)
 }
 
+// SeedServerInProgressQueue initializes the in-progress queue of the given
+// server with the given messages.
+func SeedServerInProgressQueue(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage, serverID string) {
+	tb.Helper()
+	seedRedisList(tb, r, base.InProgressKey(serverID), msgs)
+}
+
 // SeedScheduledQueue initializes the scheduled queue with the given messages.
 func SeedScheduledQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
 	tb.Helper()
 	seedRedisZSet(tb, r, base.ScheduledQueue, entries)
 }
 
+// SeedWaitingTasks initializes the set of tasks waiting for a dependency with the given messages.
+func SeedWaitingTasks(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+	tb.Helper()
+	seedRedisZSet(tb, r, base.WaitingTasks, entries)
+}
+
 // SeedRetryQueue initializes the retry queue with the given messages.
 func SeedRetryQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
 	tb.Helper()
@@ -157,6 +178,29 @@ func SeedDeadQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
 	seedRedisZSet(tb, r, base.DeadQueue, entries)
 }
 
+// SeedDeferredQueue initializes the deferred dead queue with the given messages.
+func SeedDeferredQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+	tb.Helper()
+	seedRedisZSet(tb, r, base.DeferredQueue, entries)
+}
+
+// SeedAbandonedQueue initializes the abandoned queue with the given messages.
+func SeedAbandonedQueue(tb testing.TB, r *redis.Client, entries []ZSetEntry) {
+	tb.Helper()
+	seedRedisZSet(tb, r, base.AbandonedQueue, entries)
+}
+
+// SeedDependents initializes the set of tasks waiting for the task
+// with the given id.
+func SeedDependents(tb testing.TB, r *redis.Client, msgs []*base.TaskMessage, id string) {
+	tb.Helper()
+	for _, s := range MustMarshalSlice(tb, msgs) {
+		if err := r.SAdd(base.DependentsKey(id), s).Err(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
 func seedRedisList(tb testing.TB, c *redis.Client, key string, msgs []*base.TaskMessage) {
 	data := MustMarshalSlice(tb, msgs)
 	for _, s := range data {
@@ -187,12 +231,40 @@ func GetEnqueuedMessages(tb testing.TB, r *redis.Client, queueOpt ...string) []*
 	return getListMessages(tb, r, queue)
 }
 
+// GetPriorityMessages returns all task messages in the priority queue
+// of the specified queue, ordered by their priority.
+func GetPriorityMessages(tb testing.TB, r *redis.Client, qname string) []*base.TaskMessage {
+	tb.Helper()
+	return getZSetMessages(tb, r, base.PriorityQueueKey(qname))
+}
+
 // GetInProgressMessages returns all task messages in the in-progress queue.
 func GetInProgressMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
 	tb.Helper()
 	return getListMessages(tb, r, base.InProgressQueue)
 }
 
+// GetServerInProgressMessages returns all task messages in the in-progress
+// queue of the given server.
+func GetServerInProgressMessages(tb testing.TB, r *redis.Client, serverID string) []*base.TaskMessage {
+	tb.Helper()
+	return getListMessages(tb, r, base.InProgressKey(serverID))
+}
+
+// GetHandoffMessages returns all task messages handed off to the given queue.
+func GetHandoffMessages(tb testing.TB, r *redis.Client, qname string) []*base.TaskMessage {
+	tb.Helper()
+	return getListMessages(tb, r, base.HandoffKey(qname))
+}
+
+// GetDependentMessages returns all task messages waiting for the task
+// with the given id.
+func GetDependentMessages(tb testing.TB, r *redis.Client, id string) []*base.TaskMessage {
+	tb.Helper()
+	data := r.SMembers(base.DependentsKey(id)).Val()
+	return MustUnmarshalSlice(tb, data)
+}
+
 // GetScheduledMessages returns all task messages in the scheduled queue.
 func GetScheduledMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
 	tb.Helper()
@@ -229,6 +301,36 @@ func GetDeadEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
 	return getZSetEntries(tb, r, base.DeadQueue)
 }
 
+// GetDeferredEntries returns all task messages and its score in the deferred dead queue.
+func GetDeferredEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, base.DeferredQueue)
+}
+
+// GetWaitingEntries returns all task messages waiting for a dependency and the expiration of their wait.
+func GetWaitingEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, base.WaitingTasks)
+}
+
+// GetInvisibleEntries returns all task messages and its score in the set of invisible tasks.
+func GetInvisibleEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, base.InvisibleTasks)
+}
+
+// GetAbandonedMessages returns all task messages in the abandoned queue.
+func GetAbandonedMessages(tb testing.TB, r *redis.Client) []*base.TaskMessage {
+	tb.Helper()
+	return getZSetMessages(tb, r, base.AbandonedQueue)
+}
+
+// GetAbandonedEntries returns all task messages and its score in the abandoned queue.
+func GetAbandonedEntries(tb testing.TB, r *redis.Client) []ZSetEntry {
+	tb.Helper()
+	return getZSetEntries(tb, r, base.AbandonedQueue)
+}
+
 func getListMessages(tb testing.TB, r *redis.Client, list string) []*base.TaskMessage {
 	data := r.LRange(list, 0, -1).Val()
 	return MustUnmarshalSlice(tb, data)
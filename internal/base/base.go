@@ -6,7 +6,15 @@
 package base
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/xid"
@@ -17,22 +25,138 @@ const DefaultQueueName = "default"
 
 // Redis keys
 const (
-	processedPrefix = "asynq:processed:"             // STRING - asynq:processed:<yyyy-mm-dd>
-	failurePrefix   = "asynq:failure:"               // STRING - asynq:failure:<yyyy-mm-dd>
-	QueuePrefix     = "asynq:queues:"                // LIST   - asynq:queues:<qname>
-	AllQueues       = "asynq:queues"                 // SET
-	DefaultQueue    = QueuePrefix + DefaultQueueName // LIST
-	ScheduledQueue  = "asynq:scheduled"              // ZSET
-	RetryQueue      = "asynq:retry"                  // ZSET
-	DeadQueue       = "asynq:dead"                   // ZSET
-	InProgressQueue = "asynq:in_progress"            // LIST
+	processedPrefix   = "asynq:processed:"             // STRING - asynq:processed:<yyyy-mm-dd>
+	failurePrefix     = "asynq:failure:"               // STRING - asynq:failure:<yyyy-mm-dd>
+	QueuePrefix       = "asynq:queues:"                // LIST   - asynq:queues:<qname>
+	AllQueues         = "asynq:queues"                 // SET
+	DefaultQueue      = QueuePrefix + DefaultQueueName // LIST
+	ScheduledQueue    = "asynq:scheduled"              // ZSET
+	RetryQueue        = "asynq:retry"                  // ZSET
+	DeadQueue         = "asynq:dead"                   // ZSET
+	DeadPrefix        = "asynq:dead:"                  // ZSET   - asynq:dead:<qname>, dead tasks of the queue -> died_at
+	DeferredQueue     = "asynq:deferred"               // ZSET   - dead tasks to retry on a slow cadence
+	InProgressQueue   = "asynq:in_progress"            // LIST
+	InProgressPrefix  = "asynq:in_progress:"           // LIST   - asynq:in_progress:<server id>
+	Servers           = "asynq:servers"                // ZSET   - server id -> lease expiration time
+	PriorityPrefix    = "asynq:priority:"              // ZSET   - asynq:priority:<qname>
+	PausedQueues      = "asynq:paused"                 // SET    - names of paused queues
+	PausedAll         = "asynq:paused_all"             // STRING - exists while all queues are paused
+	PriorityAging     = "asynq:priority_aging"         // HASH   - qname -> aging period in milliseconds
+	AbandonedQueue    = "asynq:abandoned"              // ZSET
+	MalformedQueue    = "asynq:malformed"              // ZSET   - raw data of undecodable task messages
+	CompletedQueue    = "asynq:completed"              // ZSET   - records of completed tasks
+	ExpiringQueue     = "asynq:expiring"               // ZSET   - tasks with a pending TTL -> expiration time
+	StartedTasks      = "asynq:started"                // ZSET   - task id -> time at which the task started
+	InvisibleTasks    = "asynq:invisible"              // ZSET   - tasks in progress -> visibility expiration time
+	HandoffPrefix     = "asynq:handoff:"               // LIST   - asynq:handoff:<qname>
+	HandedOff         = "asynq:handed_off"             // ZSET   - ids of tasks handed off on shutdown -> expiration of the mark
+	WaitingTasks      = "asynq:waiting"                // ZSET   - tasks waiting for a dependency -> expiration of the wait
+	RoutedPrefix      = "asynq:routed:"                // LIST   - asynq:routed:<server id>:<qname>
+	RestoreLock       = "asynq:restore_lock"           // STRING - id of the server restoring unfinished tasks
+	CancelChannel     = "asynq:cancel"                 // PUBSUB - types of tasks to cancel
+	DeadChannel       = "asynq:dead_tasks"             // PUBSUB - tasks killed by backgrounds
+	idempotencyPrefix = "asynq:idempotency:"           // STRING - asynq:idempotency:<key>
+	uniquePrefix      = "asynq:unique:"                // STRING - asynq:unique:<key>
+	serialPrefix      = "asynq:serial:"                // STRING - asynq:serial:<key>
+	dependentsPrefix  = "asynq:dependents:"            // SET    - asynq:dependents:<task id>
+	resolvedPrefix    = "asynq:resolved:"              // STRING - asynq:resolved:<task id>
+	affinityPrefix    = "asynq:affinity:"              // STRING - asynq:affinity:<qname>:<key>
+	completedIDPrefix = "asynq:completed_id:"          // STRING - asynq:completed_id:<task id>
+	resultPrefix      = "asynq:result:"                // STRING - asynq:result:<task id>
+	resultReadyPrefix = "asynq:result_ready:"          // LIST   - asynq:result_ready:<task id>
 )
 
+// MaxPriority is the highest priority level a task can be given within a queue.
+const MaxPriority = 255
+
 // QueueKey returns a redis key string for the given queue name.
 func QueueKey(qname string) string {
 	return QueuePrefix + strings.ToLower(qname)
 }
 
+// PriorityQueueKey returns a redis key string for the sorted set
+// holding the prioritized tasks of the given queue.
+func PriorityQueueKey(qname string) string {
+	return PriorityPrefix + strings.ToLower(qname)
+}
+
+// DeadKey returns a redis key string for the sorted set indexing the
+// dead tasks of the given queue.
+func DeadKey(qname string) string {
+	return DeadPrefix + strings.ToLower(qname)
+}
+
+// HandoffKey returns a redis key string for the list holding the tasks
+// of the given queue handed off by servers shutting down.
+func HandoffKey(qname string) string {
+	return HandoffPrefix + strings.ToLower(qname)
+}
+
+// RoutedKey returns a redis key string for the list holding the tasks
+// of the given queue routed to the given server by their affinity key.
+func RoutedKey(serverID, qname string) string {
+	return RoutedPrefix + serverID + ":" + strings.ToLower(qname)
+}
+
+// InProgressKey returns a redis key string for the list holding the tasks
+// being processed by the given server.
+func InProgressKey(serverID string) string {
+	return InProgressPrefix + serverID
+}
+
+// IdempotencyKey returns a redis key string for the given idempotency key.
+func IdempotencyKey(key string) string {
+	return idempotencyPrefix + key
+}
+
+// UniqueKey returns a redis key string for the lock held by a pending task
+// with the given unique key.
+func UniqueKey(key string) string {
+	return uniquePrefix + key
+}
+
+// SerialKey returns a redis key string for the lock held by the task being
+// processed with the given serial key.
+func SerialKey(key string) string {
+	return serialPrefix + key
+}
+
+// DependentsKey returns a redis key string for the set holding the tasks
+// waiting for the task with the given id.
+func DependentsKey(id string) string {
+	return dependentsPrefix + id
+}
+
+// ResolvedKey returns a redis key string for the outcome of the task
+// with the given id, recorded for the tasks depending on it.
+func ResolvedKey(id string) string {
+	return resolvedPrefix + id
+}
+
+// CompletedIDKey returns a redis key string for the mark of the completed
+// task with the given id.
+func CompletedIDKey(id string) string {
+	return completedIDPrefix + id
+}
+
+// ResultKey returns a redis key string for the result slot of the task
+// with the given id.
+func ResultKey(id string) string {
+	return resultPrefix + id
+}
+
+// ResultReadyKey returns a redis key string for the list signaling that
+// the result of the task with the given id is stored.
+func ResultReadyKey(id string) string {
+	return resultReadyPrefix + id
+}
+
+// AffinityKey returns a redis key string for the id of the server which
+// last processed a task of the given queue with the given affinity key.
+func AffinityKey(qname, key string) string {
+	return affinityPrefix + strings.ToLower(qname) + ":" + key
+}
+
 // ProcessedKey returns a redis key string for processed count
 // for the given day.
 func ProcessedKey(t time.Time) string {
@@ -45,27 +169,684 @@ func FailureKey(t time.Time) string {
 	return failurePrefix + t.UTC().Format("2006-01-02")
 }
 
+// Keys holds the redis keys used under a namespace.
+// Keys of the empty namespace are the same as the package level constants.
+type Keys struct {
+	prefix string
+
+	QueuePrefix     string
+	AllQueues       string
+	DefaultQueue    string
+	ScheduledQueue  string
+	RetryQueue      string
+	DeadQueue       string
+	DeadPrefix      string
+	DeferredQueue   string
+	InProgressQueue string
+	Servers         string
+	PriorityPrefix  string
+	PausedQueues    string
+	PausedAll       string
+	PriorityAging   string
+	AbandonedQueue  string
+	MalformedQueue  string
+	CompletedQueue  string
+	ExpiringQueue   string
+	StartedTasks    string
+	InvisibleTasks  string
+	HandoffPrefix   string
+	HandedOff       string
+	WaitingTasks    string
+	RoutedPrefix    string
+	RestoreLock     string
+	CancelChannel   string
+	DeadChannel     string
+}
+
+// NewKeys returns the redis keys under the given namespace.
+//
+// Keys are prefixed with the namespace and a colon, e.g. namespace "myapp"
+// uses "myapp:asynq:queues:default" for the default queue.
+func NewKeys(namespace string) *Keys {
+	prefix := ""
+	if namespace != "" {
+		prefix = namespace + ":"
+	}
+	return &Keys{
+		prefix:          prefix,
+		QueuePrefix:     prefix + QueuePrefix,
+		AllQueues:       prefix + AllQueues,
+		DefaultQueue:    prefix + DefaultQueue,
+		ScheduledQueue:  prefix + ScheduledQueue,
+		RetryQueue:      prefix + RetryQueue,
+		DeadQueue:       prefix + DeadQueue,
+		DeadPrefix:      prefix + DeadPrefix,
+		DeferredQueue:   prefix + DeferredQueue,
+		InProgressQueue: prefix + InProgressQueue,
+		Servers:         prefix + Servers,
+		PriorityPrefix:  prefix + PriorityPrefix,
+		PausedQueues:    prefix + PausedQueues,
+		PausedAll:       prefix + PausedAll,
+		PriorityAging:   prefix + PriorityAging,
+		AbandonedQueue:  prefix + AbandonedQueue,
+		MalformedQueue:  prefix + MalformedQueue,
+		CompletedQueue:  prefix + CompletedQueue,
+		ExpiringQueue:   prefix + ExpiringQueue,
+		StartedTasks:    prefix + StartedTasks,
+		InvisibleTasks:  prefix + InvisibleTasks,
+		HandoffPrefix:   prefix + HandoffPrefix,
+		HandedOff:       prefix + HandedOff,
+		WaitingTasks:    prefix + WaitingTasks,
+		RoutedPrefix:    prefix + RoutedPrefix,
+		RestoreLock:     prefix + RestoreLock,
+		CancelChannel:   prefix + CancelChannel,
+		DeadChannel:     prefix + DeadChannel,
+	}
+}
+
+// QueueKey returns a redis key string for the given queue name.
+func (k *Keys) QueueKey(qname string) string {
+	return k.prefix + QueueKey(qname)
+}
+
+// PriorityQueueKey returns a redis key string for the sorted set
+// holding the prioritized tasks of the given queue.
+func (k *Keys) PriorityQueueKey(qname string) string {
+	return k.prefix + PriorityQueueKey(qname)
+}
+
+// DeadKey returns a redis key string for the sorted set indexing the
+// dead tasks of the given queue.
+func (k *Keys) DeadKey(qname string) string {
+	return k.prefix + DeadKey(qname)
+}
+
+// HandoffKey returns a redis key string for the list holding the tasks
+// of the given queue handed off by servers shutting down.
+func (k *Keys) HandoffKey(qname string) string {
+	return k.prefix + HandoffKey(qname)
+}
+
+// RoutedKey returns a redis key string for the list holding the tasks
+// of the given queue routed to the given server by their affinity key.
+func (k *Keys) RoutedKey(serverID, qname string) string {
+	return k.prefix + RoutedKey(serverID, qname)
+}
+
+// InProgressKey returns a redis key string for the list holding the tasks
+// being processed by the given server.
+func (k *Keys) InProgressKey(serverID string) string {
+	return k.prefix + InProgressKey(serverID)
+}
+
+// IdempotencyKey returns a redis key string for the given idempotency key.
+func (k *Keys) IdempotencyKey(key string) string {
+	return k.prefix + IdempotencyKey(key)
+}
+
+// UniqueKey returns a redis key string for the lock held by a pending task
+// with the given unique key.
+func (k *Keys) UniqueKey(key string) string {
+	return k.prefix + UniqueKey(key)
+}
+
+// SerialKey returns a redis key string for the lock held by the task being
+// processed with the given serial key.
+func (k *Keys) SerialKey(key string) string {
+	return k.prefix + SerialKey(key)
+}
+
+// DependentsKey returns a redis key string for the set holding the tasks
+// waiting for the task with the given id.
+func (k *Keys) DependentsKey(id string) string {
+	return k.prefix + DependentsKey(id)
+}
+
+// ResolvedKey returns a redis key string for the outcome of the task
+// with the given id, recorded for the tasks depending on it.
+func (k *Keys) ResolvedKey(id string) string {
+	return k.prefix + ResolvedKey(id)
+}
+
+// CompletedIDKey returns a redis key string for the mark of the completed
+// task with the given id.
+func (k *Keys) CompletedIDKey(id string) string {
+	return k.prefix + CompletedIDKey(id)
+}
+
+// ResultKey returns a redis key string for the result slot of the task
+// with the given id.
+func (k *Keys) ResultKey(id string) string {
+	return k.prefix + ResultKey(id)
+}
+
+// ResultReadyKey returns a redis key string for the list signaling that
+// the result of the task with the given id is stored.
+func (k *Keys) ResultReadyKey(id string) string {
+	return k.prefix + ResultReadyKey(id)
+}
+
+// AffinityKey returns a redis key string for the id of the server which
+// last processed a task of the given queue with the given affinity key.
+func (k *Keys) AffinityKey(qname, key string) string {
+	return k.prefix + AffinityKey(qname, key)
+}
+
+// ProcessedKey returns a redis key string for processed count
+// for the given day.
+func (k *Keys) ProcessedKey(t time.Time) string {
+	return k.prefix + ProcessedKey(t)
+}
+
+// FailureKey returns a redis key string for failure count
+// for the given day.
+func (k *Keys) FailureKey(t time.Time) string {
+	return k.prefix + FailureKey(t)
+}
+
+// MessageVersion is the version of the schema of the task messages written
+// by this package. It's incremented on the changes to the schema which older
+// versions cannot process correctly, e.g. a field whose meaning changes.
+// Adding an optional field doesn't need a new version.
+//
+// Messages of a newer version are not decoded (see VersionError), so that
+// they're not processed by a version which would misinterpret them.
+const MessageVersion = 1
+
 // TaskMessage is the internal representation of a task with additional metadata fields.
 // Serialized data of this type gets written to redis.
+//
+// The messages are JSON objects with the field names below (see "Task Message
+// Format" in README for the fields to write from other languages). Fields
+// with a zero value may be omitted, and unknown fields are ignored.
 type TaskMessage struct {
+	// Version is the version of the schema the message was written with.
+	//
+	// Zero if the message was written before the schema was versioned,
+	// which is the same as version 1.
+	Version int `json:",omitempty"`
+
 	// Type indicates the kind of the task to be performed.
 	Type string
 
 	// Payload holds data needed to process the task.
+	//
+	// Nil if the payload is compressed.
 	Payload map[string]interface{}
 
+	// Compressed indicates whether the payload is compressed.
+	Compressed bool `json:",omitempty"`
+
+	// CompressedPayload holds the gzip-compressed JSON encoding of the payload
+	// if Compressed is true. Use DecodePayload to get the payload.
+	CompressedPayload []byte `json:",omitempty"`
+
 	// ID is a unique identifier for each task.
 	ID xid.ID
 
 	// Queue is a name this message should be enqueued to.
 	Queue string
 
+	// Priority is the priority level of this task within its queue.
+	//
+	// Tasks with a higher priority are processed first. Zero means
+	// the task has no priority and is processed in FIFO order.
+	Priority int
+
 	// Retry is the max number of retry for this task.
 	Retry int
 
 	// Retried is the number of times we've retried this task so far.
 	Retried int
 
+	// Attempts is the number of times the task has been processed so far,
+	// including the attempts which were snoozed and did not count as retries.
+	Attempts int `json:",omitempty"`
+
+	// EnqueuedAt is the time in unix nanoseconds at which the task was
+	// first registered by a client. It's kept intact across retries.
+	//
+	// Zero if unknown (e.g., the task was enqueued by an older version).
+	EnqueuedAt int64 `json:",omitempty"`
+
+	// Timeout is the max duration to process this task, formatted as
+	// a duration string (e.g. "30s").
+	//
+	// Empty if the task has no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Deadline is the time in unix seconds after which the task should not
+	// be processed. A retry which would be processed after the deadline
+	// kills the task instead.
+	//
+	// Zero if the task has no deadline.
+	Deadline int64 `json:",omitempty"`
+
+	// RetrySchedule holds the delays before each retry of this task,
+	// formatted as duration strings (e.g. "1m"). The Nth retry uses the Nth
+	// delay, and the retries beyond the schedule use the last delay.
+	//
+	// Empty if the task uses the retry delay function of the background.
+	RetrySchedule []string `json:",omitempty"`
+
+	// Weight is the share of the concurrency of the background taken by
+	// this task while it's processed.
+	//
+	// Zero means the default weight of one.
+	Weight int64 `json:",omitempty"`
+
+	// ResultTTL is the time in seconds for which the result of this task is
+	// kept in its result slot once the task is done or killed.
+	//
+	// Zero if the result of the task is not stored.
+	ResultTTL int64 `json:",omitempty"`
+
 	// ErrorMsg holds the error message from the last failure.
 	ErrorMsg string
+
+	// ErrorHistory holds the error messages from the failures prior to
+	// the last one, oldest first.
+	ErrorHistory []string `json:",omitempty"`
+
+	// CorrelationID is an identifier set by the producer of the task to
+	// trace the task from end to end.
+	//
+	// Empty if not specified.
+	CorrelationID string `json:",omitempty"`
+
+	// ExpiresAt is the time in unix seconds after which the task is removed
+	// if it's still waiting to be processed.
+	//
+	// Zero if the task has no pending TTL.
+	ExpiresAt int64 `json:",omitempty"`
+
+	// UniqueKey identifies the task among the pending tasks. No other task
+	// with the same key can be enqueued until this task is dequeued or
+	// the lock expires.
+	//
+	// Empty if the task is not unique.
+	UniqueKey string `json:",omitempty"`
+
+	// SerialKey groups the tasks which have to be processed one at a time.
+	// At most one task with the same key is processed at any time.
+	//
+	// Empty if the task is not serialized.
+	SerialKey string `json:",omitempty"`
+
+	// Category is the broad category of the task (e.g., "io-bound"),
+	// by which tasks of different types are limited and measured.
+	//
+	// Empty if the task has no category.
+	Category string `json:",omitempty"`
+
+	// Affinity groups the tasks which are preferably processed by the same
+	// server, e.g. to make use of its warm caches.
+	//
+	// Empty if the task has no affinity.
+	Affinity string `json:",omitempty"`
+
+	// DependsOn is the ID of the task which has to complete before
+	// this task is enqueued.
+	//
+	// Empty if the task has no dependency.
+	DependsOn string `json:",omitempty"`
+
+	// OnComplete and OnFailure are the tasks to enqueue once this task
+	// completes or is sent to the dead queue respectively.
+	//
+	// Nil if the task has no follow-up task.
+	OnComplete *TaskMessage `json:",omitempty"`
+	OnFailure  *TaskMessage `json:",omitempty"`
+
+	// ParentID is the ID of the task which this task follows up
+	// (see OnComplete and OnFailure).
+	//
+	// Empty if the task is not a follow-up task.
+	ParentID string `json:",omitempty"`
+
+	// FailedAt is the time in unix seconds at which the task last failed
+	// and was sent to the retry queue.
+	//
+	// Zero if the task has not been retried.
+	FailedAt int64 `json:",omitempty"`
+
+	// DiedAt is the time in unix seconds at which the task was killed.
+	//
+	// Zero if the task has not been killed.
+	DiedAt int64 `json:",omitempty"`
+
+	// DeadRetried is the number of times the task has been retried after
+	// it was to be killed, i.e. retried from the deferred dead queue.
+	DeadRetried int `json:",omitempty"`
+
+	// ServerID is the ID of the background instance which killed the task.
+	//
+	// Empty if the task has not been killed.
+	ServerID string `json:",omitempty"`
+}
+
+// ErrCodecMismatch indicates that a task message was encoded with a codec
+// other than the one used to decode it, e.g. the clients and the backgrounds
+// are configured with different codecs.
+var ErrCodecMismatch = errors.New("task message encoded with another codec")
+
+// Codec encodes and decodes the task messages written to redis.
+//
+// Note: Redis scripts inspect the ID, Queue, Priority and Deadline fields of
+// the messages with cjson, so every codec has to write a JSON object with
+// those fields. Codecs other than JSONCodec write them next to the message
+// encoded in their own format (see frame).
+type Codec interface {
+	// Name identifies the codec in the messages it encodes.
+	Name() string
+
+	// Encode returns the encoded bytes of the given message.
+	Encode(msg *TaskMessage) ([]byte, error)
+
+	// Decode returns the message decoded from the given bytes. It returns
+	// an error wrapping ErrCodecMismatch if the bytes were encoded
+	// with another codec, and a *VersionError if the message was written
+	// with a newer version than MessageVersion.
+	Decode(data []byte) (*TaskMessage, error)
+}
+
+// Codecs supported for task messages.
+var (
+	// JSONCodec encodes the messages as JSON objects (see TaskMessage),
+	// which is the default and the format to write from other languages.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes the messages with encoding/gob. The payloads stay
+	// encoded as JSON, so that the handlers get the same payloads with
+	// either codec and the same message always has the same encoding.
+	// Note: gob writes the type information along with each message, so
+	// it's slower than JSONCodec for the typical messages (see the benchmarks).
+	GobCodec Codec = gobCodec{}
+)
+
+// EncodeMessage marshals the given task message with JSONCodec and returns
+// the encoded bytes to be written to redis.
+func EncodeMessage(msg *TaskMessage) ([]byte, error) {
+	return JSONCodec.Encode(msg)
+}
+
+// DecodeMessage unmarshals the given bytes with JSONCodec and returns a decoded
+// task message. It returns an error if the data is not a task message encoded
+// by EncodeMessage.
+//
+// Messages of an older version than MessageVersion are decoded, and the fields
+// unknown to this version are ignored. Messages of a newer version are not
+// decoded and a *VersionError is returned, since they may have fields whose
+// meaning changed.
+func DecodeMessage(data []byte) (*TaskMessage, error) {
+	return JSONCodec.Decode(data)
+}
+
+// frame is the JSON object written by the codecs other than JSONCodec.
+type frame struct {
+	ID       xid.ID
+	Queue    string
+	Priority int   `json:",omitempty"`
+	Deadline int64 `json:",omitempty"`
+
+	// Codec is the name of the codec which encoded Body.
+	Codec string
+	Body  []byte
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(msg *TaskMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte) (*TaskMessage, error) {
+	var decoded struct {
+		TaskMessage
+		Codec string `json:",omitempty"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("could not decode task message: %v", err)
+	}
+	if decoded.Codec != "" {
+		return nil, fmt.Errorf("could not decode task message with codec %q: %w (%q)", "json", ErrCodecMismatch, decoded.Codec)
+	}
+	msg := decoded.TaskMessage
+	return validateMessage(&msg, data)
+}
+
+// gobMessage is the message encoded by GobCodec, with the payload and
+// the follow-up tasks encoded separately so that no map is encoded by gob,
+// whose order of map entries varies.
+type gobMessage struct {
+	Msg        TaskMessage
+	Payload    []byte
+	OnComplete []byte
+	OnFailure  []byte
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (c gobCodec) Encode(msg *TaskMessage) ([]byte, error) {
+	body, err := c.encodeBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&frame{
+		ID:       msg.ID,
+		Queue:    msg.Queue,
+		Priority: msg.Priority,
+		Deadline: msg.Deadline,
+		Codec:    c.Name(),
+		Body:     body,
+	})
+}
+
+func (c gobCodec) encodeBody(msg *TaskMessage) ([]byte, error) {
+	m := gobMessage{Msg: *msg}
+	m.Msg.Payload, m.Msg.OnComplete, m.Msg.OnFailure = nil, nil, nil
+	var err error
+	if msg.Payload != nil {
+		if m.Payload, err = json.Marshal(msg.Payload); err != nil {
+			return nil, err
+		}
+	}
+	if msg.OnComplete != nil {
+		if m.OnComplete, err = c.encodeBody(msg.OnComplete); err != nil {
+			return nil, err
+		}
+	}
+	if msg.OnFailure != nil {
+		if m.OnFailure, err = c.encodeBody(msg.OnFailure); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gobCodec) Decode(data []byte) (*TaskMessage, error) {
+	var f frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("could not decode task message: %v", err)
+	}
+	if f.Codec != c.Name() {
+		name := f.Codec
+		if name == "" {
+			name = "json"
+		}
+		return nil, fmt.Errorf("could not decode task message with codec %q: %w (%q)", c.Name(), ErrCodecMismatch, name)
+	}
+	msg, err := c.decodeBody(f.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode task message: %v", err)
+	}
+	return validateMessage(msg, data)
+}
+
+func (c gobCodec) decodeBody(body []byte) (*TaskMessage, error) {
+	var m gobMessage
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&m); err != nil {
+		return nil, err
+	}
+	msg := &m.Msg
+	if m.Payload != nil {
+		if err := json.Unmarshal(m.Payload, &msg.Payload); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if m.OnComplete != nil {
+		if msg.OnComplete, err = c.decodeBody(m.OnComplete); err != nil {
+			return nil, err
+		}
+	}
+	if m.OnFailure != nil {
+		if msg.OnFailure, err = c.decodeBody(m.OnFailure); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// validateMessage returns the given message decoded from data if it
+// has the required fields and a version not newer than MessageVersion.
+func validateMessage(msg *TaskMessage, data []byte) (*TaskMessage, error) {
+	if msg.Type == "" || msg.ID.IsNil() {
+		return nil, fmt.Errorf("could not decode task message: missing Type or ID in %q", truncate(data, 64))
+	}
+	if msg.Version > MessageVersion {
+		return nil, &VersionError{ID: msg.ID.String(), Version: msg.Version}
+	}
+	return msg, nil
+}
+
+// ErrUnsupportedVersion indicates that a task message was written with
+// a newer version of the schema than MessageVersion (see VersionError).
+var ErrUnsupportedVersion = errors.New("unsupported task message version")
+
+// VersionError is returned when decoding a task message written with a newer
+// version of the schema than MessageVersion, whose fields may have a meaning
+// unknown to this version. It matches ErrUnsupportedVersion with errors.Is.
+type VersionError struct {
+	ID      string // id of the task
+	Version int    // version the message was written with
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("task message %s has version %d, newer than the supported version %d", e.ID, e.Version, MessageVersion)
+}
+
+// Is reports whether target is ErrUnsupportedVersion.
+func (e *VersionError) Is(target error) bool { return target == ErrUnsupportedVersion }
+
+// truncate returns the first n bytes of data.
+func truncate(data []byte, n int) []byte {
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
+
+// CompressPayload compresses the payload of the message with gzip
+// if its JSON encoding is larger than threshold bytes.
+func CompressPayload(msg *TaskMessage, threshold int) error {
+	if msg.Compressed || msg.Payload == nil {
+		return nil
+	}
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if len(data) <= threshold {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	msg.Payload = nil
+	msg.Compressed = true
+	msg.CompressedPayload = buf.Bytes()
+	return nil
+}
+
+// DecodePayload returns the payload of the message,
+// decompressing it if it's compressed.
+func DecodePayload(msg *TaskMessage) (map[string]interface{}, error) {
+	if !msg.Compressed {
+		return msg.Payload, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.CompressedPayload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Clock is an interface to get the current time.
+// It allows time-dependent behavior to be tested deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// NewRealClock returns a Clock which reports the current time
+// using time.Now.
+func NewRealClock() Clock { return &realTimeClock{} }
+
+type realTimeClock struct{}
+
+func (*realTimeClock) Now() time.Time { return time.Now() }
+
+// SimulatedClock is a Clock whose time is set and advanced manually.
+// It is safe for concurrent use.
+type SimulatedClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewSimulatedClock returns a SimulatedClock set to the given time.
+func NewSimulatedClock(t time.Time) *SimulatedClock {
+	return &SimulatedClock{t: t}
+}
+
+// Now returns the current time of the clock.
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// SetTime sets the current time of the clock to t.
+func (c *SimulatedClock) SetTime(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// AdvanceTime moves the current time of the clock forward by d.
+func (c *SimulatedClock) AdvanceTime(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
 }
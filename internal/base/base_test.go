@@ -5,8 +5,16 @@
 package base
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rs/xid"
 )
 
 func TestQueueKey(t *testing.T) {
@@ -25,6 +33,23 @@ func TestQueueKey(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueKey(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"custom", "asynq:priority:custom"},
+		{"Critical", "asynq:priority:critical"},
+	}
+
+	for _, tc := range tests {
+		got := PriorityQueueKey(tc.qname)
+		if got != tc.want {
+			t.Errorf("PriorityQueueKey(%q) = %q, want %q", tc.qname, got, tc.want)
+		}
+	}
+}
+
 func TestProcessedKey(t *testing.T) {
 	tests := []struct {
 		input time.Time
@@ -60,3 +85,395 @@ func TestFailureKey(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressPayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"user_id": float64(42),
+		"body":    strings.Repeat("hello world ", 100),
+		"tags":    []interface{}{"a", "b"},
+	}
+
+	tests := []struct {
+		desc           string
+		payload        map[string]interface{}
+		threshold      int
+		wantCompressed bool
+	}{
+		{"payload larger than threshold", payload, 100, true},
+		{"payload smaller than threshold", payload, 1 << 20, false},
+		{"nil payload", nil, 0, false},
+	}
+
+	for _, tc := range tests {
+		msg := &TaskMessage{Type: "send_email", Payload: tc.payload}
+		if err := CompressPayload(msg, tc.threshold); err != nil {
+			t.Errorf("%s: CompressPayload returned error: %v", tc.desc, err)
+			continue
+		}
+		if msg.Compressed != tc.wantCompressed {
+			t.Errorf("%s: msg.Compressed = %t, want %t", tc.desc, msg.Compressed, tc.wantCompressed)
+		}
+		if tc.wantCompressed && msg.Payload != nil {
+			t.Errorf("%s: msg.Payload = %v after compression, want nil", tc.desc, msg.Payload)
+		}
+
+		// round trip through JSON as the message would be stored in redis.
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded TaskMessage
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodePayload(&decoded)
+		if err != nil {
+			t.Errorf("%s: DecodePayload returned error: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.payload) {
+			t.Errorf("%s: DecodePayload returned %v, want %v", tc.desc, got, tc.payload)
+		}
+	}
+}
+
+func TestDecodePayloadCorrupted(t *testing.T) {
+	msg := &TaskMessage{Type: "send_email", Compressed: true, CompressedPayload: []byte("not gzip")}
+	if _, err := DecodePayload(msg); err == nil {
+		t.Errorf("DecodePayload with corrupted payload returned nil error, want non-nil")
+	}
+}
+
+func TestSimulatedClock(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		desc      string
+		initTime  time.Time
+		advanceBy time.Duration
+		wantTime  time.Time
+	}{
+		{
+			desc:      "advance time forward",
+			initTime:  now,
+			advanceBy: 30 * time.Second,
+			wantTime:  now.Add(30 * time.Second),
+		},
+		{
+			desc:      "advance time backward",
+			initTime:  now,
+			advanceBy: -10 * time.Second,
+			wantTime:  now.Add(-10 * time.Second),
+		},
+	}
+
+	for _, tc := range tests {
+		c := NewSimulatedClock(tc.initTime)
+
+		if c.Now() != tc.initTime {
+			t.Errorf("%s: Before Advance; SimulatedClock.Now() = %v, want %v", tc.desc, c.Now(), tc.initTime)
+		}
+
+		c.AdvanceTime(tc.advanceBy)
+
+		if c.Now() != tc.wantTime {
+			t.Errorf("%s: After Advance; SimulatedClock.Now() = %v, want %v", tc.desc, c.Now(), tc.wantTime)
+		}
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	msg := &TaskMessage{
+		Type:       "send_email",
+		Payload:    map[string]interface{}{"user_id": 42.0, "subject": "hello"},
+		ID:         xid.New(),
+		Queue:      "default",
+		Priority:   3,
+		Retry:      10,
+		Retried:    2,
+		EnqueuedAt: time.Now().UnixNano(),
+		Timeout:    "30s",
+		ErrorMsg:   "something went wrong",
+	}
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessage(msg) returned error: %v", err)
+	}
+	got, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatalf("DecodeMessage(data) returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("DecodeMessage(EncodeMessage(msg)) = %+v, want %+v", got, msg)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	msg := &TaskMessage{
+		Type:          "send_email",
+		Payload:       map[string]interface{}{"user_id": 42.0, "subject": "hello", "tags": []interface{}{"a", "b"}},
+		ID:            xid.New(),
+		Queue:         "default",
+		Priority:      3,
+		Retry:         10,
+		Deadline:      time.Now().Unix(),
+		RetrySchedule: []string{"1m", "10m"},
+		OnComplete: &TaskMessage{
+			Type:    "notify",
+			Payload: map[string]interface{}{"user_id": 42.0},
+			ID:      xid.New(),
+			Queue:   "low",
+		},
+	}
+
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		data, err := c.Encode(msg)
+		if err != nil {
+			t.Fatalf("%s: Encode(msg) returned error: %v", c.Name(), err)
+		}
+		got, err := c.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: Decode(data) returned error: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%s: Decode(Encode(msg)) = %+v, want %+v", c.Name(), got, msg)
+		}
+
+		// Since messages are removed from redis by their encoding,
+		// the same message has to be encoded the same way every time.
+		for i := 0; i < 10; i++ {
+			again, err := c.Encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("%s: Encode(msg) = %q, want the same bytes as before %q", c.Name(), again, data)
+				break
+			}
+		}
+
+		// Redis scripts read these fields as JSON.
+		var fields struct {
+			ID       string
+			Queue    string
+			Priority int
+			Deadline int64
+		}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("%s: encoded message is not a JSON object: %v", c.Name(), err)
+		}
+		if fields.ID != msg.ID.String() || fields.Queue != msg.Queue || fields.Priority != msg.Priority || fields.Deadline != msg.Deadline {
+			t.Errorf("%s: encoded message has the fields %+v, want the ones of %+v", c.Name(), fields, msg)
+		}
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	msg := &TaskMessage{Type: "send_email", ID: xid.New(), Queue: "default"}
+	tests := []struct {
+		enc, dec Codec
+	}{
+		{JSONCodec, GobCodec},
+		{GobCodec, JSONCodec},
+	}
+
+	for _, tc := range tests {
+		data, err := tc.enc.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tc.dec.Decode(data)
+		if !errors.Is(err, ErrCodecMismatch) {
+			t.Errorf("%s.Decode(data encoded with %s) = %+v, %v; want ErrCodecMismatch",
+				tc.dec.Name(), tc.enc.Name(), got, err)
+		}
+	}
+}
+
+func TestDecodeMessageInvalidData(t *testing.T) {
+	var gobData bytes.Buffer
+	msg := &TaskMessage{Type: "send_email", ID: xid.New(), Queue: "default"}
+	if err := gob.NewEncoder(&gobData).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc string
+		data []byte
+	}{
+		{"data encoded with another codec", gobData.Bytes()},
+		{"empty JSON object", []byte(`{}`)},
+		{"JSON without ID", []byte(`{"Type":"send_email","Queue":"default"}`)},
+		{"not a JSON object", []byte(`"send_email"`)},
+	}
+
+	for _, tc := range tests {
+		if got, err := DecodeMessage(tc.data); err == nil {
+			t.Errorf("%s: DecodeMessage(%q) = %+v, nil; want error", tc.desc, tc.data, got)
+		}
+	}
+}
+
+func TestDecodeMessageFromOtherClient(t *testing.T) {
+	// Messages written by clients in other languages, with the fields
+	// in another order and some of the optional fields omitted.
+	tests := []struct {
+		desc string
+		data string
+		want *TaskMessage
+	}{
+		{
+			desc: "current version",
+			data: `{
+				"Version": 1,
+				"ID": "9m4e2mr0ui3e8a215n4g",
+				"Type": "send_email",
+				"Queue": "default",
+				"Payload": {"user_id": 42, "subject": "hello"},
+				"Retry": 25,
+				"Timeout": "30s",
+				"EnqueuedAt": 1577836800000000000
+			}`,
+			want: &TaskMessage{
+				Version:    1,
+				Type:       "send_email",
+				Payload:    map[string]interface{}{"user_id": 42.0, "subject": "hello"},
+				Queue:      "default",
+				Retry:      25,
+				Timeout:    "30s",
+				EnqueuedAt: 1577836800000000000,
+			},
+		},
+		{
+			desc: "unversioned",
+			data: `{"Type":"send_email","ID":"9m4e2mr0ui3e8a215n4g","Queue":"default","Payload":null}`,
+			want: &TaskMessage{Type: "send_email", Queue: "default"},
+		},
+		{
+			desc: "unknown fields",
+			data: `{"Version":1,"Type":"send_email","ID":"9m4e2mr0ui3e8a215n4g","Queue":"critical","Retry":3,"Tenant":"acme"}`,
+			want: &TaskMessage{Version: 1, Type: "send_email", Queue: "critical", Retry: 3},
+		},
+	}
+
+	id, err := xid.FromString("9m4e2mr0ui3e8a215n4g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		got, err := DecodeMessage([]byte(tc.data))
+		if err != nil {
+			t.Errorf("%s: DecodeMessage(%q) returned error: %v", tc.desc, tc.data, err)
+			continue
+		}
+		tc.want.ID = id
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: DecodeMessage(%q) = %+v, want %+v", tc.desc, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeMessageNewerVersion(t *testing.T) {
+	msg := &TaskMessage{Version: MessageVersion + 1, Type: "send_email", ID: xid.New(), Queue: "critical"}
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		data, err := c.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Decode(data)
+		if err == nil {
+			t.Fatalf("%s: Decode(data) = %+v, nil for a newer version; want error", c.Name(), got)
+		}
+		var verr *VersionError
+		if !errors.As(err, &verr) || verr.Version != msg.Version || verr.ID != msg.ID.String() {
+			t.Errorf("%s: Decode(data) returned error %v, want *VersionError with version %d", c.Name(), err, msg.Version)
+		}
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%s: errors.Is(%v, ErrUnsupportedVersion) = false, want true", c.Name(), err)
+		}
+	}
+}
+
+func benchmarkMessage() *TaskMessage {
+	return &TaskMessage{
+		Type:       "send_email",
+		Payload:    map[string]interface{}{"user_id": 42.0, "subject": "hello", "body": strings.Repeat("a", 200)},
+		ID:         xid.New(),
+		Queue:      "default",
+		Retry:      25,
+		EnqueuedAt: time.Now().UnixNano(),
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	msg := benchmarkMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	data, err := EncodeMessage(benchmarkMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeMessage(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeMessageGob(b *testing.B) {
+	msg := benchmarkMessage()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GobCodec.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessageGob(b *testing.B) {
+	data, err := GobCodec.Encode(benchmarkMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GobCodec.Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	now := time.Date(2020, 1, 2, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		namespace string
+		got       func(k *Keys) string
+		want      string
+	}{
+		{"", func(k *Keys) string { return k.DefaultQueue }, "asynq:queues:default"},
+		{"", func(k *Keys) string { return k.QueueKey("Critical") }, "asynq:queues:critical"},
+		{"myapp", func(k *Keys) string { return k.DefaultQueue }, "myapp:asynq:queues:default"},
+		{"myapp", func(k *Keys) string { return k.AllQueues }, "myapp:asynq:queues"},
+		{"myapp", func(k *Keys) string { return k.QueueKey("Critical") }, "myapp:asynq:queues:critical"},
+		{"myapp", func(k *Keys) string { return k.PriorityQueueKey("low") }, "myapp:asynq:priority:low"},
+		{"myapp", func(k *Keys) string { return k.InProgressQueue }, "myapp:asynq:in_progress"},
+		{"myapp", func(k *Keys) string { return k.DeadQueue }, "myapp:asynq:dead"},
+		{"myapp", func(k *Keys) string { return k.DeadKey("Low") }, "myapp:asynq:dead:low"},
+		{"myapp", func(k *Keys) string { return k.ProcessedKey(now) }, "myapp:asynq:processed:2020-01-02"},
+		{"myapp", func(k *Keys) string { return k.IdempotencyKey("abc") }, "myapp:asynq:idempotency:abc"},
+	}
+
+	for _, tc := range tests {
+		if got := tc.got(NewKeys(tc.namespace)); got != tc.want {
+			t.Errorf("key in namespace %q = %q, want %q", tc.namespace, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+// Package hook gives the subpackages of asynq access to the unexported
+// machinery of package asynq, which sets the hooks on init.
+package hook
+
+// Perform calls the handler, an asynq.Handler, with the task, an *asynq.Task,
+// of the named queue in the same way as the background does, e.g. recovering
+// from panic, and returns the error the background would handle the task
+// with, e.g. asynq.ErrNacked if the handler nacked the task. If requireAck
+// is set, the task has to be acknowledged as with Config.RequireAck.
+var Perform func(handler, task interface{}, qname string, requireAck bool) error
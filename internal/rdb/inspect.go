@@ -5,8 +5,10 @@
 package rdb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -38,10 +40,11 @@ type DailyStats struct {
 
 // EnqueuedTask is a task in a queue and is ready to be processed.
 type EnqueuedTask struct {
-	ID      xid.ID
-	Type    string
-	Payload map[string]interface{}
-	Queue   string
+	ID       xid.ID
+	Type     string
+	Payload  map[string]interface{}
+	Queue    string
+	Priority int
 }
 
 // InProgressTask is a task that's currently being processed.
@@ -49,6 +52,16 @@ type InProgressTask struct {
 	ID      xid.ID
 	Type    string
 	Payload map[string]interface{}
+	Queue   string
+}
+
+// StuckTask is a task that has been in progress for long.
+type StuckTask struct {
+	ID        xid.ID
+	Type      string
+	Payload   map[string]interface{}
+	Queue     string
+	StartedAt time.Time
 }
 
 // ScheduledTask is a task that's scheduled to be processed in the future.
@@ -61,12 +74,29 @@ type ScheduledTask struct {
 	Queue     string
 }
 
+// WaitingTask is a task that's waiting for its dependency to complete
+// (see EnqueueDependent).
+type WaitingTask struct {
+	ID        xid.ID
+	Type      string
+	Payload   map[string]interface{}
+	Queue     string
+	DependsOn string
+	// ExpireAt is the time after which the task is killed if it's still waiting.
+	ExpireAt time.Time
+	Score    int64
+}
+
 // RetryTask is a task that's in retry queue because worker failed to process the task.
 type RetryTask struct {
 	ID      xid.ID
 	Type    string
 	Payload map[string]interface{}
-	// TODO(hibiken): add LastFailedAt time.Time
+	// LastFailedAt is the time the task last failed. Zero if unknown.
+	LastFailedAt time.Time
+	// Delay is the retry delay computed on the last failure, i.e. the
+	// duration the task waits in the retry queue. Zero if unknown.
+	Delay     time.Duration
 	ProcessAt time.Time
 	ErrorMsg  string
 	Retried   int
@@ -82,10 +112,24 @@ type DeadTask struct {
 	Payload      map[string]interface{}
 	LastFailedAt time.Time
 	ErrorMsg     string
+	ErrorHistory []string
+	Retried      int
+	ServerID     string
 	Score        int64
 	Queue        string
 }
 
+// CompletedTask is a record of a task that has been processed successfully.
+type CompletedTask struct {
+	ID          xid.ID
+	Type        string
+	Queue       string
+	CompletedAt time.Time
+	Duration    time.Duration
+	// Result is the result reported by the handler, if any.
+	Result *TaskResult
+}
+
 // CurrentStats returns a current state of the queues.
 func (r *RDB) CurrentStats() (*Stats, error) {
 	// KEYS[1] -> asynq:queues
@@ -95,15 +139,24 @@ func (r *RDB) CurrentStats() (*Stats, error) {
 	// KEYS[5] -> asynq:dead
 	// KEYS[6] -> asynq:processed:<yyyy-mm-dd>
 	// KEYS[7] -> asynq:failure:<yyyy-mm-dd>
+	// KEYS[8] -> asynq:servers
+	// ARGV[1] -> r.keys.QueuePrefix
+	// ARGV[2] -> r.keys.PriorityPrefix
+	// ARGV[3] -> in-progress list prefix
 	script := redis.NewScript(`
 	local res = {}
 	local queues = redis.call("SMEMBERS", KEYS[1])
 	for _, qkey in ipairs(queues) do
+	  local pkey = ARGV[2] .. string.sub(qkey, string.len(ARGV[1]) + 1)
 	  table.insert(res, qkey)
-	  table.insert(res, redis.call("LLEN", qkey))
+	  table.insert(res, redis.call("LLEN", qkey) + redis.call("ZCARD", pkey))
+	end
+	local inprogress = redis.call("LLEN", KEYS[2])
+	for _, id in ipairs(redis.call("ZRANGE", KEYS[8], 0, -1)) do
+		inprogress = inprogress + redis.call("LLEN", ARGV[3] .. id)
 	end
 	table.insert(res, KEYS[2])
-	table.insert(res, redis.call("LLEN", KEYS[2]))
+	table.insert(res, inprogress)
 	table.insert(res, KEYS[3])
 	table.insert(res, redis.call("ZCARD", KEYS[3]))
 	table.insert(res, KEYS[4])
@@ -127,16 +180,17 @@ func (r *RDB) CurrentStats() (*Stats, error) {
 	return res
 	`)
 
-	now := time.Now()
+	now := r.clock.Now()
 	res, err := script.Run(r.client, []string{
-		base.AllQueues,
-		base.InProgressQueue,
-		base.ScheduledQueue,
-		base.RetryQueue,
-		base.DeadQueue,
-		base.ProcessedKey(now),
-		base.FailureKey(now),
-	}).Result()
+		r.keys.AllQueues,
+		r.keys.InProgressQueue,
+		r.keys.ScheduledQueue,
+		r.keys.RetryQueue,
+		r.keys.DeadQueue,
+		r.keys.ProcessedKey(now),
+		r.keys.FailureKey(now),
+		r.keys.Servers,
+	}, r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.InProgressKey("")).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -153,16 +207,16 @@ func (r *RDB) CurrentStats() (*Stats, error) {
 		val := cast.ToInt(data[i+1])
 
 		switch {
-		case strings.HasPrefix(key, base.QueuePrefix):
+		case strings.HasPrefix(key, r.keys.QueuePrefix):
 			stats.Enqueued += val
-			stats.Queues[strings.TrimPrefix(key, base.QueuePrefix)] = val
-		case key == base.InProgressQueue:
+			stats.Queues[strings.TrimPrefix(key, r.keys.QueuePrefix)] = val
+		case key == r.keys.InProgressQueue:
 			stats.InProgress = val
-		case key == base.ScheduledQueue:
+		case key == r.keys.ScheduledQueue:
 			stats.Scheduled = val
-		case key == base.RetryQueue:
+		case key == r.keys.RetryQueue:
 			stats.Retry = val
-		case key == base.DeadQueue:
+		case key == r.keys.DeadQueue:
 			stats.Dead = val
 		case key == "processed":
 			stats.Processed = val
@@ -179,14 +233,14 @@ func (r *RDB) HistoricalStats(n int) ([]*DailyStats, error) {
 		return []*DailyStats{}, nil
 	}
 	const day = 24 * time.Hour
-	now := time.Now().UTC()
+	now := r.clock.Now().UTC()
 	var days []time.Time
 	var keys []string
 	for i := 0; i < n; i++ {
 		ts := now.Add(-time.Duration(i) * day)
 		days = append(days, ts)
-		keys = append(keys, base.ProcessedKey(ts))
-		keys = append(keys, base.FailureKey(ts))
+		keys = append(keys, r.keys.ProcessedKey(ts))
+		keys = append(keys, r.keys.FailureKey(ts))
 	}
 	script := redis.NewScript(`
 	local res = {}
@@ -235,6 +289,126 @@ func (r *RDB) RedisInfo() (map[string]string, error) {
 	return info, nil
 }
 
+// ServerMemory returns the number of bytes used by the redis server and
+// its memory limit (maxmemory), as reported by INFO command.
+// The limit is zero if the server has no limit.
+func (r *RDB) ServerMemory() (used, limit int64, err error) {
+	res, err := r.client.Info("memory").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for _, l := range strings.Split(res, "\r\n") {
+		kv := strings.Split(l, ":")
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "used_memory":
+			used, err = cast.ToInt64E(kv[1])
+			found = true
+		case "maxmemory":
+			limit, err = cast.ToInt64E(kv[1])
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not parse %s: %v", kv[0], err)
+		}
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("redis did not report used_memory")
+	}
+	return used, limit, nil
+}
+
+// MemoryUsage holds the number of bytes used by the keys of each task state.
+type MemoryUsage struct {
+	Enqueued   int64
+	InProgress int64
+	Scheduled  int64
+	Retry      int64
+	Dead       int64
+
+	// Approximate is true if the redis server does not support MEMORY USAGE
+	// command, in which case each value is the total size of the task messages.
+	Approximate bool
+}
+
+// MemoryUsage returns the memory used by asynq keys for each task state.
+func (r *RDB) MemoryUsage() (*MemoryUsage, error) {
+	qkeys, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	var enqueuedKeys []string
+	for _, qkey := range qkeys {
+		qname := strings.TrimPrefix(qkey, r.keys.QueuePrefix)
+		enqueuedKeys = append(enqueuedKeys, qkey, r.keys.PriorityQueueKey(qname))
+	}
+	inProgressKeys, err := r.inProgressKeys()
+	if err != nil {
+		return nil, err
+	}
+	usage := &MemoryUsage{}
+	states := []struct {
+		keys []string
+		dst  *int64
+	}{
+		{enqueuedKeys, &usage.Enqueued},
+		{inProgressKeys, &usage.InProgress},
+		{[]string{r.keys.ScheduledQueue}, &usage.Scheduled},
+		{[]string{r.keys.RetryQueue}, &usage.Retry},
+		{[]string{r.keys.DeadQueue}, &usage.Dead},
+	}
+	for _, st := range states {
+		for _, key := range st.keys {
+			n, err := r.keyMemoryUsage(key, &usage.Approximate)
+			if err != nil {
+				return nil, err
+			}
+			*st.dst += n
+		}
+	}
+	return usage, nil
+}
+
+// keyMemoryUsage returns the number of bytes used by the key.
+// If the server does not support MEMORY USAGE command, it sets approximate
+// to true and returns the total size of the elements of the key instead.
+func (r *RDB) keyMemoryUsage(key string, approximate *bool) (int64, error) {
+	if !*approximate {
+		n, err := r.client.MemoryUsage(key).Result()
+		if err == redis.Nil {
+			return 0, nil // key does not exist
+		}
+		if err == nil {
+			return n, nil
+		}
+		if !strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			return 0, err
+		}
+		*approximate = true
+	}
+	typ, err := r.client.Type(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	var elems []string
+	switch typ {
+	case "list":
+		elems, err = r.client.LRange(key, 0, -1).Result()
+	case "zset":
+		elems, err = r.client.ZRange(key, 0, -1).Result()
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range elems {
+		total += int64(len(e))
+	}
+	return total, nil
+}
+
 // ListEnqueued returns enqueued tasks that are ready to be processed.
 //
 // Queue names can be optionally passed to query only the specified queues.
@@ -247,10 +421,17 @@ func (r *RDB) ListEnqueued(qnames ...string) ([]*EnqueuedTask, error) {
 }
 
 func (r *RDB) listAllEnqueued() ([]*EnqueuedTask, error) {
+	// KEYS[1] -> asynq:queues
+	// ARGV[1] -> r.keys.QueuePrefix
+	// ARGV[2] -> r.keys.PriorityPrefix
 	script := redis.NewScript(`
 	local res = {}
 	local queues = redis.call("SMEMBERS", KEYS[1])
 	for _, qkey in ipairs(queues) do
+		local pkey = ARGV[2] .. string.sub(qkey, string.len(ARGV[1]) + 1)
+		for _, msg in ipairs(redis.call("ZRANGE", pkey, 0, -1)) do
+			table.insert(res, msg)
+		end
 		local msgs = redis.call("LRANGE", qkey, 0, -1)
 		for _, msg in ipairs(msgs) do
 			table.insert(res, msg)
@@ -258,7 +439,7 @@ func (r *RDB) listAllEnqueued() ([]*EnqueuedTask, error) {
 	end
 	return res
 	`)
-	res, err := script.Run(r.client, []string{base.AllQueues}).Result()
+	res, err := script.Run(r.client, []string{r.keys.AllQueues}, r.keys.QueuePrefix, r.keys.PriorityPrefix).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -266,14 +447,18 @@ func (r *RDB) listAllEnqueued() ([]*EnqueuedTask, error) {
 	if err != nil {
 		return nil, err
 	}
-	return toEnqueuedTasks(data)
+	return r.toEnqueuedTasks(data)
 }
 
 func (r *RDB) listEnqueued(qnames ...string) ([]*EnqueuedTask, error) {
+	// KEYS -> pairs of asynq:priority:<qname> and asynq:queues:<qname>
 	script := redis.NewScript(`
 	local res = {}
-	for _, qkey in ipairs(KEYS) do
-		local msgs = redis.call("LRANGE", qkey, 0, -1)
+	for i = 1, table.getn(KEYS), 2 do
+		for _, msg in ipairs(redis.call("ZRANGE", KEYS[i], 0, -1)) do
+			table.insert(res, msg)
+		end
+		local msgs = redis.call("LRANGE", KEYS[i+1], 0, -1)
 		for _, msg in ipairs(msgs) do
 			table.insert(res, msg)
 		end
@@ -282,7 +467,7 @@ func (r *RDB) listEnqueued(qnames ...string) ([]*EnqueuedTask, error) {
 	`)
 	var keys []string
 	for _, q := range qnames {
-		keys = append(keys, base.QueueKey(q))
+		keys = append(keys, r.keys.PriorityQueueKey(q), r.keys.QueueKey(q))
 	}
 	res, err := script.Run(r.client, keys).Result()
 	if err != nil {
@@ -292,53 +477,420 @@ func (r *RDB) listEnqueued(qnames ...string) ([]*EnqueuedTask, error) {
 	if err != nil {
 		return nil, err
 	}
-	return toEnqueuedTasks(data)
+	return r.toEnqueuedTasks(data)
 }
 
-func toEnqueuedTasks(data []string) ([]*EnqueuedTask, error) {
+func (r *RDB) toEnqueuedTasks(data []string) ([]*EnqueuedTask, error) {
 	var tasks []*EnqueuedTask
 	for _, s := range data {
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
 		tasks = append(tasks, &EnqueuedTask{
-			ID:      msg.ID,
-			Type:    msg.Type,
-			Payload: msg.Payload,
-			Queue:   msg.Queue,
+			ID:       msg.ID,
+			Type:     msg.Type,
+			Payload:  payload,
+			Queue:    msg.Queue,
+			Priority: msg.Priority,
 		})
 	}
 	return tasks, nil
 }
 
-// ListInProgress returns all tasks that are currently being processed.
+// inProgressKeys returns the keys of the shared in-progress list and
+// the in-progress lists of the servers holding a lease.
+func (r *RDB) inProgressKeys() ([]string, error) {
+	ids, err := r.client.ZRange(r.keys.Servers, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{r.keys.InProgressQueue}
+	for _, id := range ids {
+		keys = append(keys, r.keys.InProgressKey(id))
+	}
+	return keys, nil
+}
+
+// StreamDeadTasks returns a channel which yields the tasks killed by the
+// backgrounds from the time of the call, i.e. as they're sent to the dead
+// queue. The subscription is confirmed on return.
+//
+// The channel is closed once ctx is canceled. Tasks killed while no one
+// is reading the channel may be dropped by redis.
+func (r *RDB) StreamDeadTasks(ctx context.Context) (<-chan *TaskInfo, error) {
+	pubsub := r.client.Subscribe(r.keys.DeadChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	ch := make(chan *TaskInfo)
+	go func() {
+		defer close(ch)
+		defer pubsub.Close()
+		msgs := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-msgs:
+				if !ok {
+					return
+				}
+				msg, err := r.decode([]byte(m.Payload))
+				if err != nil {
+					continue // bad data, ignore and continue
+				}
+				payload, err := base.DecodePayload(msg)
+				if err != nil {
+					continue // bad data, ignore and continue
+				}
+				info := &TaskInfo{State: "dead", Message: msg, Payload: payload}
+				if msg.DiedAt > 0 {
+					info.LastFailedAt = time.Unix(msg.DiedAt, 0)
+				}
+				select {
+				case ch <- info:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// CancelByType signals the backgrounds to cancel the in-progress tasks of
+// the given type, including the ones pulled out of the queues but not
+// processed yet, and returns the number of in-progress tasks of the type.
+//
+// The signal is delivered only to the backgrounds connected at the time
+// (see CancelationPubSub). It returns zero if no background receives it.
+func (r *RDB) CancelByType(taskType string) (int64, error) {
+	tasks, err := r.ListInProgress()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, t := range tasks {
+		if t.Type == taskType {
+			n++
+		}
+	}
+	receivers, err := r.client.Publish(r.keys.CancelChannel, taskType).Result()
+	if err != nil {
+		return 0, err
+	}
+	if receivers == 0 {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// TaskInfo is a task found by GetTaskInfo or PeekPending, along with its
+// current state.
+type TaskInfo struct {
+	// State is the state of the task, which is one of "enqueued",
+	// "inprogress", "scheduled", "retry" and "dead".
+	State   string
+	Message *base.TaskMessage
+	Payload map[string]interface{}
+	// ProcessAt is the time the task is processed next. Set only if State
+	// is "scheduled" or "retry".
+	ProcessAt time.Time
+	// LastFailedAt is the time the task last failed. Zero if unknown.
+	LastFailedAt time.Time
+}
+
+// GetTaskInfo finds the task with the given id in the given queue, across
+// all states, and returns the task along with its state.
+// If no task matches the id, it returns ErrTaskNotFound.
+//
+// The lists and sorted sets are scanned in chunks of getTaskInfoChunk tasks
+// so that redis is not blocked by a single long script. Since the chunks are
+// not scanned atomically, a task moving to another state during the lookup
+// may not be found.
+func (r *RDB) GetTaskInfo(qname string, id xid.ID) (*TaskInfo, error) {
+	inProgress, err := r.inProgressKeys()
+	if err != nil {
+		return nil, err
+	}
+	type source struct {
+		key, state string
+		zset       bool
+	}
+	sources := []source{
+		{r.keys.QueueKey(qname), "enqueued", false},
+		{r.keys.PriorityQueueKey(qname), "enqueued", true},
+	}
+	for _, key := range inProgress {
+		sources = append(sources, source{key, "inprogress", false})
+	}
+	sources = append(sources,
+		source{r.keys.ScheduledQueue, "scheduled", true},
+		source{r.keys.RetryQueue, "retry", true},
+		source{r.keys.DeadQueue, "dead", true})
+	for _, src := range sources {
+		data, err := r.findTaskChunked(src.key, src.zset, id.String(), strings.ToLower(qname))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			return r.newTaskInfo(src.state, data)
+		}
+	}
+	return nil, ErrTaskNotFound
+}
+
+// getTaskInfoChunk is the number of tasks GetTaskInfo scans in a script.
+const getTaskInfoChunk = 1000
+
+// findTaskChunked scans the list, or the sorted set if zset is true, in
+// chunks for the task with the given id in the given queue, and returns
+// the raw message and the score of the task, or nil if it's not found.
+func (r *RDB) findTaskChunked(key string, zset bool, id, qname string) ([]interface{}, error) {
+	// Note: Look for the id in the raw messages before decoding them,
+	// so that only the matching messages are decoded.
+	// KEYS[1] -> list or sorted set of tasks
+	// ARGV[1] -> task id
+	// ARGV[2] -> queue name
+	// ARGV[3] -> start index of the chunk
+	// ARGV[4] -> stop index of the chunk
+	// ARGV[5] -> "zset" if KEYS[1] is a sorted set
+	script := redis.NewScript(`
+	local function match(msg)
+		if not string.find(msg, ARGV[1], 1, true) then
+			return false
+		end
+		local decoded = cjson.decode(msg)
+		return decoded["ID"] == ARGV[1] and string.lower(tostring(decoded["Queue"])) == ARGV[2]
+	end
+	if ARGV[5] == "zset" then
+		local res = redis.call("ZRANGE", KEYS[1], ARGV[3], ARGV[4], "WITHSCORES")
+		for i = 1, #res, 2 do
+			if match(res[i]) then return {#res / 2, res[i], res[i+1]} end
+		end
+		return {#res / 2}
+	end
+	local res = redis.call("LRANGE", KEYS[1], ARGV[3], ARGV[4])
+	for _, msg in ipairs(res) do
+		if match(msg) then return {#res, msg, 0} end
+	end
+	return {#res}
+	`)
+	kind := "list"
+	if zset {
+		kind = "zset"
+	}
+	for start := 0; ; start += getTaskInfoChunk {
+		res, err := script.Run(r.client, []string{key},
+			id, qname, start, start+getTaskInfoChunk-1, kind).Result()
+		if err != nil {
+			return nil, err
+		}
+		data, err := cast.ToSliceE(res)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 3 {
+			return data[1:], nil
+		}
+		if len(data) != 1 || cast.ToInt(data[0]) < getTaskInfoChunk {
+			return nil, nil
+		}
+	}
+}
+
+// newTaskInfo returns the info of the task in the given state from the raw
+// message and the score of the task.
+func (r *RDB) newTaskInfo(state string, data []interface{}) (*TaskInfo, error) {
+	msg, err := r.decode([]byte(cast.ToString(data[0])))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base.DecodePayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	info := &TaskInfo{State: state, Message: msg, Payload: payload}
+	if msg.FailedAt > 0 {
+		info.LastFailedAt = time.Unix(msg.FailedAt, 0)
+	}
+	score := cast.ToInt64(data[1])
+	switch info.State {
+	case "scheduled", "retry":
+		info.ProcessAt = time.Unix(score, 0)
+	case "dead":
+		info.LastFailedAt = time.Unix(score, 0)
+	}
+	return info, nil
+}
+
+// PeekPending returns the enqueued task which is dequeued next from the
+// given queue, without removing it from the queue.
+// The tasks handed off to the queue come first, and then the tasks with
+// a priority (see base.TaskMessage.Priority) before the others.
+// Note: The tasks routed to a background by affinity are not considered.
+// If the queue has no enqueued tasks, it returns ErrQueueEmpty.
+func (r *RDB) PeekPending(qname string) (*TaskInfo, error) {
+	qname = strings.ToLower(qname)
+	// KEYS[1] -> asynq:handoff:<qname>
+	// KEYS[2] -> asynq:priority:<qname>
+	// KEYS[3] -> asynq:queues:<qname>
+	script := redis.NewScript(`
+	local handed = redis.call("LINDEX", KEYS[1], -1)
+	if handed then
+		return handed
+	end
+	local msgs = redis.call("ZRANGE", KEYS[2], 0, 0)
+	if table.getn(msgs) > 0 then
+		return msgs[1]
+	end
+	local msg = redis.call("LINDEX", KEYS[3], -1)
+	if msg then
+		return msg
+	end
+	return ""
+	`)
+	res, err := script.Run(r.client, []string{r.keys.HandoffKey(qname),
+		r.keys.PriorityQueueKey(qname), r.keys.QueueKey(qname)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, err := cast.ToStringE(res)
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, ErrQueueEmpty
+	}
+	msg, err := r.decode([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base.DecodePayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	info := &TaskInfo{State: "enqueued", Message: msg, Payload: payload}
+	if msg.FailedAt > 0 {
+		info.LastFailedAt = time.Unix(msg.FailedAt, 0)
+	}
+	return info, nil
+}
+
+// ListInProgress returns all tasks that are currently being processed,
+// including the ones in the in-progress lists of the servers.
 func (r *RDB) ListInProgress() ([]*InProgressTask, error) {
-	data, err := r.client.LRange(base.InProgressQueue, 0, -1).Result()
+	keys, err := r.inProgressKeys()
 	if err != nil {
 		return nil, err
 	}
+	var data []string
+	for _, key := range keys {
+		vals, err := r.client.LRange(key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, vals...)
+	}
 	var tasks []*InProgressTask
 	for _, s := range data {
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
 		tasks = append(tasks, &InProgressTask{
 			ID:      msg.ID,
 			Type:    msg.Type,
-			Payload: msg.Payload,
+			Payload: payload,
+			Queue:   msg.Queue,
 		})
 	}
 	return tasks, nil
 }
 
+// ListStuckTasks returns the in-progress tasks of the given queue which
+// started more than olderThan ago, oldest first. Empty qname matches all
+// queues.
+//
+// Only the tasks processed by the backgrounds which record the start times
+// (see TrackStartTimes in Config) are reported.
+func (r *RDB) ListStuckTasks(qname string, olderThan time.Duration) ([]*StuckTask, error) {
+	qname = strings.ToLower(qname)
+	keys, err := r.inProgressKeys()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*base.TaskMessage
+	for _, key := range keys {
+		vals, err := r.client.LRange(key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range vals {
+			msg, err := r.decode([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			if qname == "" || msg.Queue == qname {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.FloatCmd, len(msgs))
+	for i, msg := range msgs {
+		cmds[i] = pipe.ZScore(r.keys.StartedTasks, msg.ID.String())
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	threshold := r.clock.Now().Add(-olderThan)
+	var tasks []*StuckTask
+	for i, msg := range msgs {
+		score, err := cmds[i].Result()
+		if err == redis.Nil {
+			continue // start time not recorded
+		}
+		if err != nil {
+			return nil, err
+		}
+		startedAt := time.Unix(int64(score), 0)
+		if startedAt.After(threshold) {
+			continue
+		}
+		payload, err := base.DecodePayload(msg)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		tasks = append(tasks, &StuckTask{
+			ID:        msg.ID,
+			Type:      msg.Type,
+			Payload:   payload,
+			Queue:     msg.Queue,
+			StartedAt: startedAt,
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].StartedAt.Before(tasks[j].StartedAt) })
+	return tasks, nil
+}
+
 // ListScheduled returns all tasks that are scheduled to be processed
 // in the future.
 func (r *RDB) ListScheduled() ([]*ScheduledTask, error) {
-	data, err := r.client.ZRangeWithScores(base.ScheduledQueue, 0, -1).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.ScheduledQueue, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -348,8 +900,11 @@ func (r *RDB) ListScheduled() ([]*ScheduledTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -357,7 +912,7 @@ func (r *RDB) ListScheduled() ([]*ScheduledTask, error) {
 		tasks = append(tasks, &ScheduledTask{
 			ID:        msg.ID,
 			Type:      msg.Type,
-			Payload:   msg.Payload,
+			Payload:   payload,
 			Queue:     msg.Queue,
 			ProcessAt: processAt,
 			Score:     int64(z.Score),
@@ -366,10 +921,44 @@ func (r *RDB) ListScheduled() ([]*ScheduledTask, error) {
 	return tasks, nil
 }
 
+// ListWaiting returns all tasks that are waiting for their dependency
+// to complete.
+func (r *RDB) ListWaiting() ([]*WaitingTask, error) {
+	data, err := r.client.ZRangeWithScores(r.keys.WaitingTasks, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*WaitingTask
+	for _, z := range data {
+		s, ok := z.Member.(string)
+		if !ok {
+			continue // bad data, ignore and continue
+		}
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		tasks = append(tasks, &WaitingTask{
+			ID:        msg.ID,
+			Type:      msg.Type,
+			Payload:   payload,
+			Queue:     msg.Queue,
+			DependsOn: msg.DependsOn,
+			ExpireAt:  time.Unix(int64(z.Score), 0),
+			Score:     int64(z.Score),
+		})
+	}
+	return tasks, nil
+}
+
 // ListRetry returns all tasks that have failed before and willl be retried
 // in the future.
 func (r *RDB) ListRetry() ([]*RetryTask, error) {
-	data, err := r.client.ZRangeWithScores(base.RetryQueue, 0, -1).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.RetryQueue, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -379,22 +968,33 @@ func (r *RDB) ListRetry() ([]*RetryTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
 		processAt := time.Unix(int64(z.Score), 0)
+		var lastFailedAt time.Time
+		var delay time.Duration
+		if msg.FailedAt > 0 {
+			lastFailedAt = time.Unix(msg.FailedAt, 0)
+			delay = processAt.Sub(lastFailedAt)
+		}
 		tasks = append(tasks, &RetryTask{
-			ID:        msg.ID,
-			Type:      msg.Type,
-			Payload:   msg.Payload,
-			ErrorMsg:  msg.ErrorMsg,
-			Retry:     msg.Retry,
-			Retried:   msg.Retried,
-			Queue:     msg.Queue,
-			ProcessAt: processAt,
-			Score:     int64(z.Score),
+			ID:           msg.ID,
+			Type:         msg.Type,
+			Payload:      payload,
+			LastFailedAt: lastFailedAt,
+			Delay:        delay,
+			ErrorMsg:     msg.ErrorMsg,
+			Retry:        msg.Retry,
+			Retried:      msg.Retried,
+			Queue:        msg.Queue,
+			ProcessAt:    processAt,
+			Score:        int64(z.Score),
 		})
 	}
 	return tasks, nil
@@ -402,7 +1002,7 @@ func (r *RDB) ListRetry() ([]*RetryTask, error) {
 
 // ListDead returns all tasks that have exhausted its retry limit.
 func (r *RDB) ListDead() ([]*DeadTask, error) {
-	data, err := r.client.ZRangeWithScores(base.DeadQueue, 0, -1).Result()
+	data, err := r.client.ZRangeWithScores(r.keys.DeadQueue, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -412,8 +1012,11 @@ func (r *RDB) ListDead() ([]*DeadTask, error) {
 		if !ok {
 			continue // bad data, ignore and continue
 		}
-		var msg base.TaskMessage
-		err := json.Unmarshal([]byte(s), &msg)
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		payload, err := base.DecodePayload(msg)
 		if err != nil {
 			continue // bad data, ignore and continue
 		}
@@ -421,8 +1024,11 @@ func (r *RDB) ListDead() ([]*DeadTask, error) {
 		tasks = append(tasks, &DeadTask{
 			ID:           msg.ID,
 			Type:         msg.Type,
-			Payload:      msg.Payload,
+			Payload:      payload,
 			ErrorMsg:     msg.ErrorMsg,
+			ErrorHistory: msg.ErrorHistory,
+			Retried:      msg.Retried,
+			ServerID:     msg.ServerID,
 			Queue:        msg.Queue,
 			LastFailedAt: lastFailedAt,
 			Score:        int64(z.Score),
@@ -431,11 +1037,45 @@ func (r *RDB) ListDead() ([]*DeadTask, error) {
 	return tasks, nil
 }
 
+// ListCompleted returns the records of the completed tasks which have not
+// expired yet, ordered from the oldest to the most recent.
+func (r *RDB) ListCompleted() ([]*CompletedTask, error) {
+	min := fmt.Sprintf("(%d", r.clock.Now().Unix())
+	data, err := r.client.ZRangeByScore(r.keys.CompletedQueue,
+		&redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*CompletedTask
+	for _, s := range data {
+		var rec completedRecord
+		if err := json.Unmarshal([]byte(s), &rec); err != nil {
+			continue // bad data, ignore and continue
+		}
+		id, err := xid.FromString(rec.ID)
+		if err != nil {
+			continue // bad data, ignore and continue
+		}
+		tasks = append(tasks, &CompletedTask{
+			ID:          id,
+			Type:        rec.Type,
+			Queue:       rec.Queue,
+			CompletedAt: time.Unix(0, rec.CompletedAt*int64(time.Millisecond)),
+			Duration:    time.Duration(rec.Duration),
+			Result:      rec.Result,
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].CompletedAt.Before(tasks[j].CompletedAt)
+	})
+	return tasks, nil
+}
+
 // EnqueueDeadTask finds a task that matches the given id and score from dead queue
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.DeadQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.DeadQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -449,7 +1089,7 @@ func (r *RDB) EnqueueDeadTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score
 // does not exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.RetryQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -463,10 +1103,45 @@ func (r *RDB) EnqueueRetryTask(id xid.ID, score int64) error {
 // and enqueues it for processing. If a task that matches the id and score does not
 // exist, it returns ErrTaskNotFound.
 func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndEnqueue(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndEnqueue(r.keys.ScheduledQueue, id.String(), float64(score))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// RescheduleScheduledTask finds a task that matches the given id and score from
+// scheduled queue and changes the time to process the task to processAt.
+// If a task that matches the id and score does not exist (e.g., the task has
+// already been enqueued for processing), it returns ErrTaskNotFound.
+func (r *RDB) RescheduleScheduledTask(id xid.ID, score int64, processAt time.Time) error {
+	// KEYS[1] -> asynq:scheduled
+	// ARGV[1] -> score of the task to reschedule
+	// ARGV[2] -> id of the task to reschedule
+	// ARGV[3] -> new score
+	script := redis.NewScript(`
+	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
+	for _, msg in ipairs(msgs) do
+		local decoded = cjson.decode(msg)
+		if decoded["ID"] == ARGV[2] then
+			redis.call("ZADD", KEYS[1], "XX", ARGV[3], msg)
+			return 1
+		end
+	end
+	return 0
+	`)
+	res, err := script.Run(r.client, []string{r.keys.ScheduledQueue},
+		score, id.String(), processAt.Unix()).Result()
 	if err != nil {
 		return err
 	}
+	n, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("could not cast %v to int64", res)
+	}
 	if n == 0 {
 		return ErrTaskNotFound
 	}
@@ -476,36 +1151,80 @@ func (r *RDB) EnqueueScheduledTask(id xid.ID, score int64) error {
 // EnqueueAllScheduledTasks enqueues all tasks from scheduled queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllScheduledTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.ScheduledQueue)
+	return r.removeAndEnqueueAll(r.keys.ScheduledQueue)
 }
 
 // EnqueueAllRetryTasks enqueues all tasks from retry queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllRetryTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.RetryQueue)
+	return r.removeAndEnqueueAll(r.keys.RetryQueue)
+}
+
+// EnqueueRetryTasksInQueue atomically enqueues all tasks in retry queue
+// which belong to the given queue, and returns the number of tasks enqueued.
+func (r *RDB) EnqueueRetryTasksInQueue(qname string) (int64, error) {
+	return r.removeAndEnqueueAllInQueue(r.keys.RetryQueue, strings.ToLower(qname))
 }
 
 // EnqueueAllDeadTasks enqueues all tasks from dead queue
 // and returns the number of tasks enqueued.
 func (r *RDB) EnqueueAllDeadTasks() (int64, error) {
-	return r.removeAndEnqueueAll(base.DeadQueue)
+	return r.removeAndEnqueueAll(r.keys.DeadQueue)
+}
+
+// EnqueueDeadTasksWhere enqueues the tasks in dead queue for which
+// the predicate returns true, and returns the number of tasks enqueued.
+//
+// Each task is moved atomically one by one, so if it returns an error
+// the tasks enqueued before the error stay enqueued and calling it again
+// only enqueues the remaining matching tasks.
+func (r *RDB) EnqueueDeadTasksWhere(predicate func(t *DeadTask) bool) (int64, error) {
+	tasks, err := r.ListDead()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, t := range tasks {
+		if !predicate(t) {
+			continue
+		}
+		// n is zero if the task has been removed from the dead queue since listed.
+		n, err := r.removeAndEnqueue(r.keys.DeadQueue, t.ID.String(), float64(t.Score))
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// deadPrefixOf returns the prefix of the keys indexing the dead tasks of
+// each queue if zset is the dead queue, or an empty string otherwise.
+func (r *RDB) deadPrefixOf(zset string) string {
+	if zset == r.keys.DeadQueue {
+		return r.keys.DeadPrefix
+	}
+	return ""
 }
 
 func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
-	script := redis.NewScript(`
+	script := redis.NewScript(luaPush + luaDeadIndex + `
 	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 	for _, msg in ipairs(msgs) do
 		local decoded = cjson.decode(msg)
 		if decoded["ID"] == ARGV[2] then
 			redis.call("ZREM", KEYS[1], msg)
-			local qkey = ARGV[3] .. decoded["Queue"]
-			redis.call("LPUSH", qkey, msg)
+			if ARGV[7] ~= "" then
+				unindex_dead(ARGV[7], msg)
+			end
+			push(ARGV[3], ARGV[4], ARGV[5], msg, ARGV[6])
 			return 1
 		end
 	end
 	return 0
 	`)
-	res, err := script.Run(r.client, []string{zset}, score, id, base.QueuePrefix).Result()
+	res, err := script.Run(r.client, []string{zset}, score, id,
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis(), r.deadPrefixOf(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -517,17 +1236,29 @@ func (r *RDB) removeAndEnqueue(zset, id string, score float64) (int64, error) {
 }
 
 func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
-	script := redis.NewScript(`
+	return r.removeAndEnqueueAllInQueue(zset, "")
+}
+
+// removeAndEnqueueAllInQueue enqueues the tasks in zset which belong to
+// qname, or all tasks if qname is empty.
+func (r *RDB) removeAndEnqueueAllInQueue(zset, qname string) (int64, error) {
+	script := redis.NewScript(luaPush + luaDeadIndex + `
 	local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
+	local n = 0
 	for _, msg in ipairs(msgs) do
-		redis.call("ZREM", KEYS[1], msg)
-		local decoded = cjson.decode(msg)
-		local qkey = ARGV[1] .. decoded["Queue"]
-		redis.call("LPUSH", qkey, msg)
+		if ARGV[5] == "" or cjson.decode(msg)["Queue"] == ARGV[5] then
+			redis.call("ZREM", KEYS[1], msg)
+			if ARGV[6] ~= "" then
+				unindex_dead(ARGV[6], msg)
+			end
+			push(ARGV[1], ARGV[2], ARGV[3], msg, ARGV[4])
+			n = n + 1
+		end
 	end
-	return table.getn(msgs)
+	return n
 	`)
-	res, err := script.Run(r.client, []string{zset}, base.QueuePrefix).Result()
+	res, err := script.Run(r.client, []string{zset},
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis(), qname, r.deadPrefixOf(zset)).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -542,7 +1273,7 @@ func (r *RDB) removeAndEnqueueAll(zset string) (int64, error) {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.RetryQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.RetryQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -556,7 +1287,7 @@ func (r *RDB) KillRetryTask(id xid.ID, score int64) error {
 // and moves it to dead queue. If a task that maches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
-	n, err := r.removeAndKill(base.ScheduledQueue, id.String(), float64(score))
+	n, err := r.removeAndKill(r.keys.ScheduledQueue, id.String(), float64(score))
 	if err != nil {
 		return err
 	}
@@ -569,13 +1300,13 @@ func (r *RDB) KillScheduledTask(id xid.ID, score int64) error {
 // KillAllRetryTasks moves all tasks from retry queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllRetryTasks() (int64, error) {
-	return r.removeAndKillAll(base.RetryQueue)
+	return r.removeAndKillAll(r.keys.RetryQueue)
 }
 
 // KillAllScheduledTasks moves all tasks from scheduled queue to dead queue and
 // returns the number of tasks that were moved.
 func (r *RDB) KillAllScheduledTasks() (int64, error) {
-	return r.removeAndKillAll(base.ScheduledQueue)
+	return r.removeAndKillAll(r.keys.ScheduledQueue)
 }
 
 func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
@@ -586,7 +1317,8 @@ func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 	// ARGV[3] -> current timestamp
 	// ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
 	// ARGV[5] -> max number of tasks in dead queue (e.g., 100)
-	script := redis.NewScript(`
+	// ARGV[6] -> r.keys.DeadPrefix
+	script := redis.NewScript(luaDeadIndex + `
 	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 	for _, msg in ipairs(msgs) do
 		local decoded = cjson.decode(msg)
@@ -595,16 +1327,17 @@ func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 			redis.call("ZADD", KEYS[2], ARGV[3], msg)
 			redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
 			redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+			index_dead(KEYS[2], ARGV[6], msg, ARGV[3], tonumber(ARGV[5]))
 			return 1
 		end
 	end
 	return 0
 	`)
-	now := time.Now()
+	now := r.clock.Now()
 	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
 	res, err := script.Run(r.client,
-		[]string{zset, base.DeadQueue},
-		score, id, now.Unix(), limit, maxDeadTasks).Result()
+		[]string{zset, r.keys.DeadQueue},
+		score, id, now.Unix(), limit, maxDeadTasks, r.keys.DeadPrefix).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -612,6 +1345,11 @@ func (r *RDB) removeAndKill(zset, id string, score float64) (int64, error) {
 	if !ok {
 		return 0, fmt.Errorf("could not cast %v to int64", res)
 	}
+	if n > 0 {
+		if err := r.refreshTTL(r.keys.DeadQueue, r.deadTTL); err != nil {
+			return n, err
+		}
+	}
 	return n, nil
 }
 
@@ -621,20 +1359,22 @@ func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 	// ARGV[1] -> current timestamp
 	// ARGV[2] -> cutoff timestamp (e.g., 90 days ago)
 	// ARGV[3] -> max number of tasks in dead queue (e.g., 100)
-	script := redis.NewScript(`
+	// ARGV[4] -> r.keys.DeadPrefix
+	script := redis.NewScript(luaDeadIndex + `
 	local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
 	for _, msg in ipairs(msgs) do
 		redis.call("ZREM", KEYS[1], msg)
 		redis.call("ZADD", KEYS[2], ARGV[1], msg)
 		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
 		redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[3])
+		index_dead(KEYS[2], ARGV[4], msg, ARGV[1], tonumber(ARGV[3]))
 	end
 	return table.getn(msgs)
 	`)
-	now := time.Now()
+	now := r.clock.Now()
 	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	res, err := script.Run(r.client, []string{zset, base.DeadQueue},
-		now.Unix(), limit, maxDeadTasks).Result()
+	res, err := script.Run(r.client, []string{zset, r.keys.DeadQueue},
+		now.Unix(), limit, maxDeadTasks, r.keys.DeadPrefix).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -642,6 +1382,11 @@ func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 	if !ok {
 		return 0, fmt.Errorf("could not cast %v to int64", res)
 	}
+	if n > 0 {
+		if err := r.refreshTTL(r.keys.DeadQueue, r.deadTTL); err != nil {
+			return n, err
+		}
+	}
 	return n, nil
 }
 
@@ -649,36 +1394,173 @@ func (r *RDB) removeAndKillAll(zset string) (int64, error) {
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteDeadTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.DeadQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.DeadQueue, id.String(), float64(score))
 }
 
 // DeleteRetryTask finds a task that matches the given id and score from retry queue
 // and deletes it. If a task that matches the id and score does not exist,
 // it returns ErrTaskNotFound.
 func (r *RDB) DeleteRetryTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.RetryQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.RetryQueue, id.String(), float64(score))
 }
 
 // DeleteScheduledTask finds a task that matches the given id and score from
 // scheduled queue  and deletes it. If a task that matches the id and score
 //does not exist, it returns ErrTaskNotFound.
 func (r *RDB) DeleteScheduledTask(id xid.ID, score int64) error {
-	return r.deleteTask(base.ScheduledQueue, id.String(), float64(score))
+	return r.deleteTask(r.keys.ScheduledQueue, id.String(), float64(score))
 }
 
-func (r *RDB) deleteTask(zset, id string, score float64) error {
+// DeleteEnqueuedTask finds a task that matches the given id from the specified
+// queue and deletes it. If a task that matches the id does not exist in the queue
+// (e.g., the task has already been dequeued for processing), it returns ErrTaskNotFound.
+func (r *RDB) DeleteEnqueuedTask(qname string, id xid.ID) error {
+	// KEYS[1] -> asynq:queues:<qname>
+	// KEYS[2] -> asynq:priority:<qname>
+	// ARGV[1] -> id of the task to delete
 	script := redis.NewScript(`
+	local msgs = redis.call("LRANGE", KEYS[1], 0, -1)
+	for _, msg in ipairs(msgs) do
+		local decoded = cjson.decode(msg)
+		if decoded["ID"] == ARGV[1] then
+			redis.call("LREM", KEYS[1], 1, msg)
+			return 1
+		end
+	end
+	msgs = redis.call("ZRANGE", KEYS[2], 0, -1)
+	for _, msg in ipairs(msgs) do
+		local decoded = cjson.decode(msg)
+		if decoded["ID"] == ARGV[1] then
+			redis.call("ZREM", KEYS[2], msg)
+			return 1
+		end
+	end
+	return 0
+	`)
+	res, err := script.Run(r.client,
+		[]string{r.keys.QueueKey(qname), r.keys.PriorityQueueKey(qname)}, id.String()).Result()
+	if err != nil {
+		return err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("could not cast %v to int64", res)
+	}
+	if n == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// MoveEnqueuedTask finds a task that matches the given id from the queue named
+// from, and moves it to the tail of the queue named to, updating the queue name
+// of the task. If a task that matches the id does not exist in the queue
+// (e.g., the task has already been dequeued for processing), it returns ErrTaskNotFound.
+func (r *RDB) MoveEnqueuedTask(id xid.ID, from, to string) error {
+	data, prioritized, err := r.findEnqueued(from, id)
+	if err != nil {
+		return err
+	}
+	msg, err := r.decode([]byte(data))
+	if err != nil {
+		return err
+	}
+	msg.Queue = strings.ToLower(to)
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// Note: Removing the exact value fetched above makes sure the task
+	// has not been dequeued in the meantime.
+	// KEYS[1] -> asynq:queues:<from>
+	// KEYS[2] -> asynq:priority:<from>
+	// KEYS[3] -> asynq:queues
+	// ARGV[1] -> task message data in the source queue
+	// ARGV[2] -> task message data to push to the destination queue
+	// ARGV[3] -> 1 if the task is in the priority queue, 0 otherwise
+	// ARGV[4] -> destination queue key
+	// ARGV[5] -> r.keys.QueuePrefix
+	// ARGV[6] -> r.keys.PriorityPrefix
+	// ARGV[7] -> r.keys.PriorityAging
+	// ARGV[8] -> current unix time in milliseconds
+	script := redis.NewScript(luaPush + `
+	local n
+	if ARGV[3] == "1" then
+		n = redis.call("ZREM", KEYS[2], ARGV[1])
+	else
+		n = redis.call("LREM", KEYS[1], 1, ARGV[1])
+	end
+	if n == 0 then
+		return 0
+	end
+	redis.call("SADD", KEYS[3], ARGV[4])
+	push(ARGV[5], ARGV[6], ARGV[7], ARGV[2], ARGV[8])
+	return 1
+	`)
+	p := 0
+	if prioritized {
+		p = 1
+	}
+	res, err := script.Run(r.client,
+		[]string{r.keys.QueueKey(from), r.keys.PriorityQueueKey(from), r.keys.AllQueues},
+		data, string(bytes), p, r.keys.QueueKey(to),
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis()).Result()
+	if err != nil {
+		return err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("could not cast %v to int64", res)
+	}
+	if n == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// findEnqueued returns the data of the task that matches the given id in the
+// specified queue, and reports whether the task is in the priority queue.
+// If no task matches the id, it returns ErrTaskNotFound.
+func (r *RDB) findEnqueued(qname string, id xid.ID) (data string, prioritized bool, err error) {
+	for _, key := range []string{r.keys.QueueKey(qname), r.keys.PriorityQueueKey(qname)} {
+		var msgs []string
+		if key == r.keys.QueueKey(qname) {
+			msgs, err = r.client.LRange(key, 0, -1).Result()
+		} else {
+			msgs, err = r.client.ZRange(key, 0, -1).Result()
+		}
+		if err != nil {
+			return "", false, err
+		}
+		for _, s := range msgs {
+			msg, err := r.decode([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			if msg.ID == id {
+				return s, key == r.keys.PriorityQueueKey(qname), nil
+			}
+		}
+	}
+	return "", false, ErrTaskNotFound
+}
+
+func (r *RDB) deleteTask(zset, id string, score float64) error {
+	script := redis.NewScript(luaDeadIndex + `
 	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], ARGV[1])
 	for _, msg in ipairs(msgs) do
 		local decoded = cjson.decode(msg)
 		if decoded["ID"] == ARGV[2] then
 			redis.call("ZREM", KEYS[1], msg)
+			if ARGV[3] ~= "" then
+				unindex_dead(ARGV[3], msg)
+			end
 			return 1
 		end
 	end
 	return 0
 	`)
-	res, err := script.Run(r.client, []string{zset}, score, id).Result()
+	res, err := script.Run(r.client, []string{zset}, score, id, r.deadPrefixOf(zset)).Result()
 	if err != nil {
 		return err
 	}
@@ -692,19 +1574,34 @@ func (r *RDB) deleteTask(zset, id string, score float64) error {
 	return nil
 }
 
-// DeleteAllDeadTasks deletes all tasks from the dead queue.
+// DeleteAllDeadTasks deletes all tasks from the dead queue, along with
+// the indexes of the dead tasks of the queues.
 func (r *RDB) DeleteAllDeadTasks() error {
-	return r.client.Del(base.DeadQueue).Err()
+	// KEYS[1] -> asynq:dead
+	// ARGV[1] -> r.keys.DeadPrefix
+	script := redis.NewScript(`
+	local deleted = {}
+	for _, msg in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+		local key = ARGV[1] .. cjson.decode(msg)["Queue"]
+		if not deleted[key] then
+			redis.call("DEL", key)
+			deleted[key] = true
+		end
+	end
+	redis.call("DEL", KEYS[1])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.keys.DeadQueue}, r.keys.DeadPrefix).Err()
 }
 
 // DeleteAllRetryTasks deletes all tasks from the dead queue.
 func (r *RDB) DeleteAllRetryTasks() error {
-	return r.client.Del(base.RetryQueue).Err()
+	return r.client.Del(r.keys.RetryQueue).Err()
 }
 
 // DeleteAllScheduledTasks deletes all tasks from the dead queue.
 func (r *RDB) DeleteAllScheduledTasks() error {
-	return r.client.Del(base.ScheduledQueue).Err()
+	return r.client.Del(r.keys.ScheduledQueue).Err()
 }
 
 // ErrQueueNotFound indicates specified queue does not exist.
@@ -739,12 +1636,12 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 		if n == 0 then
 			return redis.error_reply("LIST NOT FOUND")
 		end
-		redis.call("DEL", KEYS[2])
+		redis.call("DEL", KEYS[2], KEYS[3])
 		return redis.status_reply("OK")
 		`)
 	} else {
 		script = redis.NewScript(`
-		local l = redis.call("LLEN", KEYS[2])
+		local l = redis.call("LLEN", KEYS[2]) + redis.call("ZCARD", KEYS[3])
 		if l > 0 then
 			return redis.error_reply("LIST NOT EMPTY")
 		end
@@ -752,12 +1649,12 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 		if n == 0 then
 			return redis.error_reply("LIST NOT FOUND")
 		end
-		redis.call("DEL", KEYS[2])
+		redis.call("DEL", KEYS[2], KEYS[3])
 		return redis.status_reply("OK")
 		`)
 	}
 	err := script.Run(r.client,
-		[]string{base.AllQueues, base.QueueKey(qname)},
+		[]string{r.keys.AllQueues, r.keys.QueueKey(qname), r.keys.PriorityQueueKey(qname)},
 		force).Err()
 	if err != nil {
 		switch err.Error() {
@@ -771,3 +1668,170 @@ func (r *RDB) RemoveQueue(qname string, force bool) error {
 	}
 	return nil
 }
+
+// PauseQueue pauses the processing of the specified queue.
+// Tasks in a paused queue are kept in the queue until the queue is unpaused.
+//
+// The pause state is stored in redis, so that it takes effect on all
+// background instances and persists across restarts.
+func (r *RDB) PauseQueue(qname string) error {
+	return r.client.SAdd(r.keys.PausedQueues, strings.ToLower(qname)).Err()
+}
+
+// UnpauseQueue resumes the processing of the specified queue.
+func (r *RDB) UnpauseQueue(qname string) error {
+	return r.client.SRem(r.keys.PausedQueues, strings.ToLower(qname)).Err()
+}
+
+// PauseAll pauses the processing of all queues, regardless of the queues
+// paused by PauseQueue.
+//
+// Like PauseQueue, it takes effect on all background instances.
+// Tasks which are being processed are not affected.
+func (r *RDB) PauseAll() error {
+	return r.client.Set(r.keys.PausedAll, 1, 0).Err()
+}
+
+// UnpauseAll resumes the processing of the queues paused by PauseAll.
+// Queues paused by PauseQueue remain paused.
+func (r *RDB) UnpauseAll() error {
+	return r.client.Del(r.keys.PausedAll).Err()
+}
+
+// IsPausedAll reports whether the processing of all queues is paused by PauseAll.
+func (r *RDB) IsPausedAll() (bool, error) {
+	n, err := r.client.Exists(r.keys.PausedAll).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ListPausedQueues returns the names of all paused queues, sorted by name.
+func (r *RDB) ListPausedQueues() ([]string, error) {
+	qnames, err := r.client.SMembers(r.keys.PausedQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(qnames)
+	return qnames, nil
+}
+
+// QueueSnapshot is the state of a queue at a certain time, with the number
+// of tasks and a sample of them in each state.
+type QueueSnapshot struct {
+	Queue     string                    `json:"queue"`
+	Paused    bool                      `json:"paused"`
+	Timestamp time.Time                 `json:"timestamp"`
+	States    map[string]*StateSnapshot `json:"states"`
+}
+
+// StateSnapshot is the number of tasks of a queue in a state, e.g. "retry",
+// and a sample of them.
+type StateSnapshot struct {
+	Count int            `json:"count"`
+	Tasks []*TaskSummary `json:"tasks"`
+}
+
+// TaskSummary is a task sampled in a QueueSnapshot.
+type TaskSummary struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// PayloadSize is the size of the JSON encoded payload in bytes.
+	PayloadSize int `json:"payload_size"`
+	// Payload is the JSON encoded payload, truncated to the limit given to
+	// ExportQueueSnapshot. Empty if the payload is redacted.
+	Payload   string     `json:"payload,omitempty"`
+	ProcessAt *time.Time `json:"process_at,omitempty"`
+	ErrorMsg  string     `json:"error_msg,omitempty"`
+	Retried   int        `json:"retried,omitempty"`
+}
+
+// ExportQueueSnapshot returns the JSON encoded QueueSnapshot of the given
+// queue, with up to sampleSize tasks in each of the "enqueued",
+// "in_progress", "scheduled", "retry" and "dead" states.
+//
+// Payloads may contain sensitive data, so they're redacted unless
+// payloadLimit is positive, in which case each payload is included
+// truncated to payloadLimit bytes.
+func (r *RDB) ExportQueueSnapshot(qname string, sampleSize, payloadLimit int) ([]byte, error) {
+	qname = strings.ToLower(qname)
+	paused, err := r.client.SIsMember(r.keys.PausedQueues, qname).Result()
+	if err != nil {
+		return nil, err
+	}
+	snap := &QueueSnapshot{
+		Queue:     qname,
+		Paused:    paused,
+		Timestamp: r.clock.Now().UTC(),
+		States:    make(map[string]*StateSnapshot),
+	}
+	for _, state := range []string{"enqueued", "in_progress", "scheduled", "retry", "dead"} {
+		snap.States[state] = &StateSnapshot{Tasks: []*TaskSummary{}}
+	}
+	add := func(state string, t *TaskSummary, payload map[string]interface{}) {
+		st := snap.States[state]
+		st.Count++
+		if st.Count > sampleSize {
+			return
+		}
+		b, _ := json.Marshal(payload)
+		t.PayloadSize = len(b)
+		if payloadLimit > 0 {
+			if len(b) > payloadLimit {
+				b = b[:payloadLimit]
+			}
+			t.Payload = string(b)
+		}
+		st.Tasks = append(st.Tasks, t)
+	}
+
+	enqueued, err := r.ListEnqueued(qname)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range enqueued {
+		add("enqueued", &TaskSummary{ID: t.ID.String(), Type: t.Type}, t.Payload)
+	}
+	inProgress, err := r.ListInProgress()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range inProgress {
+		if t.Queue == qname {
+			add("in_progress", &TaskSummary{ID: t.ID.String(), Type: t.Type}, t.Payload)
+		}
+	}
+	scheduled, err := r.ListScheduled()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range scheduled {
+		if t.Queue == qname {
+			processAt := t.ProcessAt.UTC()
+			add("scheduled", &TaskSummary{ID: t.ID.String(), Type: t.Type, ProcessAt: &processAt}, t.Payload)
+		}
+	}
+	retry, err := r.ListRetry()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range retry {
+		if t.Queue == qname {
+			processAt := t.ProcessAt.UTC()
+			add("retry", &TaskSummary{ID: t.ID.String(), Type: t.Type, ProcessAt: &processAt,
+				ErrorMsg: t.ErrorMsg, Retried: t.Retried}, t.Payload)
+		}
+	}
+	dead, err := r.ListDead()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range dead {
+		if t.Queue == qname {
+			add("dead", &TaskSummary{ID: t.ID.String(), Type: t.Type,
+				ErrorMsg: t.ErrorMsg, Retried: t.Retried}, t.Payload)
+		}
+	}
+	return json.MarshalIndent(snap, "", "  ")
+}
@@ -5,10 +5,13 @@
 package rdb
 
 import (
+	"context"
+	"encoding/json"
 	"sort"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
@@ -197,6 +200,99 @@ func TestHistoricalStats(t *testing.T) {
 
 }
 
+func TestMemoryUsage(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessageWithQueue("gen_thumbnail", map[string]interface{}{"src": "some/path/to/img"}, "critical")
+	m3.Priority = 3
+	m4 := h.NewTaskMessage("sync", nil)
+	m5 := h.NewTaskMessage("import", nil)
+	now := time.Now()
+	size := func(msgs ...*base.TaskMessage) int64 {
+		var n int64
+		for _, msg := range msgs {
+			n += int64(len(h.MustMarshal(t, msg)))
+		}
+		return n
+	}
+
+	tests := []struct {
+		enqueued   []*base.TaskMessage
+		priority   []h.ZSetEntry // initial state of the priority queue of "critical"
+		inProgress []*base.TaskMessage
+		scheduled  []h.ZSetEntry
+		retry      []h.ZSetEntry
+		dead       []h.ZSetEntry
+		want       *MemoryUsage // with approximate values
+	}{
+		{
+			enqueued:   []*base.TaskMessage{m1},
+			priority:   []h.ZSetEntry{{Msg: m3, Score: priorityScore(m3.Priority, now)}},
+			inProgress: []*base.TaskMessage{m2},
+			scheduled:  []h.ZSetEntry{{Msg: m4, Score: float64(now.Add(time.Hour).Unix())}},
+			retry:      []h.ZSetEntry{},
+			dead:       []h.ZSetEntry{{Msg: m5, Score: float64(now.Unix())}},
+			want: &MemoryUsage{
+				Enqueued:   size(m1, m3),
+				InProgress: size(m2),
+				Scheduled:  size(m4),
+				Retry:      0,
+				Dead:       size(m5),
+			},
+		},
+		{
+			enqueued:   []*base.TaskMessage{},
+			inProgress: []*base.TaskMessage{},
+			scheduled:  []h.ZSetEntry{},
+			retry:      []h.ZSetEntry{},
+			dead:       []h.ZSetEntry{},
+			want:       &MemoryUsage{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
+		h.SeedPriorityQueue(t, r.client, tc.priority, "critical")
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedScheduledQueue(t, r.client, tc.scheduled)
+		h.SeedRetryQueue(t, r.client, tc.retry)
+		h.SeedDeadQueue(t, r.client, tc.dead)
+
+		got, err := r.MemoryUsage()
+		if err != nil {
+			t.Errorf("r.MemoryUsage() returned error: %v", err)
+			continue
+		}
+		if got.Approximate {
+			// The redis server does not support MEMORY USAGE command.
+			want := *tc.want
+			want.Approximate = true
+			if diff := cmp.Diff(&want, got); diff != "" {
+				t.Errorf("r.MemoryUsage() = %+v, want %+v; (-want, +got)\n%s", got, &want, diff)
+			}
+			continue
+		}
+		// Memory used by a key should be no less than the size of its data.
+		checks := []struct {
+			name      string
+			got, want int64
+		}{
+			{"Enqueued", got.Enqueued, tc.want.Enqueued},
+			{"InProgress", got.InProgress, tc.want.InProgress},
+			{"Scheduled", got.Scheduled, tc.want.Scheduled},
+			{"Retry", got.Retry, tc.want.Retry},
+			{"Dead", got.Dead, tc.want.Dead},
+		}
+		for _, c := range checks {
+			if c.got < c.want || (c.want == 0 && c.got != 0) {
+				t.Errorf("r.MemoryUsage().%s = %d, want %d or larger (zero if empty)", c.name, c.got, c.want)
+			}
+		}
+	}
+}
+
 func TestRedisInfo(t *testing.T) {
 	r := setup(t)
 
@@ -305,13 +401,275 @@ func TestListEnqueued(t *testing.T) {
 	}
 }
 
+func TestGetTaskInfo(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": "42"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Priority = 3
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m4 := h.NewTaskMessage("sync", nil)
+	m5 := h.NewTaskMessage("export_csv", nil)
+	m5.FailedAt = time.Now().Add(-time.Minute).Unix()
+	m6 := h.NewTaskMessage("import_csv", nil)
+	m7 := h.NewTaskMessage("resize", nil)
+	m8 := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	processAt := time.Now().Add(time.Hour)
+	diedAt := time.Now().Add(-time.Hour)
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1})
+	h.SeedPriorityQueue(t, r.client, []h.ZSetEntry{{Msg: m2, Score: 1}}, base.DefaultQueueName)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m3})
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: m4, Score: float64(processAt.Unix())}})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m5, Score: float64(processAt.Unix())}})
+	h.SeedDeadQueue(t, r.client, []h.ZSetEntry{{Msg: m6, Score: float64(diedAt.Unix())}})
+	if err := r.ExtendLease("server-1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{m7}, "server-1")
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m8}, "critical")
+
+	tests := []struct {
+		msg  *base.TaskMessage
+		want *TaskInfo
+	}{
+		{m1, &TaskInfo{State: "enqueued", Message: m1, Payload: m1.Payload}},
+		{m2, &TaskInfo{State: "enqueued", Message: m2, Payload: m2.Payload}},
+		{m3, &TaskInfo{State: "inprogress", Message: m3, Payload: m3.Payload}},
+		{m7, &TaskInfo{State: "inprogress", Message: m7, Payload: m7.Payload}},
+		{m4, &TaskInfo{State: "scheduled", Message: m4, Payload: m4.Payload,
+			ProcessAt: time.Unix(processAt.Unix(), 0)}},
+		{m5, &TaskInfo{State: "retry", Message: m5, Payload: m5.Payload,
+			ProcessAt: time.Unix(processAt.Unix(), 0), LastFailedAt: time.Unix(m5.FailedAt, 0)}},
+		{m6, &TaskInfo{State: "dead", Message: m6, Payload: m6.Payload,
+			LastFailedAt: time.Unix(diedAt.Unix(), 0)}},
+	}
+
+	for _, tc := range tests {
+		got, err := r.GetTaskInfo(tc.msg.Queue, tc.msg.ID)
+		if err != nil {
+			t.Errorf("r.GetTaskInfo(%q, %v) = _, %v, want nil", tc.msg.Queue, tc.msg.ID, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("r.GetTaskInfo(%q, %v) = %+v, want %+v; (-want,+got)\n%s",
+				tc.msg.Queue, tc.msg.ID, got, tc.want, diff)
+		}
+	}
+
+	// m8 is in another queue.
+	if _, err := r.GetTaskInfo(base.DefaultQueueName, m8.ID); err != ErrTaskNotFound {
+		t.Errorf("r.GetTaskInfo(%q, %v) = _, %v, want %v", base.DefaultQueueName, m8.ID, err, ErrTaskNotFound)
+	}
+	if _, err := r.GetTaskInfo(base.DefaultQueueName, xid.New()); err != ErrTaskNotFound {
+		t.Errorf("r.GetTaskInfo() with unknown id = _, %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestGetTaskInfoScansInChunks(t *testing.T) {
+	r := setup(t)
+	var enqueued []*base.TaskMessage
+	var dead []h.ZSetEntry
+	for i := 0; i < 2*getTaskInfoChunk+1; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("send_email", nil))
+		dead = append(dead, h.ZSetEntry{Msg: h.NewTaskMessage("export_csv", nil), Score: float64(i)})
+	}
+	h.SeedEnqueuedQueue(t, r.client, enqueued)
+	h.SeedDeadQueue(t, r.client, dead)
+
+	// The first tasks seeded are at the end of the list and the sorted set.
+	for _, tc := range []struct {
+		msg   *base.TaskMessage
+		state string
+	}{
+		{enqueued[0], "enqueued"},
+		{dead[0].Msg, "dead"},
+		{dead[len(dead)-1].Msg, "dead"},
+	} {
+		got, err := r.GetTaskInfo(base.DefaultQueueName, tc.msg.ID)
+		if err != nil {
+			t.Errorf("r.GetTaskInfo(%q, %v) returned error: %v", base.DefaultQueueName, tc.msg.ID, err)
+			continue
+		}
+		if got.State != tc.state || got.Message.ID != tc.msg.ID {
+			t.Errorf("r.GetTaskInfo(%q, %v) = %s task %v, want %s task %v", base.DefaultQueueName, tc.msg.ID, got.State, got.Message.ID, tc.state, tc.msg.ID)
+		}
+	}
+	if _, err := r.GetTaskInfo(base.DefaultQueueName, xid.New()); err != ErrTaskNotFound {
+		t.Errorf("r.GetTaskInfo with an unknown id returned error %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestPeekPending(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": "42"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m3.Priority = 3
+	m4 := h.NewTaskMessage("sync", nil)
+	m4.Priority = 5
+	m5 := h.NewTaskMessage("export_csv", nil)
+
+	tests := []struct {
+		desc     string
+		enqueued []*base.TaskMessage
+		priority []h.ZSetEntry
+		handoff  []*base.TaskMessage
+		want     *base.TaskMessage // nil if the queue is empty
+	}{
+		{
+			desc: "empty queue",
+			want: nil,
+		},
+		{
+			desc:     "oldest task first",
+			enqueued: []*base.TaskMessage{m1, m2},
+			want:     m1,
+		},
+		{
+			desc:     "tasks with a priority first",
+			enqueued: []*base.TaskMessage{m1, m2},
+			priority: []h.ZSetEntry{{Msg: m3, Score: 2}, {Msg: m4, Score: 1}},
+			want:     m4,
+		},
+		{
+			desc:     "handed off tasks first",
+			enqueued: []*base.TaskMessage{m1},
+			priority: []h.ZSetEntry{{Msg: m4, Score: 1}},
+			handoff:  []*base.TaskMessage{m5},
+			want:     m5,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
+		h.SeedPriorityQueue(t, r.client, tc.priority, base.DefaultQueueName)
+		for _, msg := range tc.handoff {
+			if err := r.client.LPush(base.HandoffKey(base.DefaultQueueName), h.MustMarshal(t, msg)).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := r.PeekPending("Default")
+		if tc.want == nil {
+			if err != ErrQueueEmpty {
+				t.Errorf("%s: PeekPending = %v, %v; want ErrQueueEmpty", tc.desc, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: PeekPending returned error: %v", tc.desc, err)
+			continue
+		}
+		want := &TaskInfo{State: "enqueued", Message: tc.want, Payload: tc.want.Payload}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: mismatch found in PeekPending; (-want,+got)\n%s", tc.desc, diff)
+		}
+		// peeking doesn't remove the task.
+		if diff := cmp.Diff(tc.enqueued, h.GetEnqueuedMessages(t, r.client), h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want,+got)\n%s", tc.desc, base.DefaultQueue, diff)
+		}
+		var wantPriority []*base.TaskMessage
+		for _, e := range tc.priority {
+			wantPriority = append(wantPriority, e.Msg)
+		}
+		if diff := cmp.Diff(wantPriority, h.GetPriorityMessages(t, r.client, base.DefaultQueueName), h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want,+got)\n%s", tc.desc, base.PriorityQueueKey(base.DefaultQueueName), diff)
+		}
+		if diff := cmp.Diff(tc.handoff, h.GetHandoffMessages(t, r.client, base.DefaultQueueName), h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want,+got)\n%s", tc.desc, base.HandoffKey(base.DefaultQueueName), diff)
+		}
+	}
+}
+
+func TestStreamDeadTasks(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := h.NewTaskMessage("reindex", nil)
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1, m2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := r.StreamDeadTasks(ctx)
+	if err != nil {
+		t.Fatalf("r.StreamDeadTasks() = _, %v, want nil", err)
+	}
+
+	for _, msg := range []*base.TaskMessage{m1, m2} {
+		if err := r.Kill(msg, "something went wrong", "server1", 0); err != nil {
+			t.Fatalf("r.Kill(%v) = %v, want nil", msg, err)
+		}
+	}
+	for _, want := range []*base.TaskMessage{m1, m2} {
+		select {
+		case got := <-ch:
+			if got.State != "dead" || got.Message.ID != want.ID || got.Message.ErrorMsg != "something went wrong" {
+				t.Errorf("streamed %+v, want the killed task %v", got, want.ID)
+			}
+			if diff := cmp.Diff(want.Payload, got.Payload); diff != "" {
+				t.Errorf("payload of streamed task mismatch; (-want,+got)\n%s", diff)
+			}
+			if got.LastFailedAt.IsZero() {
+				t.Errorf("LastFailedAt of streamed task is zero, want the time it was killed")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for killed task %v on the stream", want.ID)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Errorf("received a task after canceling the context, want the channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("channel not closed after canceling the context")
+	}
+}
+
+func TestCancelByType(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("export_csv", nil)
+	m2 := h.NewTaskMessage("export_csv", nil)
+	m3 := h.NewTaskMessage("send_email", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1, m3})
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{m2}, "server1")
+	r.client.ZAdd(base.Servers, &redis.Z{Member: "server1", Score: float64(time.Now().Add(time.Minute).Unix())})
+
+	// no background receives the cancelation.
+	if n, err := r.CancelByType("export_csv"); err != nil || n != 0 {
+		t.Fatalf("(*RDB).CancelByType(%q) = %d, %v without subscribers, want 0, nil", "export_csv", n, err)
+	}
+
+	pubsub, err := r.CancelationPubSub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub.Close()
+
+	n, err := r.CancelByType("export_csv")
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).CancelByType(%q) = %d, %v, want 2, nil", "export_csv", n, err)
+	}
+	select {
+	case msg := <-pubsub.Channel():
+		if msg.Payload != "export_csv" {
+			t.Errorf("cancelation published %q, want %q", msg.Payload, "export_csv")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("cancelation was not published")
+	}
+}
+
 func TestListInProgress(t *testing.T) {
 	r := setup(t)
 
 	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
 	m2 := h.NewTaskMessage("reindex", nil)
-	t1 := &InProgressTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload}
-	t2 := &InProgressTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload}
+	t1 := &InProgressTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload, Queue: m1.Queue}
+	t2 := &InProgressTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload, Queue: m2.Queue}
 	tests := []struct {
 		inProgress []*base.TaskMessage
 		want       []*InProgressTask
@@ -349,6 +707,178 @@ func TestListInProgress(t *testing.T) {
 	}
 }
 
+func TestListStuckTasks(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now.Add(-time.Hour))
+	r.SetClock(clock)
+
+	m1 := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	m2 := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	m3 := h.NewTaskMessage("reindex", nil)
+	m4 := h.NewTaskMessage("gen_thumbnail", nil) // start time not recorded
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m1, m2, m3, m4})
+	if err := r.MarkStarted(m1, m3); err != nil {
+		t.Fatal(err)
+	}
+	clock.SetTime(now)
+	if err := r.MarkStarted(m2); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qname     string
+		olderThan time.Duration
+		want      []xid.ID
+	}{
+		{"critical", 30 * time.Minute, []xid.ID{m1.ID}},
+		{"CRITICAL", 30 * time.Minute, []xid.ID{m1.ID}},
+		{"", 30 * time.Minute, []xid.ID{m1.ID, m3.ID}},
+		{"critical", 0, []xid.ID{m1.ID, m2.ID}},
+		{"low", 0, nil},
+	}
+	sortIDs := cmp.Transformer("SortIDs", func(in []xid.ID) []string {
+		var out []string
+		for _, id := range in {
+			out = append(out, id.String())
+		}
+		sort.Strings(out)
+		return out
+	})
+	for _, tc := range tests {
+		got, err := r.ListStuckTasks(tc.qname, tc.olderThan)
+		if err != nil {
+			t.Errorf("r.ListStuckTasks(%q, %v) returned error: %v", tc.qname, tc.olderThan, err)
+			continue
+		}
+		var gotIDs []xid.ID
+		for _, task := range got {
+			gotIDs = append(gotIDs, task.ID)
+		}
+		if diff := cmp.Diff(tc.want, gotIDs, sortIDs); diff != "" {
+			t.Errorf("r.ListStuckTasks(%q, %v) mismatch; (-want,+got)\n%s", tc.qname, tc.olderThan, diff)
+		}
+	}
+
+	got, err := r.ListStuckTasks("critical", 30*time.Minute)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("r.ListStuckTasks = %v, %v; want 1 task", got, err)
+	}
+	if want := now.Add(-time.Hour).Unix(); got[0].StartedAt.Unix() != want || got[0].Queue != "critical" {
+		t.Errorf("stuck task = %+v, want started at %v in %q queue", got[0], time.Unix(want, 0), "critical")
+	}
+
+	if err := r.ClearStarted(m1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.ListStuckTasks("critical", 30*time.Minute); err != nil || len(got) != 0 {
+		t.Errorf("r.ListStuckTasks after ClearStarted = %v, %v; want none", got, err)
+	}
+}
+
+func TestExportQueueSnapshot(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "user@example.com"})
+	m2 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "admin@example.com"})
+	m3 := h.NewTaskMessage("reindex", nil)
+	m4 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	m5 := h.NewTaskMessage("gen_thumbnail", nil)
+	m5.ErrorMsg = "connection timeout"
+	m5.Retried = 2
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m4}, "low")
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{m3, m4})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{{Msg: m5, Score: float64(time.Now().Add(time.Minute).Unix())}})
+	if err := r.PauseQueue("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc         string
+		sampleSize   int
+		payloadLimit int
+		wantCounts   map[string]int
+		wantSampled  map[string]int
+		wantPayload  string
+	}{
+		{
+			desc:         "bounded sample",
+			sampleSize:   1,
+			payloadLimit: 0,
+			wantCounts:   map[string]int{"enqueued": 2, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantSampled:  map[string]int{"enqueued": 1, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantPayload:  "",
+		},
+		{
+			desc:         "redacted payloads",
+			sampleSize:   10,
+			payloadLimit: 0,
+			wantCounts:   map[string]int{"enqueued": 2, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantSampled:  map[string]int{"enqueued": 2, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantPayload:  "",
+		},
+		{
+			desc:         "truncated payloads",
+			sampleSize:   10,
+			payloadLimit: 8,
+			wantCounts:   map[string]int{"enqueued": 2, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantSampled:  map[string]int{"enqueued": 2, "in_progress": 1, "scheduled": 0, "retry": 1, "dead": 0},
+			wantPayload:  `{"to":"u`,
+		},
+	}
+
+	for _, tc := range tests {
+		data, err := r.ExportQueueSnapshot("default", tc.sampleSize, tc.payloadLimit)
+		if err != nil {
+			t.Errorf("%s: r.ExportQueueSnapshot returned error: %v", tc.desc, err)
+			continue
+		}
+		var got struct {
+			Queue  string `json:"queue"`
+			Paused bool   `json:"paused"`
+			States map[string]struct {
+				Count int                      `json:"count"`
+				Tasks []map[string]interface{} `json:"tasks"`
+			} `json:"states"`
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Errorf("%s: r.ExportQueueSnapshot returned invalid JSON: %v", tc.desc, err)
+			continue
+		}
+		if got.Queue != "default" || !got.Paused {
+			t.Errorf("%s: snapshot of queue %q (paused: %t), want %q (paused: true)", tc.desc, got.Queue, got.Paused, "default")
+		}
+		gotCounts := make(map[string]int)
+		gotSampled := make(map[string]int)
+		for state, st := range got.States {
+			gotCounts[state] = st.Count
+			gotSampled[state] = len(st.Tasks)
+		}
+		if diff := cmp.Diff(tc.wantCounts, gotCounts); diff != "" {
+			t.Errorf("%s: mismatch found in counts; (-want,+got)\n%s", tc.desc, diff)
+		}
+		if diff := cmp.Diff(tc.wantSampled, gotSampled); diff != "" {
+			t.Errorf("%s: mismatch found in sampled tasks; (-want,+got)\n%s", tc.desc, diff)
+		}
+
+		for _, task := range got.States["enqueued"].Tasks {
+			if task["id"] != m1.ID.String() {
+				continue
+			}
+			if task["type"] != m1.Type || task["payload_size"] != float64(len(`{"to":"user@example.com"}`)) {
+				t.Errorf("%s: enqueued task = %v, want summary of %+v", tc.desc, task, m1)
+			}
+			if payload, _ := task["payload"].(string); payload != tc.wantPayload {
+				t.Errorf("%s: payload = %q, want %q", tc.desc, payload, tc.wantPayload)
+			}
+		}
+		retried := got.States["retry"].Tasks[0]
+		if retried["error_msg"] != m5.ErrorMsg || retried["retried"] != float64(m5.Retried) || retried["process_at"] == nil {
+			t.Errorf("%s: retry task = %v, want error message, retried count and process time of %+v", tc.desc, retried, m5)
+		}
+	}
+}
+
 func TestListScheduled(t *testing.T) {
 	r := setup(t)
 	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
@@ -398,6 +928,57 @@ func TestListScheduled(t *testing.T) {
 	}
 }
 
+func TestListWaiting(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	m1.DependsOn = "db7ood38di1fg7jvnddg"
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.DependsOn = m1.ID.String()
+	e1 := time.Now().Add(time.Hour)
+	e2 := time.Now().Add(24 * time.Hour)
+	t1 := &WaitingTask{ID: m1.ID, Type: m1.Type, Payload: m1.Payload, Queue: m1.Queue, DependsOn: m1.DependsOn, ExpireAt: e1, Score: e1.Unix()}
+	t2 := &WaitingTask{ID: m2.ID, Type: m2.Type, Payload: m2.Payload, Queue: m2.Queue, DependsOn: m2.DependsOn, ExpireAt: e2, Score: e2.Unix()}
+
+	tests := []struct {
+		waiting []h.ZSetEntry
+		want    []*WaitingTask
+	}{
+		{
+			waiting: []h.ZSetEntry{
+				{Msg: m1, Score: float64(e1.Unix())},
+				{Msg: m2, Score: float64(e2.Unix())},
+			},
+			want: []*WaitingTask{t1, t2},
+		},
+		{
+			waiting: []h.ZSetEntry{},
+			want:    []*WaitingTask{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedWaitingTasks(t, r.client, tc.waiting)
+
+		got, err := r.ListWaiting()
+		if err != nil {
+			t.Errorf("r.ListWaiting() = %v, %v, want %v, nil", got, err, tc.want)
+			continue
+		}
+		sortOpt := cmp.Transformer("SortMsg", func(in []*WaitingTask) []*WaitingTask {
+			out := append([]*WaitingTask(nil), in...) // Copy input to avoid mutating it
+			sort.Slice(out, func(i, j int) bool {
+				return out[i].ID.String() < out[j].ID.String()
+			})
+			return out
+		})
+		if diff := cmp.Diff(tc.want, got, sortOpt, timeCmpOpt); diff != "" {
+			t.Errorf("r.ListWaiting() = %v, %v, want %v, nil; (-want, +got)\n%s", got, err, tc.want, diff)
+			continue
+		}
+	}
+}
+
 func TestListRetry(t *testing.T) {
 	r := setup(t)
 	m1 := &base.TaskMessage{
@@ -408,6 +989,7 @@ func TestListRetry(t *testing.T) {
 		ErrorMsg: "email server not responding",
 		Retry:    25,
 		Retried:  10,
+		FailedAt: time.Now().Add(-time.Minute).Unix(),
 	}
 	m2 := &base.TaskMessage{
 		ID:       xid.New(),
@@ -421,15 +1003,17 @@ func TestListRetry(t *testing.T) {
 	p1 := time.Now().Add(5 * time.Minute)
 	p2 := time.Now().Add(24 * time.Hour)
 	t1 := &RetryTask{
-		ID:        m1.ID,
-		Type:      m1.Type,
-		Payload:   m1.Payload,
-		ProcessAt: p1,
-		ErrorMsg:  m1.ErrorMsg,
-		Retried:   m1.Retried,
-		Retry:     m1.Retry,
-		Score:     p1.Unix(),
-		Queue:     m1.Queue,
+		ID:           m1.ID,
+		Type:         m1.Type,
+		Payload:      m1.Payload,
+		LastFailedAt: time.Unix(m1.FailedAt, 0),
+		Delay:        time.Duration(p1.Unix()-m1.FailedAt) * time.Second,
+		ProcessAt:    p1,
+		ErrorMsg:     m1.ErrorMsg,
+		Retried:      m1.Retried,
+		Retry:        m1.Retry,
+		Score:        p1.Unix(),
+		Queue:        m1.Queue,
 	}
 	t2 := &RetryTask{
 		ID:        m2.ID,
@@ -815,6 +1399,82 @@ func TestEnqueueScheduledTask(t *testing.T) {
 	}
 }
 
+func TestRescheduleScheduledTask(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("gen_thumbnail", nil)
+	s1 := time.Now().Add(5 * time.Minute).Unix()
+	s2 := time.Now().Add(time.Hour).Unix()
+	newTime := time.Now().Add(24 * time.Hour)
+
+	tests := []struct {
+		scheduled     []h.ZSetEntry
+		score         int64
+		id            xid.ID
+		processAt     time.Time
+		want          error // expected return value from calling RescheduleScheduledTask
+		wantScheduled []h.ZSetEntry
+	}{
+		{
+			scheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+				{Msg: t2, Score: float64(s2)},
+			},
+			score:     s2,
+			id:        t2.ID,
+			processAt: newTime,
+			want:      nil,
+			wantScheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+				{Msg: t2, Score: float64(newTime.Unix())},
+			},
+		},
+		{
+			scheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+				{Msg: t2, Score: float64(s2)},
+			},
+			score:     123,
+			id:        t2.ID,
+			processAt: newTime,
+			want:      ErrTaskNotFound,
+			wantScheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+				{Msg: t2, Score: float64(s2)},
+			},
+		},
+		{
+			// task is no longer scheduled (e.g. already enqueued).
+			scheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+			},
+			score:     s2,
+			id:        t2.ID,
+			processAt: newTime,
+			want:      ErrTaskNotFound,
+			wantScheduled: []h.ZSetEntry{
+				{Msg: t1, Score: float64(s1)},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedScheduledQueue(t, r.client, tc.scheduled)
+
+		got := r.RescheduleScheduledTask(tc.id, tc.score, tc.processAt)
+		if got != tc.want {
+			t.Errorf("r.RescheduleScheduledTask(%s, %d, %v) = %v, want %v", tc.id, tc.score, tc.processAt, got, tc.want)
+			continue
+		}
+
+		gotScheduled := h.GetScheduledEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q, (-want, +got)\n%s", base.ScheduledQueue, diff)
+		}
+	}
+}
+
 func TestEnqueueAllScheduledTasks(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -973,6 +1633,40 @@ func TestEnqueueAllRetryTasks(t *testing.T) {
 	}
 }
 
+func TestEnqueueRetryTasksInQueue(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("important_notification", nil, "critical")
+	t3 := h.NewTaskMessageWithQueue("important_notification", nil, "critical")
+	t3.Priority = 3
+	t4 := h.NewTaskMessageWithQueue("minor_notification", nil, "low")
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t1, Score: float64(time.Now().Add(time.Hour).Unix())},
+		{Msg: t2, Score: float64(time.Now().Add(time.Hour).Unix())},
+		{Msg: t3, Score: float64(time.Now().Add(2 * time.Hour).Unix())},
+		{Msg: t4, Score: float64(time.Now().Add(time.Hour).Unix())},
+	})
+
+	got, err := r.EnqueueRetryTasksInQueue("critical")
+	if err != nil || got != 2 {
+		t.Fatalf("r.EnqueueRetryTasksInQueue(%q) = %v, %v; want 2, nil", "critical", got, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, h.GetEnqueuedMessages(t, r.client, "critical")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey("critical"), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t3}, h.GetPriorityMessages(t, r.client, "critical")); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.PriorityQueueKey("critical"), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1, t4}, h.GetRetryMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+
+	// No task of the queue is left in retry queue.
+	if got, err := r.EnqueueRetryTasksInQueue("critical"); err != nil || got != 0 {
+		t.Errorf("second r.EnqueueRetryTasksInQueue(%q) = %v, %v; want 0, nil", "critical", got, err)
+	}
+}
+
 func TestEnqueueAllDeadTasks(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
@@ -1052,6 +1746,100 @@ func TestEnqueueAllDeadTasks(t *testing.T) {
 	}
 }
 
+func TestEnqueueDeadTasksWhere(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("gen_thumbnail", nil)
+	t3 := h.NewTaskMessage("send_email", nil)
+	t4 := h.NewTaskMessage("send_email", nil)
+	t4.Queue = "critical"
+	hourAgo := time.Now().Add(-time.Hour)
+	minuteAgo := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		desc         string
+		dead         []h.ZSetEntry
+		predicate    func(t *DeadTask) bool
+		want         int64
+		wantEnqueued map[string][]*base.TaskMessage
+		wantDead     []*base.TaskMessage
+	}{
+		{
+			desc: "filter by type",
+			dead: []h.ZSetEntry{
+				{Msg: t1, Score: float64(minuteAgo.Unix())},
+				{Msg: t2, Score: float64(minuteAgo.Unix())},
+				{Msg: t3, Score: float64(hourAgo.Unix())},
+				{Msg: t4, Score: float64(minuteAgo.Unix())},
+			},
+			predicate: func(t *DeadTask) bool { return t.Type == "send_email" },
+			want:      3,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1, t3},
+				"critical":            {t4},
+			},
+			wantDead: []*base.TaskMessage{t2},
+		},
+		{
+			desc: "filter by type and time of failure",
+			dead: []h.ZSetEntry{
+				{Msg: t1, Score: float64(minuteAgo.Unix())},
+				{Msg: t2, Score: float64(minuteAgo.Unix())},
+				{Msg: t3, Score: float64(hourAgo.Unix())},
+			},
+			predicate: func(t *DeadTask) bool {
+				return t.Type == "send_email" && t.LastFailedAt.After(hourAgo.Add(time.Minute))
+			},
+			want: 1,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {t1},
+			},
+			wantDead: []*base.TaskMessage{t2, t3},
+		},
+		{
+			desc: "with no matching tasks",
+			dead: []h.ZSetEntry{
+				{Msg: t2, Score: float64(minuteAgo.Unix())},
+			},
+			predicate: func(t *DeadTask) bool { return t.Type == "send_email" },
+			want:      0,
+			wantEnqueued: map[string][]*base.TaskMessage{
+				base.DefaultQueueName: {},
+			},
+			wantDead: []*base.TaskMessage{t2},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedDeadQueue(t, r.client, tc.dead)
+
+		got, err := r.EnqueueDeadTasksWhere(tc.predicate)
+		if err != nil || got != tc.want {
+			t.Errorf("%s; r.EnqueueDeadTasksWhere = %v, %v; want %v, nil",
+				tc.desc, got, err, tc.want)
+			continue
+		}
+
+		for qname, want := range tc.wantEnqueued {
+			gotEnqueued := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, gotEnqueued, h.SortMsgOpt); diff != "" {
+				t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, base.QueueKey(qname), diff)
+			}
+		}
+		gotDead := h.GetDeadMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s; mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DeadQueue, diff)
+		}
+
+		// Calling it again should not enqueue the tasks twice.
+		got, err = r.EnqueueDeadTasksWhere(tc.predicate)
+		if err != nil || got != 0 {
+			t.Errorf("%s; second r.EnqueueDeadTasksWhere = %v, %v; want 0, nil", tc.desc, got, err)
+		}
+	}
+}
+
 func TestKillRetryTask(t *testing.T) {
 	r := setup(t)
 	m1 := h.NewTaskMessage("send_email", nil)
@@ -1534,6 +2322,173 @@ func TestDeleteScheduledTask(t *testing.T) {
 	}
 }
 
+func TestDeleteEnqueuedTask(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessageWithQueue("gen_thumbnail", nil, "critical")
+	m3.Priority = 5
+
+	tests := []struct {
+		enqueued       []*base.TaskMessage
+		priority       []h.ZSetEntry // initial state of the priority queue of "critical"
+		inProgress     []*base.TaskMessage
+		qname          string
+		id             xid.ID
+		want           error
+		wantEnqueued   []*base.TaskMessage
+		wantPriority   []*base.TaskMessage
+		wantInProgress []*base.TaskMessage
+	}{
+		{
+			enqueued:       []*base.TaskMessage{m1, m2},
+			qname:          "default",
+			id:             m1.ID,
+			want:           nil,
+			wantEnqueued:   []*base.TaskMessage{m2},
+			wantInProgress: []*base.TaskMessage{},
+		},
+		{
+			priority:       []h.ZSetEntry{{Msg: m3, Score: priorityScore(m3.Priority, time.Now())}},
+			qname:          "critical",
+			id:             m3.ID,
+			want:           nil,
+			wantPriority:   []*base.TaskMessage{},
+			wantInProgress: []*base.TaskMessage{},
+		},
+		{
+			// task has already been dequeued for processing.
+			enqueued:       []*base.TaskMessage{m2},
+			inProgress:     []*base.TaskMessage{m1},
+			qname:          "default",
+			id:             m1.ID,
+			want:           ErrTaskNotFound,
+			wantEnqueued:   []*base.TaskMessage{m2},
+			wantInProgress: []*base.TaskMessage{m1},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued, tc.qname)
+		h.SeedPriorityQueue(t, r.client, tc.priority, "critical")
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+
+		got := r.DeleteEnqueuedTask(tc.qname, tc.id)
+		if got != tc.want {
+			t.Errorf("r.DeleteEnqueuedTask(%q, %v) = %v, want %v", tc.qname, tc.id, got, tc.want)
+			continue
+		}
+
+		gotEnqueued := h.GetEnqueuedMessages(t, r.client, tc.qname)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(tc.qname), diff)
+		}
+		gotPriority := h.GetPriorityMessages(t, r.client, "critical")
+		if diff := cmp.Diff(tc.wantPriority, gotPriority, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.PriorityQueueKey("critical"), diff)
+		}
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+		}
+	}
+}
+
+func TestMoveEnqueuedTask(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m3 := h.NewTaskMessageWithQueue("gen_thumbnail", nil, "critical")
+	m3.Priority = 5
+
+	tests := []struct {
+		enqueued       []*base.TaskMessage
+		priority       []h.ZSetEntry // initial state of the priority queue of "critical"
+		inProgress     []*base.TaskMessage
+		from           string
+		to             string
+		id             xid.ID
+		want           error
+		wantEnqueued   []*base.TaskMessage // final state of the source queue
+		wantInProgress []*base.TaskMessage
+		wantMoved      *base.TaskMessage // task dequeued from the destination queue; nil if none
+	}{
+		{
+			enqueued:       []*base.TaskMessage{m1, m2},
+			from:           "default",
+			to:             "low",
+			id:             m1.ID,
+			want:           nil,
+			wantEnqueued:   []*base.TaskMessage{m2},
+			wantInProgress: []*base.TaskMessage{},
+			wantMoved:      &base.TaskMessage{ID: m1.ID, Type: m1.Type, Queue: "low", Retry: m1.Retry},
+		},
+		{
+			priority:       []h.ZSetEntry{{Msg: m3, Score: priorityScore(m3.Priority, time.Now())}},
+			from:           "critical",
+			to:             "Low",
+			id:             m3.ID,
+			want:           nil,
+			wantEnqueued:   []*base.TaskMessage{},
+			wantInProgress: []*base.TaskMessage{},
+			wantMoved:      &base.TaskMessage{ID: m3.ID, Type: m3.Type, Queue: "low", Retry: m3.Retry, Priority: 5},
+		},
+		{
+			// task has already been dequeued for processing.
+			enqueued:       []*base.TaskMessage{m2},
+			inProgress:     []*base.TaskMessage{m1},
+			from:           "default",
+			to:             "low",
+			id:             m1.ID,
+			want:           ErrTaskNotFound,
+			wantEnqueued:   []*base.TaskMessage{m2},
+			wantInProgress: []*base.TaskMessage{m1},
+			wantMoved:      nil,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued, tc.from)
+		h.SeedPriorityQueue(t, r.client, tc.priority, "critical")
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+
+		got := r.MoveEnqueuedTask(tc.id, tc.from, tc.to)
+		if got != tc.want {
+			t.Errorf("r.MoveEnqueuedTask(%v, %q, %q) = %v, want %v", tc.id, tc.from, tc.to, got, tc.want)
+			continue
+		}
+
+		gotEnqueued := h.GetEnqueuedMessages(t, r.client, tc.from)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.QueueKey(tc.from), diff)
+		}
+		if n := len(h.GetPriorityMessages(t, r.client, tc.from)); n != 0 {
+			t.Errorf("%q has %d tasks, want 0", base.PriorityQueueKey(tc.from), n)
+		}
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+		}
+
+		gotMoved, err := r.Dequeue(tc.to)
+		if tc.wantMoved == nil {
+			if err != ErrNoProcessableTask {
+				t.Errorf("r.Dequeue(%q) = %v, %v; want nil, %v", tc.to, gotMoved, err, ErrNoProcessableTask)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("r.Dequeue(%q) returned error: %v", tc.to, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.wantMoved, gotMoved); diff != "" {
+			t.Errorf("r.Dequeue(%q) returned %+v; want %+v\n(-want, +got)\n%s", tc.to, gotMoved, tc.wantMoved, diff)
+		}
+	}
+}
+
 func TestDeleteAllDeadTasks(t *testing.T) {
 	r := setup(t)
 	m1 := h.NewTaskMessage("send_email", nil)
@@ -1767,3 +2722,90 @@ func TestRemoveQueueError(t *testing.T) {
 		}
 	}
 }
+
+func TestPauseQueue(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("gen_thumbnail", nil, "critical")
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t2}, "critical")
+
+	if err := r.PauseQueue("Critical"); err != nil {
+		t.Fatalf("(*RDB).PauseQueue(%q) = %v, want nil", "Critical", err)
+	}
+	if err := r.PauseQueue("low"); err != nil {
+		t.Fatalf("(*RDB).PauseQueue(%q) = %v, want nil", "low", err)
+	}
+
+	got, err := r.ListPausedQueues()
+	if err != nil {
+		t.Fatalf("(*RDB).ListPausedQueues() returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"critical", "low"}, got); diff != "" {
+		t.Errorf("(*RDB).ListPausedQueues() = %v; (-want,+got)\n%s", got, diff)
+	}
+
+	// paused queue should be skipped.
+	msg, err := r.Dequeue("critical", "default")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+	}
+	if diff := cmp.Diff(t1, msg); diff != "" {
+		t.Errorf("(*RDB).Dequeue() = %v, want %v; (-want,+got)\n%s", msg, t1, diff)
+	}
+	if _, err := r.Dequeue("critical"); err != ErrNoProcessableTask {
+		t.Errorf("(*RDB).Dequeue(%q) returned %v for paused queue, want %v", "critical", err, ErrNoProcessableTask)
+	}
+
+	if err := r.UnpauseQueue("critical"); err != nil {
+		t.Fatalf("(*RDB).UnpauseQueue(%q) = %v, want nil", "critical", err)
+	}
+	got, err = r.ListPausedQueues()
+	if err != nil {
+		t.Fatalf("(*RDB).ListPausedQueues() returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"low"}, got); diff != "" {
+		t.Errorf("(*RDB).ListPausedQueues() = %v after unpause; (-want,+got)\n%s", got, diff)
+	}
+	msg, err = r.Dequeue("critical")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", "critical", err)
+	}
+	if diff := cmp.Diff(t2, msg); diff != "" {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, want %v; (-want,+got)\n%s", "critical", msg, t2, diff)
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+
+	if err := r.PauseAll(); err != nil {
+		t.Fatalf("(*RDB).PauseAll() = %v, want nil", err)
+	}
+	paused, err := r.IsPausedAll()
+	if err != nil || !paused {
+		t.Fatalf("(*RDB).IsPausedAll() = %t, %v, want true, nil", paused, err)
+	}
+
+	// all queues should be skipped.
+	if _, err := r.Dequeue("default"); err != ErrNoProcessableTask {
+		t.Errorf("(*RDB).Dequeue(%q) returned %v while all queues are paused, want %v", "default", err, ErrNoProcessableTask)
+	}
+
+	if err := r.UnpauseAll(); err != nil {
+		t.Fatalf("(*RDB).UnpauseAll() = %v, want nil", err)
+	}
+	paused, err = r.IsPausedAll()
+	if err != nil || paused {
+		t.Fatalf("(*RDB).IsPausedAll() = %t, %v after unpause, want false, nil", paused, err)
+	}
+	msg, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", "default", err)
+	}
+	if diff := cmp.Diff(t1, msg); diff != "" {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, want %v; (-want,+got)\n%s", "default", msg, t1, diff)
+	}
+}
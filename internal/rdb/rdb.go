@@ -9,10 +9,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
 	"github.com/spf13/cast"
 )
 
@@ -22,18 +25,262 @@ var (
 
 	// ErrTaskNotFound indicates that a task that matches the given identifier was not found.
 	ErrTaskNotFound = errors.New("could not find a task")
+
+	// ErrIdempotencyKeyExists indicates that the idempotency key is already associated with a task.
+	ErrIdempotencyKeyExists = errors.New("idempotency key already exists")
+
+	// ErrDuplicateTask indicates that a pending task holds the unique key.
+	ErrDuplicateTask = errors.New("task already exists")
+
+	// ErrQueueEmpty indicates that the queue has no enqueued tasks.
+	ErrQueueEmpty = errors.New("queue is empty")
+
+	// ErrResultNotFound indicates that the task has no result slot, or the slot has expired.
+	ErrResultNotFound = errors.New("could not find the result of the task")
 )
 
+// MalformedTaskError indicates that the data pulled out of a queue could not
+// be decoded into a task message.
+//
+// The data has been moved from the in-progress queue to the malformed queue
+// as is, so that it's not pulled out of the queue again.
+type MalformedTaskError struct {
+	Data []byte // raw data of the message
+	Err  error  // decoding error
+}
+
+func (e *MalformedTaskError) Error() string {
+	return fmt.Sprintf("malformed task message: %v", e.Err)
+}
+
+func (e *MalformedTaskError) Unwrap() error { return e.Err }
+
+// MalformedTasksError is returned by DequeueBatch along with the decoded
+// messages if some of the messages could not be decoded.
+type MalformedTasksError []*MalformedTaskError
+
+func (e MalformedTasksError) Error() string {
+	return fmt.Sprintf("%d malformed task message(s): %v", len(e), e[0].Err)
+}
+
 const statsTTL = 90 * 24 * time.Hour // 90 days
 
 // RDB is a client interface to query and mutate task queues.
 type RDB struct {
 	client *redis.Client
+	clock  base.Clock
+	keys   *base.Keys
+
+	// inProgress is the key of the list holding the tasks being processed.
+	// It's the shared in-progress list unless scoped with ScopeInProgress.
+	// The comments of the scripts refer to it by the scoped key name,
+	// asynq:in_progress:<server id>.
+	inProgress string
+
+	// retryTTL and deadTTL are the expiration of the retry and dead queues
+	// refreshed on write (see SetQueueTTL).
+	retryTTL, deadTTL time.Duration
+
+	// serverID is the id of the server the tasks are routed to by their
+	// affinity key, for affinityTTL since the last task of the key
+	// (see SetAffinity).
+	serverID    string
+	affinityTTL time.Duration
+
+	// serverClock overrides the time of the redis server by which due tasks
+	// are promoted, if set (see SetServerClock).
+	serverClock base.Clock
+
+	// codec encodes and decodes the task messages (see SetCodec).
+	codec base.Codec
 }
 
 // NewRDB returns a new instance of RDB.
 func NewRDB(client *redis.Client) *RDB {
-	return &RDB{client}
+	return NewRDBWithNamespace(client, "")
+}
+
+// NewRDBWithNamespace returns a new instance of RDB which reads and writes
+// the keys under the given namespace.
+// Empty namespace is the same as the one used by NewRDB.
+func NewRDBWithNamespace(client *redis.Client, namespace string) *RDB {
+	keys := base.NewKeys(namespace)
+	return &RDB{client: client, clock: base.NewRealClock(), keys: keys, inProgress: keys.InProgressQueue, codec: base.JSONCodec}
+}
+
+// SetCodec makes r encode and decode the task messages with the given codec
+// instead of base.JSONCodec. The messages encoded with another codec cannot
+// be decoded by r, so all clients and servers have to use the same codec.
+// It must be called before r is used.
+func (r *RDB) SetCodec(c base.Codec) {
+	r.codec = c
+}
+
+// encode encodes the given task message with the codec of r.
+func (r *RDB) encode(msg *base.TaskMessage) ([]byte, error) {
+	return r.codec.Encode(msg)
+}
+
+// decode decodes the given data with the codec of r.
+func (r *RDB) decode(data []byte) (*base.TaskMessage, error) {
+	return r.codec.Decode(data)
+}
+
+// ScopeInProgress makes r track the tasks being processed in the in-progress
+// list of the given server instead of the shared list, so that
+// RestoreUnfinished and AbandonUnfinished only move the tasks of the server.
+//
+// The server should hold a lease (see ExtendLease), so that its tasks are
+// reclaimed by ReclaimExpired if it dies without restoring them.
+// It must be called before r is used to process tasks.
+func (r *RDB) ScopeInProgress(serverID string) {
+	r.inProgress = r.keys.InProgressKey(serverID)
+}
+
+// SetQueueTTL makes r refresh the expiration of the retry queue to retryTTL
+// and of the dead queue to deadTTL each time it writes tasks to them, so that
+// a queue which goes idle frees its memory once the TTL elapses even if the
+// tasks are never cleaned up. The tasks in the queue are deleted along with it.
+// Zero or negative TTL keeps the queue from expiring, which is the default.
+func (r *RDB) SetQueueTTL(retryTTL, deadTTL time.Duration) {
+	r.retryTTL = retryTTL
+	r.deadTTL = deadTTL
+}
+
+// refreshTTL sets the expiration of the given queue to ttl if it's positive.
+func (r *RDB) refreshTTL(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return r.client.PExpire(key, ttl).Err()
+}
+
+// SetAffinity makes r route the tasks with an affinity key to the server
+// which last processed a task of the same queue with the key, as long as
+// the server holds a lease (see ExtendLease). r processes the tasks as the given server.
+//
+// A task whose key was last processed by r, by a server which no longer
+// holds a lease, or by no server within ttl, is processed by r, and r takes
+// over the key. The tasks routed to a server whose lease expires or is
+// released are moved back to their queues.
+// It must be called before r is used to process tasks.
+func (r *RDB) SetAffinity(serverID string, ttl time.Duration) {
+	r.serverID = serverID
+	r.affinityTTL = ttl
+}
+
+// ExtendLease extends the lease of the given server for ttl from now.
+func (r *RDB) ExtendLease(serverID string, ttl time.Duration) error {
+	expireAt := r.clock.Now().Add(ttl)
+	return r.client.ZAdd(r.keys.Servers, &redis.Z{Score: float64(expireAt.Unix()), Member: serverID}).Err()
+}
+
+// ReleaseLease releases the lease of the given server.
+//
+// If the in-progress list of the server is not empty (e.g., the tasks could
+// not be restored), the lease is expired instead so that the tasks are
+// reclaimed by ReclaimExpired.
+func (r *RDB) ReleaseLease(serverID string) error {
+	// KEYS[1] -> asynq:servers
+	// KEYS[2] -> asynq:in_progress:<server id>
+	// KEYS[3] -> asynq:queues
+	// ARGV[1] -> server id
+	// ARGV[2] -> current unix time
+	// ARGV[3] -> r.keys.QueuePrefix
+	// ARGV[4] -> r.keys.PriorityPrefix
+	// ARGV[5] -> r.keys.PriorityAging
+	// ARGV[6] -> r.keys.RoutedPrefix
+	script := redis.NewScript(luaUnroute + `
+	unroute(KEYS[3], ARGV[3], ARGV[4], ARGV[5], ARGV[6], ARGV[1])
+	if redis.call("LLEN", KEYS[2]) == 0 then
+		redis.call("ZREM", KEYS[1], ARGV[1])
+	else
+		redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+	end
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.keys.Servers, r.keys.InProgressKey(serverID), r.keys.AllQueues},
+		serverID, r.clock.Now().Unix(),
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.keys.RoutedPrefix).Err()
+}
+
+// ReclaimExpired moves the tasks in the in-progress lists of the servers
+// whose lease has expired back to their queues, along with the tasks routed
+// to the servers (see SetAffinity), and reports the number of tasks moved.
+//
+// Prioritized tasks are moved to the front of their priority level.
+func (r *RDB) ReclaimExpired() (int64, error) {
+	// KEYS[1] -> asynq:servers
+	// KEYS[2] -> asynq:queues
+	// KEYS[3] -> asynq:started
+	// ARGV[1] -> current unix time
+	// ARGV[2] -> in-progress list prefix
+	// ARGV[3] -> r.keys.QueuePrefix
+	// ARGV[4] -> r.keys.PriorityPrefix
+	// ARGV[5] -> r.keys.PriorityAging
+	// ARGV[6] -> r.keys.RoutedPrefix
+	script := redis.NewScript(luaUnroute + `
+	local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[1])
+	local n = 0
+	for _, id in ipairs(ids) do
+		local key = ARGV[2] .. id
+		local msg = redis.call("RPOP", key)
+		while msg do
+			push(ARGV[3], ARGV[4], ARGV[5], msg, 0)
+			redis.call("ZREM", KEYS[3], cjson.decode(msg)["ID"])
+			n = n + 1
+			msg = redis.call("RPOP", key)
+		end
+		n = n + unroute(KEYS[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], id)
+		redis.call("ZREM", KEYS[1], id)
+	end
+	return n
+	`)
+	res, err := script.Run(r.client, []string{r.keys.Servers, r.keys.AllQueues, r.keys.StartedTasks},
+		r.clock.Now().Unix(), r.keys.InProgressKey(""),
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.keys.RoutedPrefix).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n, nil
+}
+
+// Ping checks the connection with redis server.
+func (r *RDB) Ping() error {
+	return r.client.Ping().Err()
+}
+
+// CancelationPubSub returns a pubsub for the types of tasks to cancel
+// published by CancelByType. The subscription is confirmed on return.
+func (r *RDB) CancelationPubSub() (*redis.PubSub, error) {
+	pubsub := r.client.Subscribe(r.keys.CancelChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+// SetClock sets the clock used to compute timestamps and scores.
+// It is intended to be used in tests.
+//
+// Note: The scheduled and retry tasks are promoted by the time of the redis
+// server regardless of the clock (see CheckAndEnqueue); use SetServerClock
+// to simulate the time of the server.
+func (r *RDB) SetClock(c base.Clock) {
+	r.clock = c
+}
+
+// SetServerClock sets the clock used in place of the time of the redis
+// server to determine the due tasks to promote.
+// It is intended to be used in tests.
+func (r *RDB) SetServerClock(c base.Clock) {
+	r.serverClock = c
 }
 
 // Close closes the connection with redis server.
@@ -41,155 +288,1647 @@ func (r *RDB) Close() error {
 	return r.client.Close()
 }
 
+// priorityBand is the range of scores allotted to each priority level
+// in a priority queue. Scores within a band are unix time in milliseconds,
+// so that tasks with the same priority are dequeued in FIFO order.
+//
+// If the queue has a priority aging period, the band is the period in
+// milliseconds instead, so that a task gains one priority level over the
+// tasks enqueued after it for each period it waits.
+const priorityBand = 1e13
+
+// priorityScore returns the score of a task with priority p enqueued at t
+// in a queue with no priority aging.
+// Lower score means the task should be processed sooner.
+func priorityScore(p int, t time.Time) float64 {
+	return -float64(p)*priorityBand + float64(t.UnixNano()/int64(time.Millisecond))
+}
+
+// nowInMillis returns the current unix time in milliseconds.
+func (r *RDB) nowInMillis() int64 {
+	return r.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// serverNow returns the unix time to pass to server_time (see luaServerTime),
+// which is zero unless the time of the server is overridden by SetServerClock.
+func (r *RDB) serverNow() int64 {
+	if r.serverClock == nil {
+		return 0
+	}
+	return r.serverClock.Now().Unix()
+}
+
+// luaServerTime defines a lua function which returns the current unix time
+// in seconds of the redis server, or the given time if it's positive
+// (see serverNow). Due tasks are determined by the time of the server rather
+// than of the processes, so that a clock of a process moving backward
+// (e.g., by an NTP correction) doesn't stall the promotion.
+//
+// Note: Scripts calling server_time have to call redis.replicate_commands()
+// first to write after calling the non-deterministic TIME command
+// (noop since redis 5).
+const luaServerTime = `
+local function server_time(now)
+	local t = tonumber(now) or 0
+	if t > 0 then
+		return t
+	end
+	return tonumber(redis.call("TIME")[1])
+end
+`
+
+// luaPriorityScore defines a lua function which returns the score of a task
+// with priority p in the priority queue of qname, taking the priority aging
+// period of the queue into account (see priorityBand).
+//
+// agingkey -> r.keys.PriorityAging
+// now      -> current unix time in milliseconds (use 0 to score at the front)
+const luaPriorityScore = `
+local function priority_score(agingkey, qname, p, now)
+	local band = tonumber(redis.call("HGET", agingkey, qname)) or 1e13
+	return string.format("%.0f", -p * band + now)
+end
+`
+
+// luaPush defines a lua function which pushes a task message to the queue
+// named in the message. If the message has a non-zero priority, it is added
+// to the priority queue instead of the list.
+//
+// qprefix  -> r.keys.QueuePrefix
+// pprefix  -> r.keys.PriorityPrefix
+// agingkey -> r.keys.PriorityAging
+// msg      -> base.TaskMessage value
+// now      -> current unix time in milliseconds (use 0 to push to the front)
+//
+// push_front pushes the message to the head of the list instead, or to the
+// front of its priority level in the priority queue.
+const luaPush = luaPriorityScore + `
+local function push(qprefix, pprefix, agingkey, msg, now)
+	local decoded = cjson.decode(msg)
+	local p = tonumber(decoded["Priority"]) or 0
+	if p > 0 then
+		local score = priority_score(agingkey, decoded["Queue"], p, now)
+		redis.call("ZADD", pprefix .. decoded["Queue"], score, msg)
+	else
+		redis.call("LPUSH", qprefix .. decoded["Queue"], msg)
+	end
+end
+
+local function push_front(qprefix, pprefix, agingkey, msg)
+	local decoded = cjson.decode(msg)
+	local p = tonumber(decoded["Priority"]) or 0
+	if p > 0 then
+		local score = priority_score(agingkey, decoded["Queue"], p, 0)
+		redis.call("ZADD", pprefix .. decoded["Queue"], score, msg)
+	else
+		-- Note: Use RPUSH to push to the head of the queue.
+		redis.call("RPUSH", qprefix .. decoded["Queue"], msg)
+	end
+end
+`
+
+// luaUnroute defines a lua function which moves the tasks routed to the
+// given server (see SetAffinity) back to their queues, and returns the
+// number of tasks moved.
+//
+// queueskey -> r.keys.AllQueues
+// qprefix   -> r.keys.QueuePrefix
+// pprefix   -> r.keys.PriorityPrefix
+// agingkey  -> r.keys.PriorityAging
+// rprefix   -> r.keys.RoutedPrefix
+// id        -> server id
+const luaUnroute = luaPush + `
+local function unroute(queueskey, qprefix, pprefix, agingkey, rprefix, id)
+	local n = 0
+	for _, qkey in ipairs(redis.call("SMEMBERS", queueskey)) do
+		local key = rprefix .. id .. ":" .. string.sub(qkey, string.len(qprefix) + 1)
+		local msg = redis.call("RPOP", key)
+		while msg do
+			push(qprefix, pprefix, agingkey, msg, 0)
+			n = n + 1
+			msg = redis.call("RPOP", key)
+		end
+	end
+	return n
+end
+`
+
+// SetPriorityAging sets the priority aging period of the given queues.
+//
+// A prioritized task enqueued after the call gains one priority level over
+// the tasks enqueued after it for each period it waits in the queue, so that
+// low priority tasks are not overtaken by higher priority tasks forever.
+// Zero or negative period disables priority aging.
+func (r *RDB) SetPriorityAging(d time.Duration, qnames ...string) error {
+	if len(qnames) == 0 {
+		return nil
+	}
+	var fields []string
+	for _, qname := range qnames {
+		fields = append(fields, strings.ToLower(qname))
+	}
+	if d <= 0 {
+		return r.client.HDel(r.keys.PriorityAging, fields...).Err()
+	}
+	ms := int64(d / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	values := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		values[f] = ms
+	}
+	return r.client.HMSet(r.keys.PriorityAging, values).Err()
+}
+
 // Enqueue inserts the given task to the tail of the queue.
+//
+// If the task has a non-zero priority, it is inserted to the priority queue
+// and placed ahead of tasks with a lower priority.
 func (r *RDB) Enqueue(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+	_, err := r.EnqueueWithDepth(msg)
+	return err
+}
+
+// EnqueueWithDepth inserts the given task to the queue in the same way as
+// Enqueue, and returns the number of pending tasks in the queue right after
+// the insertion, including the task itself.
+func (r *RDB) EnqueueWithDepth(msg *base.TaskMessage) (int64, error) {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return 0, err
+	}
+	res, err := enqueueCmd.Run(r.client, r.enqueueKeys(msg), r.enqueueArgs(msg, bytes)...).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n, nil
+}
+
+// EnqueueTx queues the commands to insert the given task to the queue in the
+// same way as Enqueue on the given pipeline, so that the task is enqueued
+// only when the pipeline is executed, e.g. atomically with other writes of
+// a MULTI/EXEC transaction. Errors of the commands are returned by Exec.
+//
+// The pipeline must be created by a client connected to the same redis
+// database as r.
+func (r *RDB) EnqueueTx(pipe redis.Pipeliner, msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// Use EVAL since scripts can't be loaded on NOSCRIPT error in a pipeline.
+	enqueueCmd.Eval(pipe, r.enqueueKeys(msg), r.enqueueArgs(msg, bytes)...)
+	return nil
+}
+
+// EnqueueAll inserts the given tasks to their queues in the same way as
+// Enqueue, in a single MULTI/EXEC transaction so that either all or none
+// of them are enqueued.
+func (r *RDB) EnqueueAll(msgs ...*base.TaskMessage) error {
+	pipe := r.client.TxPipeline()
+	for _, msg := range msgs {
+		if err := r.EnqueueTx(pipe, msg); err != nil {
+			pipe.Discard()
+			return err
+		}
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// ScheduleTx queues the command to add the task to the backlog queue in the
+// same way as Schedule on the given pipeline. See EnqueueTx.
+func (r *RDB) ScheduleTx(pipe redis.Pipeliner, msg *base.TaskMessage, processAt time.Time) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	pipe.ZAdd(r.keys.ScheduledQueue, &redis.Z{Member: string(bytes), Score: float64(processAt.Unix())})
+	return nil
+}
+
+// KEYS[1] -> asynq:queues:<qname>
+// KEYS[2] -> asynq:priority:<qname>
+// KEYS[3] -> asynq:queues
+// KEYS[4] -> asynq:priority_aging
+// KEYS[5] -> asynq:result:<task id>
+// KEYS[6] -> asynq:result_ready:<task id>
+// ARGV[1] -> base.TaskMessage value
+// ARGV[2] -> task priority
+// ARGV[3] -> queue name
+// ARGV[4] -> current unix time in milliseconds
+// ARGV[5] -> pending result record
+// ARGV[6] -> ttl of the result slot in milliseconds
+var enqueueCmd = redis.NewScript(luaPriorityScore + luaReserveResult + `
+reserve_result(KEYS[5], KEYS[6], ARGV[5], ARGV[6])
+local p = tonumber(ARGV[2])
+if p > 0 then
+	redis.call("ZADD", KEYS[2], priority_score(KEYS[4], ARGV[3], p, ARGV[4]), ARGV[1])
+else
+	redis.call("LPUSH", KEYS[1], ARGV[1])
+end
+redis.call("SADD", KEYS[3], KEYS[1])
+return redis.call("LLEN", KEYS[1]) + redis.call("ZCARD", KEYS[2])
+`)
+
+func (r *RDB) enqueueKeys(msg *base.TaskMessage) []string {
+	return append([]string{r.keys.QueueKey(msg.Queue), r.keys.PriorityQueueKey(msg.Queue), r.keys.AllQueues,
+		r.keys.PriorityAging}, r.resultKeys(msg)...)
+}
+
+func (r *RDB) enqueueArgs(msg *base.TaskMessage, encoded []byte) []interface{} {
+	return append([]interface{}{string(encoded), msg.Priority, strings.ToLower(msg.Queue), r.nowInMillis()},
+		resultArgs(msg)...)
+}
+
+// PendingResultTTL is the duration to keep the result slot of a task
+// waiting to be processed, on top of the ttl of the result.
+const PendingResultTTL = 24 * time.Hour
+
+// luaReserveResult defines a lua function which creates the result slot of
+// a task holding a pending record for the given ttl, unless the ttl is zero,
+// so that the slot is created atomically with the enqueue of the task.
+//
+// rkey     -> asynq:result:<task id>
+// readykey -> asynq:result_ready:<task id>
+// record   -> pending result record
+// ttl      -> ttl of the slot in milliseconds
+const luaReserveResult = `
+local function reserve_result(rkey, readykey, record, ttl)
+	if tonumber(ttl) > 0 then
+		redis.call("SET", rkey, record, "PX", ttl)
+		redis.call("DEL", readykey)
+	end
+end
+`
+
+// pendingResult is the encoded record of the result slot of a task waiting
+// to be processed.
+var pendingResult = func() string {
+	record, _ := json.Marshal(ResultRecord{State: ResultPending})
+	return string(record)
+}()
+
+// resultKeys returns the keys of the result slot of the task, and resultArgs
+// returns the arguments to pass to reserve_result for the task, which
+// leave the slot alone if the result of the task is not stored.
+func (r *RDB) resultKeys(msg *base.TaskMessage) []string {
+	return []string{r.keys.ResultKey(msg.ID.String()), r.keys.ResultReadyKey(msg.ID.String())}
+}
+
+func resultArgs(msg *base.TaskMessage) []interface{} {
+	if msg.ResultTTL == 0 {
+		return []interface{}{pendingResult, 0}
+	}
+	ttl := PendingResultTTL + time.Duration(msg.ResultTTL)*time.Second
+	return []interface{}{pendingResult, ttl.Milliseconds()}
+}
+
+// Dequeue queries given queues in order and pops a task message if there
+// is one and returns it. If all queues are empty, it blocks on the first
+// queue in qnames until a task becomes available in the queue or timeout of
+// a second is reached, in which case ErrNoProcessableTask error is returned.
+//
+// Within each queue, tasks handed off by servers shutting down (see HandOff)
+// are dequeued first, then the tasks routed to r (see SetAffinity) and
+// prioritized tasks before the others. A task routed to another server is
+// not returned, and ErrNoProcessableTask error is returned instead.
+// Paused queues are skipped. If all queues are paused (including by PauseAll),
+// it waits for a second and returns ErrNoProcessableTask error.
+//
+// Callers should vary the first queue in qnames between calls to avoid
+// having all idle workers blocking on the same queue.
+func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
+	return r.DequeueWithTimeout(time.Second, qnames...)
+}
+
+// DequeueWithTimeout is like Dequeue but waits up to the given timeout
+// instead of a second if there's no task to process.
+//
+// Note: Blocking on a queue has a resolution of a second, so the timeout
+// is rounded down to seconds (and up to a second if shorter) for the wait
+// on an empty queue. The wait with all queues paused is not rounded.
+//
+// If the message pulled out of the queue cannot be decoded, it's moved to
+// the malformed queue and a *MalformedTaskError is returned.
+func (r *RDB) DequeueWithTimeout(timeout time.Duration, qnames ...string) (*base.TaskMessage, error) {
+	data, waitKey, err := r.dequeue(qnames...)
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		if waitKey == "" {
+			// all queues are paused, wait to avoid slamming redis.
+			time.Sleep(timeout)
+			return nil, ErrNoProcessableTask
+		}
+		// Note: Blocking pop is not available for sorted sets and for multiple
+		// source lists, so the first unpaused queue is waited on after polling
+		// all queues.
+		// timeout needed to avoid blocking forever
+		if timeout < time.Second {
+			timeout = time.Second
+		}
+		data, err = r.client.BRPopLPush(waitKey, r.inProgress, timeout).Result()
+	}
+	if err == redis.Nil {
+		return nil, ErrNoProcessableTask
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg, err := r.decode([]byte(data))
+	if err != nil {
+		if err := r.quarantine(data); err != nil {
+			return nil, err
+		}
+		return nil, &MalformedTaskError{Data: []byte(data), Err: err}
+	}
+	if err := r.canonicalize(data, msg); err != nil {
+		return nil, err
+	}
+	routed, err := r.route(msg)
+	if err != nil {
+		return nil, err
+	}
+	if routed {
+		return nil, ErrNoProcessableTask
+	}
+	r.releaseUniqueKey(msg)
+	return msg, nil
+}
+
+// route moves the task with an affinity key from in-progress queue to the
+// tasks routed to the server which last processed a task with the key,
+// and reports whether the task has been routed. If the server is r itself
+// or not available, r takes over the key and the task stays in progress
+// (see SetAffinity).
+func (r *RDB) route(msg *base.TaskMessage) (bool, error) {
+	if r.affinityTTL <= 0 || msg.Affinity == "" {
+		return false, nil
+	}
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return false, err
+	}
+	// KEYS[1] -> asynq:affinity:<qname>:<key>
+	// KEYS[2] -> asynq:servers
+	// KEYS[3] -> asynq:in_progress:<server id>
+	// ARGV[1] -> server id
+	// ARGV[2] -> base.TaskMessage value
+	// ARGV[3] -> current unix time
+	// ARGV[4] -> r.keys.RoutedPrefix
+	// ARGV[5] -> queue name
+	// ARGV[6] -> ttl of the affinity in milliseconds
+	script := redis.NewScript(`
+	local owner = redis.call("GET", KEYS[1])
+	if owner and owner ~= ARGV[1] then
+		local lease = redis.call("ZSCORE", KEYS[2], owner)
+		if lease and tonumber(lease) >= tonumber(ARGV[3]) then
+			if redis.call("LREM", KEYS[3], 1, ARGV[2]) > 0 then
+				redis.call("LPUSH", ARGV[4] .. owner .. ":" .. ARGV[5], ARGV[2])
+			end
+			return 1
+		end
+	end
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[6])
+	return 0
+	`)
+	ttl := int64(r.affinityTTL / time.Millisecond)
+	if ttl < 1 {
+		ttl = 1
+	}
+	n, err := script.Run(r.client,
+		[]string{r.keys.AffinityKey(msg.Queue, msg.Affinity), r.keys.Servers, r.inProgress},
+		r.serverID, string(bytes), r.clock.Now().Unix(), r.keys.RoutedPrefix, msg.Queue, ttl).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// canonicalize replaces the data of the message in the in-progress queue
+// with the encoding of the decoded message, if they differ, e.g. since the
+// message was written by a client in another language or by a newer version
+// with unknown fields. The message in the in-progress queue has to match
+// its encoding for the message to be removed from the queue once processed.
+func (r *RDB) canonicalize(data string, msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
 	if err != nil {
 		return err
 	}
-	key := base.QueueKey(msg.Queue)
+	if string(bytes) == data {
+		return nil
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// ARGV[1] -> data of the message pulled out of the queue
+	// ARGV[2] -> base.TaskMessage value
+	script := redis.NewScript(`
+	if redis.call("LREM", KEYS[1], 1, ARGV[1]) > 0 then
+		redis.call("LPUSH", KEYS[1], ARGV[2])
+	end
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.inProgress}, data, string(bytes)).Err()
+}
+
+// quarantine moves the undecodable data from in-progress queue to
+// malformed queue, so that it's not retried forever.
+func (r *RDB) quarantine(data string) error {
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:malformed
+	// ARGV[1] -> raw data of the message
+	// ARGV[2] -> quarantined_at UNIX timestamp
+	script := redis.NewScript(`
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.MalformedQueue},
+		data, r.clock.Now().Unix()).Err()
+}
+
+// DequeueBatch pops up to n task messages from the specified queue
+// atomically and returns them. Tasks handed off (see HandOff) are popped
+// first, then the tasks routed to r (see SetAffinity) and prioritized tasks.
+// Tasks routed to another server on the way are not returned.
+//
+// Unlike Dequeue, it does not block if the queue is empty, and returns
+// an empty slice if there's no task to process or the queue is paused.
+//
+// Messages which cannot be decoded are moved to the malformed queue, and
+// reported with MalformedTasksError along with the decoded messages.
+// Other errors are returned along with the messages processed successfully.
+func (r *RDB) DequeueBatch(qname string, n int) ([]*base.TaskMessage, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	qname = strings.ToLower(qname)
+	// KEYS[1] -> asynq:queues:<qname>
+	// KEYS[2] -> asynq:priority:<qname>
+	// KEYS[3] -> asynq:in_progress:<server id>
+	// KEYS[4] -> asynq:paused
+	// KEYS[5] -> asynq:paused_all
+	// KEYS[6] -> asynq:handoff:<qname>
+	// KEYS[7] -> asynq:routed:<server id>:<qname>
+	// ARGV[1] -> queue name
+	// ARGV[2] -> max number of tasks to pop
+	script := redis.NewScript(`
+	if redis.call("EXISTS", KEYS[5]) == 1 or redis.call("SISMEMBER", KEYS[4], ARGV[1]) == 1 then
+		return {}
+	end
+	local n = tonumber(ARGV[2])
+	local res = {}
+	for _, key in ipairs({KEYS[6], KEYS[7]}) do
+		while table.getn(res) < n do
+			local msg = redis.call("RPOPLPUSH", key, KEYS[3])
+			if not msg then
+				break
+			end
+			table.insert(res, msg)
+		end
+	end
+	if table.getn(res) < n then
+		local msgs = redis.call("ZRANGE", KEYS[2], 0, n - table.getn(res) - 1)
+		for _, msg in ipairs(msgs) do
+			redis.call("ZREM", KEYS[2], msg)
+			redis.call("LPUSH", KEYS[3], msg)
+			table.insert(res, msg)
+		end
+	end
+	while table.getn(res) < n do
+		local msg = redis.call("RPOPLPUSH", KEYS[1], KEYS[3])
+		if not msg then
+			break
+		end
+		table.insert(res, msg)
+	end
+	return res
+	`)
+	res, err := script.Run(r.client,
+		[]string{r.keys.QueueKey(qname), r.keys.PriorityQueueKey(qname), r.inProgress,
+			r.keys.PausedQueues, r.keys.PausedAll, r.keys.HandoffKey(qname),
+			r.keys.RoutedKey(r.serverID, qname)},
+		qname, n).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, err := cast.ToStringSliceE(res)
+	if err != nil {
+		return nil, err
+	}
+	// Note: A message which fails is skipped rather than failing the batch,
+	// since the other messages have already been moved to in-progress.
+	// Messages left in in-progress are restored with the unfinished tasks.
+	msgs := make([]*base.TaskMessage, 0, len(data))
+	var malformed MalformedTasksError
+	var firstErr error
+	for _, s := range data {
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			if err := r.quarantine(s); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			malformed = append(malformed, &MalformedTaskError{Data: []byte(s), Err: err})
+			continue
+		}
+		if err := r.canonicalize(s, msg); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		routed, err := r.route(msg)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if routed {
+			continue
+		}
+		r.releaseUniqueKey(msg)
+		msgs = append(msgs, msg)
+	}
+	if firstErr != nil {
+		return msgs, firstErr
+	}
+	if len(malformed) > 0 {
+		return msgs, malformed
+	}
+	return msgs, nil
+}
+
+// QueueNames returns the names of all queues registered in redis.
+// A queue is registered when a task is first enqueued to the queue.
+func (r *RDB) QueueNames() ([]string, error) {
+	keys, err := r.client.SMembers(r.keys.AllQueues).Result()
+	if err != nil {
+		return nil, err
+	}
+	var qnames []string
+	for _, key := range keys {
+		qnames = append(qnames, strings.TrimPrefix(key, r.keys.QueuePrefix))
+	}
+	sort.Strings(qnames)
+	return qnames, nil
+}
+
+// QueueDepths returns the number of pending tasks in each of the given
+// queues, including the tasks in their priority queues.
+func (r *RDB) QueueDepths(qnames ...string) (map[string]int64, error) {
+	pipe := r.client.Pipeline()
+	cmds := make(map[string][2]*redis.IntCmd, len(qnames))
+	for _, qname := range qnames {
+		cmds[qname] = [2]*redis.IntCmd{
+			pipe.LLen(r.keys.QueueKey(qname)),
+			pipe.ZCard(r.keys.PriorityQueueKey(qname)),
+		}
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	res := make(map[string]int64, len(qnames))
+	for qname, c := range cmds {
+		res[qname] = c[0].Val() + c[1].Val()
+	}
+	return res, nil
+}
+
+// QueueLatency returns the time the oldest pending task of the given queue
+// has been waiting since it was first enqueued, i.e. the age of the task
+// next to be dequeued from the queue or the oldest of its prioritized tasks.
+//
+// It returns zero if the queue is empty or the enqueue time of the tasks
+// is unknown (e.g., they were enqueued by an older version).
+func (r *RDB) QueueLatency(qname string) (time.Duration, error) {
+	qname = strings.ToLower(qname)
+	pipe := r.client.Pipeline()
+	head := pipe.LIndex(r.keys.QueueKey(qname), -1)
+	prioritized := pipe.ZRange(r.keys.PriorityQueueKey(qname), 0, -1)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return 0, err
+	}
+	data := prioritized.Val()
+	if head.Val() != "" {
+		data = append(data, head.Val())
+	}
+	var oldest int64
+	for _, s := range data {
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			return 0, err
+		}
+		if msg.EnqueuedAt > 0 && (oldest == 0 || msg.EnqueuedAt < oldest) {
+			oldest = msg.EnqueuedAt
+		}
+	}
+	if oldest == 0 {
+		return 0, nil
+	}
+	if d := r.clock.Now().Sub(time.Unix(0, oldest)); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// dequeue pops a task message from the first non-empty, unpaused queue.
+// If there's no task to process, data is empty and waitKey holds
+// the key of the first unpaused queue (empty if all queues are paused).
+func (r *RDB) dequeue(qnames ...string) (data, waitKey string, err error) {
+	var routedPrefix string
+	if r.affinityTTL > 0 {
+		routedPrefix = r.keys.RoutedKey(r.serverID, "")
+	}
+	args := []interface{}{r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.HandoffPrefix, routedPrefix}
+	for _, qname := range qnames {
+		args = append(args, strings.ToLower(qname))
+	}
+	// KEYS[1]    -> asynq:in_progress:<server id>
+	// KEYS[2]    -> asynq:paused
+	// KEYS[3]    -> asynq:paused_all
+	// ARGV[1]    -> r.keys.QueuePrefix
+	// ARGV[2]    -> r.keys.PriorityPrefix
+	// ARGV[3]    -> r.keys.HandoffPrefix
+	// ARGV[4]    -> prefix of the lists of tasks routed to the server (empty if no affinity)
+	// ARGV[5...] -> queue names
+	script := redis.NewScript(`
+	if redis.call("EXISTS", KEYS[3]) == 1 then
+		return {"", ""}
+	end
+	local wait = ""
+	for i = 5, table.getn(ARGV) do
+		if redis.call("SISMEMBER", KEYS[2], ARGV[i]) == 0 then
+			local qkey = ARGV[1] .. ARGV[i]
+			if wait == "" then
+				wait = qkey
+			end
+			local handed = redis.call("RPOPLPUSH", ARGV[3] .. ARGV[i], KEYS[1])
+			if handed then
+				return {handed, ""}
+			end
+			if ARGV[4] ~= "" then
+				local routed = redis.call("RPOPLPUSH", ARGV[4] .. ARGV[i], KEYS[1])
+				if routed then
+					return {routed, ""}
+				end
+			end
+			local pkey = ARGV[2] .. ARGV[i]
+			local msgs = redis.call("ZRANGE", pkey, 0, 0)
+			if table.getn(msgs) > 0 then
+				redis.call("ZREM", pkey, msgs[1])
+				redis.call("LPUSH", KEYS[1], msgs[1])
+				return {msgs[1], ""}
+			end
+			local res = redis.call("RPOPLPUSH", qkey, KEYS[1])
+			if res then
+				return {res, ""}
+			end
+		end
+	end
+	return {"", wait}
+	`)
+	res, err := script.Run(r.client,
+		[]string{r.inProgress, r.keys.PausedQueues, r.keys.PausedAll}, args...).Result()
+	if err != nil {
+		return "", "", err
+	}
+	vals, err := cast.ToStringSliceE(res)
+	if err != nil {
+		return "", "", err
+	}
+	if len(vals) != 2 {
+		return "", "", fmt.Errorf("unexpected return value from dequeue script: %v", res)
+	}
+	return vals[0], vals[1], nil
+}
+
+// MarkCompleted marks the task with the given id as completed for ttl,
+// so that IsCompleted recognizes the task if it's processed again,
+// e.g. since it's restored before it's marked as done.
+func (r *RDB) MarkCompleted(id xid.ID, ttl time.Duration) error {
+	return r.client.Set(r.keys.CompletedIDKey(id.String()), 1, ttl).Err()
+}
+
+// IsCompleted reports whether the task with the given id has been marked
+// as completed by MarkCompleted within its ttl.
+func (r *RDB) IsCompleted(id xid.ID) (bool, error) {
+	n, err := r.client.Exists(r.keys.CompletedIDKey(id.String())).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Done removes the task from in-progress queue to mark the task as done.
+//
+// The tasks waiting for the task (see EnqueueDependent) are pushed to
+// their queues.
+func (r *RDB) Done(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// Note: LREM count ZERO means "remove all elements equal to val"
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+	// KEYS[3] -> asynq:resolved:<task id>
+	// KEYS[4] -> asynq:dependents:<task id>
+	// KEYS[5] -> asynq:waiting
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> stats expiration timestamp
+	// ARGV[3] -> ttl of the resolved outcome in seconds
+	// ARGV[4] -> r.keys.QueuePrefix
+	// ARGV[5] -> r.keys.PriorityPrefix
+	// ARGV[6] -> r.keys.PriorityAging
+	// ARGV[7] -> current unix time in milliseconds
+	script := redis.NewScript(luaResolveDone + `
+	redis.call("LREM", KEYS[1], 0, ARGV[1]) 
+	local n = redis.call("INCR", KEYS[2])
+	if tonumber(n) == 1 then
+		redis.call("EXPIREAT", KEYS[2], ARGV[2])
+	end
+	resolve_done(KEYS[3], KEYS[4], KEYS[5], ARGV[3], ARGV[4], ARGV[5], ARGV[6], ARGV[7])
+	return redis.status_reply("OK")
+	`)
+	now := r.clock.Now()
+	processedKey := r.keys.ProcessedKey(now)
+	expireAt := now.Add(statsTTL)
+	id := msg.ID.String()
+	return script.Run(r.client,
+		[]string{r.inProgress, processedKey, r.keys.ResolvedKey(id), r.keys.DependentsKey(id), r.keys.WaitingTasks},
+		string(bytes), expireAt.Unix(), int64(resolvedTTL/time.Second),
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis()).Err()
+}
+
+// resolvedTTL is the duration to keep the outcome of a completed or killed
+// task, so that a task enqueued with a dependency on the task shortly after
+// its completion is resolved right away instead of waiting forever.
+const resolvedTTL = time.Hour
+
+// Outcomes of a task recorded for the tasks depending on it.
+const (
+	resolvedDone = "done"
+	resolvedDead = "dead"
+)
+
+// luaResolveDone defines a lua function which records the completion of a
+// task and pushes the tasks waiting for it to their queues.
+const luaResolveDone = luaPush + `
+local function resolve_done(resolvedkey, depkey, waitkey, ttl, qprefix, pprefix, agingkey, now)
+	redis.call("SET", resolvedkey, "` + resolvedDone + `", "EX", ttl)
+	for _, m in ipairs(redis.call("SMEMBERS", depkey)) do
+		push(qprefix, pprefix, agingkey, m, now)
+		redis.call("ZREM", waitkey, m)
+	end
+	redis.call("DEL", depkey)
+end
+`
+
+// maxCompletedTasks is the max number of completed task records to keep.
+const maxCompletedTasks = 10000
+
+// completedRecord is the value stored in the completed queue.
+type completedRecord struct {
+	ID          string
+	Type        string
+	Queue       string
+	CompletedAt int64       // unix time in milliseconds
+	Duration    int64       // in nanoseconds
+	Result      *TaskResult `json:",omitempty"`
+}
+
+// TaskResult is the result of a task reported by its handler, which is kept
+// with the record of the completion.
+type TaskResult struct {
+	Status  string
+	Message string `json:",omitempty"`
+	Data    []byte `json:",omitempty"`
+}
+
+// DoneWithRecord removes the task from in-progress queue to mark the task
+// as done, and keeps a record of the completion for the given ttl.
+//
+// duration is the time it took to process the task.
+// Records are evicted once they expire, and at most 10,000 records are kept
+// by evicting the oldest ones.
+// The tasks waiting for the task are pushed to their queues as in Done.
+func (r *RDB) DoneWithRecord(msg *base.TaskMessage, duration, ttl time.Duration) error {
+	return r.DoneWithResult(msg, duration, ttl, nil)
+}
+
+// DoneWithResult marks the task as done in the same way as DoneWithRecord,
+// and keeps the given result of the task, if any, with the record.
+func (r *RDB) DoneWithResult(msg *base.TaskMessage, duration, ttl time.Duration, res *TaskResult) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	record, err := json.Marshal(completedRecord{
+		ID:          msg.ID.String(),
+		Type:        msg.Type,
+		Queue:       msg.Queue,
+		CompletedAt: now.UnixNano() / int64(time.Millisecond),
+		Duration:    int64(duration),
+		Result:      res,
+	})
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+	// KEYS[3] -> asynq:completed
+	// KEYS[4] -> asynq:resolved:<task id>
+	// KEYS[5] -> asynq:dependents:<task id>
+	// KEYS[6] -> asynq:waiting
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> stats expiration timestamp
+	// ARGV[3] -> completed record
+	// ARGV[4] -> record expiration timestamp (used as score)
+	// ARGV[5] -> current unix time
+	// ARGV[6] -> ttl of the completed queue in seconds
+	// ARGV[7] -> max number of completed records
+	// ARGV[8] -> ttl of the resolved outcome in seconds
+	// ARGV[9] -> r.keys.QueuePrefix
+	// ARGV[10] -> r.keys.PriorityPrefix
+	// ARGV[11] -> r.keys.PriorityAging
+	// ARGV[12] -> current unix time in milliseconds
+	script := redis.NewScript(luaResolveDone + `
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	local n = redis.call("INCR", KEYS[2])
+	if tonumber(n) == 1 then
+		redis.call("EXPIREAT", KEYS[2], ARGV[2])
+	end
+	redis.call("ZADD", KEYS[3], ARGV[4], ARGV[3])
+	redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", ARGV[5])
+	redis.call("ZREMRANGEBYRANK", KEYS[3], 0, -(tonumber(ARGV[7]) + 1))
+	local ttl = redis.call("TTL", KEYS[3])
+	if ttl < tonumber(ARGV[6]) then
+		redis.call("EXPIRE", KEYS[3], ARGV[6])
+	end
+	resolve_done(KEYS[4], KEYS[5], KEYS[6], ARGV[8], ARGV[9], ARGV[10], ARGV[11], ARGV[12])
+	return redis.status_reply("OK")
+	`)
+	ttlSecs := int64(ttl / time.Second)
+	if ttlSecs < 1 {
+		ttlSecs = 1
+	}
+	id := msg.ID.String()
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.ProcessedKey(now), r.keys.CompletedQueue,
+			r.keys.ResolvedKey(id), r.keys.DependentsKey(id), r.keys.WaitingTasks},
+		string(bytes), now.Add(statsTTL).Unix(), string(record),
+		now.Add(ttl).Unix(), now.Unix(), ttlSecs, maxCompletedTasks,
+		int64(resolvedTTL/time.Second), r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging,
+		now.UnixNano()/int64(time.Millisecond)).Err()
+}
+
+// Result states of the tasks, recorded in their result slots.
+const (
+	ResultPending   = "pending"
+	ResultCompleted = "completed"
+	ResultDead      = "dead"
+)
+
+// ResultRecord is the content of the result slot of a task.
+type ResultRecord struct {
+	State  string
+	Result *TaskResult `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// StoreResult writes the given record to the result slot of the task for
+// the given ttl, and wakes up the waiters of the result.
+func (r *RDB) StoreResult(id xid.ID, rec *ResultRecord, ttl time.Duration) error {
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:result:<task id>
+	// KEYS[2] -> asynq:result_ready:<task id>
+	// ARGV[1] -> result record
+	// ARGV[2] -> ttl in milliseconds
+	script := redis.NewScript(`
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	redis.call("DEL", KEYS[2])
+	redis.call("RPUSH", KEYS[2], 1)
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.keys.ResultKey(id.String()), r.keys.ResultReadyKey(id.String())},
+		string(record), ttl.Milliseconds()).Err()
+}
+
+// GetResult returns the content of the result slot of the task with the
+// given id. It returns ErrResultNotFound if there's no slot.
+func (r *RDB) GetResult(id xid.ID) (*ResultRecord, error) {
+	data, err := r.client.Get(r.keys.ResultKey(id.String())).Result()
+	if err == redis.Nil {
+		return nil, ErrResultNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec ResultRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// WaitResult blocks for up to the given timeout until the result of the
+// task with the given id is stored, and returns the content of its result
+// slot, which is still pending if the timeout elapsed first.
+//
+// The signal of the result is left in place, so that every waiter of the
+// result is woken up, including those which start waiting after the result
+// is stored.
+func (r *RDB) WaitResult(id xid.ID, timeout time.Duration) (*ResultRecord, error) {
+	ready := r.keys.ResultReadyKey(id.String())
+	err := r.client.BRPopLPush(ready, ready, timeout).Err()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return r.GetResult(id)
+}
+
+// EnqueueDependent registers the given task to wait for the task with the
+// ID of msg.DependsOn.
+//
+// The task is pushed to its queue when the dependency completes. If the
+// outcome of the dependency is already known, it's resolved right away:
+// the task is pushed to its queue if the dependency has completed, and
+// sent to the dead queue if the dependency died (see KillDependents).
+//
+// The task waits until its ExpiresAt if set, or for dependentTTL otherwise,
+// after which it's sent to the dead queue by KillExpiredDependents.
+func (r *RDB) EnqueueDependent(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	killedBytes, err := r.encode(dependentKilled(msg, fmt.Sprintf("dependency %s died", msg.DependsOn), now))
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:resolved:<dependency id>
+	// KEYS[2] -> asynq:dependents:<dependency id>
+	// KEYS[3] -> asynq:dead
+	// KEYS[4] -> asynq:queues
+	// KEYS[5] -> asynq:queues:<qname>
+	// KEYS[6] -> asynq:waiting
+	// KEYS[7] -> asynq:result:<task id>
+	// KEYS[8] -> asynq:result_ready:<task id>
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> base.TaskMessage value to add to Dead queue
+	// ARGV[3] -> died_at UNIX timestamp
+	// ARGV[4] -> r.keys.QueuePrefix
+	// ARGV[5] -> r.keys.PriorityPrefix
+	// ARGV[6] -> r.keys.PriorityAging
+	// ARGV[7] -> current unix time in milliseconds
+	// ARGV[8] -> expiration of the wait in unix time
+	// ARGV[9] -> r.keys.DeadPrefix
+	// ARGV[10] -> max number of tasks in dead queue
+	// ARGV[11] -> pending result record
+	// ARGV[12] -> ttl of the result slot in milliseconds
+	script := redis.NewScript(luaPush + luaDeadIndex + luaReserveResult + `
+	reserve_result(KEYS[7], KEYS[8], ARGV[11], ARGV[12])
+	redis.call("SADD", KEYS[4], KEYS[5])
+	local resolved = redis.call("GET", KEYS[1])
+	if resolved == "` + resolvedDone + `" then
+		push(ARGV[4], ARGV[5], ARGV[6], ARGV[1], ARGV[7])
+	elseif resolved == "` + resolvedDead + `" then
+		redis.call("ZADD", KEYS[3], ARGV[3], ARGV[2])
+		index_dead(KEYS[3], ARGV[9], ARGV[2], ARGV[3], tonumber(ARGV[10]))
+		return 1
+	else
+		redis.call("SADD", KEYS[2], ARGV[1])
+		redis.call("ZADD", KEYS[6], ARGV[8], ARGV[1])
+	end
+	return 0
+	`)
+	expireAt := now.Add(dependentTTL).Unix()
+	if msg.ExpiresAt > 0 {
+		expireAt = msg.ExpiresAt
+	}
+	killed, err := script.Run(r.client,
+		append([]string{r.keys.ResolvedKey(msg.DependsOn), r.keys.DependentsKey(msg.DependsOn),
+			r.keys.DeadQueue, r.keys.AllQueues, r.keys.QueueKey(msg.Queue), r.keys.WaitingTasks},
+			r.resultKeys(msg)...),
+		append([]interface{}{string(bytes), string(killedBytes), now.Unix(),
+			r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis(), expireAt,
+			r.keys.DeadPrefix, maxDeadTasks}, resultArgs(msg)...)...).Int64()
+	if err != nil {
+		return err
+	}
+	if killed == 1 {
+		return r.refreshTTL(r.keys.DeadQueue, r.deadTTL)
+	}
+	return nil
+}
+
+// KillDependents records that the task with the given id died, and sends
+// the tasks waiting for it to the dead queue, along with the tasks waiting
+// for those tasks. It returns the number of tasks killed.
+//
+// Tasks enqueued with a dependency on a killed task within an hour are
+// sent to the dead queue right away.
+func (r *RDB) KillDependents(id xid.ID) (int64, error) {
+	// KEYS[1] -> asynq:resolved:<task id>
+	// KEYS[2] -> asynq:dependents:<task id>
+	// ARGV[1] -> ttl of the resolved outcome in seconds
+	resolve := redis.NewScript(`
+	redis.call("SET", KEYS[1], "` + resolvedDead + `", "EX", ARGV[1])
+	return redis.call("SMEMBERS", KEYS[2])
+	`)
+	// KEYS[1] -> asynq:dependents:<task id>
+	// KEYS[2] -> asynq:dead
+	// KEYS[3] -> asynq:waiting
+	// ARGV[1] -> died_at UNIX timestamp
+	// ARGV[2] -> max number of tasks in dead queue
+	// ARGV[3] -> r.keys.DeadPrefix
+	// ARGV[4:] -> pairs of base.TaskMessage values to remove from the
+	//             dependents and to add to Dead queue
+	kill := redis.NewScript(luaDeadIndex + `
+	for i = 4, table.getn(ARGV), 2 do
+		redis.call("SREM", KEYS[1], ARGV[i])
+		redis.call("ZREM", KEYS[3], ARGV[i])
+		redis.call("ZADD", KEYS[2], ARGV[1], ARGV[i+1])
+	end
+	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[2])
+	for i = 4, table.getn(ARGV), 2 do
+		index_dead(KEYS[2], ARGV[3], ARGV[i+1], ARGV[1], tonumber(ARGV[2]))
+	end
+	return redis.status_reply("OK")
+	`)
+	var killed int64
+	ids := []string{id.String()}
+	for len(ids) > 0 {
+		dep := ids[0]
+		ids = ids[1:]
+		data, err := resolve.Run(r.client,
+			[]string{r.keys.ResolvedKey(dep), r.keys.DependentsKey(dep)},
+			int64(resolvedTTL/time.Second)).Result()
+		if err != nil {
+			return killed, err
+		}
+		members, err := cast.ToStringSliceE(data)
+		if err != nil {
+			return killed, err
+		}
+		if len(members) == 0 {
+			continue
+		}
+		now := r.clock.Now()
+		args := []interface{}{now.Unix(), maxDeadTasks, r.keys.DeadPrefix}
+		for _, s := range members {
+			msg, err := r.decode([]byte(s))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			bytes, err := r.encode(dependentKilled(msg, fmt.Sprintf("dependency %s died", dep), now))
+			if err != nil {
+				continue // bad data, ignore and continue
+			}
+			args = append(args, s, string(bytes))
+			ids = append(ids, msg.ID.String())
+		}
+		err = kill.Run(r.client,
+			[]string{r.keys.DependentsKey(dep), r.keys.DeadQueue, r.keys.WaitingTasks}, args...).Err()
+		if err != nil {
+			return killed, err
+		}
+		killed += int64((len(args) - 3) / 2)
+		if err := r.refreshTTL(r.keys.DeadQueue, r.deadTTL); err != nil {
+			return killed, err
+		}
+	}
+	return killed, nil
+}
+
+// KillExpiredDependents sends the tasks which have been waiting for their
+// dependency past the expiration of the wait (see EnqueueDependent) to the
+// dead queue, along with the tasks waiting for those tasks, and returns
+// the number of tasks killed.
+//
+// It catches the tasks whose dependency will never be resolved, e.g. the
+// dependency completed long before the task was enqueued.
+func (r *RDB) KillExpiredDependents() (int64, error) {
+	now := r.clock.Now()
+	data, err := r.client.ZRangeByScore(r.keys.WaitingTasks,
+		&redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("%d", now.Unix())}).Result()
+	if err != nil {
+		return 0, err
+	}
+	// KEYS[1] -> asynq:waiting
+	// KEYS[2] -> asynq:dependents:<dependency id>
+	// KEYS[3] -> asynq:dead
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> base.TaskMessage value to add to Dead queue
+	// ARGV[3] -> died_at UNIX timestamp
+	// ARGV[4] -> max number of tasks in dead queue
+	// ARGV[5] -> r.keys.DeadPrefix
+	script := redis.NewScript(luaDeadIndex + `
+	if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+		return 0
+	end
+	redis.call("SREM", KEYS[2], ARGV[1])
+	redis.call("ZADD", KEYS[3], ARGV[3], ARGV[2])
+	redis.call("ZREMRANGEBYRANK", KEYS[3], 0, -ARGV[4])
+	index_dead(KEYS[3], ARGV[5], ARGV[2], ARGV[3], tonumber(ARGV[4]))
+	return 1
+	`)
+	var killed int64
+	for _, s := range data {
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			// bad data, remove it so that it's not scanned again.
+			if err := r.client.ZRem(r.keys.WaitingTasks, s).Err(); err != nil {
+				return killed, err
+			}
+			continue
+		}
+		errMsg := fmt.Sprintf("dependency %s was not resolved in time", msg.DependsOn)
+		bytes, err := r.encode(dependentKilled(msg, errMsg, now))
+		if err != nil {
+			return killed, err
+		}
+		n, err := script.Run(r.client,
+			[]string{r.keys.WaitingTasks, r.keys.DependentsKey(msg.DependsOn), r.keys.DeadQueue},
+			s, string(bytes), now.Unix(), maxDeadTasks, r.keys.DeadPrefix).Int64()
+		if err != nil {
+			return killed, err
+		}
+		if n == 0 {
+			continue // resolved in the meantime
+		}
+		killed++
+		n, err = r.KillDependents(msg.ID)
+		killed += n
+		if err != nil {
+			return killed, err
+		}
+	}
+	if killed > 0 {
+		return killed, r.refreshTTL(r.keys.DeadQueue, r.deadTTL)
+	}
+	return killed, nil
+}
+
+// dependentTTL is the duration for which a task without an expiration
+// waits for its dependency (see EnqueueDependent).
+const dependentTTL = 24 * time.Hour
+
+// dependentKilled returns a copy of the task waiting for a dependency,
+// as stored in the dead queue with the given error message when the task
+// is killed, e.g. the dependency died.
+func dependentKilled(msg *base.TaskMessage, errMsg string, now time.Time) *base.TaskMessage {
+	modified := *msg
+	modified.ErrorHistory = appendErrorHistory(msg.ErrorHistory, msg.ErrorMsg)
+	modified.ErrorMsg = errMsg
+	modified.DiedAt = now.Unix()
+	return &modified
+}
+
+// Requeue moves the task from in-progress queue to the head of its
+// queue.
+//
+// Prioritized task is moved to the front of its priority level
+// in the priority queue.
+func (r *RDB) Requeue(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:priority_aging
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> r.keys.QueuePrefix
+	// ARGV[3] -> r.keys.PriorityPrefix
+	script := redis.NewScript(luaPush + `
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	push_front(ARGV[2], ARGV[3], KEYS[2], ARGV[1])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.PriorityAging},
+		string(bytes), r.keys.QueuePrefix, r.keys.PriorityPrefix).Err()
+}
+
+// Postpone moves the task from in-progress queue back to the tail of its queue,
+// so that the tasks behind it get processed first.
+func (r *RDB) Postpone(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> r.keys.QueuePrefix
+	// ARGV[3] -> r.keys.PriorityPrefix
+	// ARGV[4] -> r.keys.PriorityAging
+	// ARGV[5] -> current unix time in milliseconds
+	script := redis.NewScript(luaPush + `
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	push(ARGV[2], ARGV[3], ARGV[4], ARGV[1], ARGV[5])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.inProgress},
+		string(bytes), r.keys.QueuePrefix, r.keys.PriorityPrefix, r.keys.PriorityAging, r.nowInMillis()).Err()
+}
+
+// Abandon moves the task from in-progress queue to abandoned queue
+// so that the task is not processed again until it gets reviewed.
+func (r *RDB) Abandon(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:abandoned
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> abandoned_at UNIX timestamp
+	script := redis.NewScript(`
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.AbandonedQueue},
+		string(bytes), r.clock.Now().Unix()).Err()
+}
+
+// SetIdempotencyKey associates the idempotency key with the task id
+// for the given duration.
+// If the key is already associated with a task, it returns the id of
+// the task and ErrIdempotencyKeyExists.
+func (r *RDB) SetIdempotencyKey(key string, id xid.ID, ttl time.Duration) (xid.ID, error) {
+	// KEYS[1] -> asynq:idempotency:<key>
+	// ARGV[1] -> task ID
+	// ARGV[2] -> ttl in milliseconds
+	script := redis.NewScript(`
+	if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+		return ARGV[1]
+	end
+	return redis.call("GET", KEYS[1])
+	`)
+	res, err := script.Run(r.client, []string{r.keys.IdempotencyKey(key)},
+		id.String(), ttl.Milliseconds()).Result()
+	if err != nil {
+		return xid.ID{}, err
+	}
+	s, err := cast.ToStringE(res)
+	if err != nil {
+		return xid.ID{}, err
+	}
+	if s == id.String() {
+		return id, nil
+	}
+	existing, err := xid.FromString(s)
+	if err != nil {
+		return xid.ID{}, err
+	}
+	return existing, ErrIdempotencyKeyExists
+}
+
+// DeleteIdempotencyKey deletes the idempotency key if it's associated
+// with the task id.
+func (r *RDB) DeleteIdempotencyKey(key string, id xid.ID) error {
+	// KEYS[1] -> asynq:idempotency:<key>
+	// ARGV[1] -> task ID
+	script := redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.keys.IdempotencyKey(key)}, id.String()).Err()
+}
+
+// SetUniqueKey takes the lock of the unique key for the task id for
+// the given duration. It returns ErrDuplicateTask if another task holds
+// the lock.
+func (r *RDB) SetUniqueKey(key string, id xid.ID, ttl time.Duration) error {
+	ok, err := r.client.SetNX(r.keys.UniqueKey(key), id.String(), ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDuplicateTask
+	}
+	return nil
+}
+
+// DeleteUniqueKey releases the lock of the unique key if it's held by
+// the task id.
+func (r *RDB) DeleteUniqueKey(key string, id xid.ID) error {
+	// KEYS[1] -> asynq:unique:<key>
+	// ARGV[1] -> task ID
+	script := redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.keys.UniqueKey(key)}, id.String()).Err()
+}
+
+// LockSerialKey takes the lock of the serial key for the task id for
+// the given duration, and reports whether it's taken. It reports false
+// if another task holds the lock.
+func (r *RDB) LockSerialKey(key string, id xid.ID, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(r.keys.SerialKey(key), id.String(), ttl).Result()
+}
+
+// UnlockSerialKey releases the lock of the serial key if it's held by
+// the task id.
+func (r *RDB) UnlockSerialKey(key string, id xid.ID) error {
+	// KEYS[1] -> asynq:serial:<key>
+	// ARGV[1] -> task ID
+	script := redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client, []string{r.keys.SerialKey(key)}, id.String()).Err()
+}
+
+// releaseUniqueKey releases the lock held by the dequeued task, if any,
+// so that another task with the same key can be enqueued while it's
+// processed.
+// Note: The error is ignored since the lock expires anyway.
+func (r *RDB) releaseUniqueKey(msg *base.TaskMessage) {
+	if msg.UniqueKey != "" {
+		r.DeleteUniqueKey(msg.UniqueKey, msg.ID)
+	}
+}
+
+// MarkStarted records the current time as the start time of the tasks,
+// which is reported by ListStuckTasks while the tasks are in progress.
+// The start time is deleted by ClearStarted once the tasks are finished,
+// or when the tasks are restored, abandoned or reclaimed from a dead server.
+func (r *RDB) MarkStarted(msgs ...*base.TaskMessage) error {
+	now := float64(r.clock.Now().Unix())
+	members := make([]*redis.Z, len(msgs))
+	for i, msg := range msgs {
+		members[i] = &redis.Z{Member: msg.ID.String(), Score: now}
+	}
+	return r.client.ZAdd(r.keys.StartedTasks, members...).Err()
+}
+
+// ClearStarted deletes the start time of the tasks recorded by MarkStarted.
+func (r *RDB) ClearStarted(msgs ...*base.TaskMessage) error {
+	ids := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID.String()
+	}
+	return r.client.ZRem(r.keys.StartedTasks, ids...).Err()
+}
+
+// Hide makes the tasks pulled out of the queues invisible until the given
+// time. Tasks still invisible by then, i.e. not acknowledged with Ack nor
+// extended with ExtendVisibility, are made visible again by RequeueInvisible.
+func (r *RDB) Hide(until time.Time, msgs ...*base.TaskMessage) error {
+	members := make([]*redis.Z, len(msgs))
+	for i, msg := range msgs {
+		bytes, err := r.encode(msg)
+		if err != nil {
+			return err
+		}
+		members[i] = &redis.Z{Member: string(bytes), Score: float64(until.Unix())}
+	}
+	return r.client.ZAdd(r.keys.InvisibleTasks, members...).Err()
+}
+
+// ExtendVisibility keeps the task hidden with Hide invisible until the given
+// time. It reports false if the task is no longer invisible, e.g. it has been
+// made visible again by RequeueInvisible.
+func (r *RDB) ExtendVisibility(msg *base.TaskMessage, until time.Time) (bool, error) {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return false, err
+	}
+	// KEYS[1] -> asynq:invisible
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> visibility expiration UNIX timestamp
 	script := redis.NewScript(`
-	redis.call("LPUSH", KEYS[1], ARGV[1])
-	redis.call("SADD", KEYS[2], KEYS[1])
+	if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+		return 0
+	end
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
 	return 1
 	`)
-	return script.Run(r.client, []string{key, base.AllQueues}, string(bytes)).Err()
+	n, err := script.Run(r.client, []string{r.keys.InvisibleTasks}, string(bytes), until.Unix()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
 }
 
-// Dequeue queries given queues in order and pops a task message if there
-// is one and returns it. If all queues are empty, ErrNoProcessableTask
-// error is returned.
-func (r *RDB) Dequeue(qnames ...string) (*base.TaskMessage, error) {
-	var data string
-	var err error
-	if len(qnames) == 1 {
-		data, err = r.dequeueSingle(base.QueueKey(qnames[0]))
-	} else {
-		var keys []string
-		for _, q := range qnames {
-			keys = append(keys, base.QueueKey(q))
+// Ack acknowledges that the tasks hidden with Hide are finished so that
+// they don't become visible again. Call it once the tasks are removed from
+// the in-progress queue, e.g. with Done.
+func (r *RDB) Ack(msgs ...*base.TaskMessage) error {
+	members := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		bytes, err := r.encode(msg)
+		if err != nil {
+			return err
 		}
-		data, err = r.dequeue(keys...)
-	}
-	if err == redis.Nil {
-		return nil, ErrNoProcessableTask
-	}
-	if err != nil {
-		return nil, err
+		members[i] = string(bytes)
 	}
-	var msg base.TaskMessage
-	err = json.Unmarshal([]byte(data), &msg)
+	return r.client.ZRem(r.keys.InvisibleTasks, members...).Err()
+}
+
+// RequeueInvisible moves the tasks whose visibility timeout has elapsed
+// from the in-progress queue back to their queues, and returns the number
+// of tasks moved. Tasks no longer in progress are just made visible.
+//
+// Note: A task may still be processed when it's moved, in which case it
+// may be processed again.
+func (r *RDB) RequeueInvisible() (int64, error) {
+	// KEYS[1] -> asynq:invisible
+	// KEYS[2] -> asynq:in_progress:<server id>
+	// ARGV[1] -> current unix time
+	// ARGV[2] -> r.keys.QueuePrefix
+	// ARGV[3] -> r.keys.PriorityPrefix
+	// ARGV[4] -> r.keys.PriorityAging
+	// ARGV[5] -> current unix time in milliseconds
+	script := redis.NewScript(luaPush + `
+	local n = 0
+	for _, msg in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])) do
+		redis.call("ZREM", KEYS[1], msg)
+		if redis.call("LREM", KEYS[2], 0, msg) > 0 then
+			push(ARGV[2], ARGV[3], ARGV[4], msg, ARGV[5])
+			n = n + 1
+		end
+	end
+	return n
+	`)
+	return script.Run(r.client, []string{r.keys.InvisibleTasks, r.inProgress},
+		r.clock.Now().Unix(), r.keys.QueuePrefix, r.keys.PriorityPrefix,
+		r.keys.PriorityAging, r.nowInMillis()).Int64()
+}
+
+// ExpirePending registers the task to be removed from its queue at the
+// expiration time of the task (see ExpiresAt of TaskMessage) if it's still
+// waiting to be processed by then. Call it before the task is enqueued.
+func (r *RDB) ExpirePending(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &msg, nil
+	return r.client.ZAdd(r.keys.ExpiringQueue, &redis.Z{Member: string(bytes), Score: float64(msg.ExpiresAt)}).Err()
 }
 
-func (r *RDB) dequeueSingle(queue string) (data string, err error) {
-	// timeout needed to avoid blocking forever
-	return r.client.BRPopLPush(queue, base.InProgressQueue, time.Second).Result()
+// CancelExpiration undoes ExpirePending, e.g. if the task failed to be enqueued.
+func (r *RDB) CancelExpiration(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.ZRem(r.keys.ExpiringQueue, string(bytes)).Err()
 }
 
-func (r *RDB) dequeue(queues ...string) (data string, err error) {
-	var args []interface{}
-	for _, qkey := range queues {
-		args = append(args, qkey)
-	}
+// DeleteExpired removes the tasks past their expiration time which are still
+// waiting to be processed, and returns the number of tasks removed.
+// Tasks already pulled out of the queues are left intact.
+//
+// Note: Lists cannot expire their elements, so the expiration depends on
+// a periodic call to DeleteExpired.
+func (r *RDB) DeleteExpired() (int64, error) {
+	// KEYS[1] -> asynq:expiring
+	// KEYS[2] -> asynq:scheduled
+	// ARGV[1] -> current unix time
+	// ARGV[2] -> r.keys.QueuePrefix
+	// ARGV[3] -> r.keys.PriorityPrefix
 	script := redis.NewScript(`
-	local res
-	for _, qkey in ipairs(ARGV) do
-		res = redis.call("RPOPLPUSH", qkey, KEYS[1])
-		if res then
-			return res
+	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+	local n = 0
+	for _, msg in ipairs(msgs) do
+		local qname = cjson.decode(msg)["Queue"]
+		local removed = redis.call("LREM", ARGV[2] .. qname, 0, msg)
+		removed = removed + redis.call("ZREM", ARGV[3] .. qname, msg)
+		removed = removed + redis.call("ZREM", KEYS[2], msg)
+		if removed > 0 then
+			n = n + 1
 		end
+		redis.call("ZREM", KEYS[1], msg)
 	end
-	return res
+	return n
 	`)
-	res, err := script.Run(r.client, []string{base.InProgressQueue}, args...).Result()
+	res, err := script.Run(r.client,
+		[]string{r.keys.ExpiringQueue, r.keys.ScheduledQueue},
+		r.clock.Now().Unix(), r.keys.QueuePrefix, r.keys.PriorityPrefix).Result()
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
 	}
-	return cast.ToStringE(res)
+	return n, nil
 }
 
-// Done removes the task from in-progress queue to mark the task as done.
-func (r *RDB) Done(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+// Schedule adds the task to the backlog queue to be processed in the future.
+func (r *RDB) Schedule(msg *base.TaskMessage, processAt time.Time) error {
+	bytes, err := r.encode(msg)
 	if err != nil {
 		return err
 	}
-	// Note: LREM count ZERO means "remove all elements equal to val"
-	// KEYS[1] -> asynq:in_progress
-	// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+	// KEYS[1] -> asynq:scheduled
+	// KEYS[2] -> asynq:result:<task id>
+	// KEYS[3] -> asynq:result_ready:<task id>
 	// ARGV[1] -> base.TaskMessage value
-	// ARGV[2] -> stats expiration timestamp
-	script := redis.NewScript(`
-	redis.call("LREM", KEYS[1], 0, ARGV[1]) 
-	local n = redis.call("INCR", KEYS[2])
-	if tonumber(n) == 1 then
-		redis.call("EXPIREAT", KEYS[2], ARGV[2])
-	end
+	// ARGV[2] -> process time in unix time
+	// ARGV[3] -> pending result record
+	// ARGV[4] -> ttl of the result slot in milliseconds
+	script := redis.NewScript(luaReserveResult + `
+	reserve_result(KEYS[2], KEYS[3], ARGV[3], ARGV[4])
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
 	return redis.status_reply("OK")
 	`)
-	now := time.Now()
-	processedKey := base.ProcessedKey(now)
-	expireAt := now.Add(statsTTL)
-	return script.Run(r.client,
-		[]string{base.InProgressQueue, processedKey},
-		string(bytes), expireAt.Unix()).Err()
+	return script.Run(r.client, append([]string{r.keys.ScheduledQueue}, r.resultKeys(msg)...),
+		append([]interface{}{string(bytes), processAt.Unix()}, resultArgs(msg)...)...).Err()
 }
 
-// Requeue moves the task from in-progress queue to the default
-// queue.
-func (r *RDB) Requeue(msg *base.TaskMessage) error {
-	bytes, err := json.Marshal(msg)
+// ScheduleIn adds the task to the backlog queue to be processed after
+// the given duration, and returns the time to process the task.
+// The time is computed using the redis server time so that it's not
+// affected by the local clock.
+func (r *RDB) ScheduleIn(msg *base.TaskMessage, d time.Duration) (time.Time, error) {
+	bytes, err := r.encode(msg)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	// Note: Use RPUSH to push to the head of the queue.
-	// KEYS[1] -> asynq:in_progress
-	// KEYS[2] -> asynq:queues:default
+	// Note: replicate_commands is needed to write after calling
+	// the non-deterministic TIME command (noop since redis 5).
+	// KEYS[1] -> asynq:scheduled
+	// KEYS[2] -> asynq:result:<task id>
+	// KEYS[3] -> asynq:result_ready:<task id>
 	// ARGV[1] -> base.TaskMessage value
-	script := redis.NewScript(`
-	redis.call("LREM", KEYS[1], 0, ARGV[1])
-	redis.call("RPUSH", KEYS[2], ARGV[1])
-	return redis.status_reply("OK")
+	// ARGV[2] -> delay in seconds
+	// ARGV[3] -> pending result record
+	// ARGV[4] -> ttl of the result slot in milliseconds
+	script := redis.NewScript(luaReserveResult + `
+	redis.replicate_commands()
+	reserve_result(KEYS[2], KEYS[3], ARGV[3], ARGV[4])
+	local t = redis.call("TIME")
+	local score = math.floor(tonumber(t[1]) + tonumber(t[2]) / 1000000 + tonumber(ARGV[2]))
+	redis.call("ZADD", KEYS[1], string.format("%.0f", score), ARGV[1])
+	return score
 	`)
-	return script.Run(r.client,
-		[]string{base.InProgressQueue, base.DefaultQueue},
-		string(bytes)).Err()
-}
-
-// Schedule adds the task to the backlog queue to be processed in the future.
-func (r *RDB) Schedule(msg *base.TaskMessage, processAt time.Time) error {
-	bytes, err := json.Marshal(msg)
+	score, err := script.Run(r.client, append([]string{r.keys.ScheduledQueue}, r.resultKeys(msg)...),
+		append([]interface{}{string(bytes), d.Seconds()}, resultArgs(msg)...)...).Int64()
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	score := float64(processAt.Unix())
-	return r.client.ZAdd(base.ScheduledQueue,
-		&redis.Z{Member: string(bytes), Score: score}).Err()
+	return time.Unix(score, 0), nil
 }
 
-// Retry moves the task from in-progress to retry queue, incrementing retry count
-// and assigning error message to the task message.
+// Retry moves the task from in-progress to retry queue, incrementing retry
+// and attempt counts and assigning error message to the task message.
 func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string) error {
-	bytesToRemove, err := json.Marshal(msg)
+	return r.RetryInQueue(msg, msg.Queue, msg.Priority, processAt, errMsg)
+}
+
+// RetryInQueue moves the task to retry queue in the same way as Retry,
+// and changes the queue of the task to qname and its priority to priority
+// so that the task is retried on the queue with the priority.
+func (r *RDB) RetryInQueue(msg *base.TaskMessage, qname string, priority int, processAt time.Time, errMsg string) error {
+	bytesToRemove, err := r.encode(msg)
 	if err != nil {
 		return err
 	}
+	now := r.clock.Now()
 	modified := *msg
 	modified.Retried++
+	modified.Attempts++
+	modified.ErrorHistory = appendErrorHistory(msg.ErrorHistory, msg.ErrorMsg)
 	modified.ErrorMsg = errMsg
-	bytesToAdd, err := json.Marshal(&modified)
+	modified.FailedAt = now.Unix()
+	modified.Queue = qname
+	modified.Priority = priority
+	bytesToAdd, err := r.encode(&modified)
 	if err != nil {
 		return err
 	}
-	// KEYS[1] -> asynq:in_progress
+	// KEYS[1] -> asynq:in_progress:<server id>
 	// KEYS[2] -> asynq:retry
 	// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
 	// KEYS[4] -> asynq:failure:<yyyy-mm-dd>
-	// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+	// ARGV[1] -> base.TaskMessage value to remove from the in-progress queue
 	// ARGV[2] -> base.TaskMessage value to add to Retry queue
 	// ARGV[3] -> retry_at UNIX timestamp
 	// ARGV[4] -> stats expiration timestamp
@@ -206,13 +1945,77 @@ func (r *RDB) Retry(msg *base.TaskMessage, processAt time.Time, errMsg string) e
 	end
 	return redis.status_reply("OK")
 	`)
-	now := time.Now()
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
+	processedKey := r.keys.ProcessedKey(now)
+	failureKey := r.keys.FailureKey(now)
 	expireAt := now.Add(statsTTL)
-	return script.Run(r.client,
-		[]string{base.InProgressQueue, base.RetryQueue, processedKey, failureKey},
+	err = script.Run(r.client,
+		[]string{r.inProgress, r.keys.RetryQueue, processedKey, failureKey},
 		string(bytesToRemove), string(bytesToAdd), processAt.Unix(), expireAt.Unix()).Err()
+	if err != nil {
+		return err
+	}
+	return r.refreshTTL(r.keys.RetryQueue, r.retryTTL)
+}
+
+// Snooze moves the task from in-progress queue to scheduled queue to be
+// processed again at the specified time. Unlike Retry, it does not count
+// the attempt toward the retry limit nor as a failure, but increments
+// the attempt count of the task.
+func (r *RDB) Snooze(msg *base.TaskMessage, processAt time.Time) error {
+	bytesToRemove, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	modified := *msg
+	modified.Attempts++
+	bytesToAdd, err := r.encode(&modified)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:scheduled
+	// ARGV[1] -> base.TaskMessage value to remove from the in-progress queue
+	// ARGV[2] -> base.TaskMessage value to add to Scheduled queue
+	// ARGV[3] -> process_at UNIX timestamp
+	script := redis.NewScript(`
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+	return redis.status_reply("OK")
+	`)
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.ScheduledQueue},
+		string(bytesToRemove), string(bytesToAdd), processAt.Unix()).Err()
+}
+
+// Drop removes the task from in-progress queue to discard the task
+// without retrying it. The task is counted as a failure.
+func (r *RDB) Drop(msg *base.TaskMessage) error {
+	bytes, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:processed:<yyyy-mm-dd>
+	// KEYS[3] -> asynq:failure:<yyyy-mm-dd>
+	// ARGV[1] -> base.TaskMessage value
+	// ARGV[2] -> stats expiration timestamp
+	script := redis.NewScript(`
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	local n = redis.call("INCR", KEYS[2])
+	if tonumber(n) == 1 then
+		redis.call("EXPIREAT", KEYS[2], ARGV[2])
+	end
+	local m = redis.call("INCR", KEYS[3])
+	if tonumber(m) == 1 then
+		redis.call("EXPIREAT", KEYS[3], ARGV[2])
+	end
+	return redis.status_reply("OK")
+	`)
+	now := r.clock.Now()
+	expireAt := now.Add(statsTTL)
+	return script.Run(r.client,
+		[]string{r.inProgress, r.keys.ProcessedKey(now), r.keys.FailureKey(now)},
+		string(bytes), expireAt.Unix()).Err()
 }
 
 const (
@@ -220,40 +2023,125 @@ const (
 	deadExpirationInDays = 90
 )
 
+// luaDeadIndex defines lua functions which maintain the index of the dead
+// tasks of each queue (see base.DeadKey), so that the dead tasks of a queue
+// are counted and evicted without scanning the dead queue.
+//
+// index_dead adds the message, which has been added to the dead queue with
+// the score, to the index of its queue, and evicts the oldest dead tasks of
+// the queue from the dead queue to keep at most max of them.
+// unindex_dead removes the message from the index of its queue.
+//
+// deadkey -> r.keys.DeadQueue
+// dprefix -> r.keys.DeadPrefix
+// msg     -> base.TaskMessage value
+// score   -> died_at UNIX timestamp
+// max     -> max number of dead tasks of the queue
+//
+// Note: The index is built from the dead queue if it doesn't exist, e.g.
+// for the tasks killed before the index was introduced. Tasks removed from
+// the dead queue by its trims are left in the index, but they're the oldest
+// ones and thus evicted from the index first without effect.
+const luaDeadIndex = `
+local function index_dead(deadkey, dprefix, msg, score, max)
+	local qname = cjson.decode(msg)["Queue"]
+	local key = dprefix .. qname
+	if redis.call("EXISTS", key) == 0 then
+		local entries = redis.call("ZRANGE", deadkey, 0, -1, "WITHSCORES")
+		for i = 1, table.getn(entries), 2 do
+			if cjson.decode(entries[i])["Queue"] == qname then
+				redis.call("ZADD", key, entries[i+1], entries[i])
+			end
+		end
+	end
+	redis.call("ZADD", key, score, msg)
+	local n = redis.call("ZCARD", key) - max
+	if n > 0 then
+		local evicted = redis.call("ZPOPMIN", key, n)
+		for i = 1, table.getn(evicted), 2 do
+			redis.call("ZREM", deadkey, evicted[i])
+		end
+	end
+end
+
+local function unindex_dead(dprefix, msg)
+	redis.call("ZREM", dprefix .. cjson.decode(msg)["Queue"], msg)
+end
+`
+
+// maxErrorHistory is the max number of previous error messages kept in a task.
+const maxErrorHistory = 10
+
+// appendErrorHistory returns a new history with errMsg appended to the given
+// history, dropping the oldest entries to keep at most maxErrorHistory entries.
+func appendErrorHistory(history []string, errMsg string) []string {
+	if errMsg == "" {
+		return history
+	}
+	res := append(append([]string(nil), history...), errMsg)
+	if len(res) > maxErrorHistory {
+		res = res[len(res)-maxErrorHistory:]
+	}
+	return res
+}
+
 // Kill sends the task to "dead" queue from in-progress queue, assigning
 // the error message to the task.
 // It also trims the set by timestamp and set size.
-func (r *RDB) Kill(msg *base.TaskMessage, errMsg string) error {
-	bytesToRemove, err := json.Marshal(msg)
+//
+// The task stored in the dead queue is a snapshot of the task at the time of
+// death, stamped with the time and the ID of the server which killed it.
+// Note: Each dead task keeps up to 10 previous error messages in addition to
+// the last one, so long error messages increase the memory used by the dead queue.
+//
+// If maxPerQueue is positive, it keeps at most maxPerQueue dead tasks
+// from the task's queue by evicting the oldest ones, which are looked up
+// in the index of the dead tasks of the queue.
+func (r *RDB) Kill(msg *base.TaskMessage, errMsg, serverID string, maxPerQueue int) error {
+	_, err := r.KillMessage(msg, errMsg, serverID, maxPerQueue)
+	return err
+}
+
+// KillMessage is like Kill, but it also returns the task as stored in
+// the dead queue.
+func (r *RDB) KillMessage(msg *base.TaskMessage, errMsg, serverID string, maxPerQueue int) (*base.TaskMessage, error) {
+	bytesToRemove, err := r.encode(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	now := r.clock.Now()
 	modified := *msg
+	modified.ErrorHistory = appendErrorHistory(msg.ErrorHistory, msg.ErrorMsg)
 	modified.ErrorMsg = errMsg
-	bytesToAdd, err := json.Marshal(&modified)
+	modified.DiedAt = now.Unix()
+	modified.ServerID = serverID
+	bytesToAdd, err := r.encode(&modified)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	now := time.Now()
 	limit := now.AddDate(0, 0, -deadExpirationInDays).Unix() // 90 days ago
-	processedKey := base.ProcessedKey(now)
-	failureKey := base.FailureKey(now)
+	processedKey := r.keys.ProcessedKey(now)
+	failureKey := r.keys.FailureKey(now)
 	expireAt := now.Add(statsTTL)
-	// KEYS[1] -> asynq:in_progress
+	// KEYS[1] -> asynq:in_progress:<server id>
 	// KEYS[2] -> asynq:dead
 	// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
 	// KEYS[4] -> asynq.failure:<yyyy-mm-dd>
-	// ARGV[1] -> base.TaskMessage value to remove from base.InProgressQueue queue
+	// KEYS[5] -> asynq:dead_tasks
+	// ARGV[1] -> base.TaskMessage value to remove from the in-progress queue
 	// ARGV[2] -> base.TaskMessage value to add to Dead queue
 	// ARGV[3] -> died_at UNIX timestamp
 	// ARGV[4] -> cutoff timestamp (e.g., 90 days ago)
 	// ARGV[5] -> max number of tasks in dead queue (e.g., 100)
 	// ARGV[6] -> stats expiration timestamp
-	script := redis.NewScript(`
+	// ARGV[7] -> max number of dead tasks of the queue
+	// ARGV[8] -> r.keys.DeadPrefix
+	script := redis.NewScript(luaDeadIndex + `
 	redis.call("LREM", KEYS[1], 0, ARGV[1])
 	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
 	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[4])
 	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, -ARGV[5])
+	index_dead(KEYS[2], ARGV[8], ARGV[2], ARGV[3], tonumber(ARGV[7]))
 	local n = redis.call("INCR", KEYS[3])
 	if tonumber(n) == 1 then
 		redis.call("EXPIREAT", KEYS[3], ARGV[6])
@@ -262,24 +2150,248 @@ func (r *RDB) Kill(msg *base.TaskMessage, errMsg string) error {
 	if tonumber(m) == 1 then
 		redis.call("EXPIREAT", KEYS[4], ARGV[6])
 	end
+	redis.call("PUBLISH", KEYS[5], ARGV[2])
+	return redis.status_reply("OK")
+	`)
+	if maxPerQueue <= 0 || maxPerQueue > maxDeadTasks {
+		// Note: No more than maxDeadTasks tasks are kept in the dead queue anyway.
+		maxPerQueue = maxDeadTasks
+	}
+	err = script.Run(r.client,
+		[]string{r.inProgress, r.keys.DeadQueue, processedKey, failureKey, r.keys.DeadChannel},
+		string(bytesToRemove), string(bytesToAdd), now.Unix(), limit, maxDeadTasks, expireAt.Unix(),
+		maxPerQueue, r.keys.DeadPrefix).Err()
+	if err != nil {
+		return nil, err
+	}
+	return &modified, r.refreshTTL(r.keys.DeadQueue, r.deadTTL)
+}
+
+// Defer moves the task from in-progress queue to the deferred dead queue,
+// instead of killing it, to be retried at the specified time.
+// It increments the dead retry count and assigns the error message to the
+// task, and counts the task as a failure.
+func (r *RDB) Defer(msg *base.TaskMessage, processAt time.Time, errMsg string) error {
+	bytesToRemove, err := r.encode(msg)
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	modified := *msg
+	modified.DeadRetried++
+	modified.ErrorHistory = appendErrorHistory(msg.ErrorHistory, msg.ErrorMsg)
+	modified.ErrorMsg = errMsg
+	modified.FailedAt = now.Unix()
+	bytesToAdd, err := r.encode(&modified)
+	if err != nil {
+		return err
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:deferred
+	// KEYS[3] -> asynq:processed:<yyyy-mm-dd>
+	// KEYS[4] -> asynq:failure:<yyyy-mm-dd>
+	// ARGV[1] -> base.TaskMessage value to remove from the in-progress queue
+	// ARGV[2] -> base.TaskMessage value to add to Deferred queue
+	// ARGV[3] -> process_at UNIX timestamp
+	// ARGV[4] -> stats expiration timestamp
+	script := redis.NewScript(`
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+	local n = redis.call("INCR", KEYS[3])
+	if tonumber(n) == 1 then
+		redis.call("EXPIREAT", KEYS[3], ARGV[4])
+	end
+	local m = redis.call("INCR", KEYS[4])
+	if tonumber(m) == 1 then
+		redis.call("EXPIREAT", KEYS[4], ARGV[4])
+	end
 	return redis.status_reply("OK")
 	`)
+	expireAt := now.Add(statsTTL)
 	return script.Run(r.client,
-		[]string{base.InProgressQueue, base.DeadQueue, processedKey, failureKey},
-		string(bytesToRemove), string(bytesToAdd), now.Unix(), limit, maxDeadTasks, expireAt.Unix()).Err()
+		[]string{r.inProgress, r.keys.DeferredQueue, r.keys.ProcessedKey(now), r.keys.FailureKey(now)},
+		string(bytesToRemove), string(bytesToAdd), processAt.Unix(), expireAt.Unix()).Err()
+}
+
+// TryRestoreLock acquires the lock to restore the unfinished tasks of the
+// shared in-progress list for the given server, and reports whether it's
+// acquired. The lock is not released but expires after ttl, so that only
+// one of the servers starting within ttl of each other restores the tasks.
+//
+// If r is scoped to the in-progress list of a server (see ScopeInProgress),
+// there's nothing to coordinate and it always reports true.
+func (r *RDB) TryRestoreLock(serverID string, ttl time.Duration) (bool, error) {
+	if r.inProgress != r.keys.InProgressQueue {
+		return true, nil
+	}
+	return r.client.SetNX(r.keys.RestoreLock, serverID, ttl).Result()
 }
 
 // RestoreUnfinished  moves all tasks from in-progress list to the queue
 // and reports the number of tasks restored.
+//
+// Prioritized tasks are moved back to the priority queue they came from.
 func (r *RDB) RestoreUnfinished() (int64, error) {
+	n, _, err := r.restoreUnfinished(time.Time{})
+	return n, err
+}
+
+// RestoreUnexpired is like RestoreUnfinished but leaves the tasks whose
+// deadline has passed in the in-progress list, and returns them so that
+// they can be killed or dropped instead of processed too late.
+func (r *RDB) RestoreUnexpired() (restored int64, expired []*base.TaskMessage, err error) {
+	n, data, err := r.restoreUnfinished(r.clock.Now())
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, s := range data {
+		msg, err := r.decode([]byte(s))
+		if err != nil {
+			return n, expired, err
+		}
+		expired = append(expired, msg)
+	}
+	return n, expired, nil
+}
+
+// restoreUnfinished restores the unfinished tasks, except for the ones
+// whose deadline is before now unless now is zero, and returns the number
+// of tasks restored and the data of the tasks left in the in-progress list.
+func (r *RDB) restoreUnfinished(now time.Time) (int64, []string, error) {
+	var nowUnix int64
+	if !now.IsZero() {
+		nowUnix = now.Unix()
+	}
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:priority_aging
+	// KEYS[3] -> asynq:handed_off
+	// KEYS[4] -> asynq:started
+	// ARGV[1] -> r.keys.QueuePrefix
+	// ARGV[2] -> r.keys.PriorityPrefix
+	// ARGV[3] -> current unix time in seconds, or 0 to ignore deadlines
+	// ARGV[4] -> current unix time in seconds to expire the handoff marks
+	script := redis.NewScript(luaPush + `
+	local now = tonumber(ARGV[3])
+	-- the marks past their expiration no longer protect the tasks.
+	redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", "(" .. ARGV[4])
+	local len = redis.call("LLEN", KEYS[1])
+	local n = 0
+	local expired = {}
+	for i = len, 1, -1 do
+		local msg = redis.call("RPOP", KEYS[1])
+		local decoded = cjson.decode(msg)
+		local deadline = tonumber(decoded["Deadline"]) or 0
+		local handedOff = redis.call("ZSCORE", KEYS[3], decoded["ID"]) ~= false
+		if not handedOff then
+			-- no longer started by this server.
+			redis.call("ZREM", KEYS[4], decoded["ID"])
+		end
+		if handedOff then
+			-- taken over by another server on handoff.
+			redis.call("LPUSH", KEYS[1], msg)
+		elseif now > 0 and deadline > 0 and deadline < now then
+			redis.call("LPUSH", KEYS[1], msg)
+			table.insert(expired, msg)
+		else
+			push(ARGV[1], ARGV[2], KEYS[2], msg, 0)
+			n = n + 1
+		end
+	end
+	return {n, expired}
+	`)
+	res, err := script.Run(r.client,
+		[]string{r.inProgress, r.keys.PriorityAging, r.keys.HandedOff, r.keys.StartedTasks},
+		r.keys.QueuePrefix, r.keys.PriorityPrefix, nowUnix, r.clock.Now().Unix()).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return 0, nil, fmt.Errorf("unexpected return value from restore script: %v", res)
+	}
+	n, ok := vals[0].(int64)
+	if !ok {
+		return 0, nil, fmt.Errorf("could not cast %v to int64", vals[0])
+	}
+	data, err := cast.ToStringSliceE(vals[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, data, nil
+}
+
+// AbandonUnfinished moves all tasks from in-progress list to the abandoned
+// queue and reports the number of tasks moved.
+func (r *RDB) AbandonUnfinished() (int64, error) {
+	// KEYS[1] -> asynq:in_progress:<server id>
+	// KEYS[2] -> asynq:abandoned
+	// KEYS[3] -> asynq:started
+	// ARGV[1] -> abandoned_at UNIX timestamp
 	script := redis.NewScript(`
 	local len = redis.call("LLEN", KEYS[1])
 	for i = len, 1, -1 do
-		redis.call("RPOPLPUSH", KEYS[1], KEYS[2])
+		local msg = redis.call("RPOP", KEYS[1])
+		redis.call("ZADD", KEYS[2], ARGV[1], msg)
+		redis.call("ZREM", KEYS[3], cjson.decode(msg)["ID"])
 	end
 	return len
 	`)
-	res, err := script.Run(r.client, []string{base.InProgressQueue, base.DefaultQueue}).Result()
+	res, err := script.Run(r.client,
+		[]string{r.inProgress, r.keys.AbandonedQueue, r.keys.StartedTasks}, r.clock.Now().Unix()).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n, nil
+}
+
+// HandOff moves the given tasks from in-progress list to the handoff lists
+// of their queues, from which the tasks are dequeued ahead of the queues,
+// and reports the number of tasks moved. Tasks no longer in progress are
+// skipped.
+//
+// The tasks are marked as handed off until ClearHandoff is called or ttl
+// elapses, and the marked tasks are left in the in-progress list when the
+// unfinished tasks are restored, so that a server restarting doesn't requeue
+// a task taken over by another server. Once the mark expires, e.g. the server
+// which took over the task crashed, the task is restored as any other task.
+func (r *RDB) HandOff(ttl time.Duration, msgs ...*base.TaskMessage) (int64, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	now := r.clock.Now()
+	args := []interface{}{r.keys.HandoffPrefix, now.Add(ttl).Unix(), now.Unix()}
+	for _, msg := range msgs {
+		bytes, err := r.encode(msg)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, string(bytes))
+	}
+	// KEYS[1]    -> asynq:in_progress:<server id>
+	// KEYS[2]    -> asynq:handed_off
+	// ARGV[1]    -> r.keys.HandoffPrefix
+	// ARGV[2]    -> expiration of the marks in unix time
+	// ARGV[3]    -> current unix time
+	// ARGV[4...] -> task messages to hand off
+	script := redis.NewScript(`
+	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[3])
+	local n = 0
+	for i = 4, table.getn(ARGV) do
+		if redis.call("LREM", KEYS[1], 0, ARGV[i]) > 0 then
+			local decoded = cjson.decode(ARGV[i])
+			redis.call("LPUSH", ARGV[1] .. decoded["Queue"], ARGV[i])
+			redis.call("ZADD", KEYS[2], ARGV[2], decoded["ID"])
+			n = n + 1
+		end
+	end
+	return n
+	`)
+	res, err := script.Run(r.client,
+		[]string{r.inProgress, r.keys.HandedOff}, args...).Result()
 	if err != nil {
 		return 0, err
 	}
@@ -290,16 +2402,41 @@ func (r *RDB) RestoreUnfinished() (int64, error) {
 	return n, nil
 }
 
+// ClearHandoff removes the handoff mark of the tasks set by HandOff,
+// once the tasks are finished.
+func (r *RDB) ClearHandoff(msgs ...*base.TaskMessage) error {
+	ids := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID.String()
+	}
+	return r.client.ZRem(r.keys.HandedOff, ids...).Err()
+}
+
 // CheckAndEnqueue checks for all scheduled tasks and enqueues any tasks that
 // have to be processed.
 //
+// Tasks in the retry queue are promoted the same way as scheduled tasks,
+// i.e. once the score (the time to process the task) is due, so a retried
+// task becomes pending at the retry time shown in ListRetry.
+//
+// Whether a task is due is determined by the time of the redis server,
+// so that the clocks of the processes moving backward don't stall the
+// promotion. Clocks of the clients and the server are assumed to be in sync
+// apart from such corrections.
+//
+// Note: Only the promotion uses the time of the server. The scores are
+// computed by the processes writing them (e.g., the retry time by the clock
+// of the background, and the process time by the clock of the client except
+// with ScheduleIn), and the deadlines compared by RequeueInvisible and
+// DeleteExpired are compared against the clock of r, which writes them.
+//
 // qnames specifies to which queues to send tasks.
 func (r *RDB) CheckAndEnqueue(qnames ...string) error {
-	delayed := []string{base.ScheduledQueue, base.RetryQueue}
+	delayed := []string{r.keys.ScheduledQueue, r.keys.RetryQueue}
 	for _, zset := range delayed {
 		var err error
 		if len(qnames) == 1 {
-			err = r.forwardSingle(zset, base.QueueKey(qnames[0]))
+			err = r.forwardSingle(zset, qnames[0])
 		} else {
 			err = r.forward(zset)
 		}
@@ -310,36 +2447,121 @@ func (r *RDB) CheckAndEnqueue(qnames ...string) error {
 	return nil
 }
 
+// ForwardScheduled moves the due tasks in the scheduled queue to the queues
+// in the same way as CheckAndEnqueue, leaving the retry queue untouched.
+func (r *RDB) ForwardScheduled(qnames ...string) error {
+	if len(qnames) == 1 {
+		return r.forwardSingle(r.keys.ScheduledQueue, qnames[0])
+	}
+	return r.forward(r.keys.ScheduledQueue)
+}
+
+// ForwardDeferred moves the due tasks in the deferred dead queue to the
+// queues in the same way as CheckAndEnqueue.
+func (r *RDB) ForwardDeferred(qnames ...string) error {
+	if len(qnames) == 1 {
+		return r.forwardSingle(r.keys.DeferredQueue, qnames[0])
+	}
+	return r.forward(r.keys.DeferredQueue)
+}
+
+// ForwardRetry moves at most limit due tasks in the retry queue to each
+// queue, oldest first, and returns the number of tasks moved.
+// As with CheckAndEnqueue, all the tasks are moved to the queue if only one
+// queue name is given.
+func (r *RDB) ForwardRetry(limit int, qnames ...string) (int64, error) {
+	var single string
+	if len(qnames) == 1 {
+		single = strings.ToLower(qnames[0])
+	}
+	// KEYS[1] -> asynq:retry
+	// KEYS[2] -> asynq:priority_aging
+	// ARGV[1] -> max number of tasks to move to each queue
+	// ARGV[2] -> r.keys.QueuePrefix
+	// ARGV[3] -> r.keys.PriorityPrefix
+	// ARGV[4] -> current unix time in milliseconds
+	// ARGV[5] -> queue name to move all the tasks to (empty for their own queues)
+	// ARGV[6] -> r.serverNow()
+	script := redis.NewScript(luaServerTime + luaPush + `
+	redis.replicate_commands()
+	local limit = tonumber(ARGV[1])
+	local single = ARGV[5]
+	local counts = {}
+	local moved = 0
+	for _, msg in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", server_time(ARGV[6]))) do
+		local decoded = cjson.decode(msg)
+		local qname = single
+		if qname == "" then
+			qname = decoded["Queue"]
+		end
+		local n = counts[qname] or 0
+		if n < limit then
+			counts[qname] = n + 1
+			moved = moved + 1
+			redis.call("ZREM", KEYS[1], msg)
+			if single == "" then
+				push(ARGV[2], ARGV[3], KEYS[2], msg, ARGV[4])
+			else
+				local p = tonumber(decoded["Priority"]) or 0
+				if p > 0 then
+					redis.call("ZADD", ARGV[3] .. single, priority_score(KEYS[2], single, p, ARGV[4]), msg)
+				else
+					redis.call("LPUSH", ARGV[2] .. single, msg)
+				end
+			end
+		end
+	end
+	return moved
+	`)
+	res, err := script.Run(r.client, []string{r.keys.RetryQueue, r.keys.PriorityAging},
+		limit, r.keys.QueuePrefix, r.keys.PriorityPrefix, r.nowInMillis(), single, r.serverNow()).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("could not cast %v to int64", res)
+	}
+	return n, nil
+}
+
 // forward moves all tasks with a score less than the current unix time
-// from the src zset.
+// of the redis server from the src zset.
 func (r *RDB) forward(src string) error {
-	script := redis.NewScript(`
-	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+	script := redis.NewScript(luaServerTime + luaPush + `
+	redis.replicate_commands()
+	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", server_time(ARGV[5]))
 	for _, msg in ipairs(msgs) do
 		redis.call("ZREM", KEYS[1], msg)
-		local decoded = cjson.decode(msg)
-		local qkey = ARGV[2] .. decoded["Queue"]
-		redis.call("LPUSH", qkey, msg)
+		push(ARGV[1], ARGV[2], ARGV[3], msg, ARGV[4])
 	end
 	return msgs
 	`)
-	now := float64(time.Now().Unix())
 	return script.Run(r.client,
-		[]string{src}, now, base.QueuePrefix).Err()
+		[]string{src}, r.keys.QueuePrefix, r.keys.PriorityPrefix,
+		r.keys.PriorityAging, r.nowInMillis(), r.serverNow()).Err()
 }
 
 // forwardSingle moves all tasks with a score less than the current unix time
-// from the src zset to dst list.
-func (r *RDB) forwardSingle(src, dst string) error {
-	script := redis.NewScript(`
-	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+// of the redis server from the src zset to dst list.
+//
+// Prioritized tasks are moved to the priority queue of dst instead.
+func (r *RDB) forwardSingle(src, qname string) error {
+	script := redis.NewScript(luaServerTime + luaPriorityScore + `
+	redis.replicate_commands()
+	local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", server_time(ARGV[3]))
 	for _, msg in ipairs(msgs) do
 		redis.call("ZREM", KEYS[1], msg)
-		redis.call("LPUSH", KEYS[2], msg)
+		local p = tonumber(cjson.decode(msg)["Priority"]) or 0
+		if p > 0 then
+			redis.call("ZADD", KEYS[3], priority_score(KEYS[4], ARGV[2], p, ARGV[1]), msg)
+		else
+			redis.call("LPUSH", KEYS[2], msg)
+		end
 	end
 	return msgs
 	`)
-	now := float64(time.Now().Unix())
 	return script.Run(r.client,
-		[]string{src, dst}, now).Err()
+		[]string{src, r.keys.QueueKey(qname), r.keys.PriorityQueueKey(qname), r.keys.PriorityAging},
+		r.nowInMillis(), strings.ToLower(qname), r.serverNow()).Err()
 }
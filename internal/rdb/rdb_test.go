@@ -5,14 +5,19 @@
 package rdb
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/rs/xid"
 )
 
 // TODO(hibiken): Get Redis address and db number from ENV variables.
@@ -27,6 +32,20 @@ func setup(t *testing.T) *RDB {
 	return r
 }
 
+func TestClose(t *testing.T) {
+	r := setup(t)
+	if err := r.client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("(*RDB).Close() = %v, want nil", err)
+	}
+	if n := r.client.PoolStats().TotalConns; n != 0 {
+		t.Errorf("%d connections remain open after (*RDB).Close(), want 0", n)
+	}
+}
+
 func TestEnqueue(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"to": "exampleuser@gmail.com", "from": "noreply@example.com"})
@@ -181,101 +200,241 @@ func TestDequeue(t *testing.T) {
 	}
 }
 
-func TestDone(t *testing.T) {
+func TestDequeueMessageFromOtherClient(t *testing.T) {
+	r := setup(t)
+	// Written by a client in another language, with a field unknown to
+	// this version.
+	data := `{"Version": 1, "ID": "9m4e2mr0ui3e8a215n4g", "Type": "send_email", "Queue": "default", "Payload": {"user_id": 42}, "Retry": 25, "Tenant": "acme"}`
+	if err := r.client.LPush(base.DefaultQueue, data).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", "default", err)
+	}
+	if msg.Type != "send_email" || msg.Retry != 25 || msg.Version != 1 {
+		t.Errorf("(*RDB).Dequeue(%q) = %+v, want the message written by the other client", "default", msg)
+	}
+	// The message is removed from the in-progress queue once processed,
+	// even though it's encoded differently by this package.
+	if err := r.Done(msg); err != nil {
+		t.Fatalf("(*RDB).Done(msg) = %v, want nil", err)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("LLEN %q = %d after the task is done, want 0", base.InProgressQueue, n)
+	}
+}
+
+func TestDequeueBlocksOnFirstQueue(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+
+	type result struct {
+		msg *base.TaskMessage
+		err error
+	}
+	ch := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		msg, err := r.Dequeue("critical", "default", "low")
+		ch <- result{msg, err}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if err := r.Enqueue(t1); err != nil {
+		t.Fatalf("(*RDB).Enqueue(msg) = %v, want nil", err)
+	}
+
+	res := <-ch
+	if res.err != nil {
+		t.Fatalf("(*RDB).Dequeue() returned error: %v", res.err)
+	}
+	if diff := cmp.Diff(t1, res.msg); diff != "" {
+		t.Errorf("(*RDB).Dequeue() = %v, want %v; (-want,+got):\n%s", res.msg, t1, diff)
+	}
+	// the task should be picked up as soon as it's enqueued rather than on timeout.
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("(*RDB).Dequeue() took %v, want it to return as soon as the task is enqueued", elapsed)
+	}
+}
+
+func TestEnqueueWithPriority(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
-	t2 := h.NewTaskMessage("export_csv", nil)
+	t1.Priority = 1
+	t2 := h.NewTaskMessage("generate_csv", nil)
+	t2.Priority = 5
+	t3 := h.NewTaskMessage("sync", nil)
+	t3.Priority = 1
+	t4 := h.NewTaskMessage("reindex", nil)
 
-	tests := []struct {
-		inProgress     []*base.TaskMessage // initial state of the in-progress list
-		target         *base.TaskMessage   // task to remove
-		wantInProgress []*base.TaskMessage // final state of the in-progress list
-	}{
-		{
-			inProgress:     []*base.TaskMessage{t1, t2},
-			target:         t1,
-			wantInProgress: []*base.TaskMessage{t2},
-		},
-		{
-			inProgress:     []*base.TaskMessage{t1},
-			target:         t1,
-			wantInProgress: []*base.TaskMessage{},
-		},
+	// enqueue in this order.
+	msgs := []*base.TaskMessage{t1, t2, t3, t4}
+	for _, msg := range msgs {
+		time.Sleep(2 * time.Millisecond) // make sure each task has distinct enqueue time.
+		if err := r.Enqueue(msg); err != nil {
+			t.Fatalf("(*RDB).Enqueue(msg) = %v, want nil", err)
+		}
 	}
 
-	for _, tc := range tests {
-		h.FlushDB(t, r.client) // clean up db before each test case
-		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+	// prioritized tasks should be ordered by priority, then by enqueue time.
+	wantPriority := []*base.TaskMessage{t2, t1, t3}
+	gotPriority := h.GetPriorityMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff(wantPriority, gotPriority); diff != "" {
+		t.Errorf("mismatch found in %q: (-want,+got):\n%s", base.PriorityQueueKey(base.DefaultQueueName), diff)
+	}
+	wantEnqueued := []*base.TaskMessage{t4}
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff(wantEnqueued, gotEnqueued); diff != "" {
+		t.Errorf("mismatch found in %q: (-want,+got):\n%s", base.DefaultQueue, diff)
+	}
+	if !r.client.SIsMember(base.AllQueues, base.DefaultQueue).Val() {
+		t.Errorf("%q is not a member of SET %q", base.DefaultQueue, base.AllQueues)
+	}
 
-		err := r.Done(tc.target)
+	// dequeue should return prioritized tasks first.
+	want := []*base.TaskMessage{t2, t1, t3, t4}
+	for _, w := range want {
+		got, err := r.Dequeue(base.DefaultQueueName, "low")
 		if err != nil {
-			t.Errorf("(*RDB).Done(task) = %v, want nil", err)
-			continue
+			t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+		}
+		if diff := cmp.Diff(w, got); diff != "" {
+			t.Errorf("(*RDB).Dequeue() = %v, want %v; (-want,+got):\n%s", got, w, diff)
 		}
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff(want, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want,+got):\n%s", base.InProgressQueue, diff)
+	}
+}
 
-		gotInProgress := h.GetInProgressMessages(t, r.client)
-		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
-			continue
+func TestPriorityAging(t *testing.T) {
+	tests := []struct {
+		aging  time.Duration
+		wait   time.Duration
+		wantID int // index of the task to be dequeued first
+	}{
+		// without aging, the fresh task with higher priority is dequeued first.
+		{aging: 0, wait: time.Hour, wantID: 1},
+		// the old task has not waited long enough to catch up.
+		{aging: time.Minute, wait: time.Minute, wantID: 1},
+		// the old task has gained enough priority levels while waiting.
+		{aging: time.Minute, wait: 3 * time.Minute, wantID: 0},
+	}
+
+	r := setup(t)
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		clock := base.NewSimulatedClock(time.Now())
+		r.SetClock(clock)
+		if err := r.SetPriorityAging(tc.aging, "default"); err != nil {
+			t.Fatalf("(*RDB).SetPriorityAging(%v) = %v, want nil", tc.aging, err)
 		}
 
-		processedKey := base.ProcessedKey(time.Now())
-		gotProcessed := r.client.Get(processedKey).Val()
-		if gotProcessed != "1" {
-			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
+		old := h.NewTaskMessage("send_email", nil)
+		old.Priority = 1
+		fresh := h.NewTaskMessage("send_email", nil)
+		fresh.Priority = 3
+		if err := r.Enqueue(old); err != nil {
+			t.Fatal(err)
+		}
+		clock.AdvanceTime(tc.wait)
+		if err := r.Enqueue(fresh); err != nil {
+			t.Fatal(err)
 		}
 
-		gotTTL := r.client.TTL(processedKey).Val()
-		if gotTTL > statsTTL {
-			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
+		want := []*base.TaskMessage{old, fresh}[tc.wantID]
+		got, err := r.Dequeue("default")
+		if err != nil || got.ID != want.ID {
+			t.Errorf("with aging %v and wait %v; (*RDB).Dequeue() = %v, %v; want %v, nil",
+				tc.aging, tc.wait, got, err, want)
 		}
 	}
+
+	// Zero aging period removes the setting.
+	if err := r.SetPriorityAging(0, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.HLen(base.PriorityAging).Val(); n != 0 {
+		t.Errorf("%q has %d fields, want 0", base.PriorityAging, n)
+	}
 }
 
-func TestRequeue(t *testing.T) {
+func TestDequeueBatch(t *testing.T) {
 	r := setup(t)
-	t1 := h.NewTaskMessage("send_email", nil)
-	t2 := h.NewTaskMessage("export_csv", nil)
+	t1 := h.NewTaskMessageWithQueue("send_email", nil, "events")
+	t2 := h.NewTaskMessageWithQueue("send_email", nil, "events")
+	t3 := h.NewTaskMessageWithQueue("send_email", nil, "events")
+	t4 := h.NewTaskMessageWithQueue("send_email", nil, "events")
+	t4.Priority = 5
 
 	tests := []struct {
-		enqueued       []*base.TaskMessage // initial state of the default queue
-		inProgress     []*base.TaskMessage // initial state of the in-progress list
-		target         *base.TaskMessage   // task to requeue
-		wantEnqueued   []*base.TaskMessage // final state of the default queue
-		wantInProgress []*base.TaskMessage // final state of the in-progress list
+		enqueued       []*base.TaskMessage
+		prioritized    []h.ZSetEntry
+		paused         bool
+		n              int
+		want           []*base.TaskMessage
+		wantEnqueued   []*base.TaskMessage
+		wantInProgress []*base.TaskMessage
 	}{
+		{
+			enqueued:       []*base.TaskMessage{t1, t2, t3},
+			n:              2,
+			want:           []*base.TaskMessage{t1, t2},
+			wantEnqueued:   []*base.TaskMessage{t3},
+			wantInProgress: []*base.TaskMessage{t1, t2},
+		},
+		{
+			enqueued:       []*base.TaskMessage{t1, t2},
+			prioritized:    []h.ZSetEntry{{Msg: t4, Score: 1}},
+			n:              10,
+			want:           []*base.TaskMessage{t4, t1, t2},
+			wantEnqueued:   []*base.TaskMessage{},
+			wantInProgress: []*base.TaskMessage{t1, t2, t4},
+		},
 		{
 			enqueued:       []*base.TaskMessage{},
-			inProgress:     []*base.TaskMessage{t1, t2},
-			target:         t1,
-			wantEnqueued:   []*base.TaskMessage{t1},
-			wantInProgress: []*base.TaskMessage{t2},
+			n:              10,
+			want:           []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{},
+			wantInProgress: []*base.TaskMessage{},
 		},
 		{
 			enqueued:       []*base.TaskMessage{t1},
-			inProgress:     []*base.TaskMessage{t2},
-			target:         t2,
-			wantEnqueued:   []*base.TaskMessage{t1, t2},
+			paused:         true,
+			n:              10,
+			want:           []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{t1},
 			wantInProgress: []*base.TaskMessage{},
 		},
 	}
 
 	for _, tc := range tests {
 		h.FlushDB(t, r.client) // clean up db before each test case
-		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
-		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued, "events")
+		h.SeedPriorityQueue(t, r.client, tc.prioritized, "events")
+		if tc.paused {
+			if err := r.PauseQueue("events"); err != nil {
+				t.Fatal(err)
+			}
+		}
 
-		err := r.Requeue(tc.target)
+		got, err := r.DequeueBatch("events", tc.n)
 		if err != nil {
-			t.Errorf("(*RDB).Requeue(task) = %v, want nil", err)
+			t.Errorf("(*RDB).DequeueBatch(%q, %d) returned error: %v", "events", tc.n, err)
 			continue
 		}
-
-		gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).DequeueBatch(%q, %d) = %v, want %v; (-want, +got)\n%s",
+				"events", tc.n, got, tc.want, diff)
+			continue
+		}
+		gotEnqueued := h.GetEnqueuedMessages(t, r.client, "events")
 		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.QueueKey("events"), diff)
 		}
-
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
 			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
@@ -283,109 +442,175 @@ func TestRequeue(t *testing.T) {
 	}
 }
 
-func TestSchedule(t *testing.T) {
+func TestDequeueMalformed(t *testing.T) {
 	r := setup(t)
-	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+	t1 := h.NewTaskMessage("send_email", nil)
+	const garbage = "not a task message"
+
+	// Dequeue
+	h.FlushDB(t, r.client)
+	if err := r.client.LPush(base.DefaultQueue, garbage).Err(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := r.Dequeue(base.DefaultQueueName)
+	var merr *MalformedTaskError
+	if !errors.As(err, &merr) || string(merr.Data) != garbage {
+		t.Fatalf("(*RDB).Dequeue() returned error %v, want *MalformedTaskError with data %q", err, garbage)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has %d messages, want 0", base.InProgressQueue, n)
+	}
+	wantMalformed := []redis.Z{{Member: garbage, Score: float64(now.Unix())}}
+	gotMalformed := r.client.ZRangeWithScores(base.MalformedQueue, 0, -1).Val()
+	if diff := cmp.Diff(wantMalformed, gotMalformed); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.MalformedQueue, diff)
+	}
+	if _, err := r.Dequeue(base.DefaultQueueName); err != ErrNoProcessableTask {
+		t.Errorf("(*RDB).Dequeue() after quarantine returned error %v, want %v", err, ErrNoProcessableTask)
+	}
+
+	// DequeueBatch
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	if err := r.client.LPush(base.DefaultQueue, garbage).Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.DequeueBatch(base.DefaultQueueName, 10)
+	var merrs MalformedTasksError
+	if !errors.As(err, &merrs) || len(merrs) != 1 || string(merrs[0].Data) != garbage {
+		t.Fatalf("(*RDB).DequeueBatch() returned error %v, want MalformedTasksError with data %q", err, garbage)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, got); diff != "" {
+		t.Errorf("(*RDB).DequeueBatch() = %v, want %v; (-want, +got)\n%s", got, []*base.TaskMessage{t1}, diff)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	gotMalformed = r.client.ZRangeWithScores(base.MalformedQueue, 0, -1).Val()
+	if diff := cmp.Diff(wantMalformed, gotMalformed); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.MalformedQueue, diff)
+	}
+
+	// The messages after the malformed one are returned as well.
+	h.FlushDB(t, r.client)
+	t2, t3 := h.NewTaskMessage("reindex", nil), h.NewTaskMessage("gen_thumbnail", nil)
+	if err := r.client.LPush(base.DefaultQueue, garbage).Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t2, t3})
+	got, err = r.DequeueBatch(base.DefaultQueueName, 10)
+	if !errors.As(err, &merrs) || len(merrs) != 1 {
+		t.Fatalf("(*RDB).DequeueBatch() returned error %v, want MalformedTasksError", err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t2, t3}, got, h.SortMsgOpt); diff != "" {
+		t.Errorf("(*RDB).DequeueBatch() with a malformed message first mismatch; (-want, +got)\n%s", diff)
+	}
+	if n := r.client.LLen(base.InProgressQueue).Val(); n != 2 {
+		t.Errorf("%q has %d messages, want 2", base.InProgressQueue, n)
+	}
+}
+
+func TestQueueNames(t *testing.T) {
+	r := setup(t)
+
 	tests := []struct {
-		msg       *base.TaskMessage
-		processAt time.Time
+		enqueued map[string][]*base.TaskMessage
+		want     []string
 	}{
-		{t1, time.Now().Add(15 * time.Minute)},
+		{
+			enqueued: map[string][]*base.TaskMessage{},
+			want:     nil,
+		},
+		{
+			enqueued: map[string][]*base.TaskMessage{
+				"default":  {h.NewTaskMessage("send_email", nil)},
+				"tenant_b": {h.NewTaskMessageWithQueue("sync", nil, "tenant_b")},
+				"tenant_a": {h.NewTaskMessageWithQueue("sync", nil, "tenant_a")},
+			},
+			want: []string{"default", "tenant_a", "tenant_b"},
+		},
 	}
 
 	for _, tc := range tests {
 		h.FlushDB(t, r.client) // clean up db before each test case
+		for _, msgs := range tc.enqueued {
+			for _, msg := range msgs {
+				if err := r.Enqueue(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
 
-		desc := fmt.Sprintf("(*RDB).Schedule(%v, %v)", tc.msg, tc.processAt)
-		err := r.Schedule(tc.msg, tc.processAt)
+		got, err := r.QueueNames()
 		if err != nil {
-			t.Errorf("%s = %v, want nil", desc, err)
+			t.Errorf("(*RDB).QueueNames() returned error: %v", err)
 			continue
 		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).QueueNames() = %v, want %v; (-want, +got)\n%s", got, tc.want, diff)
+		}
+	}
+}
 
-		gotScheduled := h.GetScheduledEntries(t, r.client)
-		if len(gotScheduled) != 1 {
-			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), base.ScheduledQueue)
-			continue
+func TestDequeueSingleWithPriority(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("generate_csv", nil)
+	t2.Priority = 2
+
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	h.SeedPriorityQueue(t, r.client, []h.ZSetEntry{{Msg: t2, Score: priorityScore(t2.Priority, time.Now())}}, base.DefaultQueueName)
+
+	for _, want := range []*base.TaskMessage{t2, t1} {
+		got, err := r.Dequeue(base.DefaultQueueName)
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue(%q) returned error: %v", base.DefaultQueueName, err)
 		}
-		if int64(gotScheduled[0].Score) != tc.processAt.Unix() {
-			t.Errorf("%s inserted an item with score %d, want %d", desc, int64(gotScheduled[0].Score), tc.processAt.Unix())
-			continue
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("(*RDB).Dequeue(%q) = %v, want %v; (-want,+got):\n%s", base.DefaultQueueName, got, want, diff)
 		}
 	}
 }
 
-func TestRetry(t *testing.T) {
+func TestDone(t *testing.T) {
 	r := setup(t)
-	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "Hola!"})
-	t2 := h.NewTaskMessage("gen_thumbnail", map[string]interface{}{"path": "some/path/to/image.jpg"})
-	t3 := h.NewTaskMessage("reindex", nil)
-	t1.Retried = 10
-	errMsg := "SMTP server is not responding"
-	t1AfterRetry := &base.TaskMessage{
-		ID:       t1.ID,
-		Type:     t1.Type,
-		Payload:  t1.Payload,
-		Queue:    t1.Queue,
-		Retry:    t1.Retry,
-		Retried:  t1.Retried + 1,
-		ErrorMsg: errMsg,
-	}
-	now := time.Now()
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
 
 	tests := []struct {
-		inProgress     []*base.TaskMessage
-		retry          []h.ZSetEntry
-		msg            *base.TaskMessage
-		processAt      time.Time
-		errMsg         string
-		wantInProgress []*base.TaskMessage
-		wantRetry      []h.ZSetEntry
+		inProgress     []*base.TaskMessage // initial state of the in-progress list
+		target         *base.TaskMessage   // task to remove
+		wantInProgress []*base.TaskMessage // final state of the in-progress list
 	}{
 		{
-			inProgress: []*base.TaskMessage{t1, t2},
-			retry: []h.ZSetEntry{
-				{
-					Msg:   t3,
-					Score: float64(now.Add(time.Minute).Unix()),
-				},
-			},
-			msg:            t1,
-			processAt:      now.Add(5 * time.Minute),
-			errMsg:         errMsg,
+			inProgress:     []*base.TaskMessage{t1, t2},
+			target:         t1,
 			wantInProgress: []*base.TaskMessage{t2},
-			wantRetry: []h.ZSetEntry{
-				{
-					Msg:   t1AfterRetry,
-					Score: float64(now.Add(5 * time.Minute).Unix()),
-				},
-				{
-					Msg:   t3,
-					Score: float64(now.Add(time.Minute).Unix()),
-				},
-			},
+		},
+		{
+			inProgress:     []*base.TaskMessage{t1},
+			target:         t1,
+			wantInProgress: []*base.TaskMessage{},
 		},
 	}
 
 	for _, tc := range tests {
-		h.FlushDB(t, r.client)
+		h.FlushDB(t, r.client) // clean up db before each test case
 		h.SeedInProgressQueue(t, r.client, tc.inProgress)
-		h.SeedRetryQueue(t, r.client, tc.retry)
 
-		err := r.Retry(tc.msg, tc.processAt, tc.errMsg)
+		err := r.Done(tc.target)
 		if err != nil {
-			t.Errorf("(*RDB).Retry = %v, want nil", err)
+			t.Errorf("(*RDB).Done(task) = %v, want nil", err)
 			continue
 		}
 
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
-		}
-
-		gotRetry := h.GetRetryEntries(t, r.client)
-		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt); diff != "" {
-			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+			continue
 		}
 
 		processedKey := base.ProcessedKey(time.Now())
@@ -393,127 +618,1560 @@ func TestRetry(t *testing.T) {
 		if gotProcessed != "1" {
 			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
 		}
+
 		gotTTL := r.client.TTL(processedKey).Val()
 		if gotTTL > statsTTL {
 			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
 		}
+	}
+}
 
-		failureKey := base.FailureKey(time.Now())
-		gotFailure := r.client.Get(failureKey).Val()
-		if gotFailure != "1" {
-			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
+func TestDoneWithRecord(t *testing.T) {
+	r := setup(t)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := base.NewSimulatedClock(start)
+	r.SetClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	if err := r.DoneWithRecord(t1, 3*time.Second, time.Hour); err != nil {
+		t.Fatalf("(*RDB).DoneWithRecord(t1, 3s, 1h) = %v, want nil", err)
+	}
+	clock.AdvanceTime(30 * time.Minute)
+	if err := r.DoneWithRecord(t2, time.Second, time.Hour); err != nil {
+		t.Fatalf("(*RDB).DoneWithRecord(t2, 1s, 1h) = %v, want nil", err)
+	}
+
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if len(gotInProgress) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, len(gotInProgress))
+	}
+	tests := []struct {
+		advance time.Duration
+		want    []*CompletedTask
+	}{
+		{
+			advance: 0,
+			want: []*CompletedTask{
+				{ID: t1.ID, Type: t1.Type, Queue: t1.Queue, CompletedAt: start, Duration: 3 * time.Second},
+				{ID: t2.ID, Type: t2.Type, Queue: t2.Queue, CompletedAt: start.Add(30 * time.Minute), Duration: time.Second},
+			},
+		},
+		{
+			advance: 45 * time.Minute, // t1's record has expired
+			want: []*CompletedTask{
+				{ID: t2.ID, Type: t2.Type, Queue: t2.Queue, CompletedAt: start.Add(30 * time.Minute), Duration: time.Second},
+			},
+		},
+		{
+			advance: 30 * time.Minute, // all records have expired
+			want:    nil,
+		},
+	}
+
+	for _, tc := range tests {
+		clock.AdvanceTime(tc.advance)
+		got, err := r.ListCompleted()
+		if err != nil {
+			t.Errorf("(*RDB).ListCompleted() returned error: %v", err)
+			continue
 		}
-		gotTTL = r.client.TTL(processedKey).Val()
-		if gotTTL > statsTTL {
-			t.Errorf("TTL %q = %v, want less than or equal to %v", failureKey, gotTTL, statsTTL)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("(*RDB).ListCompleted() = %v, want %v; (-want, +got)\n%s", got, tc.want, diff)
 		}
 	}
+
+	// Expired records are evicted on the next write.
+	t3 := h.NewTaskMessage("sync", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t3})
+	if err := r.DoneWithRecord(t3, time.Second, time.Hour); err != nil {
+		t.Fatalf("(*RDB).DoneWithRecord(t3, 1s, 1h) = %v, want nil", err)
+	}
+	if n := r.client.ZCard(base.CompletedQueue).Val(); n != 1 {
+		t.Errorf("ZCARD %q = %d, want 1", base.CompletedQueue, n)
+	}
+	if ttl := r.client.TTL(base.CompletedQueue).Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL %q = %v, want positive and less than or equal to %v", base.CompletedQueue, ttl, time.Hour)
+	}
 }
 
-func TestKill(t *testing.T) {
+func TestDoneEnqueuesDependents(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("export_csv", nil)
+	t2 := h.NewTaskMessage("send_email", nil)
+	t2.DependsOn = t1.ID.String()
+	t3 := h.NewTaskMessageWithQueue("notify", nil, "low")
+	t3.DependsOn = t1.ID.String()
+	t3.Priority = 3
+
+	tests := []struct {
+		desc string
+		done func(msg *base.TaskMessage) error
+	}{
+		{"Done", r.Done},
+		{"DoneWithRecord", func(msg *base.TaskMessage) error { return r.DoneWithRecord(msg, time.Second, time.Hour) }},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+		h.SeedDependents(t, r.client, []*base.TaskMessage{t2, t3}, t1.ID.String())
+
+		if err := tc.done(t1); err != nil {
+			t.Errorf("%s: (*RDB).%s(task) = %v, want nil", tc.desc, tc.desc, err)
+			continue
+		}
+
+		if diff := cmp.Diff([]*base.TaskMessage{t2}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DefaultQueue, diff)
+		}
+		if diff := cmp.Diff([]*base.TaskMessage{t3}, h.GetPriorityMessages(t, r.client, "low")); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.PriorityQueueKey("low"), diff)
+		}
+		if got := h.GetDependentMessages(t, r.client, t1.ID.String()); len(got) != 0 {
+			t.Errorf("%s: %d tasks waiting for the task after it's done, want 0", tc.desc, len(got))
+		}
+		resolvedKey := base.ResolvedKey(t1.ID.String())
+		if got := r.client.Get(resolvedKey).Val(); got != resolvedDone {
+			t.Errorf("%s: GET %q = %q, want %q", tc.desc, resolvedKey, got, resolvedDone)
+		}
+		if ttl := r.client.TTL(resolvedKey).Val(); ttl <= 0 || ttl > resolvedTTL {
+			t.Errorf("%s: TTL %q = %v, want in (0, %v]", tc.desc, resolvedKey, ttl, resolvedTTL)
+		}
+	}
+}
+
+func TestEnqueueDependent(t *testing.T) {
 	r := setup(t)
+	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+	dep := h.NewTaskMessage("export_csv", nil)
 	t1 := h.NewTaskMessage("send_email", nil)
-	t2 := h.NewTaskMessage("reindex", nil)
-	t3 := h.NewTaskMessage("generate_csv", nil)
-	errMsg := "SMTP server not responding"
-	t1AfterKill := &base.TaskMessage{
-		ID:       t1.ID,
-		Type:     t1.Type,
-		Payload:  t1.Payload,
-		Queue:    t1.Queue,
-		Retry:    t1.Retry,
-		Retried:  t1.Retried,
-		ErrorMsg: errMsg,
+	t1.DependsOn = dep.ID.String()
+	killed := *t1
+	killed.ErrorMsg = fmt.Sprintf("dependency %s died", dep.ID)
+	killed.DiedAt = now.Unix()
+
+	tests := []struct {
+		desc           string
+		resolved       string // outcome of the dependency; empty if unknown
+		wantEnqueued   []*base.TaskMessage
+		wantDependents []*base.TaskMessage
+		wantDead       []*base.TaskMessage
+	}{
+		{
+			desc:           "dependency not finished",
+			resolved:       "",
+			wantEnqueued:   []*base.TaskMessage{},
+			wantDependents: []*base.TaskMessage{t1},
+			wantDead:       []*base.TaskMessage{},
+		},
+		{
+			desc:           "dependency completed",
+			resolved:       resolvedDone,
+			wantEnqueued:   []*base.TaskMessage{t1},
+			wantDependents: []*base.TaskMessage{},
+			wantDead:       []*base.TaskMessage{},
+		},
+		{
+			desc:           "dependency died",
+			resolved:       resolvedDead,
+			wantEnqueued:   []*base.TaskMessage{},
+			wantDependents: []*base.TaskMessage{},
+			wantDead:       []*base.TaskMessage{&killed},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		if tc.resolved != "" {
+			if err := r.client.Set(base.ResolvedKey(dep.ID.String()), tc.resolved, time.Minute).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := r.EnqueueDependent(t1); err != nil {
+			t.Errorf("%s: (*RDB).EnqueueDependent(task) = %v, want nil", tc.desc, err)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.wantEnqueued, h.GetEnqueuedMessages(t, r.client), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DefaultQueue, diff)
+		}
+		gotDependents := h.GetDependentMessages(t, r.client, dep.ID.String())
+		if diff := cmp.Diff(tc.wantDependents, gotDependents, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DependentsKey(dep.ID.String()), diff)
+		}
+		if diff := cmp.Diff(tc.wantDead, h.GetDeadMessages(t, r.client), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DeadQueue, diff)
+		}
 	}
+}
+
+func TestKillDependents(t *testing.T) {
+	r := setup(t)
 	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+	dep := h.NewTaskMessage("export_csv", nil)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t1.DependsOn = dep.ID.String()
+	t2 := h.NewTaskMessage("notify", nil) // waits for t1
+	t2.DependsOn = t1.ID.String()
+	h.SeedDependents(t, r.client, []*base.TaskMessage{t1}, dep.ID.String())
+	h.SeedDependents(t, r.client, []*base.TaskMessage{t2}, t1.ID.String())
+
+	n, err := r.KillDependents(dep.ID)
+	if err != nil || n != 2 {
+		t.Fatalf("(*RDB).KillDependents(id) = %d, %v, want 2, nil", n, err)
+	}
+
+	k1, k2 := *t1, *t2
+	k1.ErrorMsg = fmt.Sprintf("dependency %s died", dep.ID)
+	k1.DiedAt = now.Unix()
+	k2.ErrorMsg = fmt.Sprintf("dependency %s died", t1.ID)
+	k2.DiedAt = now.Unix()
+	if diff := cmp.Diff([]*base.TaskMessage{&k1, &k2}, h.GetDeadMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.DeadQueue, diff)
+	}
+	for _, id := range []string{dep.ID.String(), t1.ID.String()} {
+		if got := h.GetDependentMessages(t, r.client, id); len(got) != 0 {
+			t.Errorf("%d tasks waiting for task %s after it died, want 0", len(got), id)
+		}
+		if got := r.client.Get(base.ResolvedKey(id)).Val(); got != resolvedDead {
+			t.Errorf("GET %q = %q, want %q", base.ResolvedKey(id), got, resolvedDead)
+		}
+	}
+}
+
+func TestKillExpiredDependents(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now)
+	r.SetClock(clock)
+	dep := h.NewTaskMessage("export_csv", nil)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t1.DependsOn = dep.ID.String()
+	t2 := h.NewTaskMessage("notify", nil) // waits for t1
+	t2.DependsOn = t1.ID.String()
+	t2.ExpiresAt = now.Add(2 * dependentTTL).Unix()
+	t3 := h.NewTaskMessage("reindex", nil) // waits until it expires
+	t3.DependsOn = dep.ID.String()
+	t3.ExpiresAt = now.Add(time.Hour).Unix()
+	for _, msg := range []*base.TaskMessage{t1, t2, t3} {
+		if err := r.EnqueueDependent(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantWaiting := []h.ZSetEntry{
+		{Msg: t1, Score: float64(now.Add(dependentTTL).Unix())},
+		{Msg: t2, Score: float64(t2.ExpiresAt)},
+		{Msg: t3, Score: float64(t3.ExpiresAt)},
+	}
+	if diff := cmp.Diff(wantWaiting, h.GetWaitingEntries(t, r.client), h.SortZSetEntryOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.WaitingTasks, diff)
+	}
+
+	// Only the task past its expiration is killed.
+	clock.AdvanceTime(2 * time.Hour)
+	if n, err := r.KillExpiredDependents(); n != 1 || err != nil {
+		t.Errorf("(*RDB).KillExpiredDependents() = %d, %v after 2 hours, want 1, nil", n, err)
+	}
+	k3 := *t3
+	k3.ErrorMsg = fmt.Sprintf("dependency %s was not resolved in time", dep.ID)
+	k3.DiedAt = clock.Now().Unix()
+	if diff := cmp.Diff([]*base.TaskMessage{&k3}, h.GetDeadMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q after 2 hours; (-want, +got)\n%s", base.DeadQueue, diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, h.GetDependentMessages(t, r.client, dep.ID.String())); diff != "" {
+		t.Errorf("mismatch found in %q after 2 hours; (-want, +got)\n%s", base.DependentsKey(dep.ID.String()), diff)
+	}
+
+	// The tasks waiting for a killed task are killed along with it.
+	clock.AdvanceTime(dependentTTL)
+	if n, err := r.KillExpiredDependents(); n != 2 || err != nil {
+		t.Errorf("(*RDB).KillExpiredDependents() = %d, %v after the wait expired, want 2, nil", n, err)
+	}
+	k1, k2 := *t1, *t2
+	k1.ErrorMsg = fmt.Sprintf("dependency %s was not resolved in time", dep.ID)
+	k1.DiedAt = clock.Now().Unix()
+	k2.ErrorMsg = fmt.Sprintf("dependency %s died", t1.ID)
+	k2.DiedAt = clock.Now().Unix()
+	if diff := cmp.Diff([]*base.TaskMessage{&k1, &k2, &k3}, h.GetDeadMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after the wait expired; (-want, +got)\n%s", base.DeadQueue, diff)
+	}
+	if n := r.client.ZCard(base.WaitingTasks).Val(); n != 0 {
+		t.Errorf("%q has %d tasks after the wait expired, want 0", base.WaitingTasks, n)
+	}
+	for _, id := range []string{dep.ID.String(), t1.ID.String()} {
+		if got := h.GetDependentMessages(t, r.client, id); len(got) != 0 {
+			t.Errorf("%d tasks waiting for task %s after the wait expired, want 0", len(got), id)
+		}
+	}
+
+	// A resolved task is removed from the waiting tasks.
+	t4 := h.NewTaskMessage("send_email", nil)
+	t4.DependsOn = dep.ID.String()
+	if err := r.EnqueueDependent(t4); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{dep})
+	if err := r.Done(dep); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.ZCard(base.WaitingTasks).Val(); n != 0 {
+		t.Errorf("%q has %d tasks after the dependency completed, want 0", base.WaitingTasks, n)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessageWithQueue("reindex", nil, "critical")
 
-	// TODO(hibiken): add test cases for trimming
 	tests := []struct {
-		inProgress     []*base.TaskMessage
-		dead           []h.ZSetEntry
-		target         *base.TaskMessage // task to kill
-		wantInProgress []*base.TaskMessage
-		wantDead       []h.ZSetEntry
+		enqueued       []*base.TaskMessage // initial state of the default queue
+		inProgress     []*base.TaskMessage // initial state of the in-progress list
+		target         *base.TaskMessage   // task to requeue
+		wantEnqueued   []*base.TaskMessage // final state of the default queue
+		wantCritical   []*base.TaskMessage // final state of the critical queue
+		wantInProgress []*base.TaskMessage // final state of the in-progress list
 	}{
 		{
-			inProgress: []*base.TaskMessage{t1, t2},
-			dead: []h.ZSetEntry{
-				{
-					Msg:   t3,
-					Score: float64(now.Add(-time.Hour).Unix()),
-				},
-			},
+			enqueued:       []*base.TaskMessage{},
+			inProgress:     []*base.TaskMessage{t1, t2},
 			target:         t1,
+			wantEnqueued:   []*base.TaskMessage{t1},
+			wantCritical:   []*base.TaskMessage{},
 			wantInProgress: []*base.TaskMessage{t2},
-			wantDead: []h.ZSetEntry{
-				{
-					Msg:   t1AfterKill,
-					Score: float64(now.Unix()),
-				},
-				{
-					Msg:   t3,
-					Score: float64(now.Add(-time.Hour).Unix()),
-				},
-			},
 		},
 		{
-			inProgress:     []*base.TaskMessage{t1, t2, t3},
-			dead:           []h.ZSetEntry{},
-			target:         t1,
-			wantInProgress: []*base.TaskMessage{t2, t3},
-			wantDead: []h.ZSetEntry{
-				{
-					Msg:   t1AfterKill,
-					Score: float64(now.Unix()),
-				},
-			},
+			enqueued:       []*base.TaskMessage{t1},
+			inProgress:     []*base.TaskMessage{t2},
+			target:         t2,
+			wantEnqueued:   []*base.TaskMessage{t1, t2},
+			wantCritical:   []*base.TaskMessage{},
+			wantInProgress: []*base.TaskMessage{},
+		},
+		{
+			enqueued:       []*base.TaskMessage{t1},
+			inProgress:     []*base.TaskMessage{t3},
+			target:         t3,
+			wantEnqueued:   []*base.TaskMessage{t1},
+			wantCritical:   []*base.TaskMessage{t3},
+			wantInProgress: []*base.TaskMessage{},
 		},
 	}
 
 	for _, tc := range tests {
 		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
 		h.SeedInProgressQueue(t, r.client, tc.inProgress)
-		h.SeedDeadQueue(t, r.client, tc.dead)
 
-		err := r.Kill(tc.target, errMsg)
+		err := r.Requeue(tc.target)
 		if err != nil {
-			t.Errorf("(*RDB).Kill(%v, %v) = %v, want nil", tc.target, errMsg, err)
+			t.Errorf("(*RDB).Requeue(task) = %v, want nil", err)
 			continue
 		}
 
+		gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+		}
+		gotCritical := h.GetEnqueuedMessages(t, r.client, "critical")
+		if diff := cmp.Diff(tc.wantCritical, gotCritical, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.QueueKey("critical"), diff)
+		}
+
 		gotInProgress := h.GetInProgressMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
 		}
+	}
+}
 
-		gotDead := h.GetDeadEntries(t, r.client)
-		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
-			t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", base.DeadQueue, diff)
+func TestRequeueWithPriority(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	t1.Priority = 3
+	t2 := h.NewTaskMessageWithQueue("export_csv", nil, "critical")
+	t2.Priority = 3
+
+	h.SeedPriorityQueue(t, r.client, []h.ZSetEntry{{Msg: t2, Score: priorityScore(t2.Priority, time.Now())}}, "critical")
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+
+	if err := r.Requeue(t1); err != nil {
+		t.Fatalf("(*RDB).Requeue(task) = %v, want nil", err)
+	}
+
+	// requeued task should be placed ahead of tasks with the same priority.
+	wantPriority := []*base.TaskMessage{t1, t2}
+	gotPriority := h.GetPriorityMessages(t, r.client, "critical")
+	if diff := cmp.Diff(wantPriority, gotPriority); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.PriorityQueueKey("critical"), diff)
+	}
+	if l := r.client.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has length %d, want 0", base.InProgressQueue, l)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	tests := []struct {
+		msg       *base.TaskMessage
+		processAt time.Time
+	}{
+		{t1, time.Now().Add(15 * time.Minute)},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+
+		desc := fmt.Sprintf("(*RDB).Schedule(%v, %v)", tc.msg, tc.processAt)
+		err := r.Schedule(tc.msg, tc.processAt)
+		if err != nil {
+			t.Errorf("%s = %v, want nil", desc, err)
+			continue
 		}
 
-		processedKey := base.ProcessedKey(time.Now())
-		gotProcessed := r.client.Get(processedKey).Val()
-		if gotProcessed != "1" {
-			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
+		gotScheduled := h.GetScheduledEntries(t, r.client)
+		if len(gotScheduled) != 1 {
+			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), base.ScheduledQueue)
+			continue
 		}
-		gotTTL := r.client.TTL(processedKey).Val()
-		if gotTTL > statsTTL {
-			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
+		if int64(gotScheduled[0].Score) != tc.processAt.Unix() {
+			t.Errorf("%s inserted an item with score %d, want %d", desc, int64(gotScheduled[0].Score), tc.processAt.Unix())
+			continue
 		}
+	}
+}
 
-		failureKey := base.FailureKey(time.Now())
-		gotFailure := r.client.Get(failureKey).Val()
-		if gotFailure != "1" {
-			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
-		}
-		gotTTL = r.client.TTL(processedKey).Val()
-		if gotTTL > statsTTL {
-			t.Errorf("TTL %q = %v, want less than or equal to %v", failureKey, gotTTL, statsTTL)
+func TestScheduleIn(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "hello"})
+	tests := []struct {
+		msg   *base.TaskMessage
+		delay time.Duration
+	}{
+		{t1, 15 * time.Minute},
+		{t1, 90 * time.Second},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+
+		// score should be computed against the redis server clock,
+		// not the local clock.
+		serverNow, err := r.client.Time().Result()
+		if err != nil {
+			t.Fatal(err)
 		}
+		desc := fmt.Sprintf("(*RDB).ScheduleIn(%v, %v)", tc.msg, tc.delay)
+		processAt, err := r.ScheduleIn(tc.msg, tc.delay)
+		if err != nil {
+			t.Errorf("%s = %v, want nil", desc, err)
+			continue
+		}
+
+		gotScheduled := h.GetScheduledEntries(t, r.client)
+		if len(gotScheduled) != 1 {
+			t.Errorf("%s inserted %d items to %q, want 1 items inserted", desc, len(gotScheduled), base.ScheduledQueue)
+			continue
+		}
+		want := serverNow.Add(tc.delay).Unix()
+		if got := int64(gotScheduled[0].Score); got < want || got > want+1 {
+			t.Errorf("%s inserted an item with score %d, want %d", desc, got, want)
+		}
+		if got := processAt.Unix(); got != int64(gotScheduled[0].Score) {
+			t.Errorf("%s returned %d, want the score %d", desc, got, int64(gotScheduled[0].Score))
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", map[string]interface{}{"subject": "Hola!"})
+	t2 := h.NewTaskMessage("gen_thumbnail", map[string]interface{}{"path": "some/path/to/image.jpg"})
+	t3 := h.NewTaskMessage("reindex", nil)
+	t1.Retried = 10
+	errMsg := "SMTP server is not responding"
+	t1AfterRetry := &base.TaskMessage{
+		ID:       t1.ID,
+		Type:     t1.Type,
+		Payload:  t1.Payload,
+		Queue:    t1.Queue,
+		Retry:    t1.Retry,
+		Retried:  t1.Retried + 1,
+		Attempts: t1.Attempts + 1,
+		ErrorMsg: errMsg,
+	}
+	now := time.Now()
+	t1AfterRetry.FailedAt = now.Unix()
+
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		retry          []h.ZSetEntry
+		msg            *base.TaskMessage
+		processAt      time.Time
+		errMsg         string
+		wantInProgress []*base.TaskMessage
+		wantRetry      []h.ZSetEntry
+	}{
+		{
+			inProgress: []*base.TaskMessage{t1, t2},
+			retry: []h.ZSetEntry{
+				{
+					Msg:   t3,
+					Score: float64(now.Add(time.Minute).Unix()),
+				},
+			},
+			msg:            t1,
+			processAt:      now.Add(5 * time.Minute),
+			errMsg:         errMsg,
+			wantInProgress: []*base.TaskMessage{t2},
+			wantRetry: []h.ZSetEntry{
+				{
+					Msg:   t1AfterRetry,
+					Score: float64(now.Add(5 * time.Minute).Unix()),
+				},
+				{
+					Msg:   t3,
+					Score: float64(now.Add(time.Minute).Unix()),
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedRetryQueue(t, r.client, tc.retry)
+
+		err := r.Retry(tc.msg, tc.processAt, tc.errMsg)
+		if err != nil {
+			t.Errorf("(*RDB).Retry = %v, want nil", err)
+			continue
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+		}
+
+		gotRetry := h.GetRetryEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+		}
+
+		processedKey := base.ProcessedKey(time.Now())
+		gotProcessed := r.client.Get(processedKey).Val()
+		if gotProcessed != "1" {
+			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
+		}
+		gotTTL := r.client.TTL(processedKey).Val()
+		if gotTTL > statsTTL {
+			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
+		}
+
+		failureKey := base.FailureKey(time.Now())
+		gotFailure := r.client.Get(failureKey).Val()
+		if gotFailure != "1" {
+			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
+		}
+		gotTTL = r.client.TTL(processedKey).Val()
+		if gotTTL > statsTTL {
+			t.Errorf("TTL %q = %v, want less than or equal to %v", failureKey, gotTTL, statsTTL)
+		}
+	}
+}
+
+func TestKill(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t3 := h.NewTaskMessage("generate_csv", nil)
+	errMsg := "SMTP server not responding"
+	serverID := "localhost:1234:bnqj25rf9i6g4bgj2pfg"
+	now := time.Now()
+	t1AfterKill := &base.TaskMessage{
+		ID:       t1.ID,
+		Type:     t1.Type,
+		Payload:  t1.Payload,
+		Queue:    t1.Queue,
+		Retry:    t1.Retry,
+		Retried:  t1.Retried,
+		ErrorMsg: errMsg,
+		DiedAt:   now.Unix(),
+		ServerID: serverID,
+	}
+
+	// TODO(hibiken): add test cases for trimming
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		dead           []h.ZSetEntry
+		target         *base.TaskMessage // task to kill
+		wantInProgress []*base.TaskMessage
+		wantDead       []h.ZSetEntry
+	}{
+		{
+			inProgress: []*base.TaskMessage{t1, t2},
+			dead: []h.ZSetEntry{
+				{
+					Msg:   t3,
+					Score: float64(now.Add(-time.Hour).Unix()),
+				},
+			},
+			target:         t1,
+			wantInProgress: []*base.TaskMessage{t2},
+			wantDead: []h.ZSetEntry{
+				{
+					Msg:   t1AfterKill,
+					Score: float64(now.Unix()),
+				},
+				{
+					Msg:   t3,
+					Score: float64(now.Add(-time.Hour).Unix()),
+				},
+			},
+		},
+		{
+			inProgress:     []*base.TaskMessage{t1, t2, t3},
+			dead:           []h.ZSetEntry{},
+			target:         t1,
+			wantInProgress: []*base.TaskMessage{t2, t3},
+			wantDead: []h.ZSetEntry{
+				{
+					Msg:   t1AfterKill,
+					Score: float64(now.Unix()),
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedDeadQueue(t, r.client, tc.dead)
+
+		err := r.Kill(tc.target, errMsg, serverID, 0)
+		if err != nil {
+			t.Errorf("(*RDB).Kill(%v, %v, %q, 0) = %v, want nil", tc.target, errMsg, serverID, err)
+			continue
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+		}
+
+		gotDead := h.GetDeadEntries(t, r.client)
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortZSetEntryOpt); diff != "" {
+			t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", base.DeadQueue, diff)
+		}
+
+		processedKey := base.ProcessedKey(time.Now())
+		gotProcessed := r.client.Get(processedKey).Val()
+		if gotProcessed != "1" {
+			t.Errorf("GET %q = %q, want 1", processedKey, gotProcessed)
+		}
+		gotTTL := r.client.TTL(processedKey).Val()
+		if gotTTL > statsTTL {
+			t.Errorf("TTL %q = %v, want less than or equal to %v", processedKey, gotTTL, statsTTL)
+		}
+
+		failureKey := base.FailureKey(time.Now())
+		gotFailure := r.client.Get(failureKey).Val()
+		if gotFailure != "1" {
+			t.Errorf("GET %q = %q, want 1", failureKey, gotFailure)
+		}
+		gotTTL = r.client.TTL(processedKey).Val()
+		if gotTTL > statsTTL {
+			t.Errorf("TTL %q = %v, want less than or equal to %v", failureKey, gotTTL, statsTTL)
+		}
+	}
+}
+
+func TestQueueTTL(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("reindex", nil)
+	t3 := h.NewTaskMessage("generate_csv", nil)
+	h.FlushDB(t, r.client)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2, t3})
+	retryAt := time.Now().Add(time.Minute)
+
+	// Queues don't expire by default.
+	if err := r.Retry(t1, retryAt, "error"); err != nil {
+		t.Fatalf("(*RDB).Retry(%v) = %v, want nil", t1, err)
+	}
+	if got := r.client.PTTL(base.RetryQueue).Val(); got >= 0 {
+		t.Errorf("PTTL %q = %v without the TTL set, want no expiration", base.RetryQueue, got)
+	}
+
+	r.SetQueueTTL(time.Hour, 2*time.Hour)
+	defer r.SetQueueTTL(0, 0)
+	if err := r.Retry(t2, retryAt, "error"); err != nil {
+		t.Fatalf("(*RDB).Retry(%v) = %v, want nil", t2, err)
+	}
+	if err := r.Kill(t3, "error", "", 0); err != nil {
+		t.Fatalf("(*RDB).Kill(%v) = %v, want nil", t3, err)
+	}
+	for key, want := range map[string]time.Duration{base.RetryQueue: time.Hour, base.DeadQueue: 2 * time.Hour} {
+		got := r.client.PTTL(key).Val()
+		if got <= want-time.Minute || got > want {
+			t.Errorf("PTTL %q = %v, want %v", key, got, want)
+		}
+	}
+
+	// Moving a task to the dead queue refreshes its TTL.
+	r.client.PExpire(base.DeadQueue, time.Minute)
+	if err := r.KillRetryTask(t2.ID, retryAt.Unix()); err != nil {
+		t.Fatalf("(*RDB).KillRetryTask(%v) = %v, want nil", t2.ID, err)
+	}
+	if got := r.client.PTTL(base.DeadQueue).Val(); got <= time.Hour {
+		t.Errorf("PTTL %q = %v after killing a retry task, want refreshed to 2h", base.DeadQueue, got)
+	}
+}
+
+func TestSnooze(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t1.Retried = 2
+	t1.ErrorMsg = "previous error"
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	processAt := time.Now().Add(5 * time.Minute)
+	if err := r.Snooze(t1, processAt); err != nil {
+		t.Fatalf("(*RDB).Snooze(msg, %v) = %v, want nil", processAt, err)
+	}
+
+	// task should be scheduled with only the attempt count incremented.
+	snoozed := *t1
+	snoozed.Attempts++
+	wantScheduled := []h.ZSetEntry{{Msg: &snoozed, Score: float64(processAt.Unix())}}
+	gotScheduled := h.GetScheduledEntries(t, r.client)
+	if diff := cmp.Diff(wantScheduled, gotScheduled); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.ScheduledQueue, diff)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	if n := r.client.Exists(base.FailureKey(time.Now())).Val(); n != 0 {
+		t.Errorf("%q exists, want snooze not to count as a failure", base.FailureKey(time.Now()))
+	}
+}
+
+func TestDrop(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	if err := r.Drop(t1); err != nil {
+		t.Fatalf("(*RDB).Drop(msg) = %v, want nil", err)
+	}
+
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	for _, key := range []string{base.ProcessedKey(time.Now()), base.FailureKey(time.Now())} {
+		if got := r.client.Get(key).Val(); got != "1" {
+			t.Errorf("GET %q = %q, want 1", key, got)
+		}
+	}
+	for _, key := range []string{base.RetryQueue, base.DeadQueue, base.ScheduledQueue} {
+		if n := r.client.ZCard(key).Val(); n != 0 {
+			t.Errorf("ZCARD %q = %d, want 0", key, n)
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t1.Retried = 25
+	t1.ErrorMsg = "previous error"
+	t2 := h.NewTaskMessage("export_csv", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	processAt := time.Now().Add(24 * time.Hour)
+	if err := r.Defer(t1, processAt, "last error"); err != nil {
+		t.Fatalf("(*RDB).Defer(msg, %v, errMsg) = %v, want nil", processAt, err)
+	}
+
+	gotDeferred := h.GetDeferredEntries(t, r.client)
+	if len(gotDeferred) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.DeferredQueue, len(gotDeferred))
+	}
+	if got, want := gotDeferred[0].Score, float64(processAt.Unix()); got != want {
+		t.Errorf("score of deferred task = %v, want %v", got, want)
+	}
+	got := gotDeferred[0].Msg
+	if got.DeadRetried != 1 || got.Retried != 25 || got.ErrorMsg != "last error" ||
+		!cmp.Equal(got.ErrorHistory, []string{"previous error"}) {
+		t.Errorf("deferred task = %+v, want DeadRetried 1, Retried 25 and the last error with the previous one in history", got)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	if got := r.client.Get(base.FailureKey(time.Now())).Val(); got != "1" {
+		t.Errorf("GET %q = %q, want 1", base.FailureKey(time.Now()), got)
+	}
+	if n := r.client.ZCard(base.DeadQueue).Val(); n != 0 {
+		t.Errorf("ZCARD %q = %d, want 0", base.DeadQueue, n)
+	}
+
+	// Only the due tasks are forwarded.
+	t3 := h.NewTaskMessage("reindex", nil)
+	h.SeedDeferredQueue(t, r.client, []h.ZSetEntry{{Msg: t3, Score: float64(time.Now().Add(-time.Minute).Unix())}})
+	if err := r.ForwardDeferred("default"); err != nil {
+		t.Fatalf("(*RDB).ForwardDeferred(%q) = %v, want nil", "default", err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t3}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+	if n := r.client.ZCard(base.DeferredQueue).Val(); n != 1 {
+		t.Errorf("ZCARD %q = %d, want 1", base.DeferredQueue, n)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessage("reindex", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2, t3})
+
+	expired := time.Now().Add(-time.Second)
+	if err := r.Hide(expired, t1, t2, t3); err != nil {
+		t.Fatalf("(*RDB).Hide(%v, msgs...) = %v, want nil", expired, err)
+	}
+	// t1 is done and acknowledged, and the visibility of t2 is extended.
+	if err := r.Done(t1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Ack(t1); err != nil {
+		t.Fatalf("(*RDB).Ack(msg) = %v, want nil", err)
+	}
+	until := time.Now().Add(time.Hour)
+	if ok, err := r.ExtendVisibility(t2, until); !ok || err != nil {
+		t.Fatalf("(*RDB).ExtendVisibility(msg, %v) = %t, %v, want true, nil", until, ok, err)
+	}
+
+	n, err := r.RequeueInvisible()
+	if err != nil {
+		t.Fatalf("(*RDB).RequeueInvisible() returned error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("(*RDB).RequeueInvisible() = %d, want 1", n)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t3}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, h.GetInProgressMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	wantInvisible := []h.ZSetEntry{{Msg: t2, Score: float64(until.Unix())}}
+	gotInvisible := h.GetInvisibleEntries(t, r.client)
+	if diff := cmp.Diff(wantInvisible, gotInvisible); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.InvisibleTasks, diff)
+	}
+
+	// The visibility of a task made visible again cannot be extended.
+	if ok, err := r.ExtendVisibility(t3, until); ok || err != nil {
+		t.Errorf("(*RDB).ExtendVisibility(msg, %v) = %t, %v after the timeout, want false, nil", until, ok, err)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessageWithQueue("export_csv", nil, "low")
+	t3 := h.NewTaskMessage("reindex", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2, t3})
+
+	// t3 is not interrupted and stays in progress.
+	n, err := r.HandOff(time.Hour, t1, t2)
+	if err != nil {
+		t.Fatalf("(*RDB).HandOff(time.Hour, msgs...) returned error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("(*RDB).HandOff(time.Hour, msgs...) = %d, want 2", n)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, h.GetHandoffMessages(t, r.client, "default")); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.HandoffKey("default"), diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, h.GetHandoffMessages(t, r.client, "low")); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.HandoffKey("low"), diff)
+	}
+
+	// Handed off tasks are dequeued ahead of the queue.
+	t4 := h.NewTaskMessage("sync", nil)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t4})
+	got, err := r.Dequeue("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(t1, got); diff != "" {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, want the handed off task %v", "default", got, t1)
+	}
+	batch, err := r.DequeueBatch("low", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, batch); diff != "" {
+		t.Errorf("(*RDB).DequeueBatch(%q, 2) mismatch: (-want, +got)\n%s", "low", diff)
+	}
+
+	// Restoring leaves the marked tasks in progress.
+	if _, err := r.RestoreUnfinished(); err != nil {
+		t.Fatal(err)
+	}
+	wantInProgress := []*base.TaskMessage{t1, t2}
+	if diff := cmp.Diff(wantInProgress, h.GetInProgressMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after restore: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t3, t4}, h.GetEnqueuedMessages(t, r.client), h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after restore: (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+
+	// Once the mark is cleared, the tasks are restored.
+	if err := r.ClearHandoff(t1, t2); err != nil {
+		t.Fatalf("(*RDB).ClearHandoff(msgs...) = %v, want nil", err)
+	}
+	if n, err := r.RestoreUnfinished(); n != 2 || err != nil {
+		t.Errorf("(*RDB).RestoreUnfinished() = %d, %v after clearing the marks, want 2, nil", n, err)
+	}
+}
+
+func TestHandOffReceiverCrash(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now)
+	r.SetClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+
+	if _, err := r.HandOff(10*time.Minute, t1); err != nil {
+		t.Fatal(err)
+	}
+	wantExpiry := float64(now.Add(10 * time.Minute).Unix())
+	if got := r.client.ZScore(base.HandedOff, t1.ID.String()).Val(); got != wantExpiry {
+		t.Errorf("%q has score %v for the handed off task, want %v", base.HandedOff, got, wantExpiry)
+	}
+
+	// Another server takes over the task and crashes before finishing it,
+	// so the mark is never cleared.
+	if _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Until the mark expires, the task is left for the other server.
+	clock.AdvanceTime(9 * time.Minute)
+	if n, err := r.RestoreUnfinished(); n != 0 || err != nil {
+		t.Errorf("(*RDB).RestoreUnfinished() = %d, %v before the mark expired, want 0, nil", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, h.GetInProgressMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q before the mark expired: (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+
+	// Once the mark expires, the task is restored and the mark is removed.
+	clock.AdvanceTime(2 * time.Minute)
+	if n, err := r.RestoreUnfinished(); n != 1 || err != nil {
+		t.Errorf("(*RDB).RestoreUnfinished() = %d, %v after the mark expired, want 1, nil", n, err)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q after the mark expired: (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+	if n := r.client.ZCard(base.HandedOff).Val(); n != 0 {
+		t.Errorf("%q has %d entries after the mark expired, want 0", base.HandedOff, n)
+	}
+}
+
+func TestKillSnapshot(t *testing.T) {
+	r := setup(t)
+	msg := &base.TaskMessage{
+		ID:           xid.New(),
+		Type:         "send_email",
+		Payload:      map[string]interface{}{"to": "user@example.com", "meta": map[string]interface{}{"attempts": 3.0}},
+		Queue:        "critical",
+		Priority:     2,
+		Retry:        3,
+		Retried:      3,
+		ErrorMsg:     "third error",
+		ErrorHistory: []string{"first error", "second error"},
+	}
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+
+	now := time.Now()
+	if err := r.Kill(msg, "last error", "server1", 0); err != nil {
+		t.Fatalf("(*RDB).Kill() = %v, want nil", err)
+	}
+
+	want := &base.TaskMessage{
+		ID:           msg.ID,
+		Type:         msg.Type,
+		Payload:      msg.Payload,
+		Queue:        msg.Queue,
+		Priority:     msg.Priority,
+		Retry:        msg.Retry,
+		Retried:      msg.Retried,
+		ErrorMsg:     "last error",
+		ErrorHistory: []string{"first error", "second error", "third error"},
+		DiedAt:       now.Unix(),
+		ServerID:     "server1",
+	}
+	gotDead := h.GetDeadMessages(t, r.client)
+	if len(gotDead) != 1 {
+		t.Fatalf("%q has length %d, want 1", base.DeadQueue, len(gotDead))
+	}
+	if diff := cmp.Diff(want, gotDead[0]); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got)\n%s", base.DeadQueue, diff)
+	}
+}
+
+func TestAppendErrorHistory(t *testing.T) {
+	var history []string
+	for i := 0; i < maxErrorHistory+5; i++ {
+		history = appendErrorHistory(history, fmt.Sprintf("error%d", i))
+	}
+	if len(history) != maxErrorHistory {
+		t.Fatalf("len(history) = %d, want %d", len(history), maxErrorHistory)
+	}
+	if history[0] != "error5" || history[maxErrorHistory-1] != fmt.Sprintf("error%d", maxErrorHistory+4) {
+		t.Errorf("history = %v, want oldest entries to be dropped", history)
+	}
+	if got := appendErrorHistory(nil, ""); got != nil {
+		t.Errorf("appendErrorHistory(nil, \"\") = %v, want nil", got)
+	}
+}
+
+func TestKillWithMaxPerQueue(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	const max = 3
+
+	// seed dead queue with max number of tasks from default queue,
+	// and a task from another queue which should not be affected.
+	var dead []h.ZSetEntry
+	for i := 0; i < max; i++ {
+		dead = append(dead, h.ZSetEntry{
+			Msg:   h.NewTaskMessage(fmt.Sprintf("task%d", i), nil),
+			Score: float64(now.Add(-time.Duration(max-i) * time.Minute).Unix()),
+		})
+	}
+	other := h.ZSetEntry{
+		Msg:   h.NewTaskMessageWithQueue("other", nil, "low"),
+		Score: float64(now.Add(-time.Hour).Unix()),
+	}
+	h.SeedDeadQueue(t, r.client, append(dead, other))
+
+	// kill more tasks than the limit.
+	var killed []*base.TaskMessage
+	for i := 0; i < 2; i++ {
+		msg := h.NewTaskMessage(fmt.Sprintf("new%d", i), nil)
+		h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+		if err := r.Kill(msg, "error", "server1", max); err != nil {
+			t.Fatalf("(*RDB).Kill(msg, %q, %q, %d) = %v, want nil", "error", "server1", max, err)
+		}
+		modified := *msg
+		modified.ErrorMsg = "error"
+		modified.DiedAt = now.Unix()
+		modified.ServerID = "server1"
+		killed = append(killed, &modified)
+	}
+
+	// two oldest tasks from default queue should be evicted.
+	want := []*base.TaskMessage{other.Msg, dead[2].Msg, killed[0], killed[1]}
+	got := h.GetDeadMessages(t, r.client)
+	if diff := cmp.Diff(want, got, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after calling (*RDB).Kill: (-want, +got):\n%s", base.DeadQueue, diff)
+	}
+	if n := r.client.ZCard(base.DeadKey("default")).Val(); n != max {
+		t.Errorf("%q has %d tasks, want %d", base.DeadKey("default"), n, max)
+	}
+}
+
+func TestKillWithMaxPerQueueAfterRemoval(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now)
+	r.SetClock(clock)
+	const max = 3
+
+	kill := func(typename string) *base.TaskMessage {
+		t.Helper()
+		msg := h.NewTaskMessage(typename, nil)
+		h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{msg})
+		if err := r.Kill(msg, "error", "server1", max); err != nil {
+			t.Fatalf("(*RDB).Kill(msg, %q, %q, %d) = %v, want nil", "error", "server1", max, err)
+		}
+		return msg
+	}
+	kill("task1")
+	clock.AdvanceTime(time.Minute)
+	t2, t3 := kill("task2"), kill("task3")
+	diedAt := clock.Now().Unix()
+
+	// tasks removed from the dead queue no longer count toward the limit.
+	if err := r.EnqueueDeadTask(t2.ID, diedAt); err != nil {
+		t.Fatalf("(*RDB).EnqueueDeadTask(%v, %d) = %v, want nil", t2.ID, diedAt, err)
+	}
+	if err := r.DeleteDeadTask(t3.ID, diedAt); err != nil {
+		t.Fatalf("(*RDB).DeleteDeadTask(%v, %d) = %v, want nil", t3.ID, diedAt, err)
+	}
+	clock.AdvanceTime(time.Minute)
+	kill("task4")
+	kill("task5")
+
+	var got []string
+	for _, msg := range h.GetDeadMessages(t, r.client) {
+		got = append(got, msg.Type)
+	}
+	sort.Strings(got)
+	if want := []string{"task1", "task4", "task5"}; !cmp.Equal(want, got) {
+		t.Errorf("dead tasks = %v, want %v", got, want)
+	}
+
+	if err := r.DeleteAllDeadTasks(); err != nil {
+		t.Fatalf("(*RDB).DeleteAllDeadTasks() = %v, want nil", err)
+	}
+	if n := r.client.Exists(base.DeadKey("default")).Val(); n != 0 {
+		t.Errorf("%q exists after deleting all dead tasks", base.DeadKey("default"))
+	}
+}
+
+func TestRestoreUnfinished(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessage("sync_stuff", nil)
+	t4 := h.NewTaskMessageWithQueue("reindex", nil, "critical")
+
+	tests := []struct {
+		inProgress     []*base.TaskMessage
+		enqueued       []*base.TaskMessage
+		want           int64
+		wantInProgress []*base.TaskMessage
+		wantEnqueued   []*base.TaskMessage
+		wantCritical   []*base.TaskMessage
+	}{
+		{
+			inProgress:     []*base.TaskMessage{t1, t2, t3},
+			enqueued:       []*base.TaskMessage{},
+			want:           3,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantCritical:   []*base.TaskMessage{},
+		},
+		{
+			inProgress:     []*base.TaskMessage{},
+			enqueued:       []*base.TaskMessage{t1, t2, t3},
+			want:           0,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantCritical:   []*base.TaskMessage{},
+		},
+		{
+			inProgress:     []*base.TaskMessage{t2, t3},
+			enqueued:       []*base.TaskMessage{t1},
+			want:           2,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantCritical:   []*base.TaskMessage{},
+		},
+		{
+			inProgress:     []*base.TaskMessage{t1, t4},
+			enqueued:       []*base.TaskMessage{},
+			want:           2,
+			wantInProgress: []*base.TaskMessage{},
+			wantEnqueued:   []*base.TaskMessage{t1},
+			wantCritical:   []*base.TaskMessage{t4},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client) // clean up db before each test case
+		h.SeedInProgressQueue(t, r.client, tc.inProgress)
+		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
+
+		got, err := r.RestoreUnfinished()
+		if got != tc.want || err != nil {
+			t.Errorf("(*RDB).RestoreUnfinished() = %v %v, want %v nil", got, err, tc.want)
+			continue
+		}
+
+		gotInProgress := h.GetInProgressMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+		}
+
+		gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+		}
+		gotCritical := h.GetEnqueuedMessages(t, r.client, "critical")
+		if diff := cmp.Diff(tc.wantCritical, gotCritical, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.QueueKey("critical"), diff)
+		}
+	}
+}
+
+func TestRestoreUnexpired(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("send_reminder", nil)
+	t2.Deadline = now.Add(-time.Minute).Unix()
+	t3 := h.NewTaskMessage("send_reminder", nil)
+	t3.Deadline = now.Add(time.Minute).Unix()
+	t4 := h.NewTaskMessage("send_reminder", nil)
+	t4.Deadline = now.Add(-time.Hour).Unix()
+	t4.Priority = 3
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2, t3, t4})
+
+	n, expired, err := r.RestoreUnexpired()
+	if n != 2 || err != nil {
+		t.Fatalf("(*RDB).RestoreUnexpired() = %v, _, %v, want 2, _, nil", n, err)
+	}
+	wantExpired := []*base.TaskMessage{t2, t4}
+	if diff := cmp.Diff(wantExpired, expired, h.SortMsgOpt); diff != "" {
+		t.Errorf("(*RDB).RestoreUnexpired() returned expired tasks %v, want %v; (-want, +got)\n%s",
+			expired, wantExpired, diff)
+	}
+	// Expired tasks are left in-progress.
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff(wantExpired, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1, t3}, gotEnqueued, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+	}
+	if l := r.client.ZCard(base.PriorityQueueKey(base.DefaultQueueName)).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.PriorityQueueKey(base.DefaultQueueName), l)
+	}
+}
+
+func TestRestoreUnfinishedWithScopedInProgress(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessage("sync_stuff", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{t2}, "server1")
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{t3}, "server2")
+
+	r.ScopeInProgress("server1")
+	got, err := r.RestoreUnfinished()
+	if got != 1 || err != nil {
+		t.Fatalf("(*RDB).RestoreUnfinished() = %v %v, want 1 nil", got, err)
+	}
+
+	// Only the tasks of the server are restored.
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotEnqueued, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	gotOther := h.GetServerInProgressMessages(t, r.client, "server2")
+	if diff := cmp.Diff([]*base.TaskMessage{t3}, gotOther, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressKey("server2"), diff)
+	}
+
+	// Tasks dequeued by the scoped RDB are tracked in the list of the server.
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1})
+	if _, err := r.Dequeue("default"); err != nil {
+		t.Fatal(err)
+	}
+	gotInProgress = h.GetServerInProgressMessages(t, r.client, "server1")
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressKey("server1"), diff)
+	}
+	if err := r.Done(t1); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.LLen(base.InProgressKey("server1")).Val(); n != 0 {
+		t.Errorf("%q has %d tasks after Done, want 0", base.InProgressKey("server1"), n)
+	}
+}
+
+func TestStartedTimeClearedWithUnfinishedTasks(t *testing.T) {
+	r := setup(t)
+	tests := []struct {
+		desc   string
+		finish func(r *RDB) (int64, error)
+	}{
+		{"RestoreUnfinished", (*RDB).RestoreUnfinished},
+		{"AbandonUnfinished", (*RDB).AbandonUnfinished},
+		{"ReclaimExpired", func(r *RDB) (int64, error) {
+			r.SetClock(base.NewSimulatedClock(time.Now().Add(time.Hour)))
+			return r.ReclaimExpired()
+		}},
+	}
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		r := NewRDB(r.client)
+		r.ScopeInProgress("server1")
+		if err := r.ExtendLease("server1", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		m1 := h.NewTaskMessage("send_email", nil)
+		m2 := h.NewTaskMessage("reindex", nil)
+		h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{m1, m2}, "server1")
+		if err := r.MarkStarted(m1, m2); err != nil {
+			t.Fatal(err)
+		}
+
+		if n, err := tc.finish(r); n != 2 || err != nil {
+			t.Errorf("%s returned %d, %v; want 2, nil", tc.desc, n, err)
+			continue
+		}
+		if n := r.client.ZCard(base.StartedTasks).Val(); n != 0 {
+			t.Errorf("%s left %d tasks in %q, want 0", tc.desc, n, base.StartedTasks)
+		}
+	}
+}
+
+func TestReclaimExpired(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now)
+	r.SetClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessageWithQueue("sync_stuff", nil, "critical")
+	t3.Priority = 2
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{t1, t3}, "dead")
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{t2}, "alive")
+
+	if err := r.ExtendLease("dead", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ExtendLease("alive", 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.ReclaimExpired(); got != 0 || err != nil {
+		t.Errorf("(*RDB).ReclaimExpired() = %v %v before the lease expires, want 0 nil", got, err)
+	}
+
+	// "dead" stops extending its lease.
+	clock.AdvanceTime(2 * time.Minute)
+	if err := r.ExtendLease("alive", 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ReclaimExpired()
+	if got != 2 || err != nil {
+		t.Fatalf("(*RDB).ReclaimExpired() = %v %v, want 2 nil", got, err)
+	}
+
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1}, gotEnqueued); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+	}
+	gotPriority := h.GetPriorityMessages(t, r.client, "critical")
+	if diff := cmp.Diff([]*base.TaskMessage{t3}, gotPriority); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.PriorityQueueKey("critical"), diff)
+	}
+	if n := r.client.LLen(base.InProgressKey("dead")).Val(); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressKey("dead"), n)
+	}
+	gotAlive := h.GetServerInProgressMessages(t, r.client, "alive")
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotAlive); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressKey("alive"), diff)
+	}
+	gotServers := r.client.ZRange(base.Servers, 0, -1).Val()
+	if diff := cmp.Diff([]string{"alive"}, gotServers); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.Servers, diff)
+	}
+
+	// Tasks in the list of a live server are listed as in-progress.
+	tasks, err := r.ListInProgress()
+	if err != nil || len(tasks) != 1 || tasks[0].ID != t2.ID {
+		t.Errorf("(*RDB).ListInProgress() = %v, %v; want the task %v", tasks, err, t2)
+	}
+	stats, err := r.CurrentStats()
+	if err != nil || stats.InProgress != 1 {
+		t.Errorf("(*RDB).CurrentStats() = %+v, %v; want 1 in-progress task", stats, err)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	h.SeedServerInProgressQueue(t, r.client, []*base.TaskMessage{t1}, "server2")
+	for _, id := range []string{"server1", "server2"} {
+		if err := r.ExtendLease(id, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.ReleaseLease(id); err != nil {
+			t.Fatalf("(*RDB).ReleaseLease(%q) = %v, want nil", id, err)
+		}
+	}
+
+	// The lease of the server with unfinished tasks is expired instead.
+	gotServers := r.client.ZRange(base.Servers, 0, -1).Val()
+	if diff := cmp.Diff([]string{"server2"}, gotServers); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.Servers, diff)
+	}
+	r.SetClock(base.NewSimulatedClock(time.Now().Add(time.Second)))
+	if got, err := r.ReclaimExpired(); got != 1 || err != nil {
+		t.Errorf("(*RDB).ReclaimExpired() = %v %v, want 1 nil", got, err)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	r := setup(t)
+	h.FlushDB(t, r.client)
+	a := NewRDB(r.client)
+	a.ScopeInProgress("a")
+	a.SetAffinity("a", time.Hour)
+	b := NewRDB(r.client)
+	b.ScopeInProgress("b")
+	b.SetAffinity("b", time.Hour)
+	for _, id := range []string{"a", "b"} {
+		if err := r.ExtendLease(id, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var msgs []*base.TaskMessage
+	for i := 0; i < 4; i++ {
+		msg := h.NewTaskMessage("sync_user", nil)
+		msg.Affinity = "user:1"
+		msgs = append(msgs, msg)
+	}
+	other := h.NewTaskMessage("sync_user", nil)
+	other.Affinity = "user:2"
+	h.SeedEnqueuedQueue(t, r.client, append(msgs, other))
+
+	processed := make(map[string]string) // task id -> server id
+	dequeue := func(r *RDB, id string, want *base.TaskMessage) {
+		t.Helper()
+		got, err := r.Dequeue(base.DefaultQueueName)
+		if want == nil {
+			if err != ErrNoProcessableTask {
+				t.Fatalf("%s: (*RDB).Dequeue() = %v, %v; want the task routed away", id, got, err)
+			}
+			return
+		}
+		if err != nil || got.ID != want.ID {
+			t.Fatalf("%s: (*RDB).Dequeue() = %v, %v; want %v", id, got, err, want)
+		}
+		if prev, ok := processed[got.ID.String()]; ok {
+			t.Fatalf("%s: task %v dequeued again, already dequeued by %s", id, got.ID, prev)
+		}
+		processed[got.ID.String()] = id
+		if err := r.Done(got); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The tasks of the key taken by a are routed to a.
+	dequeue(a, "a", msgs[0])
+	dequeue(b, "b", nil)
+	dequeue(b, "b", nil)
+	dequeue(b, "b", nil)
+	dequeue(b, "b", other)
+	dequeue(a, "a", msgs[1])
+	if got := h.GetEnqueuedMessages(t, r.client); len(got) != 0 {
+		t.Errorf("%q has %d tasks after routing, want 0", base.DefaultQueue, len(got))
+	}
+
+	// Once a releases its lease, the tasks routed to a are moved back to
+	// the queue, and b takes over the key.
+	if err := a.ReleaseLease("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.LLen(base.RoutedKey("a", base.DefaultQueueName)).Val(); n != 0 {
+		t.Errorf("%q has %d tasks after the lease is released, want 0", base.RoutedKey("a", base.DefaultQueueName), n)
+	}
+	dequeue(b, "b", msgs[2])
+	dequeue(b, "b", msgs[3])
+	if got := r.client.Get(base.AffinityKey(base.DefaultQueueName, "user:1")).Val(); got != "b" {
+		t.Errorf("GET %q = %q, want %q", base.AffinityKey(base.DefaultQueueName, "user:1"), got, "b")
+	}
+	if len(processed) != 5 {
+		t.Errorf("%d tasks processed, want 5", len(processed))
+	}
+}
+
+func TestPostpone(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+	t3 := h.NewTaskMessageWithQueue("gen_thumbnail", nil, "critical")
+	t3.Priority = 3
+	t4 := h.NewTaskMessageWithQueue("reindex", nil, "critical")
+	t4.Priority = 3
+
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t2})
+	h.SeedPriorityQueue(t, r.client, []h.ZSetEntry{{Msg: t4, Score: priorityScore(t4.Priority, time.Now().Add(-time.Minute))}}, "critical")
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t3})
+
+	if err := r.Postpone(t1); err != nil {
+		t.Fatalf("(*RDB).Postpone(%v) = %v, want nil", t1, err)
+	}
+	if err := r.Postpone(t3); err != nil {
+		t.Fatalf("(*RDB).Postpone(%v) = %v, want nil", t3, err)
+	}
+
+	// postponed task should be placed behind the tasks in the queue.
+	if got, err := r.Dequeue("default"); err != nil || got.ID != t2.ID {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, %v; want %v, nil", "default", got, err, t2)
+	}
+	if got, err := r.Dequeue("default"); err != nil || got.ID != t1.ID {
+		t.Errorf("(*RDB).Dequeue(%q) = %v, %v; want %v, nil", "default", got, err, t1)
+	}
+	wantPriority := []*base.TaskMessage{t4, t3}
+	gotPriority := h.GetPriorityMessages(t, r.client, "critical")
+	if diff := cmp.Diff(wantPriority, gotPriority); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.PriorityQueueKey("critical"), diff)
+	}
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2, t1}, gotInProgress, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("export_csv", nil)
+
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1, t2})
+
+	now := time.Now()
+	if err := r.Abandon(t1); err != nil {
+		t.Fatalf("(*RDB).Abandon(task) = %v, want nil", err)
+	}
+
+	gotInProgress := h.GetInProgressMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
+	}
+	gotAbandoned := h.GetAbandonedEntries(t, r.client)
+	wantAbandoned := []h.ZSetEntry{{Msg: t1, Score: float64(now.Unix())}}
+	cmpOpt := cmp.Comparer(func(x, y float64) bool { return math.Abs(x-y) <= 1 })
+	if diff := cmp.Diff(wantAbandoned, gotAbandoned, cmpOpt); diff != "" {
+		t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.AbandonedQueue, diff)
+	}
+	if got := h.GetEnqueuedMessages(t, r.client); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, len(got))
 	}
 }
 
-func TestRestoreUnfinished(t *testing.T) {
+func TestAbandonUnfinished(t *testing.T) {
 	r := setup(t)
 	t1 := h.NewTaskMessage("send_email", nil)
 	t2 := h.NewTaskMessage("export_csv", nil)
@@ -521,42 +2179,42 @@ func TestRestoreUnfinished(t *testing.T) {
 
 	tests := []struct {
 		inProgress     []*base.TaskMessage
-		enqueued       []*base.TaskMessage
+		abandoned      []h.ZSetEntry
 		want           int64
 		wantInProgress []*base.TaskMessage
-		wantEnqueued   []*base.TaskMessage
+		wantAbandoned  []*base.TaskMessage
 	}{
 		{
-			inProgress:     []*base.TaskMessage{t1, t2, t3},
-			enqueued:       []*base.TaskMessage{},
-			want:           3,
+			inProgress:     []*base.TaskMessage{t1, t2},
+			abandoned:      []h.ZSetEntry{},
+			want:           2,
 			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantAbandoned:  []*base.TaskMessage{t1, t2},
 		},
 		{
-			inProgress:     []*base.TaskMessage{},
-			enqueued:       []*base.TaskMessage{t1, t2, t3},
-			want:           0,
+			inProgress:     []*base.TaskMessage{t2, t3},
+			abandoned:      []h.ZSetEntry{{Msg: t1, Score: float64(time.Now().Add(-time.Hour).Unix())}},
+			want:           2,
 			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantAbandoned:  []*base.TaskMessage{t1, t2, t3},
 		},
 		{
-			inProgress:     []*base.TaskMessage{t2, t3},
-			enqueued:       []*base.TaskMessage{t1},
-			want:           2,
+			inProgress:     []*base.TaskMessage{},
+			abandoned:      []h.ZSetEntry{},
+			want:           0,
 			wantInProgress: []*base.TaskMessage{},
-			wantEnqueued:   []*base.TaskMessage{t1, t2, t3},
+			wantAbandoned:  []*base.TaskMessage{},
 		},
 	}
 
 	for _, tc := range tests {
 		h.FlushDB(t, r.client) // clean up db before each test case
 		h.SeedInProgressQueue(t, r.client, tc.inProgress)
-		h.SeedEnqueuedQueue(t, r.client, tc.enqueued)
+		h.SeedAbandonedQueue(t, r.client, tc.abandoned)
 
-		got, err := r.RestoreUnfinished()
+		got, err := r.AbandonUnfinished()
 		if got != tc.want || err != nil {
-			t.Errorf("(*RDB).RestoreUnfinished() = %v %v, want %v nil", got, err, tc.want)
+			t.Errorf("(*RDB).AbandonUnfinished() = %v %v, want %v nil", got, err, tc.want)
 			continue
 		}
 
@@ -564,11 +2222,160 @@ func TestRestoreUnfinished(t *testing.T) {
 		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, h.SortMsgOpt); diff != "" {
 			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.InProgressQueue, diff)
 		}
+		gotAbandoned := h.GetAbandonedMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantAbandoned, gotAbandoned, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.AbandonedQueue, diff)
+		}
+		if got := h.GetEnqueuedMessages(t, r.client); len(got) != 0 {
+			t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, len(got))
+		}
+	}
+}
+
+func TestRetriedTaskEnqueuedAtRetryTime(t *testing.T) {
+	r := setup(t)
+	clock := base.NewSimulatedClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	r.SetClock(clock)
+	r.SetServerClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{t1})
+
+	retryAt := clock.Now().Add(10 * time.Minute)
+	if err := r.Retry(t1, retryAt, "something went wrong"); err != nil {
+		t.Fatalf("(*RDB).Retry() = %v, want nil", err)
+	}
+	retried, err := r.ListRetry()
+	if err != nil {
+		t.Fatalf("(*RDB).ListRetry() returned error: %v", err)
+	}
+	if len(retried) != 1 || !retried[0].ProcessAt.Equal(retryAt) {
+		t.Fatalf("(*RDB).ListRetry() = %+v, want a task to be processed at %v", retried, retryAt)
+	}
+
+	tests := []struct {
+		advance      time.Duration
+		wantEnqueued int
+		wantRetry    int
+	}{
+		{advance: 10*time.Minute - time.Second, wantEnqueued: 0, wantRetry: 1},
+		{advance: time.Second, wantEnqueued: 1, wantRetry: 0},
+	}
+
+	// Note: test cases share the state and are run in order.
+	for _, tc := range tests {
+		clock.AdvanceTime(tc.advance)
+		if err := r.CheckAndEnqueue(); err != nil {
+			t.Errorf("(*RDB).CheckAndEnqueue() = %v, want nil", err)
+			continue
+		}
+		if got := len(h.GetEnqueuedMessages(t, r.client)); got != tc.wantEnqueued {
+			t.Errorf("%q has %d tasks at %v, want %d", base.DefaultQueue, got, clock.Now(), tc.wantEnqueued)
+		}
+		if got := len(h.GetRetryMessages(t, r.client)); got != tc.wantRetry {
+			t.Errorf("%q has %d tasks at %v, want %d", base.RetryQueue, got, clock.Now(), tc.wantRetry)
+		}
+	}
+}
+
+func TestCheckAndEnqueueWithSimulatedClock(t *testing.T) {
+	r := setup(t)
+	clock := base.NewSimulatedClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	r.SetClock(clock)
+	r.SetServerClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("generate_csv", nil)
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t1, Score: float64(clock.Now().Add(time.Minute).Unix())},
+	})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t2, Score: float64(clock.Now().Add(time.Hour).Unix())},
+	})
+
+	tests := []struct {
+		advance       time.Duration
+		wantEnqueued  []*base.TaskMessage
+		wantScheduled []*base.TaskMessage
+		wantRetry     []*base.TaskMessage
+	}{
+		{
+			advance:       0,
+			wantEnqueued:  []*base.TaskMessage{},
+			wantScheduled: []*base.TaskMessage{t1},
+			wantRetry:     []*base.TaskMessage{t2},
+		},
+		{
+			advance:       time.Minute,
+			wantEnqueued:  []*base.TaskMessage{t1},
+			wantScheduled: []*base.TaskMessage{},
+			wantRetry:     []*base.TaskMessage{t2},
+		},
+		{
+			advance:       time.Hour,
+			wantEnqueued:  []*base.TaskMessage{t1, t2},
+			wantScheduled: []*base.TaskMessage{},
+			wantRetry:     []*base.TaskMessage{},
+		},
+	}
 
+	// Note: test cases share the state and are run in order.
+	for _, tc := range tests {
+		clock.AdvanceTime(tc.advance)
+		if err := r.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+			t.Errorf("(*RDB).CheckAndEnqueue() = %v, want nil", err)
+			continue
+		}
 		gotEnqueued := h.GetEnqueuedMessages(t, r.client)
 		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q: (-want, +got):\n%s", base.DefaultQueue, diff)
+			t.Errorf("mismatch found in %q after advancing clock by %v; (-want, +got)\n%s", base.DefaultQueue, tc.advance, diff)
+		}
+		gotScheduled := h.GetScheduledMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantScheduled, gotScheduled, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q after advancing clock by %v; (-want, +got)\n%s", base.ScheduledQueue, tc.advance, diff)
+		}
+		gotRetry := h.GetRetryMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q after advancing clock by %v; (-want, +got)\n%s", base.RetryQueue, tc.advance, diff)
+		}
+	}
+}
+
+func TestCheckAndEnqueueWithClockMovingBackward(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	clock := base.NewSimulatedClock(now)
+	r.SetClock(clock)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("generate_csv", nil)
+	t3 := h.NewTaskMessage("gen_thumbnail", nil)
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t1, Score: float64(now.Add(-time.Second).Unix())},
+		{Msg: t2, Score: float64(now.Add(time.Hour).Unix())},
+	})
+	h.SeedRetryQueue(t, r.client, []h.ZSetEntry{
+		{Msg: t3, Score: float64(now.Add(-time.Minute).Unix())},
+	})
+
+	// The clock of the process jumps an hour backward, e.g. by an NTP
+	// correction, while the due tasks are still promoted.
+	clock.AdvanceTime(-time.Hour)
+	for _, qnames := range [][]string{{base.DefaultQueueName}, {base.DefaultQueueName, "critical"}} {
+		if err := r.CheckAndEnqueue(qnames...); err != nil {
+			t.Fatalf("(*RDB).CheckAndEnqueue(%v) = %v, want nil", qnames, err)
 		}
+		if _, err := r.ForwardRetry(10, qnames...); err != nil {
+			t.Fatalf("(*RDB).ForwardRetry(10, %v) returned error: %v", qnames, err)
+		}
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1, t3}, gotEnqueued, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after the clock moved backward; (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+	gotScheduled := h.GetScheduledMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotScheduled, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q after the clock moved backward; (-want, +got)\n%s", base.ScheduledQueue, diff)
+	}
+	if got := h.GetRetryMessages(t, r.client); len(got) != 0 {
+		t.Errorf("%q has %d tasks after the clock moved backward, want 0", base.RetryQueue, len(got))
 	}
 }
 
@@ -679,3 +2486,415 @@ func TestCheckAndEnqueue(t *testing.T) {
 		}
 	}
 }
+
+func TestSetIdempotencyKey(t *testing.T) {
+	r := setup(t)
+	id1, id2 := xid.New(), xid.New()
+	ttl := time.Hour
+
+	got, err := r.SetIdempotencyKey("key", id1, ttl)
+	if err != nil || got != id1 {
+		t.Fatalf("r.SetIdempotencyKey(%q, %v, %v) = %v, %v; want %v, nil", "key", id1, ttl, got, err, id1)
+	}
+	key := base.IdempotencyKey("key")
+	if gotTTL := r.client.TTL(key).Val(); gotTTL <= 0 || gotTTL > ttl {
+		t.Errorf("TTL of %q = %v, want (0, %v]", key, gotTTL, ttl)
+	}
+
+	got, err = r.SetIdempotencyKey("key", id2, ttl)
+	if err != ErrIdempotencyKeyExists || got != id1 {
+		t.Errorf("r.SetIdempotencyKey(%q, %v, %v) = %v, %v; want %v, %v", "key", id2, ttl, got, err, id1, ErrIdempotencyKeyExists)
+	}
+
+	// Key associated with another task should not be deleted.
+	if err := r.DeleteIdempotencyKey("key", id2); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.Exists(key).Val(); n != 1 {
+		t.Errorf("%q was deleted by a task not associated with the key", key)
+	}
+	if err := r.DeleteIdempotencyKey("key", id1); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.Exists(key).Val(); n != 0 {
+		t.Errorf("%q was not deleted", key)
+	}
+
+	got, err = r.SetIdempotencyKey("key", id2, ttl)
+	if err != nil || got != id2 {
+		t.Errorf("r.SetIdempotencyKey(%q, %v, %v) after delete = %v, %v; want %v, nil", "key", id2, ttl, got, err, id2)
+	}
+}
+
+func TestResultSlot(t *testing.T) {
+	r := setup(t)
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.ResultTTL = 60
+	id := msg.ID
+
+	if _, err := r.GetResult(id); err != ErrResultNotFound {
+		t.Errorf("r.GetResult(%v) before Enqueue returned error %v, want %v", id, err, ErrResultNotFound)
+	}
+	if err := r.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.WaitResult(id, time.Second)
+	if err != nil || got.State != ResultPending {
+		t.Fatalf("r.WaitResult(%v) before StoreResult = %+v, %v; want pending", id, got, err)
+	}
+
+	want := &ResultRecord{State: ResultCompleted, Result: &TaskResult{Status: "success", Data: []byte("ok")}}
+	if err := r.StoreResult(id, want, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Every waiter gets the result, including those which start waiting
+	// after the result is stored.
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		got, err := r.WaitResult(id, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("r.WaitResult(%v) = %+v, want %+v; (-want,+got)\n%s", id, got, want, diff)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("r.WaitResult(%v) took %v, want it to return right away", id, elapsed)
+		}
+	}
+	key := base.ResultKey(id.String())
+	if ttl := r.client.PTTL(key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL of %q = %v, want (0, %v]", key, ttl, time.Minute)
+	}
+}
+
+func TestEnqueueReservesResultSlot(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	tests := []struct {
+		desc    string
+		enqueue func(msg *base.TaskMessage) error
+	}{
+		{"Enqueue", r.Enqueue},
+		{"Schedule", func(msg *base.TaskMessage) error { return r.Schedule(msg, now.Add(time.Hour)) }},
+		{"ScheduleIn", func(msg *base.TaskMessage) error { _, err := r.ScheduleIn(msg, time.Hour); return err }},
+		{"EnqueueDependent", func(msg *base.TaskMessage) error {
+			msg.DependsOn = xid.New().String()
+			return r.EnqueueDependent(msg)
+		}},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		stored := h.NewTaskMessage("send_email", nil)
+		stored.ResultTTL = 60
+		if err := tc.enqueue(stored); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		got, err := r.GetResult(stored.ID)
+		if err != nil || got.State != ResultPending {
+			t.Errorf("%s: r.GetResult(%v) = %+v, %v; want pending", tc.desc, stored.ID, got, err)
+		}
+		key := base.ResultKey(stored.ID.String())
+		if ttl, want := r.client.PTTL(key).Val(), PendingResultTTL+time.Minute; ttl <= PendingResultTTL || ttl > want {
+			t.Errorf("%s: TTL of %q = %v, want (%v, %v]", tc.desc, key, ttl, PendingResultTTL, want)
+		}
+
+		plain := h.NewTaskMessage("send_email", nil)
+		if err := tc.enqueue(plain); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if _, err := r.GetResult(plain.ID); err != ErrResultNotFound {
+			t.Errorf("%s: r.GetResult(%v) without ResultTTL returned error %v, want %v", tc.desc, plain.ID, err, ErrResultNotFound)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	r := setup(t)
+	r1 := NewRDBWithNamespace(r.client, "app1")
+	r2 := NewRDBWithNamespace(r.client, "app2")
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+
+	if err := r1.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Schedule(m2, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.client.LLen("app1:asynq:queues:default").Val(); n != 1 {
+		t.Errorf("%q has %d tasks, want 1", "app1:asynq:queues:default", n)
+	}
+
+	// Tasks in other namespaces should not be visible.
+	for _, rdb := range []*RDB{r, r2} {
+		if got, err := rdb.Dequeue(base.DefaultQueueName); err != ErrNoProcessableTask {
+			t.Errorf("(*RDB).Dequeue() = %v, %v; want nil, %v", got, err, ErrNoProcessableTask)
+		}
+	}
+	stats, err := r.CurrentStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Enqueued != 0 || stats.Scheduled != 0 {
+		t.Errorf("CurrentStats() in default namespace = %+v, want no tasks", stats)
+	}
+
+	got, err := r1.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() in namespace app1 returned error: %v", err)
+	}
+	if diff := cmp.Diff(m1, got); diff != "" {
+		t.Errorf("(*RDB).Dequeue() in namespace app1 = %v, want %v; (-want,+got):\n%s", got, m1, diff)
+	}
+
+	if err := r2.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r1.Dequeue(base.DefaultQueueName); err != ErrNoProcessableTask {
+		t.Errorf("(*RDB).Dequeue() in namespace app1 = %v, %v; want nil, %v", got, err, ErrNoProcessableTask)
+	}
+	got, err = r2.Dequeue(base.DefaultQueueName)
+	if err != nil {
+		t.Fatalf("(*RDB).Dequeue() in namespace app2 returned error: %v", err)
+	}
+	if diff := cmp.Diff(m2, got); diff != "" {
+		t.Errorf("(*RDB).Dequeue() in namespace app2 = %v, want %v; (-want,+got):\n%s", got, m2, diff)
+	}
+}
+
+func TestEnqueueWithDepth(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("generate_csv", nil)
+	t2.Priority = 3
+	t3 := h.NewTaskMessage("sync", nil)
+	t4 := h.NewTaskMessageWithQueue("reindex", nil, "low")
+
+	tests := []struct {
+		msg  *base.TaskMessage
+		want int64
+	}{
+		{t1, 1},
+		{t2, 2}, // prioritized tasks count toward the depth of the queue
+		{t3, 3},
+		{t4, 1}, // depth of another queue
+	}
+
+	// Note: test cases share the state and are run in order.
+	for _, tc := range tests {
+		got, err := r.EnqueueWithDepth(tc.msg)
+		if err != nil {
+			t.Errorf("(*RDB).EnqueueWithDepth(%v) returned error: %v", tc.msg, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).EnqueueWithDepth(%v) = %d, want %d", tc.msg, got, tc.want)
+		}
+	}
+
+	gotEnqueued := h.GetEnqueuedMessages(t, r.client)
+	if diff := cmp.Diff([]*base.TaskMessage{t1, t3}, gotEnqueued, h.SortMsgOpt); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	gotPriority := h.GetPriorityMessages(t, r.client, base.DefaultQueueName)
+	if diff := cmp.Diff([]*base.TaskMessage{t2}, gotPriority); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.PriorityQueueKey(base.DefaultQueueName), diff)
+	}
+
+	// depth decreases as tasks get dequeued.
+	if _, err := r.Dequeue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.EnqueueWithDepth(h.NewTaskMessage("send_email", nil)); err != nil || got != 3 {
+		t.Errorf("(*RDB).EnqueueWithDepth() after dequeue = %d, %v; want 3, nil", got, err)
+	}
+}
+
+func TestQueueDepths(t *testing.T) {
+	r := setup(t)
+	t1 := h.NewTaskMessage("send_email", nil)
+	t2 := h.NewTaskMessage("send_email", nil)
+	t3 := h.NewTaskMessageWithQueue("generate_csv", nil, "low")
+	t4 := h.NewTaskMessageWithQueue("generate_csv", nil, "low")
+	t4.Priority = 2
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t1, t2})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{t3}, "low")
+	if err := r.Enqueue(t4); err != nil {
+		t.Fatalf("(*RDB).Enqueue(%v) = %v, want nil", t4, err)
+	}
+
+	got, err := r.QueueDepths("default", "low", "critical")
+	if err != nil {
+		t.Fatalf("(*RDB).QueueDepths() = _, %v, want nil", err)
+	}
+	want := map[string]int64{"default": 2, "low": 2, "critical": 0}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(*RDB).QueueDepths() = %v, want %v; (-want,+got)\n%s", got, want, diff)
+	}
+}
+
+func TestQueueLatency(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+	newMsg := func(qname string, age time.Duration) *base.TaskMessage {
+		msg := h.NewTaskMessageWithQueue("send_email", nil, qname)
+		msg.EnqueuedAt = now.Add(-age).UnixNano()
+		return msg
+	}
+	m1 := newMsg("default", 3*time.Minute)
+	m2 := newMsg("default", time.Minute)
+	m3 := newMsg("low", time.Minute)
+	m4 := newMsg("low", 10*time.Minute)
+	m4.Priority = 2
+	m5 := h.NewTaskMessageWithQueue("send_email", nil, "legacy") // enqueue time unknown
+
+	h.FlushDB(t, r.client)
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m1, m2})
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m3}, "low")
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{m5}, "legacy")
+	if err := r.Enqueue(m4); err != nil {
+		t.Fatalf("(*RDB).Enqueue(%v) = %v, want nil", m4, err)
+	}
+
+	tests := []struct {
+		qname string
+		want  time.Duration
+	}{
+		{"default", 3 * time.Minute},
+		{"low", 10 * time.Minute}, // prioritized task is older
+		{"legacy", 0},
+		{"empty", 0},
+	}
+	for _, tc := range tests {
+		got, err := r.QueueLatency(tc.qname)
+		if err != nil {
+			t.Errorf("(*RDB).QueueLatency(%q) returned error: %v", tc.qname, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("(*RDB).QueueLatency(%q) = %v, want %v", tc.qname, got, tc.want)
+		}
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	r.SetClock(base.NewSimulatedClock(now))
+
+	expired := h.NewTaskMessage("send_email", nil)
+	expired.ExpiresAt = now.Add(-time.Minute).Unix()
+	fresh := h.NewTaskMessage("send_email", nil)
+	fresh.ExpiresAt = now.Add(time.Minute).Unix()
+	prioritized := h.NewTaskMessageWithQueue("reindex", nil, "low")
+	prioritized.Priority = 5
+	prioritized.ExpiresAt = now.Add(-time.Minute).Unix()
+	scheduled := h.NewTaskMessage("gen_thumbnail", nil)
+	scheduled.ExpiresAt = now.Add(-time.Minute).Unix()
+	inProgress := h.NewTaskMessage("sync", nil)
+	inProgress.ExpiresAt = now.Add(-time.Minute).Unix()
+
+	for _, msg := range []*base.TaskMessage{expired, fresh, prioritized, scheduled, inProgress} {
+		if err := r.ExpirePending(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.SeedEnqueuedQueue(t, r.client, []*base.TaskMessage{expired, fresh})
+	h.SeedPriorityQueue(t, r.client, []h.ZSetEntry{{Msg: prioritized, Score: 1}}, "low")
+	h.SeedScheduledQueue(t, r.client, []h.ZSetEntry{{Msg: scheduled, Score: float64(now.Add(time.Hour).Unix())}})
+	h.SeedInProgressQueue(t, r.client, []*base.TaskMessage{inProgress})
+
+	n, err := r.DeleteExpired()
+	if err != nil {
+		t.Fatalf("r.DeleteExpired() returned error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("r.DeleteExpired() = %d, want 3", n)
+	}
+	if diff := cmp.Diff([]*base.TaskMessage{fresh}, h.GetEnqueuedMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	if got := h.GetPriorityMessages(t, r.client, "low"); len(got) != 0 {
+		t.Errorf("priority queue of %q has %d tasks, want 0", "low", len(got))
+	}
+	if got := h.GetScheduledMessages(t, r.client); len(got) != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledQueue, len(got))
+	}
+	// Tasks pulled out of the queue are not affected.
+	if diff := cmp.Diff([]*base.TaskMessage{inProgress}, h.GetInProgressMessages(t, r.client)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.InProgressQueue, diff)
+	}
+	if got := r.client.ZCard(base.ExpiringQueue).Val(); got != 1 {
+		t.Errorf("%q has %d entries, want 1", base.ExpiringQueue, got)
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	r := setup(t)
+	now := time.Now()
+	due := float64(now.Add(-time.Minute).Unix())
+	future := float64(now.Add(time.Hour).Unix())
+	m1 := h.NewTaskMessage("sync", nil)
+	m2 := h.NewTaskMessage("sync", nil)
+	m3 := h.NewTaskMessage("sync", nil)
+	m4 := h.NewTaskMessageWithQueue("sync", nil, "low")
+	m5 := h.NewTaskMessage("sync", nil)
+	entries := []h.ZSetEntry{
+		{Msg: m1, Score: due - 2},
+		{Msg: m2, Score: due - 1},
+		{Msg: m3, Score: due},
+		{Msg: m4, Score: due},
+		{Msg: m5, Score: future},
+	}
+
+	tests := []struct {
+		qnames    []string
+		wantMoved int64
+		wantQueue map[string][]*base.TaskMessage
+		wantRetry []*base.TaskMessage
+	}{
+		{
+			qnames:    []string{"default", "low"},
+			wantMoved: 3,
+			wantQueue: map[string][]*base.TaskMessage{
+				"default": {m1, m2}, // oldest first
+				"low":     {m4},
+			},
+			wantRetry: []*base.TaskMessage{m3, m5},
+		},
+		{
+			qnames:    []string{"default"},
+			wantMoved: 2,
+			wantQueue: map[string][]*base.TaskMessage{
+				"default": {m1, m2},
+				"low":     {},
+			},
+			wantRetry: []*base.TaskMessage{m3, m4, m5},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r.client)
+		h.SeedRetryQueue(t, r.client, entries)
+
+		n, err := r.ForwardRetry(2, tc.qnames...)
+		if err != nil || n != tc.wantMoved {
+			t.Errorf("(*RDB).ForwardRetry(2, %v) = %d, %v, want %d, nil", tc.qnames, n, err, tc.wantMoved)
+			continue
+		}
+		for qname, want := range tc.wantQueue {
+			got := h.GetEnqueuedMessages(t, r.client, qname)
+			if diff := cmp.Diff(want, got, h.SortMsgOpt); diff != "" {
+				t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.QueueKey(qname), diff)
+			}
+		}
+		got := h.GetRetryMessages(t, r.client)
+		if diff := cmp.Diff(tc.wantRetry, got, h.SortMsgOpt); diff != "" {
+			t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.RetryQueue, diff)
+		}
+	}
+}
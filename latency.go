@@ -0,0 +1,89 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyPercentiles holds the percentiles of the time the handler took to
+// process the tasks of a type, over the latest durations kept by the
+// background (see Config.TypeLatencySamples).
+type LatencyPercentiles struct {
+	// Count is the number of durations the percentiles are computed from.
+	Count int
+
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// latencyTracker holds up to size latest handler durations per task type,
+// overwriting the oldest duration of the type once it's full.
+type latencyTracker struct {
+	size int
+
+	mu    sync.Mutex
+	types map[string]*latencySamples
+}
+
+type latencySamples struct {
+	durations []time.Duration
+	next      int // index to write the next duration at
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{size: size, types: make(map[string]*latencySamples)}
+}
+
+func (t *latencyTracker) add(tasktype string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.types[tasktype]
+	if !ok {
+		s = &latencySamples{}
+		t.types[tasktype] = s
+	}
+	if len(s.durations) < t.size {
+		s.durations = append(s.durations, d)
+		return
+	}
+	s.durations[s.next] = d
+	s.next = (s.next + 1) % t.size
+}
+
+// percentiles returns the percentiles of the durations kept for each type.
+func (t *latencyTracker) percentiles() map[string]LatencyPercentiles {
+	t.mu.Lock()
+	sorted := make(map[string][]time.Duration, len(t.types))
+	for tasktype, s := range t.types {
+		sorted[tasktype] = append([]time.Duration(nil), s.durations...)
+	}
+	t.mu.Unlock()
+
+	res := make(map[string]LatencyPercentiles, len(sorted))
+	for tasktype, ds := range sorted {
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		res[tasktype] = LatencyPercentiles{
+			Count: len(ds),
+			P50:   percentile(ds, 50),
+			P95:   percentile(ds, 95),
+			P99:   percentile(ds, 99),
+		}
+	}
+	return res
+}
+
+// percentile returns the p-th percentile of the sorted durations by the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
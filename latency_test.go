@@ -0,0 +1,70 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	tr := newLatencyTracker(100)
+	// Durations of 1ms to 100ms in random order for "send_email".
+	for _, i := range rand.Perm(100) {
+		tr.add("send_email", time.Duration(i+1)*time.Millisecond)
+	}
+	tr.add("reindex", time.Second)
+
+	want := map[string]LatencyPercentiles{
+		"send_email": {Count: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond},
+		"reindex":    {Count: 1, P50: time.Second, P95: time.Second, P99: time.Second},
+	}
+	if diff := cmp.Diff(want, tr.percentiles()); diff != "" {
+		t.Errorf("percentiles() mismatch (-want,+got):\n%s", diff)
+	}
+
+	// Only the latest 100 durations are kept.
+	for i := 0; i < 100; i++ {
+		tr.add("send_email", time.Second+time.Duration(i)*time.Millisecond)
+	}
+	got := tr.percentiles()["send_email"]
+	if got.Count != 100 || got.P50 < time.Second {
+		t.Errorf("percentiles()[%q] = %+v after 100 more durations, want 100 durations of at least 1s", "send_email", got)
+	}
+	if n := len(tr.types["send_email"].durations); n != 100 {
+		t.Errorf("%d durations kept, want 100", n)
+	}
+}
+
+func TestBackgroundTypeLatencies(t *testing.T) {
+	setup(t)
+	r := &RedisClientOpt{Addr: "localhost:6379", DB: 14}
+	client := NewClient(r)
+	bg := NewBackground(r, &Config{Concurrency: 1, TypeLatencySamples: 10})
+	done := make(chan struct{}, 1)
+	bg.start(HandlerFunc(func(task *Task) error {
+		time.Sleep(100 * time.Millisecond)
+		done <- struct{}{}
+		return nil
+	}))
+	defer bg.stop()
+
+	if err := client.Schedule(NewTask("send_email", nil), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not processed")
+	}
+	time.Sleep(100 * time.Millisecond) // let the worker record the duration
+	got, ok := bg.TypeLatencies()["send_email"]
+	if !ok || got.Count != 1 || got.P50 < 100*time.Millisecond || got.P50 > time.Second {
+		t.Errorf("TypeLatencies()[%q] = %+v, want one duration of about 100ms", "send_email", got)
+	}
+}
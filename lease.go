@@ -0,0 +1,80 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// leaser keeps the lease of the background's in-progress list, and reclaims
+// the tasks of the backgrounds whose lease has expired.
+type leaser struct {
+	rdb *rdb.RDB
+
+	// serverID is the ID of the background holding the lease.
+	serverID string
+
+	// ttl is the duration of the lease, which is extended every ttl/3.
+	ttl time.Duration
+
+	logger *logger
+
+	// channel to communicate back to the long running "leaser" goroutine.
+	done chan struct{}
+}
+
+func newLeaser(r *rdb.RDB, serverID string, ttl time.Duration) *leaser {
+	return &leaser{
+		rdb:      r,
+		serverID: serverID,
+		ttl:      ttl,
+		logger:   defaultLogger,
+		done:     make(chan struct{}),
+	}
+}
+
+// terminate stops the "leaser" goroutine and releases the lease.
+// It should be called after the processor has restored its unfinished tasks.
+func (l *leaser) terminate() {
+	l.logger.printf("[INFO] Leaser shutting down...")
+	// Signal the leaser goroutine to stop extending the lease.
+	l.done <- struct{}{}
+	if err := l.rdb.ReleaseLease(l.serverID); err != nil {
+		l.logger.printf("[ERROR] could not release the lease: %v\n", err)
+	}
+}
+
+// start acquires the lease and starts the "leaser" goroutine.
+func (l *leaser) start() {
+	// Note: Acquire the lease before any task is pulled out of the queues,
+	// so that the tasks are never in a list without a lease.
+	l.exec()
+	go func() {
+		for {
+			select {
+			case <-l.done:
+				l.logger.printf("[INFO] Leaser done.")
+				return
+			case <-time.After(l.ttl / 3):
+				l.exec()
+			}
+		}
+	}()
+}
+
+func (l *leaser) exec() {
+	if err := l.rdb.ExtendLease(l.serverID, l.ttl); err != nil {
+		l.logger.printf("[ERROR] could not extend the lease: %v\n", err)
+	}
+	n, err := l.rdb.ReclaimExpired()
+	if err != nil {
+		l.logger.printf("[ERROR] could not reclaim tasks of expired leases: %v\n", err)
+	}
+	if n > 0 {
+		l.logger.printf("[INFO] Reclaimed %d tasks from backgrounds with expired lease.\n", n)
+	}
+}
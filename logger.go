@@ -0,0 +1,167 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq/internal/base"
+)
+
+// LogFormat specifies the format of the logs of the background.
+type LogFormat int
+
+const (
+	// TextLog logs lines prefixed with the level (e.g., "[INFO] Processor done.")
+	// with the standard log package. It's the default.
+	TextLog LogFormat = iota
+
+	// JSONLog logs a JSON object per line to stderr, with "time", "level" and
+	// "msg" fields, and "queue", "task_id" and "task_type" fields for the
+	// lines about a task, and "correlation_id" field for the lines about
+	// a task with a correlation ID.
+	JSONLog
+)
+
+// LogLevel specifies the least severe level of the lines logged by
+// the background.
+type LogLevel int
+
+const (
+	// InfoLevel logs the lines of INFO, WARN and ERROR levels. It's the default.
+	InfoLevel LogLevel = iota
+
+	// DebugLevel logs the lines of all levels, including the DEBUG lines
+	// with the details of each task, e.g. the failures of the tasks left out
+	// of the throttled failure logs.
+	DebugLevel
+
+	// WarnLevel logs the lines of WARN and ERROR levels.
+	WarnLevel
+
+	// ErrorLevel logs the lines of ERROR level only.
+	ErrorLevel
+)
+
+// severity returns the rank of the level, higher for more severe levels.
+func (lv LogLevel) severity() int {
+	switch lv {
+	case DebugLevel:
+		return 0
+	case WarnLevel:
+		return 2
+	case ErrorLevel:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// lineSeverity returns the rank of the level in the prefix of the line
+// (e.g., "[WARN] ..."). Lines without a known level are INFO lines.
+func lineSeverity(line string) int {
+	switch {
+	case strings.HasPrefix(line, "[DEBUG]"):
+		return DebugLevel.severity()
+	case strings.HasPrefix(line, "[WARN]"):
+		return WarnLevel.severity()
+	case strings.HasPrefix(line, "[ERROR]"):
+		return ErrorLevel.severity()
+	default:
+		return InfoLevel.severity()
+	}
+}
+
+// logger logs the lines of the background in the configured format.
+//
+// Lines are given in the format of the standard log package, prefixed
+// with the level in brackets (e.g., "[WARN] ..."). Lines less severe than
+// the level of the logger are dropped.
+type logger struct {
+	format LogFormat
+	level  LogLevel
+
+	mu  sync.Mutex
+	out io.Writer // used by JSONLog
+}
+
+// defaultLogger is used by the components created without a logger.
+var defaultLogger = newLogger(TextLog, nil)
+
+func newLogger(format LogFormat, out io.Writer) *logger {
+	if out == nil {
+		out = os.Stderr
+	}
+	return &logger{format: format, out: out}
+}
+
+// jsonLogEntry is a line logged in JSONLog format.
+type jsonLogEntry struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Msg      string `json:"msg"`
+	Queue    string `json:"queue,omitempty"`
+	TaskID   string `json:"task_id,omitempty"`
+	TaskType string `json:"task_type,omitempty"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// printf logs the line.
+func (l *logger) printf(format string, args ...interface{}) {
+	l.taskPrintf(nil, format, args...)
+}
+
+// taskPrintf logs the line about the given task.
+// The task is used by JSONLog format to fill the task fields. TextLog format
+// only appends the correlation ID of the task, if any, to the line.
+func (l *logger) taskPrintf(msg *base.TaskMessage, format string, args ...interface{}) {
+	if lineSeverity(format) < l.level.severity() {
+		return
+	}
+	if l.format != JSONLog {
+		if msg != nil && msg.CorrelationID != "" {
+			format = strings.TrimRight(format, "\n") + " (correlation ID: %s)\n"
+			args = append(args[:len(args):len(args)], msg.CorrelationID)
+		}
+		log.Printf(format, args...)
+		return
+	}
+	line := strings.TrimSpace(fmt.Sprintf(format, args...))
+	level := "info"
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "]"); i > 0 {
+			level = strings.ToLower(line[1:i])
+			line = strings.TrimSpace(line[i+1:])
+		}
+	}
+	entry := jsonLogEntry{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: level,
+		Msg:   line,
+	}
+	if msg != nil {
+		entry.Queue = msg.Queue
+		entry.TaskID = msg.ID.String()
+		entry.TaskType = msg.Type
+		entry.CorrelationID = msg.CorrelationID
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// Note: Marshaling the entry of strings never fails in practice.
+		log.Printf(format, args...)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(b, '\n'))
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// decodeJSONLines decodes each line in the buffer as a JSON object.
+func decodeJSONLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("could not decode log line %q as JSON: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(JSONLog, &buf)
+	msg := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+
+	l.printf("[INFO] Processor done.")
+	l.taskPrintf(msg, "[WARN] Retry exhausted for task(Type: %q, ID: %v)\n", msg.Type, msg.ID)
+	l.printf("no level")
+
+	entries := decodeJSONLines(t, &buf)
+	if len(entries) != 3 {
+		t.Fatalf("logged %d lines, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		ts, ok := entry["time"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, ts); !ok || err != nil {
+			t.Errorf("time = %v, want a RFC 3339 timestamp", entry["time"])
+		}
+		delete(entry, "time")
+	}
+	want := []map[string]interface{}{
+		{"level": "info", "msg": "Processor done."},
+		{
+			"level":     "warn",
+			"msg":       `Retry exhausted for task(Type: "send_email", ID: ` + msg.ID.String() + ")",
+			"queue":     "critical",
+			"task_id":   msg.ID.String(),
+			"task_type": "send_email",
+		},
+		{"level": "info", "msg": "no level"},
+	}
+	if diff := cmp.Diff(want, entries); diff != "" {
+		t.Errorf("logged lines mismatch; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level LogLevel
+		want  []string // levels of the lines logged
+	}{
+		{InfoLevel, []string{"info", "warn", "error"}},
+		{DebugLevel, []string{"debug", "info", "warn", "error"}},
+		{WarnLevel, []string{"warn", "error"}},
+		{ErrorLevel, []string{"error"}},
+	}
+	msg := h.NewTaskMessage("send_email", nil)
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		l := newLogger(JSONLog, &buf)
+		l.level = tc.level
+		l.taskPrintf(msg, "[DEBUG] Retry exhausted for task(ID: %v)\n", msg.ID)
+		l.printf("[INFO] Processor done.")
+		l.taskPrintf(msg, "[WARN] Retry exhausted for task(ID: %v)\n", msg.ID)
+		l.printf("[ERROR] Could not dequeue task")
+
+		var got []string
+		for _, entry := range decodeJSONLines(t, &buf) {
+			got = append(got, entry["level"].(string))
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("level %d; logged levels mismatch; (-want,+got)\n%s", tc.level, diff)
+		}
+	}
+}
+
+func TestJSONLoggerCorrelationID(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(JSONLog, &buf)
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.CorrelationID = "req-123"
+
+	l.taskPrintf(msg, "[INFO] Task done\n")
+
+	entries := decodeJSONLines(t, &buf)
+	if len(entries) != 1 || entries[0]["correlation_id"] != "req-123" {
+		t.Errorf("logged lines = %v, want a line with correlation_id %q", entries, "req-123")
+	}
+}
+
+func TestProcessorWithJSONLogger(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	var buf bytes.Buffer
+	p := newProcessor(processorParams{
+		rdb:            rdb.NewRDB(r),
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		logger:         newLogger(JSONLog, &buf),
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return ErrHandlerNotFound })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	var found bool
+	for _, entry := range decodeJSONLines(t, &buf) {
+		if entry["task_id"] == m1.ID.String() {
+			found = true
+			if entry["level"] != "warn" || entry["queue"] != base.DefaultQueueName || entry["task_type"] != m1.Type {
+				t.Errorf("log line of the unhandled task = %v, want warn level with the task fields", entry)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no log line with the task ID %v in\n%s", m1.ID, buf.String())
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "time"
+
+// MetricsCollector receives the metrics of the tasks processed by the
+// background (see Config.Metrics), to export them to a monitoring system.
+// See the statsd package for an implementation.
+//
+// The methods are called from the worker goroutines, so they must be safe
+// for concurrent use and should not block for long.
+type MetricsCollector interface {
+	// TaskProcessed is called after a task is processed successfully.
+	TaskProcessed(queue, tasktype string)
+
+	// TaskFailed is called after the processing of a task fails, before
+	// the task is retried or killed.
+	TaskFailed(queue, tasktype string)
+
+	// TaskRetried is called after a failed task is sent to the retry queue.
+	TaskRetried(queue, tasktype string)
+
+	// TaskKilled is called after a task is sent to the dead queue.
+	TaskKilled(queue, tasktype string)
+
+	// TaskDuration is called with the time the handler took to process
+	// a task, whether it succeeded or failed.
+	TaskDuration(queue, tasktype string, d time.Duration)
+}
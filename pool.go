@@ -0,0 +1,47 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+// workerPool is a set of long running goroutines which run the functions
+// handed to them, to avoid starting goroutines for each task.
+//
+// A function is run in a new goroutine if no goroutine of the pool is idle,
+// e.g. when handlers of terminated tasks are left running, so that run never
+// blocks on the pool.
+type workerPool struct {
+	size int
+	work chan func()
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{size: size, work: make(chan func())}
+}
+
+// start starts the goroutines of the pool.
+func (wp *workerPool) start() {
+	for i := 0; i < wp.size; i++ {
+		go func() {
+			for fn := range wp.work {
+				fn()
+			}
+		}()
+	}
+}
+
+// run runs fn in an idle goroutine of the pool, or in a new goroutine
+// if there's none. It must not be called after stop.
+func (wp *workerPool) run(fn func()) {
+	select {
+	case wp.work <- fn:
+	default:
+		go fn()
+	}
+}
+
+// stop tells the goroutines of the pool to exit once they're idle,
+// and returns without waiting for them.
+func (wp *workerPool) stop() {
+	close(wp.work)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	wp := newWorkerPool(2)
+	wp.start()
+	defer wp.stop()
+
+	// Functions are run while all the goroutines of the pool are busy.
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		wp.run(func() {
+			defer wg.Done()
+			<-release
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("functions did not return with the pool of 2 goroutines busy")
+	}
+}
+
+const benchmarkSpawnConcurrency = 10
+
+func BenchmarkSpawnGoroutine(b *testing.B) {
+	p := newProcessor(processorParams{concurrency: benchmarkSpawnConcurrency})
+	benchmarkSpawn(b, p)
+}
+
+func BenchmarkSpawnWorkerPool(b *testing.B) {
+	p := newProcessor(processorParams{concurrency: benchmarkSpawnConcurrency, workerPool: true})
+	p.pool.start()
+	defer p.pool.stop()
+	benchmarkSpawn(b, p)
+}
+
+// benchmarkSpawn runs the workers of short tasks the way exec does, with a
+// worker and a handler goroutine for each task.
+func benchmarkSpawn(b *testing.B, p *processor) {
+	b.ReportAllocs()
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		p.sema.acquire(1, nil)
+		p.spawn(func() {
+			defer wg.Done()
+			defer p.sema.release(1)
+			resCh := make(chan error, 1)
+			p.spawn(func() { resCh <- nil })
+			<-resCh
+		})
+	}
+	wg.Wait()
+}
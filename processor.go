@@ -5,218 +5,2394 @@
 package asynq
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"math/rand"
+	"runtime/debug"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/hook"
 	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
 )
 
 type processor struct {
 	rdb *rdb.RDB
 
+	// serverID is the ID of the background instance running the processor.
+	serverID string
+
 	handler Handler
 
+	// queueHandlers holds the handlers for specific queues.
+	// Tasks in other queues are processed by handler.
+	queueHandlers map[string]Handler
+
+	// batches holds the batch configs of the queues processed in batches.
+	batches map[string]Batch
+
+	// breakers holds the circuit breakers of the queues.
+	breakers map[string]*breaker
+
+	// queueDiscovery specifies whether to process the queues registered in
+	// redis in addition to the ones in queueConfig.
+	// lastDiscovery is the time the queues were last discovered.
+	// Only accessed by the "processor" goroutine.
+	queueDiscovery bool
+	lastDiscovery  time.Time
+
+	// pollInterval is the base duration to wait for a task when the queues
+	// are empty. Each wait is followed by a jitter using rand, which also
+	// orders the queues randomly.
+	// rand is only accessed by the "processor" goroutine.
+	pollInterval time.Duration
+	rand         *rand.Rand
+
+	// maxPolledQueues is the max number of queues to check at a time.
+	// pollCursor is the position to rotate through the queues from, if
+	// there are more queues. Only accessed by the "processor" goroutine.
+	maxPolledQueues int
+	pollCursor      int
+
+	// queueMu guards the updates of queueConfig and orderedQueues.
+	// They're updated only by the "processor" goroutine, which can read them
+	// without holding the lock; other goroutines must hold the lock.
+	queueMu     sync.Mutex
 	queueConfig map[string]uint
 
+	// pendingQueues is the queue config given to reconfigure, which the
+	// "processor" goroutine applies before it pulls the next task.
+	// Guarded by queueMu.
+	pendingQueues map[string]uint
+
 	// orderedQueues is set only in strict-priority mode.
+	// It caches the order of StrictSelector.
 	orderedQueues []string
 
+	// selector is a custom QueueSelector, which overrides the strict-priority
+	// and depth-aware modes. Nil if not specified.
+	selector QueueSelector
+
+	// reversedQueues is orderedQueues in reverse order, which is used
+	// when the number of tasks dequeued in a row from queues other than the
+	// lowest priority one (consecutive) reaches starvationGuard.
+	// Only accessed by the "processor" goroutine.
+	reversedQueues  []string
+	starvationGuard int
+	consecutive     int
+
+	// depthAware specifies whether to weight the queues by their pending
+	// depth in addition to their priority when they're ordered randomly.
+	// queueDepths is the depth of the queues sampled at lastDepthSample.
+	// Only accessed by the "processor" goroutine.
+	depthAware      bool
+	queueDepths     map[string]int64
+	lastDepthSample time.Time
+
+	// priorityAging is the priority aging period of the queues,
+	// which is stored in redis on start.
+	priorityAging time.Duration
+
 	retryDelayFunc retryDelayFunc
 
-	// sema is a counting semaphore to ensure the number of active workers
-	// does not exceed the limit.
-	sema chan struct{}
+	// queueRetryDelays holds the functions to compute retry delay of the
+	// tasks in specific queues, which take precedence over retryDelayFunc.
+	queueRetryDelays map[string]retryDelayFunc
+
+	retryDecider retryDecider
+
+	// errorClassifiers classify the errors of failed tasks before
+	// the retry decision.
+	errorClassifiers []func(error) ErrorClass
+
+	// retryPriorityBoost is added to the priority of a task on retry.
+	retryPriorityBoost int
+
+	onSuccess func(task *Task, latency time.Duration)
+
+	metrics MetricsCollector
+
+	// exporter archives the killed tasks, in goroutines tracked by exports
+	// if exportAsync is set. Nil if not specified.
+	exporter    DeadTaskExporter
+	exportAsync bool
+	exports     sync.WaitGroup
+
+	onRequeue func(task *Task)
+
+	onRetry func(task *Task, delay time.Duration)
+
+	onMalformedTask func(data []byte, err error)
+
+	// drainReportInterval is the interval to report the number of workers
+	// still busy while waiting for them to finish on shutdown.
+	drainReportInterval time.Duration
+
+	onDrainProgress func(remaining int)
+
+	// clock is used to compute retry and snooze times and task latency.
+	clock base.Clock
+
+	logger *logger
+
+	// failureLog logs the outcomes of failed tasks, throttled to avoid
+	// flooding the log during a mass failure.
+	failureLog *throttledLogger
+
+	// maxDeadTasks is the max number of dead tasks to keep per queue.
+	// Zero means there's no per-queue limit.
+	maxDeadTasks int
+
+	// keepCompleted is how long to keep a record of each completed task.
+	// Zero means no records are kept.
+	keepCompleted time.Duration
+
+	// killDependents specifies whether to kill the tasks waiting for
+	// a task which is killed or dropped.
+	killDependents bool
+
+	// maxErrorLength is the max number of bytes of an error message
+	// stored with a failed task.
+	maxErrorLength int
+
+	// maxAttempts is the max number of times to process a task, including
+	// snoozed attempts. Zero means there's no limit.
+	maxAttempts int
+
+	// abandon specifies whether to move unfinished tasks to abandoned queue
+	// instead of sending them back to the queue.
+	abandon bool
+
+	// handoff specifies whether to hand off unfinished tasks to the other
+	// servers on shutdown instead of sending them back to the queue.
+	// handoffTTL is how long the handed off tasks are marked as taken over.
+	handoff    bool
+	handoffTTL time.Duration
+
+	// requireAck specifies whether a task whose handler returns nil without
+	// calling Ack is treated as failed.
+	requireAck bool
+
+	// retryUnhandled specifies whether to retry tasks with no matching handler
+	// instead of killing them immediately.
+	retryUnhandled bool
+
+	// sema is a weighted semaphore to ensure the total weight of the tasks
+	// processed by active workers does not exceed the limit.
+	sema *weightedSema
+
+	// pool runs the worker goroutines if WorkerPool is enabled.
+	// Nil if a goroutine is started for each task.
+	pool *workerPool
+
+	// typeSema maps task type names to counting semaphores to ensure
+	// the number of active workers per type does not exceed the limit.
+	typeSema map[string]chan struct{}
+
+	// categorySema maps category names to counting semaphores to ensure
+	// the number of active workers per category does not exceed the limit.
+	categorySema map[string]chan struct{}
+
+	// categoryCounts maps category names to the numbers of task outcomes
+	// of the category, guarded by categoryMu.
+	categoryMu     sync.Mutex
+	categoryCounts map[string]*categoryCounters
+
+	// restored is the number of unfinished tasks restored on start,
+	// and restoreErr is the error encountered while restoring them if any.
+	restored   int64
+	restoreErr error
+
+	// expired is the number of unfinished tasks past their deadline which
+	// were killed or dropped instead of restored. Must be accessed atomically.
+	expired int64
+
+	// dropExpired specifies whether to drop the unfinished tasks past their
+	// deadline instead of killing them.
+	dropExpired bool
+
+	// number of workers currently holding a token from sema.
+	// Must be accessed atomically.
+	activeWorkers int32
+
+	// counters holds the numbers of task outcomes since the processor
+	// was created. Allocated separately to keep the int64 fields aligned
+	// for atomic access.
+	counters *taskCounters
+
+	// activeTasks holds the tasks currently processed by workers.
+	// Entries are added on token acquire and removed on completion.
+	activeMu    sync.Mutex
+	activeTasks map[*base.TaskMessage]ActiveTask
+
+	// cancels holds the channels closed to cancel the tasks processed by
+	// workers, except for the ones processed in batches.
+	// Guarded by activeMu.
+	cancels map[*base.TaskMessage]chan struct{}
+
+	// claimed holds the tasks pulled out of the queues but not handed to
+	// workers yet (e.g. prefetched tasks), mapped to whether they've been
+	// canceled by cancelType in the meantime.
+	// Guarded by activeMu.
+	claimed map[*base.TaskMessage]bool
+
+	// events holds the latest processing events. Nil if they aren't kept.
+	events *eventRing
+
+	// latencies holds the latest handler durations per task type.
+	// Nil if they aren't kept.
+	latencies *latencyTracker
+
+	// dedupWindow is the duration to remember the IDs of completed tasks
+	// for, to skip the tasks processed again. Zero if not remembered.
+	dedupWindow time.Duration
+
+	// interrupted holds the tasks whose workers quit on shutdown, to be
+	// handed off if handoff is set.
+	// Guarded by activeMu.
+	interrupted []*base.TaskMessage
+
+	// paused is set to 1 while the processor is paused.
+	// Must be accessed atomically.
+	paused int32
 
 	// channel to communicate back to the long running "processor" goroutine.
 	// once is used to send value to the channel only once.
 	done chan struct{}
 	once sync.Once
 
+	// stopped channel is closed when the "processor" goroutine exits.
+	stopped chan struct{}
+
+	// prefetch is the max number of tasks to pull out of a queue at a time.
+	// prefetched holds the tasks pulled out but not handed to workers yet.
+	// prefetched is only accessed by the "processor" goroutine.
+	prefetch   int
+	prefetched []*base.TaskMessage
+
+	// backoffs maps the limits reached, i.e. task types, categories and
+	// serial keys, to the time until which their tasks are postponed
+	// without trying to acquire the limits.
+	// postponed holds the tasks postponed since a task was last handed to
+	// a worker, which tells when every task in the queues is postponed.
+	// backoffs and postponed are only accessed by the "processor" goroutine.
+	backoffs  map[string]time.Time
+	postponed map[xid.ID]bool
+
 	// abort channel is closed when the shutdown of the "processor" goroutine starts.
 	abort chan struct{}
 
+	// deadline by which tasks dequeued during shutdown should be requeued.
+	// Set before abort channel is closed.
+	requeueDeadline time.Time
+
+	// trackStarted specifies whether to record the start time of each task
+	// in redis while the task is processed.
+	trackStarted bool
+
+	// finishClaimed specifies whether a task pulled out of the queue when
+	// the shutdown starts waits for a worker to finish within the shutdown
+	// timeout, instead of being requeued immediately.
+	finishClaimed bool
+
+	// stateUpdateTimeout is the duration to keep retrying to record the
+	// result of a processed task in redis.
+	stateUpdateTimeout time.Duration
+
+	// restoreLockTTL is the duration for which the lock to restore the
+	// unfinished tasks on start is held. Zero means no coordination.
+	restoreLockTTL time.Duration
+
+	// dequeueLimiter caps the rate of the commands pulling tasks out of
+	// the queues. Nil if there's no cap.
+	dequeueLimiter *rateLimiter
+
+	// deadRetryInterval is the duration after which a task to be killed is
+	// retried from the deferred dead queue, up to deadRetryAttempts times.
+	// Zero means tasks are killed right away.
+	deadRetryInterval time.Duration
+	deadRetryAttempts int
+
+	// visibilityTimeout is the duration for which a task being processed
+	// is invisible, after which it's moved back to its queue unless the
+	// task is acknowledged or its visibility is extended.
+	// Zero means tasks are not hidden.
+	visibilityTimeout time.Duration
+
 	// quit channel communicates to the in-flight worker goroutines to stop.
-	quit chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+type retryDelayFunc func(n int, err error, task *Task) time.Duration
+
+type retryDecider func(task *Task, err error, retried, maxRetry int) Decision
+
+type processorParams struct {
+	// rdb is an instance of RDB used by the processor.
+	rdb *rdb.RDB
+
+	// serverID is the ID of the background instance running the processor.
+	serverID string
+
+	// concurrency specifies the max number of concurrenct worker goroutines.
+	concurrency int
+
+	// typeLimits maps task type names to the max number of concurrent
+	// worker goroutines processing tasks of the type.
+	typeLimits map[string]int
+
+	// categoryLimits maps category names to the max number of concurrent
+	// worker goroutines processing tasks of the category.
+	categoryLimits map[string]int
+
+	// queues is a mapping of queue names to associated priority level.
+	queues map[string]uint
+
+	// strictPriority specifies whether queue priority should be treated strictly.
+	strictPriority bool
+
+	// starvationGuard specifies the number of tasks to dequeue in a row from
+	// queues other than the lowest priority one before checking the queues in
+	// reverse order in strict-priority mode. Zero or negative disables the guard.
+	starvationGuard int
+
+	// depthAware specifies whether to weight the queues by their pending
+	// depth in addition to their priority. It's ignored in strict-priority mode.
+	depthAware bool
+
+	// priorityAging specifies the priority aging period of the queues.
+	// Zero or negative disables priority aging.
+	priorityAging time.Duration
+
+	// retryDelayFunc is a function to compute retry delay.
+	retryDelayFunc retryDelayFunc
+
+	// queueRetryDelays specifies the functions to compute retry delay
+	// of the tasks in specific queues.
+	queueRetryDelays map[string]retryDelayFunc
+
+	// retryDecider is a function to decide how to handle a failed task.
+	// If nil, defaultRetryDecider is used.
+	retryDecider retryDecider
+
+	// errorClassifiers classify the errors of failed tasks, see
+	// Config.ErrorClassifiers.
+	errorClassifiers []func(error) ErrorClass
+
+	// retryPriorityBoost specifies how much to raise the priority of a task
+	// on retry, if positive.
+	retryPriorityBoost int
+
+	// maxDeadTasks specifies the max number of dead tasks to keep per queue.
+	maxDeadTasks int
+
+	// keepCompleted specifies how long to keep a record of each completed task.
+	keepCompleted time.Duration
+
+	// killDependents specifies whether to kill the tasks waiting for
+	// a task which is killed or dropped.
+	killDependents bool
+
+	// maxErrorLength specifies the max number of bytes of an error message
+	// stored with a failed task. Zero or negative means defaultMaxErrorLength.
+	maxErrorLength int
+
+	// maxAttempts specifies the max number of times to process a task.
+	// Zero or negative means there's no limit.
+	maxAttempts int
+
+	// queueHandlers specifies the handlers for specific queues.
+	queueHandlers map[string]Handler
+
+	// batches specifies the queues to process in batches.
+	batches map[string]Batch
+
+	// circuitBreakers specifies the circuit breakers of the queues.
+	circuitBreakers map[string]CircuitBreaker
+
+	// queueDiscovery specifies whether to discover the queues to process
+	// from redis.
+	queueDiscovery bool
+
+	// pollInterval specifies the base duration to wait for a task when the
+	// queues are empty. Zero or negative means defaultPollInterval.
+	pollInterval time.Duration
+
+	// maxPolledQueues specifies the max number of queues to check for a
+	// task at a time. Zero or negative means no limit.
+	maxPolledQueues int
+
+	// abandon specifies whether unfinished tasks should be abandoned
+	// instead of requeued.
+	abandon bool
+
+	// handoff specifies whether unfinished tasks should be handed off
+	// on shutdown instead of requeued.
+	handoff bool
+
+	// handoffTTL specifies how long the handed off tasks are marked as
+	// taken over by another server. Zero or negative means defaultHandoffTTL.
+	handoffTTL time.Duration
+
+	// recentEvents specifies the number of the latest processing events
+	// to keep, if positive.
+	recentEvents int
+
+	// latencySamples specifies the number of the latest handler durations
+	// to keep per task type, if positive.
+	latencySamples int
+
+	// dedupWindow specifies the duration to remember the IDs of completed
+	// tasks for, if positive.
+	dedupWindow time.Duration
+
+	// requireAck specifies whether handlers have to call Ack for the tasks
+	// to count as done.
+	requireAck bool
+
+	// finishClaimed specifies whether to process the task pulled out of
+	// the queue right before shutdown instead of requeuing it.
+	finishClaimed bool
+
+	// trackStarted specifies whether to record the start times of tasks
+	// in redis.
+	trackStarted bool
+
+	// stateUpdateTimeout specifies how long to retry recording the result
+	// of a processed task in redis. Zero means defaultStateUpdateTimeout,
+	// and negative means no retries.
+	stateUpdateTimeout time.Duration
+
+	// restoreLockTTL specifies how long the lock to restore the unfinished
+	// tasks on start is held, if positive.
+	restoreLockTTL time.Duration
+
+	// maxDequeueRate specifies the max number of commands per second to pull
+	// tasks out of the queues, if positive.
+	maxDequeueRate float64
+
+	// deadRetryInterval and deadRetryAttempts specify how often and how many
+	// times to retry the tasks to be killed, if both positive.
+	deadRetryInterval time.Duration
+	deadRetryAttempts int
+
+	// visibilityTimeout specifies how long a task being processed is
+	// invisible, if positive.
+	visibilityTimeout time.Duration
+
+	// randSource is the source of randomness of the processor, e.g. to
+	// order the queues. If nil, a source seeded with the current time is used.
+	randSource rand.Source
+
+	// retryUnhandled specifies whether tasks with no matching handler
+	// should be retried instead of killed immediately.
+	retryUnhandled bool
+
+	// onSuccess is an optional function called after a task is processed
+	// successfully.
+	onSuccess func(task *Task, latency time.Duration)
+
+	// metrics is an optional collector of the metrics of the tasks.
+	metrics MetricsCollector
+
+	// exporter is an optional exporter of the killed tasks, called in
+	// a separate goroutine if exportAsync is set.
+	exporter    DeadTaskExporter
+	exportAsync bool
+
+	// onRequeue is an optional function called after a task pulled out
+	// during shutdown is moved back to the queue.
+	onRequeue func(task *Task)
+
+	// onRetry is an optional function called after a failed task is sent
+	// to the retry queue.
+	onRetry func(task *Task, delay time.Duration)
+
+	// dropExpired specifies whether to drop the unfinished tasks past their
+	// deadline instead of sending them to the dead queue on restore.
+	dropExpired bool
+
+	// prefetch specifies the max number of tasks to pull out of a queue
+	// in one round trip. Zero or one disables prefetching.
+	prefetch int
+
+	// selector specifies a custom order to check the queues.
+	selector QueueSelector
+
+	// workerPool specifies whether to run the workers on a pool of
+	// long running goroutines instead of goroutines started for each task.
+	workerPool bool
+
+	// onMalformedTask is an optional function called after a message which
+	// cannot be decoded is moved to the malformed queue.
+	onMalformedTask func(data []byte, err error)
+
+	// drainReportInterval is the interval to report the number of workers
+	// still busy on shutdown. If zero, defaultDrainReportInterval is used.
+	drainReportInterval time.Duration
+
+	// onDrainProgress is an optional function called with the number of
+	// workers still busy on each report on shutdown.
+	onDrainProgress func(remaining int)
+
+	// clock is used to get the current time.
+	// If nil, the real clock is used.
+	clock base.Clock
+
+	// logger is used to log the lines of the processor.
+	// If nil, the lines are logged with the standard log package.
+	logger *logger
+}
+
+// newProcessor constructs a new processor.
+func newProcessor(params processorParams) *processor {
+	if !hasQueues(params.queues) {
+		// Otherwise, the processor would never find a task to process.
+		params.queues = defaultQueueConfig
+	}
+	var orderedQueues, reversedQueues []string
+	if params.strictPriority {
+		orderedQueues = StrictSelector{}.Next(params.queues)
+		reversedQueues = reversed(orderedQueues)
+	}
+	randSource := params.randSource
+	if randSource == nil {
+		randSource = rand.NewSource(time.Now().UnixNano())
+	}
+	decider := params.retryDecider
+	if decider == nil {
+		decider = defaultRetryDecider
+	}
+	clock := params.clock
+	if clock == nil {
+		clock = base.NewRealClock()
+	}
+	lg := params.logger
+	if lg == nil {
+		lg = defaultLogger
+	}
+	typeSema := make(map[string]chan struct{})
+	for typename, n := range params.typeLimits {
+		if n > 0 {
+			typeSema[typename] = make(chan struct{}, n)
+		}
+	}
+	categorySema := make(map[string]chan struct{})
+	for category, n := range params.categoryLimits {
+		if n > 0 {
+			categorySema[category] = make(chan struct{}, n)
+		}
+	}
+	var breakers map[string]*breaker
+	for qname, cfg := range params.circuitBreakers {
+		if breakers == nil {
+			breakers = make(map[string]*breaker)
+		}
+		qname = strings.ToLower(qname)
+		breakers[qname] = newBreaker(qname, cfg, clock)
+		breakers[qname].logger = lg
+	}
+	maxErrorLength := params.maxErrorLength
+	if maxErrorLength <= 0 {
+		maxErrorLength = defaultMaxErrorLength
+	}
+	pollInterval := params.pollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	deadRetryInterval := params.deadRetryInterval
+	if params.deadRetryAttempts <= 0 {
+		deadRetryInterval = 0
+	}
+	var events *eventRing
+	if params.recentEvents > 0 {
+		events = newEventRing(params.recentEvents)
+	}
+	var latencies *latencyTracker
+	if params.latencySamples > 0 {
+		latencies = newLatencyTracker(params.latencySamples)
+	}
+	handoffTTL := params.handoffTTL
+	if handoffTTL <= 0 {
+		handoffTTL = defaultHandoffTTL
+	}
+	stateUpdateTimeout := params.stateUpdateTimeout
+	if stateUpdateTimeout == 0 {
+		stateUpdateTimeout = defaultStateUpdateTimeout
+	}
+	var pool *workerPool
+	if params.workerPool {
+		// Note: Each worker runs the handler in another goroutine.
+		pool = newWorkerPool(2 * params.concurrency)
+	}
+	drainReportInterval := params.drainReportInterval
+	if drainReportInterval <= 0 {
+		drainReportInterval = defaultDrainReportInterval
+	}
+	return &processor{
+		rdb:                 params.rdb,
+		serverID:            params.serverID,
+		queueConfig:         params.queues,
+		orderedQueues:       orderedQueues,
+		reversedQueues:      reversedQueues,
+		starvationGuard:     params.starvationGuard,
+		depthAware:          params.depthAware,
+		priorityAging:       params.priorityAging,
+		retryDelayFunc:      params.retryDelayFunc,
+		queueRetryDelays:    params.queueRetryDelays,
+		retryDecider:        decider,
+		errorClassifiers:    params.errorClassifiers,
+		retryPriorityBoost:  params.retryPriorityBoost,
+		maxDeadTasks:        params.maxDeadTasks,
+		keepCompleted:       params.keepCompleted,
+		killDependents:      params.killDependents,
+		maxErrorLength:      maxErrorLength,
+		maxAttempts:         params.maxAttempts,
+		queueHandlers:       params.queueHandlers,
+		batches:             params.batches,
+		breakers:            breakers,
+		queueDiscovery:      params.queueDiscovery,
+		pollInterval:        pollInterval,
+		maxPolledQueues:     params.maxPolledQueues,
+		rand:                rand.New(randSource),
+		abandon:             params.abandon,
+		handoff:             params.handoff,
+		handoffTTL:          handoffTTL,
+		retryUnhandled:      params.retryUnhandled,
+		requireAck:          params.requireAck,
+		finishClaimed:       params.finishClaimed,
+		trackStarted:        params.trackStarted,
+		stateUpdateTimeout:  stateUpdateTimeout,
+		restoreLockTTL:      params.restoreLockTTL,
+		dequeueLimiter:      newRateLimiter(params.maxDequeueRate),
+		deadRetryInterval:   deadRetryInterval,
+		deadRetryAttempts:   params.deadRetryAttempts,
+		visibilityTimeout:   params.visibilityTimeout,
+		dropExpired:         params.dropExpired,
+		prefetch:            params.prefetch,
+		selector:            params.selector,
+		onSuccess:           params.onSuccess,
+		metrics:             params.metrics,
+		exporter:            params.exporter,
+		exportAsync:         params.exportAsync,
+		onRequeue:           params.onRequeue,
+		onRetry:             params.onRetry,
+		onMalformedTask:     params.onMalformedTask,
+		drainReportInterval: drainReportInterval,
+		onDrainProgress:     params.onDrainProgress,
+		counters:            new(taskCounters),
+		clock:               clock,
+		logger:              lg,
+		failureLog:          newThrottledLogger(clock, failureLogInterval, lg.taskPrintf),
+		sema:                newWeightedSema(int64(params.concurrency)),
+		pool:                pool,
+		typeSema:            typeSema,
+		categorySema:        categorySema,
+		categoryCounts:      make(map[string]*categoryCounters),
+		activeTasks:         make(map[*base.TaskMessage]ActiveTask),
+		cancels:             make(map[*base.TaskMessage]chan struct{}),
+		claimed:             make(map[*base.TaskMessage]bool),
+		backoffs:            make(map[string]time.Time),
+		postponed:           make(map[xid.ID]bool),
+		events:              events,
+		latencies:           latencies,
+		dedupWindow:         params.dedupWindow,
+		done:                make(chan struct{}),
+		stopped:             make(chan struct{}),
+		abort:               make(chan struct{}),
+		quit:                make(chan struct{}),
+		handler:             HandlerFunc(func(t *Task) error { return fmt.Errorf("handler not set") }),
+	}
+}
+
+// Note: stops only the "processor" goroutine, does not stop workers.
+// It's safe to call this method multiple times.
+func (p *processor) stop() {
+	p.once.Do(func() {
+		p.logger.printf("[INFO] Processor shutting down...")
+		p.requeueDeadline = time.Now().Add(requeueTimeout)
+		// Unblock if processor is waiting for sema token.
+		close(p.abort)
+		// Signal the processor goroutine to stop processing tasks
+		// from the queue.
+		p.done <- struct{}{}
+		// Wait for the prefetched tasks to be requeued, so that they're
+		// not restored at the same time.
+		<-p.stopped
+	})
+}
+
+// shutdownTimeout is the duration to wait for workers to finish on shutdown.
+//
+// IDEA: Allow user to customize this timeout value.
+const shutdownTimeout = 8 * time.Second
+
+// defaultDrainReportInterval is the default interval to report the number
+// of workers still busy on shutdown.
+const defaultDrainReportInterval = time.Second
+
+// requeueTimeout is the max duration to spend requeuing a task dequeued
+// during shutdown. Requeuing blocks the shutdown until it's done, so it takes
+// a fraction of shutdownTimeout.
+const requeueTimeout = shutdownTimeout / 4
+
+// claimedTimeout is the max duration a task dequeued during shutdown waits
+// for a worker if finishClaimed is set. It leaves the rest of shutdownTimeout
+// for the task to be processed.
+const claimedTimeout = shutdownTimeout / 2
+
+// reportDrain logs the number of workers still busy and calls
+// onDrainProgress, if any, every drainReportInterval until drained is closed.
+func (p *processor) reportDrain(drained <-chan struct{}) {
+	t := time.NewTicker(p.drainReportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-drained:
+			return
+		case <-t.C:
+			n := p.active()
+			if n == 0 {
+				// The last worker is releasing the token.
+				continue
+			}
+			p.logger.printf("[INFO] Waiting for %d workers to finish...", n)
+			p.notifyDrainProgress(n)
+		}
+	}
+}
+
+// notifyDrainProgress calls onDrainProgress, if any. A panic in
+// onDrainProgress is logged and recovered, so that the shutdown can proceed.
+func (p *processor) notifyDrainProgress(n int) {
+	if p.onDrainProgress == nil {
+		return
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.printf("[ERROR] OnDrainProgress panicked: %v\n", x)
+		}
+	}()
+	p.onDrainProgress(n)
+}
+
+// quitWorkers tells the in-flight worker goroutines to stop without waiting
+// for their tasks to finish. The unfinished tasks are restored on terminate.
+// It's safe to call this method multiple times.
+func (p *processor) quitWorkers() {
+	p.quitOnce.Do(func() { close(p.quit) })
+}
+
+// NOTE: once terminated, processor cannot be re-started.
+func (p *processor) terminate() {
+	start := time.Now()
+	p.stop()
+
+	// Note: The time spent in stop waiting for a worker for a claimed task
+	// counts toward the shutdown timeout.
+	time.AfterFunc(shutdownTimeout-time.Since(start), p.quitWorkers)
+	p.logger.printf("[INFO] Waiting for all workers to finish...")
+	drained := make(chan struct{})
+	go p.reportDrain(drained)
+	// block until all workers have released the token
+	// Note: A weight greater than any capacity is acquired once no weight
+	// is held, even if the capacity is changed in the meantime.
+	p.sema.acquire(math.MaxInt32, nil)
+	close(drained)
+	p.logger.printf("[INFO] All workers have finished.")
+	p.exports.Wait()
+	if p.pool != nil {
+		// Note: Goroutines left running handlers of terminated tasks exit
+		// when the handlers return.
+		p.pool.stop()
+	}
+	p.failureLog.flush()
+	if p.handoff {
+		p.handOff() // move any unfinished tasks to the other servers.
+		return
+	}
+	p.restore() // move any unfinished tasks back to the queue.
+}
+
+// start restores the unfinished tasks and starts the "processor" goroutine.
+// If the tasks could not be restored, it returns the error without starting
+// the goroutine.
+func (p *processor) start() error {
+	// Note: Set the aging period before restoring the tasks so that
+	// restored tasks are scored with the period.
+	cfg, _ := p.queueSnapshot()
+	qnames := make([]string, 0, len(cfg))
+	for qname := range cfg {
+		qnames = append(qnames, qname)
+	}
+	if err := p.rdb.SetPriorityAging(p.priorityAging, qnames...); err != nil {
+		p.logger.printf("[ERROR] could not set priority aging of queues %v: %v\n", qnames, err)
+	}
+	// NOTE: The call to "restore" needs to complete before starting
+	// the processor goroutine.
+	if p.claimRestore() {
+		p.restored, p.restoreErr = p.restore()
+	}
+	if p.restoreErr != nil {
+		return p.restoreErr
+	}
+	if p.pool != nil {
+		p.pool.start()
+	}
+	go func() {
+		for {
+			select {
+			case <-p.done:
+				p.requeuePrefetched()
+				p.logger.printf("[INFO] Processor done.")
+				close(p.stopped)
+				return
+			default:
+				p.safeExec()
+			}
+		}
+	}()
+	return nil
+}
+
+// panicBackoff is the duration to wait before resuming the processor
+// goroutine after recovering from a panic.
+const panicBackoff = time.Second
+
+// safeExec calls exec, recovering from a panic in the "processor" goroutine
+// so that a bug outside the handlers doesn't halt all processing.
+func (p *processor) safeExec() {
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.printf("[ERROR] processor recovered from panic: %v; resuming in %v\n", x, panicBackoff)
+			select {
+			case <-p.abort:
+			case <-time.After(panicBackoff):
+			}
+		}
+	}()
+	p.exec()
+}
+
+// defaultPollInterval is the poll interval used if none is specified.
+const defaultPollInterval = time.Second
+
+// defaultHandoffTTL is the duration to mark the handed off tasks as taken
+// over if none is specified.
+const defaultHandoffTTL = time.Hour
+
+// defaultStateUpdateTimeout is the duration to retry recording the result
+// of a processed task if none is specified.
+const defaultStateUpdateTimeout = 3 * time.Second
+
+// pollTimeout returns the duration to block on an empty queue, which is the
+// poll interval rounded up to whole seconds since blocking on a queue has
+// a resolution of a second.
+func (p *processor) pollTimeout() time.Duration {
+	d := (p.pollInterval + time.Second - 1) / time.Second * time.Second
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
+// pollJitter returns a random duration of up to a half of the poll interval
+// to wait after the queues were found empty.
+// Note: The jitter is applied as a sleep in the processor rather than added
+// to the blocking timeout, which would drop any fraction of a second.
+func (p *processor) pollJitter() time.Duration {
+	jitter := p.pollInterval / 2
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(p.rand.Int63n(int64(jitter)))
+}
+
+// sleepJitter waits for a jitter returned by pollJitter, unless the processor
+// is stopped in the meantime.
+func (p *processor) sleepJitter() {
+	select {
+	case <-p.abort:
+	case <-time.After(p.pollJitter()):
+	}
+}
+
+// exec pulls a task out of the queue and starts a worker goroutine to
+// process the task.
+func (p *processor) exec() {
+	if atomic.LoadInt32(&p.paused) == 1 {
+		p.requeuePrefetched()
+		// Note: Wait as if the queues were empty, unless the processor
+		// is stopped in the meantime.
+		select {
+		case <-p.abort:
+		case <-time.After(p.pollTimeout() + p.pollJitter()):
+		}
+		return
+	}
+	msg, ok := p.dequeue()
+	if !ok {
+		return
+	}
+	defer p.unclaim(msg)
+	// Note: If exec panics before it's done with the task, the task is
+	// requeued and the tokens acquired for it are released, rather than
+	// held until the background restarts. The panic is recovered by safeExec.
+	hold := execHold{msg: msg}
+	defer func() {
+		if x := recover(); x != nil {
+			p.releaseHold(&hold)
+			panic(x)
+		}
+	}()
+	p.countDequeued(msg)
+	if p.exceededMaxAttempts(msg) {
+		return
+	}
+	if batch, ok := p.batches[msg.Queue]; ok {
+		hold.msg = nil
+		p.clearPostponed()
+		p.execBatch(msg, batch)
+		return
+	}
+	if p.completedBefore(msg) {
+		return
+	}
+	payload, err := base.DecodePayload(msg)
+	if err != nil {
+		// retrying won't help, the payload is corrupted.
+		hold.msg = nil
+		p.kill(msg, fmt.Errorf("could not decode payload: %v", err))
+		return
+	}
+
+	if p.backingOff(msg) {
+		hold.msg = nil
+		p.postpone(msg)
+		return
+	}
+
+	weight := msg.Weight
+	if !p.acquire(weight) {
+		// shutdown is starting, return immediately after requeuing the message.
+		hold.msg = nil
+		if !p.killIfCanceled(msg) {
+			p.requeue(msg)
+		}
+		return
+	}
+	hold.weight = weight
+	typeSema := p.typeSema[msg.Type]
+	if typeSema != nil {
+		select {
+		case typeSema <- struct{}{}: // acquire type token
+			hold.typeSema = typeSema
+		default:
+			// the type is at its limit, let tasks of other types proceed.
+			hold = execHold{}
+			p.releaseTokens(weight, nil, nil)
+			p.backOff(typeBackoffKey(msg.Type))
+			p.postpone(msg)
+			return
+		}
+	}
+	categorySema := p.categorySema[msg.Category]
+	if categorySema != nil {
+		select {
+		case categorySema <- struct{}{}: // acquire category token
+			hold.categorySema = categorySema
+		default:
+			// the category is at its limit, let tasks of other categories proceed.
+			hold = execHold{}
+			p.releaseTokens(weight, typeSema, nil)
+			p.backOff(categoryBackoffKey(msg.Category))
+			p.postpone(msg)
+			return
+		}
+	}
+	if !p.lockSerialKey(msg) {
+		// another task of the key is processed, let other tasks proceed.
+		hold = execHold{}
+		p.releaseTokens(weight, typeSema, categorySema)
+		p.backOff(serialBackoffKey(msg.SerialKey))
+		p.postpone(msg)
+		return
+	}
+	hold.serialKey = true
+	canceled, ok := p.addCancel(msg)
+	if !ok {
+		// canceled before it's handed to a worker.
+		hold = execHold{}
+		p.unlockSerialKey(msg)
+		p.releaseTokens(weight, typeSema, categorySema)
+		p.killCanceled(msg)
+		return
+	}
+	hold.canceled = canceled
+	p.addActive(msg)
+	atomic.AddInt32(&p.activeWorkers, 1)
+	hold = execHold{}
+	p.clearPostponed()
+	p.spawn(func() {
+		p.hide(msg)
+		p.markStarted(msg)
+		p.recordEvent(TaskStarted, nil, msg)
+		defer func() {
+			p.ack(msg)
+			p.clearHandoff(msg)
+			p.unlockSerialKey(msg)
+			p.clearStarted(msg)
+			p.removeActive(msg)
+			atomic.AddInt32(&p.activeWorkers, -1)
+			p.releaseTokens(weight, typeSema, categorySema)
+		}()
+
+		resCh := make(chan error, 1)
+		// Note: Pass a copy of the payload so that the handler cannot mutate
+		// the message, which has to match the one in the in-progress queue.
+		task := NewTask(msg.Type, clonePayload(payload))
+		state := &taskState{queue: msg.Queue, correlationID: msg.CorrelationID, parentID: msg.ParentID, extend: p.extender(msg)}
+		taskStates.Store(task, state)
+		defer taskStates.Delete(task)
+		start := p.clock.Now()
+		p.spawn(func() {
+			resCh <- perform(p.handlerFor(msg), task)
+		})
+
+		var timeoutCh <-chan time.Time
+		if d := p.timeout(msg); d > 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeoutCh = timer.C
+		}
+		defer p.removeCancel(msg)
+
+		select {
+		case <-p.quit:
+			// time is up, quit this worker goroutine.
+			p.logger.taskPrintf(msg, "[WARN] Terminating in-progress task %+v\n", msg)
+			p.interrupt(msg)
+			return
+		case <-canceled:
+			p.logger.taskPrintf(msg, "[WARN] Task(Type: %q, ID: %v) canceled\n", msg.Type, msg.ID)
+			p.kill(msg, errTaskCanceled)
+			p.awaitHandler(msg, resCh)
+		case <-timeoutCh:
+			p.failureLog.taskPrintf(msg, "[WARN] Task(Type: %q, ID: %v) timed out after %s\n", msg.Type, msg.ID, msg.Timeout)
+			p.handleFailure(task, msg, fmt.Errorf("task timed out after %s", msg.Timeout))
+			p.awaitHandler(msg, resCh)
+		case resErr := <-resCh:
+			d := p.clock.Now().Sub(start)
+			if p.latencies != nil {
+				p.latencies.add(msg.Type, d)
+			}
+			if p.metrics != nil {
+				p.metrics.TaskDuration(msg.Queue, msg.Type, d)
+			}
+			// Note: One of five things should happen.
+			// 1) Done   -> Removes the message from InProgress
+			// 2) Retry  -> Removes the message from InProgress & Adds the message to Retry
+			// 3) Kill   -> Removes the message from InProgress & Adds the message to Dead
+			// 4) Snooze -> Removes the message from InProgress & Adds the message to Scheduled
+			// 5) Drop   -> Removes the message from InProgress
+			resErr = p.handlerResult(msg, state, resErr)
+			if resErr != nil {
+				p.handleFailure(task, msg, resErr)
+				return
+			}
+			p.markAsDone(task, msg, p.clock.Now().Sub(start))
+		}
+	})
+}
+
+// execHold is what exec holds on to for a task pulled out of the queues,
+// until the task is resolved or handed to a worker.
+type execHold struct {
+	msg          *base.TaskMessage // nil once exec is done with the task
+	weight       int64             // weight acquired from the semaphore
+	typeSema     chan struct{}     // set once a type token is acquired
+	categorySema chan struct{}     // set once a category token is acquired
+	serialKey    bool              // set once the serial key is locked
+	canceled     <-chan struct{}   // set once the task can be canceled
+}
+
+// releaseHold releases the tokens and the lock of the serial key held for
+// the task, and requeues the task if exec is not done with it.
+func (p *processor) releaseHold(hold *execHold) {
+	if hold.msg == nil {
+		return
+	}
+	if hold.serialKey {
+		p.unlockSerialKey(hold.msg)
+	}
+	p.releaseTokens(hold.weight, hold.typeSema, hold.categorySema)
+	if hold.canceled != nil {
+		p.removeCancel(hold.msg)
+		select {
+		case <-hold.canceled:
+			p.killCanceled(hold.msg)
+			return
+		default:
+		}
+	}
+	if !p.killIfCanceled(hold.msg) {
+		p.requeue(hold.msg)
+	}
+}
+
+// releaseTokens releases the weight acquired from the semaphore, and the
+// type and category tokens if not nil.
+func (p *processor) releaseTokens(weight int64, typeSema, categorySema chan struct{}) {
+	if categorySema != nil {
+		<-categorySema /* release category token */
+	}
+	if typeSema != nil {
+		<-typeSema /* release type token */
+	}
+	p.sema.release(weight)
+}
+
+// awaitHandler blocks until the handler of the task, which has timed out or
+// been canceled, returns, so that the worker holds on to the concurrency
+// tokens while the handler is still running. The result of the handler is
+// discarded.
+//
+// Note: It stops waiting once the shutdown timeout elapses, leaving the
+// handler running, so that a stuck handler cannot block the shutdown.
+func (p *processor) awaitHandler(msg *base.TaskMessage, resCh <-chan error) {
+	select {
+	case <-resCh:
+	case <-p.quit:
+		p.logger.taskPrintf(msg, "[WARN] Leaving the handler of Task(Type: %q, ID: %v) running\n", msg.Type, msg.ID)
+	}
+}
+
+// dequeue returns the next task to process, which is either a prefetched
+// task or a task pulled out of the queues. It reports false if there's no
+// task to process.
+func (p *processor) dequeue() (*base.TaskMessage, bool) {
+	if len(p.prefetched) > 0 {
+		msg := p.prefetched[0]
+		p.prefetched = p.prefetched[1:]
+		return msg, true
+	}
+	if !p.dequeueLimiter.wait(p.abort) {
+		return nil, false
+	}
+	qnames := p.queues()
+	msg, err := p.dequeueUntil(time.Now().Add(p.pollTimeout()), qnames)
+	if err == rdb.ErrNoProcessableTask {
+		// queues are empty, this is a normal behavior.
+		// Note: Dequeue blocks on the first queue in qnames before returning the error.
+		// Since the order of queue names is randomized based on their priority,
+		// idle processors are spread across queues in proportion to the priority,
+		// and no queue is left without a waiting processor for long.
+		// With a single queue, the processor always blocks on the queue, so a task
+		// is picked up as soon as it's enqueued without polling redis.
+		p.sleepJitter()
+		return nil, false
+	}
+	var malformed *rdb.MalformedTaskError
+	if errors.As(err, &malformed) {
+		p.notifyMalformed(malformed)
+		return nil, false
+	}
+	if err != nil {
+		p.logger.printf("[ERROR] unexpected error while pulling a task out of queue: %v\n", err)
+		return nil, false
+	}
+	if _, ok := p.batches[msg.Queue]; !ok {
+		// Note: Tasks processed in batches cannot be canceled.
+		p.claim(msg)
+	}
+	p.prefetchFrom(msg.Queue)
+	return msg, true
+}
+
+// maxBlockTimeout is the max duration to block on an empty queue at a time,
+// so that the processor stops promptly while the queues are empty.
+const maxBlockTimeout = time.Second
+
+// dequeueUntil pulls a task out of the given queues, waiting for a task
+// until the given deadline unless the processor is stopped in the meantime.
+//
+// Note: Each wait is capped at maxBlockTimeout, so the queues are polled
+// again every maxBlockTimeout while they're empty.
+func (p *processor) dequeueUntil(deadline time.Time, qnames []string) (*base.TaskMessage, error) {
+	for {
+		timeout := time.Until(deadline)
+		if timeout > maxBlockTimeout {
+			timeout = maxBlockTimeout
+		}
+		msg, err := p.rdb.DequeueWithTimeout(timeout, qnames...)
+		if err != rdb.ErrNoProcessableTask || !time.Now().Before(deadline) {
+			return msg, err
+		}
+		select {
+		case <-p.abort:
+			return nil, err
+		default:
+		}
+	}
+}
+
+// prefetchFrom pulls out up to prefetch-1 more tasks from the given queue
+// in one round trip, to be processed after the task dequeued from the queue.
+//
+// Prefetched tasks are tracked in the in-progress queue as dequeued tasks,
+// so they're restored if the background crashes.
+func (p *processor) prefetchFrom(qname string) {
+	if p.prefetch <= 1 {
+		return
+	}
+	if _, ok := p.batches[qname]; ok {
+		// Note: The tasks are pulled out by execBatch.
+		return
+	}
+	if !p.dequeueLimiter.wait(p.abort) {
+		return
+	}
+	more, err := p.rdb.DequeueBatch(qname, p.prefetch-1)
+	var malformed rdb.MalformedTasksError
+	if errors.As(err, &malformed) {
+		for _, e := range malformed {
+			p.notifyMalformed(e)
+		}
+	} else if err != nil {
+		p.logger.printf("[ERROR] unexpected error while prefetching tasks out of queue: %v\n", err)
+	}
+	p.claim(more...)
+	p.prefetched = append(p.prefetched, more...)
+}
+
+// requeuePrefetched moves the prefetched tasks, which have not been handed
+// to workers, back to the queue.
+func (p *processor) requeuePrefetched() {
+	for _, msg := range p.prefetched {
+		if !p.killIfCanceled(msg) {
+			p.requeue(msg)
+		}
+	}
+	p.prefetched = nil
+}
+
+// acquire acquires the weight from the semaphore for a task pulled out of
+// the queue. It reports false if the shutdown starts in the meantime, unless
+// finishClaimed is set, in which case it keeps waiting for a worker to finish
+// for up to claimedTimeout.
+func (p *processor) acquire(weight int64) bool {
+	if p.sema.acquire(weight, p.abort) {
+		return true
+	}
+	if !p.finishClaimed {
+		return false
+	}
+	// Note: Immediate shutdown quits waiting as well.
+	cancel := make(chan struct{})
+	var once sync.Once
+	stopWaiting := func() { once.Do(func() { close(cancel) }) }
+	timer := time.AfterFunc(claimedTimeout, stopWaiting)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-p.quit:
+			stopWaiting()
+		case <-cancel:
+		}
+	}()
+	ok := p.sema.acquire(weight, cancel)
+	stopWaiting()
+	if ok {
+		return true
+	}
+	// Note: requeueDeadline has passed while waiting.
+	p.requeueDeadline = time.Now().Add(requeueTimeout)
+	return false
+}
+
+// execBatch pulls more tasks out of the queue of the given task and starts
+// a worker goroutine to process the tasks as a batch.
+func (p *processor) execBatch(msg *base.TaskMessage, batch Batch) {
+	// Note: A batch weighs 1 regardless of the weight of its tasks.
+	if !p.acquire(1) {
+		// shutdown is starting, return immediately after requeuing the message.
+		p.requeue(msg)
+		return
+	}
+	msgs := []*base.TaskMessage{msg}
+	// Note: The batch is processed with the tasks pulled out so far
+	// if the shutdown starts while waiting.
+	var more []*base.TaskMessage
+	var err error
+	if p.dequeueLimiter.wait(p.abort) {
+		more, err = p.rdb.DequeueBatch(msg.Queue, batch.Size-1)
+	}
+	var malformed rdb.MalformedTasksError
+	if errors.As(err, &malformed) {
+		for _, e := range malformed {
+			p.notifyMalformed(e)
+		}
+	} else if err != nil {
+		p.logger.printf("[ERROR] unexpected error while pulling a batch of tasks out of queue: %v\n", err)
+	}
+	msgs = append(msgs, more...)
+
+	var tasks []*Task
+	var taskMsgs []*base.TaskMessage
+	for i, m := range msgs {
+		// Note: The first message is checked by exec.
+		if i > 0 && p.exceededMaxAttempts(m) {
+			continue
+		}
+		payload, err := base.DecodePayload(m)
+		if err != nil {
+			// retrying won't help, the payload is corrupted.
+			p.kill(m, fmt.Errorf("could not decode payload: %v", err))
+			continue
+		}
+		tasks = append(tasks, NewTask(m.Type, clonePayload(payload)))
+		taskMsgs = append(taskMsgs, m)
+	}
+	if len(tasks) == 0 {
+		p.sema.release(1)
+		return
+	}
+
+	atomic.AddInt32(&p.activeWorkers, 1)
+	p.addActive(taskMsgs...)
+	p.spawn(func() {
+		p.hide(taskMsgs...)
+		p.markStarted(taskMsgs...)
+		p.recordEvent(TaskStarted, nil, taskMsgs...)
+		defer func() {
+			p.ack(taskMsgs...)
+			p.clearHandoff(taskMsgs...)
+			p.clearStarted(taskMsgs...)
+			p.removeActive(taskMsgs...)
+			atomic.AddInt32(&p.activeWorkers, -1)
+			p.sema.release(1)
+		}()
+
+		states := make([]*taskState, len(tasks))
+		for i, task := range tasks {
+			states[i] = &taskState{queue: taskMsgs[i].Queue, correlationID: taskMsgs[i].CorrelationID,
+				parentID: taskMsgs[i].ParentID, extend: p.extender(taskMsgs[i])}
+			taskStates.Store(task, states[i])
+			defer taskStates.Delete(task)
+		}
+		resCh := make(chan []error, 1)
+		start := p.clock.Now()
+		p.spawn(func() {
+			resCh <- performBatch(batch.Handler, tasks)
+		})
+
+		select {
+		case <-p.quit:
+			// time is up, quit this worker goroutine.
+			p.logger.printf("[WARN] Terminating in-progress batch of %d tasks from %q queue\n", len(tasks), msg.Queue)
+			p.interrupt(taskMsgs...)
+			return
+		case errs := <-resCh:
+			d := p.clock.Now().Sub(start)
+			for i, task := range tasks {
+				resErr := p.handlerResult(taskMsgs[i], states[i], errs[i])
+				if resErr != nil {
+					p.handleFailure(task, taskMsgs[i], resErr)
+					continue
+				}
+				p.markAsDone(task, taskMsgs[i], d)
+			}
+		}
+	})
+}
+
+// markStarted records the start time of the tasks if trackStarted is set.
+func (p *processor) markStarted(msgs ...*base.TaskMessage) {
+	if !p.trackStarted {
+		return
+	}
+	if err := p.rdb.MarkStarted(msgs...); err != nil {
+		p.logger.printf("[WARN] Could not record start time of %d tasks: %v\n", len(msgs), err)
+	}
+}
+
+// clearStarted deletes the start time of the tasks recorded by markStarted.
+func (p *processor) clearStarted(msgs ...*base.TaskMessage) {
+	if !p.trackStarted {
+		return
+	}
+	if err := p.rdb.ClearStarted(msgs...); err != nil {
+		p.logger.printf("[WARN] Could not delete start time of %d tasks: %v\n", len(msgs), err)
+	}
+}
+
+// hide makes the tasks invisible for visibilityTimeout if it's set.
+func (p *processor) hide(msgs ...*base.TaskMessage) {
+	if p.visibilityTimeout <= 0 {
+		return
+	}
+	if err := p.rdb.Hide(p.clock.Now().Add(p.visibilityTimeout), msgs...); err != nil {
+		p.logger.printf("[WARN] Could not hide %d tasks: %v\n", len(msgs), err)
+	}
+}
+
+// ack acknowledges the tasks hidden by hide once they're finished.
+func (p *processor) ack(msgs ...*base.TaskMessage) {
+	if p.visibilityTimeout <= 0 {
+		return
+	}
+	if err := p.rdb.Ack(msgs...); err != nil {
+		p.logger.printf("[WARN] Could not acknowledge %d tasks: %v\n", len(msgs), err)
+	}
+}
+
+// clearHandoff removes the handoff mark of the tasks once they're finished,
+// if handoff is set.
+func (p *processor) clearHandoff(msgs ...*base.TaskMessage) {
+	if !p.handoff {
+		return
+	}
+	if err := p.rdb.ClearHandoff(msgs...); err != nil {
+		p.logger.printf("[WARN] Could not clear handoff mark of %d tasks: %v\n", len(msgs), err)
+	}
+}
+
+// extender returns the function to extend the visibility of the task
+// for ExtendVisibility, or nil if visibilityTimeout is not set.
+func (p *processor) extender(msg *base.TaskMessage) func(time.Duration) error {
+	if p.visibilityTimeout <= 0 {
+		return nil
+	}
+	return func(d time.Duration) error {
+		ok, err := p.rdb.ExtendVisibility(msg, p.clock.Now().Add(d))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrVisibilityExpired
+		}
+		return nil
+	}
+}
+
+// handlerResult returns the error to handle the task with, given the error
+// returned by the handler and the state of the task left by the handler.
+func (p *processor) handlerResult(msg *base.TaskMessage, state *taskState, err error) error {
+	if err != nil {
+		return err
+	}
+	err = stateResult(state, p.requireAck)
+	if err == ErrNotAcked {
+		p.logger.taskPrintf(msg, "[WARN] Task(Type: %q, ID: %v) returned nil without Ack, treating as failed\n", msg.Type, msg.ID)
+	}
+	if res, ok := state.result.Load().(ProcessResult); err == nil && ok && res.Status == StatusWarning {
+		p.logger.taskPrintf(msg, "[WARN] Task(Type: %q, ID: %v) completed with warning: %s\n", msg.Type, msg.ID, res.Message)
+	}
+	return err
+}
+
+// stateResult returns the error to handle the task with, given the state of
+// the task left by the handler which returned nil.
+func stateResult(state *taskState, requireAck bool) error {
+	ack := atomic.LoadInt32(&state.ack)
+	if ack == ackNacked {
+		if r, _ := state.nackReason.Load().(nackReason); r.err != nil {
+			return r.err
+		}
+		return ErrNacked
+	}
+	if atomic.LoadInt32(&state.retryRequested) == 1 {
+		return ErrRetryRequested
+	}
+	res, ok := state.result.Load().(ProcessResult)
+	if ok && res.Status == StatusPartial {
+		if res.Message == "" {
+			return ErrPartiallyCompleted
+		}
+		return fmt.Errorf("%w: %s", ErrPartiallyCompleted, res.Message)
+	}
+	if requireAck && !ok && ack != ackAcked {
+		return ErrNotAcked
+	}
+	return nil
+}
+
+// spawn runs fn in a goroutine of the pool if WorkerPool is enabled,
+// or in a new goroutine otherwise.
+func (p *processor) spawn(fn func()) {
+	if p.pool != nil {
+		p.pool.run(fn)
+		return
+	}
+	go fn()
+}
+
+// completedBefore removes the task from the in-progress queue without
+// processing it and reports true, if the task has completed within the
+// dedup window, e.g. the task was restored since the background died
+// before removing it from the in-progress queue.
+func (p *processor) completedBefore(msg *base.TaskMessage) bool {
+	if p.dedupWindow <= 0 {
+		return false
+	}
+	completed, err := p.rdb.IsCompleted(msg.ID)
+	if err != nil {
+		// Note: Process the task rather than risk losing it.
+		p.logger.taskPrintf(msg, "[ERROR] Could not check whether task(Type: %q, ID: %v) has completed: %v\n", msg.Type, msg.ID, err)
+		return false
+	}
+	if !completed {
+		return false
+	}
+	p.logger.taskPrintf(msg, "[INFO] Skipping task(Type: %q, ID: %v) already completed\n", msg.Type, msg.ID)
+	err = p.updateState(func() error {
+		return p.rdb.Done(msg)
+	})
+	if err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not remove task from InProgress queue: %v\n", err)
+	}
+	return true
+}
+
+// exceededMaxAttempts kills the task and reports true if the task has been
+// processed maxAttempts times already.
+func (p *processor) exceededMaxAttempts(msg *base.TaskMessage) bool {
+	if p.maxAttempts <= 0 || msg.Attempts < p.maxAttempts {
+		return false
+	}
+	p.kill(msg, fmt.Errorf("task has been processed %d times, exceeding the max attempts of %d", msg.Attempts, p.maxAttempts))
+	return true
+}
+
+// handleFailure handles the failed task based on the decision
+// made by retryDecider, unless the error is classified as Permanent.
+func (p *processor) handleFailure(task *Task, msg *base.TaskMessage, e error) {
+	atomic.AddInt64(&p.counters.failed, 1)
+	if p.metrics != nil {
+		p.metrics.TaskFailed(msg.Queue, msg.Type)
+	}
+	p.recordResult(msg, false)
+	p.recordEvent(TaskFailed, e, msg)
+	if !p.retryUnhandled && errors.Is(e, ErrHandlerNotFound) {
+		p.failureLog.taskPrintf(msg, "[WARN] No handler for task(Type: %q, ID: %v)\n", msg.Type, msg.ID)
+		p.kill(msg, e)
+		return
+	}
+	if classifyError(e, p.errorClassifiers) == Permanent {
+		p.failureLog.taskPrintf(msg, "[WARN] Permanent error for task(Type: %q, ID: %v), not retrying\n", msg.Type, msg.ID)
+		p.kill(msg, e)
+		return
+	}
+	switch p.retryDecider(task, e, msg.Retried, msg.Retry) {
+	case Kill:
+		p.kill(msg, e)
+	case Snooze:
+		p.snooze(msg, e)
+	case Drop:
+		p.drop(msg, e)
+	default:
+		p.retry(msg, e)
+	}
+}
+
+// timeout returns the processing timeout of the task.
+// Zero means the task has no timeout.
+func (p *processor) timeout(msg *base.TaskMessage) time.Duration {
+	if msg.Timeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(msg.Timeout)
+	if err != nil {
+		p.logger.taskPrintf(msg, "[WARN] Could not parse timeout %q of task(Type: %q, ID: %v): %v\n", msg.Timeout, msg.Type, msg.ID, err)
+		return 0
+	}
+	return d
+}
+
+// pause stops pulling tasks out of the queues until resume is called.
+// Workers processing tasks are not affected.
+func (p *processor) pause() {
+	atomic.StoreInt32(&p.paused, 1)
+}
+
+// resume resumes pulling tasks out of the queues.
+func (p *processor) resume() {
+	atomic.StoreInt32(&p.paused, 0)
+}
+
+// active returns the number of workers currently processing tasks.
+func (p *processor) active() int {
+	return int(atomic.LoadInt32(&p.activeWorkers))
+}
+
+// taskCounters counts the outcomes of tasks. Must be accessed atomically.
+type taskCounters struct {
+	succeeded int64
+	failed    int64
+	retried   int64
+	killed    int64
+}
+
+// categoryCounters holds the numbers of task outcomes of a category.
+type categoryCounters struct {
+	succeeded int64
+	failed    int64
+}
+
+// stats returns a snapshot of the counters.
+func (p *processor) stats() Stats {
+	c := p.counters
+	succeeded := atomic.LoadInt64(&c.succeeded)
+	failed := atomic.LoadInt64(&c.failed)
+	return Stats{
+		Processed:     succeeded + failed,
+		Succeeded:     succeeded,
+		Failed:        failed,
+		Retried:       atomic.LoadInt64(&c.retried),
+		Killed:        atomic.LoadInt64(&c.killed),
+		ActiveWorkers: p.active(),
+		Categories:    p.categoryStats(),
+	}
+}
+
+// categoryStats returns a snapshot of the counters per category, or nil
+// if no task with a category has been processed.
+func (p *processor) categoryStats() map[string]CategoryStats {
+	res := make(map[string]CategoryStats)
+	p.categoryMu.Lock()
+	for category, c := range p.categoryCounts {
+		res[category] = CategoryStats{
+			Processed: c.succeeded + c.failed,
+			Succeeded: c.succeeded,
+			Failed:    c.failed,
+		}
+	}
+	p.categoryMu.Unlock()
+	p.activeMu.Lock()
+	for _, t := range p.activeTasks {
+		if t.Category != "" {
+			s := res[t.Category]
+			s.ActiveWorkers++
+			res[t.Category] = s
+		}
+	}
+	p.activeMu.Unlock()
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// claimRestore reports whether the processor should restore the unfinished
+// tasks on start. If restoreLockTTL is set, only the processor acquiring
+// the restore lock does, so that backgrounds restarted together don't all
+// run the restore at once. If the lock can't be checked, it restores the
+// tasks anyway.
+func (p *processor) claimRestore() bool {
+	if p.restoreLockTTL <= 0 {
+		return true
+	}
+	ok, err := p.rdb.TryRestoreLock(p.serverID, p.restoreLockTTL)
+	if err != nil {
+		p.logger.printf("[WARN] Could not acquire restore lock, restoring unfinished tasks anyway: %v\n", err)
+		return true
+	}
+	if !ok {
+		p.logger.printf("[INFO] Unfinished tasks were restored by another instance recently, skipping restore.\n")
+	}
+	return ok
+}
+
+// restore moves all tasks from "in-progress" back to queue
+// to restore all unfinished tasks, and returns the number of tasks moved.
+// If abandon is set, tasks are moved to "abandoned" queue instead.
+func (p *processor) restore() (int64, error) {
+	if p.abandon {
+		n, err := p.rdb.AbandonUnfinished()
+		if err != nil {
+			p.logger.printf("[ERROR] Could not abandon unfinished tasks: %v\n", err)
+		}
+		if n > 0 {
+			p.logger.printf("[WARN] Moved %d unfinished tasks to abandoned queue.\n", n)
+		}
+		return n, err
+	}
+	n, expired, err := p.rdb.RestoreUnexpired()
+	if err != nil {
+		p.logger.printf("[ERROR] Could not restore unfinished tasks: %v\n", err)
+	}
+	if n > 0 {
+		p.logger.printf("[INFO] Restored %d unfinished tasks back to queue.\n", n)
+	}
+	for _, msg := range expired {
+		// processing the task won't help, it's past the deadline.
+		e := fmt.Errorf("unfinished task is past the deadline %v",
+			time.Unix(msg.Deadline, 0).UTC().Format(time.RFC3339))
+		if p.dropExpired {
+			p.drop(msg, e)
+		} else {
+			p.kill(msg, e)
+		}
+	}
+	if len(expired) > 0 {
+		atomic.AddInt64(&p.expired, int64(len(expired)))
+		p.logger.printf("[WARN] Did not restore %d unfinished tasks past their deadline.\n", len(expired))
+	}
+	return n, err
+}
+
+// handOff moves the tasks interrupted on shutdown from "in-progress" to
+// the handoff lists of their queues, to be processed by the other servers,
+// and returns the number of tasks moved. If it fails, the tasks are left
+// in "in-progress" to be restored.
+func (p *processor) handOff() (int64, error) {
+	p.activeMu.Lock()
+	msgs := p.interrupted
+	p.interrupted = nil
+	p.activeMu.Unlock()
+	n, err := p.rdb.HandOff(p.handoffTTL, msgs...)
+	if err != nil {
+		p.logger.printf("[ERROR] Could not hand off unfinished tasks: %v\n", err)
+	}
+	if n > 0 {
+		p.logger.printf("[INFO] Handed off %d unfinished tasks to other servers.\n", n)
+	}
+	return n, err
+}
+
+// requeue moves the task dequeued during shutdown back to the queue.
+// Failures are retried with backoff until requeueDeadline, since redis
+// tends to be under load while many instances are shutting down.
+// If it doesn't succeed, the task stays in "in-progress" and gets restored
+// on the next start.
+func (p *processor) requeue(msg *base.TaskMessage) {
+	if p.abandon {
+		err := retryUntil(p.requeueDeadline, func() error { return p.rdb.Abandon(msg) })
+		if err != nil {
+			p.logger.taskPrintf(msg, "[ERROR] Could not move task from InProgress to Abandoned queue: %v\n", err)
+		}
+		return
+	}
+	err := retryUntil(p.requeueDeadline, func() error { return p.rdb.Requeue(msg) })
+	if err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not move task from InProgress back to queue: %v\n", err)
+		return
+	}
+	p.notifyRequeue(msg)
+}
+
+// notifyRequeue calls onRequeue, if any, with the requeued task.
+// A panic in onRequeue is logged and recovered, so that the shutdown
+// can proceed with the rest of the tasks.
+func (p *processor) notifyRequeue(msg *base.TaskMessage) {
+	if p.onRequeue == nil {
+		return
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.taskPrintf(msg, "[ERROR] OnRequeue panicked for task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, x)
+		}
+	}()
+	// Note: The payload is nil if it cannot be decoded.
+	payload, _ := base.DecodePayload(msg)
+	p.onRequeue(NewTask(msg.Type, payload))
+}
+
+// notifyMalformed logs the message moved to the malformed queue and calls
+// onMalformedTask, if any. A panic in onMalformedTask is logged and recovered.
+func (p *processor) notifyMalformed(e *rdb.MalformedTaskError) {
+	p.logger.printf("[ERROR] %v; moved the message to the malformed queue\n", e)
+	if p.onMalformedTask == nil {
+		return
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			p.logger.printf("[ERROR] OnMalformedTask panicked: %v\n", x)
+		}
+	}()
+	p.onMalformedTask(e.Data, e.Err)
+}
+
+// Backoff bounds for retryUntil.
+const (
+	minRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff = 500 * time.Millisecond
+)
+
+// retryUntil calls fn until it returns nil or the deadline passes,
+// doubling the wait between attempts. It returns the last error.
+// fn is called at least once.
+func retryUntil(deadline time.Time, fn func() error) error {
+	backoff := minRetryBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// updateState calls fn, which records the result of a processed task in
+// redis, retrying with backoff for up to stateUpdateTimeout so that
+// a transient failure doesn't leave the task in "in-progress" to be
+// restored and processed again.
+//
+// Note: A retried call may have taken effect despite the error,
+// e.g. if the reply was lost, so the result may be recorded twice.
+func (p *processor) updateState(fn func() error) error {
+	return retryUntil(time.Now().Add(p.stateUpdateTimeout), fn)
+}
+
+// postponeBackoff is the duration to postpone the tasks of a type or
+// a category at its concurrency limit, or of a serial key held by another
+// task, without trying to process them.
+const postponeBackoff = 10 * time.Millisecond
+
+// maxPostponed is the max number of tasks postponed in a row before waiting
+// for postponeBackoff, which bounds the rate of postponing the tasks while
+// the queues are full of tasks at their limits.
+const maxPostponed = 100
+
+// serialKeyTTL returns the duration to hold the lock of the serial key of
+// the task for, which outlives the timeout of the task if any, so that
+// the lock is released by the worker, or expires if the worker dies.
+func (p *processor) serialKeyTTL(msg *base.TaskMessage) time.Duration {
+	if d := p.timeout(msg); d > 0 {
+		return d + serialKeyMargin
+	}
+	return defaultSerialKeyTTL
+}
+
+const (
+	// serialKeyMargin is the time the lock of a serial key is held for
+	// past the timeout of the task.
+	serialKeyMargin = time.Minute
+
+	// defaultSerialKeyTTL is the time the lock of a serial key is held for
+	// if the task has no timeout.
+	defaultSerialKeyTTL = 30 * time.Minute
+)
+
+// lockSerialKey takes the lock of the serial key of the task, if any,
+// and reports whether the task can be processed.
+func (p *processor) lockSerialKey(msg *base.TaskMessage) bool {
+	if msg.SerialKey == "" {
+		return true
+	}
+	ok, err := p.rdb.LockSerialKey(msg.SerialKey, msg.ID, p.serialKeyTTL(msg))
+	if err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not lock serial key %q: %v\n", msg.SerialKey, err)
+		return false
+	}
+	return ok
+}
+
+// unlockSerialKey releases the lock of the serial key of the task, if any.
+func (p *processor) unlockSerialKey(msg *base.TaskMessage) {
+	if msg.SerialKey == "" {
+		return
+	}
+	if err := p.rdb.UnlockSerialKey(msg.SerialKey, msg.ID); err != nil {
+		p.logger.taskPrintf(msg, "[WARN] Could not unlock serial key %q, it expires in %v: %v\n", msg.SerialKey, p.serialKeyTTL(msg), err)
+	}
+}
+
+// postpone moves the task back to the tail of its queue, so that the tasks
+// behind it get processed first.
+//
+// Note: Once every task in the queues, or maxPostponed tasks, have been
+// postponed since a task was last handed to a worker, it waits for
+// postponeBackoff to avoid spinning on the queues.
+func (p *processor) postpone(msg *base.TaskMessage) {
+	if p.killIfCanceled(msg) {
+		return
+	}
+	err := p.rdb.Postpone(msg)
+	if err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not move task from InProgress back to queue: %v\n", err)
+	}
+	if !p.postponed[msg.ID] && len(p.postponed) < maxPostponed {
+		p.postponed[msg.ID] = true
+		return
+	}
+	p.clearPostponed()
+	select {
+	case <-p.abort:
+	case <-time.After(postponeBackoff):
+	}
+}
+
+// clearPostponed forgets the tasks postponed so far.
+func (p *processor) clearPostponed() {
+	if len(p.postponed) > 0 {
+		p.postponed = make(map[xid.ID]bool)
+	}
+}
+
+// backOff postpones the tasks of the given limit for postponeBackoff.
+func (p *processor) backOff(key string) {
+	p.backoffs[key] = time.Now().Add(postponeBackoff)
+}
+
+// backingOff reports whether the type, the category or the serial key of
+// the task has reached its limit within postponeBackoff.
+func (p *processor) backingOff(msg *base.TaskMessage) bool {
+	if len(p.backoffs) == 0 {
+		return false
+	}
+	now := time.Now()
+	for key, until := range p.backoffs {
+		if !now.Before(until) {
+			delete(p.backoffs, key)
+		}
+	}
+	for _, key := range []string{typeBackoffKey(msg.Type), categoryBackoffKey(msg.Category), serialBackoffKey(msg.SerialKey)} {
+		if _, ok := p.backoffs[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func typeBackoffKey(typename string) string { return "type:" + typename }
+
+func categoryBackoffKey(category string) string { return "category:" + category }
+
+func serialBackoffKey(key string) string { return "serial:" + key }
+
+func (p *processor) markAsDone(task *Task, msg *base.TaskMessage, duration time.Duration) {
+	atomic.AddInt64(&p.counters.succeeded, 1)
+	if p.metrics != nil {
+		p.metrics.TaskProcessed(msg.Queue, msg.Type)
+	}
+	p.recordResult(msg, true)
+	p.recordEvent(TaskSucceeded, nil, msg)
+	if _, ok := p.batches[msg.Queue]; p.dedupWindow > 0 && !ok {
+		// Note: Mark the task before removing it from the in-progress queue,
+		// so that the task is skipped if it's restored since the removal fails.
+		if err := p.rdb.MarkCompleted(msg.ID, p.dedupWindow); err != nil {
+			p.logger.taskPrintf(msg, "[ERROR] Could not mark task(Type: %q, ID: %v) as completed: %v\n", msg.Type, msg.ID, err)
+		}
+	}
+	err := p.updateState(func() error {
+		if p.keepCompleted > 0 {
+			return p.rdb.DoneWithResult(msg, duration, p.keepCompleted, completedResult(task))
+		}
+		return p.rdb.Done(msg)
+	})
+	if err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not remove task from InProgress queue, it will be processed again once restored: %v\n", err)
+	} else {
+		p.storeResult(msg, &rdb.ResultRecord{State: rdb.ResultCompleted, Result: completedResult(task)})
+		p.enqueueFollowUp(msg, msg.OnComplete)
+	}
+	if p.onSuccess != nil {
+		p.onSuccess(task, p.latency(msg))
+	}
+}
+
+// enqueueFollowUp enqueues the follow-up task of the given task, if any
+// (see OnComplete and OnFailure). The follow-up task is not enqueued again
+// if the enqueue fails.
+func (p *processor) enqueueFollowUp(msg, followUp *base.TaskMessage) {
+	if followUp == nil {
+		return
+	}
+	next := *followUp
+	next.ParentID = msg.ID.String()
+	next.EnqueuedAt = p.clock.Now().UnixNano()
+	if err := p.rdb.Enqueue(&next); err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not enqueue follow-up task(Type: %q, ID: %v) of task(Type: %q, ID: %v): %v\n",
+			next.Type, next.ID, msg.Type, msg.ID, err)
+	}
+}
+
+// completedResult returns the result of the task set by SetResult to keep
+// with the record of the completion, or nil if there's none.
+func completedResult(task *Task) *rdb.TaskResult {
+	res, ok := taskResult(task)
+	if !ok {
+		return nil
+	}
+	return &rdb.TaskResult{Status: res.Status.String(), Message: res.Message, Data: res.Data}
+}
+
+// recordResult records the result of the task to the circuit breaker
+// of the task's queue, if any, and to the counters of the task's category.
+func (p *processor) recordResult(msg *base.TaskMessage, success bool) {
+	if b, ok := p.breakers[msg.Queue]; ok {
+		b.record(success)
+	}
+	if msg.Category == "" {
+		return
+	}
+	p.categoryMu.Lock()
+	defer p.categoryMu.Unlock()
+	c, ok := p.categoryCounts[msg.Category]
+	if !ok {
+		c = new(categoryCounters)
+		p.categoryCounts[msg.Category] = c
+	}
+	if success {
+		c.succeeded++
+	} else {
+		c.failed++
+	}
+}
+
+// recordEvent records an event of the tasks if events are kept.
+// err is the error of the failed tasks, nil otherwise.
+func (p *processor) recordEvent(kind EventKind, err error, msgs ...*base.TaskMessage) {
+	if p.events == nil {
+		return
+	}
+	now := p.clock.Now()
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	for _, msg := range msgs {
+		p.events.add(Event{
+			Kind:   kind,
+			Time:   now,
+			TaskID: msg.ID.String(),
+			Type:   msg.Type,
+			Queue:  msg.Queue,
+			Error:  errMsg,
+		})
+	}
 }
 
-type retryDelayFunc func(n int, err error, task *Task) time.Duration
+// latency returns the time elapsed since the task was first enqueued.
+// Zero if the enqueue time is unknown.
+func (p *processor) latency(msg *base.TaskMessage) time.Duration {
+	if msg.EnqueuedAt == 0 {
+		return 0
+	}
+	return p.clock.Now().Sub(time.Unix(0, msg.EnqueuedAt))
+}
 
-// newProcessor constructs a new processor.
-//
-// r is an instance of RDB used by the processor.
-// n specifies the max number of concurrenct worker goroutines.
-// qfcg is a mapping of queue names to associated priority level.
-// strict specifies whether queue priority should be treated strictly.
-// fn is a function to compute retry delay.
-func newProcessor(r *rdb.RDB, n int, qcfg map[string]uint, strict bool, fn retryDelayFunc) *processor {
-	orderedQueues := []string(nil)
-	if strict {
-		orderedQueues = sortByPriority(qcfg)
+// delay returns the duration to wait before processing the failed task again.
+func (p *processor) delay(msg *base.TaskMessage, e error) time.Duration {
+	if d, ok := RetryAfter(e); ok {
+		return d
 	}
-	return &processor{
-		rdb:            r,
-		queueConfig:    qcfg,
-		orderedQueues:  orderedQueues,
-		retryDelayFunc: fn,
-		sema:           make(chan struct{}, n),
-		done:           make(chan struct{}),
-		abort:          make(chan struct{}),
-		quit:           make(chan struct{}),
-		handler:        HandlerFunc(func(t *Task) error { return fmt.Errorf("handler not set") }),
+	if d, ok := scheduledDelay(msg); ok {
+		return d
+	}
+	payload, _ := base.DecodePayload(msg)
+	fn := p.retryDelayFunc
+	if qfn, ok := p.queueRetryDelays[msg.Queue]; ok {
+		fn = qfn
 	}
+	return fn(msg.Retried, e, NewTask(msg.Type, payload))
 }
 
-// Note: stops only the "processor" goroutine, does not stop workers.
-// It's safe to call this method multiple times.
-func (p *processor) stop() {
-	p.once.Do(func() {
-		log.Println("[INFO] Processor shutting down...")
-		// Unblock if processor is waiting for sema token.
-		close(p.abort)
-		// Signal the processor goroutine to stop processing tasks
-		// from the queue.
-		p.done <- struct{}{}
-	})
+// scheduledDelay returns the delay for the next retry of the task from its
+// retry schedule, clamping to the last delay. It reports false if the task
+// has no retry schedule or the schedule cannot be parsed.
+func scheduledDelay(msg *base.TaskMessage) (time.Duration, bool) {
+	n := len(msg.RetrySchedule)
+	if n == 0 {
+		return 0, false
+	}
+	i := msg.Retried
+	if i >= n {
+		i = n - 1
+	}
+	d, err := time.ParseDuration(msg.RetrySchedule[i])
+	if err != nil {
+		return 0, false
+	}
+	return d, true
 }
 
-// NOTE: once terminated, processor cannot be re-started.
-func (p *processor) terminate() {
-	p.stop()
+// defaultMaxErrorLength is the max length of stored error messages used
+// if none is specified.
+const defaultMaxErrorLength = 4096
 
-	// IDEA: Allow user to customize this timeout value.
-	const timeout = 8 * time.Second
-	time.AfterFunc(timeout, func() { close(p.quit) })
-	log.Println("[INFO] Waiting for all workers to finish...")
-	// block until all workers have released the token
-	for i := 0; i < cap(p.sema); i++ {
-		p.sema <- struct{}{}
+// truncatedMarker is appended to error messages truncated by errorMsg.
+const truncatedMarker = "...(truncated)"
+
+// errorMsg returns the error message to store with the failed task,
+// truncated to maxErrorLength bytes if it's longer.
+func (p *processor) errorMsg(e error) string {
+	s := e.Error()
+	if len(s) <= p.maxErrorLength {
+		return s
 	}
-	log.Println("[INFO] All workers have finished.")
-	p.restore() // move any unfinished tasks back to the queue.
+	n := p.maxErrorLength
+	// Note: Avoid cutting a multi-byte character in the middle.
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + truncatedMarker
 }
 
-func (p *processor) start() {
-	// NOTE: The call to "restore" needs to complete before starting
-	// the processor goroutine.
-	p.restore()
-	go func() {
-		for {
-			select {
-			case <-p.done:
-				log.Println("[INFO] Processor done.")
-				return
-			default:
-				p.exec()
-			}
+func (p *processor) retry(msg *base.TaskMessage, e error) {
+	delay := p.delay(msg, e)
+	retryAt := p.clock.Now().Add(delay)
+	if msg.Deadline > 0 && retryAt.After(time.Unix(msg.Deadline, 0)) {
+		// retrying won't help, the retry would be processed too late.
+		deadline := time.Unix(msg.Deadline, 0).UTC()
+		p.failureLog.taskPrintf(msg, "[WARN] Retry of task(Type: %q, ID: %v) would be past its deadline %v\n",
+			msg.Type, msg.ID, deadline.Format(time.RFC3339))
+		p.kill(msg, fmt.Errorf("%v (retry would be past the deadline %v)", e, deadline.Format(time.RFC3339)))
+		return
+	}
+	qname := p.retryQueue(msg, e)
+	priority := msg.Priority
+	if p.retryPriorityBoost > 0 {
+		priority += p.retryPriorityBoost
+		if priority > base.MaxPriority {
+			priority = base.MaxPriority
 		}
-	}()
+	}
+	err := p.updateState(func() error {
+		return p.rdb.RetryInQueue(msg, qname, priority, retryAt, p.errorMsg(e))
+	})
+	if err != nil {
+		p.failureLog.taskPrintf(msg, "[ERROR] Could not send task %+v to Retry queue: %v\n", msg, err)
+		return
+	}
+	atomic.AddInt64(&p.counters.retried, 1)
+	if p.metrics != nil {
+		p.metrics.TaskRetried(msg.Queue, msg.Type)
+	}
+	if p.onRetry != nil {
+		// Note: The payload is nil if it cannot be decoded.
+		payload, _ := base.DecodePayload(msg)
+		p.onRetry(NewTask(msg.Type, payload), delay)
+	}
 }
 
-// exec pulls a task out of the queue and starts a worker goroutine to
-// process the task.
-func (p *processor) exec() {
-	qnames := p.queues()
-	msg, err := p.rdb.Dequeue(qnames...)
-	if err == rdb.ErrNoProcessableTask {
-		// queues are empty, this is a normal behavior.
-		if len(p.queueConfig) > 1 {
-			// sleep to avoid slamming redis and let scheduler move tasks into queues.
-			// Note: With multiple queues, we are not using blocking pop operation and
-			// polling queues instead. This adds significant load to redis.
-			time.Sleep(time.Second)
+// retryQueue returns the queue to retry the task on, which is the queue
+// suggested by the error if it's processed by the processor, or the queue
+// of the task otherwise.
+func (p *processor) retryQueue(msg *base.TaskMessage, e error) string {
+	qname, ok := RetryQueue(e)
+	if !ok || qname == strings.ToLower(msg.Queue) {
+		return msg.Queue
+	}
+	cfg, _ := p.queueSnapshot()
+	for q := range cfg {
+		if strings.ToLower(q) == qname {
+			return qname
 		}
+	}
+	p.logger.taskPrintf(msg, "[WARN] Could not retry task(Type: %q, ID: %v) on queue %q which is not processed; retrying on queue %q\n",
+		msg.Type, msg.ID, qname, msg.Queue)
+	return msg.Queue
+}
+
+func (p *processor) kill(msg *base.TaskMessage, e error) {
+	if p.deferDead(msg, e) {
 		return
 	}
+	p.failureLog.taskPrintf(msg, "[WARN] Retry exhausted for task(Type: %q, ID: %v)\n", msg.Type, msg.ID)
+	var dead *base.TaskMessage
+	err := p.updateState(func() (err error) {
+		dead, err = p.rdb.KillMessage(msg, p.errorMsg(e), p.serverID, p.maxDeadTasks)
+		return err
+	})
 	if err != nil {
-		log.Printf("[ERROR] unexpected error while pulling a task out of queue: %v\n", err)
+		p.failureLog.taskPrintf(msg, "[ERROR] Could not send task %+v to Dead queue: %v\n", msg, err)
 		return
 	}
+	p.export(dead)
+	atomic.AddInt64(&p.counters.killed, 1)
+	if p.metrics != nil {
+		p.metrics.TaskKilled(msg.Queue, msg.Type)
+	}
+	p.resolveDead(msg)
+	p.storeResult(msg, &rdb.ResultRecord{State: rdb.ResultDead, Error: dead.ErrorMsg})
+	p.enqueueFollowUp(msg, msg.OnFailure)
+}
 
-	select {
-	case <-p.abort:
-		// shutdown is starting, return immediately after requeuing the message.
-		p.requeue(msg)
+// storeResult writes the given record to the result slot of the task,
+// if the result of the task is stored (see StoreResult).
+func (p *processor) storeResult(msg *base.TaskMessage, rec *rdb.ResultRecord) {
+	if msg.ResultTTL == 0 {
 		return
-	case p.sema <- struct{}{}: // acquire token
-		go func() {
-			defer func() { <-p.sema /* release token */ }()
-
-			resCh := make(chan error, 1)
-			task := NewTask(msg.Type, msg.Payload)
-			go func() {
-				resCh <- perform(p.handler, task)
-			}()
-
-			select {
-			case <-p.quit:
-				// time is up, quit this worker goroutine.
-				log.Printf("[WARN] Terminating in-progress task %+v\n", msg)
-				return
-			case resErr := <-resCh:
-				// Note: One of three things should happen.
-				// 1) Done  -> Removes the message from InProgress
-				// 2) Retry -> Removes the message from InProgress & Adds the message to Retry
-				// 3) Kill  -> Removes the message from InProgress & Adds the message to Dead
-				if resErr != nil {
-					if msg.Retried >= msg.Retry {
-						p.kill(msg, resErr)
-					} else {
-						p.retry(msg, resErr)
-					}
-					return
-				}
-				p.markAsDone(msg)
-			}
-		}()
+	}
+	if err := p.rdb.StoreResult(msg.ID, rec, time.Duration(msg.ResultTTL)*time.Second); err != nil {
+		p.logger.taskPrintf(msg, "[ERROR] Could not store result of task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, err)
 	}
 }
 
-// restore moves all tasks from "in-progress" back to queue
-// to restore all unfinished tasks.
-func (p *processor) restore() {
-	n, err := p.rdb.RestoreUnfinished()
+// export passes the killed task to the exporter, if any. The failure of
+// the export is logged, and the task stays in the dead queue regardless.
+func (p *processor) export(msg *base.TaskMessage) {
+	if p.exporter == nil {
+		return
+	}
+	t, err := newDeadTask(msg)
 	if err != nil {
-		log.Printf("[ERROR] Could not restore unfinished tasks: %v\n", err)
+		p.logger.taskPrintf(msg, "[ERROR] Could not export dead task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, err)
+		return
 	}
-	if n > 0 {
-		log.Printf("[INFO] Restored %d unfinished tasks back to queue.\n", n)
+	export := func() {
+		if err := p.exporter.Export(t); err != nil {
+			p.logger.taskPrintf(msg, "[ERROR] Could not export dead task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, err)
+		}
+	}
+	if !p.exportAsync {
+		export()
+		return
 	}
+	p.exports.Add(1)
+	go func() {
+		defer p.exports.Done()
+		export()
+	}()
 }
 
-func (p *processor) requeue(msg *base.TaskMessage) {
-	err := p.rdb.Requeue(msg)
+// deferDead moves the task to be killed to the deferred dead queue and
+// reports true, if the task has dead retries left. The task is retried
+// after deadRetryInterval, unless the retry would be past its deadline.
+func (p *processor) deferDead(msg *base.TaskMessage, e error) bool {
+	if p.deadRetryInterval <= 0 || msg.DeadRetried >= p.deadRetryAttempts || errors.Is(e, errTaskCanceled) {
+		return false
+	}
+	if classifyError(e, p.errorClassifiers) == Permanent {
+		return false
+	}
+	processAt := p.clock.Now().Add(p.deadRetryInterval)
+	if msg.Deadline > 0 && processAt.After(time.Unix(msg.Deadline, 0)) {
+		return false
+	}
+	err := p.updateState(func() error {
+		return p.rdb.Defer(msg, processAt, p.errorMsg(e))
+	})
 	if err != nil {
-		log.Printf("[ERROR] Could not move task from InProgress back to queue: %v\n", err)
+		p.failureLog.taskPrintf(msg, "[ERROR] Could not send task %+v to Deferred queue: %v\n", msg, err)
+		return true
 	}
+	p.failureLog.taskPrintf(msg, "[WARN] Deferred task(Type: %q, ID: %v) to retry at %v (dead retry %d of %d)\n",
+		msg.Type, msg.ID, processAt.Format(time.RFC3339), msg.DeadRetried+1, p.deadRetryAttempts)
+	return true
 }
 
-func (p *processor) markAsDone(msg *base.TaskMessage) {
-	err := p.rdb.Done(msg)
+func (p *processor) snooze(msg *base.TaskMessage, e error) {
+	processAt := p.clock.Now().Add(p.delay(msg, e))
+	err := p.rdb.Snooze(msg, processAt)
 	if err != nil {
-		log.Printf("[ERROR] Could not remove task from InProgress queue: %v\n", err)
+		p.failureLog.taskPrintf(msg, "[ERROR] Could not send task %+v to Scheduled queue: %v\n", msg, err)
 	}
 }
 
-func (p *processor) retry(msg *base.TaskMessage, e error) {
-	d := p.retryDelayFunc(msg.Retried, e, NewTask(msg.Type, msg.Payload))
-	retryAt := time.Now().Add(d)
-	err := p.rdb.Retry(msg, retryAt, e.Error())
+func (p *processor) drop(msg *base.TaskMessage, e error) {
+	p.failureLog.taskPrintf(msg, "[WARN] Dropping task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, e)
+	err := p.rdb.Drop(msg)
 	if err != nil {
-		log.Printf("[ERROR] Could not send task %+v to Retry queue: %v\n", msg, err)
+		p.logger.taskPrintf(msg, "[ERROR] Could not remove task from InProgress queue: %v\n", err)
+		return
 	}
+	// Note: A dropped task is not kept anywhere to be enqueued again, so the
+	// tasks waiting for it are killed regardless of killDependents.
+	p.killWaiting(msg)
 }
 
-func (p *processor) kill(msg *base.TaskMessage, e error) {
-	log.Printf("[WARN] Retry exhausted for task(Type: %q, ID: %v)\n", msg.Type, msg.ID)
-	err := p.rdb.Kill(msg, e.Error())
+// resolveDead kills the tasks waiting for the given task, which will never
+// complete, if killDependents is set. Otherwise they're left waiting, e.g.
+// until the task is enqueued again from the dead queue and completes.
+func (p *processor) resolveDead(msg *base.TaskMessage) {
+	if !p.killDependents {
+		return
+	}
+	p.killWaiting(msg)
+}
+
+// killWaiting kills the tasks waiting for the given task.
+func (p *processor) killWaiting(msg *base.TaskMessage) {
+	n, err := p.rdb.KillDependents(msg.ID)
 	if err != nil {
-		log.Printf("[ERROR] Could not send task %+v to Dead queue: %v\n", msg, err)
+		p.logger.taskPrintf(msg, "[ERROR] Could not kill tasks depending on task(Type: %q, ID: %v): %v\n", msg.Type, msg.ID, err)
+	}
+	if n > 0 {
+		p.logger.taskPrintf(msg, "[WARN] Killed %d tasks depending on task(Type: %q, ID: %v)\n", n, msg.Type, msg.ID)
+	}
+}
+
+// failureLogInterval is the minimum interval between the log lines of
+// the same kind of task failure.
+const failureLogInterval = time.Second
+
+// throttledLogger logs at most one line per interval for each format string.
+// Suppressed lines are counted and the count is reported with the next line
+// logged for the format (or by flush).
+type throttledLogger struct {
+	clock    base.Clock
+	interval time.Duration
+	logf     func(msg *base.TaskMessage, format string, args ...interface{})
+
+	mu         sync.Mutex
+	last       map[string]time.Time // format -> time of the last line logged
+	suppressed map[string]int       // format -> number of lines suppressed since
+}
+
+func newThrottledLogger(clock base.Clock, interval time.Duration, logf func(msg *base.TaskMessage, format string, args ...interface{})) *throttledLogger {
+	return &throttledLogger{
+		clock:      clock,
+		interval:   interval,
+		logf:       logf,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// printf logs the line unless a line of the same format has been logged
+// within the interval, in which case the line is logged at DEBUG level.
+func (l *throttledLogger) printf(format string, args ...interface{}) {
+	l.taskPrintf(nil, format, args...)
+}
+
+// taskPrintf is like printf, but the line is about the given task.
+func (l *throttledLogger) taskPrintf(msg *base.TaskMessage, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if last, ok := l.last[format]; ok && now.Sub(last) < l.interval {
+		l.suppressed[format]++
+		// Note: Keep the detail of the line at debug level.
+		if i := strings.Index(format, "]"); strings.HasPrefix(format, "[") && i > 0 {
+			l.logf(msg, "[DEBUG]"+format[i+1:], args...)
+		}
+		return
+	}
+	l.last[format] = now
+	if n := l.suppressed[format]; n > 0 {
+		delete(l.suppressed, format)
+		l.logf(msg, strings.TrimSuffix(format, "\n")+" (%d similar messages suppressed)\n", append(args, n)...)
+		return
 	}
+	l.logf(msg, format, args...)
+}
+
+// flush logs the number of suppressed lines for each format.
+func (l *throttledLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for format, n := range l.suppressed {
+		prefix := format[:strings.Index(format, "]")+1]
+		l.logf(nil, "%s %d similar messages suppressed: %q\n", prefix, n, strings.TrimSpace(format))
+	}
+	l.suppressed = make(map[string]int)
 }
 
 // queues returns a list of queues to query.
@@ -225,6 +2401,53 @@ func (p *processor) kill(msg *base.TaskMessage, e error) {
 // If strict-priority is false, then the order of queue names are roughly based on
 // the priority level but randomized in order to avoid starving low priority queues.
 func (p *processor) queues() []string {
+	p.applyPendingQueues()
+	if p.queueDiscovery {
+		p.discoverQueues()
+	}
+	qnames := p.orderQueues()
+	if len(p.breakers) == 0 {
+		return p.limitQueues(qnames)
+	}
+	// Note: Skip the queues with open circuit breakers. If all queues are
+	// skipped, Dequeue waits as if all queues are paused.
+	var res []string
+	for _, qname := range qnames {
+		if b, ok := p.breakers[strings.ToLower(qname)]; ok && !b.allow() {
+			continue
+		}
+		res = append(res, qname)
+	}
+	return p.limitQueues(res)
+}
+
+// limitQueues returns up to maxPolledQueues of the ordered queues: the first
+// half of them, and the rest taken in turn from the other queues sorted by
+// name, so that every queue is checked over time.
+func (p *processor) limitQueues(qnames []string) []string {
+	if p.maxPolledQueues <= 0 || len(qnames) <= p.maxPolledQueues {
+		return qnames
+	}
+	// Note: With one queue at a time, all queues are taken in turn.
+	top := p.maxPolledQueues / 2
+	res := make([]string, top, p.maxPolledQueues)
+	copy(res, qnames[:top])
+	others := append([]string(nil), qnames[top:]...)
+	sort.Strings(others)
+	n := p.maxPolledQueues - top
+	for i := 0; i < n; i++ {
+		res = append(res, others[(p.pollCursor+i)%len(others)])
+	}
+	p.pollCursor = (p.pollCursor + n) % len(others)
+	return res
+}
+
+// orderQueues returns a list of queues to query, ordered by the queue
+// priority strictly or randomly based on the priority.
+func (p *processor) orderQueues() []string {
+	if p.selector != nil {
+		return p.selector.Next(p.queueConfig)
+	}
 	// skip the overhead of generating a list of queue names
 	// if we are processing one queue.
 	if len(p.queueConfig) == 1 {
@@ -233,17 +2456,361 @@ func (p *processor) queues() []string {
 		}
 	}
 	if p.orderedQueues != nil {
+		if p.starvationGuard > 0 && p.consecutive >= p.starvationGuard {
+			p.consecutive = 0
+			return p.reversedQueues
+		}
 		return p.orderedQueues
 	}
-	var names []string
+	if p.depthAware {
+		p.sampleDepths()
+		return p.orderQueuesByDepth()
+	}
+	return WeightedSelector{Rand: p.rand}.Next(p.queueConfig)
+}
+
+// depthSampleInterval is the interval to sample the depth of the queues
+// in depth-aware mode.
+const depthSampleInterval = time.Second
+
+// sampleDepths updates the depth of the queues, at most once per interval.
+// On error, the last sampled depths are kept.
+func (p *processor) sampleDepths() {
+	now := p.clock.Now()
+	if now.Sub(p.lastDepthSample) < depthSampleInterval {
+		return
+	}
+	p.lastDepthSample = now
+	qnames := make([]string, 0, len(p.queueConfig))
+	for qname := range p.queueConfig {
+		qnames = append(qnames, qname)
+	}
+	depths, err := p.rdb.QueueDepths(qnames...)
+	if err != nil {
+		p.logger.printf("[ERROR] could not sample queue depths: %v\n", err)
+		return
+	}
+	p.queueDepths = depths
+}
+
+// orderQueuesByDepth returns a list of queues to query, ordered randomly
+// based on both the priority and the sampled depth of the queues.
+//
+// The weight of a queue is its priority scaled by 1 + n*depth/total, where
+// n is the number of queues and total is the sum of their depths, so that
+// a queue with a large backlog is drained faster than its priority alone
+// suggests, while a queue with few tasks keeps at least its priority weight.
+func (p *processor) orderQueuesByDepth() []string {
+	var total int64
+	for qname := range p.queueConfig {
+		total += p.queueDepths[qname]
+	}
+	n := float64(len(p.queueConfig))
+	names := make([]string, 0, len(p.queueConfig))
+	weights := make([]float64, 0, len(p.queueConfig))
 	for qname, priority := range p.queueConfig {
-		for i := 0; i < int(priority); i++ {
-			names = append(names, qname)
+		w := float64(priority)
+		if total > 0 {
+			w *= 1 + n*float64(p.queueDepths[qname])/float64(total)
+		}
+		names = append(names, qname)
+		weights = append(weights, w)
+	}
+	// Note: Pick the queues one by one with the probability proportional
+	// to their weights among the queues not picked yet.
+	res := make([]string, 0, len(names))
+	for len(names) > 0 {
+		var sum float64
+		for _, w := range weights {
+			sum += w
+		}
+		x := p.rand.Float64() * sum
+		i := 0
+		for ; i < len(weights)-1; i++ {
+			x -= weights[i]
+			if x < 0 {
+				break
+			}
+		}
+		res = append(res, names[i])
+		names = append(names[:i], names[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return res
+}
+
+// queueDiscoveryInterval is the interval to refresh the queues to process
+// from redis if queue discovery is enabled.
+const queueDiscoveryInterval = 5 * time.Second
+
+// discoveredQueuePriority is the priority level of the discovered queues.
+const discoveredQueuePriority = 1
+
+// discoverQueues adds the queues registered in redis but missing from
+// queueConfig to the queues to process, at most once per interval.
+func (p *processor) discoverQueues() {
+	now := p.clock.Now()
+	if now.Sub(p.lastDiscovery) < queueDiscoveryInterval {
+		return
+	}
+	p.lastDiscovery = now
+	qnames, err := p.rdb.QueueNames()
+	if err != nil {
+		p.logger.printf("[ERROR] could not discover queues: %v\n", err)
+		return
+	}
+	known := make(map[string]bool)
+	for qname := range p.queueConfig {
+		known[strings.ToLower(qname)] = true
+	}
+	var cfg map[string]uint
+	for _, qname := range qnames {
+		if known[qname] {
+			continue
+		}
+		if cfg == nil {
+			cfg = make(map[string]uint)
+			for q, n := range p.queueConfig {
+				cfg[q] = n
+			}
+		}
+		cfg[qname] = discoveredQueuePriority
+		p.logger.printf("[INFO] Discovered queue %q\n", qname)
+	}
+	if cfg == nil {
+		return
+	}
+	p.setQueueConfig(cfg)
+}
+
+// reconfigure replaces the queues to process with the ones in cfg, from
+// the next time the "processor" goroutine pulls a task out of the queues.
+// Tasks being processed are not affected.
+func (p *processor) reconfigure(cfg map[string]uint) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	p.pendingQueues = cfg
+}
+
+// applyPendingQueues applies the queue config given to reconfigure, if any.
+func (p *processor) applyPendingQueues() {
+	p.queueMu.Lock()
+	cfg := p.pendingQueues
+	p.pendingQueues = nil
+	p.queueMu.Unlock()
+	if cfg == nil {
+		return
+	}
+	p.setQueueConfig(cfg)
+	p.consecutive = 0
+	// discover the queues missing from the new config right away.
+	p.lastDiscovery = time.Time{}
+	p.logger.printf("[INFO] Reconfigured queues: %v\n", cfg)
+}
+
+// setQueueConfig replaces queueConfig with cfg, reordering the queues
+// in strict-priority mode. It must be called by the "processor" goroutine.
+func (p *processor) setQueueConfig(cfg map[string]uint) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	p.queueConfig = cfg
+	if p.orderedQueues != nil {
+		p.orderedQueues = sortByPriority(cfg)
+		p.reversedQueues = reversed(p.orderedQueues)
+	}
+}
+
+// addActive records the given tasks as processed by workers.
+func (p *processor) addActive(msgs ...*base.TaskMessage) {
+	now := p.clock.Now()
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	for _, msg := range msgs {
+		p.activeTasks[msg] = ActiveTask{
+			ID:       msg.ID.String(),
+			Type:     msg.Type,
+			Queue:    msg.Queue,
+			Category: msg.Category,
+			Started:  now,
+			ServerID: p.serverID,
+		}
+	}
+}
+
+// interrupt records the given tasks as interrupted on shutdown if handoff
+// is set.
+func (p *processor) interrupt(msgs ...*base.TaskMessage) {
+	if !p.handoff {
+		return
+	}
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	p.interrupted = append(p.interrupted, msgs...)
+}
+
+// removeActive removes the given tasks from the tasks processed by workers.
+func (p *processor) removeActive(msgs ...*base.TaskMessage) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	for _, msg := range msgs {
+		delete(p.activeTasks, msg)
+	}
+}
+
+// errTaskCanceled is the error recorded for a task canceled by type.
+var errTaskCanceled = errors.New("task canceled")
+
+// addCancel returns a channel which is closed when the given task is
+// canceled by cancelType. It reports false if the task has been canceled
+// since it was pulled out of the queue, in which case the task must not
+// be processed.
+func (p *processor) addCancel(msg *base.TaskMessage) (<-chan struct{}, bool) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	canceled := p.claimed[msg]
+	delete(p.claimed, msg)
+	if canceled {
+		return nil, false
+	}
+	ch := make(chan struct{})
+	p.cancels[msg] = ch
+	return ch, true
+}
+
+// claim records the tasks pulled out of the queues, so that cancelType
+// cancels them before they're handed to workers.
+func (p *processor) claim(msgs ...*base.TaskMessage) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	for _, msg := range msgs {
+		p.claimed[msg] = false
+	}
+}
+
+// unclaim removes the record of the task made by claim, if any, and
+// reports whether the task has been canceled.
+func (p *processor) unclaim(msg *base.TaskMessage) bool {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	canceled := p.claimed[msg]
+	delete(p.claimed, msg)
+	return canceled
+}
+
+// killIfCanceled sends the task to the dead queue and reports true, if
+// the task has been canceled since it was pulled out of the queue.
+func (p *processor) killIfCanceled(msg *base.TaskMessage) bool {
+	if !p.unclaim(msg) {
+		return false
+	}
+	p.killCanceled(msg)
+	return true
+}
+
+func (p *processor) killCanceled(msg *base.TaskMessage) {
+	p.logger.taskPrintf(msg, "[WARN] Task(Type: %q, ID: %v) canceled\n", msg.Type, msg.ID)
+	p.kill(msg, errTaskCanceled)
+}
+
+func (p *processor) removeCancel(msg *base.TaskMessage) {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	delete(p.cancels, msg)
+}
+
+// cancelType cancels the tasks of the given type processed by workers or
+// pulled out of the queues to be processed (e.g. prefetched tasks), and
+// returns the number of the tasks canceled.
+//
+// The canceled tasks are sent to the dead queue, but the handlers cannot be
+// interrupted, so the workers are busy until the handlers return. The tasks
+// not handed to workers yet are sent to the dead queue without processing.
+func (p *processor) cancelType(taskType string) int {
+	p.activeMu.Lock()
+	defer p.activeMu.Unlock()
+	n := 0
+	for msg, ch := range p.cancels {
+		if msg.Type == taskType {
+			close(ch)
+			delete(p.cancels, msg)
+			n++
+		}
+	}
+	for msg, canceled := range p.claimed {
+		if msg.Type == taskType && !canceled {
+			p.claimed[msg] = true
+			n++
+		}
+	}
+	return n
+}
+
+// activeSnapshot returns the tasks currently processed by workers,
+// sorted by the start time.
+func (p *processor) activeSnapshot() []ActiveTask {
+	p.activeMu.Lock()
+	tasks := make([]ActiveTask, 0, len(p.activeTasks))
+	for _, t := range p.activeTasks {
+		tasks = append(tasks, t)
+	}
+	p.activeMu.Unlock()
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Started.Equal(tasks[j].Started) {
+			return tasks[i].ID < tasks[j].ID
+		}
+		return tasks[i].Started.Before(tasks[j].Started)
+	})
+	return tasks
+}
+
+// queueSnapshot returns a copy of the current queue config and, in
+// strict-priority mode, the queue names ordered by priority.
+func (p *processor) queueSnapshot() (map[string]uint, []string) {
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	cfg := make(map[string]uint, len(p.queueConfig))
+	for qname, n := range p.queueConfig {
+		cfg[qname] = n
+	}
+	var ordered []string
+	if p.orderedQueues != nil {
+		ordered = append([]string(nil), p.orderedQueues...)
+	}
+	return cfg, ordered
+}
+
+// countDequeued updates the number of tasks dequeued in a row from queues
+// other than the lowest priority one, used by the starvation guard.
+func (p *processor) countDequeued(msg *base.TaskMessage) {
+	if p.starvationGuard <= 0 || len(p.orderedQueues) < 2 {
+		return
+	}
+	if msg.Queue == p.orderedQueues[len(p.orderedQueues)-1] {
+		p.consecutive = 0
+		return
+	}
+	p.consecutive++
+}
+
+// handlerFor returns the handler to process the given task.
+func (p *processor) handlerFor(msg *base.TaskMessage) Handler {
+	if h, ok := p.queueHandlers[msg.Queue]; ok {
+		return h
+	}
+	return p.handler
+}
+
+func init() {
+	hook.Perform = func(h, task interface{}, qname string, requireAck bool) error {
+		t := task.(*Task)
+		state := &taskState{queue: qname}
+		taskStates.Store(t, state)
+		defer taskStates.Delete(t)
+		if err := perform(h.(Handler), t); err != nil {
+			return err
 		}
+		return stateResult(state, requireAck)
 	}
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	r.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
-	return uniq(names, len(p.queueConfig))
 }
 
 // perform calls the handler with the given task.
@@ -252,12 +2819,63 @@ func (p *processor) queues() []string {
 func perform(h Handler, task *Task) (err error) {
 	defer func() {
 		if x := recover(); x != nil {
-			err = fmt.Errorf("panic: %v", x)
+			err = &PanicError{Value: x, Stack: debug.Stack()}
 		}
 	}()
 	return h.ProcessTask(task)
 }
 
+// performBatch calls the batch handler with the given tasks and returns
+// an error for each task.
+// If the handler panics or returns a wrong number of errors, the same
+// error is returned for all tasks.
+func performBatch(h BatchHandler, tasks []*Task) (errs []error) {
+	fail := func(err error) []error {
+		res := make([]error, len(tasks))
+		for i := range res {
+			res[i] = err
+		}
+		return res
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			errs = fail(&PanicError{Value: x, Stack: debug.Stack()})
+		}
+	}()
+	errs = h.ProcessTasks(tasks)
+	if len(errs) != len(tasks) {
+		return fail(fmt.Errorf("batch handler returned %d results for %d tasks", len(errs), len(tasks)))
+	}
+	return errs
+}
+
+// clonePayload returns a deep copy of the payload decoded from JSON.
+func clonePayload(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+	return cloneValue(payload).(map[string]interface{})
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			res[key] = cloneValue(val)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, val := range v {
+			res[i] = cloneValue(val)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
 // uniq dedupes elements and returns a slice of unique names of length l.
 // Order of the output slice is based on the input list.
 func uniq(names []string, l int) []string {
@@ -290,6 +2908,15 @@ func sortByPriority(qcfg map[string]uint) []string {
 	return res
 }
 
+// reversed returns a copy of xs in reverse order.
+func reversed(xs []string) []string {
+	res := make([]string, 0, len(xs))
+	for i := len(xs) - 1; i >= 0; i-- {
+		res = append(res, xs[i])
+	}
+	return res
+}
+
 type queue struct {
 	name     string
 	priority uint
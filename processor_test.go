@@ -5,12 +5,22 @@
 package asynq
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	h "github.com/hibiken/asynq/internal/asynqtest"
@@ -65,7 +75,12 @@ func TestProcessorSuccess(t *testing.T) {
 			processed = append(processed, task)
 			return nil
 		}
-		p := newProcessor(rdbClient, 10, defaultQueueConfig, false, defaultDelayFunc)
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+		})
 		p.handler = HandlerFunc(handler)
 
 		p.start()
@@ -89,6 +104,592 @@ func TestProcessorSuccess(t *testing.T) {
 	}
 }
 
+func TestProcessorSingleQueueLatency(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	processedAt := make(chan time.Time, 10)
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		processedAt <- time.Now()
+		return nil
+	})
+	p.start()
+	defer p.terminate()
+
+	// Enqueue tasks at various offsets from the start of the blocking pop,
+	// and measure the latency of the tasks picked up by the blocking pop
+	// against the prioritized tasks, which cannot be waited on and are
+	// picked up by polling once the pop times out.
+	latency := func(priority int) time.Duration {
+		var total time.Duration
+		for i := 0; i < 5; i++ {
+			time.Sleep(300 * time.Millisecond)
+			msg := h.NewTaskMessage("send_email", nil)
+			msg.Priority = priority
+			enqueuedAt := time.Now()
+			if err := rdbClient.Enqueue(msg); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-processedAt:
+				total += got.Sub(enqueuedAt)
+			case <-time.After(3 * time.Second):
+				t.Fatalf("task was not processed")
+			}
+		}
+		return total / 5
+	}
+	blocking := latency(0)
+	polling := latency(1)
+	t.Logf("average latency: blocking %v, polling %v", blocking, polling)
+	if blocking > 200*time.Millisecond {
+		t.Errorf("tasks were processed %v after enqueued on average, want them to be processed as soon as they're enqueued", blocking)
+	}
+	if polling < 2*blocking {
+		t.Errorf("average latency of the blocking pop %v is not lower than the one of polling %v", blocking, polling)
+	}
+}
+
+func TestProcessorStopDuringBlockingPop(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		pollInterval:   10 * time.Second,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return nil })
+	p.start()
+	time.Sleep(300 * time.Millisecond) // let the processor block on the empty queue
+
+	start := time.Now()
+	p.terminate()
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("processor stopped %v after terminate during the blocking pop, want it to stop within %v",
+			elapsed, 1500*time.Millisecond)
+	}
+}
+
+func TestProcessorKeepCompleted(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		keepCompleted:  time.Hour,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	got, err := rdbClient.ListCompleted()
+	if err != nil {
+		t.Fatalf("(*RDB).ListCompleted() returned error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("(*RDB).ListCompleted() returned %d records, want 1", len(got))
+	}
+	if got[0].ID != m1.ID || got[0].Type != m1.Type || got[0].Queue != m1.Queue {
+		t.Errorf("completed record = %+v, want a record of task %+v", got[0], m1)
+	}
+	if got[0].Duration < 100*time.Millisecond {
+		t.Errorf("completed record has duration %v, want at least 100ms", got[0].Duration)
+	}
+}
+
+func TestProcessorDiscoverQueues(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	clock := base.NewSimulatedClock(time.Now())
+
+	m1 := h.NewTaskMessageWithQueue("sync", nil, "tenant_a")
+	m2 := h.NewTaskMessageWithQueue("sync", nil, "tenant_b")
+	if err := rdbClient.Enqueue(m1); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var processed []*Task
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		queueDiscovery: true,
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	})
+	p.start()
+	defer p.terminate()
+
+	time.Sleep(2 * time.Second)
+	// tenant_b is created at runtime and discovered on the next refresh.
+	if err := rdbClient.Enqueue(m2); err != nil {
+		t.Fatal(err)
+	}
+	clock.AdvanceTime(queueDiscoveryInterval)
+	time.Sleep(3 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []*Task{NewTask(m1.Type, m1.Payload), NewTask(m2.Type, m2.Payload)}
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorPause(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("gen_thumbnail", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	var mu sync.Mutex
+	var processed []*Task
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	})
+	p.start()
+	defer p.terminate()
+
+	time.Sleep(time.Second)
+	p.pause()
+	// Note: Wait for the pending dequeue to return.
+	time.Sleep(2 * time.Second)
+	if err := rdbClient.Enqueue(m2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+
+	mu.Lock()
+	want := []*Task{NewTask(m1.Type, m1.Payload)}
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks while paused; (-want, +got)\n%s", diff)
+	}
+	mu.Unlock()
+	if diff := cmp.Diff([]*base.TaskMessage{m2}, h.GetEnqueuedMessages(t, r)); diff != "" {
+		t.Errorf("mismatch found in %q while paused; (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+
+	p.resume()
+	time.Sleep(2 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want = append(want, NewTask(m2.Type, m2.Payload))
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks after resume; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorTruncatesErrorMsg(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	hugeErr := strings.Repeat("x", 10000)
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		return errors.New(hugeErr)
+	})
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	gotRetry := h.GetRetryMessages(t, r)
+	if len(gotRetry) != 1 {
+		t.Fatalf("%q has %d tasks, want 1", base.RetryQueue, len(gotRetry))
+	}
+	want := hugeErr[:defaultMaxErrorLength] + truncatedMarker
+	if gotRetry[0].ErrorMsg != want {
+		t.Errorf("stored error message has length %d, want %d with %q marker",
+			len(gotRetry[0].ErrorMsg), len(want), truncatedMarker)
+	}
+}
+
+func TestErrorMsg(t *testing.T) {
+	tests := []struct {
+		maxErrorLength int
+		err            error
+		want           string
+	}{
+		{10, errors.New("short"), "short"},
+		{5, errors.New("exactly"[:5]), "exact"},
+		{4, errors.New("too long"), "too " + truncatedMarker},
+		// Note: "é" is two bytes, and is not cut in the middle.
+		{2, errors.New("aé"), "a" + truncatedMarker},
+	}
+
+	for _, tc := range tests {
+		p := &processor{maxErrorLength: tc.maxErrorLength}
+		if got := p.errorMsg(tc.err); got != tc.want {
+			t.Errorf("errorMsg(%q) with maxErrorLength %d = %q, want %q",
+				tc.err, tc.maxErrorLength, got, tc.want)
+		}
+	}
+}
+
+func TestProcessorBatch(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, h.NewTaskMessageWithQueue("record_event", map[string]interface{}{"n": float64(i)}, "events"))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs, "events")
+
+	var mu sync.Mutex
+	var batchSizes []int
+	batchHandler := BatchHandlerFunc(func(tasks []*Task) []error {
+		mu.Lock()
+		defer mu.Unlock()
+		batchSizes = append(batchSizes, len(tasks))
+		errs := make([]error, len(tasks))
+		for i, task := range tasks {
+			if n, _ := task.Payload.GetInt("n"); n%2 == 1 {
+				errs[i] = fmt.Errorf("could not record event %d", n)
+			}
+		}
+		return errs
+	})
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         map[string]uint{"events": 1},
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		batches:        map[string]Batch{"events": {Handler: batchHandler, Size: 10}},
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		t.Errorf("handler called with task %+v, want batch handler to be called", task)
+		return nil
+	})
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]int{5}, batchSizes); diff != "" {
+		t.Errorf("mismatch found in batch sizes; (-want, +got)\n%s", diff)
+	}
+	// tasks 1 and 3 failed and should be retried.
+	gotRetry := h.GetRetryMessages(t, r)
+	var gotFailed []string
+	for _, m := range gotRetry {
+		gotFailed = append(gotFailed, m.ErrorMsg)
+	}
+	sort.Strings(gotFailed)
+	wantFailed := []string{"could not record event 1", "could not record event 3"}
+	if diff := cmp.Diff(wantFailed, gotFailed); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+	if l := r.LLen(base.QueueKey("events")).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.QueueKey("events"), l)
+	}
+}
+
+func TestPerformBatch(t *testing.T) {
+	tasks := []*Task{NewTask("a", nil), NewTask("b", nil)}
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		desc    string
+		handler BatchHandlerFunc
+		want    []error
+	}{
+		{
+			desc:    "returns errors of handler",
+			handler: func(tasks []*Task) []error { return []error{nil, errFailed} },
+			want:    []error{nil, errFailed},
+		},
+		{
+			desc:    "fails all tasks on wrong number of results",
+			handler: func(tasks []*Task) []error { return nil },
+			want: []error{
+				errors.New("batch handler returned 0 results for 2 tasks"),
+				errors.New("batch handler returned 0 results for 2 tasks"),
+			},
+		},
+	}
+
+	errStringOpt := cmp.Comparer(func(x, y error) bool {
+		if x == nil || y == nil {
+			return x == y
+		}
+		return x.Error() == y.Error()
+	})
+	for _, tc := range tests {
+		got := performBatch(tc.handler, tasks)
+		if diff := cmp.Diff(tc.want, got, errStringOpt); diff != "" {
+			t.Errorf("%s: performBatch() = %v, want %v; (-want, +got)\n%s", tc.desc, got, tc.want, diff)
+		}
+	}
+
+	got := performBatch(BatchHandlerFunc(func(tasks []*Task) []error { panic("oops") }), tasks)
+	for i, err := range got {
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "oops" {
+			t.Errorf("performBatch() with panicking handler returned %v for task %d, want PanicError", err, i)
+		}
+	}
+}
+
+func TestProcessorCircuitBreaker(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	clock := base.NewSimulatedClock(time.Now())
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, h.NewTaskMessage("charge", map[string]interface{}{"n": float64(i)}))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	var mu sync.Mutex
+	var processed int
+	healthy := false
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Hour },
+		circuitBreakers: map[string]CircuitBreaker{
+			"default": {FailureRate: 0.5, MinTasks: 3, CoolDown: time.Minute},
+		},
+		clock: clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed++
+		if !healthy {
+			return fmt.Errorf("service unavailable")
+		}
+		return nil
+	})
+	p.start()
+	defer p.terminate()
+
+	time.Sleep(2 * time.Second)
+	mu.Lock()
+	// Note: A task may have been pulled out before the breaker tripped.
+	if processed < 3 || processed > 4 {
+		t.Errorf("processed %d tasks with sustained failures, want the breaker to trip after 3 tasks", processed)
+	}
+	healthy = true
+	wantEnqueued := int64(len(msgs) - processed)
+	mu.Unlock()
+	if l := r.LLen(base.DefaultQueue).Val(); l != wantEnqueued {
+		t.Errorf("%q has %d tasks while the breaker is open, want %d", base.DefaultQueue, l, wantEnqueued)
+	}
+
+	// After the cool-down, a successful probe closes the breaker.
+	clock.AdvanceTime(time.Minute)
+	time.Sleep(3 * time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != 10 {
+		t.Errorf("processed %d tasks after recovery, want 10", processed)
+	}
+	if l := r.LLen(base.DefaultQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks after recovery, want 0", base.DefaultQueue, l)
+	}
+}
+
+func TestProcessorMaxAttempts(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	var mu sync.Mutex
+	var calls int
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return 0 },
+		retryDecider: func(task *Task, err error, retried, maxRetry int) Decision {
+			return Snooze
+		},
+		maxAttempts: 3,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return fmt.Errorf("not ready yet")
+	})
+	// scheduler sends the snoozed task back to the queue.
+	s := newScheduler(rdbClient, 100*time.Millisecond, defaultQueueConfig)
+	s.start()
+	p.start()
+	time.Sleep(5 * time.Second)
+	p.terminate()
+	s.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 3 {
+		t.Errorf("handler was called %d times, want 3", calls)
+	}
+	gotDead := h.GetDeadMessages(t, r)
+	if len(gotDead) != 1 || gotDead[0].ID != m1.ID || gotDead[0].Attempts != 3 {
+		t.Fatalf("%q has %+v, want task %v with 3 attempts", base.DeadQueue, gotDead, m1.ID)
+	}
+	wantErr := "task has been processed 3 times, exceeding the max attempts of 3"
+	if gotDead[0].ErrorMsg != wantErr {
+		t.Errorf("dead task has error message %q, want %q", gotDead[0].ErrorMsg, wantErr)
+	}
+}
+
+func TestProcessorPollTimeout(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		pollInterval time.Duration
+		wantTimeout  time.Duration
+		wantSpread   time.Duration // min difference between the min and max jitter
+	}{
+		{0, time.Second, 250 * time.Millisecond},
+		{100 * time.Millisecond, time.Second, 25 * time.Millisecond},
+		{1500 * time.Millisecond, 2 * time.Second, 375 * time.Millisecond},
+		{4 * time.Second, 4 * time.Second, time.Second},
+	}
+
+	for _, tc := range tests {
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			pollInterval:   tc.pollInterval,
+		})
+		if got := p.pollTimeout(); got != tc.wantTimeout {
+			t.Errorf("pollTimeout() with pollInterval %v = %v, want %v",
+				tc.pollInterval, got, tc.wantTimeout)
+		}
+		if got := p.pollTimeout() % time.Second; got != 0 {
+			t.Errorf("pollTimeout() with pollInterval %v has a fraction of a second %v, want whole seconds",
+				tc.pollInterval, got)
+		}
+		maxJitter := p.pollInterval / 2
+		min, max := maxJitter, time.Duration(0)
+		for i := 0; i < 1000; i++ {
+			got := p.pollJitter()
+			if got < 0 || got >= maxJitter {
+				t.Errorf("pollJitter() with pollInterval %v = %v, want in [0, %v)",
+					tc.pollInterval, got, maxJitter)
+			}
+			if got < min {
+				min = got
+			}
+			if got > max {
+				max = got
+			}
+		}
+		if max-min < tc.wantSpread {
+			t.Errorf("pollJitter() with pollInterval %v spread over [%v, %v] in 1000 calls, want a spread of at least %v",
+				tc.pollInterval, min, max, tc.wantSpread)
+		}
+	}
+}
+
+func TestProcessorQueueHandlers(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessageWithQueue("send_email", nil, "emails")
+	m2 := h.NewTaskMessageWithQueue("resize", nil, "images")
+	m3 := h.NewTaskMessageWithQueue("sync", nil, "default")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1}, "emails")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m2}, "images")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m3}, "default")
+
+	var mu sync.Mutex
+	processed := make(map[string][]string) // handler name -> task types
+	newHandler := func(name string) Handler {
+		return HandlerFunc(func(task *Task) error {
+			mu.Lock()
+			defer mu.Unlock()
+			processed[name] = append(processed[name], task.Type)
+			return nil
+		})
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         map[string]uint{"emails": 1, "images": 1, "default": 1},
+		retryDelayFunc: defaultDelayFunc,
+		queueHandlers: map[string]Handler{
+			"emails": newHandler("emails"),
+			"images": newHandler("images"),
+		},
+	})
+	p.handler = newHandler("default")
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := map[string][]string{
+		"emails":  {"send_email"},
+		"images":  {"resize"},
+		"default": {"sync"},
+	}
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+}
+
 func TestProcessorRetry(t *testing.T) {
 	r := setup(t)
 	rdbClient := rdb.NewRDB(r)
@@ -106,12 +707,15 @@ func TestProcessorRetry(t *testing.T) {
 	r2 := *m2
 	r2.ErrorMsg = errMsg
 	r2.Retried = m2.Retried + 1
+	r2.Attempts = m2.Attempts + 1
 	r3 := *m3
 	r3.ErrorMsg = errMsg
 	r3.Retried = m3.Retried + 1
+	r3.Attempts = m3.Attempts + 1
 	r4 := *m4
 	r4.ErrorMsg = errMsg
 	r4.Retried = m4.Retried + 1
+	r4.Attempts = m4.Attempts + 1
 
 	now := time.Now()
 
@@ -124,58 +728,2683 @@ func TestProcessorRetry(t *testing.T) {
 		wantDead  []*base.TaskMessage // tasks in dead queue at the end
 	}{
 		{
-			enqueued: []*base.TaskMessage{m1, m2},
-			incoming: []*base.TaskMessage{m3, m4},
-			delay:    time.Minute,
-			wait:     time.Second,
-			wantRetry: []h.ZSetEntry{
-				{Msg: &r2, Score: float64(now.Add(time.Minute).Unix())},
-				{Msg: &r3, Score: float64(now.Add(time.Minute).Unix())},
-				{Msg: &r4, Score: float64(now.Add(time.Minute).Unix())},
-			},
-			wantDead: []*base.TaskMessage{&r1},
+			enqueued: []*base.TaskMessage{m1, m2},
+			incoming: []*base.TaskMessage{m3, m4},
+			delay:    time.Minute,
+			wait:     time.Second,
+			wantRetry: []h.ZSetEntry{
+				{Msg: &r2, Score: float64(now.Add(time.Minute).Unix())},
+				{Msg: &r3, Score: float64(now.Add(time.Minute).Unix())},
+				{Msg: &r4, Score: float64(now.Add(time.Minute).Unix())},
+			},
+			wantDead: []*base.TaskMessage{&r1},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)                        // clean up db before each test case.
+		h.SeedEnqueuedQueue(t, r, tc.enqueued) // initialize default queue.
+
+		// instantiate a new processor
+		delayFunc := func(n int, e error, t *Task) time.Duration {
+			return tc.delay
+		}
+		handler := func(task *Task) error {
+			return fmt.Errorf(errMsg)
+		}
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: delayFunc,
+		})
+		p.handler = HandlerFunc(handler)
+
+		p.start()
+		for _, msg := range tc.incoming {
+			err := rdbClient.Enqueue(msg)
+			if err != nil {
+				p.terminate()
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(tc.wait)
+		p.terminate()
+
+		cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+		gotRetry := h.GetRetryEntries(t, r)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+		}
+
+		gotDead := h.GetDeadMessages(t, r)
+		ignoreOpt := cmpopts.IgnoreFields(base.TaskMessage{}, "DiedAt") // time of death is tested in rdb package
+		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt, ignoreOpt); diff != "" {
+			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.DeadQueue, diff)
+		}
+
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestProcessorRetryWithSimulatedClock(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	clock := base.NewSimulatedClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	rdbClient.SetClock(clock)
+	rdbClient.SetServerClock(clock)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	delay := 10 * time.Minute
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return delay },
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	retryAt := clock.Now().Add(delay)
+	wantRetry := []h.ZSetEntry{
+		{
+			Msg:   &base.TaskMessage{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: "something went wrong", FailedAt: clock.Now().Unix()},
+			Score: float64(retryAt.Unix()),
+		},
+	}
+	if diff := cmp.Diff(wantRetry, h.GetRetryEntries(t, r)); diff != "" {
+		t.Fatalf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+
+	// The task should stay in the retry queue until the clock reaches retryAt.
+	clock.AdvanceTime(delay - time.Second)
+	if err := rdbClient.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.GetRetryMessages(t, r)); n != 1 {
+		t.Errorf("%q has %d tasks before retry time, want 1", base.RetryQueue, n)
+	}
+
+	clock.SetTime(retryAt)
+	if err := rdbClient.CheckAndEnqueue(base.DefaultQueueName); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.GetRetryMessages(t, r)); n != 0 {
+		t.Errorf("%q has %d tasks at retry time, want 0", base.RetryQueue, n)
+	}
+	gotEnqueued := h.GetEnqueuedMessages(t, r)
+	if len(gotEnqueued) != 1 || gotEnqueued[0].ID != m1.ID {
+		t.Errorf("%q has %v, want task %v", base.DefaultQueue, gotEnqueued, m1.ID)
+	}
+}
+
+func TestProcessorWeightedConcurrency(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	weights := map[string]int64{"render_video": 3, "send_email": 1}
+	var msgs []*base.TaskMessage
+	for i := 0; i < 4; i++ {
+		for typename, w := range weights {
+			m := h.NewTaskMessage(typename, nil)
+			m.Weight = w
+			msgs = append(msgs, m)
+		}
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	const capacity = 4
+	var (
+		mu        sync.Mutex
+		inflight  int64
+		maxWeight int64
+		processed int
+	)
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    capacity,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		inflight += weights[task.Type]
+		if inflight > maxWeight {
+			maxWeight = inflight
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		inflight -= weights[task.Type]
+		processed++
+		mu.Unlock()
+		return nil
+	})
+
+	p.start()
+	time.Sleep(2 * time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != len(msgs) {
+		t.Errorf("processed %d tasks, want %d", processed, len(msgs))
+	}
+	if maxWeight > capacity {
+		t.Errorf("max total weight of concurrently processed tasks = %d, want at most %d", maxWeight, capacity)
+	}
+	if maxWeight < capacity {
+		t.Errorf("max total weight of concurrently processed tasks = %d, want the capacity %d to be used", maxWeight, capacity)
+	}
+}
+
+func TestProcessorRetryOnQueue(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("sync_inventory", nil)
+	m2 := h.NewTaskMessage("sync_orders", nil)
+	m3 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         map[string]uint{"default": 2, "low": 1},
+		retryDelayFunc: defaultDelayFunc,
+	})
+	errDependency := errors.New("dependency is down")
+	p.handler = HandlerFunc(func(task *Task) error {
+		switch task.Type {
+		case "sync_inventory":
+			return RetryOnQueue("Low", errDependency)
+		case "sync_orders":
+			return RetryOnQueue("unknown", errDependency) // not processed
+		default:
+			return errDependency
+		}
+	})
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := map[string]string{ // task type -> queue
+		"sync_inventory": "low",
+		"sync_orders":    base.DefaultQueueName,
+		"send_email":     base.DefaultQueueName,
+	}
+	got := make(map[string]string)
+	for _, msg := range h.GetRetryMessages(t, r) {
+		got[msg.Type] = msg.Queue
+		if msg.ErrorMsg != errDependency.Error() {
+			t.Errorf("ErrorMsg of task %q = %q, want %q", msg.Type, msg.ErrorMsg, errDependency.Error())
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("queues of retried tasks mismatch; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorMalformedTask(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	const garbage = "{not a task message"
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+	if err := r.LPush(base.DefaultQueue, garbage).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var reported []string
+	var processed []string
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		onMalformedTask: func(data []byte, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				t.Errorf("OnMalformedTask called with nil error")
+			}
+			reported = append(reported, string(data))
+		},
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task.Type)
+		return nil
+	})
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{garbage}, reported); diff != "" {
+		t.Errorf("reported malformed messages mismatch; (-want, +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{m1.Type}, processed); diff != "" {
+		t.Errorf("processed tasks mismatch; (-want, +got)\n%s", diff)
+	}
+	if got := r.ZRange(base.MalformedQueue, 0, -1).Val(); !cmp.Equal([]string{garbage}, got) {
+		t.Errorf("%q has %v, want %v", base.MalformedQueue, got, []string{garbage})
+	}
+	for _, key := range []string{base.DefaultQueue, base.InProgressQueue} {
+		if n := r.LLen(key).Val(); n != 0 {
+			t.Errorf("%q has %d messages, want 0", key, n)
+		}
+	}
+	if n := r.ZCard(base.RetryQueue).Val(); n != 0 {
+		t.Errorf("%q has %d messages, want 0", base.RetryQueue, n)
+	}
+}
+
+func TestProcessorNewerMessageVersion(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	// A message written by a newer client, e.g. during a rolling upgrade.
+	newer := h.NewTaskMessage("send_email", nil)
+	newer.Version = base.MessageVersion + 1
+	data, err := json.Marshal(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LPush(base.DefaultQueue, data).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := make(chan error, 1)
+	processed := make(chan string, 1)
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		onMalformedTask: func(data []byte, err error) {
+			reported <- err
+		},
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		processed <- task.Type
+		return nil
+	})
+
+	p.start()
+	select {
+	case err := <-reported:
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("OnMalformedTask called with %v, want ErrUnsupportedVersion", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("OnMalformedTask was not called for the message of a newer version")
+	}
+	p.terminate()
+
+	select {
+	case typename := <-processed:
+		t.Errorf("processed %q of a newer version, want it not to be processed", typename)
+	default:
+	}
+	if got := r.ZRange(base.MalformedQueue, 0, -1).Val(); !cmp.Equal([]string{string(data)}, got) {
+		t.Errorf("%q has %v, want the message of a newer version", base.MalformedQueue, got)
+	}
+	for _, key := range []string{base.DefaultQueue, base.InProgressQueue} {
+		if n := r.LLen(key).Val(); n != 0 {
+			t.Errorf("%q has %d messages, want 0", key, n)
+		}
+	}
+}
+
+func TestProcessorRetryPastDeadline(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := base.NewSimulatedClock(now)
+	rdbClient.SetClock(clock)
+
+	m1 := h.NewTaskMessage("send_reminder", nil)
+	m1.Deadline = now.Add(30 * time.Second).Unix() // retry in a minute is too late
+	m2 := h.NewTaskMessage("send_email", nil)
+	m2.Deadline = now.Add(time.Hour).Unix()
+	m3 := h.NewTaskMessage("reindex", nil) // no deadline
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	var retried []string
+	for _, msg := range h.GetRetryMessages(t, r) {
+		retried = append(retried, msg.Type)
+	}
+	sort.Strings(retried)
+	if diff := cmp.Diff([]string{m3.Type, m2.Type}, retried); diff != "" {
+		t.Errorf("retried tasks mismatch; (-want, +got)\n%s", diff)
+	}
+	dead := h.GetDeadMessages(t, r)
+	if len(dead) != 1 || dead[0].ID != m1.ID {
+		t.Fatalf("%q has %v, want only the task %v", base.DeadQueue, dead, m1.ID)
+	}
+	if !strings.Contains(dead[0].ErrorMsg, "deadline") {
+		t.Errorf("ErrorMsg of the dead task = %q, want it to mention the deadline", dead[0].ErrorMsg)
+	}
+}
+
+func TestProcessorOnRetry(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	clock := base.NewSimulatedClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	rdbClient.SetClock(clock)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("reindex", nil)
+	m2.Retried = 3
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2})
+
+	// exponential backoff in minutes.
+	delayFunc := func(n int, e error, t *Task) time.Duration {
+		return time.Duration(1<<uint(n)) * time.Minute
+	}
+	var mu sync.Mutex
+	reported := make(map[string]time.Duration) // task type -> delay
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: delayFunc,
+		onRetry: func(task *Task, delay time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported[task.Type] = delay
+		},
+		clock: clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := map[string]time.Duration{
+		m1.Type: delayFunc(m1.Retried, nil, nil),
+		m2.Type: delayFunc(m2.Retried, nil, nil),
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, reported); diff != "" {
+		t.Errorf("delays reported by OnRetry mismatch; (-want, +got)\n%s", diff)
+	}
+
+	tasks, err := rdbClient.ListRetry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]time.Duration)
+	for _, task := range tasks {
+		if !task.LastFailedAt.Equal(clock.Now()) {
+			t.Errorf("LastFailedAt of task %q = %v, want %v", task.Type, task.LastFailedAt, clock.Now())
+		}
+		got[task.Type] = task.Delay
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("delays reported by (*RDB).ListRetry mismatch; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorRetryDecider(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	errMsg := "something went wrong"
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.Retried = m1.Retry // m1 has reached its max retry count
+
+	tests := []struct {
+		desc          string
+		decision      Decision
+		wantRetry     []*base.TaskMessage
+		wantDead      []*base.TaskMessage
+		wantScheduled []*base.TaskMessage
+	}{
+		{
+			desc:      "Retry takes precedence over max retry count",
+			decision:  Retry,
+			wantRetry: []*base.TaskMessage{{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: m1.Retried + 1, Attempts: 1, ErrorMsg: errMsg}},
+		},
+		{
+			desc:     "Kill",
+			decision: Kill,
+			wantDead: []*base.TaskMessage{{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: m1.Retried, ErrorMsg: errMsg}},
+		},
+		{
+			desc:          "Snooze",
+			decision:      Snooze,
+			wantScheduled: []*base.TaskMessage{{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: m1.Retried, Attempts: 1}},
+		},
+		{
+			desc:     "Drop",
+			decision: Drop,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		type args struct {
+			task              *Task
+			err               error
+			retried, maxRetry int
+		}
+		var called []args
+		var mu sync.Mutex
+		decider := func(task *Task, err error, retried, maxRetry int) Decision {
+			mu.Lock()
+			defer mu.Unlock()
+			called = append(called, args{task, err, retried, maxRetry})
+			return tc.decision
+		}
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			retryDecider:   decider,
+		})
+		p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf(errMsg) })
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		if len(called) != 1 {
+			t.Errorf("%s: decider called %d times, want 1", tc.desc, len(called))
+		} else if c := called[0]; c.task.Type != m1.Type || c.err.Error() != errMsg || c.retried != m1.Retried || c.maxRetry != m1.Retry {
+			t.Errorf("%s: decider called with (%v, %v, %d, %d), want (%v, %q, %d, %d)",
+				tc.desc, c.task, c.err, c.retried, c.maxRetry, m1.Type, errMsg, m1.Retried, m1.Retry)
+		}
+
+		ignoreOpt := cmpopts.IgnoreFields(base.TaskMessage{}, "DiedAt", "ServerID", "FailedAt")
+		for key, want := range map[string][]*base.TaskMessage{
+			base.RetryQueue:     tc.wantRetry,
+			base.DeadQueue:      tc.wantDead,
+			base.ScheduledQueue: tc.wantScheduled,
+		} {
+			got := h.MustUnmarshalSlice(t, r.ZRange(key, 0, -1).Val())
+			if diff := cmp.Diff(want, got, ignoreOpt, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s: mismatch found in %q after running processor; (-want, +got)\n%s", tc.desc, key, diff)
+			}
+		}
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%s: %q has %d tasks, want 0", tc.desc, base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestProcessorDedupWindow(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	msg := h.NewTaskMessage("send_email", nil)
+
+	var mu sync.Mutex
+	var processed int
+	p := newProcessor(processorParams{
+		rdb:         rdbClient,
+		concurrency: 10,
+		queues:      defaultQueueConfig,
+		dedupWindow: time.Hour,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed++
+		return nil
+	})
+	p.start()
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{msg})
+	time.Sleep(time.Second)
+
+	// The same task dequeued again, e.g. after restored, is skipped.
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{msg})
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != 1 {
+		t.Errorf("handler called %d times with the same task, want 1", processed)
+	}
+	if l := r.LLen(base.DefaultQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DefaultQueue, l)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+	if got := p.stats().Succeeded; got != 1 {
+		t.Errorf("Succeeded = %d, want 1", got)
+	}
+}
+
+func TestProcessorQueueRetryDelays(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	critical := h.NewTaskMessageWithQueue("send_email", nil, "critical")
+	bulk := h.NewTaskMessageWithQueue("send_email", nil, "bulk")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{critical}, "critical")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{bulk}, "bulk")
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         map[string]uint{"critical": 1, "bulk": 1},
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Hour },
+		queueRetryDelays: map[string]retryDelayFunc{
+			"critical": func(n int, e error, t *Task) time.Duration { return time.Minute },
+		},
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+	now := time.Now()
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := map[string]time.Duration{"critical": time.Minute, "bulk": time.Hour}
+	got := make(map[string]time.Duration)
+	for _, e := range h.GetRetryEntries(t, r) {
+		got[e.Msg.Queue] = time.Unix(int64(e.Score), 0).Sub(now).Round(time.Minute)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch found in retry delays by queue; (-want,+got)\n%s", diff)
+	}
+}
+
+// fakeMetrics counts the calls of each method per task type.
+type fakeMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *fakeMetrics) inc(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key]++
+}
+
+func (m *fakeMetrics) TaskProcessed(queue, tasktype string) { m.inc("processed:" + tasktype) }
+func (m *fakeMetrics) TaskFailed(queue, tasktype string)    { m.inc("failed:" + tasktype) }
+func (m *fakeMetrics) TaskRetried(queue, tasktype string)   { m.inc("retried:" + tasktype) }
+func (m *fakeMetrics) TaskKilled(queue, tasktype string)    { m.inc("killed:" + tasktype) }
+func (m *fakeMetrics) TaskDuration(queue, tasktype string, d time.Duration) {
+	m.inc("duration:" + tasktype)
+}
+
+func TestProcessorMetrics(t *testing.T) {
+	r := setup(t)
+	succeed := h.NewTaskMessage("succeed", nil)
+	retry := h.NewTaskMessage("retry", nil)
+	retry.Retry = 5
+	kill := h.NewTaskMessage("kill", nil)
+	kill.Retry = 0
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{succeed, retry, kill})
+
+	metrics := &fakeMetrics{counts: make(map[string]int)}
+	p := newProcessor(processorParams{
+		rdb:            rdb.NewRDB(r),
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Hour },
+		metrics:        metrics,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		if task.Type == "succeed" {
+			return nil
+		}
+		return fmt.Errorf("something went wrong")
+	})
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := map[string]int{
+		"processed:succeed": 1,
+		"duration:succeed":  1,
+		"failed:retry":      1,
+		"retried:retry":     1,
+		"duration:retry":    1,
+		"failed:kill":       1,
+		"killed:kill":       1,
+		"duration:kill":     1,
+	}
+	if diff := cmp.Diff(want, metrics.counts); diff != "" {
+		t.Errorf("mismatch found in metrics; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestProcessorDeadTaskExporter(t *testing.T) {
+	r := setup(t)
+	for _, async := range []bool{false, true} {
+		h.FlushDB(t, r)
+		msg := h.NewTaskMessage("send_email", map[string]interface{}{"user_id": 42.0})
+		msg.Retry = 3
+		msg.Retried = 3
+		msg.ErrorMsg = "smtp timeout"
+		msg.EnqueuedAt = time.Now().Add(-time.Hour).UnixNano()
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{msg})
+
+		var buf bytes.Buffer
+		p := newProcessor(processorParams{
+			rdb:            rdb.NewRDB(r),
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			exporter:       NewJSONExporter(&buf),
+			exportAsync:    async,
+		})
+		p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("smtp refused") })
+		start := time.Now()
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		var got []*DeadTask
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var dt DeadTask
+			if err := dec.Decode(&dt); err != nil {
+				t.Fatalf("async=%t: could not decode exported task: %v", async, err)
+			}
+			got = append(got, &dt)
+		}
+		if len(got) != 1 {
+			t.Fatalf("async=%t: exported %d tasks, want 1", async, len(got))
+		}
+		want := &DeadTask{
+			ID:           msg.ID.String(),
+			Type:         "send_email",
+			Payload:      map[string]interface{}{"user_id": 42.0},
+			Queue:        base.DefaultQueueName,
+			Retried:      3,
+			ErrorMsg:     "smtp refused",
+			ErrorHistory: []string{"smtp timeout"},
+			EnqueuedAt:   time.Unix(0, msg.EnqueuedAt),
+		}
+		opt := cmpopts.IgnoreFields(DeadTask{}, "DiedAt", "Message")
+		if diff := cmp.Diff(want, got[0], opt); diff != "" {
+			t.Errorf("async=%t: mismatch found in exported task; (-want,+got)\n%s", async, diff)
+		}
+		if d := got[0].DiedAt; d.Before(start.Truncate(time.Second)) || d.After(time.Now()) {
+			t.Errorf("async=%t: DiedAt = %v, want between %v and now", async, d, start)
+		}
+		dead := h.GetDeadMessages(t, r)
+		if len(dead) != 1 {
+			t.Fatalf("async=%t: dead queue has %d tasks, want 1", async, len(dead))
+		}
+		var exported base.TaskMessage
+		if err := json.Unmarshal(got[0].Message, &exported); err != nil {
+			t.Fatalf("async=%t: could not decode exported message: %v", async, err)
+		}
+		if diff := cmp.Diff(dead[0], &exported); diff != "" {
+			t.Errorf("async=%t: exported message differs from the dead task; (-want,+got)\n%s", async, diff)
+		}
+	}
+}
+
+func TestProcessorRetryPriorityBoost(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		desc      string
+		boost     int
+		wantFirst string // type of the task dequeued first after the retry
+	}{
+		{desc: "without boost", boost: 0, wantFirst: "fresh"},
+		{desc: "with boost", boost: 10, wantFirst: "retried"},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("retried", nil)})
+
+		p := newProcessor(processorParams{
+			rdb:                rdbClient,
+			concurrency:        10,
+			queues:             defaultQueueConfig,
+			retryDelayFunc:     func(n int, e error, t *Task) time.Duration { return 0 },
+			retryPriorityBoost: tc.boost,
+		})
+		p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		retried := h.GetRetryMessages(t, r)
+		if len(retried) != 1 || retried[0].Priority != tc.boost {
+			t.Errorf("%s: retry queue has %v, want a task with priority %d", tc.desc, retried, tc.boost)
+			continue
+		}
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{h.NewTaskMessage("fresh", nil)})
+		if err := rdbClient.CheckAndEnqueue(); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := rdbClient.Dequeue("default")
+		if err != nil {
+			t.Fatalf("%s: (*RDB).Dequeue(%q) returned error: %v", tc.desc, "default", err)
+		}
+		if msg.Type != tc.wantFirst {
+			t.Errorf("%s: first task dequeued after the retry is %q, want %q", tc.desc, msg.Type, tc.wantFirst)
+		}
+	}
+}
+
+type temporaryError struct{}
+
+func (e *temporaryError) Error() string   { return "connection reset" }
+func (e *temporaryError) Temporary() bool { return true }
+
+type validationError struct{}
+
+func (e *validationError) Error() string { return "invalid payload" }
+
+func TestProcessorErrorClassification(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	m2.Retried = m2.Retry // m2 has reached its max retry count
+	retried := func(errMsg string) []*base.TaskMessage {
+		return []*base.TaskMessage{{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: errMsg}}
+	}
+	killed := func(msg *base.TaskMessage, errMsg string) []*base.TaskMessage {
+		return []*base.TaskMessage{{ID: msg.ID, Type: msg.Type, Queue: msg.Queue, Retry: msg.Retry, Retried: msg.Retried, ErrorMsg: errMsg}}
+	}
+	// validationError is permanent, and errors with "retryable" in the
+	// message are retryable even if they wrap ErrPermanent.
+	classifiers := []func(error) ErrorClass{
+		func(err error) ErrorClass {
+			var e *validationError
+			if errors.As(err, &e) {
+				return Permanent
+			}
+			return Unclassified
+		},
+		func(err error) ErrorClass {
+			if strings.Contains(err.Error(), "retryable") {
+				return Retryable
+			}
+			return Unclassified
+		},
+	}
+
+	tests := []struct {
+		desc      string
+		msg       *base.TaskMessage
+		err       error
+		wantRetry []*base.TaskMessage
+		wantDead  []*base.TaskMessage
+	}{
+		{
+			desc:      "temporary error is retried",
+			msg:       m1,
+			err:       fmt.Errorf("could not send email: %w", &temporaryError{}),
+			wantRetry: retried("could not send email: connection reset"),
+		},
+		{
+			desc:     "temporary error is not retried past max retry count",
+			msg:      m2,
+			err:      &temporaryError{},
+			wantDead: killed(m2, "connection reset"),
+		},
+		{
+			desc:     "error wrapping ErrPermanent is killed",
+			msg:      m1,
+			err:      fmt.Errorf("unknown recipient: %w", ErrPermanent),
+			wantDead: killed(m1, "unknown recipient: permanent error"),
+		},
+		{
+			desc:     "error classified as permanent is killed",
+			msg:      m1,
+			err:      fmt.Errorf("could not send email: %w", &validationError{}),
+			wantDead: killed(m1, "could not send email: invalid payload"),
+		},
+		{
+			desc:      "first classification takes precedence",
+			msg:       m1,
+			err:       fmt.Errorf("retryable: %w", ErrPermanent),
+			wantRetry: retried("retryable: permanent error"),
+		},
+		{
+			desc:      "unclassified error is retried",
+			msg:       m1,
+			err:       fmt.Errorf("something went wrong"),
+			wantRetry: retried("something went wrong"),
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{tc.msg})
+
+		p := newProcessor(processorParams{
+			rdb:              rdbClient,
+			concurrency:      10,
+			queues:           defaultQueueConfig,
+			retryDelayFunc:   defaultDelayFunc,
+			errorClassifiers: classifiers,
+		})
+		err := tc.err
+		p.handler = HandlerFunc(func(task *Task) error { return err })
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		ignoreOpt := cmpopts.IgnoreFields(base.TaskMessage{}, "DiedAt", "ServerID", "FailedAt")
+		for key, want := range map[string][]*base.TaskMessage{
+			base.RetryQueue: tc.wantRetry,
+			base.DeadQueue:  tc.wantDead,
+		} {
+			got := h.MustUnmarshalSlice(t, r.ZRange(key, 0, -1).Val())
+			if diff := cmp.Diff(want, got, ignoreOpt, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s: mismatch found in %q after running processor; (-want, +got)\n%s", tc.desc, key, diff)
+			}
+		}
+	}
+}
+
+type retryAfterError struct {
+	d time.Duration
+}
+
+func (e *retryAfterError) Error() string             { return "rate limited" }
+func (e *retryAfterError) RetryAfter() time.Duration { return e.d }
+
+func TestProcessorRetryAfter(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	// delay suggested by the error should be preferred over delayFunc.
+	delayFunc := func(n int, e error, t *Task) time.Duration {
+		return time.Minute
+	}
+	handler := func(task *Task) error {
+		return fmt.Errorf("could not call api: %w", &retryAfterError{time.Hour})
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: delayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	now := time.Now()
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	r1 := *m1
+	r1.ErrorMsg = "could not call api: rate limited"
+	r1.Retried = m1.Retried + 1
+	r1.Attempts = m1.Attempts + 1
+	wantRetry := []h.ZSetEntry{
+		{Msg: &r1, Score: float64(now.Add(time.Hour).Unix())},
+	}
+	cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
+	gotRetry := h.GetRetryEntries(t, r)
+	if diff := cmp.Diff(wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+		t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+}
+
+func TestProcessorRetrySchedule(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	clock := base.NewSimulatedClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	rdbClient.SetClock(clock)
+
+	schedule := []string{"1m0s", "5m0s", "30m0s", "2h0m0s"}
+	tests := []struct {
+		retried   int
+		wantDelay time.Duration
+	}{
+		{0, time.Minute},
+		{2, 30 * time.Minute},
+		{3, 2 * time.Hour},
+		{10, 2 * time.Hour}, // beyond the schedule, the last delay is used
+	}
+	msgs := make([]*base.TaskMessage, len(tests))
+	for i, tc := range tests {
+		msgs[i] = h.NewTaskMessage("send_email", nil)
+		msgs[i].Retried = tc.retried
+		msgs[i].RetrySchedule = schedule
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	// schedule should be preferred over delayFunc.
+	delayFunc := func(n int, e error, t *Task) time.Duration {
+		return time.Second
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: delayFunc,
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	scores := make(map[string]float64) // task id -> retry score
+	for _, entry := range h.GetRetryEntries(t, r) {
+		scores[entry.Msg.ID.String()] = entry.Score
+	}
+	for i, tc := range tests {
+		want := float64(clock.Now().Add(tc.wantDelay).Unix())
+		if got, ok := scores[msgs[i].ID.String()]; !ok || got != want {
+			t.Errorf("retry score of task retried %d times = %v, want %v (delay of %v)",
+				tc.retried, got, want, tc.wantDelay)
+		}
+	}
+}
+
+func TestProcessorRequestRetry(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		desc      string
+		handler   HandlerFunc
+		wantRetry []*base.TaskMessage
+	}{
+		{
+			desc: "handler requested retry and returned nil",
+			handler: func(task *Task) error {
+				RequestRetry(task)
+				return nil
+			},
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: ErrRetryRequested.Error()},
+			},
+		},
+		{
+			desc:      "handler returned nil without requesting retry",
+			handler:   func(task *Task) error { return nil },
+			wantRetry: []*base.TaskMessage{},
+		},
+		{
+			desc: "handler requested retry and returned error",
+			handler: func(task *Task) error {
+				RequestRetry(task)
+				return fmt.Errorf("something went wrong")
+			},
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: "something went wrong"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+		})
+		p.handler = tc.handler
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		gotRetry := h.GetRetryMessages(t, r)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.RetryQueue, diff)
+		}
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%s: %q has %d tasks, want 0", tc.desc, base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestProcessorRequireAck(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		desc       string
+		requireAck bool
+		handler    HandlerFunc
+		wantRetry  []*base.TaskMessage
+	}{
+		{
+			desc:       "handler acked and returned nil",
+			requireAck: true,
+			handler: func(task *Task) error {
+				Ack(task)
+				return nil
+			},
+			wantRetry: []*base.TaskMessage{},
+		},
+		{
+			desc:       "handler returned nil without ack",
+			requireAck: true,
+			handler:    func(task *Task) error { return nil },
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: ErrNotAcked.Error()},
+			},
+		},
+		{
+			desc:       "handler acked and returned error",
+			requireAck: true,
+			handler: func(task *Task) error {
+				Ack(task)
+				return fmt.Errorf("something went wrong")
+			},
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: "something went wrong"},
+			},
+		},
+		{
+			desc:       "ack not required",
+			requireAck: false,
+			handler:    func(task *Task) error { return nil },
+			wantRetry:  []*base.TaskMessage{},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			requireAck:     tc.requireAck,
+		})
+		p.handler = tc.handler
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		gotRetry := h.GetRetryMessages(t, r)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.RetryQueue, diff)
+		}
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%s: %q has %d tasks, want 0", tc.desc, base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestProcessorAckNack(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	retried := func(errMsg string) []*base.TaskMessage {
+		return []*base.TaskMessage{
+			{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: errMsg},
+		}
+	}
+
+	tests := []struct {
+		desc      string
+		handler   HandlerFunc
+		wantRetry []*base.TaskMessage
+	}{
+		{
+			desc: "acked",
+			handler: func(task *Task) error {
+				Ack(task)
+				return nil
+			},
+			wantRetry: []*base.TaskMessage{},
+		},
+		{
+			desc: "nacked with reason",
+			handler: func(task *Task) error {
+				Nack(task, fmt.Errorf("upstream unavailable"))
+				return nil
+			},
+			wantRetry: retried("upstream unavailable"),
+		},
+		{
+			desc: "nacked without reason",
+			handler: func(task *Task) error {
+				Nack(task, nil)
+				return nil
+			},
+			wantRetry: retried(ErrNacked.Error()),
+		},
+		{
+			desc: "nacked then acked",
+			handler: func(task *Task) error {
+				Nack(task, fmt.Errorf("upstream unavailable"))
+				Ack(task)
+				return nil
+			},
+			wantRetry: []*base.TaskMessage{},
+		},
+		{
+			desc: "acked then nacked",
+			handler: func(task *Task) error {
+				Ack(task)
+				Nack(task, fmt.Errorf("upstream unavailable"))
+				return nil
+			},
+			wantRetry: retried("upstream unavailable"),
+		},
+		{
+			desc: "nacked and returned error",
+			handler: func(task *Task) error {
+				Nack(task, fmt.Errorf("upstream unavailable"))
+				return fmt.Errorf("something went wrong")
+			},
+			wantRetry: retried("something went wrong"),
+		},
+		{
+			desc:      "neither, returned nil",
+			handler:   func(task *Task) error { return nil },
+			wantRetry: []*base.TaskMessage{},
+		},
+		{
+			desc:      "neither, returned error",
+			handler:   func(task *Task) error { return fmt.Errorf("something went wrong") },
+			wantRetry: retried("something went wrong"),
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+		})
+		p.handler = tc.handler
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		gotRetry := h.GetRetryMessages(t, r)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.RetryQueue, diff)
+		}
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%s: %q has %d tasks, want 0", tc.desc, base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestProcessorSetResult(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("sync_contacts", nil)
+
+	tests := []struct {
+		desc          string
+		requireAck    bool
+		handler       HandlerFunc
+		wantRetry     []*base.TaskMessage
+		wantCompleted *rdb.TaskResult
+	}{
+		{
+			desc: "success with result payload",
+			handler: func(task *Task) error {
+				SetResult(task, ProcessResult{Status: StatusSuccess, Data: []byte(`{"synced":10}`)})
+				return nil
+			},
+			wantRetry:     []*base.TaskMessage{},
+			wantCompleted: &rdb.TaskResult{Status: "success", Data: []byte(`{"synced":10}`)},
+		},
+		{
+			desc: "success with warning",
+			handler: func(task *Task) error {
+				SetResult(task, ProcessResult{Status: StatusWarning, Message: "2 contacts skipped"})
+				return nil
+			},
+			wantRetry:     []*base.TaskMessage{},
+			wantCompleted: &rdb.TaskResult{Status: "warning", Message: "2 contacts skipped"},
+		},
+		{
+			desc: "partial completion",
+			handler: func(task *Task) error {
+				SetResult(task, ProcessResult{Status: StatusPartial, Message: "synced 8 of 10"})
+				return nil
+			},
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: "task partially completed: synced 8 of 10"},
+			},
+		},
+		{
+			desc: "error takes precedence over result",
+			handler: func(task *Task) error {
+				SetResult(task, ProcessResult{Status: StatusSuccess})
+				return fmt.Errorf("something went wrong")
+			},
+			wantRetry: []*base.TaskMessage{
+				{ID: m1.ID, Type: m1.Type, Queue: m1.Queue, Retry: m1.Retry, Retried: 1, Attempts: 1, ErrorMsg: "something went wrong"},
+			},
+		},
+		{
+			desc:       "result counts as ack",
+			requireAck: true,
+			handler: func(task *Task) error {
+				SetResult(task, ProcessResult{Status: StatusSuccess})
+				return nil
+			},
+			wantRetry:     []*base.TaskMessage{},
+			wantCompleted: &rdb.TaskResult{Status: "success"},
+		},
+		{
+			desc:          "error only handler",
+			handler:       func(task *Task) error { return nil },
+			wantRetry:     []*base.TaskMessage{},
+			wantCompleted: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			keepCompleted:  time.Hour,
+			requireAck:     tc.requireAck,
+		})
+		p.handler = tc.handler
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		gotRetry := h.GetRetryMessages(t, r)
+		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.RetryQueue, diff)
+		}
+		completed, err := rdbClient.ListCompleted()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tc.wantRetry) > 0 {
+			if len(completed) != 0 {
+				t.Errorf("%s: %d completed records, want 0", tc.desc, len(completed))
+			}
+			continue
+		}
+		if len(completed) != 1 {
+			t.Errorf("%s: %d completed records, want 1", tc.desc, len(completed))
+			continue
+		}
+		if diff := cmp.Diff(tc.wantCompleted, completed[0].Result); diff != "" {
+			t.Errorf("%s: mismatch found in the result of the completed task; (-want, +got)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestSetResultOutsideHandler(t *testing.T) {
+	task := NewTask("send_email", nil)
+	SetResult(task, ProcessResult{Status: StatusPartial}) // should be a no-op
+	if _, ok := taskResult(task); ok {
+		t.Errorf("SetResult recorded a result of a task which is not being processed")
+	}
+}
+
+func TestRequestRetryOutsideHandler(t *testing.T) {
+	task := NewTask("send_email", nil)
+	RequestRetry(task) // should be a no-op
+	if _, ok := taskStates.Load(task); ok {
+		t.Errorf("RequestRetry registered a task which is not being processed")
+	}
+}
+
+func TestProcessorRetryDeciderDetectsPanic(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("gen_thumbnail", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		retryDecider: func(task *Task, err error, retried, maxRetry int) Decision {
+			var perr *PanicError
+			if errors.As(err, &perr) {
+				return Kill // panics are bugs, retrying won't help.
+			}
+			return Retry
+		},
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		if task.Type == "send_email" {
+			panic("something went terribly wrong")
+		}
+		return fmt.Errorf("something went wrong")
+	})
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	gotDead := h.GetDeadMessages(t, r)
+	if len(gotDead) != 1 || gotDead[0].ID != m1.ID {
+		t.Errorf("%q has %v, want only the task whose handler panicked", base.DeadQueue, gotDead)
+	}
+	gotRetry := h.GetRetryMessages(t, r)
+	if len(gotRetry) != 1 || gotRetry[0].ID != m2.ID {
+		t.Errorf("%q has %v, want only the task whose handler returned an error", base.RetryQueue, gotRetry)
+	}
+}
+
+func TestProcessorUnhandledTask(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("unknown:type", nil)
+
+	tests := []struct {
+		desc           string
+		retryUnhandled bool
+		wantRetry      int // number of tasks in retry queue
+		wantDead       int // number of tasks in dead queue
+	}{
+		{
+			desc:           "kill unhandled task immediately by default",
+			retryUnhandled: false,
+			wantRetry:      0,
+			wantDead:       1,
+		},
+		{
+			desc:           "retry unhandled task if configured",
+			retryUnhandled: true,
+			wantRetry:      1,
+			wantDead:       0,
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+		mux := NewServeMux()
+		mux.HandleFunc("email:", func(task *Task) error { return nil })
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			retryUnhandled: tc.retryUnhandled,
+		})
+		p.handler = mux
+
+		p.start()
+		time.Sleep(time.Second)
+		p.terminate()
+
+		gotRetry := h.GetRetryMessages(t, r)
+		if len(gotRetry) != tc.wantRetry {
+			t.Errorf("%s: %q has %d tasks, want %d", tc.desc, base.RetryQueue, len(gotRetry), tc.wantRetry)
+		}
+		gotDead := h.GetDeadMessages(t, r)
+		if len(gotDead) != tc.wantDead {
+			t.Errorf("%s: %q has %d tasks, want %d", tc.desc, base.DeadQueue, len(gotDead), tc.wantDead)
+		}
+		for _, msg := range append(gotRetry, gotDead...) {
+			want := `handler not found for task type "unknown:type"`
+			if msg.ErrorMsg != want {
+				t.Errorf("%s: ErrorMsg = %q, want %q", tc.desc, msg.ErrorMsg, want)
+			}
+		}
+	}
+}
+
+func TestProcessorTypeConcurrency(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var enqueued []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("report:generate", nil))
+	}
+	for i := 0; i < 5; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("email:send", nil))
+	}
+	h.SeedEnqueuedQueue(t, r, enqueued)
+
+	var (
+		mu        sync.Mutex
+		slowCount int // number of slow tasks in progress
+		maxSlow   int // max number of slow tasks in progress at once
+		fastDone  int // number of fast tasks processed
+	)
+	done := make(chan struct{})
+	defer close(done)
+	handler := func(task *Task) error {
+		if task.Type == "email:send" {
+			mu.Lock()
+			fastDone++
+			mu.Unlock()
+			return nil
+		}
+		mu.Lock()
+		slowCount++
+		if slowCount > maxSlow {
+			maxSlow = slowCount
+		}
+		mu.Unlock()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		mu.Lock()
+		slowCount--
+		mu.Unlock()
+		return nil
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    2,
+		typeLimits:     map[string]int{"report:generate": 1},
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	gotFast, gotMaxSlow := fastDone, maxSlow
+	mu.Unlock()
+	if gotFast != 5 {
+		t.Errorf("processed %d fast tasks while slow tasks were running, want 5", gotFast)
+	}
+	if gotMaxSlow != 1 {
+		t.Errorf("max number of concurrent slow tasks = %d, want 1", gotMaxSlow)
+	}
+	done <- struct{}{} // let the running slow task finish
+	p.terminate()
+}
+
+func TestProcessorTypeLimitDoesNotDelayOtherTypes(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	// Note: Postponing the slow tasks behind the running one must not add
+	// up to a wait before the fast task is processed.
+	const numSlow = 40
+	for i := 0; i < numSlow; i++ {
+		if err := rdbClient.Enqueue(h.NewTaskMessage("report:generate", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rdbClient.Enqueue(h.NewTaskMessage("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	fastStarted := make(chan time.Time, 1)
+	handler := func(task *Task) error {
+		if task.Type == "send_email" {
+			fastStarted <- time.Now()
+			return nil
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		return nil
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    2,
+		prefetch:       10,
+		typeLimits:     map[string]int{"report:generate": 1},
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	start := time.Now()
+	p.start()
+	select {
+	case started := <-fastStarted:
+		if d, limit := started.Sub(start), numSlow*postponeBackoff/2; d > limit {
+			t.Errorf("fast task started %v after the start, want within %v", d, limit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("fast task was not processed while slow tasks were postponed")
+	}
+	close(done)
+	p.terminate()
+}
+
+func TestProcessorSerialKey(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var enqueued []*base.TaskMessage
+	for _, key := range []string{"account:1", "account:1", "account:1", "account:2", "account:2"} {
+		msg := h.NewTaskMessage("sync_account", map[string]interface{}{"key": key})
+		msg.SerialKey = key
+		enqueued = append(enqueued, msg)
+	}
+	h.SeedEnqueuedQueue(t, r, enqueued)
+
+	var (
+		mu        sync.Mutex
+		running   = make(map[string]int) // number of tasks in progress by key
+		maxPerKey int                    // max number of tasks of a key in progress at once
+		maxTotal  int                    // max number of tasks in progress at once
+		processed int
+	)
+	handler := func(task *Task) error {
+		key, err := task.Payload.GetString("key")
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		running[key]++
+		if running[key] > maxPerKey {
+			maxPerKey = running[key]
+		}
+		total := 0
+		for _, n := range running {
+			total += n
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		running[key]--
+		processed++
+		mu.Unlock()
+		return nil
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(2 * time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != len(enqueued) {
+		t.Errorf("processed %d tasks, want %d", processed, len(enqueued))
+	}
+	if maxPerKey != 1 {
+		t.Errorf("max number of concurrent tasks with the same key = %d, want 1", maxPerKey)
+	}
+	if maxTotal < 2 {
+		t.Errorf("max number of concurrent tasks = %d, want tasks of different keys to overlap", maxTotal)
+	}
+	for _, key := range []string{"account:1", "account:2"} {
+		if n := r.Exists(base.SerialKey(key)).Val(); n != 0 {
+			t.Errorf("lock of serial key %q is held after all tasks are processed", key)
+		}
+	}
+}
+
+func TestProcessorCategoryConcurrency(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var enqueued []*base.TaskMessage
+	for _, typename := range []string{"upload", "download", "sync", "upload", "download", "sync"} {
+		msg := h.NewTaskMessage(typename, nil)
+		msg.Category = "io-bound"
+		enqueued = append(enqueued, msg)
+	}
+	for i := 0; i < 3; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("resize", nil))
+	}
+	h.SeedEnqueuedQueue(t, r, enqueued)
+
+	var (
+		mu        sync.Mutex
+		running   = make(map[string]int) // number of tasks in progress by category
+		maxPerCat = make(map[string]int) // max number of tasks of a category in progress at once
+		processed int
+	)
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		categoryLimits: map[string]int{"io-bound": 2},
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		category := "none"
+		if task.Type != "resize" {
+			category = "io-bound"
+		}
+		mu.Lock()
+		running[category]++
+		if running[category] > maxPerCat[category] {
+			maxPerCat[category] = running[category]
+		}
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		running[category]--
+		processed++
+		mu.Unlock()
+		return nil
+	})
+
+	p.start()
+	time.Sleep(2 * time.Second)
+	stats := p.stats()
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != len(enqueued) {
+		t.Errorf("processed %d tasks, want %d", processed, len(enqueued))
+	}
+	if got := maxPerCat["io-bound"]; got != 2 {
+		t.Errorf("max number of concurrent tasks of the category = %d, want 2", got)
+	}
+	if got := maxPerCat["none"]; got < 2 {
+		t.Errorf("max number of concurrent tasks with no category = %d, want them not to be limited", got)
+	}
+	want := map[string]CategoryStats{"io-bound": {Processed: 6, Succeeded: 6}}
+	if diff := cmp.Diff(want, stats.Categories); diff != "" {
+		t.Errorf("Categories of stats mismatch (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorMaxDequeueRate(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var enqueued []*base.TaskMessage
+	for i := 0; i < 100; i++ {
+		enqueued = append(enqueued, h.NewTaskMessage("send_email", nil))
+	}
+	h.SeedEnqueuedQueue(t, r, enqueued)
+
+	const rate = 20
+	var processed int32
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		maxDequeueRate: rate,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		atomic.AddInt32(&processed, 1)
+		return nil
+	})
+
+	start := time.Now()
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+	elapsed := time.Since(start)
+
+	// Each task is pulled out by a command of its own.
+	max := int32(elapsed.Seconds()*rate) + 1
+	if got := atomic.LoadInt32(&processed); got > max || got < rate/2 {
+		t.Errorf("processed %d tasks in %v with the dequeue rate capped at %d/s, want between %d and %d", got, elapsed, rate, rate/2, max)
+	}
+}
+
+func TestProcessorCompressedPayload(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	payload := map[string]interface{}{"body": strings.Repeat("hello ", 100), "user_id": float64(42)}
+	m1 := h.NewTaskMessage("send_email", payload)
+	if err := base.CompressPayload(m1, 0); err != nil {
+		t.Fatal(err)
+	}
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	var mu sync.Mutex
+	var processed []*Task
+	handler := func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := []*Task{NewTask("send_email", payload)}
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+}
+
+func TestProcessorOnSuccess(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.EnqueuedAt = time.Now().Add(-3 * time.Second).UnixNano()
+	m2 := h.NewTaskMessage("gen_thumbnail", nil) // enqueue time unknown
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2})
+
+	var mu sync.Mutex
+	latencies := make(map[string]time.Duration)
+	onSuccess := func(task *Task, latency time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		latencies[task.Type] = latency
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		onSuccess:      onSuccess,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return nil })
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(latencies) != 2 {
+		t.Fatalf("onSuccess was called for %d tasks, want 2", len(latencies))
+	}
+	if got := latencies[m1.Type]; got < 3*time.Second || got > 5*time.Second {
+		t.Errorf("latency of %q = %v, want between 3s and 5s", m1.Type, got)
+	}
+	if got := latencies[m2.Type]; got != 0 {
+		t.Errorf("latency of %q = %v, want 0 for unknown enqueue time", m2.Type, got)
+	}
+}
+
+func TestProcessorDrainProgress(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, h.NewTaskMessage("send_email", map[string]interface{}{"id": i}))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	var mu sync.Mutex
+	var reports []int
+	reported := make(chan struct{}, 100)
+	p := newProcessor(processorParams{
+		rdb:                 rdbClient,
+		concurrency:         10,
+		queues:              defaultQueueConfig,
+		retryDelayFunc:      defaultDelayFunc,
+		drainReportInterval: 100 * time.Millisecond,
+		onDrainProgress: func(remaining int) {
+			mu.Lock()
+			reports = append(reports, remaining)
+			mu.Unlock()
+			reported <- struct{}{}
+			panic("panic in OnDrainProgress should not stop the shutdown")
+		},
+	})
+	started := make(chan struct{}, len(msgs))
+	release := make([]chan struct{}, len(msgs))
+	for i := range release {
+		release[i] = make(chan struct{})
+	}
+	p.handler = HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		id, _ := task.Payload.GetInt("id")
+		<-release[id]
+		return nil
+	})
+
+	p.start()
+	for range msgs {
+		<-started
+	}
+	done := make(chan struct{})
+	go func() {
+		p.terminate()
+		close(done)
+	}()
+	// Workers finish one by one during the drain.
+	for _, ch := range release {
+		select {
+		case <-reported:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("onDrainProgress was not called")
+		}
+		time.Sleep(300 * time.Millisecond)
+		close(ch)
+	}
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	n := len(reports)
+	if reports[0] != 3 || reports[n-1] != 1 {
+		t.Errorf("onDrainProgress was called with %v, want counts from 3 down to 1", reports)
+	}
+	for i := 1; i < n; i++ {
+		if reports[i] > reports[i-1] {
+			t.Errorf("onDrainProgress was called with %v, want non-increasing counts", reports)
+			break
+		}
+	}
+	// No reports after all workers have finished.
+	mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	if len(reports) != n {
+		t.Errorf("onDrainProgress was called after terminate returned")
+	}
+}
+
+func TestProcessorPrefetch(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, h.NewTaskMessage("send_email", map[string]interface{}{"id": i}))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	var mu sync.Mutex
+	var processed []int
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		prefetch:       4,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		id, err := task.Payload.GetInt("id")
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, id)
+		return nil
+	})
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Ints(processed)
+	want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	if diff := cmp.Diff(want, processed); diff != "" {
+		t.Errorf("processed tasks mismatch; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestProcessorRequeuesPrefetchedOnShutdown(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, h.NewTaskMessage("send_email", map[string]interface{}{"id": i}))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		prefetch:       5,
+	})
+	started := make(chan struct{}, len(msgs))
+	release := make(chan struct{})
+	p.handler = HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	p.start()
+	<-started
+	// Wait for the processor to block on the token with the next task.
+	time.Sleep(200 * time.Millisecond)
+	if n := r.LLen(base.DefaultQueue).Val(); n != 0 {
+		t.Errorf("%q has %d tasks before shutdown, want 0 with all tasks prefetched", base.DefaultQueue, n)
+	}
+	p.stop()
+	close(release)
+	p.terminate()
+
+	if n := len(started); n != 0 {
+		t.Errorf("%d prefetched tasks were processed after shutdown started, want 0", n)
+	}
+	var want, got []string
+	for _, msg := range msgs[1:] {
+		want = append(want, msg.ID.String())
+	}
+	for _, msg := range h.GetEnqueuedMessages(t, r) {
+		got = append(got, msg.ID.String())
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.DefaultQueue, diff)
+	}
+	if n := r.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, n)
+	}
+}
+
+func TestProcessorCancelTypePrefetched(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("export_csv", nil)
+	m3 := h.NewTaskMessage("export_csv", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		prefetch:       3,
+	})
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var exported int32
+	p.handler = HandlerFunc(func(task *Task) error {
+		if task.Type == "export_csv" {
+			atomic.AddInt32(&exported, 1)
+			return nil
+		}
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	p.start()
+	<-started
+	// Wait for the processor to block on the token with the prefetched tasks.
+	time.Sleep(200 * time.Millisecond)
+	if n := p.cancelType("export_csv"); n != 2 {
+		t.Errorf("(*processor).cancelType(%q) = %d, want 2 prefetched tasks", "export_csv", n)
+	}
+	close(release)
+	time.Sleep(500 * time.Millisecond)
+	p.terminate()
+
+	if n := atomic.LoadInt32(&exported); n != 0 {
+		t.Errorf("%d canceled tasks were processed, want 0", n)
+	}
+	dead := h.GetDeadMessages(t, r)
+	if len(dead) != 2 {
+		t.Fatalf("%q has %d tasks, want the 2 canceled tasks", base.DeadQueue, len(dead))
+	}
+	for _, msg := range dead {
+		if msg.Type != "export_csv" || msg.ErrorMsg != errTaskCanceled.Error() {
+			t.Errorf("dead task (Type: %q, ErrorMsg: %q), want (Type: %q, ErrorMsg: %q)",
+				msg.Type, msg.ErrorMsg, "export_csv", errTaskCanceled.Error())
+		}
+	}
+	if n := r.LLen(base.InProgressQueue).Val(); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, n)
+	}
+}
+
+func TestProcessorOnRequeue(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, h.NewTaskMessage("send_email", map[string]interface{}{"id": i}))
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	var mu sync.Mutex
+	var requeued []*Task
+	onRequeue := func(task *Task) {
+		mu.Lock()
+		requeued = append(requeued, task)
+		mu.Unlock()
+		panic("panic in OnRequeue should not stop the shutdown")
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		onRequeue:      onRequeue,
+	})
+	started := make(chan struct{}, len(msgs))
+	release := make(chan struct{})
+	p.handler = HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+
+	p.start()
+	<-started
+	// Wait for the processor to pull out the next task and block on the token.
+	time.Sleep(200 * time.Millisecond)
+	p.stop()
+	close(release)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requeued) != 1 {
+		t.Fatalf("onRequeue was called for %d tasks, want 1", len(requeued))
+	}
+	wantID := 1 // the task pulled out after the first one
+	if got, err := requeued[0].Payload.GetInt("id"); err != nil || got != wantID {
+		t.Errorf("onRequeue was called with the task of id %d, %v; want %d", got, err, wantID)
+	}
+	if n := len(h.GetEnqueuedMessages(t, r)); n != len(msgs)-1 {
+		t.Errorf("%q has %d tasks, want %d", base.DefaultQueue, n, len(msgs)-1)
+	}
+}
+
+func TestProcessorFinishClaimedOnShutdown(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	m3 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2, m3})
+
+	var requeued int32
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		finishClaimed:  true,
+		onRequeue:      func(task *Task) { atomic.AddInt32(&requeued, 1) },
+	})
+	var mu sync.Mutex
+	var processed []*Task
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	p.handler = HandlerFunc(func(task *Task) error {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		processed = append(processed, task)
+		mu.Unlock()
+		return nil
+	})
+
+	p.start()
+	<-started
+	// Wait for the processor to pull out the next task and block on the token.
+	time.Sleep(200 * time.Millisecond)
+	go func() {
+		// Let the worker finish after the shutdown has started.
+		time.Sleep(200 * time.Millisecond)
+		close(release)
+	}()
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(processed) != 2 {
+		t.Errorf("processed %d tasks, want 2 (the one running and the one claimed)", len(processed))
+	}
+	if n := atomic.LoadInt32(&requeued); n != 0 {
+		t.Errorf("requeued %d tasks, want 0", n)
+	}
+	enqueued := h.GetEnqueuedMessages(t, r)
+	if diff := cmp.Diff([]*base.TaskMessage{m3}, enqueued); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+}
+
+func TestProcessorTrackStarted(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		trackStarted:   true,
+	})
+	var recorded bool
+	p.handler = HandlerFunc(func(task *Task) error {
+		recorded = r.ZScore(base.StartedTasks, m1.ID.String()).Err() == nil
+		return nil
+	})
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	if !recorded {
+		t.Errorf("start time of the task was not recorded while processed")
+	}
+	if n := r.ZCard(base.StartedTasks).Val(); n != 0 {
+		t.Errorf("%q has %d entries after the task is done, want 0", base.StartedTasks, n)
+	}
+}
+
+func TestProcessorTimeout(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m1.Timeout = "500ms"
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1})
+
+	handler := func(task *Task) error {
+		time.Sleep(time.Second) // returns after the timeout
+		return nil
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(2 * time.Second)
+	p.terminate()
+
+	r1 := *m1
+	r1.ErrorMsg = "task timed out after 500ms"
+	r1.Retried = m1.Retried + 1
+	r1.Attempts = m1.Attempts + 1
+	gotRetry := h.GetRetryMessages(t, r)
+	if diff := cmp.Diff([]*base.TaskMessage{&r1}, gotRetry, h.SortMsgOpt, cmpopts.IgnoreFields(base.TaskMessage{}, "FailedAt")); diff != "" {
+		t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+}
+
+// Handlers of the tasks timed out or canceled keep running, so the workers
+// have to hold on to the tokens until the handlers return.
+func TestProcessorHandlersLeftRunningCountTowardConcurrency(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	const concurrency = 2
+
+	tests := []struct {
+		desc    string
+		timeout string
+		cancel  bool
+	}{
+		{desc: "timed out", timeout: "100ms"},
+		{desc: "canceled", cancel: true},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		var msgs []*base.TaskMessage
+		for i := 0; i < 3*concurrency; i++ {
+			msg := h.NewTaskMessage("export_csv", nil)
+			msg.Timeout = tc.timeout
+			msgs = append(msgs, msg)
+		}
+		h.SeedEnqueuedQueue(t, r, msgs)
+
+		var active, maxActive, started int32
+		handler := func(task *Task) error {
+			atomic.AddInt32(&started, 1)
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				max := atomic.LoadInt32(&maxActive)
+				if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+					break
+				}
+			}
+			time.Sleep(300 * time.Millisecond) // returns after the timeout or cancellation
+			return nil
+		}
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    concurrency,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: func(n int, e error, t *Task) time.Duration { return time.Minute },
+		})
+		p.handler = HandlerFunc(handler)
+
+		p.start()
+		stop := make(chan struct{})
+		if tc.cancel {
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(50 * time.Millisecond):
+						p.cancelType("export_csv")
+					}
+				}
+			}()
+		}
+		time.Sleep(1500 * time.Millisecond)
+		close(stop)
+		p.terminate()
+
+		if got := atomic.LoadInt32(&maxActive); got > concurrency {
+			t.Errorf("%s: %d handlers ran at the same time, want at most %d", tc.desc, got, concurrency)
+		}
+		if tc.cancel {
+			// Note: The tasks waiting for a worker are canceled without processing.
+			if got := len(h.GetDeadMessages(t, r)); got != len(msgs) {
+				t.Errorf("%s: %q has %d tasks, want %d", tc.desc, base.DeadQueue, got, len(msgs))
+			}
+		} else if got := atomic.LoadInt32(&started); got != int32(len(msgs)) {
+			t.Errorf("%s: %d tasks were processed, want %d", tc.desc, got, len(msgs))
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		err    error
+		want   time.Duration
+		wantOk bool
+	}{
+		{fmt.Errorf("something went wrong"), 0, false},
+		{&retryAfterError{time.Minute}, time.Minute, true},
+		{fmt.Errorf("wrapped: %w", &retryAfterError{time.Hour}), time.Hour, true},
+		{&retryAfterError{-time.Second}, 0, false},
+	}
+
+	for _, tc := range tests {
+		got, ok := RetryAfter(tc.err)
+		if got != tc.want || ok != tc.wantOk {
+			t.Errorf("RetryAfter(%v) = %v, %t; want %v, %t", tc.err, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
+
+func TestProcessorUnfinishedTasks(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("gen_thumbnail", nil)
+	m3 := h.NewTaskMessage("reindex", nil)
+
+	tests := []struct {
+		desc          string
+		abandon       bool
+		inProgress    []*base.TaskMessage // initial in-progress queue state
+		aborted       *base.TaskMessage   // task aborted before processing starts
+		wantEnqueued  []*base.TaskMessage
+		wantAbandoned []*base.TaskMessage
+	}{
+		{
+			desc:          "requeue mode (at-least-once)",
+			abandon:       false,
+			inProgress:    []*base.TaskMessage{m1, m2, m3},
+			aborted:       m3,
+			wantEnqueued:  []*base.TaskMessage{m1, m2, m3},
+			wantAbandoned: []*base.TaskMessage{},
+		},
+		{
+			desc:          "abandon mode (at-most-once)",
+			abandon:       true,
+			inProgress:    []*base.TaskMessage{m1, m2, m3},
+			aborted:       m3,
+			wantEnqueued:  []*base.TaskMessage{},
+			wantAbandoned: []*base.TaskMessage{m1, m2, m3},
+		},
+	}
+
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		h.SeedInProgressQueue(t, r, tc.inProgress)
+
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			abandon:        tc.abandon,
+		})
+
+		p.requeue(tc.aborted)
+		n, err := p.restore()
+		if want := int64(len(tc.inProgress) - 1); n != want || err != nil {
+			t.Errorf("%s: p.restore() = %d, %v, want %d, nil", tc.desc, n, err, want)
+		}
+
+		gotEnqueued := h.GetEnqueuedMessages(t, r)
+		if diff := cmp.Diff(tc.wantEnqueued, gotEnqueued, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DefaultQueue, diff)
+		}
+		gotAbandoned := h.GetAbandonedMessages(t, r)
+		if diff := cmp.Diff(tc.wantAbandoned, gotAbandoned, h.SortMsgOpt); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.AbandonedQueue, diff)
+		}
+		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+			t.Errorf("%s: %q has %d tasks, want 0", tc.desc, base.InProgressQueue, l)
+		}
+	}
+}
+
+func TestRetryUntil(t *testing.T) {
+	errFlaky := errors.New("connection reset")
+
+	tests := []struct {
+		desc      string
+		failures  int           // number of times fn fails before succeeding
+		timeout   time.Duration // duration until the deadline
+		wantErr   error
+		wantCalls int
+	}{
+		{"succeeds on first attempt", 0, time.Second, nil, 1},
+		{"succeeds after transient failures", 3, time.Second, nil, 4},
+		{"gives up at deadline", 1000, 200 * time.Millisecond, errFlaky, -1},
+		{"calls at least once with passed deadline", 1000, -time.Second, errFlaky, 1},
+	}
+
+	for _, tc := range tests {
+		calls := 0
+		fn := func() error {
+			calls++
+			if calls <= tc.failures {
+				return errFlaky
+			}
+			return nil
+		}
+		start := time.Now()
+		err := retryUntil(start.Add(tc.timeout), fn)
+		elapsed := time.Since(start)
+		if err != tc.wantErr {
+			t.Errorf("%s: retryUntil returned %v, want %v", tc.desc, err, tc.wantErr)
+		}
+		if tc.wantCalls >= 0 && calls != tc.wantCalls {
+			t.Errorf("%s: fn was called %d times, want %d", tc.desc, calls, tc.wantCalls)
+		}
+		if tc.timeout > 0 && elapsed > tc.timeout+50*time.Millisecond {
+			t.Errorf("%s: retryUntil took %v, want at most %v", tc.desc, elapsed, tc.timeout)
+		}
+	}
+}
+
+func TestProcessorConcurrentRestoreWithLock(t *testing.T) {
+	r := setup(t)
+	var msgs []*base.TaskMessage
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, h.NewTaskMessage("send_email", nil))
+	}
+	h.SeedInProgressQueue(t, r, msgs)
+
+	const n = 5
+	var (
+		wg       sync.WaitGroup
+		claimed  int32
+		restored int64
+	)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		p := newProcessor(processorParams{
+			rdb:            rdb.NewRDB(r),
+			serverID:       fmt.Sprintf("server%d", i),
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			retryDelayFunc: defaultDelayFunc,
+			restoreLockTTL: time.Minute,
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if !p.claimRestore() {
+				return
+			}
+			atomic.AddInt32(&claimed, 1)
+			n, err := p.restore()
+			if err != nil {
+				t.Errorf("p.restore() returned error: %v", err)
+			}
+			atomic.AddInt64(&restored, n)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if claimed != 1 {
+		t.Errorf("%d of %d processors restored the unfinished tasks, want 1", claimed, n)
+	}
+	if restored != int64(len(msgs)) {
+		t.Errorf("restored %d tasks, want %d", restored, len(msgs))
+	}
+	if got := h.GetEnqueuedMessages(t, r); len(got) != len(msgs) {
+		t.Errorf("%q has %d tasks, want %d", base.DefaultQueue, len(got), len(msgs))
+	}
+
+	// Tasks left unfinished while the lock is held are not restored.
+	h.SeedInProgressQueue(t, r, msgs[:1])
+	p := newProcessor(processorParams{
+		rdb:            rdb.NewRDB(r),
+		serverID:       "server-late",
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+		restoreLockTTL: time.Minute,
+	})
+	if p.claimRestore() {
+		t.Errorf("p.claimRestore() = true while the restore lock is held, want false")
+	}
+
+	// Without the lock, the tasks are restored by every processor.
+	p = newProcessor(processorParams{
+		rdb:            rdb.NewRDB(r),
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	if !p.claimRestore() {
+		t.Errorf("p.claimRestore() = false without restoreLockTTL, want true")
+	}
+}
+
+func TestProcessorRequeueWithUnavailableRedis(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+	h.SeedInProgressQueue(t, r, []*base.TaskMessage{m1})
+
+	// redis is unavailable since the connection is closed.
+	rdbClient := rdb.NewRDB(redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 14}))
+	rdbClient.Close()
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.requeueDeadline = time.Now().Add(300 * time.Millisecond)
+
+	start := time.Now()
+	p.requeue(m1)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requeue took %v with unavailable redis, want it bounded by the deadline", elapsed)
+	}
+	// task should be left in-progress to be restored on the next start.
+	gotInProgress := h.GetInProgressMessages(t, r)
+	if diff := cmp.Diff([]*base.TaskMessage{m1}, gotInProgress); diff != "" {
+		t.Errorf("mismatch found in %q; (-want, +got)\n%s", base.InProgressQueue, diff)
+	}
+}
+
+// failingLimiter fails the first n commands of the redis client.
+type failingLimiter struct {
+	n     int32
+	calls int32
+}
+
+func (l *failingLimiter) Allow() error {
+	if atomic.AddInt32(&l.calls, 1) <= l.n {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (l *failingLimiter) ReportResult(err error) {}
+
+func TestProcessorMarkAsDoneWithTransientFailure(t *testing.T) {
+	r := setup(t)
+	m1 := h.NewTaskMessage("send_email", nil)
+
+	tests := []struct {
+		desc           string
+		failures       int32
+		timeout        time.Duration
+		wantCalls      int32
+		wantInProgress []*base.TaskMessage
+	}{
+		{
+			desc:           "retried until it succeeds",
+			failures:       2,
+			timeout:        time.Second,
+			wantCalls:      3,
+			wantInProgress: []*base.TaskMessage{},
+		},
+		{
+			desc:           "not retried with negative timeout",
+			failures:       2,
+			timeout:        -1,
+			wantInProgress: []*base.TaskMessage{m1},
+		},
+		{
+			desc:           "gives up after the timeout",
+			failures:       1000,
+			timeout:        100 * time.Millisecond,
+			wantInProgress: []*base.TaskMessage{m1},
 		},
 	}
 
 	for _, tc := range tests {
-		h.FlushDB(t, r)                        // clean up db before each test case.
-		h.SeedEnqueuedQueue(t, r, tc.enqueued) // initialize default queue.
-
-		// instantiate a new processor
-		delayFunc := func(n int, e error, t *Task) time.Duration {
-			return tc.delay
-		}
-		handler := func(task *Task) error {
-			return fmt.Errorf(errMsg)
-		}
-		p := newProcessor(rdbClient, 10, defaultQueueConfig, false, delayFunc)
-		p.handler = HandlerFunc(handler)
+		h.FlushDB(t, r)
+		h.SeedInProgressQueue(t, r, []*base.TaskMessage{m1})
 
-		p.start()
-		for _, msg := range tc.incoming {
-			err := rdbClient.Enqueue(msg)
-			if err != nil {
-				p.terminate()
-				t.Fatal(err)
-			}
-		}
-		time.Sleep(tc.wait)
-		p.terminate()
+		limiter := &failingLimiter{n: tc.failures}
+		c := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 14})
+		c.SetLimiter(limiter)
+		p := newProcessor(processorParams{
+			rdb:                rdb.NewRDB(c),
+			concurrency:        10,
+			queues:             defaultQueueConfig,
+			retryDelayFunc:     defaultDelayFunc,
+			stateUpdateTimeout: tc.timeout,
+		})
 
-		cmpOpt := cmpopts.EquateApprox(0, float64(time.Second)) // allow up to second difference in zset score
-		gotRetry := h.GetRetryEntries(t, r)
-		if diff := cmp.Diff(tc.wantRetry, gotRetry, h.SortZSetEntryOpt, cmpOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.RetryQueue, diff)
+		start := time.Now()
+		p.markAsDone(NewTask(m1.Type, nil), m1, 0)
+		if elapsed := time.Since(start); tc.timeout > 0 && elapsed > tc.timeout+maxRetryBackoff {
+			t.Errorf("%s: markAsDone took %v, want it bounded by the timeout %v", tc.desc, elapsed, tc.timeout)
 		}
-
-		gotDead := h.GetDeadMessages(t, r)
-		if diff := cmp.Diff(tc.wantDead, gotDead, h.SortMsgOpt); diff != "" {
-			t.Errorf("mismatch found in %q after running processor; (-want, +got)\n%s", base.DeadQueue, diff)
+		if limiter.calls < tc.wantCalls {
+			t.Errorf("%s: markAsDone sent %d commands, want at least %d", tc.desc, limiter.calls, tc.wantCalls)
 		}
-
-		if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
-			t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+		gotInProgress := h.GetInProgressMessages(t, r)
+		if diff := cmp.Diff(tc.wantInProgress, gotInProgress, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.InProgressQueue, diff)
 		}
+		c.Close()
 	}
 }
 
@@ -207,7 +3436,12 @@ func TestProcessorQueues(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		p := newProcessor(nil, 10, tc.queueCfg, false, defaultDelayFunc)
+		p := newProcessor(processorParams{
+			rdb:            nil,
+			concurrency:    10,
+			queues:         tc.queueCfg,
+			retryDelayFunc: defaultDelayFunc,
+		})
 		got := p.queues()
 		if diff := cmp.Diff(tc.want, got, sortOpt); diff != "" {
 			t.Errorf("with queue config: %v\n(*processor).queues() = %v, want %v\n(-want,+got):\n%s",
@@ -216,6 +3450,188 @@ func TestProcessorQueues(t *testing.T) {
 	}
 }
 
+func TestProcessorMaxPolledQueues(t *testing.T) {
+	queueCfg := make(map[string]uint)
+	for i := 1; i <= 20; i++ {
+		queueCfg[fmt.Sprintf("queue%02d", i)] = uint(i)
+	}
+	for _, strict := range []bool{true, false} {
+		p := newProcessor(processorParams{
+			rdb:             nil,
+			concurrency:     10,
+			queues:          queueCfg,
+			strictPriority:  strict,
+			retryDelayFunc:  defaultDelayFunc,
+			maxPolledQueues: 4,
+		})
+		polled := make(map[string]bool)
+		for i := 0; i < 40; i++ {
+			qnames := p.queues()
+			if len(qnames) != 4 {
+				t.Fatalf("strict=%t: (*processor).queues() = %v, want 4 queues", strict, qnames)
+			}
+			if strict && (qnames[0] != "queue20" || qnames[1] != "queue19") {
+				t.Errorf("strict=%t: (*processor).queues() = %v, want the highest priority queues first", strict, qnames)
+			}
+			for _, qname := range qnames {
+				polled[qname] = true
+			}
+		}
+		if len(polled) != len(queueCfg) {
+			t.Errorf("strict=%t: polled %d queues, want all %d queues", strict, len(polled), len(queueCfg))
+		}
+	}
+}
+
+func TestProcessorQueuesWithFixedSeed(t *testing.T) {
+	queueCfg := map[string]uint{
+		"critical": 6,
+		"default":  3,
+		"low":      1,
+	}
+	orders := func(seed int64) [][]string {
+		p := newProcessor(processorParams{
+			rdb:            nil,
+			concurrency:    10,
+			queues:         queueCfg,
+			retryDelayFunc: defaultDelayFunc,
+			randSource:     rand.NewSource(seed),
+		})
+		var res [][]string
+		for i := 0; i < 20; i++ {
+			res = append(res, p.queues())
+		}
+		return res
+	}
+
+	first := orders(42)
+	if diff := cmp.Diff(first, orders(42)); diff != "" {
+		t.Errorf("queue orders with the same seed differ; (-first,+second)\n%s", diff)
+	}
+	seen := make(map[string]bool)
+	for _, qnames := range first {
+		seen[qnames[0]] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("the first queue is always %v over %d calls, want the order shuffled", first[0][0], len(first))
+	}
+}
+
+func TestProcessorDepthAwareQueues(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	tests := []struct {
+		desc     string
+		queueCfg map[string]uint
+		depths   map[string]int
+		target   string  // queue whose rate of being queried first is checked
+		want     float64 // expected rate of target being queried first
+	}{
+		{
+			desc:     "backed up low priority queue",
+			queueCfg: map[string]uint{"high": 6, "low": 1},
+			depths:   map[string]int{"high": 5, "low": 500},
+			target:   "low",
+			// weights: high = 6 * (1 + 2*5/505), low = 1 * (1 + 2*500/505)
+			want: 2.980 / (2.980 + 6.119),
+		},
+		{
+			desc:     "same priority with skewed backlogs",
+			queueCfg: map[string]uint{"a": 1, "b": 1},
+			depths:   map[string]int{"a": 450, "b": 50},
+			target:   "a",
+			want:     2.8 / (2.8 + 1.2),
+		},
+		{
+			desc:     "empty queues fall back to priority",
+			queueCfg: map[string]uint{"high": 6, "low": 1},
+			depths:   map[string]int{},
+			target:   "low",
+			want:     1.0 / 7,
+		},
+	}
+
+	const iterations = 5000
+	for _, tc := range tests {
+		h.FlushDB(t, r)
+		for qname, n := range tc.depths {
+			var msgs []*base.TaskMessage
+			for i := 0; i < n; i++ {
+				msgs = append(msgs, h.NewTaskMessageWithQueue("sync", nil, qname))
+			}
+			h.SeedEnqueuedQueue(t, r, msgs, qname)
+		}
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    10,
+			queues:         tc.queueCfg,
+			retryDelayFunc: defaultDelayFunc,
+			depthAware:     true,
+		})
+		first := 0
+		for i := 0; i < iterations; i++ {
+			qnames := p.queues()
+			if len(qnames) != len(tc.queueCfg) {
+				t.Fatalf("%s: (*processor).queues() = %v, want all queues in %v", tc.desc, qnames, tc.queueCfg)
+			}
+			if qnames[0] == tc.target {
+				first++
+			}
+		}
+		got := float64(first) / iterations
+		if math.Abs(got-tc.want) > 0.03 {
+			t.Errorf("%s: %q is queried first at a rate of %.3f, want %.3f", tc.desc, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestProcessorQueueFairnessAcrossInstances(t *testing.T) {
+	r := setup(t)
+
+	queueCfg := map[string]uint{
+		"critical":            3,
+		base.DefaultQueueName: 2,
+		"low":                 1,
+	}
+	const n = 600 // number of tasks to dequeue
+	for qname := range queueCfg {
+		var msgs []*base.TaskMessage
+		for i := 0; i < n; i++ {
+			msgs = append(msgs, h.NewTaskMessageWithQueue("task", nil, qname))
+		}
+		h.SeedEnqueuedQueue(t, r, msgs, qname)
+	}
+
+	// simulate multiple background instances pulling tasks from the same queues.
+	var instances []*processor
+	for i := 0; i < 3; i++ {
+		instances = append(instances, newProcessor(processorParams{
+			rdb:            rdb.NewRDB(r),
+			concurrency:    10,
+			queues:         queueCfg,
+			retryDelayFunc: defaultDelayFunc,
+		}))
+	}
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		p := instances[i%len(instances)]
+		msg, err := p.rdb.Dequeue(p.queues()...)
+		if err != nil {
+			t.Fatalf("(*RDB).Dequeue() returned error: %v", err)
+		}
+		counts[msg.Queue]++
+	}
+
+	for qname, priority := range queueCfg {
+		want := float64(priority) / 6
+		got := float64(counts[qname]) / n
+		if math.Abs(want-got) > 0.1 {
+			t.Errorf("%q was processed %.2f of the time, want roughly %.2f", qname, got, want)
+		}
+	}
+}
+
 func TestProcessorWithStrictPriority(t *testing.T) {
 	r := setup(t)
 	rdbClient := rdb.NewRDB(r)
@@ -273,7 +3689,13 @@ func TestProcessorWithStrictPriority(t *testing.T) {
 			"low":                 1,
 		}
 		// Note: Set concurrency to 1 to make sure tasks are processed one at a time.
-		p := newProcessor(rdbClient, 1 /*concurrency */, queueCfg, true /* strict */, defaultDelayFunc)
+		p := newProcessor(processorParams{
+			rdb:            rdbClient,
+			concurrency:    1,
+			queues:         queueCfg,
+			strictPriority: true,
+			retryDelayFunc: defaultDelayFunc,
+		})
 		p.handler = HandlerFunc(handler)
 
 		p.start()
@@ -290,12 +3712,161 @@ func TestProcessorWithStrictPriority(t *testing.T) {
 	}
 }
 
+// fixedSelector is a QueueSelector which always returns the same order.
+type fixedSelector []string
+
+func (s fixedSelector) Next(queues map[string]uint) []string { return s }
+
+func TestProcessorWithQueueSelector(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	m1 := h.NewTaskMessage("send_email", nil)
+	m2 := h.NewTaskMessage("send_email", nil)
+	m3 := h.NewTaskMessage("gen_thumbnail", nil)
+	m4 := h.NewTaskMessage("sync", nil)
+	m5 := h.NewTaskMessage("sync", nil)
+
+	t1 := NewTask(m1.Type, m1.Payload)
+	t2 := NewTask(m2.Type, m2.Payload)
+	t3 := NewTask(m3.Type, m3.Payload)
+	t4 := NewTask(m4.Type, m4.Payload)
+	t5 := NewTask(m5.Type, m5.Payload)
+
+	h.FlushDB(t, r)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m1, m2}, "critical")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m3}, base.DefaultQueueName)
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{m4, m5}, "low")
+
+	var mu sync.Mutex
+	var processed []*Task
+	handler := func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	}
+	// Note: Set concurrency to 1 to make sure tasks are processed one at a time.
+	p := newProcessor(processorParams{
+		rdb:         rdbClient,
+		concurrency: 1,
+		queues: map[string]uint{
+			"critical":            3,
+			base.DefaultQueueName: 2,
+			"low":                 1,
+		},
+		// Custom selector takes precedence over strict priority.
+		strictPriority: true,
+		selector:       fixedSelector{"low", "critical", base.DefaultQueueName},
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := []*Task{t4, t5, t1, t2, t3}
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestStrictSelector(t *testing.T) {
+	queues := map[string]uint{"critical": 6, "default": 3, "low": 1}
+	want := []string{"critical", "default", "low"}
+	if got := (StrictSelector{}).Next(queues); !cmp.Equal(want, got) {
+		t.Errorf("StrictSelector.Next(%v) = %v, want %v", queues, got, want)
+	}
+}
+
+func TestProcessorWithStarvationGuard(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var critical []*base.TaskMessage
+	var wantCritical []*Task
+	for i := 0; i < 6; i++ {
+		m := h.NewTaskMessageWithQueue("send_email", map[string]interface{}{"n": float64(i)}, "critical")
+		critical = append(critical, m)
+		wantCritical = append(wantCritical, NewTask(m.Type, m.Payload))
+	}
+	l1 := h.NewTaskMessageWithQueue("sync", map[string]interface{}{"n": 0.0}, "low")
+	l2 := h.NewTaskMessageWithQueue("sync", map[string]interface{}{"n": 1.0}, "low")
+
+	h.FlushDB(t, r)
+	h.SeedEnqueuedQueue(t, r, critical, "critical")
+	h.SeedEnqueuedQueue(t, r, []*base.TaskMessage{l1, l2}, "low")
+
+	var mu sync.Mutex
+	var processed []*Task
+	handler := func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task)
+		return nil
+	}
+	// Note: Set concurrency to 1 to make sure tasks are processed one at a time.
+	p := newProcessor(processorParams{
+		rdb:             rdbClient,
+		concurrency:     1,
+		queues:          map[string]uint{"critical": 2, "low": 1},
+		strictPriority:  true,
+		starvationGuard: 2,
+		retryDelayFunc:  defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(handler)
+
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	want := []*Task{
+		wantCritical[0], wantCritical[1],
+		NewTask(l1.Type, l1.Payload),
+		wantCritical[2], wantCritical[3],
+		NewTask(l2.Type, l2.Payload),
+		wantCritical[4], wantCritical[5],
+	}
+	if diff := cmp.Diff(want, processed, cmp.AllowUnexported(Payload{})); diff != "" {
+		t.Errorf("mismatch found in processed tasks; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestClonePayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"user_id": 42.0,
+		"rcpts":   []interface{}{"a@example.com", map[string]interface{}{"name": "b"}},
+		"meta":    map[string]interface{}{"attempt": 1.0},
+	}
+	want := map[string]interface{}{
+		"user_id": 42.0,
+		"rcpts":   []interface{}{"a@example.com", map[string]interface{}{"name": "b"}},
+		"meta":    map[string]interface{}{"attempt": 1.0},
+	}
+
+	got := clonePayload(payload)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("clonePayload(%v) = %v, want %v; (-want,+got)\n%s", payload, got, want, diff)
+	}
+	// mutating the copy should not affect the original.
+	got["meta"].(map[string]interface{})["attempt"] = 2.0
+	got["rcpts"].([]interface{})[1].(map[string]interface{})["name"] = "c"
+	if diff := cmp.Diff(want, payload); diff != "" {
+		t.Errorf("original payload was mutated; (-want,+got)\n%s", diff)
+	}
+	if clonePayload(nil) != nil {
+		t.Errorf("clonePayload(nil) should return nil")
+	}
+}
+
 func TestPerform(t *testing.T) {
 	tests := []struct {
-		desc    string
-		handler HandlerFunc
-		task    *Task
-		wantErr bool
+		desc      string
+		handler   HandlerFunc
+		task      *Task
+		wantErr   bool
+		wantPanic bool
 	}{
 		{
 			desc: "handler returns nil",
@@ -318,8 +3889,9 @@ func TestPerform(t *testing.T) {
 			handler: func(t *Task) error {
 				panic("something went terribly wrong")
 			},
-			task:    NewTask("gen_thumbnail", map[string]interface{}{"src": "some/img/path"}),
-			wantErr: true,
+			task:      NewTask("gen_thumbnail", map[string]interface{}{"src": "some/img/path"}),
+			wantErr:   true,
+			wantPanic: true,
 		},
 	}
 
@@ -333,5 +3905,323 @@ func TestPerform(t *testing.T) {
 			t.Errorf("%s: perform() = nil, want non-nil error", tc.desc)
 			continue
 		}
+		var perr *PanicError
+		if isPanic := errors.As(got, &perr); isPanic != tc.wantPanic {
+			t.Errorf("%s: perform() = %v; errors.As(err, *PanicError) = %t, want %t", tc.desc, got, isPanic, tc.wantPanic)
+			continue
+		}
+		if tc.wantPanic {
+			if want := "panic: something went terribly wrong"; perr.Error() != want {
+				t.Errorf("%s: PanicError.Error() = %q, want %q", tc.desc, perr.Error(), want)
+			}
+			if !strings.Contains(string(perr.Stack), "TestPerform") {
+				t.Errorf("%s: PanicError.Stack does not contain the handler frames:\n%s", tc.desc, perr.Stack)
+			}
+		}
+	}
+}
+
+func TestThrottledLogger(t *testing.T) {
+	clock := base.NewSimulatedClock(time.Now())
+	var lines []string
+	debug := 0
+	logf := func(_ *base.TaskMessage, format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		if strings.HasPrefix(line, "[DEBUG]") {
+			debug++
+			return
+		}
+		lines = append(lines, line)
+	}
+	l := newThrottledLogger(clock, time.Second, logf)
+
+	for i := 0; i < 100; i++ {
+		l.printf("[WARN] Retry exhausted for task(ID: %d)\n", i)
+	}
+	l.printf("[WARN] Dropping task(ID: %d)\n", 0) // other formats are throttled separately
+	clock.AdvanceTime(time.Second)
+	l.printf("[WARN] Retry exhausted for task(ID: %d)\n", 100)
+	l.printf("[WARN] Retry exhausted for task(ID: %d)\n", 101)
+	l.flush()
+
+	want := []string{
+		"[WARN] Retry exhausted for task(ID: 0)\n",
+		"[WARN] Dropping task(ID: 0)\n",
+		"[WARN] Retry exhausted for task(ID: 100) (99 similar messages suppressed)\n",
+		`[WARN] 1 similar messages suppressed: "[WARN] Retry exhausted for task(ID: %d)"` + "\n",
+	}
+	if diff := cmp.Diff(want, lines); diff != "" {
+		t.Errorf("logged lines mismatch; (-want,+got)\n%s", diff)
+	}
+	// Suppressed lines are kept at debug level.
+	if debug != 100 {
+		t.Errorf("logged %d debug lines, want 100", debug)
+	}
+}
+
+func TestProcessorThrottlesFailureLogs(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var msgs []*base.TaskMessage
+	for i := 0; i < 50; i++ {
+		m := h.NewTaskMessage("send_email", nil)
+		m.Retried = m.Retry // task has exhausted its retry count
+		msgs = append(msgs, m)
+	}
+	h.SeedEnqueuedQueue(t, r, msgs)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = HandlerFunc(func(task *Task) error { return fmt.Errorf("something went wrong") })
+	p.start()
+	time.Sleep(500 * time.Millisecond)
+	p.terminate()
+
+	if n := len(h.GetDeadMessages(t, r)); n != len(msgs) {
+		t.Fatalf("%q has %d tasks, want %d", base.DeadQueue, n, len(msgs))
+	}
+	var logged int
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "Retry exhausted") {
+			logged++
+		}
+	}
+	// One line for the first task and another with the count of the rest on shutdown.
+	if logged > 2 {
+		t.Errorf("logged %d lines for %d killed tasks, want at most 2:\n%s", logged, len(msgs), buf.String())
+	}
+	if !strings.Contains(buf.String(), "similar messages suppressed") {
+		t.Errorf("log does not report the number of suppressed lines:\n%s", buf.String())
+	}
+	// Debug lines of the suppressed failures are not logged by default.
+	if strings.Contains(buf.String(), "[DEBUG]") {
+		t.Errorf("logged debug lines at the default level:\n%s", buf.String())
+	}
+}
+
+func TestProcessorDependencies(t *testing.T) {
+	tests := []struct {
+		desc           string
+		parentErr      error // error returned by the handler of the parent task
+		dropParent     bool  // whether the failed parent task is dropped
+		killDependents bool
+		wantProcessed  []string // types of the tasks processed, in order
+		wantDead       []string // types of the tasks in the dead queue
+		wantWaiting    int      // number of tasks waiting for the parent task
+	}{
+		{
+			desc:          "dependency completes",
+			parentErr:     nil,
+			wantProcessed: []string{"export_csv", "email_csv"},
+			wantDead:      []string{},
+			wantWaiting:   0,
+		},
+		{
+			desc:           "dependency dies and dependents are killed",
+			parentErr:      fmt.Errorf("something went wrong"),
+			killDependents: true,
+			wantProcessed:  []string{"export_csv"},
+			wantDead:       []string{"email_csv", "export_csv"},
+			wantWaiting:    0,
+		},
+		{
+			desc:           "dependency dies and dependents keep waiting",
+			parentErr:      fmt.Errorf("something went wrong"),
+			killDependents: false,
+			wantProcessed:  []string{"export_csv"},
+			wantDead:       []string{"export_csv"},
+			wantWaiting:    1,
+		},
+		{
+			desc:           "dependency is dropped and dependents are killed",
+			parentErr:      fmt.Errorf("something went wrong"),
+			dropParent:     true,
+			killDependents: false,
+			wantProcessed:  []string{"export_csv"},
+			wantDead:       []string{"email_csv"},
+			wantWaiting:    0,
+		},
+	}
+
+	for _, tc := range tests {
+		r := setup(t)
+		client := NewClient(&RedisClientOpt{Addr: "localhost:6379", DB: 14})
+		parentID, err := client.EnqueueWithID(NewTask("export_csv", nil), MaxRetry(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.EnqueueWithID(NewTask("email_csv", nil), DependsOn(parentID)); err != nil {
+			t.Fatal(err)
+		}
+
+		var decider retryDecider
+		if tc.dropParent {
+			decider = func(task *Task, err error, retried, maxRetry int) Decision { return Drop }
+		}
+
+		var mu sync.Mutex
+		var processed []string
+		p := newProcessor(processorParams{
+			rdb:            rdb.NewRDB(r),
+			concurrency:    10,
+			queues:         defaultQueueConfig,
+			killDependents: tc.killDependents,
+			retryDecider:   decider,
+		})
+		p.handler = HandlerFunc(func(task *Task) error {
+			mu.Lock()
+			processed = append(processed, task.Type)
+			mu.Unlock()
+			if task.Type == "export_csv" {
+				return tc.parentErr
+			}
+			return nil
+		})
+
+		p.start()
+		time.Sleep(2 * time.Second)
+		p.terminate()
+
+		mu.Lock()
+		if diff := cmp.Diff(tc.wantProcessed, processed); diff != "" {
+			t.Errorf("%s: mismatch found in processed tasks; (-want, +got)\n%s", tc.desc, diff)
+		}
+		mu.Unlock()
+		var gotDead []string
+		for _, msg := range h.GetDeadMessages(t, r) {
+			gotDead = append(gotDead, msg.Type)
+		}
+		sort.Strings(gotDead)
+		if diff := cmp.Diff(tc.wantDead, gotDead, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch found in %q; (-want, +got)\n%s", tc.desc, base.DeadQueue, diff)
+		}
+		if got := len(h.GetDependentMessages(t, r, parentID)); got != tc.wantWaiting {
+			t.Errorf("%s: %d tasks waiting for the parent task, want %d", tc.desc, got, tc.wantWaiting)
+		}
+		if got := r.ZCard(base.WaitingTasks).Val(); got != int64(tc.wantWaiting) {
+			t.Errorf("%s: %q has %d tasks, want %d", tc.desc, base.WaitingTasks, got, tc.wantWaiting)
+		}
+		client.Close()
+	}
+}
+
+// panickingClock panics once on the first call to Now after it's armed.
+type panickingClock struct {
+	armed int32
+}
+
+func (c *panickingClock) Now() time.Time {
+	if atomic.CompareAndSwapInt32(&c.armed, 1, 0) {
+		panic("clock is broken")
+	}
+	return time.Now()
+}
+
+func TestProcessorRecoversFromPanic(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	clock := &panickingClock{}
+	var mu sync.Mutex
+	var processed []string
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         map[string]uint{"default": 2, "low": 1},
+		retryDelayFunc: defaultDelayFunc,
+		depthAware:     true, // queues are ordered using the clock in the processor goroutine
+		clock:          clock,
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task.Type)
+		return nil
+	})
+	p.start()
+	atomic.StoreInt32(&clock.armed, 1)
+	time.Sleep(100 * time.Millisecond)
+	if err := rdbClient.Enqueue(h.NewTaskMessage("send_email", nil)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(panicBackoff + time.Second)
+	p.terminate()
+
+	if atomic.LoadInt32(&clock.armed) != 0 {
+		t.Fatalf("clock never panicked")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff([]string{"send_email"}, processed); diff != "" {
+		t.Errorf("mismatch found in processed tasks after panic; (-want, +got)\n%s", diff)
+	}
+	if !strings.Contains(buf.String(), "[ERROR] processor recovered from panic: clock is broken") {
+		t.Errorf("log output does not contain the recovered panic; got:\n%s", buf.String())
+	}
+}
+
+func TestProcessorRecoversFromPanicAfterDequeue(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	clock := &panickingClock{}
+	var mu sync.Mutex
+	var processed []string
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    1,
+		queues:         defaultQueueConfig,
+		typeLimits:     map[string]int{"send_email": 1},
+		retryDelayFunc: defaultDelayFunc,
+		clock:          clock, // the clock is first used in the processor goroutine after the tokens are acquired
+	})
+	p.handler = HandlerFunc(func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task.Type)
+		return nil
+	})
+	msg := h.NewTaskMessage("send_email", nil)
+	msg.SerialKey = "user:1"
+	atomic.StoreInt32(&clock.armed, 1)
+	if err := rdbClient.Enqueue(msg); err != nil {
+		t.Fatal(err)
+	}
+	p.start()
+	time.Sleep(panicBackoff + time.Second)
+	p.terminate()
+
+	if atomic.LoadInt32(&clock.armed) != 0 {
+		t.Fatalf("clock never panicked")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Note: The task is processed only if it's requeued, and the weight,
+	// the type token and the serial key are released after the panic.
+	if diff := cmp.Diff([]string{"send_email"}, processed); diff != "" {
+		t.Errorf("mismatch found in processed tasks after panic; (-want, +got)\n%s", diff)
+	}
+	if l := r.LLen(base.InProgressQueue).Val(); l != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.InProgressQueue, l)
+	}
+	if !strings.Contains(buf.String(), "[ERROR] processor recovered from panic: clock is broken") {
+		t.Errorf("log output does not contain the recovered panic; got:\n%s", buf.String())
 	}
 }
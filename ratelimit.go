@@ -0,0 +1,60 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out the calls of wait so that at most the given number
+// of callers proceed per second.
+//
+// Each caller reserves the next slot and waits for it, so that concurrent
+// callers are served in order without holding the lock while waiting.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // time of the next free slot
+}
+
+// newRateLimiter returns a rateLimiter allowing rate calls per second.
+// It returns nil if rate is not positive, which allows any call.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the caller is allowed to proceed or cancel is closed.
+// It reports whether the caller is allowed to proceed.
+func (l *rateLimiter) wait(cancel <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	d := slot.Sub(now)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(50) // one call every 20ms
+
+	const n = 10
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !l.wait(nil) {
+				t.Errorf("wait(nil) = false, want true")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed, min := time.Since(start), (n-1)*20*time.Millisecond; elapsed < min {
+		t.Errorf("%d calls took %v, want at least %v", n, elapsed, min)
+	}
+
+	// Canceled caller returns without waiting for its slot.
+	l = newRateLimiter(0.1)
+	l.wait(nil)
+	cancel := make(chan struct{})
+	close(cancel)
+	if l.wait(cancel) {
+		t.Errorf("canceled wait = true, want false")
+	}
+
+	// Nil limiter allows any call.
+	if l := newRateLimiter(0); l != nil || !l.wait(nil) {
+		t.Errorf("newRateLimiter(0) = %v, want nil limiter allowing any call", l)
+	}
+}
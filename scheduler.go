@@ -5,7 +5,7 @@
 package asynq
 
 import (
-	"log"
+	"sync"
 	"time"
 
 	"github.com/hibiken/asynq/internal/rdb"
@@ -20,25 +20,61 @@ type scheduler struct {
 	// poll interval on average
 	avgInterval time.Duration
 
-	// list of queues to move the tasks into.
+	// list of queues to move the tasks into, updated by setQueues.
+	// Guarded by mu.
+	mu     sync.Mutex
 	qnames []string
+
+	// retryLimit is the max number of due retry tasks to move into each
+	// queue per retryInterval. Zero or negative means no limit, in which
+	// case retry tasks are moved along with scheduled tasks.
+	retryLimit    int
+	retryInterval time.Duration
+
+	// forwardDeferred specifies whether to move the due tasks in the
+	// deferred dead queue into the queues.
+	forwardDeferred bool
+
+	// requeueInvisible specifies whether to move the tasks whose visibility
+	// timeout has elapsed back to their queues.
+	requeueInvisible bool
+
+	logger *logger
 }
 
 func newScheduler(r *rdb.RDB, avgInterval time.Duration, qcfg map[string]uint) *scheduler {
-	var qnames []string
-	for q := range qcfg {
-		qnames = append(qnames, q)
-	}
 	return &scheduler{
 		rdb:         r,
 		done:        make(chan struct{}),
 		avgInterval: avgInterval,
-		qnames:      qnames,
+		qnames:      queueNames(qcfg),
+		logger:      defaultLogger,
 	}
 }
 
+func queueNames(qcfg map[string]uint) []string {
+	var qnames []string
+	for q := range qcfg {
+		qnames = append(qnames, q)
+	}
+	return qnames
+}
+
+// setQueues replaces the queues to move the tasks into with the ones in qcfg.
+func (s *scheduler) setQueues(qcfg map[string]uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.qnames = queueNames(qcfg)
+}
+
+func (s *scheduler) queues() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.qnames
+}
+
 func (s *scheduler) terminate() {
-	log.Println("[INFO] Scheduler shutting down...")
+	s.logger.printf("[INFO] Scheduler shutting down...")
 	// Signal the scheduler goroutine to stop polling.
 	s.done <- struct{}{}
 }
@@ -46,20 +82,67 @@ func (s *scheduler) terminate() {
 // start starts the "scheduler" goroutine.
 func (s *scheduler) start() {
 	go func() {
+		// Note: Use a ticker rather than time.After in the loop, otherwise
+		// the timer is reset whenever retryTick fires first and exec never
+		// runs if retryInterval is shorter than avgInterval.
+		ticker := time.NewTicker(s.avgInterval)
+		defer ticker.Stop()
+		var retryTick <-chan time.Time
+		if s.retryLimit > 0 {
+			retryTicker := time.NewTicker(s.retryInterval)
+			defer retryTicker.Stop()
+			retryTick = retryTicker.C
+		}
 		for {
 			select {
 			case <-s.done:
-				log.Println("[INFO] Scheduler done.")
+				s.logger.printf("[INFO] Scheduler done.")
 				return
-			case <-time.After(s.avgInterval):
+			case <-ticker.C:
 				s.exec()
+			case <-retryTick:
+				s.forwardRetry()
 			}
 		}
 	}()
 }
 
 func (s *scheduler) exec() {
-	if err := s.rdb.CheckAndEnqueue(s.qnames...); err != nil {
-		log.Printf("[ERROR] could not forward scheduled tasks: %v\n", err)
+	qnames := s.queues()
+	if _, err := s.rdb.DeleteExpired(); err != nil {
+		s.logger.printf("[ERROR] could not delete expired tasks: %v\n", err)
+	}
+	if n, err := s.rdb.KillExpiredDependents(); err != nil {
+		s.logger.printf("[ERROR] could not kill tasks waiting for their dependency too long: %v\n", err)
+	} else if n > 0 {
+		s.logger.printf("[WARN] Killed %d tasks waiting for their dependency past the expiration.\n", n)
+	}
+	if s.requeueInvisible {
+		if n, err := s.rdb.RequeueInvisible(); err != nil {
+			s.logger.printf("[ERROR] could not requeue invisible tasks: %v\n", err)
+		} else if n > 0 {
+			s.logger.printf("[INFO] Moved %d tasks past their visibility timeout back to queue.\n", n)
+		}
+	}
+	if s.forwardDeferred {
+		if err := s.rdb.ForwardDeferred(qnames...); err != nil {
+			s.logger.printf("[ERROR] could not forward deferred dead tasks: %v\n", err)
+		}
+	}
+	if s.retryLimit > 0 {
+		if err := s.rdb.ForwardScheduled(qnames...); err != nil {
+			s.logger.printf("[ERROR] could not forward scheduled tasks: %v\n", err)
+		}
+		return
+	}
+	if err := s.rdb.CheckAndEnqueue(qnames...); err != nil {
+		s.logger.printf("[ERROR] could not forward scheduled tasks: %v\n", err)
+	}
+}
+
+// forwardRetry moves at most retryLimit due retry tasks into each queue.
+func (s *scheduler) forwardRetry() {
+	if _, err := s.rdb.ForwardRetry(s.retryLimit, s.queues()...); err != nil {
+		s.logger.printf("[ERROR] could not forward retry tasks: %v\n", err)
 	}
 }
@@ -89,3 +89,74 @@ func TestScheduler(t *testing.T) {
 		}
 	}
 }
+
+func TestSchedulerRetryPromotionLimit(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	// Note: Poll interval is long enough not to interfere with the throttle.
+	s := newScheduler(rdbClient, time.Hour, map[string]uint{"default": 2, "low": 1})
+	s.retryLimit = 5
+	s.retryInterval = 500 * time.Millisecond
+
+	due := float64(time.Now().Add(-time.Minute).Unix())
+	var entries []h.ZSetEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, h.ZSetEntry{Msg: h.NewTaskMessage("sync", nil), Score: due})
+	}
+	for i := 0; i < 3; i++ {
+		entries = append(entries, h.ZSetEntry{Msg: h.NewTaskMessageWithQueue("sync", nil, "low"), Score: due})
+	}
+	h.SeedRetryQueue(t, r, entries)
+
+	s.start()
+	defer s.terminate()
+
+	// wait is measured from the start of the scheduler.
+	tests := []struct {
+		wait        time.Duration
+		wantDefault int
+		wantLow     int
+	}{
+		{250 * time.Millisecond, 0, 0},
+		{750 * time.Millisecond, 5, 3},
+		{1250 * time.Millisecond, 10, 3},
+		{2250 * time.Millisecond, 20, 3},
+	}
+	start := time.Now()
+	for _, tc := range tests {
+		time.Sleep(tc.wait - time.Since(start))
+		if got := len(h.GetEnqueuedMessages(t, r)); got != tc.wantDefault {
+			t.Errorf("after %v, %q has %d tasks, want %d", tc.wait, base.DefaultQueue, got, tc.wantDefault)
+		}
+		if got := len(h.GetEnqueuedMessages(t, r, "low")); got != tc.wantLow {
+			t.Errorf("after %v, %q has %d tasks, want %d", tc.wait, base.QueueKey("low"), got, tc.wantLow)
+		}
+	}
+	if got := len(h.GetRetryMessages(t, r)); got != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.RetryQueue, got)
+	}
+}
+
+func TestSchedulerRetryPromotionLimitForwardsScheduled(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+	// Note: Retry tasks are promoted more often than scheduled tasks,
+	// which must still be promoted at the poll interval.
+	s := newScheduler(rdbClient, 500*time.Millisecond, map[string]uint{"default": 1})
+	s.retryLimit = 5
+	s.retryInterval = 100 * time.Millisecond
+
+	msg := h.NewTaskMessage("send_email", nil)
+	h.SeedScheduledQueue(t, r, []h.ZSetEntry{{Msg: msg, Score: float64(time.Now().Add(-time.Minute).Unix())}})
+
+	s.start()
+	defer s.terminate()
+	time.Sleep(time.Second)
+
+	if diff := cmp.Diff([]*base.TaskMessage{msg}, h.GetEnqueuedMessages(t, r)); diff != "" {
+		t.Errorf("mismatch found in %q; (-want,+got)\n%s", base.DefaultQueue, diff)
+	}
+	if got := len(h.GetScheduledMessages(t, r)); got != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.ScheduledQueue, got)
+	}
+}
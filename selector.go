@@ -0,0 +1,82 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueueSelector determines the order in which the background checks
+// the queues for a task to process.
+//
+// Next is called with the queues to process and their priority levels
+// each time the background pulls out a task, and returns the names of the
+// queues to check, in order. The task is pulled out of the first non-empty
+// queue; queues missing from the result are not checked for the time.
+//
+// Next is called from a single goroutine, and must not retain or modify
+// the map.
+type QueueSelector interface {
+	Next(queues map[string]uint) []string
+}
+
+// WeightedSelector is a QueueSelector which orders the queues randomly,
+// with the probability of each queue to come first proportional to its
+// priority level. It's used by default.
+type WeightedSelector struct {
+	// Rand is the source of randomness to order the queues.
+	// Set it with a fixed seed to get a reproducible order, e.g. in tests.
+	//
+	// If nil, a source seeded with the current time shared by the package
+	// is used.
+	Rand *rand.Rand
+}
+
+// selectorRand is the source of WeightedSelector with a nil Rand.
+// rand.Rand is not safe for concurrent use, so it's guarded by mu.
+var selectorRand = struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Next returns the queue names in a random order weighted by priority.
+func (s WeightedSelector) Next(queues map[string]uint) []string {
+	// Note: Sort the names so that the order only depends on s.Rand,
+	// not on the iteration order of the map.
+	qnames := make([]string, 0, len(queues))
+	for qname := range queues {
+		qnames = append(qnames, qname)
+	}
+	sort.Strings(qnames)
+	var names []string
+	for _, qname := range qnames {
+		for i := 0; i < int(queues[qname]); i++ {
+			names = append(names, qname)
+		}
+	}
+	swap := func(i, j int) { names[i], names[j] = names[j], names[i] }
+	if s.Rand != nil {
+		s.Rand.Shuffle(len(names), swap)
+	} else {
+		selectorRand.mu.Lock()
+		selectorRand.r.Shuffle(len(names), swap)
+		selectorRand.mu.Unlock()
+	}
+	return uniq(names, len(queues))
+}
+
+// StrictSelector is a QueueSelector which orders the queues by priority,
+// highest first, so that tasks in lower priority queues are processed only
+// when the queues with higher priorities are empty.
+// It's used if StrictPriority is set in Config.
+type StrictSelector struct{}
+
+// Next returns the queue names sorted by priority in descending order.
+func (StrictSelector) Next(queues map[string]uint) []string {
+	return sortByPriority(queues)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import "sync"
+
+// weightedSema is a weighted semaphore with a total capacity, from which
+// each worker acquires the weight of the task it processes.
+//
+// Waiters are served in FIFO order so that a heavy task is not starved
+// by lighter tasks acquiring the capacity as soon as it's released.
+//
+// The capacity can be changed with resize while the semaphore is used.
+type weightedSema struct {
+	mu      sync.Mutex
+	size    int64
+	cur     int64
+	waiters []*semaWaiter
+}
+
+type semaWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newWeightedSema(size int64) *weightedSema {
+	return &weightedSema{size: size}
+}
+
+// capacity returns the total weight which can be acquired at the same time.
+func (s *weightedSema) capacity() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// resize changes the capacity to the given size. Growing the capacity wakes
+// up the waiters which fit, and shrinking it doesn't affect the weight
+// already held; it takes effect as the weight is released.
+func (s *weightedSema) resize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	s.notify()
+}
+
+// clampWeight returns n bounded below by 1.
+func clampWeight(n int64) int64 {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// fits reports whether the weight n can be acquired now.
+// A weight greater than the capacity fits if no weight is held, so that
+// any weight can be acquired eventually.
+// It must be called with s.mu held.
+func (s *weightedSema) fits(n int64) bool {
+	return s.cur+n <= s.size || s.cur == 0
+}
+
+// acquire acquires the given weight, blocking until it's available or
+// cancel is closed. It reports whether the weight was acquired.
+func (s *weightedSema) acquire(n int64, cancel <-chan struct{}) bool {
+	n = clampWeight(n)
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.fits(n) {
+		s.cur += n
+		s.mu.Unlock()
+		return true
+	}
+	w := &semaWaiter{n: n, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-cancel:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Acquired right before canceled, give it back.
+			s.cur -= n
+			s.notify()
+		default:
+			for i, x := range s.waiters {
+				if x == w {
+					s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+					break
+				}
+			}
+			// The waiter may have been blocking the ones behind it.
+			s.notify()
+		}
+		return false
+	}
+}
+
+// release releases the given weight acquired with acquire.
+func (s *weightedSema) release(n int64) {
+	n = clampWeight(n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	if s.cur < 0 {
+		panic("asynq: semaphore released more than held")
+	}
+	s.notify()
+}
+
+// notify wakes up the waiters in order while their weight fits.
+// It must be called with s.mu held.
+func (s *weightedSema) notify() {
+	for len(s.waiters) > 0 {
+		w := s.waiters[0]
+		if !s.fits(w.n) {
+			return
+		}
+		s.cur += w.n
+		s.waiters = s.waiters[1:]
+		close(w.ready)
+	}
+}
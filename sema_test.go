@@ -0,0 +1,103 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeightedSema(t *testing.T) {
+	s := newWeightedSema(4)
+	if !s.acquire(3, nil) {
+		t.Fatalf("acquire(3) = false, want true")
+	}
+
+	// A heavy waiter is served before a light one arriving after it.
+	heavy := make(chan struct{})
+	go func() {
+		s.acquire(2, nil)
+		close(heavy)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel := make(chan struct{})
+	light := make(chan bool)
+	go func() { light <- s.acquire(1, cancel) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-heavy:
+		t.Fatalf("acquire(2) returned with 3 of 4 held")
+	case <-light:
+		t.Fatalf("acquire(1) returned ahead of the waiter before it")
+	default:
+	}
+
+	s.release(3)
+	select {
+	case <-heavy:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire(2) did not return after release")
+	}
+	if got := <-light; !got {
+		t.Fatalf("acquire(1) = false, want true with 2 of 4 held")
+	}
+
+	// Canceled waiter does not hold the weight.
+	cancel = make(chan struct{})
+	done := make(chan bool)
+	go func() { done <- s.acquire(4, cancel) }()
+	time.Sleep(50 * time.Millisecond)
+	close(cancel)
+	if got := <-done; got {
+		t.Fatalf("canceled acquire(4) = true, want false")
+	}
+	s.release(2)
+	s.release(1)
+
+	// Weight greater than the capacity is clamped to the capacity.
+	if !s.acquire(10, nil) {
+		t.Fatalf("acquire(10) = false, want true")
+	}
+	s.release(10)
+	if s.cur != 0 {
+		t.Errorf("held weight = %d after releasing all, want 0", s.cur)
+	}
+}
+
+func TestWeightedSemaResize(t *testing.T) {
+	s := newWeightedSema(2)
+	s.acquire(2, nil)
+
+	// Growing wakes up the waiters which fit.
+	done := make(chan bool)
+	go func() { done <- s.acquire(2, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	s.resize(4)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire(2) did not return after growing the capacity to 4")
+	}
+
+	// Shrinking takes effect as the weight is released.
+	s.resize(1)
+	go func() { done <- s.acquire(1, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	s.release(2)
+	select {
+	case <-done:
+		t.Fatalf("acquire(1) returned with 2 held after shrinking the capacity to 1")
+	default:
+	}
+	s.release(2)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire(1) did not return after releasing all")
+	}
+	if got := s.capacity(); got != 1 {
+		t.Errorf("capacity() = %d, want 1", got)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServeMux is a multiplexer for asynchronous tasks.
+// It matches the type of each task against a list of registered patterns
+// and calls the handler for the pattern that most closely matches the
+// task's type name.
+//
+// Longer patterns take precedence over shorter ones, so that if there are
+// handlers registered for both "images" and "images:thumbnails",
+// the latter handler will be called for tasks with a type name beginning with
+// "images:thumbnails" and the former will receive tasks with type name beginning
+// with "images".
+//
+// Tasks whose type name matches none of the patterns are passed to the
+// default handler of their queue registered with HandleQueueDefault, or
+// else to the default handler registered with HandleDefault. That is,
+// a handler is resolved in the following order:
+//
+//  1. the handler for the pattern equal to the type name
+//  2. the handler for the longest pattern the type name begins with
+//  3. the default handler of the queue of the task
+//  4. the default handler
+//
+// If none of them is registered, the task is passed to NotFoundHandler.
+//
+// Handlers can be registered while the background is running the mux
+// (e.g., by plugins loaded after the start). A registration takes effect
+// for the tasks dispatched after Handle returns.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[string]muxEntry
+	es []muxEntry // slice of entries sorted from longest to shortest.
+
+	// queueDefaults maps queue names to their default handlers.
+	queueDefaults map[string]Handler
+
+	// defaultHandler is nil if not registered.
+	defaultHandler Handler
+}
+
+type muxEntry struct {
+	h       Handler
+	pattern string
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return new(ServeMux)
+}
+
+// ProcessTask dispatches the task to the handler whose
+// pattern most closely matches the task type.
+func (mux *ServeMux) ProcessTask(task *Task) error {
+	h, _ := mux.Handler(task)
+	return h.ProcessTask(task)
+}
+
+// Handler returns the handler to use for the given task.
+// It always returns a non-nil handler.
+//
+// Handler also returns the registered pattern that matches the task.
+//
+// If there is no registered handler that applies to the task,
+// handler returns a 'not found' handler which returns an error.
+// The pattern is empty for the default handlers and the 'not found' handler.
+func (mux *ServeMux) Handler(t *Task) (h Handler, pattern string) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	h, pattern = mux.match(t.Type)
+	if h != nil {
+		return h, pattern
+	}
+	// Note: The queue is unknown if the task is not passed by the background.
+	if qname, ok := taskQueue(t); ok {
+		if h, ok := mux.queueDefaults[qname]; ok {
+			return h, ""
+		}
+	}
+	if mux.defaultHandler != nil {
+		return mux.defaultHandler, ""
+	}
+	return NotFoundHandler(), ""
+}
+
+// Find a handler on a handler map given a typename string.
+// Most-specific (longest) pattern wins.
+func (mux *ServeMux) match(typename string) (h Handler, pattern string) {
+	// Check for exact match first.
+	v, ok := mux.m[typename]
+	if ok {
+		return v.h, v.pattern
+	}
+
+	// Check for longest valid match.
+	// mux.es contains all patterns from longest to shortest.
+	for _, e := range mux.es {
+		if strings.HasPrefix(typename, e.pattern) {
+			return e.h, e.pattern
+		}
+	}
+	return nil, ""
+}
+
+// Handle registers the handler for the given pattern.
+// If a handler already exists for pattern, Handle panics.
+//
+// It's safe to call Handle concurrently with the dispatch of tasks.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if pattern == "" {
+		panic("asynq: invalid pattern")
+	}
+	if handler == nil {
+		panic("asynq: nil handler")
+	}
+	if _, exist := mux.m[pattern]; exist {
+		panic("asynq: multiple registrations for " + pattern)
+	}
+
+	if mux.m == nil {
+		mux.m = make(map[string]muxEntry)
+	}
+	e := muxEntry{h: handler, pattern: pattern}
+	mux.m[pattern] = e
+	mux.es = appendSorted(mux.es, e)
+}
+
+// HandleDefault registers the handler for the tasks which no other handler
+// applies to. If a default handler already exists, HandleDefault panics.
+//
+// It's safe to call HandleDefault concurrently with the dispatch of tasks.
+func (mux *ServeMux) HandleDefault(handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if handler == nil {
+		panic("asynq: nil handler")
+	}
+	if mux.defaultHandler != nil {
+		panic("asynq: multiple registrations for default handler")
+	}
+	mux.defaultHandler = handler
+}
+
+// HandleQueueDefault registers the handler for the tasks in the given queue
+// whose type name matches none of the patterns, e.g. for a queue which
+// serves as a sink of various types of tasks.
+// If a default handler already exists for the queue, HandleQueueDefault panics.
+//
+// It's safe to call HandleQueueDefault concurrently with the dispatch of tasks.
+func (mux *ServeMux) HandleQueueDefault(qname string, handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	qname = strings.ToLower(qname)
+	if qname == "" {
+		panic("asynq: invalid queue name")
+	}
+	if handler == nil {
+		panic("asynq: nil handler")
+	}
+	if _, exist := mux.queueDefaults[qname]; exist {
+		panic("asynq: multiple registrations for default handler of queue " + qname)
+	}
+	if mux.queueDefaults == nil {
+		mux.queueDefaults = make(map[string]Handler)
+	}
+	mux.queueDefaults[qname] = handler
+}
+
+// coversQueue reports whether a handler applies to the tasks of any type
+// in the given queue, i.e. whether a default handler of the queue or
+// the default handler is registered.
+func (mux *ServeMux) coversQueue(qname string) bool {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if mux.defaultHandler != nil {
+		return true
+	}
+	_, ok := mux.queueDefaults[strings.ToLower(qname)]
+	return ok
+}
+
+func appendSorted(es []muxEntry, e muxEntry) []muxEntry {
+	n := len(es)
+	i := sort.Search(n, func(i int) bool {
+		return len(es[i].pattern) < len(e.pattern)
+	})
+	if i == n {
+		return append(es, e)
+	}
+	// we now know that i points at where we want to insert.
+	es = append(es, muxEntry{}) // try to grow the slice in place, any entry works.
+	copy(es[i+1:], es[i:])      // shift shorter entries down.
+	es[i] = e
+	return es
+}
+
+// HandleFunc registers the handler function for the given pattern.
+func (mux *ServeMux) HandleFunc(pattern string, handler func(*Task) error) {
+	if handler == nil {
+		panic("asynq: nil handler")
+	}
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// ErrHandlerNotFound indicates that no handler is registered for the task type.
+//
+// By default, the background kills a task immediately if the handler
+// returns an error wrapping ErrHandlerNotFound. See Config.RetryUnhandled.
+var ErrHandlerNotFound = errors.New("handler not found")
+
+// NotFound returns an error indicating that the handler was not found for the given task.
+func NotFound(task *Task) error {
+	return fmt.Errorf("%w for task type %q", ErrHandlerNotFound, task.Type)
+}
+
+// NotFoundHandler returns a simple task handler that returns a "not found" error.
+func NotFoundHandler() Handler { return HandlerFunc(NotFound) }
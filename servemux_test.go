@@ -0,0 +1,257 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	h "github.com/hibiken/asynq/internal/asynqtest"
+	"github.com/hibiken/asynq/internal/base"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+var called string
+
+// makeFakeHandler returns a handler that updates the global called variable
+// to the given identity.
+func makeFakeHandler(identity string) Handler {
+	return HandlerFunc(func(t *Task) error {
+		called = identity
+		return nil
+	})
+}
+
+// A list of pattern, handler pair that is registered with mux.
+var serveMuxRegister = []struct {
+	pattern string
+	h       Handler
+}{
+	{"email:", makeFakeHandler("default email handler")},
+	{"email:signup", makeFakeHandler("signup email handler")},
+	{"csv:export", makeFakeHandler("csv export handler")},
+}
+
+var serveMuxTests = []struct {
+	typename string // task's type name
+	want     string // identifier of the handler that should be called
+}{
+	{"email:signup", "signup email handler"},
+	{"csv:export", "csv export handler"},
+	{"email:daily", "default email handler"},
+}
+
+func TestServeMux(t *testing.T) {
+	mux := NewServeMux()
+	for _, e := range serveMuxRegister {
+		mux.Handle(e.pattern, e.h)
+	}
+
+	for _, tc := range serveMuxTests {
+		called = "" // reset to zero value
+
+		task := NewTask(tc.typename, nil)
+		if err := mux.ProcessTask(task); err != nil {
+			t.Fatal(err)
+		}
+
+		if called != tc.want {
+			t.Errorf("%q handler was called for task %q, want %q to be called", called, task.Type, tc.want)
+		}
+	}
+}
+
+func TestServeMuxRegisterNilHandler(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expected call to mux.HandleFunc to panic")
+		}
+	}()
+
+	mux := NewServeMux()
+	mux.HandleFunc("email:signup", nil)
+}
+
+func TestServeMuxRegisterEmptyPattern(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expected call to mux.HandleFunc to panic")
+		}
+	}()
+
+	mux := NewServeMux()
+	mux.Handle("", makeFakeHandler("email"))
+}
+
+func TestServeMuxRegisterDuplicatePattern(t *testing.T) {
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("expected call to mux.HandleFunc to panic")
+		}
+	}()
+
+	mux := NewServeMux()
+	mux.Handle("email", makeFakeHandler("email"))
+	mux.Handle("email", makeFakeHandler("email:default"))
+}
+
+var notFoundTests = []struct {
+	typename string // task's type name
+}{
+	{"image:minimize"},
+	{"csv:export"}, // registered pattern is "csv:export:"
+}
+
+func TestServeMuxNotFound(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("email:", makeFakeHandler("default email handler"))
+	mux.Handle("csv:export:", makeFakeHandler("csv export handler"))
+
+	for _, tc := range notFoundTests {
+		task := NewTask(tc.typename, nil)
+		err := mux.ProcessTask(task)
+		if !errors.Is(err, ErrHandlerNotFound) {
+			t.Errorf("ProcessTask did not return ErrHandlerNotFound for task %q; got %v", task.Type, err)
+		}
+		want := fmt.Sprintf("handler not found for task type %q", tc.typename)
+		if err.Error() != want {
+			t.Errorf("ProcessTask returned error %q, want %q", err.Error(), want)
+		}
+	}
+}
+
+func TestServeMuxDefaultHandlers(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	mux := NewServeMux()
+	var mu sync.Mutex
+	got := make(map[string]string) // task type -> handler
+	record := func(identity string) Handler {
+		return HandlerFunc(func(task *Task) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got[task.Type] = identity
+			return nil
+		})
+	}
+	mux.Handle("email:signup", record("signup email handler"))
+	mux.Handle("email:", record("email handler"))
+	mux.HandleQueueDefault("Sink", record("sink default handler"))
+	mux.HandleDefault(record("default handler"))
+
+	msgs := []*base.TaskMessage{
+		h.NewTaskMessageWithQueue("email:signup", nil, "sink"), // exact type
+		h.NewTaskMessageWithQueue("email:daily", nil, "sink"),  // prefix
+		h.NewTaskMessageWithQueue("audit:login", nil, "sink"),  // queue default
+		h.NewTaskMessage("csv:export", nil),                    // default
+	}
+	for _, msg := range msgs {
+		if err := rdbClient.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         map[string]uint{"default": 1, "sink": 1},
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = mux
+	p.start()
+	time.Sleep(time.Second)
+	p.terminate()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]string{
+		"email:signup": "signup email handler",
+		"email:daily":  "email handler",
+		"audit:login":  "sink default handler",
+		"csv:export":   "default handler",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("handlers called mismatch; (-want, +got)\n%s", diff)
+	}
+}
+
+func TestServeMuxRegisterDuplicateDefault(t *testing.T) {
+	tests := []struct {
+		desc     string
+		register func(mux *ServeMux)
+	}{
+		{"default", func(mux *ServeMux) { mux.HandleDefault(makeFakeHandler("default")) }},
+		{"queue default", func(mux *ServeMux) { mux.HandleQueueDefault("sink", makeFakeHandler("sink")) }},
+	}
+	for _, tc := range tests {
+		func() {
+			defer func() {
+				if err := recover(); err == nil {
+					t.Errorf("%s: expected the second registration to panic", tc.desc)
+				}
+			}()
+			mux := NewServeMux()
+			tc.register(mux)
+			tc.register(mux)
+		}()
+	}
+}
+
+func TestServeMuxHandleAfterStart(t *testing.T) {
+	r := setup(t)
+	rdbClient := rdb.NewRDB(r)
+
+	mux := NewServeMux()
+	var mu sync.Mutex
+	var processed []string
+	record := func(task *Task) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, task.Type)
+		return nil
+	}
+	mux.HandleFunc("email:", record)
+
+	p := newProcessor(processorParams{
+		rdb:            rdbClient,
+		concurrency:    10,
+		queues:         defaultQueueConfig,
+		retryDelayFunc: defaultDelayFunc,
+	})
+	p.handler = mux
+	p.start()
+	defer p.terminate()
+
+	// Note: Register handlers while tasks are dispatched,
+	// to find data races with go test -race.
+	for i := 0; i < 10; i++ {
+		if err := rdbClient.Enqueue(h.NewTaskMessage("email:signup", nil)); err != nil {
+			t.Fatal(err)
+		}
+		mux.HandleFunc(fmt.Sprintf("plugin%d:", i), record)
+	}
+	mux.HandleFunc("csv:export", record)
+	if err := rdbClient.Enqueue(h.NewTaskMessage("csv:export", nil)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	count := make(map[string]int)
+	for _, typename := range processed {
+		count[typename]++
+	}
+	if want := map[string]int{"email:signup": 10, "csv:export": 1}; !cmp.Equal(want, count) {
+		t.Errorf("processed %v, want 10 email:signup tasks and a csv:export task", processed)
+	}
+	if n := r.ZCard(base.DeadQueue).Val(); n != 0 {
+		t.Errorf("%q has %d tasks, want 0", base.DeadQueue, n)
+	}
+}
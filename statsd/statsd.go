@@ -0,0 +1,208 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+/*
+Package statsd provides an asynq.MetricsCollector which sends the metrics of
+the processed tasks to StatsD over UDP.
+
+The metrics are tagged with the queue and the type of the task in the
+DogStatsD format (e.g., "asynq.processed:1|c|#queue:default,type:email"):
+
+	<prefix>processed  counter of the tasks processed successfully
+	<prefix>failed     counter of the failed processing of the tasks
+	<prefix>retried    counter of the tasks sent to the retry queue
+	<prefix>killed     counter of the tasks sent to the dead queue
+	<prefix>duration   timer of the handler in milliseconds
+
+Example:
+
+	c, err := statsd.NewCollector("localhost:8125", &statsd.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	bg := asynq.NewBackground(r, &asynq.Config{Metrics: c})
+
+The metrics are buffered and flushed periodically, so that a packet carries
+as many metric lines as fit in it.
+*/
+package statsd
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Config specifies the collector's behavior.
+type Config struct {
+	// Prefix of the metric names.
+	//
+	// If unset, "asynq." is used.
+	Prefix string
+
+	// Interval to flush the buffered metrics.
+	//
+	// If set to zero or negative value, one second is used.
+	FlushInterval time.Duration
+
+	// Maximum size of a packet in bytes. The buffered metrics are flushed
+	// before a metric line would make the packet exceed the size.
+	//
+	// If set to zero or negative value, 1432 is used, which fits in
+	// an ethernet frame.
+	MaxPacketSize int
+}
+
+const (
+	defaultPrefix        = "asynq."
+	defaultFlushInterval = time.Second
+	defaultMaxPacketSize = 1432
+)
+
+// Collector sends the metrics of the processed tasks to StatsD.
+// It's safe for concurrent use.
+type Collector struct {
+	conn       net.Conn
+	prefix     string
+	maxPacket  int
+	done       chan struct{}
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
+	closeError error
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+var _ asynq.MetricsCollector = (*Collector)(nil)
+
+// NewCollector returns a collector sending the metrics to the StatsD server
+// at the given address, e.g. "localhost:8125".
+//
+// Close has to be called to flush the buffered metrics and release the
+// resources of the collector.
+func NewCollector(addr string, cfg *Config) (*Collector, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = defaultFlushInterval
+	}
+	maxPacket := cfg.MaxPacketSize
+	if maxPacket <= 0 {
+		maxPacket = defaultMaxPacketSize
+	}
+	c := &Collector{
+		conn:      conn,
+		prefix:    prefix,
+		maxPacket: maxPacket,
+		done:      make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				// Note: Metrics are lost if the write fails, there's
+				// no one to report the error to.
+				c.Flush()
+			}
+		}
+	}()
+	return c, nil
+}
+
+// TaskProcessed increments the processed counter.
+func (c *Collector) TaskProcessed(queue, tasktype string) {
+	c.add("processed", "1|c", queue, tasktype)
+}
+
+// TaskFailed increments the failed counter.
+func (c *Collector) TaskFailed(queue, tasktype string) {
+	c.add("failed", "1|c", queue, tasktype)
+}
+
+// TaskRetried increments the retried counter.
+func (c *Collector) TaskRetried(queue, tasktype string) {
+	c.add("retried", "1|c", queue, tasktype)
+}
+
+// TaskKilled increments the killed counter.
+func (c *Collector) TaskKilled(queue, tasktype string) {
+	c.add("killed", "1|c", queue, tasktype)
+}
+
+// TaskDuration records the duration to the duration timer.
+func (c *Collector) TaskDuration(queue, tasktype string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	c.add("duration", strconv.FormatFloat(ms, 'f', -1, 64)+"|ms", queue, tasktype)
+}
+
+// add buffers the metric line, flushing the buffer first if the line doesn't
+// fit in the packet.
+func (c *Collector) add(name, value, queue, tasktype string) {
+	line := c.prefix + name + ":" + value + "|#queue:" + tagValue(queue) + ",type:" + tagValue(tasktype)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf.Len() > 0 && c.buf.Len()+1+len(line) > c.maxPacket {
+		c.flush()
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.WriteString(line)
+}
+
+// tagValue replaces the characters which delimit the tags and the metrics
+// in the given value.
+var tagValue = strings.NewReplacer("|", "_", ",", "_", "#", "_", "\n", "_").Replace
+
+// Flush sends the buffered metrics.
+func (c *Collector) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// flush sends the buffered metrics in a packet.
+// It must be called with c.mu held.
+func (c *Collector) flush() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// Close flushes the buffered metrics and closes the connection.
+func (c *Collector) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		err := c.Flush()
+		if cerr := c.conn.Close(); err == nil {
+			err = cerr
+		}
+		c.closeError = err
+	})
+	return c.closeError
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// listen returns a fake StatsD server and a function to read
+// the next packet it received.
+func listen(t *testing.T) (net.PacketConn, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() []string {
+		t.Helper()
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("could not read packet: %v", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+	return conn, read
+}
+
+func TestCollector(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	c, err := NewCollector(conn.LocalAddr().String(), &Config{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.TaskProcessed("default", "send_email")
+	c.TaskFailed("critical", "charge")
+	c.TaskRetried("critical", "charge")
+	c.TaskKilled("low", "a|b,c")
+	c.TaskDuration("default", "send_email", 1500*time.Microsecond)
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush() returned error: %v", err)
+	}
+
+	want := []string{
+		"asynq.processed:1|c|#queue:default,type:send_email",
+		"asynq.failed:1|c|#queue:critical,type:charge",
+		"asynq.retried:1|c|#queue:critical,type:charge",
+		"asynq.killed:1|c|#queue:low,type:a_b_c",
+		"asynq.duration:1.5|ms|#queue:default,type:send_email",
+	}
+	if diff := cmp.Diff(want, read()); diff != "" {
+		t.Errorf("mismatch found in metric lines; (-want,+got)\n%s", diff)
+	}
+}
+
+func TestCollectorMaxPacketSize(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	line := "myapp.processed:1|c|#queue:default,type:send_email"
+	// Two lines fit in a packet, but not three.
+	c, err := NewCollector(conn.LocalAddr().String(), &Config{
+		Prefix:        "myapp.",
+		FlushInterval: time.Hour,
+		MaxPacketSize: 3*len(line) + 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.TaskProcessed("default", "send_email")
+	}
+	if got, want := read(), []string{line, line}; !cmp.Equal(want, got) {
+		t.Errorf("first packet = %v, want %v", got, want)
+	}
+	// Close flushes the rest.
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+	if got, want := read(), []string{line}; !cmp.Equal(want, got) {
+		t.Errorf("second packet = %v, want %v", got, want)
+	}
+}
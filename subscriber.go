@@ -0,0 +1,78 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package asynq
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+)
+
+// subscriber listens to the types of tasks to cancel, published by
+// "asynqmon cancel", and cancels the in-progress tasks of the types.
+type subscriber struct {
+	rdb *rdb.RDB
+
+	// cancel cancels the in-progress tasks of the given type.
+	cancel func(taskType string)
+
+	logger *logger
+
+	// channel to communicate back to the long running "subscriber" goroutine.
+	done chan struct{}
+}
+
+// subscribeRetryInterval is the duration to wait before subscribing again
+// if the subscription fails.
+const subscribeRetryInterval = 5 * time.Second
+
+func newSubscriber(r *rdb.RDB, cancel func(taskType string)) *subscriber {
+	return &subscriber{
+		rdb:    r,
+		cancel: cancel,
+		logger: defaultLogger,
+		done:   make(chan struct{}),
+	}
+}
+
+// terminate stops the "subscriber" goroutine.
+func (s *subscriber) terminate() {
+	s.logger.printf("[INFO] Subscriber shutting down...")
+	// Signal the subscriber goroutine to stop listening.
+	s.done <- struct{}{}
+}
+
+// start starts the "subscriber" goroutine.
+func (s *subscriber) start() {
+	go func() {
+		var pubsub *redis.PubSub
+		for {
+			var err error
+			pubsub, err = s.rdb.CancelationPubSub()
+			if err == nil {
+				break
+			}
+			s.logger.printf("[ERROR] could not subscribe to cancelation: %v\n", err)
+			select {
+			case <-s.done:
+				s.logger.printf("[INFO] Subscriber done.")
+				return
+			case <-time.After(subscribeRetryInterval):
+			}
+		}
+		ch := pubsub.Channel()
+		for {
+			select {
+			case <-s.done:
+				pubsub.Close()
+				s.logger.printf("[INFO] Subscriber done.")
+				return
+			case msg := <-ch:
+				s.cancel(msg.Payload)
+			}
+		}
+	}()
+}
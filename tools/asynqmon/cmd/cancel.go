@@ -0,0 +1,48 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [task type]",
+	Short: "Cancels all in-progress tasks of the given type",
+	Long: `Cancel (asynqmon cancel) will cancel all in-progress tasks of the given type
+on every running background instance.
+
+The canceled tasks are sent to the dead queue, from which they can be enqueued
+again with "asynqmon enq".
+Note: The handlers of the canceled tasks cannot be interrupted, so the workers
+are busy until the handlers return.
+
+Example: asynqmon cancel export_csv`,
+	Args: cobra.ExactArgs(1),
+	Run:  cancel,
+}
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+}
+
+func cancel(cmd *cobra.Command, args []string) {
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	}), namespace)
+	n, err := r.CancelByType(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signaled cancellation of %d in-progress tasks of type %q\n", n, args[0])
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
 	"github.com/spf13/cobra"
 )
 
@@ -23,13 +24,19 @@ The command takes one argument which specifies the task to delete.
 The task should be in either scheduled, retry or dead queue.
 Identifier for a task should be obtained by running "asynqmon ls" command.
 
-Example: asynqmon enq d:1575732274:bnogo8gt6toe23vhef0g`,
+Enqueued tasks can be deleted by specifying the queue with --queue option.
+
+Example: asynqmon del d:1575732274:bnogo8gt6toe23vhef0g
+Example: asynqmon del --queue=default bnogo8gt6toe23vhef0g`,
 	Args: cobra.ExactArgs(1),
 	Run:  del,
 }
 
+var delQueue string
+
 func init() {
 	rootCmd.AddCommand(delCmd)
+	delCmd.Flags().StringVarP(&delQueue, "queue", "q", "", "Queue to delete the enqueued task from")
 
 	// Here you will define your flags and configuration settings.
 
@@ -43,15 +50,19 @@ func init() {
 }
 
 func del(cmd *cobra.Command, args []string) {
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	}), namespace)
+	if delQueue != "" {
+		delEnqueued(r, delQueue, args[0])
+		return
+	}
 	id, score, qtype, err := parseQueryID(args[0])
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
-		Addr: uri,
-		DB:   db,
-	}))
 	switch qtype {
 	case "s":
 		err = r.DeleteScheduledTask(id, score)
@@ -69,3 +80,16 @@ func del(cmd *cobra.Command, args []string) {
 	}
 	fmt.Printf("Successfully deleted %v\n", args[0])
 }
+
+func delEnqueued(r *rdb.RDB, qname, taskID string) {
+	id, err := xid.FromString(taskID)
+	if err != nil {
+		fmt.Println("invalid id")
+		os.Exit(1)
+	}
+	if err := r.DeleteEnqueuedTask(qname, id); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully deleted %v from %q queue\n", taskID, qname)
+}
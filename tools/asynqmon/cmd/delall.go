@@ -48,7 +48,7 @@ func delall(cmd *cobra.Command, args []string) {
 		Addr: uri,
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 	var err error
 	switch args[0] {
 	case "scheduled":
@@ -51,10 +51,10 @@ func enq(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	r := rdb.NewRDB(redis.NewClient(&redis.Options{
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
 		Addr: uri,
 		DB:   db,
-	}))
+	}), namespace)
 	switch qtype {
 	case "s":
 		err = r.EnqueueScheduledTask(id, score)
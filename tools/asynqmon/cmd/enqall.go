@@ -26,14 +26,26 @@ The argument should be one of "scheduled", "retry", or "dead".
 The tasks enqueued by this command will be processed as soon as it
 gets dequeued by a processor.
 
-Example: asynqmon enqall dead -> Enqueues all tasks from the dead queue`,
+Tasks in the dead queue can be filtered by their type with --type option.
+Tasks in the retry queue can be filtered by the queue they belong to with --queue option.
+
+Example: asynqmon enqall dead -> Enqueues all tasks from the dead queue
+Example: asynqmon enqall dead --type=send_email -> Enqueues send_email tasks from the dead queue
+Example: asynqmon enqall retry --queue=critical -> Enqueues retry tasks of "critical" queue`,
 	ValidArgs: enqallValidArgs,
 	Args:      cobra.ExactValidArgs(1),
 	Run:       enqall,
 }
 
+var (
+	enqallType  string
+	enqallQueue string
+)
+
 func init() {
 	rootCmd.AddCommand(enqallCmd)
+	enqallCmd.Flags().StringVarP(&enqallType, "type", "t", "", "Type of the dead tasks to enqueue")
+	enqallCmd.Flags().StringVarP(&enqallQueue, "queue", "q", "", "Queue of the retry tasks to enqueue")
 
 	// Here you will define your flags and configuration settings.
 
@@ -51,16 +63,26 @@ func enqall(cmd *cobra.Command, args []string) {
 		Addr: uri,
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 	var n int64
 	var err error
 	switch args[0] {
 	case "scheduled":
 		n, err = r.EnqueueAllScheduledTasks()
 	case "retry":
-		n, err = r.EnqueueAllRetryTasks()
+		if enqallQueue != "" {
+			n, err = r.EnqueueRetryTasksInQueue(enqallQueue)
+		} else {
+			n, err = r.EnqueueAllRetryTasks()
+		}
 	case "dead":
-		n, err = r.EnqueueAllDeadTasks()
+		if enqallType != "" {
+			n, err = r.EnqueueDeadTasksWhere(func(t *rdb.DeadTask) bool {
+				return t.Type == enqallType
+			})
+		} else {
+			n, err = r.EnqueueAllDeadTasks()
+		}
 	default:
 		fmt.Printf("error: `asynqmon enqall [queue name]` only accepts %v as the argument.\n", enqallValidArgs)
 		os.Exit(1)
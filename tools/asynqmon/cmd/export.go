@@ -0,0 +1,56 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportSampleSize   int
+	exportPayloadLimit int
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export [queue name]",
+	Short: "Exports the state of a queue as JSON",
+	Long: `Export (asynqmon export) will print a JSON snapshot of the given queue,
+with the number of tasks and a sample of them in each state, e.g. to attach
+to a bug report.
+
+Payloads are redacted unless --payload-limit is given, in which case each
+payload is included truncated to the given number of bytes.
+
+Example: asynqmon export default --sample=20 > snapshot.json`,
+	Args: cobra.ExactArgs(1),
+	Run:  export,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().IntVar(&exportSampleSize, "sample", 10, "Max number of tasks to include in each state")
+	exportCmd.Flags().IntVar(&exportPayloadLimit, "payload-limit", 0, "Max number of bytes of each payload to include, payloads are redacted if zero")
+}
+
+func export(cmd *cobra.Command, args []string) {
+	c := redis.NewClient(&redis.Options{
+		Addr: readAddr(),
+		DB:   db,
+	})
+	r := rdb.NewRDBWithNamespace(c, namespace)
+
+	data, err := r.ExportQueueSnapshot(args[0], exportSampleSize, exportPayloadLimit)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+}
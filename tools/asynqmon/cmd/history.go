@@ -55,10 +55,10 @@ Usage: asynqmon history [num of days]
 
 	}
 	c := redis.NewClient(&redis.Options{
-		Addr: uri,
+		Addr: readAddr(),
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 
 	stats, err := r.HistoricalStats(n)
 	if err != nil {
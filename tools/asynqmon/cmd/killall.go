@@ -48,7 +48,7 @@ func killall(cmd *cobra.Command, args []string) {
 		Addr: uri,
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 	var n int64
 	var err error
 	switch args[0] {
@@ -19,7 +19,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var lsValidArgs = []string{"enqueued", "inprogress", "scheduled", "retry", "dead"}
+var lsValidArgs = []string{"enqueued", "inprogress", "stuck", "scheduled", "retry", "dead", "completed"}
 
 // lsCmd represents the ls command
 var lsCmd = &cobra.Command{
@@ -28,8 +28,14 @@ var lsCmd = &cobra.Command{
 	Long: `Ls (asynqmon ls) will list all tasks in the specified state in a table format.
 
 The command takes one argument which specifies the state of tasks.
-The argument value should be one of "enqueued", "inprogress", "scheduled",
-"retry", or "dead".
+The argument value should be one of "enqueued", "inprogress", "stuck",
+"scheduled", "retry", "dead", or "completed".
+
+Records of completed tasks are kept only if the background is configured
+with KeepCompleted.
+
+"stuck" lists the in-progress tasks which started longer ago than --older-than,
+if the background is configured with TrackStartTimes.
 
 Example:
 asynqmon ls dead -> Lists all tasks in dead state
@@ -37,13 +43,20 @@ asynqmon ls dead -> Lists all tasks in dead state
 Enqueued tasks can optionally be filtered by providing queue names after ":"
 Example:
 asynqmon ls enqueued:critical -> List tasks from critical queue only
+
+Stuck tasks can optionally be filtered by providing a queue name after ":"
+Example:
+asynqmon ls stuck:critical --older-than=1h -> List tasks of critical queue in progress for over an hour
 `,
 	Args: cobra.ExactValidArgs(1),
 	Run:  ls,
 }
 
+var lsOlderThan time.Duration
+
 func init() {
 	rootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().DurationVar(&lsOlderThan, "older-than", 10*time.Minute, "Min duration in progress of the stuck tasks to list")
 
 	// Here you will define your flags and configuration settings.
 
@@ -58,22 +71,30 @@ func init() {
 
 func ls(cmd *cobra.Command, args []string) {
 	c := redis.NewClient(&redis.Options{
-		Addr: uri,
+		Addr: readAddr(),
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 	parts := strings.Split(args[0], ":")
 	switch parts[0] {
 	case "enqueued":
 		listEnqueued(r, parts[1:]...)
 	case "inprogress":
 		listInProgress(r)
+	case "stuck":
+		var qname string
+		if len(parts) > 1 {
+			qname = parts[1]
+		}
+		listStuck(r, qname, lsOlderThan)
 	case "scheduled":
 		listScheduled(r)
 	case "retry":
 		listRetry(r)
 	case "dead":
 		listDead(r)
+	case "completed":
+		listCompleted(r)
 	default:
 		fmt.Printf("error: `asynqmon ls [task state]` only accepts %v as the argument.\n", lsValidArgs)
 		os.Exit(1)
@@ -159,6 +180,26 @@ func listInProgress(r *rdb.RDB) {
 	printTable(cols, printRows)
 }
 
+func listStuck(r *rdb.RDB, qname string, olderThan time.Duration) {
+	tasks, err := r.ListStuckTasks(qname, olderThan)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(tasks) == 0 {
+		fmt.Printf("No tasks in progress for over %v\n", olderThan)
+		return
+	}
+	cols := []string{"ID", "Type", "Payload", "In Progress For", "Queue"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, t := range tasks {
+			elapsed := fmt.Sprintf("%.0f seconds", time.Since(t.StartedAt).Seconds())
+			fmt.Fprintf(w, tmpl, t.ID, t.Type, t.Payload, elapsed, t.Queue)
+		}
+	}
+	printTable(cols, printRows)
+}
+
 func listScheduled(r *rdb.RDB) {
 	tasks, err := r.ListScheduled()
 	if err != nil {
@@ -189,11 +230,15 @@ func listRetry(r *rdb.RDB) {
 		fmt.Println("No retry tasks")
 		return
 	}
-	cols := []string{"ID", "Type", "Payload", "Retry In", "Last Error", "Retried", "Max Retry", "Queue"}
+	cols := []string{"ID", "Type", "Payload", "Retry In", "Delay", "Last Error", "Retried", "Max Retry", "Queue"}
 	printRows := func(w io.Writer, tmpl string) {
 		for _, t := range tasks {
 			retryIn := fmt.Sprintf("%.0f seconds", t.ProcessAt.Sub(time.Now()).Seconds())
-			fmt.Fprintf(w, tmpl, queryID(t.ID, t.Score, "r"), t.Type, t.Payload, retryIn, t.ErrorMsg, t.Retried, t.Retry, t.Queue)
+			delay := "-"
+			if t.Delay > 0 {
+				delay = t.Delay.String()
+			}
+			fmt.Fprintf(w, tmpl, queryID(t.ID, t.Score, "r"), t.Type, t.Payload, retryIn, delay, t.ErrorMsg, t.Retried, t.Retry, t.Queue)
 		}
 	}
 	printTable(cols, printRows)
@@ -218,6 +263,32 @@ func listDead(r *rdb.RDB) {
 	printTable(cols, printRows)
 }
 
+func listCompleted(r *rdb.RDB) {
+	tasks, err := r.ListCompleted()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(tasks) == 0 {
+		fmt.Println("No completed tasks")
+		return
+	}
+	cols := []string{"ID", "Type", "Completed", "Duration", "Queue", "Result"}
+	printRows := func(w io.Writer, tmpl string) {
+		for _, t := range tasks {
+			result := "-"
+			if t.Result != nil {
+				result = t.Result.Status
+				if t.Result.Message != "" {
+					result += ": " + t.Result.Message
+				}
+			}
+			fmt.Fprintf(w, tmpl, t.ID, t.Type, t.CompletedAt, t.Duration, t.Queue, result)
+		}
+	}
+	printTable(cols, printRows)
+}
+
 func printTable(cols []string, printRows func(w io.Writer, tmpl string)) {
 	format := strings.Repeat("%v\t", len(cols)) + "\n"
 	tw := new(tabwriter.Writer).Init(os.Stdout, 0, 8, 2, ' ', 0)
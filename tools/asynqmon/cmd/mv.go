@@ -0,0 +1,52 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+	"github.com/spf13/cobra"
+)
+
+// mvCmd represents the mv command
+var mvCmd = &cobra.Command{
+	Use:   "mv [task id] [from queue] [to queue]",
+	Short: "Moves an enqueued task to another queue",
+	Long: `Mv (asynqmon mv) will move an enqueued task from one queue to another.
+
+The command takes three arguments: the identifier of the task, the name of
+the queue the task is currently in, and the name of the destination queue.
+The task is pushed to the tail of the destination queue.
+Identifier for a task should be obtained by running "asynqmon ls enqueued:[queue name]" command.
+
+Example: asynqmon mv bnogo8gt6toe23vhef0g default low`,
+	Args: cobra.ExactArgs(3),
+	Run:  mv,
+}
+
+func init() {
+	rootCmd.AddCommand(mvCmd)
+}
+
+func mv(cmd *cobra.Command, args []string) {
+	id, err := xid.FromString(args[0])
+	if err != nil {
+		fmt.Println("invalid id")
+		os.Exit(1)
+	}
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	}), namespace)
+	if err := r.MoveEnqueuedTask(id, args[1], args[2]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully moved %v from %q queue to %q queue\n", args[0], args[1], args[2])
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// pauseCmd represents the pause command
+var pauseCmd = &cobra.Command{
+	Use:   "pause [queue name]",
+	Short: "Pauses the specified queue",
+	Long: `Pause (asynqmon pause) will pause the specified queue.
+Workers will stop processing tasks from a paused queue, but
+tasks can still be enqueued to it.
+
+If no argument is given, it will list all paused queues.
+
+The --all flag pauses all queues on every background instance
+(e.g., for maintenance), until it's undone with "asynqmon unpause --all".
+
+Example: asynqmon pause low -> Pauses "low" queue
+Example: asynqmon pause --all -> Pauses all queues`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  pause,
+}
+
+// unpauseCmd represents the unpause command
+var unpauseCmd = &cobra.Command{
+	Use:   "unpause [queue name]",
+	Short: "Resumes processing of the specified queue",
+	Long: `Unpause (asynqmon unpause) will resume processing of the specified paused queue.
+
+Example: asynqmon unpause low -> Unpauses "low" queue
+Example: asynqmon unpause --all -> Undoes "asynqmon pause --all"`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  unpause,
+}
+
+var pauseAll bool
+
+func init() {
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(unpauseCmd)
+	pauseCmd.Flags().BoolVarP(&pauseAll, "all", "a", false, "pause all queues")
+	unpauseCmd.Flags().BoolVarP(&pauseAll, "all", "a", false, "unpause all queues paused with --all")
+}
+
+func pause(cmd *cobra.Command, args []string) {
+	c := redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	})
+	r := rdb.NewRDBWithNamespace(c, namespace)
+	if pauseAll {
+		if err := r.PauseAll(); err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully paused all queues")
+		return
+	}
+	if len(args) == 0 {
+		paused, err := r.IsPausedAll()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if paused {
+			fmt.Println("All queues are paused (asynqmon unpause --all to resume)")
+		}
+		qnames, err := r.ListPausedQueues()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(qnames) == 0 {
+			fmt.Println("No paused queues")
+			return
+		}
+		for _, qname := range qnames {
+			fmt.Println(qname)
+		}
+		return
+	}
+	if err := r.PauseQueue(args[0]); err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully paused queue %q\n", args[0])
+}
+
+func unpause(cmd *cobra.Command, args []string) {
+	c := redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	})
+	r := rdb.NewRDBWithNamespace(c, namespace)
+	if pauseAll {
+		if err := r.UnpauseAll(); err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully unpaused all queues")
+		return
+	}
+	if len(args) == 0 {
+		fmt.Println("error: `asynqmon unpause` takes a queue name or --all flag")
+		os.Exit(1)
+	}
+	if err := r.UnpauseQueue(args[0]); err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully unpaused queue %q\n", args[0])
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// peekCmd represents the peek command
+var peekCmd = &cobra.Command{
+	Use:   "peek [queue name]",
+	Short: "Shows the task to be processed next from a queue",
+	Long: `Peek (asynqmon peek) will show all fields of the enqueued task which is
+processed next from the given queue, without removing the task from the queue.
+
+Example: asynqmon peek critical`,
+	Args: cobra.ExactArgs(1),
+	Run:  peek,
+}
+
+func init() {
+	rootCmd.AddCommand(peekCmd)
+}
+
+func peek(cmd *cobra.Command, args []string) {
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: readAddr(),
+		DB:   db,
+	}), namespace)
+	info, err := r.PeekPending(args[0])
+	if err == rdb.ErrQueueEmpty {
+		fmt.Printf("No enqueued tasks in %q queue\n", args[0])
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	printTaskInfo(info)
+}
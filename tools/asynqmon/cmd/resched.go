@@ -0,0 +1,61 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// reschedCmd represents the resched command
+var reschedCmd = &cobra.Command{
+	Use:   "resched [task id] [time]",
+	Short: "Changes the time to process a scheduled task",
+	Long: `Resched (asynqmon resched) will change the time to process a scheduled task.
+
+The command takes two arguments: the first specifies the task to reschedule and
+the second the new time to process the task in RFC3339 format.
+The task should be in scheduled queue.
+Identifier for a task should be obtained by running "asynqmon ls" command.
+
+Example: asynqmon resched s:1575732274:bnogo8gt6toe23vhef0g 2020-01-02T15:04:05Z`,
+	Args: cobra.ExactArgs(2),
+	Run:  resched,
+}
+
+func init() {
+	rootCmd.AddCommand(reschedCmd)
+}
+
+func resched(cmd *cobra.Command, args []string) {
+	id, score, qtype, err := parseQueryID(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if qtype != "s" {
+		fmt.Println("only scheduled tasks can be rescheduled")
+		os.Exit(1)
+	}
+	processAt, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		fmt.Printf("invalid time: %v\n", err)
+		os.Exit(1)
+	}
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: uri,
+		DB:   db,
+	}), namespace)
+	if err := r.RescheduleScheduledTask(id, score, processAt); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully rescheduled %v to %v\n", args[0], processAt)
+}
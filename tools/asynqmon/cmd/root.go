@@ -17,7 +17,9 @@ var cfgFile string
 
 // Flags
 var uri string
+var readURI string
 var db int
+var namespace string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -50,7 +52,21 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.asynqmon.yaml)")
 	rootCmd.PersistentFlags().StringVarP(&uri, "uri", "u", "127.0.0.1:6379", "Redis server URI")
+	rootCmd.PersistentFlags().StringVar(&readURI, "read-uri", "", "Redis server URI for the read-only commands, e.g. a replica (default is --uri)")
 	rootCmd.PersistentFlags().IntVarP(&db, "db", "n", 0, "Redis database number (default is 0)")
+	rootCmd.PersistentFlags().StringVar(&namespace, "namespace", "", "Namespace of the asynq keys (default is no namespace)")
+}
+
+// readAddr returns the address of the redis server to connect to for the
+// read-only commands (ls, show, stats, history and tail).
+//
+// Note: A replica may lag behind the primary, so the tasks and counts read
+// from it can be slightly stale.
+func readAddr() string {
+	if readURI != "" {
+		return readURI
+	}
+	return uri
 }
 
 // initConfig reads in config file and ENV variables if set.
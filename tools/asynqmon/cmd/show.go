@@ -0,0 +1,94 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/rs/xid"
+	"github.com/spf13/cobra"
+)
+
+// showCmd represents the show command
+var showCmd = &cobra.Command{
+	Use:   "show [task id]",
+	Short: "Shows the detail of a task given its ID",
+	Long: `Show (asynqmon show) will show the current state and all fields of a task
+given the ID of the task, looking for the task in every state
+(enqueued, inprogress, scheduled, retry and dead).
+
+The task is looked up in the queue specified with --queue option.
+
+Example: asynqmon show bnogo8gt6toe23vhef0g
+Example: asynqmon show --queue=critical bnogo8gt6toe23vhef0g`,
+	Args: cobra.ExactArgs(1),
+	Run:  show,
+}
+
+var showQueue string
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+	showCmd.Flags().StringVarP(&showQueue, "queue", "q", "default", "Queue of the task")
+}
+
+func show(cmd *cobra.Command, args []string) {
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: readAddr(),
+		DB:   db,
+	}), namespace)
+	id, err := xid.FromString(args[0])
+	if err != nil {
+		fmt.Println("invalid id")
+		os.Exit(1)
+	}
+	info, err := r.GetTaskInfo(showQueue, id)
+	if err == rdb.ErrTaskNotFound {
+		fmt.Printf("No task with id %v in %q queue\n", id, showQueue)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	printTaskInfo(info)
+}
+
+// printTaskInfo prints the state and all fields of the task.
+func printTaskInfo(info *rdb.TaskInfo) {
+	msg := info.Message
+	fmt.Printf("ID:         %v\n", msg.ID)
+	fmt.Printf("Type:       %s\n", msg.Type)
+	fmt.Printf("State:      %s\n", info.State)
+	fmt.Printf("Queue:      %s\n", msg.Queue)
+	fmt.Printf("Payload:    %v\n", info.Payload)
+	fmt.Printf("Priority:   %d\n", msg.Priority)
+	fmt.Printf("Retried:    %d/%d\n", msg.Retried, msg.Retry)
+	if msg.EnqueuedAt > 0 {
+		fmt.Printf("Enqueued:   %v\n", time.Unix(0, msg.EnqueuedAt).Format(time.RFC3339))
+	}
+	if msg.Timeout != "" {
+		fmt.Printf("Timeout:    %s\n", msg.Timeout)
+	}
+	if msg.DependsOn != "" {
+		fmt.Printf("Depends On: %s\n", msg.DependsOn)
+	}
+	if !info.ProcessAt.IsZero() {
+		fmt.Printf("Process At: %v\n", info.ProcessAt.Format(time.RFC3339))
+	}
+	if !info.LastFailedAt.IsZero() {
+		fmt.Printf("Failed At:  %v\n", info.LastFailedAt.Format(time.RFC3339))
+	}
+	if msg.ErrorMsg != "" {
+		fmt.Printf("Last Error: %s\n", msg.ErrorMsg)
+	}
+	for _, e := range msg.ErrorHistory {
+		fmt.Printf("            %s\n", e)
+	}
+}
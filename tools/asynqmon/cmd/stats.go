@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/hibiken/asynq/internal/rdb"
@@ -21,7 +22,8 @@ import (
 var statsCmd = &cobra.Command{
 	Use:   "stats",
 	Short: "Shows current state of the queues",
-	Long: `Stats (aysnqmon stats) will show the number of tasks in each queue at that instant.
+	Long: `Stats (aysnqmon stats) will show the number of tasks in each queue at that instant,
+and the time the oldest pending task of each queue has been waiting.
 It also displays basic information about the running redis instance.
 
 To monitor the queues continuously, it's recommended that you run this
@@ -48,10 +50,10 @@ func init() {
 
 func stats(cmd *cobra.Command, args []string) {
 	c := redis.NewClient(&redis.Options{
-		Addr: uri,
+		Addr: readAddr(),
 		DB:   db,
 	})
-	r := rdb.NewRDB(c)
+	r := rdb.NewRDBWithNamespace(c, namespace)
 
 	stats, err := r.CurrentStats()
 	if err != nil {
@@ -63,12 +65,34 @@ func stats(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	usage, err := r.MemoryUsage()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	latencies := make(map[string]time.Duration)
+	for qname := range stats.Queues {
+		d, err := r.QueueLatency(qname)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		latencies[qname] = d
+	}
 	fmt.Println("STATES")
 	printStates(stats)
 	fmt.Println()
 
+	if usage.Approximate {
+		fmt.Println("MEMORY USAGE (approximate)")
+	} else {
+		fmt.Println("MEMORY USAGE")
+	}
+	printMemoryUsage(usage)
+	fmt.Println()
+
 	fmt.Println("QUEUES")
-	printQueues(stats.Queues)
+	printQueues(stats.Queues, latencies)
 	fmt.Println()
 
 	fmt.Printf("STATS FOR %s UTC\n", stats.Timestamp.UTC().Format("2006-01-02"))
@@ -89,8 +113,34 @@ func printStates(s *rdb.Stats) {
 	tw.Flush()
 }
 
-func printQueues(queues map[string]int) {
-	var qnames, seps, counts []string
+func printMemoryUsage(u *rdb.MemoryUsage) {
+	format := strings.Repeat("%v\t", 5) + "\n"
+	tw := new(tabwriter.Writer).Init(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, format, "InProgress", "Enqueued", "Scheduled", "Retry", "Dead")
+	fmt.Fprintf(tw, format, "----------", "--------", "---------", "-----", "----")
+	fmt.Fprintf(tw, format, bytesHuman(u.InProgress), bytesHuman(u.Enqueued),
+		bytesHuman(u.Scheduled), bytesHuman(u.Retry), bytesHuman(u.Dead))
+	tw.Flush()
+}
+
+// bytesHuman returns a human readable representation of n bytes.
+func bytesHuman(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printQueues prints the number of pending tasks in each queue, and the
+// time the oldest of them has been waiting.
+func printQueues(queues map[string]int, latencies map[string]time.Duration) {
+	var qnames, seps, counts, ages []string
 	for q := range queues {
 		qnames = append(qnames, strings.Title(q))
 	}
@@ -98,12 +148,14 @@ func printQueues(queues map[string]int) {
 	for _, q := range qnames {
 		seps = append(seps, strings.Repeat("-", len(q)))
 		counts = append(counts, strconv.Itoa(queues[strings.ToLower(q)]))
+		ages = append(ages, latencies[strings.ToLower(q)].Round(time.Second).String())
 	}
 	format := strings.Repeat("%v\t", len(qnames)) + "\n"
 	tw := new(tabwriter.Writer).Init(os.Stdout, 0, 8, 2, ' ', 0)
 	fmt.Fprintf(tw, format, toInterfaceSlice(qnames)...)
 	fmt.Fprintf(tw, format, toInterfaceSlice(seps)...)
 	fmt.Fprintf(tw, format, toInterfaceSlice(counts)...)
+	fmt.Fprintf(tw, format, toInterfaceSlice(ages)...)
 	tw.Flush()
 }
 
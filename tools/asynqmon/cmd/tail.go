@@ -0,0 +1,60 @@
+// Copyright 2020 Kentaro Hibino. All rights reserved.
+// Use of this source code is governed by a MIT license
+// that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/hibiken/asynq/internal/rdb"
+	"github.com/spf13/cobra"
+)
+
+// tailCmd represents the tail command
+var tailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Streams the tasks sent to the dead queue in real time",
+	Long: `Tail (asynqmon tail) will print the tasks killed by the running background
+instances as they're sent to the dead queue, until interrupted.
+
+Tasks killed before the command starts are not printed; use "asynqmon ls dead"
+to list them.
+
+Example: asynqmon tail`,
+	Args: cobra.NoArgs,
+	Run:  tail,
+}
+
+func init() {
+	rootCmd.AddCommand(tailCmd)
+}
+
+func tail(cmd *cobra.Command, args []string) {
+	r := rdb.NewRDBWithNamespace(redis.NewClient(&redis.Options{
+		Addr: readAddr(),
+		DB:   db,
+	}), namespace)
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	ch, err := r.StreamDeadTasks(ctx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for info := range ch {
+		msg := info.Message
+		fmt.Printf("%v  %v  %s  %s  %v  %q\n", info.LastFailedAt.Format(time.RFC3339),
+			msg.ID, msg.Queue, msg.Type, info.Payload, msg.ErrorMsg)
+	}
+}